@@ -0,0 +1,244 @@
+// Package admin implements HTTP handlers for serving metrics and for
+// inspecting the discovery Manager.
+package admin
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/m-lab/gcp-service-discovery/discovery"
+)
+
+// ChecksumHeader is the response header of the targets endpoint with the hex
+// encoded SHA256 digest of the response body.
+const ChecksumHeader = "X-Checksum-Sha256"
+
+// NewServeMux creates a ServeMux that serves Prometheus metrics, pprof
+// profiles, and debug handlers for the given Manager.
+func NewServeMux(m *discovery.Manager) *http.ServeMux {
+	return NewServeMuxFor(m, prometheus.DefaultGatherer)
+}
+
+// NewServeMuxFor is like NewServeMux, but serves the metrics of g, e.g. the
+// registry given to discovery.WithRegisterer.
+func NewServeMuxFor(m *discovery.Manager, g prometheus.Gatherer) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	if g == prometheus.DefaultGatherer {
+		mux.Handle("/metrics", promhttp.Handler())
+	} else {
+		mux.Handle("/metrics", promhttp.HandlerFor(g, promhttp.HandlerOpts{}))
+	}
+	mux.Handle("/debug/explain", &explainHandler{manager: m})
+	mux.HandleFunc("/api/v1/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, m.Status())
+	})
+	mux.Handle("/api/v1/targets", &targetsHandler{manager: m})
+	mux.HandleFunc("/api/v1/digest", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, m.Digests())
+	})
+	mux.Handle("/api/v1/diff", &diffHandler{manager: m})
+	mux.HandleFunc("/api/v1/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		// Buffer the snapshot, so errors are reported with a status code.
+		buf := &bytes.Buffer{}
+		err := m.Snapshot(buf)
+		if err != nil {
+			http.Error(w, "Error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Write(buf.Bytes())
+	})
+	return mux
+}
+
+// HandleLifecycle registers the /-/reload, /-/pause, and /-/resume handlers,
+// which change the state of m, on mux. The handlers are not registered by
+// NewServeMux, since metrics are usually served to every client that may
+// scrape them.
+func HandleLifecycle(mux *http.ServeMux, m *discovery.Manager) {
+	mux.HandleFunc("/-/reload", func(w http.ResponseWriter, r *http.Request) {
+		if !allowUpdate(w, r, "reload") {
+			return
+		}
+		m.Reload()
+	})
+	mux.HandleFunc("/-/pause", func(w http.ResponseWriter, r *http.Request) {
+		if !allowUpdate(w, r, "pause") {
+			return
+		}
+		updateSource(w, m.Pause(sourceParam(r)))
+	})
+	mux.HandleFunc("/-/resume", func(w http.ResponseWriter, r *http.Request) {
+		if !allowUpdate(w, r, "resume") {
+			return
+		}
+		updateSource(w, m.Resume(sourceParam(r)))
+	})
+}
+
+// updateSource writes err of pausing or resuming a source to w. A source that
+// selects no registered service is not found.
+func updateSource(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, discovery.ErrUnknownSource):
+		http.Error(w, "Error: "+err.Error(), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, "Error: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// allowUpdate returns true if r may change state. Like Prometheus, only POST
+// and PUT requests are accepted. Otherwise, allowUpdate writes an error to w.
+func allowUpdate(w http.ResponseWriter, r *http.Request, action string) bool {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		w.Header().Set("Allow", "POST, PUT")
+		http.Error(w, "Error: "+action+" requires POST or PUT", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+// sourceParam returns the source parameter of r, e.g.
+//
+//	/-/pause?source=gke.Service
+//
+// or discovery.AllServices when it is missing.
+func sourceParam(r *http.Request) string {
+	if source := r.URL.Query().Get("source"); source != "" {
+		return source
+	}
+	return discovery.AllServices
+}
+
+// explainHandler reports which sources produced a target, e.g.
+//
+//	/debug/explain?target=1.2.3.4:9090
+type explainHandler struct {
+	manager *discovery.Manager
+}
+
+func (h *explainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "Error: specify a target parameter", http.StatusBadRequest)
+		return
+	}
+	result := h.manager.Explain(target)
+	if len(result) == 0 {
+		http.Error(w, "Error: target not found: "+target, http.StatusNotFound)
+		return
+	}
+	writeJSON(w, result)
+}
+
+// targetsHandler serves the targets most recently written to an output, in the
+// Prometheus HTTP SD format, e.g.
+//
+//	/api/v1/targets?output=/targets/aeflex.json
+type targetsHandler struct {
+	manager *discovery.Manager
+}
+
+func (h *targetsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	output := r.URL.Query().Get("output")
+	if output == "" {
+		http.Error(w, "Error: specify an output parameter", http.StatusBadRequest)
+		return
+	}
+	targets, ok := h.manager.Targets(output)
+	if !ok {
+		http.Error(w, "Error: no targets written to output: "+output, http.StatusNotFound)
+		return
+	}
+	data, err := discovery.MarshalTargets(targets)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sum := sha256.Sum256(data)
+	w.Header().Set(ChecksumHeader, hex.EncodeToString(sum[:]))
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// diffHandler reports the targets added and removed between two times, e.g.
+//
+//	/api/v1/diff?source=gke.Service&from=1h
+//
+// The source is a service name or an output, and defaults to every source.
+// Times are RFC 3339 timestamps, Unix timestamps, or durations before now. The
+// default is the last hour.
+type diffHandler struct {
+	manager *discovery.Manager
+}
+
+func (h *diffHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	from, err := timeParam(r, "from", now, now.Add(-time.Hour))
+	if err != nil {
+		http.Error(w, "Error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := timeParam(r, "to", now, now)
+	if err != nil {
+		http.Error(w, "Error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if to.Before(from) {
+		http.Error(w, "Error: to is before from", http.StatusBadRequest)
+		return
+	}
+	source := sourceParam(r)
+	result := h.manager.Changes(source, from, to)
+	if len(result) == 0 {
+		http.Error(w, "Error: no target history of source: "+source, http.StatusNotFound)
+		return
+	}
+	writeJSON(w, result)
+}
+
+// timeParam parses the named time parameter of r, or returns def when it is
+// missing. Durations are relative to now, e.g. "1h" is an hour ago.
+func timeParam(r *http.Request, name string, now, def time.Time) (time.Time, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if sec, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Unix(0, int64(sec*float64(time.Second))), nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid %s %q: want an RFC 3339 time, a Unix time, or a duration", name, value)
+}
+
+// writeJSON writes v to w as indented JSON.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,377 @@
+package admin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/m-lab/gcp-service-discovery/discovery"
+)
+
+type fakeService struct{}
+
+func (f *fakeService) Discover(ctx context.Context) ([]discovery.StaticConfig, error) {
+	config := discovery.StaticConfig{
+		Targets: []string{"1.2.3.4:9090"},
+		Labels:  map[string]string{"service": "fake"},
+	}
+	discovery.RecordOrigin(ctx, config, "fake-object")
+	return []discovery.StaticConfig{config}, nil
+}
+
+func newManager(t *testing.T) *discovery.Manager {
+	m := discovery.NewManager(discovery.WithTimeout(time.Minute))
+	m.Register(&fakeService{}, filepath.Join(t.TempDir(), "output.json"))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// Run returns after one pass since ctx is already canceled.
+	m.Run(ctx, time.Minute)
+	return m
+}
+
+func TestExplain(t *testing.T) {
+	m := newManager(t)
+	tests := []struct {
+		name string
+		url  string
+		code int
+	}{
+		{
+			name: "success",
+			url:  "/debug/explain?target=1.2.3.4:9090",
+			code: http.StatusOK,
+		},
+		{
+			name: "failure-missing-target",
+			url:  "/debug/explain",
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "failure-unknown-target",
+			url:  "/debug/explain?target=5.6.7.8:9090",
+			code: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			NewServeMux(m).ServeHTTP(rw, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			if rw.Code != tt.code {
+				t.Fatalf("explain code = %d, want %d", rw.Code, tt.code)
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+			var got []discovery.Explanation
+			err := json.Unmarshal(rw.Body.Bytes(), &got)
+			if err != nil {
+				t.Fatalf("json.Unmarshal() error = %v", err)
+			}
+			if len(got) != 1 || got[0].Object != "fake-object" || got[0].Source != "admin.fakeService" {
+				t.Errorf("explain = %#v, want one explanation from admin.fakeService", got)
+			}
+			if got[0].LabelsBefore["service"] != "fake" || got[0].LabelsAfter["service"] != "fake" {
+				t.Errorf("explain labels = %#v, want service=fake", got[0])
+			}
+		})
+	}
+}
+
+func TestStatus(t *testing.T) {
+	m := newManager(t)
+	rw := httptest.NewRecorder()
+	NewServeMux(m).ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/api/v1/status", nil))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("status code = %d, want %d", rw.Code, http.StatusOK)
+	}
+	var got []discovery.Status
+	err := json.Unmarshal(rw.Body.Bytes(), &got)
+	if err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	if len(got) != 1 || got[0].Health != discovery.HealthOK || got[0].Targets != 1 {
+		t.Errorf("status = %#v, want one ok source with 1 target", got)
+	}
+}
+
+func TestReload(t *testing.T) {
+	m := newManager(t)
+	tests := []struct {
+		name     string
+		method   string
+		code     int
+		disabled bool
+	}{
+		{
+			name:   "success",
+			method: http.MethodPost,
+			code:   http.StatusOK,
+		},
+		{
+			name:   "failure-get",
+			method: http.MethodGet,
+			code:   http.StatusMethodNotAllowed,
+		},
+		{
+			name:     "failure-disabled",
+			method:   http.MethodPost,
+			code:     http.StatusNotFound,
+			disabled: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := NewServeMux(m)
+			if !tt.disabled {
+				HandleLifecycle(mux, m)
+			}
+			rw := httptest.NewRecorder()
+			mux.ServeHTTP(rw, httptest.NewRequest(tt.method, "/-/reload", nil))
+			if rw.Code != tt.code {
+				t.Errorf("reload code = %d, want %d", rw.Code, tt.code)
+			}
+		})
+	}
+}
+
+func TestPause(t *testing.T) {
+	m := newManager(t)
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		code   int
+		want   []string
+	}{
+		{
+			name:   "success-pause-source",
+			method: http.MethodPost,
+			url:    "/-/pause?source=admin.fakeService",
+			code:   http.StatusOK,
+			want:   []string{"admin.fakeService"},
+		},
+		{
+			name:   "success-pause-all",
+			method: http.MethodPut,
+			url:    "/-/pause",
+			code:   http.StatusOK,
+			want:   []string{discovery.AllServices, "admin.fakeService"},
+		},
+		{
+			name:   "failure-pause-unknown",
+			method: http.MethodPost,
+			url:    "/-/pause?source=gke.Service",
+			code:   http.StatusNotFound,
+			want:   []string{discovery.AllServices, "admin.fakeService"},
+		},
+		{
+			name:   "success-resume-source",
+			method: http.MethodPost,
+			url:    "/-/resume?source=admin.fakeService",
+			code:   http.StatusOK,
+			want:   []string{discovery.AllServices},
+		},
+		{
+			name:   "failure-get",
+			method: http.MethodGet,
+			url:    "/-/resume",
+			code:   http.StatusMethodNotAllowed,
+			want:   []string{discovery.AllServices},
+		},
+		{
+			name:   "success-resume-all",
+			method: http.MethodPost,
+			url:    "/-/resume",
+			code:   http.StatusOK,
+			want:   []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := NewServeMux(m)
+			HandleLifecycle(mux, m)
+			rw := httptest.NewRecorder()
+			mux.ServeHTTP(rw, httptest.NewRequest(tt.method, tt.url, nil))
+			if rw.Code != tt.code {
+				t.Errorf("pause code = %d, want %d", rw.Code, tt.code)
+			}
+			if got := m.Paused(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Manager.Paused() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	m := newManager(t)
+	rw := httptest.NewRecorder()
+	NewServeMux(m).ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/api/v1/snapshot", nil))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("snapshot code = %d, want %d", rw.Code, http.StatusOK)
+	}
+	if ct := rw.Header().Get("Content-Type"); ct != "application/gzip" {
+		t.Errorf("snapshot Content-Type = %q, want application/gzip", ct)
+	}
+	if err := m.Restore(rw.Body); err != nil {
+		t.Errorf("Manager.Restore() error = %v", err)
+	}
+}
+
+func TestTargets(t *testing.T) {
+	m := newManager(t)
+	output := m.Status()[0].Output
+	tests := []struct {
+		name     string
+		url      string
+		wantCode int
+	}{
+		{
+			name:     "success",
+			url:      "/api/v1/targets?output=" + output,
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "failure-missing-output",
+			url:      "/api/v1/targets",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "failure-unknown-output",
+			url:      "/api/v1/targets?output=other.json",
+			wantCode: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			NewServeMux(m).ServeHTTP(rw, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			if rw.Code != tt.wantCode {
+				t.Fatalf("targets code = %d, want %d", rw.Code, tt.wantCode)
+			}
+			if rw.Code != http.StatusOK {
+				return
+			}
+			sum := sha256.Sum256(rw.Body.Bytes())
+			if got := rw.Header().Get(ChecksumHeader); got != hex.EncodeToString(sum[:]) {
+				t.Errorf("targets checksum = %q, want checksum of body", got)
+			}
+			configs := []discovery.StaticConfig{}
+			if err := json.Unmarshal(rw.Body.Bytes(), &configs); err != nil || len(configs) != 1 {
+				t.Errorf("targets = %s, %v; want 1 config", rw.Body.String(), err)
+			}
+		})
+	}
+}
+
+func TestDigest(t *testing.T) {
+	m := newManager(t)
+	output := m.Status()[0].Output
+	mux := NewServeMux(m)
+	rw := httptest.NewRecorder()
+	mux.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/api/v1/digest", nil))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("digest code = %d, want %d", rw.Code, http.StatusOK)
+	}
+	digests := map[string]string{}
+	if err := json.Unmarshal(rw.Body.Bytes(), &digests); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	// The digest matches the checksum of the targets.
+	rw = httptest.NewRecorder()
+	mux.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/api/v1/targets?output="+output, nil))
+	want := map[string]string{output: rw.Header().Get(ChecksumHeader)}
+	if !reflect.DeepEqual(digests, want) {
+		t.Errorf("digest = %v, want %v", digests, want)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	m := discovery.NewManager(discovery.WithTimeout(time.Minute), discovery.WithTimeline(10, ""))
+	m.Register(&fakeService{}, filepath.Join(t.TempDir(), "output.json"))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m.Run(ctx, time.Minute)
+	tests := []struct {
+		name     string
+		url      string
+		wantCode int
+	}{
+		{
+			name:     "success",
+			url:      "/api/v1/diff?source=admin.fakeService&from=2000-01-01T00:00:00Z",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "success-unix-times",
+			url:      "/api/v1/diff?from=946684800&to=" + strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10),
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "failure-invalid-time",
+			url:      "/api/v1/diff?from=yesterday",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "failure-reversed",
+			url:      "/api/v1/diff?from=1m&to=2m",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "failure-unknown-source",
+			url:      "/api/v1/diff?source=gke.Service",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "failure-before-history",
+			url:      "/api/v1/diff?to=1h",
+			wantCode: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			NewServeMux(m).ServeHTTP(rw, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			if rw.Code != tt.wantCode {
+				t.Fatalf("diff code = %d, want %d: %s", rw.Code, tt.wantCode, rw.Body)
+			}
+			if rw.Code != http.StatusOK {
+				return
+			}
+			var got []discovery.TimelineDiff
+			if err := json.Unmarshal(rw.Body.Bytes(), &got); err != nil {
+				t.Fatalf("json.Unmarshal() error = %v", err)
+			}
+			// The first pass is the oldest change, so nothing changed since.
+			if len(got) != 1 || got[0].Source != "admin.fakeService" || !got[0].Empty() {
+				t.Errorf("diff = %+v, want no changes of admin.fakeService", got)
+			}
+		})
+	}
+}
+
+func TestNewServeMuxFor(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "gcp_admin_test", Help: "Test gauge."}))
+	rw := httptest.NewRecorder()
+	NewServeMuxFor(newManager(t), reg).ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("metrics code = %d, want %d", rw.Code, http.StatusOK)
+	}
+	if !strings.Contains(rw.Body.String(), "gcp_admin_test 0") {
+		t.Errorf("metrics = %q, want gcp_admin_test", rw.Body.String())
+	}
+	if strings.Contains(rw.Body.String(), "go_goroutines") {
+		t.Errorf("metrics include the default gatherer")
+	}
+}
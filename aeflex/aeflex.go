@@ -5,28 +5,33 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
-
 	"github.com/m-lab/gcp-service-discovery/aeflex/iface"
+	"github.com/m-lab/gcp-service-discovery/apilimit"
+	"github.com/m-lab/gcp-service-discovery/credentials"
 	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/gce"
+	"github.com/m-lab/gcp-service-discovery/internal/apicall"
+	"github.com/m-lab/gcp-service-discovery/metrics"
 	appengine "google.golang.org/api/appengine/v1"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 const (
 	aefLabel             = "__aef_"
 	aefLabelProject      = aefLabel + "project"
+	aefLabelLocation     = aefLabel + "location"
 	aefLabelService      = aefLabel + "service"
 	aefLabelVersion      = aefLabel + "version"
 	aefLabelInstance     = aefLabel + "instance"
+	aefLabelVMIP         = aefLabel + "vm_ip"
 	aefLabelPublicProto  = aefLabel + "public_protocol"
+	aefLabelPort         = aefLabel + "port"
+	aefLabelPortIndex    = aefLabel + "port_index"
 	aefMaxTotalInstances = aefLabel + "max_total_instances"
 	aefVMDebugEnabled    = aefLabel + "vm_debug_enabled"
 )
@@ -45,7 +50,7 @@ var (
 	//   gcp_aeflex_services
 	// Example usage:
 	//   ServiceCount.Set(count)
-	ServiceCount = promauto.NewGauge(
+	ServiceCount = metrics.NewGauge(
 		prometheus.GaugeOpts{
 			Name: "gcp_aeflex_services",
 			Help: "Number of active AEFlex services.",
@@ -58,7 +63,7 @@ var (
 	//   gcp_aeflex_versions{service="etl-batch-parser"}
 	// Example usage:
 	//   VersionCount.WithLabelValues("etl-batch-parser").Set(count)
-	VersionCount = promauto.NewGaugeVec(
+	VersionCount = metrics.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "gcp_aeflex_versions",
 			Help: "Total number of versions.",
@@ -72,7 +77,7 @@ var (
 	//   gcp_aeflex_instances{service="etl-batch-parser", serving="true"}
 	// Example usage:
 	//   InstanceCount.WithLabelValues("etl-batch-parser", "true").Set(count)
-	InstanceCount = promauto.NewGaugeVec(
+	InstanceCount = metrics.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "gcp_aeflex_instances",
 			Help: "Total number of running serving instances.",
@@ -81,74 +86,207 @@ var (
 	)
 )
 
+// InstanceKey selects the labels that identify the instance of a target.
+// InstanceKey implements the flag.Value interface.
+type InstanceKey string
+
+// Supported instance keys.
+const (
+	// KeyID labels targets with the App Engine instance ID, which changes
+	// whenever an instance is recreated, e.g. during autoscaling.
+	KeyID InstanceKey = "id"
+
+	// KeyIP labels targets with the VM IP instead of the instance ID, so
+	// series are kept while the VM keeps its address.
+	KeyIP InstanceKey = "ip"
+
+	// KeyBoth labels targets with both the instance ID and the VM IP.
+	KeyBoth InstanceKey = "both"
+)
+
+// String returns the key name.
+func (k InstanceKey) String() string {
+	return string(k)
+}
+
+// Set parses a key name.
+func (k *InstanceKey) Set(value string) error {
+	switch v := InstanceKey(strings.ToLower(value)); v {
+	case KeyID, KeyIP, KeyBoth:
+		*k = v
+		return nil
+	}
+	return fmt.Errorf("unknown instance key %q: want %q, %q, or %q", value, KeyID, KeyIP, KeyBoth)
+}
+
 // Service caches information collected from the App Engine Admin API during target discovery.
 type Service struct {
-	project string
+	// apps are the App Engine applications discovered by the Service.
+	apps []*application
+
+	// connect creates the App Engine Admin API clients of apps. It is called
+	// again to recreate the clients after an authentication error.
+	connect func(ctx context.Context) error
 
 	// targets collects found targets.
 	targets []discovery.StaticConfig
 
+	// byAddress maps the addresses of found targets to their index in targets
+	// and instance start time, to collapse duplicate addresses.
+	byAddress map[string]found
+
+	// InstanceKey selects the labels that identify the instance of a target.
+	// The zero value is equivalent to KeyID.
+	InstanceKey InstanceKey
+
+	// CollapseIPs keeps only the most recently started instance when more
+	// than one instance has the same address, e.g. while App Engine replaces
+	// an instance on the same VM, so a target never appears twice.
+	CollapseIPs bool
+
+	// ReadyLabel adds the discovery.LabelReady label to every target, which is
+	// "true" when App Engine reports the instance VM as healthy.
+	ReadyLabel bool
+}
+
+// found is a target found by the current discovery.
+type found struct {
+	object  string
+	index   int
+	started time.Time
+}
+
+// application is an App Engine application and the client used to read it.
+type application struct {
+	id  string
 	api iface.AppAPI
+
+	// location is the location ID of the application, e.g. "us-central", read
+	// during the first discovery.
+	location string
 }
 
-// NewService returns a Service initialized with authenticated clients for
-// App Engine Admin API. The Service implements the discovery.Service interface.
-func NewService(project string) (*Service, error) {
-	source := &Service{
-		project: project,
+// NewService returns a Service initialized with clients for the App Engine
+// Admin API authenticated by creds. The Service implements the
+// discovery.Service interface. The Service discovers the application of
+// project, or the applications with the given IDs, e.g. "example.com:app" for
+// domain-scoped projects, or the applications of other projects in other
+// regions. NewService fails if the credentials are not found before ctx is
+// done.
+func NewService(ctx context.Context, project string, creds credentials.Config, appIDs ...string) (*Service, error) {
+	source := &Service{}
+	if len(appIDs) == 0 {
+		appIDs = []string{project}
 	}
-	// Create a new authenticated HTTP client.
-	client, err := google.DefaultClient(oauth2.NoContext, defaultScopes...)
-	if err != nil {
-		return nil, fmt.Errorf("Error setting up AppEngine client: %s", err)
+	for _, id := range appIDs {
+		source.apps = append(source.apps, &application{id: id})
 	}
-	// Create a new AppEngine service instance.
-	aec, err := newAppengineClient(client)
-	if err != nil {
-		return nil, fmt.Errorf("Error setting up AppEngine client: %s", err)
+	source.connect = func(ctx context.Context) error {
+		// Create a new authenticated HTTP client.
+		client, err := creds.Client(ctx, defaultScopes...)
+		if err != nil {
+			return fmt.Errorf("Error setting up AppEngine client: %s", err)
+		}
+		// Create a new AppEngine service instance.
+		aec, err := newAppengineClient(apilimit.Client(client))
+		if err != nil {
+			return fmt.Errorf("Error setting up AppEngine client: %s", err)
+		}
+		for _, app := range source.apps {
+			app.api = iface.NewAppAPI(app.id, aec)
+		}
+		return nil
+	}
+	if err := source.connect(ctx); err != nil {
+		return nil, err
 	}
-	source.api = iface.NewAppAPI(source.project, aec)
 	return source, nil
 }
 
 // Discover contacts the App Engine Admin API to to check every service, and
 // every serving version. Collect saves every AppEngine Flexible Environments
-// VMs that is in a RUNNING and SERVING state.
+// VMs that is in a RUNNING and SERVING state. After an authentication error,
+// Discover recreates its clients and tries once more.
 func (source *Service) Discover(ctx context.Context) ([]discovery.StaticConfig, error) {
+	var targets []discovery.StaticConfig
+	err := credentials.Retry(ctx, "aeflex", source.connect, func() error {
+		var err error
+		targets, err = source.discover(ctx)
+		return err
+	})
+	return targets, err
+}
+
+// discover checks every application once.
+func (source *Service) discover(ctx context.Context) ([]discovery.StaticConfig, error) {
 	// List all services.
 	services := 0
 	source.targets = []discovery.StaticConfig{}
-	err := source.api.ServicesPages(
+	source.byAddress = map[string]found{}
+	var err error
+	for _, app := range source.apps {
+		if err = source.discoverApp(ctx, app, &services); err != nil {
+			break
+		}
+	}
+	ServiceCount.Set(float64(services))
+	if err != nil {
+		return nil, err
+	}
+	// TODO(p2, soltesz): consider using goroutines to speed up collection.
+	return source.targets, nil
+}
+
+// discoverApp checks every service of the application, and counts them.
+func (source *Service) discoverApp(ctx context.Context, app *application, services *int) error {
+	if app.location == "" {
+		// The location of an application never changes.
+		a, err := app.api.AppGet(ctx)
+		if err != nil {
+			return fmt.Errorf("cannot read App Engine application %q: %w", app.id, err)
+		}
+		app.location = a.LocationId
+	}
+	return app.api.ServicesPages(
 		ctx, func(listSvc *appengine.ListServicesResponse) error {
-			services += len(listSvc.Services)
+			*services += len(listSvc.Services)
+			discovery.CountScanned(ctx, "services", len(listSvc.Services))
 			for _, service := range listSvc.Services {
-				err := source.discoverVersions(ctx, service)
+				err := source.discoverVersions(ctx, app, service)
 				if err != nil {
 					return err
 				}
 			}
 			return nil
 		})
-	ServiceCount.Set(float64(services))
-	if err != nil {
-		return nil, err
+}
+
+// Check verifies access to the App Engine Admin API by reading the first page
+// of services of every application. Check implements the discovery.Checker
+// interface.
+func (source *Service) Check(ctx context.Context) error {
+	for _, app := range source.apps {
+		err := apicall.FirstPage(ctx, app.api.ServicesPages)
+		if err != nil {
+			return fmt.Errorf("cannot list App Engine services in project %q; "+
+				"verify the App Engine Admin API is enabled and the credentials "+
+				"have the App Engine Viewer role: %s", app.id, err)
+		}
 	}
-	// TODO(p2, soltesz): collect and report metrics about number of API calls.
-	// TODO(p2, soltesz): consider using goroutines to speed up collection.
-	return source.targets, nil
+	return nil
 }
 
-func (source *Service) discoverVersions(ctx context.Context, service *appengine.Service) error {
+func (source *Service) discoverVersions(ctx context.Context, app *application, service *appengine.Service) error {
 	// List all versions of each service.
 	versions := 0
 	active := 0
 	inactive := 0
-	err := source.api.VersionsPages(
+	err := app.api.VersionsPages(
 		ctx, service.Id, func(listVer *appengine.ListVersionsResponse) error {
 			versions += len(listVer.Versions)
-			return source.handleVersions(ctx, listVer, service, &active, &inactive)
+			discovery.CountScanned(ctx, "versions", len(listVer.Versions))
+			return source.handleVersions(ctx, app, listVer, service, &active, &inactive)
 		})
-	log.Println(service.Name, "versions:", versions, "active:", active, "inactive:", inactive)
 	VersionCount.WithLabelValues(service.Id).Set(float64(versions))
 	InstanceCount.WithLabelValues(service.Id, "true").Set(float64(active))
 	InstanceCount.WithLabelValues(service.Id, "false").Set(float64(inactive))
@@ -157,18 +295,21 @@ func (source *Service) discoverVersions(ctx context.Context, service *appengine.
 
 // handleVersions checks every instance for each AppEngine version.
 func (source *Service) handleVersions(
-	ctx context.Context, listVer *appengine.ListVersionsResponse,
+	ctx context.Context, app *application, listVer *appengine.ListVersionsResponse,
 	service *appengine.Service, active *int, inactive *int) error {
 
 	for _, version := range listVer.Versions {
+		object := service.Id + "/" + version.Id
 		// We can only monitor instances that are running.
 		if version.ServingStatus != "SERVING" {
+			discovery.Decide(ctx, object, false, "version not serving")
 			continue
 		}
 
 		created, err := time.Parse(time.RFC3339, version.CreateTime)
 		if err != nil {
 			log.Println("Failed to parse version.CreateTime:", version.CreateTime)
+			discovery.Decide(ctx, object, false, "invalid version create time")
 			continue
 		}
 
@@ -183,9 +324,10 @@ func (source *Service) handleVersions(
 		_, shouldMonitor := service.Split.Allocations[version.Id]
 
 		// List instances associated with each service version.
-		err = source.api.InstancesPages(
+		err = app.api.InstancesPages(
 			ctx, service.Id, version.Id, func(listInst *appengine.ListInstancesResponse) error {
-				found, err := source.handleInstances(listInst, service, version, shouldMonitor)
+				discovery.CountScanned(ctx, "instances", len(listInst.Instances))
+				found, err := source.handleInstances(ctx, app, listInst, service, version, shouldMonitor)
 				if shouldMonitor || shouldMonitorBeforeServing {
 					*active += found
 				} else {
@@ -206,44 +348,92 @@ func (source *Service) handleVersions(
 // is helpful for situations where we want to count running instances without
 // monitoring them.
 func (source *Service) handleInstances(
-	listInst *appengine.ListInstancesResponse, service *appengine.Service,
-	version *appengine.Version, shouldMonitor bool) (int, error) {
+	ctx context.Context, app *application, listInst *appengine.ListInstancesResponse,
+	service *appengine.Service, version *appengine.Version,
+	shouldMonitor bool) (int, error) {
 	found := 0
 	for _, instance := range listInst.Instances {
+		object := service.Id + "/" + version.Id + "/" + instance.Id
 		// Only flex instances have a VmIp.
 		if instance.VmIp == "" {
 			// Ignore standard instances.
+			discovery.Decide(ctx, object, false, "no vm ip")
 			continue
 		}
 		if instance.VmStatus != "RUNNING" {
+			discovery.Decide(ctx, object, false, "vm not running")
 			continue
 		}
 		// Ignore instances without networks or forwarded ports.
-		if version.Network == nil {
-			continue
-		}
-		if len(version.Network.ForwardedPorts) == 0 {
+		if version.Network == nil || len(version.Network.ForwardedPorts) == 0 {
+			discovery.Decide(ctx, object, false, "no forwarded ports")
 			continue
 		}
 		found++
 		if shouldMonitor {
-			source.targets = append(
-				source.targets,
-				source.getLabels(service, version, instance))
+			config := source.getLabels(app, service, version, instance, 0)
+			discovery.RecordOrigin(ctx, config, map[string]interface{}{
+				"service":  service.Id,
+				"version":  version.Id,
+				"instance": instance,
+			})
+			if instance.VmLiveness == "DRAINING" {
+				discovery.RecordLifecycle(ctx, config, discovery.LifecycleDraining, "instance "+instance.Id+" DRAINING")
+			}
+			source.addTarget(ctx, object, instance, config)
+		} else {
+			discovery.Decide(ctx, object, false, "no traffic allocation")
 		}
 	}
 	return found, nil
 }
 
+// addTarget adds the target configuration of instance. With CollapseIPs, a
+// target with the address of a previously found target replaces it only if
+// the instance started later.
+func (source *Service) addTarget(
+	ctx context.Context, object string, instance *appengine.Instance, config discovery.StaticConfig) {
+	if !source.CollapseIPs {
+		discovery.Decide(ctx, object, true, "serving")
+		source.targets = append(source.targets, config)
+		return
+	}
+	// StartTime is empty for instances that are starting, which are newest.
+	started, err := time.Parse(time.RFC3339, instance.StartTime)
+	if err != nil {
+		started = time.Now().UTC()
+	}
+	addr := config.Targets[0]
+	prev, ok := source.byAddress[addr]
+	if !ok {
+		discovery.Decide(ctx, object, true, "serving")
+		source.byAddress[addr] = found{object: object, index: len(source.targets), started: started}
+		source.targets = append(source.targets, config)
+		return
+	}
+	if !started.After(prev.started) {
+		discovery.Decide(ctx, object, false, "duplicate address of "+prev.object)
+		return
+	}
+	discovery.Decide(ctx, prev.object, false, "duplicate address of "+object)
+	discovery.Decide(ctx, object, true, "serving")
+	source.byAddress[addr] = found{object: object, index: prev.index, started: started}
+	source.targets[prev.index] = config
+}
+
 // getLabels creates a target configuration for a prometheus service discovery
-// file. The given service version should have a "SERVING" status, the instance
-// should be in a "RUNNING" state and have at least one forwarded port.
+// file, for the forwarded port of the version with the given index. The given
+// service version should have a "SERVING" status, the instance should be in a
+// "RUNNING" state and have at least index+1 forwarded ports.
 //
 // In serialized form, the label set look like:
 //   {
 //       "labels": {
 //           "__aef_instance": "aef-etl--parser-20170418t195100-abcd",
+//           "__aef_location": "us-central",
 //           "__aef_max_total_instances": "20",
+//           "__aef_port": "9090",
+//           "__aef_port_index": "0",
 //           "__aef_project": "mlab-sandbox",
 //           "__aef_public_protocol": "tcp",
 //           "__aef_service": "etl-parser",
@@ -255,8 +445,8 @@ func (source *Service) handleInstances(
 //       ]
 //   }
 func (source *Service) getLabels(
-	service *appengine.Service, version *appengine.Version,
-	instance *appengine.Instance) discovery.StaticConfig {
+	app *application, service *appengine.Service, version *appengine.Version,
+	instance *appengine.Instance, index int) discovery.StaticConfig {
 	var instances int64
 	if version.AutomaticScaling != nil {
 		instances = version.AutomaticScaling.MaxTotalInstances
@@ -264,19 +454,31 @@ func (source *Service) getLabels(
 		instances = version.ManualScaling.Instances
 	}
 	labels := map[string]string{
-		aefLabelProject:      source.project,
+		aefLabelProject:      app.id,
+		aefLabelLocation:     app.location,
 		aefLabelService:      service.Id,
 		aefLabelVersion:      version.Id,
-		aefLabelInstance:     instance.Id,
 		aefMaxTotalInstances: fmt.Sprintf("%d", instances),
 		aefVMDebugEnabled:    fmt.Sprintf("%t", instance.VmDebugEnabled),
 	}
-	if strings.HasSuffix(version.Network.ForwardedPorts[0], "/udp") {
-		labels[aefLabelPublicProto] = "udp"
-	} else if strings.HasSuffix(version.Network.ForwardedPorts[0], "/tcp") {
-		labels[aefLabelPublicProto] = "tcp"
-	} else {
-		labels[aefLabelPublicProto] = "both"
+	if source.InstanceKey != KeyIP {
+		labels[aefLabelInstance] = instance.Id
+	}
+	if source.InstanceKey == KeyIP || source.InstanceKey == KeyBoth {
+		labels[aefLabelVMIP] = instance.VmIp
+	}
+	port, protocol := forwardedPort(version.Network.ForwardedPorts[index])
+	labels[aefLabelPort] = port
+	labels[aefLabelPortIndex] = strconv.Itoa(index)
+	labels[aefLabelPublicProto] = protocol
+	if source.ReadyLabel {
+		labels[discovery.LabelReady] = fmt.Sprintf("%t", instance.VmLiveness == "HEALTHY")
+	}
+	// Identify the VM, so gce.Enricher can add its metadata.
+	if instance.VmName != "" && instance.VmZoneName != "" {
+		labels[gce.LabelProject] = app.id
+		labels[gce.LabelInstance] = instance.VmName
+		labels[gce.LabelZone] = instance.VmZoneName
 	}
 
 	// TODO(dev): collect max resource sizes: cpu, memory, disk.
@@ -288,10 +490,7 @@ func (source *Service) getLabels(
 	//   Resources.Volumes[0].VolumeType
 
 	// TODO: do we need to support multiple forwarded ports? How to choose?
-	// Extract target address in the form of the VM public IP and forwarded port.
-	re := regexp.MustCompile("([0-9]+)(/.*)")
-	port := re.ReplaceAllString(version.Network.ForwardedPorts[0], "$1")
-
+	// The target address is the VM public IP and the forwarded port.
 	values := discovery.StaticConfig{
 		Targets: []string{fmt.Sprintf("%s:%s", instance.VmIp, port)},
 		// Construct a record for the Prometheus file service discovery format.
@@ -300,3 +499,20 @@ func (source *Service) getLabels(
 	}
 	return values
 }
+
+// forwardedPort parses a forwarded port of an App Engine Flex network, like
+// "9090", "9090/tcp", or "8080:9090/udp", and returns the public port of the
+// VM and its protocol: "tcp", "udp", or "both" when no protocol is given.
+func forwardedPort(spec string) (string, string) {
+	protocol := "both"
+	if strings.HasSuffix(spec, "/udp") {
+		protocol = "udp"
+	} else if strings.HasSuffix(spec, "/tcp") {
+		protocol = "tcp"
+	}
+	port, _, _ := strings.Cut(spec, "/")
+	// A mapping like "8080:9090" forwards public port 8080 to container port
+	// 9090.
+	port, _, _ = strings.Cut(port, ":")
+	return port, protocol
+}
@@ -2,19 +2,26 @@ package aeflex
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/m-lab/gcp-service-discovery/aeflex/iface"
+	"github.com/m-lab/gcp-service-discovery/credentials"
 	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/internal/schematest"
 	"github.com/m-lab/go/prometheusx/promtest"
 	appengine "google.golang.org/api/appengine/v1"
 )
 
 type fakeAppAPIImpl struct {
+	appError       error
+	appCalls       int
 	services       []*appengine.Service
 	versions       []*appengine.Version
 	instances      []*appengine.Instance
@@ -23,6 +30,14 @@ type fakeAppAPIImpl struct {
 	instancesError error
 }
 
+func (api *fakeAppAPIImpl) AppGet(ctx context.Context) (*appengine.Application, error) {
+	api.appCalls++
+	if api.appError != nil {
+		return nil, api.appError
+	}
+	return &appengine.Application{Id: "fake-project", LocationId: "us-central"}, nil
+}
+
 func (api *fakeAppAPIImpl) ServicesPages(
 	ctx context.Context, f func(listVer *appengine.ListServicesResponse) error) error {
 	if api.servicesError != nil {
@@ -206,16 +221,17 @@ func TestService_Discover(t *testing.T) {
 		},
 		instances: []*appengine.Instance{
 			{
-				Id:       "aef-etl--sidestream--parser-20181027t210126-x2qh",
-				VmIp:     "192.168.0.2",
-				VmStatus: "RUNNING",
+				Id:         "aef-etl--sidestream--parser-20181027t210126-x2qh",
+				VmIp:       "192.168.0.2",
+				VmStatus:   "RUNNING",
+				VmName:     "aef-etl--sidestream--parser-20181027t210126-x2qh",
+				VmZoneName: "us-central1-b",
 			},
 		},
 	}
 
 	tests := []struct {
 		name    string
-		project string
 		targets []discovery.StaticConfig
 		api     iface.AppAPI
 		ctx     context.Context
@@ -224,20 +240,21 @@ func TestService_Discover(t *testing.T) {
 	}{
 		{
 			name:    "failure-to-list-instances",
-			project: "fake-project",
 			api:     failureToListInstances,
 			wantErr: true,
 		},
 		{
-			name:    "success-manual-scaling-udp-port",
-			project: "fake-project",
-			api:     successManualScalingUDPPort,
+			name: "success-manual-scaling-udp-port",
+			api:  successManualScalingUDPPort,
 			want: []discovery.StaticConfig{
 				{
 					Targets: []string{"192.168.0.2:9090"},
 					Labels: map[string]string{
 						"__aef_public_protocol":     "udp",
+						"__aef_port":                "9090",
+						"__aef_port_index":          "0",
 						"__aef_project":             "fake-project",
+						"__aef_location":            "us-central",
 						"__aef_service":             "fake-service-name",
 						"__aef_version":             "20181027t210126-active",
 						"__aef_instance":            "aef-etl--sidestream--parser-20181027t210126-x2qh",
@@ -248,15 +265,17 @@ func TestService_Discover(t *testing.T) {
 			},
 		},
 		{
-			name:    "success-automatic-scaling-tcp-and-udp",
-			project: "fake-project",
-			api:     successAutomaticScalingTCPAndUDP,
+			name: "success-automatic-scaling-tcp-and-udp",
+			api:  successAutomaticScalingTCPAndUDP,
 			want: []discovery.StaticConfig{
 				{
 					Targets: []string{"192.168.0.2:9090"},
 					Labels: map[string]string{
 						"__aef_public_protocol":     "both",
+						"__aef_port":                "9090",
+						"__aef_port_index":          "0",
 						"__aef_project":             "fake-project",
+						"__aef_location":            "us-central",
 						"__aef_service":             "fake-service-name",
 						"__aef_version":             "20181027t210126-active",
 						"__aef_instance":            "aef-etl--sidestream--parser-20181027t210126-x2qh",
@@ -267,15 +286,20 @@ func TestService_Discover(t *testing.T) {
 			},
 		},
 		{
-			name:    "success-automatic-scaling-tcp-port",
-			project: "fake-project",
-			api:     successAutomaticScalingTCPPort,
+			name: "success-automatic-scaling-tcp-port",
+			api:  successAutomaticScalingTCPPort,
 			want: []discovery.StaticConfig{
 				{
 					Targets: []string{"192.168.0.2:9090"},
 					Labels: map[string]string{
+						"__gce_project":             "fake-project",
+						"__gce_instance":            "aef-etl--sidestream--parser-20181027t210126-x2qh",
+						"__gce_zone":                "us-central1-b",
 						"__aef_public_protocol":     "tcp",
+						"__aef_port":                "9090",
+						"__aef_port_index":          "0",
 						"__aef_project":             "fake-project",
+						"__aef_location":            "us-central",
 						"__aef_service":             "fake-service-name",
 						"__aef_version":             "20181027t210126-active",
 						"__aef_instance":            "aef-etl--sidestream--parser-20181027t210126-x2qh",
@@ -289,8 +313,7 @@ func TestService_Discover(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			source := &Service{
-				project: tt.project,
-				api:     tt.api,
+				apps:    []*application{{id: "fake-project", api: tt.api}},
 				targets: tt.targets,
 			}
 			got, err := source.Discover(tt.ctx)
@@ -301,6 +324,12 @@ func TestService_Discover(t *testing.T) {
 			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("Service.Discover() = %v, want %v", got, tt.want)
 			}
+			if err == nil {
+				data, _ := json.Marshal(got)
+				if err := schematest.Validate([]byte(discovery.Schema), data); err != nil {
+					t.Errorf("Service.Discover() = %s, which does not match the schema: %v", data, err)
+				}
+			}
 			// Call Discover again, to verify it returns the same set of targets.
 			got2, err := source.Discover(tt.ctx)
 			if (err != nil) != tt.wantErr {
@@ -356,7 +385,7 @@ func TestNewService(t *testing.T) {
 					newAppengineClient = origFunc
 				}()
 			}
-			_, err := NewService(tt.project)
+			_, err := NewService(context.Background(), tt.project, credentials.Config{})
 			if (err != nil) != tt.wantErr {
 				t.Errorf("NewService() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -365,8 +394,314 @@ func TestNewService(t *testing.T) {
 	}
 }
 
+func TestService_DiscoverAuthRefresh(t *testing.T) {
+	expired := &fakeAppAPIImpl{appError: &credentials.AuthError{Err: fmt.Errorf("token expired")}}
+	tests := []struct {
+		name        string
+		connectErr  error
+		wantErr     bool
+		wantConnect int
+	}{
+		{
+			name:        "success",
+			wantConnect: 1,
+		},
+		{
+			name:        "failure-connect",
+			connectErr:  fmt.Errorf("metadata server unavailable"),
+			wantErr:     true,
+			wantConnect: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &application{id: "fake-project", api: expired}
+			connects := 0
+			source := &Service{
+				apps: []*application{app},
+				connect: func(ctx context.Context) error {
+					connects++
+					if tt.connectErr != nil {
+						return tt.connectErr
+					}
+					app.api = &fakeAppAPIImpl{}
+					return nil
+				},
+			}
+			_, err := source.Discover(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Service.Discover() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if connects != tt.wantConnect {
+				t.Errorf("Service.Discover() connected %d times, want %d", connects, tt.wantConnect)
+			}
+		})
+	}
+}
+
 func TestMetrics(t *testing.T) {
 	InstanceCount.WithLabelValues("x", "x")
 	VersionCount.WithLabelValues("x")
 	promtest.LintMetrics(t)
 }
+
+func TestService_Check(t *testing.T) {
+	tests := []struct {
+		name    string
+		api     iface.AppAPI
+		wantErr bool
+	}{
+		{
+			name: "success",
+			api:  &fakeAppAPIImpl{},
+		},
+		{
+			name:    "failure",
+			api:     &fakeAppAPIImpl{servicesError: fmt.Errorf("permission denied")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := &Service{apps: []*application{{id: "fake-project", api: tt.api}}}
+			err := source.Check(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Service.Check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// newSyntheticAppAPI returns a fake AppAPI with the given number of services,
+// each with one serving version and the given number of instances.
+func newSyntheticAppAPI(services, instances int) *fakeAppAPIImpl {
+	api := &fakeAppAPIImpl{
+		versions: []*appengine.Version{
+			{
+				Id:            "20181027t210126",
+				ServingStatus: "SERVING",
+				CreateTime:    "2018-10-27T21:01:26Z",
+				Network: &appengine.Network{
+					ForwardedPorts: []string{"9090/tcp"},
+				},
+				AutomaticScaling: &appengine.AutomaticScaling{
+					MaxTotalInstances: int64(instances),
+				},
+			},
+		},
+	}
+	for i := 0; i < services; i++ {
+		api.services = append(api.services, &appengine.Service{
+			Id: fmt.Sprintf("service-%04d", i),
+			Split: &appengine.TrafficSplit{
+				Allocations: map[string]float64{"20181027t210126": 1.0},
+			},
+		})
+	}
+	for i := 0; i < instances; i++ {
+		api.instances = append(api.instances, &appengine.Instance{
+			Id:       fmt.Sprintf("aef-service-20181027t210126-%04d", i),
+			VmIp:     fmt.Sprintf("192.168.%d.%d", i/256, i%256),
+			VmStatus: "RUNNING",
+		})
+	}
+	return api
+}
+
+func BenchmarkService_Discover(b *testing.B) {
+	source := &Service{
+		apps: []*application{{id: "fake-project", api: newSyntheticAppAPI(1000, 10)}},
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := source.Discover(context.Background())
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestService_DiscoverReadyLabel(t *testing.T) {
+	api := newSyntheticAppAPI(1, 2)
+	api.instances[0].VmLiveness = "HEALTHY"
+	api.instances[1].VmLiveness = "UNHEALTHY"
+	source := &Service{apps: []*application{{id: "fake-project", api: api}}, ReadyLabel: true}
+	got, err := source.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("Service.Discover() error = %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("Service.Discover() got %d targets, want 2", len(got))
+	}
+	if got[0].Labels[discovery.LabelReady] != "true" || got[1].Labels[discovery.LabelReady] != "false" {
+		t.Errorf("Service.Discover() ready labels = %q, %q; want true, false",
+			got[0].Labels[discovery.LabelReady], got[1].Labels[discovery.LabelReady])
+	}
+}
+
+func TestService_DiscoverLifecycle(t *testing.T) {
+	api := newSyntheticAppAPI(1, 2)
+	api.instances[0].VmLiveness = "HEALTHY"
+	api.instances[1].VmLiveness = "DRAINING"
+	source := &Service{apps: []*application{{id: "fake-project", api: api}}}
+	output := filepath.Join(t.TempDir(), "aeflex.json")
+	m := discovery.NewManager(discovery.WithTimeout(time.Minute), discovery.WithLifecycle(true))
+	m.Register(source, output)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m.Run(ctx, time.Minute)
+
+	l, err := discovery.ReadLifecycles(output)
+	if err != nil {
+		t.Fatalf("ReadLifecycles() error = %v", err)
+	}
+	want := map[string]discovery.Lifecycle{
+		"192.168.0.1:9090": {State: discovery.LifecycleDraining, Reason: "instance aef-service-20181027t210126-0001 DRAINING"},
+	}
+	if !reflect.DeepEqual(l.Targets, want) {
+		t.Errorf("ReadLifecycles() targets = %v, want %v", l.Targets, want)
+	}
+}
+
+func TestService_DiscoverApps(t *testing.T) {
+	first := newSyntheticAppAPI(1, 1)
+	second := newSyntheticAppAPI(1, 2)
+	source := &Service{apps: []*application{
+		{id: "example.com:app", api: first},
+		{id: "mlab-sandbox", api: second},
+	}}
+	for i := 0; i < 2; i++ {
+		got, err := source.Discover(context.Background())
+		if err != nil || len(got) != 3 {
+			t.Fatalf("Service.Discover() = %v, %v; want 3 targets", got, err)
+		}
+		if got[0].Labels["__aef_project"] != "example.com:app" || got[2].Labels["__aef_project"] != "mlab-sandbox" {
+			t.Errorf("Service.Discover() = %v, want targets labeled by app ID", got)
+		}
+		if got[0].Labels["__aef_location"] != "us-central" {
+			t.Errorf("Service.Discover() = %v, want targets labeled by location", got)
+		}
+	}
+	// The location is read once.
+	if first.appCalls != 1 || second.appCalls != 1 {
+		t.Errorf("Service.Discover() read applications %d and %d times, want once", first.appCalls, second.appCalls)
+	}
+
+	source.apps[1] = &application{id: "mlab-oti", api: &fakeAppAPIImpl{appError: fmt.Errorf("not found")}}
+	if _, err := source.Discover(context.Background()); err == nil {
+		t.Errorf("Service.Discover() error = nil, want error for unreadable application")
+	}
+}
+
+func TestService_DiscoverInstanceKey(t *testing.T) {
+	tests := []struct {
+		name         string
+		key          InstanceKey
+		wantInstance bool
+		wantIP       bool
+	}{
+		{name: "default", wantInstance: true},
+		{name: "id", key: KeyID, wantInstance: true},
+		{name: "ip", key: KeyIP, wantIP: true},
+		{name: "both", key: KeyBoth, wantInstance: true, wantIP: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newSyntheticAppAPI(1, 1)
+			source := &Service{apps: []*application{{id: "fake-project", api: api}}, InstanceKey: tt.key}
+			got, err := source.Discover(context.Background())
+			if err != nil || len(got) != 1 {
+				t.Fatalf("Service.Discover() = %v, %v; want 1 target", got, err)
+			}
+			_, hasInstance := got[0].Labels["__aef_instance"]
+			ip, hasIP := got[0].Labels["__aef_vm_ip"]
+			if hasInstance != tt.wantInstance || hasIP != tt.wantIP {
+				t.Errorf("Service.Discover() labels = %v, want instance %t, vm ip %t", got[0].Labels, tt.wantInstance, tt.wantIP)
+			}
+			if hasIP && ip != "192.168.0.0" {
+				t.Errorf("Service.Discover() vm ip = %q, want 192.168.0.0", ip)
+			}
+		})
+	}
+}
+
+func TestInstanceKey_Set(t *testing.T) {
+	var k InstanceKey
+	if err := k.Set("IP"); err != nil || k != KeyIP {
+		t.Errorf("InstanceKey.Set() = %q, %v; want %q", k, err, KeyIP)
+	}
+	if err := k.Set("name"); err == nil {
+		t.Errorf("InstanceKey.Set() error = nil, want error")
+	}
+}
+
+func TestService_DiscoverCollapseIPs(t *testing.T) {
+	api := newSyntheticAppAPI(1, 4)
+	// A restarted instance on the same VM as instance 0, and a starting
+	// instance on the same VM as instance 2.
+	api.instances[0].StartTime = "2021-07-10T03:00:00Z"
+	api.instances[1].StartTime = "2021-07-10T04:00:00Z"
+	api.instances[1].VmIp = api.instances[0].VmIp
+	api.instances[2].StartTime = "2021-07-10T03:00:00Z"
+	api.instances[3].VmIp = api.instances[2].VmIp
+	for _, collapse := range []bool{false, true} {
+		source := &Service{apps: []*application{{id: "fake-project", api: api}}, CollapseIPs: collapse}
+		got, err := source.Discover(context.Background())
+		if err != nil {
+			t.Fatalf("Service.Discover() error = %v", err)
+		}
+		if !collapse {
+			if len(got) != 4 {
+				t.Errorf("Service.Discover() got %d targets, want 4", len(got))
+			}
+			continue
+		}
+		ids := []string{}
+		for _, c := range got {
+			ids = append(ids, c.Labels["__aef_instance"])
+		}
+		want := []string{api.instances[1].Id, api.instances[3].Id}
+		if !reflect.DeepEqual(ids, want) {
+			t.Errorf("Service.Discover() with CollapseIPs = %v, want %v", ids, want)
+		}
+	}
+}
+
+func Test_forwardedPort(t *testing.T) {
+	tests := []struct {
+		spec         string
+		wantPort     string
+		wantProtocol string
+	}{
+		{spec: "9090", wantPort: "9090", wantProtocol: "both"},
+		{spec: "9090/tcp", wantPort: "9090", wantProtocol: "tcp"},
+		{spec: "8080:9090/udp", wantPort: "8080", wantProtocol: "udp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			port, protocol := forwardedPort(tt.spec)
+			if port != tt.wantPort || protocol != tt.wantProtocol {
+				t.Errorf("forwardedPort() = %q, %q, want %q, %q", port, protocol, tt.wantPort, tt.wantProtocol)
+			}
+		})
+	}
+}
+
+func TestService_getLabelsPortIndex(t *testing.T) {
+	source := &Service{}
+	version := &appengine.Version{
+		Id:      "20181027t210126",
+		Network: &appengine.Network{ForwardedPorts: []string{"9090/tcp", "9091/udp"}},
+	}
+	instance := &appengine.Instance{Id: "abcd", VmIp: "192.168.0.2"}
+	got := source.getLabels(&application{id: "fake-project"}, &appengine.Service{Id: "etl"}, version, instance, 1)
+	if got.Targets[0] != "192.168.0.2:9091" {
+		t.Errorf("Service.getLabels() target = %q, want 192.168.0.2:9091", got.Targets[0])
+	}
+	for k, want := range map[string]string{"__aef_port": "9091", "__aef_port_index": "1", "__aef_public_protocol": "udp"} {
+		if got.Labels[k] != want {
+			t.Errorf("Service.getLabels() label %s = %q, want %q", k, got.Labels[k], want)
+		}
+	}
+}
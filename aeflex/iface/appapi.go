@@ -4,12 +4,28 @@ package iface
 
 import (
 	"context"
+	"net/http"
 
 	appengine "google.golang.org/api/appengine/v1"
+	"google.golang.org/api/googleapi"
+
+	"github.com/m-lab/gcp-service-discovery/internal/apicall"
+)
+
+// api names the App Engine Admin API in quota metrics.
+const api = "appengine"
+
+// Field masks limit API responses to the fields used by the aeflex logic.
+const (
+	appFields      = googleapi.Field("id,locationId")
+	serviceFields  = googleapi.Field("nextPageToken,services(id,name,split)")
+	versionFields  = googleapi.Field("nextPageToken,versions(id,servingStatus,createTime,network/forwardedPorts,automaticScaling/maxTotalInstances,manualScaling/instances)")
+	instanceFields = googleapi.Field("nextPageToken,instances(id,startTime,vmIp,vmStatus,vmDebugEnabled,vmLiveness,vmName,vmZoneName)")
 )
 
 // AppAPI defines the interface used by the aeflex logic.
 type AppAPI interface {
+	AppGet(ctx context.Context) (*appengine.Application, error)
 	ServicesPages(ctx context.Context, f func(listVer *appengine.ListServicesResponse) error) error
 	VersionsPages(ctx context.Context, serviceID string, f func(listVer *appengine.ListVersionsResponse) error) error
 	InstancesPages(ctx context.Context, serviceID, versionID string, f func(listInst *appengine.ListInstancesResponse) error) error
@@ -17,20 +33,36 @@ type AppAPI interface {
 
 // AppAPIImpl implements the AppAPI interface.
 type AppAPIImpl struct {
-	project string
-	apis    *appengine.APIService
+	appID string
+	apis  *appengine.APIService
+}
+
+// NewAppAPI creates a new instance of the AppAPI for the given application ID.
+// The application ID is the project ID, e.g. "mlab-sandbox" or
+// "example.com:app" for domain-scoped projects.
+func NewAppAPI(appID string, apis *appengine.APIService) *AppAPIImpl {
+	return &AppAPIImpl{appID: appID, apis: apis}
 }
 
-// NewAppAPI creates a new instance of the AppAPI for the given project.
-func NewAppAPI(project string, apis *appengine.APIService) *AppAPIImpl {
-	return &AppAPIImpl{project: project, apis: apis}
+// AppGet returns the AppEngine application, including its location.
+func (a *AppAPIImpl) AppGet(ctx context.Context) (*appengine.Application, error) {
+	return apicall.Get(ctx, api,
+		func(ctx context.Context) (*appengine.Application, error) {
+			return a.apis.Apps.Get(a.appID).Fields(appFields).Context(ctx).Do()
+		},
+		func(app *appengine.Application) http.Header { return app.Header })
 }
 
 // ServicesPages lists all AppEngine services and calls the given function for
 // each "page" of results.
 func (a *AppAPIImpl) ServicesPages(
 	ctx context.Context, f func(listVer *appengine.ListServicesResponse) error) error {
-	return a.apis.Apps.Services.List(a.project).Pages(ctx, f)
+	return apicall.Pages(ctx, api,
+		func(ctx context.Context, token string) (*appengine.ListServicesResponse, error) {
+			return a.apis.Apps.Services.List(a.appID).Fields(serviceFields).PageToken(token).Context(ctx).Do()
+		},
+		func(r *appengine.ListServicesResponse) (http.Header, string) { return r.Header, r.NextPageToken },
+		f)
 }
 
 // VersionsPages lists all AppEngine versions for the given service and calls
@@ -38,7 +70,12 @@ func (a *AppAPIImpl) ServicesPages(
 func (a *AppAPIImpl) VersionsPages(
 	ctx context.Context, serviceID string,
 	f func(listVer *appengine.ListVersionsResponse) error) error {
-	return a.apis.Apps.Services.Versions.List(a.project, serviceID).Pages(ctx, f)
+	return apicall.Pages(ctx, api,
+		func(ctx context.Context, token string) (*appengine.ListVersionsResponse, error) {
+			return a.apis.Apps.Services.Versions.List(a.appID, serviceID).Fields(versionFields).PageToken(token).Context(ctx).Do()
+		},
+		func(r *appengine.ListVersionsResponse) (http.Header, string) { return r.Header, r.NextPageToken },
+		f)
 }
 
 // InstancesPages lists all AppEngine instances for the given service and
@@ -46,6 +83,11 @@ func (a *AppAPIImpl) VersionsPages(
 func (a *AppAPIImpl) InstancesPages(
 	ctx context.Context, serviceID, versionID string,
 	f func(listInst *appengine.ListInstancesResponse) error) error {
-	return a.apis.Apps.Services.Versions.Instances.List(
-		a.project, serviceID, versionID).Pages(ctx, f)
+	return apicall.Pages(ctx, api,
+		func(ctx context.Context, token string) (*appengine.ListInstancesResponse, error) {
+			return a.apis.Apps.Services.Versions.Instances.List(
+				a.appID, serviceID, versionID).Fields(instanceFields).PageToken(token).Context(ctx).Do()
+		},
+		func(r *appengine.ListInstancesResponse) (http.Header, string) { return r.Header, r.NextPageToken },
+		f)
 }
@@ -0,0 +1,99 @@
+package iface
+
+import (
+	"strings"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+)
+
+// maskPaths returns the slash separated paths selected by a field mask, e.g.
+// "a,b(c,d/e)" selects "a", "b/c", and "b/d/e".
+func maskPaths(mask string) map[string]bool {
+	paths := map[string]bool{}
+	var prefixes []string
+	start := 0
+	add := func(end int) {
+		if name := strings.TrimSpace(mask[start:end]); name != "" {
+			paths[strings.Join(append(prefixes, name), "/")] = true
+		}
+	}
+	for i, c := range mask {
+		switch c {
+		case '(':
+			prefixes = append(prefixes, strings.TrimSpace(mask[start:i]))
+			start = i + 1
+		case ')':
+			add(i)
+			prefixes = prefixes[:len(prefixes)-1]
+			start = i + 1
+		case ',':
+			add(i)
+			start = i + 1
+		}
+	}
+	add(len(mask))
+	return paths
+}
+
+// Test_fieldMasks verifies that every field read by the aeflex logic is
+// requested. Fake APIs ignore field masks, so a missing field is otherwise
+// only noticed in production, where it is always empty.
+func Test_fieldMasks(t *testing.T) {
+	tests := []struct {
+		name   string
+		mask   googleapi.Field
+		fields []string
+	}{
+		{
+			name:   "appFields",
+			mask:   appFields,
+			fields: []string{"id", "locationId"},
+		},
+		{
+			name:   "serviceFields",
+			mask:   serviceFields,
+			fields: []string{"nextPageToken", "services/id", "services/split"},
+		},
+		{
+			name: "versionFields",
+			mask: versionFields,
+			fields: []string{
+				"nextPageToken", "versions/id", "versions/servingStatus", "versions/createTime",
+				"versions/network/forwardedPorts", "versions/automaticScaling/maxTotalInstances",
+				"versions/manualScaling/instances",
+			},
+		},
+		{
+			name: "instanceFields",
+			mask: instanceFields,
+			fields: []string{
+				"nextPageToken", "instances/id", "instances/startTime", "instances/vmIp",
+				"instances/vmStatus", "instances/vmDebugEnabled", "instances/vmLiveness",
+				"instances/vmName", "instances/vmZoneName",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paths := maskPaths(string(tt.mask))
+			for _, f := range tt.fields {
+				if !paths[f] {
+					t.Errorf("%s = %q, which does not select %q", tt.name, tt.mask, f)
+				}
+			}
+		})
+	}
+}
+
+func Test_maskPaths(t *testing.T) {
+	got := maskPaths("a, b(c,d/e), f(g(h))")
+	for _, want := range []string{"a", "b/c", "b/d/e", "f/g/h"} {
+		if !got[want] {
+			t.Errorf("maskPaths() = %v, want %q", got, want)
+		}
+	}
+	if len(got) != 4 {
+		t.Errorf("maskPaths() = %v, want 4 paths", got)
+	}
+}
@@ -0,0 +1,70 @@
+// Package apilimit limits the number of concurrent, in-flight API requests made
+// by all discovery sources in the process. This allows projects with small API
+// quotas to reduce the request rate caused by parallel discovery.
+package apilimit
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/m-lab/gcp-service-discovery/discovery"
+)
+
+var (
+	mu  sync.RWMutex
+	sem chan struct{}
+)
+
+// SetMaxInFlight limits the number of concurrent requests made through clients
+// returned by Client or transports returned by Wrap. A value less than one
+// removes the limit. SetMaxInFlight should be called before discovery starts.
+func SetMaxInFlight(n int) {
+	mu.Lock()
+	defer mu.Unlock()
+	if n < 1 {
+		sem = nil
+		return
+	}
+	sem = make(chan struct{}, n)
+}
+
+// transport acquires a request slot before every request.
+type transport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip waits for a request slot, or for the request context to be
+// canceled, and then performs the request using the base transport. Requests
+// made during discovery are counted with discovery.CountAPICall.
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	discovery.CountAPICall(req.Context())
+	mu.RLock()
+	s := sem
+	mu.RUnlock()
+	if s != nil {
+		select {
+		case s <- struct{}{}:
+			defer func() { <-s }()
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	return t.base.RoundTrip(req)
+}
+
+// Wrap returns a RoundTripper that applies the process-wide limit to requests
+// made with rt. When rt is nil, http.DefaultTransport is used.
+func Wrap(rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &transport{base: rt}
+}
+
+// Client returns a shallow copy of the given client that applies the
+// process-wide limit to every request.
+func Client(c *http.Client) *http.Client {
+	limited := *c
+	limited.Transport = Wrap(c.Transport)
+	return &limited
+}
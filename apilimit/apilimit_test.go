@@ -0,0 +1,64 @@
+package apilimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClient(t *testing.T) {
+	var inFlight, maxInFlight int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		for {
+			m := atomic.LoadInt32(&maxInFlight)
+			if n <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+	}))
+	defer ts.Close()
+
+	SetMaxInFlight(2)
+	defer SetMaxInFlight(0)
+	c := Client(&http.Client{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := c.Get(ts.URL)
+			if err != nil {
+				t.Errorf("Client.Get() error = %v", err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	if maxInFlight > 2 {
+		t.Errorf("Client() allowed %d requests in flight, want at most 2", maxInFlight)
+	}
+}
+
+func TestTransport_RoundTripCanceled(t *testing.T) {
+	SetMaxInFlight(1)
+	defer SetMaxInFlight(0)
+	// Occupy the only request slot.
+	sem <- struct{}{}
+	defer func() { <-sem }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/", nil)
+	_, err := Wrap(nil).RoundTrip(req.WithContext(ctx))
+	if err != context.Canceled {
+		t.Errorf("RoundTrip() error = %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,253 @@
+// Package apis implements service discovery for the published API surfaces of
+// a project: the gateways of API Gateway and the services of Cloud Endpoints.
+// Every hostname is returned as a target without a port, for blackbox probing.
+package apis
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	apigateway "google.golang.org/api/apigateway/v1"
+	servicemanagement "google.golang.org/api/servicemanagement/v1"
+
+	"github.com/m-lab/gcp-service-discovery/apilimit"
+	"github.com/m-lab/gcp-service-discovery/apis/iface"
+	"github.com/m-lab/gcp-service-discovery/credentials"
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/internal/apicall"
+	"github.com/m-lab/gcp-service-discovery/metrics"
+)
+
+const (
+	apiLabel      = "__api_"
+	labelType     = apiLabel + "type"
+	labelService  = apiLabel + "service"
+	labelConfig   = apiLabel + "config"
+	labelGateway  = apiLabel + "gateway"
+	labelLocation = apiLabel + "location"
+
+	// The values of the type label.
+	typeGateway   = "gateway"
+	typeEndpoints = "endpoints"
+)
+
+var (
+	// newGatewayClient and newManagementClient allocate new API clients. The
+	// indirection facilitates testing.
+	newGatewayClient    = apigateway.New
+	newManagementClient = servicemanagement.New
+)
+
+var (
+	// TargetCount is the number of discovered API hostnames by type.
+	//
+	// Provides metrics:
+	//   gcp_apis_targets{type="gateway"}
+	// Example usage:
+	//   TargetCount.WithLabelValues("gateway").Set(count)
+	TargetCount = metrics.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gcp_apis_targets",
+			Help: "Number of discovered API hostnames by type.",
+		},
+		[]string{"type"},
+	)
+)
+
+// Service discovers the API Gateway gateways and Cloud Endpoints services of a
+// project.
+type Service struct {
+	project string
+	api     iface.APIs
+
+	// connect creates api. It is called again to recreate the clients after
+	// an authentication error.
+	connect func(ctx context.Context) error
+}
+
+// NewService returns a Service initialized with API Gateway and Service
+// Management API clients authenticated by creds. The Service implements the
+// discovery.Service interface. NewService fails if the credentials are not
+// found before ctx is done.
+func NewService(ctx context.Context, project string, creds credentials.Config) (*Service, error) {
+	s := &Service{project: project}
+	s.connect = func(ctx context.Context) error {
+		client, err := creds.Client(ctx, apigateway.CloudPlatformScope)
+		if err != nil {
+			return fmt.Errorf("Error setting up API clients: %s", err)
+		}
+		client = apilimit.Client(client)
+		gateway, err := newGatewayClient(client)
+		if err != nil {
+			return fmt.Errorf("Error setting up API Gateway client: %s", err)
+		}
+		management, err := newManagementClient(client)
+		if err != nil {
+			return fmt.Errorf("Error setting up Service Management client: %s", err)
+		}
+		s.api = iface.NewAPIs(project, gateway, management)
+		return nil
+	}
+	if err := s.connect(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Discover lists every active gateway and every Cloud Endpoints service
+// produced by the project. Services that implement the APIs of gateways are
+// only returned as gateways. After an authentication error, Discover recreates
+// its clients and tries once more.
+func (s *Service) Discover(ctx context.Context) ([]discovery.StaticConfig, error) {
+	var targets []discovery.StaticConfig
+	err := credentials.Retry(ctx, "apis", s.connect, func() error {
+		var err error
+		targets, err = s.discover(ctx)
+		return err
+	})
+	return targets, err
+}
+
+// discover lists every gateway and service once.
+func (s *Service) discover(ctx context.Context) ([]discovery.StaticConfig, error) {
+	// managed maps the names of gateway APIs to their managed services.
+	managed := map[string]string{}
+	targets := []discovery.StaticConfig{}
+	err := s.api.GatewayPages(ctx, func(list *apigateway.ApigatewayListGatewaysResponse) error {
+		discovery.CountScanned(ctx, "gateways", len(list.Gateways))
+		for _, gw := range list.Gateways {
+			object := gw.Name
+			if gw.State != "ACTIVE" {
+				discovery.Decide(ctx, object, false, "gateway state "+gw.State)
+				continue
+			}
+			if gw.DefaultHostname == "" {
+				discovery.Decide(ctx, object, false, "no hostname")
+				continue
+			}
+			apiName := gatewayAPIName(gw.ApiConfig)
+			if _, ok := managed[apiName]; !ok {
+				api, err := s.api.APIGet(ctx, apiName)
+				if err != nil {
+					return fmt.Errorf("cannot read API %q of gateway %q: %w", apiName, gw.Name, err)
+				}
+				managed[apiName] = api.ManagedService
+			}
+			config := gatewayLabels(gw, managed[apiName])
+			discovery.RecordOrigin(ctx, config, gw)
+			discovery.Decide(ctx, object, true, "active gateway")
+			targets = append(targets, config)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	gateways := len(targets)
+
+	gatewayServices := map[string]bool{}
+	for _, service := range managed {
+		gatewayServices[service] = true
+	}
+	var services []string
+	err = s.api.ServicePages(ctx, func(list *servicemanagement.ListServicesResponse) error {
+		discovery.CountScanned(ctx, "services", len(list.Services))
+		for _, ms := range list.Services {
+			if gatewayServices[ms.ServiceName] {
+				discovery.Decide(ctx, ms.ServiceName, false, "implemented by a gateway")
+				continue
+			}
+			services = append(services, ms.ServiceName)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range services {
+		cfg, err := s.api.ServiceConfig(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the configuration of service %q: %w", name, err)
+		}
+		config := discovery.StaticConfig{
+			Targets: []string{name},
+			Labels: map[string]string{
+				labelType:    typeEndpoints,
+				labelService: name,
+				labelConfig:  cfg.Id,
+			},
+		}
+		discovery.RecordOrigin(ctx, config, map[string]string{"service": name, "config": cfg.Id})
+		discovery.Decide(ctx, name, true, "endpoints service")
+		targets = append(targets, config)
+	}
+	TargetCount.WithLabelValues(typeGateway).Set(float64(gateways))
+	TargetCount.WithLabelValues(typeEndpoints).Set(float64(len(targets) - gateways))
+	return targets, nil
+}
+
+// gatewayAPIName returns the name of the API of an API config name, e.g.
+// "projects/p/locations/global/apis/a" for
+// "projects/p/locations/global/apis/a/configs/c".
+func gatewayAPIName(apiConfig string) string {
+	if i := strings.Index(apiConfig, "/configs/"); i >= 0 {
+		return apiConfig[:i]
+	}
+	return apiConfig
+}
+
+// gatewayLabels creates a target configuration for the hostname of gw.
+//
+// In serialized form, the label set look like:
+//
+//	{
+//	    "labels": {
+//	        "__api_config": "v2",
+//	        "__api_gateway": "web",
+//	        "__api_location": "us-central1",
+//	        "__api_service": "web-1a2b3c4d.apigateway.mlab-sandbox.cloud.goog",
+//	        "__api_type": "gateway"
+//	    },
+//	    "targets": [
+//	        "web-1a2b3c4d.uc.gateway.dev"
+//	    ]
+//	}
+func gatewayLabels(gw *apigateway.ApigatewayGateway, service string) discovery.StaticConfig {
+	// Gateway names look like projects/p/locations/l/gateways/g.
+	location := ""
+	if parts := strings.Split(gw.Name, "/"); len(parts) == 6 {
+		location = parts[3]
+	}
+	return discovery.StaticConfig{
+		Targets: []string{gw.DefaultHostname},
+		Labels: map[string]string{
+			labelType:     typeGateway,
+			labelService:  service,
+			labelConfig:   path.Base(gw.ApiConfig),
+			labelGateway:  path.Base(gw.Name),
+			labelLocation: location,
+		},
+	}
+}
+
+// Check verifies access to the API Gateway and Service Management APIs by
+// reading the first page of gateways and services. Check implements the
+// discovery.Checker interface.
+func (s *Service) Check(ctx context.Context) error {
+	err := apicall.FirstPage(ctx, s.api.GatewayPages)
+	if err != nil {
+		return fmt.Errorf("cannot list API Gateway gateways in project %q; "+
+			"verify the API Gateway API is enabled and the credentials have "+
+			"the API Gateway Viewer role: %s", s.project, err)
+	}
+	err = apicall.FirstPage(ctx, s.api.ServicePages)
+	if err != nil {
+		return fmt.Errorf("cannot list Cloud Endpoints services in project %q; "+
+			"verify the Service Management API is enabled and the credentials "+
+			"have the Service Config Viewer role: %s", s.project, err)
+	}
+	return nil
+}
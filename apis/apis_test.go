@@ -0,0 +1,259 @@
+package apis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/m-lab/go/prometheusx/promtest"
+	apigateway "google.golang.org/api/apigateway/v1"
+	"google.golang.org/api/googleapi"
+	servicemanagement "google.golang.org/api/servicemanagement/v1"
+
+	"github.com/m-lab/gcp-service-discovery/credentials"
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/internal/schematest"
+)
+
+const apiName = "projects/mlab-sandbox/locations/global/apis/web"
+
+type fakeAPIs struct {
+	gateways   []*apigateway.ApigatewayGateway
+	apis       map[string]*apigateway.ApigatewayApi
+	services   []*servicemanagement.ManagedService
+	configs    map[string]*servicemanagement.Service
+	gatewayErr error
+	apiErr     error
+	serviceErr error
+	configErr  error
+	apiGets    int
+}
+
+func (f *fakeAPIs) GatewayPages(ctx context.Context, fn func(list *apigateway.ApigatewayListGatewaysResponse) error) error {
+	if f.gatewayErr != nil {
+		return f.gatewayErr
+	}
+	return fn(&apigateway.ApigatewayListGatewaysResponse{Gateways: f.gateways})
+}
+
+func (f *fakeAPIs) APIGet(ctx context.Context, name string) (*apigateway.ApigatewayApi, error) {
+	f.apiGets++
+	if f.apiErr != nil {
+		return nil, f.apiErr
+	}
+	return f.apis[name], nil
+}
+
+func (f *fakeAPIs) ServicePages(ctx context.Context, fn func(list *servicemanagement.ListServicesResponse) error) error {
+	if f.serviceErr != nil {
+		return f.serviceErr
+	}
+	return fn(&servicemanagement.ListServicesResponse{Services: f.services})
+}
+
+func (f *fakeAPIs) ServiceConfig(ctx context.Context, name string) (*servicemanagement.Service, error) {
+	if f.configErr != nil {
+		return nil, f.configErr
+	}
+	return f.configs[name], nil
+}
+
+func newFakeAPIs() *fakeAPIs {
+	return &fakeAPIs{
+		gateways: []*apigateway.ApigatewayGateway{
+			{
+				Name:            "projects/mlab-sandbox/locations/us-central1/gateways/web",
+				ApiConfig:       apiName + "/configs/v2",
+				DefaultHostname: "web-1a2b3c4d.uc.gateway.dev",
+				State:           "ACTIVE",
+			},
+			{
+				Name:            "projects/mlab-sandbox/locations/europe-west1/gateways/web-eu",
+				ApiConfig:       apiName + "/configs/v2",
+				DefaultHostname: "web-eu-1a2b3c4d.ew.gateway.dev",
+				State:           "ACTIVE",
+			},
+			{
+				Name:      "projects/mlab-sandbox/locations/us-central1/gateways/new",
+				ApiConfig: apiName + "/configs/v3",
+				State:     "CREATING",
+			},
+		},
+		apis: map[string]*apigateway.ApigatewayApi{
+			apiName: {Name: apiName, ManagedService: "web-1a2b3c4d.apigateway.mlab-sandbox.cloud.goog"},
+		},
+		services: []*servicemanagement.ManagedService{
+			{ServiceName: "web-1a2b3c4d.apigateway.mlab-sandbox.cloud.goog"},
+			{ServiceName: "locate.endpoints.mlab-sandbox.cloud.goog"},
+		},
+		configs: map[string]*servicemanagement.Service{
+			"locate.endpoints.mlab-sandbox.cloud.goog": {Id: "2023-05-01r0"},
+		},
+	}
+}
+
+func TestService_Discover(t *testing.T) {
+	tests := []struct {
+		name    string
+		api     *fakeAPIs
+		want    []discovery.StaticConfig
+		wantErr bool
+	}{
+		{
+			name: "success",
+			api:  newFakeAPIs(),
+			want: []discovery.StaticConfig{
+				{
+					Targets: []string{"web-1a2b3c4d.uc.gateway.dev"},
+					Labels: map[string]string{
+						"__api_type":     "gateway",
+						"__api_service":  "web-1a2b3c4d.apigateway.mlab-sandbox.cloud.goog",
+						"__api_config":   "v2",
+						"__api_gateway":  "web",
+						"__api_location": "us-central1",
+					},
+				},
+				{
+					Targets: []string{"web-eu-1a2b3c4d.ew.gateway.dev"},
+					Labels: map[string]string{
+						"__api_type":     "gateway",
+						"__api_service":  "web-1a2b3c4d.apigateway.mlab-sandbox.cloud.goog",
+						"__api_config":   "v2",
+						"__api_gateway":  "web-eu",
+						"__api_location": "europe-west1",
+					},
+				},
+				{
+					Targets: []string{"locate.endpoints.mlab-sandbox.cloud.goog"},
+					Labels: map[string]string{
+						"__api_type":    "endpoints",
+						"__api_service": "locate.endpoints.mlab-sandbox.cloud.goog",
+						"__api_config":  "2023-05-01r0",
+					},
+				},
+			},
+		},
+		{
+			name: "success-empty",
+			api:  &fakeAPIs{},
+			want: []discovery.StaticConfig{},
+		},
+		{
+			name:    "failure-gateways",
+			api:     &fakeAPIs{gatewayErr: fmt.Errorf("forbidden")},
+			wantErr: true,
+		},
+		{
+			name: "failure-api",
+			api: func() *fakeAPIs {
+				f := newFakeAPIs()
+				f.apiErr = fmt.Errorf("not found")
+				return f
+			}(),
+			wantErr: true,
+		},
+		{
+			name:    "failure-services",
+			api:     &fakeAPIs{serviceErr: fmt.Errorf("forbidden")},
+			wantErr: true,
+		},
+		{
+			name: "failure-config",
+			api: func() *fakeAPIs {
+				f := newFakeAPIs()
+				f.configErr = fmt.Errorf("unavailable")
+				return f
+			}(),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Service{project: "mlab-sandbox", api: tt.api}
+			got, err := s.Discover(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Service.Discover() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Service.Discover() = %v, want %v", got, tt.want)
+			}
+			if err == nil {
+				data, _ := json.Marshal(got)
+				if err := schematest.Validate([]byte(discovery.Schema), data); err != nil {
+					t.Errorf("Service.Discover() = %s, which does not match the schema: %v", data, err)
+				}
+			}
+		})
+	}
+}
+
+func TestService_DiscoverReadsAPIsOnce(t *testing.T) {
+	api := newFakeAPIs()
+	s := &Service{project: "mlab-sandbox", api: api}
+	if _, err := s.Discover(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if api.apiGets != 1 {
+		t.Errorf("Service.Discover() read APIs %d times, want 1", api.apiGets)
+	}
+}
+
+func TestService_Check(t *testing.T) {
+	s := &Service{project: "mlab-sandbox", api: newFakeAPIs()}
+	if err := s.Check(context.Background()); err != nil {
+		t.Errorf("Service.Check() error = %v", err)
+	}
+	s.api = &fakeAPIs{gatewayErr: fmt.Errorf("forbidden")}
+	if err := s.Check(context.Background()); err == nil {
+		t.Errorf("Service.Check() error = nil, want error")
+	}
+	s.api = &fakeAPIs{serviceErr: fmt.Errorf("forbidden")}
+	if err := s.Check(context.Background()); err == nil {
+		t.Errorf("Service.Check() error = nil, want error")
+	}
+}
+
+func TestNewService(t *testing.T) {
+	origGateway, origManagement := newGatewayClient, newManagementClient
+	defer func() { newGatewayClient, newManagementClient = origGateway, origManagement }()
+	if _, err := NewService(context.Background(), "mlab-sandbox", credentials.Config{}); err != nil {
+		t.Errorf("NewService() error = %v", err)
+	}
+	newManagementClient = func(client *http.Client) (*servicemanagement.APIService, error) {
+		return nil, fmt.Errorf("failed to create client")
+	}
+	if _, err := NewService(context.Background(), "mlab-sandbox", credentials.Config{}); err == nil {
+		t.Errorf("NewService() error = nil, want error")
+	}
+	newGatewayClient = func(client *http.Client) (*apigateway.Service, error) {
+		return nil, fmt.Errorf("failed to create client")
+	}
+	if _, err := NewService(context.Background(), "mlab-sandbox", credentials.Config{}); err == nil {
+		t.Errorf("NewService() error = nil, want error")
+	}
+}
+
+func TestService_DiscoverAuthRefresh(t *testing.T) {
+	s := &Service{project: "mlab-sandbox", api: &fakeAPIs{gatewayErr: &googleapi.Error{Code: http.StatusUnauthorized}}}
+	connects := 0
+	s.connect = func(ctx context.Context) error {
+		connects++
+		s.api = newFakeAPIs()
+		return nil
+	}
+	got, err := s.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("Service.Discover() error = %v", err)
+	}
+	if connects != 1 || len(got) == 0 {
+		t.Errorf("Service.Discover() connected %d times and found %d targets, want 1 and more than 0", connects, len(got))
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	TargetCount.WithLabelValues("x")
+	promtest.LintMetrics(t)
+}
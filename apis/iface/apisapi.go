@@ -0,0 +1,89 @@
+// Package iface defines an interface for accessing the API Gateway and Service
+// Management APIs. This is helpful for creating testable packages.
+package iface
+
+import (
+	"context"
+	"net/http"
+
+	apigateway "google.golang.org/api/apigateway/v1"
+	servicemanagement "google.golang.org/api/servicemanagement/v1"
+
+	"github.com/m-lab/gcp-service-discovery/internal/apicall"
+)
+
+// The names of the APIs in quota metrics.
+const (
+	gatewayAPI    = "apigateway"
+	managementAPI = "servicemanagement"
+)
+
+// APIs defines the interface used by the apis logic.
+type APIs interface {
+	GatewayPages(ctx context.Context, f func(list *apigateway.ApigatewayListGatewaysResponse) error) error
+	APIGet(ctx context.Context, name string) (*apigateway.ApigatewayApi, error)
+	ServicePages(ctx context.Context, f func(list *servicemanagement.ListServicesResponse) error) error
+	ServiceConfig(ctx context.Context, name string) (*servicemanagement.Service, error)
+}
+
+// APIsImpl implements the APIs interface.
+type APIsImpl struct {
+	project    string
+	gateway    *apigateway.Service
+	management *servicemanagement.APIService
+}
+
+// NewAPIs creates a new APIs for the given project.
+func NewAPIs(project string, gateway *apigateway.Service, management *servicemanagement.APIService) *APIsImpl {
+	return &APIsImpl{project: project, gateway: gateway, management: management}
+}
+
+// GatewayPages lists the API Gateway gateways of every location and calls the
+// given function for each "page" of results.
+func (a *APIsImpl) GatewayPages(ctx context.Context, f func(list *apigateway.ApigatewayListGatewaysResponse) error) error {
+	parent := "projects/" + a.project + "/locations/-"
+	return apicall.Pages(ctx, gatewayAPI,
+		func(ctx context.Context, token string) (*apigateway.ApigatewayListGatewaysResponse, error) {
+			return a.gateway.Projects.Locations.Gateways.List(parent).PageToken(token).Context(ctx).Do()
+		},
+		func(list *apigateway.ApigatewayListGatewaysResponse) (http.Header, string) {
+			return list.Header, list.NextPageToken
+		},
+		f)
+}
+
+// APIGet reads the named API, e.g. "projects/p/locations/global/apis/a".
+func (a *APIsImpl) APIGet(ctx context.Context, name string) (*apigateway.ApigatewayApi, error) {
+	return apicall.Get(ctx, gatewayAPI,
+		func(ctx context.Context) (*apigateway.ApigatewayApi, error) {
+			return a.gateway.Projects.Locations.Apis.Get(name).Context(ctx).Do()
+		},
+		func(api *apigateway.ApigatewayApi) http.Header {
+			return api.Header
+		})
+}
+
+// ServicePages lists the managed services produced by the project and calls
+// the given function for each "page" of results.
+func (a *APIsImpl) ServicePages(ctx context.Context, f func(list *servicemanagement.ListServicesResponse) error) error {
+	return apicall.Pages(ctx, managementAPI,
+		func(ctx context.Context, token string) (*servicemanagement.ListServicesResponse, error) {
+			return a.management.Services.List().ProducerProjectId(a.project).PageToken(token).Context(ctx).Do()
+		},
+		func(list *servicemanagement.ListServicesResponse) (http.Header, string) {
+			return list.Header, list.NextPageToken
+		},
+		f)
+}
+
+// ServiceConfig reads the basic view of the latest configuration of the named
+// managed service.
+func (a *APIsImpl) ServiceConfig(ctx context.Context, name string) (*servicemanagement.Service, error) {
+	return apicall.Get(ctx, managementAPI,
+		func(ctx context.Context) (*servicemanagement.Service, error) {
+			return a.management.Services.GetConfig(name).View("BASIC").Context(ctx).Do()
+		},
+		func(s *servicemanagement.Service) http.Header {
+			return s.Header
+		})
+}
@@ -0,0 +1,164 @@
+// Package auditlog triggers discovery when Cloud Audit Logs report changes to
+// discovered resources, e.g. App Engine deployments, so targets are updated
+// without waiting for the next refresh.
+//
+// Audit logs are read from a Pub/Sub subscription of a log sink, created with
+// a filter like:
+//
+//	protoPayload.serviceName="appengine.googleapis.com"
+package auditlog
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	pubsub "google.golang.org/api/pubsub/v1"
+
+	"github.com/m-lab/gcp-service-discovery/apilimit"
+	"github.com/m-lab/gcp-service-discovery/auditlog/iface"
+	"github.com/m-lab/gcp-service-discovery/credentials"
+	"github.com/m-lab/gcp-service-discovery/metrics"
+)
+
+// AppEngineMethods are the App Engine Admin API methods that change the
+// serving instances of App Engine Flex services.
+var AppEngineMethods = []string{
+	"google.appengine.v1.Versions.CreateVersion",
+	"google.appengine.v1.Versions.UpdateVersion",
+	"google.appengine.v1.Versions.DeleteVersion",
+	"google.appengine.v1.Services.UpdateService",
+	"google.appengine.v1.Services.DeleteService",
+}
+
+// maxMessages is the maximum number of messages read by one pull.
+const maxMessages = 100
+
+// retryDelay is the time to wait before pulling again after an error.
+var retryDelay = 10 * time.Second
+
+var (
+	// eventsTotal counts audit log entries read from the subscription. The
+	// metric is labeled by the method name, or "other" for entries of methods
+	// that do not trigger discovery.
+	//
+	// Provides metrics:
+	//   gcp_auditlog_events_total{method="google.appengine.v1.Versions.CreateVersion"}
+	// Example usage:
+	//   eventsTotal.WithLabelValues("google.appengine.v1.Versions.CreateVersion").Inc()
+	eventsTotal = metrics.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gcp_auditlog_events_total",
+			Help: "Number of audit log entries read from Pub/Sub.",
+		},
+		[]string{"method"},
+	)
+)
+
+// entry is the subset of a LogEntry used to identify the audited method.
+type entry struct {
+	ProtoPayload struct {
+		MethodName   string `json:"methodName"`
+		ResourceName string `json:"resourceName"`
+	} `json:"protoPayload"`
+}
+
+// Listener reads audit log entries from a Pub/Sub subscription.
+type Listener struct {
+	sub     iface.Subscription
+	name    string
+	methods map[string]bool
+}
+
+// New creates a Listener for the subscription with the given full name, e.g.
+// "projects/mlab-sandbox/subscriptions/aeflex-deploys", that reports entries
+// for the given methods. New fails if default credentials are not found before
+// ctx is done.
+func New(ctx context.Context, subscription string, methods []string) (*Listener, error) {
+	client, err := credentials.Config{}.Client(ctx, pubsub.PubsubScope)
+	if err != nil {
+		return nil, fmt.Errorf("Error setting up Pub/Sub client: %s", err)
+	}
+	service, err := pubsub.New(apilimit.Client(client))
+	if err != nil {
+		return nil, fmt.Errorf("Error setting up Pub/Sub client: %s", err)
+	}
+	return newListener(iface.NewSubscription(subscription, service), subscription, methods), nil
+}
+
+func newListener(sub iface.Subscription, name string, methods []string) *Listener {
+	l := &Listener{sub: sub, name: name, methods: map[string]bool{}}
+	for _, m := range methods {
+		l.methods[m] = true
+	}
+	return l
+}
+
+// Run reads entries from the subscription until ctx is canceled, and calls
+// trigger once for every batch of entries that includes a matching method.
+// Errors are logged and retried.
+func (l *Listener) Run(ctx context.Context, trigger func()) {
+	for ctx.Err() == nil {
+		found, err := l.pull(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Error: failed to read audit logs from %s: %s", l.name, err)
+			select {
+			case <-time.After(retryDelay):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		if found {
+			trigger()
+		}
+	}
+}
+
+// pull reads and acknowledges one batch of messages, and returns true if any
+// message is an entry for a matching method. Messages that are not log
+// entries are acknowledged and ignored.
+func (l *Listener) pull(ctx context.Context) (bool, error) {
+	msgs, err := l.sub.Pull(ctx, maxMessages)
+	if err != nil {
+		return false, err
+	}
+	if len(msgs) == 0 {
+		return false, nil
+	}
+	found := false
+	ackIDs := make([]string, 0, len(msgs))
+	for _, m := range msgs {
+		ackIDs = append(ackIDs, m.AckId)
+		if m.Message == nil {
+			continue
+		}
+		method, ok := l.match(m.Message.Data)
+		if !ok {
+			eventsTotal.WithLabelValues("other").Inc()
+			continue
+		}
+		eventsTotal.WithLabelValues(method).Inc()
+		log.Printf("Audit log: %s", method)
+		found = true
+	}
+	return found, l.sub.Acknowledge(ctx, ackIDs)
+}
+
+// match returns the method name of the base64 encoded log entry, and whether
+// it is one of the Listener methods.
+func (l *Listener) match(data string) (string, bool) {
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", false
+	}
+	e := entry{}
+	if json.Unmarshal(raw, &e) != nil {
+		return "", false
+	}
+	method := e.ProtoPayload.MethodName
+	return method, l.methods[method]
+}
@@ -0,0 +1,114 @@
+package auditlog
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/prometheusx/promtest"
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+type fakeSubscription struct {
+	batches [][]*pubsub.ReceivedMessage
+	pullErr error
+	acked   []string
+	cancel  context.CancelFunc
+}
+
+func (f *fakeSubscription) Pull(ctx context.Context, max int64) ([]*pubsub.ReceivedMessage, error) {
+	if len(f.batches) == 0 {
+		// Stop the listener once every batch is delivered.
+		f.cancel()
+		return nil, ctx.Err()
+	}
+	if f.pullErr != nil {
+		err := f.pullErr
+		f.pullErr = nil
+		return nil, err
+	}
+	b := f.batches[0]
+	f.batches = f.batches[1:]
+	return b, nil
+}
+
+func (f *fakeSubscription) Acknowledge(ctx context.Context, ackIDs []string) error {
+	f.acked = append(f.acked, ackIDs...)
+	return nil
+}
+
+func message(id, data string) *pubsub.ReceivedMessage {
+	return &pubsub.ReceivedMessage{
+		AckId:   id,
+		Message: &pubsub.PubsubMessage{Data: base64.StdEncoding.EncodeToString([]byte(data))},
+	}
+}
+
+func TestListener_Run(t *testing.T) {
+	create := `{"protoPayload": {"methodName": "google.appengine.v1.Versions.CreateVersion"}}`
+	get := `{"protoPayload": {"methodName": "google.appengine.v1.Versions.GetVersion"}}`
+	tests := []struct {
+		name         string
+		batches      [][]*pubsub.ReceivedMessage
+		pullErr      error
+		wantTriggers int
+		wantAcked    []string
+	}{
+		{
+			name:         "success-one-trigger-per-batch",
+			batches:      [][]*pubsub.ReceivedMessage{{message("a", create), message("b", create)}},
+			wantTriggers: 1,
+			wantAcked:    []string{"a", "b"},
+		},
+		{
+			name: "success-ignore-other-methods",
+			batches: [][]*pubsub.ReceivedMessage{
+				{message("a", get)},
+				{message("b", "not json"), {AckId: "c"}},
+				{},
+				{message("d", create)},
+			},
+			wantTriggers: 1,
+			wantAcked:    []string{"a", "b", "c", "d"},
+		},
+		{
+			name:         "success-retry-after-error",
+			batches:      [][]*pubsub.ReceivedMessage{{message("a", create)}},
+			pullErr:      fmt.Errorf("unavailable"),
+			wantTriggers: 1,
+			wantAcked:    []string{"a"},
+		},
+	}
+	retryDelay = time.Millisecond
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			f := &fakeSubscription{batches: tt.batches, pullErr: tt.pullErr, cancel: cancel}
+			l := newListener(f, "projects/p/subscriptions/s", AppEngineMethods)
+			triggers := 0
+			l.Run(ctx, func() { triggers++ })
+			if triggers != tt.wantTriggers {
+				t.Errorf("Listener.Run() triggers = %d, want %d", triggers, tt.wantTriggers)
+			}
+			if !reflect.DeepEqual(f.acked, tt.wantAcked) {
+				t.Errorf("Listener.Run() acked = %v, want %v", f.acked, tt.wantAcked)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(context.Background(), "projects/p/subscriptions/s", AppEngineMethods)
+	if err != nil {
+		t.Errorf("New() error = %v", err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	eventsTotal.WithLabelValues("x")
+	promtest.LintMetrics(t)
+}
@@ -0,0 +1,56 @@
+// Package iface defines an interface for accessing Pub/Sub subscriptions. This
+// is helpful for creating testable packages.
+package iface
+
+import (
+	"context"
+
+	pubsub "google.golang.org/api/pubsub/v1"
+
+	"github.com/m-lab/gcp-service-discovery/quota"
+)
+
+// api names the Pub/Sub API in quota metrics.
+const api = "pubsub"
+
+// Subscription defines the interface used by the auditlog logic.
+type Subscription interface {
+	Pull(ctx context.Context, max int64) ([]*pubsub.ReceivedMessage, error)
+	Acknowledge(ctx context.Context, ackIDs []string) error
+}
+
+// SubscriptionImpl implements the Subscription interface for one subscription.
+type SubscriptionImpl struct {
+	name    string
+	service *pubsub.Service
+}
+
+// NewSubscription creates a new Subscription for the subscription with the
+// given full name, e.g. "projects/mlab-sandbox/subscriptions/aeflex-deploys".
+func NewSubscription(name string, service *pubsub.Service) *SubscriptionImpl {
+	return &SubscriptionImpl{name: name, service: service}
+}
+
+// Pull waits for up to max messages from the subscription. Pull may return
+// no messages.
+func (s *SubscriptionImpl) Pull(ctx context.Context, max int64) ([]*pubsub.ReceivedMessage, error) {
+	r, err := s.service.Projects.Subscriptions.Pull(s.name, &pubsub.PullRequest{MaxMessages: max}).Context(ctx).Do()
+	if err != nil {
+		quota.ObserveError(api, err)
+		return nil, err
+	}
+	quota.Observe(api, r.Header)
+	return r.ReceivedMessages, nil
+}
+
+// Acknowledge acknowledges the given messages, so they are not delivered
+// again.
+func (s *SubscriptionImpl) Acknowledge(ctx context.Context, ackIDs []string) error {
+	r, err := s.service.Projects.Subscriptions.Acknowledge(s.name, &pubsub.AcknowledgeRequest{AckIds: ackIDs}).Context(ctx).Do()
+	if err != nil {
+		quota.ObserveError(api, err)
+		return err
+	}
+	quota.Observe(api, r.Header)
+	return nil
+}
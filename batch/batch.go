@@ -0,0 +1,271 @@
+// Package batch implements service discovery for the VMs of running GCP Batch
+// jobs, so batch workers that expose metrics are scraped while they run.
+//
+// Jobs are listed with the Batch API. Batch labels the Compute Engine VMs of
+// every job with the job UID, so the VMs of running jobs are listed with the
+// Compute API.
+package batch
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	compute "google.golang.org/api/compute/v1"
+
+	"github.com/m-lab/gcp-service-discovery/apilimit"
+	"github.com/m-lab/gcp-service-discovery/batch/iface"
+	"github.com/m-lab/gcp-service-discovery/credentials"
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/gce"
+	giface "github.com/m-lab/gcp-service-discovery/gce/iface"
+	"github.com/m-lab/gcp-service-discovery/internal/apicall"
+	"github.com/m-lab/gcp-service-discovery/metrics"
+)
+
+// DefaultPort is the port of VM targets unless changed by Service.Port, the
+// port of the Prometheus node exporter.
+const DefaultPort = gce.DefaultPort
+
+const (
+	batchLabel    = "__batch_"
+	labelJob      = batchLabel + "job"
+	labelJobUID   = batchLabel + "job_uid"
+	labelState    = batchLabel + "state"
+	labelLocation = batchLabel + "location"
+	labelPrefix   = batchLabel + "label_"
+
+	// jobUIDLabel is the GCE label with the UID of the job of every VM
+	// created by Batch.
+	jobUIDLabel = "batch-job-uid"
+)
+
+// activeStates are the job states in which VMs may run tasks.
+var activeStates = map[string]bool{"SCHEDULED": true, "RUNNING": true}
+
+var (
+	// newComputeClient allocates a new Compute client. The indirection
+	// facilitates testing.
+	newComputeClient = compute.New
+)
+
+var (
+	// JobCount is the number of Batch jobs by state.
+	//
+	// Provides metrics:
+	//   gcp_batch_jobs{state="RUNNING"}
+	// Example usage:
+	//   JobCount.WithLabelValues("RUNNING").Set(count)
+	JobCount = metrics.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gcp_batch_jobs",
+			Help: "Number of Batch jobs by state.",
+		},
+		[]string{"state"},
+	)
+)
+
+// Service discovers the VMs of the active Batch jobs of a project.
+type Service struct {
+	project string
+	api     iface.Batch
+	compute giface.Compute
+
+	// connect creates api and compute. It is called again to recreate the
+	// clients after an authentication error.
+	connect func(ctx context.Context) error
+
+	// Port is the port of every target. When zero, DefaultPort is used.
+	Port int
+}
+
+// NewService returns a Service initialized with Batch and Compute API clients
+// authenticated by creds. The Service implements the discovery.Service
+// interface. NewService fails if the credentials are not found before ctx is
+// done.
+func NewService(ctx context.Context, project string, creds credentials.Config) (*Service, error) {
+	s := &Service{project: project}
+	s.connect = func(ctx context.Context) error {
+		client, err := creds.Client(ctx, compute.CloudPlatformScope)
+		if err != nil {
+			return fmt.Errorf("Error setting up API clients: %s", err)
+		}
+		client = apilimit.Client(client)
+		c, err := newComputeClient(client)
+		if err != nil {
+			return fmt.Errorf("Error setting up Compute client: %s", err)
+		}
+		s.api = iface.NewBatch(project, client, iface.BasePath)
+		s.compute = giface.NewCompute(c)
+		return nil
+	}
+	if err := s.connect(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Discover lists the jobs of every location, and returns a target for the
+// primary internal address of every running VM of a scheduled or running job.
+// After an authentication error, Discover recreates its clients and tries once
+// more.
+func (s *Service) Discover(ctx context.Context) ([]discovery.StaticConfig, error) {
+	var targets []discovery.StaticConfig
+	err := credentials.Retry(ctx, "batch", s.connect, func() error {
+		var err error
+		targets, err = s.discover(ctx)
+		return err
+	})
+	return targets, err
+}
+
+// discover lists every job and VM once.
+func (s *Service) discover(ctx context.Context) ([]discovery.StaticConfig, error) {
+	jobs := map[string]*iface.Job{}
+	states := map[string]int{}
+	err := s.api.JobPages(ctx, func(list *iface.ListJobsResponse) error {
+		discovery.CountScanned(ctx, "jobs", len(list.Jobs))
+		for _, job := range list.Jobs {
+			state := "STATE_UNSPECIFIED"
+			if job.Status != nil && job.Status.State != "" {
+				state = job.Status.State
+			}
+			states[state]++
+			if !activeStates[state] {
+				discovery.Decide(ctx, job.Name, false, "job "+state)
+				continue
+			}
+			jobs[job.Uid] = job
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	JobCount.Reset()
+	for state, n := range states {
+		JobCount.WithLabelValues(state).Set(float64(n))
+	}
+	targets := []discovery.StaticConfig{}
+	if len(jobs) == 0 {
+		return targets, nil
+	}
+
+	var instances []*compute.Instance
+	err = s.compute.InstancePages(ctx, s.project, filter(), func(list *compute.InstanceAggregatedList) error {
+		// Sort scopes, so targets are returned in a stable order.
+		scopes := make([]string, 0, len(list.Items))
+		for scope := range list.Items {
+			scopes = append(scopes, scope)
+		}
+		sort.Strings(scopes)
+		for _, scope := range scopes {
+			instances = append(instances, list.Items[scope].Instances...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	discovery.CountScanned(ctx, "instances", len(instances))
+
+	for _, instance := range instances {
+		zone := path.Base(instance.Zone)
+		object := zone + "/" + instance.Name
+		job, ok := jobs[instance.Labels[jobUIDLabel]]
+		if !ok {
+			discovery.Decide(ctx, object, false, "job not active")
+			continue
+		}
+		if instance.Status != "RUNNING" {
+			discovery.Decide(ctx, object, false, "instance "+instance.Status)
+			continue
+		}
+		if len(instance.NetworkInterfaces) == 0 || instance.NetworkInterfaces[0].NetworkIP == "" {
+			discovery.Decide(ctx, object, false, "no internal address")
+			continue
+		}
+		config := s.getLabels(job, instance, zone)
+		discovery.RecordOrigin(ctx, config, instance)
+		discovery.Decide(ctx, object, true, "VM of job "+job.Name)
+		targets = append(targets, config)
+	}
+	return targets, nil
+}
+
+// filter returns a Compute API list filter for the VMs of Batch jobs.
+func filter() string {
+	return "labels." + jobUIDLabel + ":*"
+}
+
+// getLabels creates a target configuration for the primary internal address of
+// a VM of a job.
+//
+// In serialized form, the label set look like:
+//
+//	{
+//	    "labels": {
+//	        "__batch_job": "reprocess-2021-07",
+//	        "__batch_job_uid": "reprocess-2021-07-5e1b2c3d-4e5f-6a7b",
+//	        "__batch_label_team": "data-eng",
+//	        "__batch_location": "us-central1",
+//	        "__batch_state": "RUNNING",
+//	        "__gce_instance": "reprocess-2021-07-5e1b2c3d-group0-0-x1z2",
+//	        "__gce_project": "mlab-sandbox",
+//	        "__gce_zone": "us-central1-a"
+//	    },
+//	    "targets": [
+//	        "10.128.0.9:9100"
+//	    ]
+//	}
+func (s *Service) getLabels(job *iface.Job, instance *compute.Instance, zone string) discovery.StaticConfig {
+	// Job names look like projects/p/locations/l/jobs/j.
+	location := ""
+	if parts := strings.Split(job.Name, "/"); len(parts) == 6 {
+		location = parts[3]
+	}
+	labels := map[string]string{
+		labelJob:          path.Base(job.Name),
+		labelJobUID:       job.Uid,
+		labelState:        job.Status.State,
+		labelLocation:     location,
+		gce.LabelProject:  s.project,
+		gce.LabelInstance: instance.Name,
+		gce.LabelZone:     zone,
+	}
+	for k, v := range job.Labels {
+		labels[labelPrefix+strings.ReplaceAll(k, "-", "_")] = v
+	}
+	port := s.Port
+	if port == 0 {
+		port = DefaultPort
+	}
+	return discovery.StaticConfig{
+		Targets: []string{instance.NetworkInterfaces[0].NetworkIP + ":" + strconv.Itoa(port)},
+		Labels:  labels,
+	}
+}
+
+// Check verifies access to the Batch and Compute APIs by reading the first
+// page of jobs and VMs. Check implements the discovery.Checker interface.
+func (s *Service) Check(ctx context.Context) error {
+	err := apicall.FirstPage(ctx, s.api.JobPages)
+	if err != nil {
+		return fmt.Errorf("cannot list Batch jobs in project %q; "+
+			"verify the Batch API is enabled and the credentials have the "+
+			"Batch Job Viewer role: %s", s.project, err)
+	}
+	err = apicall.FirstPage(ctx, func(ctx context.Context, f func(*compute.InstanceAggregatedList) error) error {
+		return s.compute.InstancePages(ctx, s.project, filter(), f)
+	})
+	if err != nil {
+		return fmt.Errorf("cannot list GCE instances in project %q; "+
+			"verify the Compute API is enabled and the credentials have the "+
+			"Compute Viewer role: %s", s.project, err)
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package batch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/m-lab/go/prometheusx/promtest"
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+
+	"github.com/m-lab/gcp-service-discovery/batch/iface"
+	"github.com/m-lab/gcp-service-discovery/credentials"
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/internal/schematest"
+)
+
+type fakeBatch struct {
+	jobs []*iface.Job
+	err  error
+}
+
+func (f *fakeBatch) JobPages(ctx context.Context, fn func(list *iface.ListJobsResponse) error) error {
+	if f.err != nil {
+		return f.err
+	}
+	return fn(&iface.ListJobsResponse{Jobs: f.jobs})
+}
+
+type fakeCompute struct {
+	list       []*compute.Instance
+	listFilter string
+	listErr    error
+}
+
+func (f *fakeCompute) InstanceGet(ctx context.Context, project, zone, name string) (*compute.Instance, error) {
+	return nil, &googleapi.Error{Code: http.StatusNotFound}
+}
+
+func (f *fakeCompute) FirewallList(ctx context.Context, project string) ([]*compute.Firewall, error) {
+	return nil, nil
+}
+
+func (f *fakeCompute) InstancePages(ctx context.Context, project, filter string, fn func(list *compute.InstanceAggregatedList) error) error {
+	f.listFilter = filter
+	if f.listErr != nil {
+		return f.listErr
+	}
+	return fn(&compute.InstanceAggregatedList{
+		Items: map[string]compute.InstancesScopedList{"zones/us-central1-a": {Instances: f.list}},
+	})
+}
+
+func newFakeJobs() []*iface.Job {
+	return []*iface.Job{
+		{
+			Name:   "projects/mlab-sandbox/locations/us-central1/jobs/reprocess",
+			Uid:    "reprocess-1a2b",
+			Labels: map[string]string{"data-team": "etl"},
+			Status: &iface.JobStatus{State: "RUNNING"},
+		},
+		{
+			Name:   "projects/mlab-sandbox/locations/us-central1/jobs/finished",
+			Uid:    "finished-3c4d",
+			Status: &iface.JobStatus{State: "SUCCEEDED"},
+		},
+	}
+}
+
+func newFakeInstances() []*compute.Instance {
+	return []*compute.Instance{
+		{
+			Name:   "reprocess-1a2b-group0-0-abcd",
+			Zone:   "https://www.googleapis.com/compute/v1/projects/mlab-sandbox/zones/us-central1-a",
+			Status: "RUNNING",
+			Labels: map[string]string{jobUIDLabel: "reprocess-1a2b"},
+			NetworkInterfaces: []*compute.NetworkInterface{
+				{NetworkIP: "10.128.0.9"},
+			},
+		},
+		{
+			Name:   "reprocess-1a2b-group0-1-efgh",
+			Zone:   "zones/us-central1-a",
+			Status: "STAGING",
+			Labels: map[string]string{jobUIDLabel: "reprocess-1a2b"},
+		},
+		{
+			Name:   "finished-3c4d-group0-0-ijkl",
+			Zone:   "zones/us-central1-a",
+			Status: "RUNNING",
+			Labels: map[string]string{jobUIDLabel: "finished-3c4d"},
+			NetworkInterfaces: []*compute.NetworkInterface{
+				{NetworkIP: "10.128.0.10"},
+			},
+		},
+	}
+}
+
+func TestService_Discover(t *testing.T) {
+	tests := []struct {
+		name       string
+		api        *fakeBatch
+		compute    *fakeCompute
+		port       int
+		want       []discovery.StaticConfig
+		wantFilter string
+		wantErr    bool
+	}{
+		{
+			name:    "success",
+			api:     &fakeBatch{jobs: newFakeJobs()},
+			compute: &fakeCompute{list: newFakeInstances()},
+			port:    9090,
+			want: []discovery.StaticConfig{
+				{
+					Targets: []string{"10.128.0.9:9090"},
+					Labels: map[string]string{
+						"__batch_job":             "reprocess",
+						"__batch_job_uid":         "reprocess-1a2b",
+						"__batch_state":           "RUNNING",
+						"__batch_location":        "us-central1",
+						"__batch_label_data_team": "etl",
+						"__gce_project":           "mlab-sandbox",
+						"__gce_instance":          "reprocess-1a2b-group0-0-abcd",
+						"__gce_zone":              "us-central1-a",
+					},
+				},
+			},
+			wantFilter: "labels.batch-job-uid:*",
+		},
+		{
+			name:    "success-no-active-jobs",
+			api:     &fakeBatch{jobs: newFakeJobs()[1:]},
+			compute: &fakeCompute{list: newFakeInstances()},
+			want:    []discovery.StaticConfig{},
+		},
+		{
+			name:    "failure-jobs",
+			api:     &fakeBatch{err: fmt.Errorf("forbidden")},
+			compute: &fakeCompute{},
+			wantErr: true,
+		},
+		{
+			name:    "failure-instances",
+			api:     &fakeBatch{jobs: newFakeJobs()},
+			compute: &fakeCompute{listErr: fmt.Errorf("forbidden")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Service{project: "mlab-sandbox", api: tt.api, compute: tt.compute, Port: tt.port}
+			got, err := s.Discover(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Service.Discover() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Service.Discover() = %v, want %v", got, tt.want)
+			}
+			if err != nil {
+				return
+			}
+			if tt.compute.listFilter != tt.wantFilter {
+				t.Errorf("Service.Discover() filter = %q, want %q", tt.compute.listFilter, tt.wantFilter)
+			}
+			data, _ := json.Marshal(got)
+			if err := schematest.Validate([]byte(discovery.Schema), data); err != nil {
+				t.Errorf("Service.Discover() = %s, which does not match the schema: %v", data, err)
+			}
+		})
+	}
+}
+
+func TestService_DiscoverAuthRefresh(t *testing.T) {
+	s := &Service{
+		project: "mlab-sandbox",
+		api:     &fakeBatch{err: &googleapi.Error{Code: http.StatusUnauthorized}},
+		compute: &fakeCompute{},
+	}
+	connects := 0
+	s.connect = func(ctx context.Context) error {
+		connects++
+		s.api = &fakeBatch{jobs: newFakeJobs()}
+		s.compute = &fakeCompute{list: newFakeInstances()}
+		return nil
+	}
+	got, err := s.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("Service.Discover() error = %v", err)
+	}
+	if connects != 1 || len(got) != 1 || got[0].Targets[0] != "10.128.0.9:9100" {
+		t.Errorf("Service.Discover() connected %d times and found %v, want 1 and one target at the default port", connects, got)
+	}
+}
+
+func TestService_Check(t *testing.T) {
+	s := &Service{project: "mlab-sandbox", api: &fakeBatch{}, compute: &fakeCompute{}}
+	if err := s.Check(context.Background()); err != nil {
+		t.Errorf("Service.Check() error = %v", err)
+	}
+	s.api = &fakeBatch{err: fmt.Errorf("forbidden")}
+	if err := s.Check(context.Background()); err == nil {
+		t.Errorf("Service.Check() error = nil, want error")
+	}
+	s.api = &fakeBatch{}
+	s.compute = &fakeCompute{listErr: fmt.Errorf("forbidden")}
+	if err := s.Check(context.Background()); err == nil {
+		t.Errorf("Service.Check() error = nil, want error")
+	}
+}
+
+func TestNewService(t *testing.T) {
+	orig := newComputeClient
+	defer func() { newComputeClient = orig }()
+	if _, err := NewService(context.Background(), "mlab-sandbox", credentials.Config{}); err != nil {
+		t.Errorf("NewService() error = %v", err)
+	}
+	newComputeClient = func(client *http.Client) (*compute.Service, error) {
+		return nil, fmt.Errorf("failed to create client")
+	}
+	if _, err := NewService(context.Background(), "mlab-sandbox", credentials.Config{}); err == nil {
+		t.Errorf("NewService() error = nil, want error")
+	}
+}
+
+func TestNewBatch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/projects/mlab-sandbox/locations/-/jobs" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("pageToken") == "" {
+			fmt.Fprint(w, `{"jobs": [{"name": "projects/mlab-sandbox/locations/us-central1/jobs/a", "uid": "a-1", "status": {"state": "RUNNING"}}], "nextPageToken": "next"}`)
+			return
+		}
+		fmt.Fprint(w, `{"jobs": [{"name": "projects/mlab-sandbox/locations/us-east1/jobs/b", "uid": "b-2"}]}`)
+	}))
+	defer srv.Close()
+
+	b := iface.NewBatch("mlab-sandbox", srv.Client(), srv.URL+"/")
+	var uids []string
+	err := b.JobPages(context.Background(), func(list *iface.ListJobsResponse) error {
+		for _, job := range list.Jobs {
+			uids = append(uids, job.Uid)
+		}
+		return nil
+	})
+	if err != nil || !reflect.DeepEqual(uids, []string{"a-1", "b-2"}) {
+		t.Errorf("BatchImpl.JobPages() = %v, %v, want [a-1 b-2]", uids, err)
+	}
+
+	b = iface.NewBatch("unknown", srv.Client(), srv.URL+"/")
+	err = b.JobPages(context.Background(), func(list *iface.ListJobsResponse) error { return nil })
+	if e, ok := err.(*googleapi.Error); !ok || e.Code != http.StatusNotFound {
+		t.Errorf("BatchImpl.JobPages() error = %v, want a 404 googleapi.Error", err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	JobCount.WithLabelValues("x")
+	promtest.LintMetrics(t)
+}
@@ -0,0 +1,120 @@
+// Package iface defines an interface for accessing the Batch API. This is
+// helpful for creating testable packages.
+//
+// The google.golang.org/api module used by this repository predates the Batch
+// API, so the few Job fields used by the batch logic are decoded here from the
+// responses of the v1 REST API.
+package iface
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"google.golang.org/api/googleapi"
+
+	"github.com/m-lab/gcp-service-discovery/internal/apicall"
+)
+
+// api names the Batch API in quota metrics.
+const api = "batch"
+
+// BasePath is the URL of the Batch v1 REST API.
+const BasePath = "https://batch.googleapis.com/v1/"
+
+// jobListFields limits job list responses to the fields used by the batch
+// logic.
+const jobListFields = "nextPageToken,jobs(name,uid,labels,status/state)"
+
+// Job is a Batch job.
+type Job struct {
+	// Name is the resource name of the job, like
+	// projects/p/locations/l/jobs/j.
+	Name string `json:"name,omitempty"`
+
+	// Uid is the unique ID of the job, which labels its VMs.
+	Uid string `json:"uid,omitempty"`
+
+	// Labels are the labels of the job.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Status is the status of the job.
+	Status *JobStatus `json:"status,omitempty"`
+}
+
+// JobStatus is the status of a Batch job.
+type JobStatus struct {
+	// State is the state of the job, e.g. "SCHEDULED" or "RUNNING".
+	State string `json:"state,omitempty"`
+}
+
+// ListJobsResponse is a page of Batch jobs.
+type ListJobsResponse struct {
+	Jobs          []*Job `json:"jobs,omitempty"`
+	NextPageToken string `json:"nextPageToken,omitempty"`
+
+	googleapi.ServerResponse `json:"-"`
+}
+
+// Batch defines the interface used by the batch logic.
+type Batch interface {
+	JobPages(ctx context.Context, f func(list *ListJobsResponse) error) error
+}
+
+// BatchImpl implements the Batch interface.
+type BatchImpl struct {
+	project  string
+	client   *http.Client
+	basePath string
+}
+
+// NewBatch creates a new Batch for the given project that sends requests with
+// client to basePath, usually BasePath.
+func NewBatch(project string, client *http.Client, basePath string) *BatchImpl {
+	return &BatchImpl{project: project, client: client, basePath: basePath}
+}
+
+// JobPages lists the jobs of every location and calls the given function for
+// each "page" of results.
+func (b *BatchImpl) JobPages(ctx context.Context, f func(list *ListJobsResponse) error) error {
+	return apicall.Pages(ctx, api,
+		func(ctx context.Context, token string) (*ListJobsResponse, error) {
+			return b.list(ctx, token)
+		},
+		func(list *ListJobsResponse) (http.Header, string) {
+			return list.Header, list.NextPageToken
+		},
+		f)
+}
+
+// list requests one page of jobs, like the Do method of a generated call.
+func (b *BatchImpl) list(ctx context.Context, token string) (*ListJobsResponse, error) {
+	params := url.Values{"fields": {jobListFields}}
+	if token != "" {
+		params.Set("pageToken", token)
+	}
+	u := b.basePath + "projects/" + url.PathEscape(b.project) + "/locations/-/jobs?" + params.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer googleapi.CloseBody(resp)
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return nil, err
+	}
+	list := &ListJobsResponse{
+		ServerResponse: googleapi.ServerResponse{
+			Header:         resp.Header,
+			HTTPStatusCode: resp.StatusCode,
+		},
+	}
+	if err := json.NewDecoder(resp.Body).Decode(list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
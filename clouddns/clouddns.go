@@ -0,0 +1,236 @@
+// Package clouddns publishes discovered targets as records in a Cloud DNS
+// managed zone, so people and tools other than Prometheus can reach a fleet by
+// stable names.
+//
+// For a record name like "gke.example.com.", every pass maintains:
+//   - A and AAAA records at gke.example.com. with the addresses of all targets.
+//   - An A or AAAA record for each target address, e.g. 10-0-0-1.gke.example.com.
+//   - SRV records at _prometheus._tcp.gke.example.com. for every target port.
+//   - TXT ownership records at every name, like external-dns, so that only
+//     records created by this Writer are changed or removed.
+package clouddns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/oauth2/google"
+	dns "google.golang.org/api/dns/v1"
+
+	"github.com/m-lab/gcp-service-discovery/apilimit"
+	"github.com/m-lab/gcp-service-discovery/clouddns/iface"
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/transport"
+)
+
+// Scheme is the URL scheme of Cloud DNS outputs, which name the project,
+// managed zone, and record name, e.g.
+//
+//	clouddns://mlab-sandbox/prometheus-zone/gke.example.com?ttl=60&owner=prod
+const Scheme = "clouddns"
+
+// DefaultTTL is the record TTL, in seconds, used when the output URL does not
+// set ttl.
+const DefaultTTL = 300
+
+// srvPrefix is the prefix of SRV record names.
+const srvPrefix = "_prometheus._tcp."
+
+// Writer maintains records in a managed zone for the targets of a source.
+// Writer implements the discovery.Writer interface.
+type Writer struct {
+	api     iface.DNS
+	project string
+	zone    string
+	name    string
+	ttl     int64
+	owner   string
+}
+
+// New creates a Writer for the project, managed zone, and record name of a URL
+// with the Scheme. New is a discovery.WriterFactory.
+func New(u *url.URL) (discovery.Writer, error) {
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if u.Host == "" || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("clouddns output must name a project, zone, and record: %q", u.String())
+	}
+	ttl := int64(DefaultTTL)
+	if v := u.Query().Get("ttl"); v != "" {
+		var err error
+		ttl, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid ttl: %q", v)
+		}
+	}
+	owner := u.Query().Get("owner")
+	if owner == "" {
+		owner = "default"
+	}
+	client, err := google.DefaultClient(transport.Context(context.Background()), dns.NdevClouddnsReadwriteScope)
+	if err != nil {
+		return nil, fmt.Errorf("Error setting up Cloud DNS client: %s", err)
+	}
+	service, err := dns.New(apilimit.Client(client))
+	if err != nil {
+		return nil, fmt.Errorf("Error setting up Cloud DNS client: %s", err)
+	}
+	w := newWriter(iface.NewDNS(u.Host, parts[0], service), u.Host, parts[0], parts[1], owner)
+	w.ttl = ttl
+	return w, nil
+}
+
+func newWriter(api iface.DNS, project, zone, name, owner string) *Writer {
+	return &Writer{
+		api:     api,
+		project: project,
+		zone:    zone,
+		name:    strings.TrimSuffix(name, ".") + ".",
+		ttl:     DefaultTTL,
+		owner:   owner,
+	}
+}
+
+// String returns the output URL of the Writer.
+func (w *Writer) String() string {
+	return Scheme + "://" + w.project + "/" + w.zone + "/" + strings.TrimSuffix(w.name, ".")
+}
+
+// key identifies a record set.
+type key struct {
+	name string
+	typ  string
+}
+
+// Write reconciles the records owned by the Writer with the targets in
+// configs, using a single change to the managed zone.
+func (w *Writer) Write(ctx context.Context, configs []discovery.StaticConfig) error {
+	want, err := w.records(configs)
+	if err != nil {
+		return err
+	}
+	current, owned, err := w.current(ctx)
+	if err != nil {
+		return err
+	}
+	change := &dns.Change{}
+	for _, k := range sortedKeys(want) {
+		cur := current[k]
+		if cur != nil && cur.Ttl == want[k].Ttl && reflect.DeepEqual(cur.Rrdatas, want[k].Rrdatas) {
+			continue
+		}
+		if cur != nil && !owned[k.name] {
+			return fmt.Errorf("%s record %s exists and is not owned by %q", k.typ, k.name, w.owner)
+		}
+		if cur != nil {
+			change.Deletions = append(change.Deletions, cur)
+		}
+		change.Additions = append(change.Additions, want[k])
+	}
+	for _, k := range sortedKeys(current) {
+		if owned[k.name] && want[k] == nil {
+			change.Deletions = append(change.Deletions, current[k])
+		}
+	}
+	if len(change.Additions) == 0 && len(change.Deletions) == 0 {
+		return nil
+	}
+	return w.api.Change(ctx, change)
+}
+
+// records returns the record sets for the targets in configs.
+func (w *Writer) records(configs []discovery.StaticConfig) (map[key]*dns.ResourceRecordSet, error) {
+	want := map[key]*dns.ResourceRecordSet{}
+	add := func(name, typ, data string) {
+		k := key{name, typ}
+		if want[k] == nil {
+			want[k] = &dns.ResourceRecordSet{Name: name, Type: typ, Ttl: w.ttl}
+		}
+		for _, d := range want[k].Rrdatas {
+			if d == data {
+				return
+			}
+		}
+		want[k].Rrdatas = append(want[k].Rrdatas, data)
+	}
+	for _, config := range configs {
+		for _, target := range config.Targets {
+			host, port, err := net.SplitHostPort(target)
+			if err != nil {
+				return nil, fmt.Errorf("clouddns target %q must be ip:port: %s", target, err)
+			}
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return nil, fmt.Errorf("clouddns target %q must be an IP address", target)
+			}
+			typ := "A"
+			if ip.To4() == nil {
+				typ = "AAAA"
+			}
+			hostname := strings.NewReplacer(".", "-", ":", "-").Replace(ip.String()) + "." + w.name
+			add(w.name, typ, ip.String())
+			add(hostname, typ, ip.String())
+			add(srvPrefix+w.name, "SRV", "0 0 "+port+" "+hostname)
+		}
+	}
+	names := map[string]bool{}
+	for k := range want {
+		names[k.name] = true
+	}
+	for name := range names {
+		add(name, "TXT", w.ownerRecord())
+	}
+	for _, rr := range want {
+		sort.Strings(rr.Rrdatas)
+	}
+	return want, nil
+}
+
+// current returns the record sets in the zone at or below the record name,
+// and the names owned by the Writer.
+func (w *Writer) current(ctx context.Context) (map[key]*dns.ResourceRecordSet, map[string]bool, error) {
+	current := map[key]*dns.ResourceRecordSet{}
+	owned := map[string]bool{}
+	err := w.api.RecordsPages(ctx, func(r *dns.ResourceRecordSetsListResponse) error {
+		for _, rr := range r.Rrsets {
+			if rr.Name != w.name && !strings.HasSuffix(rr.Name, "."+w.name) {
+				continue
+			}
+			sort.Strings(rr.Rrdatas)
+			current[key{rr.Name, rr.Type}] = rr
+			if rr.Type == "TXT" && len(rr.Rrdatas) == 1 && rr.Rrdatas[0] == w.ownerRecord() {
+				owned[rr.Name] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot list records in zone %s: %s", w.zone, err)
+	}
+	return current, owned, nil
+}
+
+// ownerRecord returns the TXT data that marks names owned by the Writer.
+func (w *Writer) ownerRecord() string {
+	return strconv.Quote("heritage=gcp-service-discovery,owner=" + w.owner)
+}
+
+// sortedKeys returns the keys of records in a stable order.
+func sortedKeys(records map[key]*dns.ResourceRecordSet) []key {
+	keys := make([]key, 0, len(records))
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		return keys[i].typ < keys[j].typ
+	})
+	return keys
+}
@@ -0,0 +1,181 @@
+package clouddns
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"reflect"
+	"sort"
+	"testing"
+
+	dns "google.golang.org/api/dns/v1"
+
+	"github.com/m-lab/gcp-service-discovery/discovery"
+)
+
+// fakeDNS stores record sets in memory and applies changes like Cloud DNS.
+type fakeDNS struct {
+	records map[key]*dns.ResourceRecordSet
+	changes int
+}
+
+func (f *fakeDNS) RecordsPages(ctx context.Context, fn func(r *dns.ResourceRecordSetsListResponse) error) error {
+	r := &dns.ResourceRecordSetsListResponse{}
+	for _, rr := range f.records {
+		c := *rr
+		c.Rrdatas = append([]string{}, rr.Rrdatas...)
+		r.Rrsets = append(r.Rrsets, &c)
+	}
+	return fn(r)
+}
+
+func (f *fakeDNS) Change(ctx context.Context, change *dns.Change) error {
+	for _, rr := range change.Deletions {
+		cur := f.records[key{rr.Name, rr.Type}]
+		if cur == nil || !reflect.DeepEqual(cur.Rrdatas, rr.Rrdatas) {
+			return errors.New("deleted record does not match")
+		}
+	}
+	for _, rr := range change.Deletions {
+		delete(f.records, key{rr.Name, rr.Type})
+	}
+	for _, rr := range change.Additions {
+		if f.records[key{rr.Name, rr.Type}] != nil {
+			return errors.New("added record already exists")
+		}
+		f.records[key{rr.Name, rr.Type}] = rr
+	}
+	f.changes++
+	return nil
+}
+
+func (f *fakeDNS) data(name, typ string) []string {
+	rr := f.records[key{name, typ}]
+	if rr == nil {
+		return nil
+	}
+	d := append([]string{}, rr.Rrdatas...)
+	sort.Strings(d)
+	return d
+}
+
+func TestWriter_Write(t *testing.T) {
+	other := &dns.ResourceRecordSet{Name: "www.example.com.", Type: "A", Ttl: 60, Rrdatas: []string{"192.0.2.1"}}
+	f := &fakeDNS{records: map[key]*dns.ResourceRecordSet{{other.Name, other.Type}: other}}
+	w := newWriter(f, "mlab-sandbox", "zone", "gke.example.com", "test")
+	ctx := context.Background()
+
+	// Create records for two targets.
+	configs := []discovery.StaticConfig{{Targets: []string{"10.0.0.1:9090", "10.0.0.2:9091"}}}
+	err := w.Write(ctx, configs)
+	if err != nil {
+		t.Fatalf("Writer.Write() error = %v", err)
+	}
+	if got := f.data("gke.example.com.", "A"); !reflect.DeepEqual(got, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Errorf("Writer.Write() A = %v", got)
+	}
+	if got := f.data("10-0-0-2.gke.example.com.", "A"); !reflect.DeepEqual(got, []string{"10.0.0.2"}) {
+		t.Errorf("Writer.Write() host A = %v", got)
+	}
+	wantSRV := []string{"0 0 9090 10-0-0-1.gke.example.com.", "0 0 9091 10-0-0-2.gke.example.com."}
+	if got := f.data("_prometheus._tcp.gke.example.com.", "SRV"); !reflect.DeepEqual(got, wantSRV) {
+		t.Errorf("Writer.Write() SRV = %v, want %v", got, wantSRV)
+	}
+	if got := f.data("gke.example.com.", "TXT"); len(got) != 1 || got[0] != `"heritage=gcp-service-discovery,owner=test"` {
+		t.Errorf("Writer.Write() TXT = %v", got)
+	}
+
+	// An unchanged pass makes no changes.
+	err = w.Write(ctx, configs)
+	if err != nil || f.changes != 1 {
+		t.Errorf("Writer.Write() error = %v, changes = %d, want 1 change", err, f.changes)
+	}
+
+	// Remove a target and add an IPv6 target.
+	err = w.Write(ctx, []discovery.StaticConfig{{Targets: []string{"10.0.0.1:9090", "[2001:db8::1]:9090"}}})
+	if err != nil {
+		t.Fatalf("Writer.Write() error = %v", err)
+	}
+	if f.records[key{"10-0-0-2.gke.example.com.", "A"}] != nil || f.records[key{"10-0-0-2.gke.example.com.", "TXT"}] != nil {
+		t.Errorf("Writer.Write() did not remove records of a removed target")
+	}
+	if got := f.data("gke.example.com.", "AAAA"); !reflect.DeepEqual(got, []string{"2001:db8::1"}) {
+		t.Errorf("Writer.Write() AAAA = %v", got)
+	}
+
+	// Remove all targets.
+	err = w.Write(ctx, nil)
+	if err != nil {
+		t.Fatalf("Writer.Write() error = %v", err)
+	}
+	if len(f.records) != 1 || f.records[key{other.Name, other.Type}] == nil {
+		t.Errorf("Writer.Write() left records %v, want only %s", f.records, other.Name)
+	}
+}
+
+func TestWriter_WriteErrors(t *testing.T) {
+	foreign := &dns.ResourceRecordSet{Name: "gke.example.com.", Type: "A", Ttl: 60, Rrdatas: []string{"192.0.2.1"}}
+	tests := []struct {
+		name    string
+		targets []string
+		records []*dns.ResourceRecordSet
+	}{
+		{
+			name:    "failure-hostname",
+			targets: []string{"prometheus.example.com:9090"},
+		},
+		{
+			name:    "failure-no-port",
+			targets: []string{"10.0.0.1"},
+		},
+		{
+			name:    "failure-not-owned",
+			targets: []string{"10.0.0.1:9090"},
+			records: []*dns.ResourceRecordSet{foreign},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeDNS{records: map[key]*dns.ResourceRecordSet{}}
+			for _, rr := range tt.records {
+				f.records[key{rr.Name, rr.Type}] = rr
+			}
+			w := newWriter(f, "mlab-sandbox", "zone", "gke.example.com.", "test")
+			err := w.Write(context.Background(), []discovery.StaticConfig{{Targets: tt.targets}})
+			if err == nil {
+				t.Errorf("Writer.Write() error = nil, want error")
+			}
+			if f.changes != 0 {
+				t.Errorf("Writer.Write() made %d changes, want 0", f.changes)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+	}{
+		{
+			name:   "failure-no-zone",
+			output: "clouddns://mlab-sandbox/gke.example.com",
+		},
+		{
+			name:   "failure-bad-ttl",
+			output: "clouddns://mlab-sandbox/zone/gke.example.com?ttl=0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.output)
+			if err != nil {
+				t.Fatalf("url.Parse() error = %v", err)
+			}
+			_, err = New(u)
+			if err == nil {
+				t.Errorf("New() error = nil, want error")
+			}
+		})
+	}
+}
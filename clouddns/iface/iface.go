@@ -0,0 +1,63 @@
+// Package iface defines an interface for accessing the Cloud DNS API. This is
+// helpful for creating testable packages.
+package iface
+
+import (
+	"context"
+	"net/http"
+
+	dns "google.golang.org/api/dns/v1"
+	"google.golang.org/api/googleapi"
+
+	"github.com/m-lab/gcp-service-discovery/internal/apicall"
+)
+
+// api names the Cloud DNS API in quota metrics.
+const api = "dns"
+
+// recordFields limits record list responses to the fields used by the
+// clouddns logic.
+const recordFields = googleapi.Field("nextPageToken,rrsets(name,type,ttl,rrdatas)")
+
+// DNS defines the interface used by the clouddns logic.
+type DNS interface {
+	RecordsPages(ctx context.Context, f func(r *dns.ResourceRecordSetsListResponse) error) error
+	Change(ctx context.Context, change *dns.Change) error
+}
+
+// DNSImpl implements the DNS interface for one managed zone.
+type DNSImpl struct {
+	project string
+	zone    string
+	service *dns.Service
+}
+
+// NewDNS creates a new DNS instance for the given project and managed zone.
+func NewDNS(project, zone string, service *dns.Service) *DNSImpl {
+	return &DNSImpl{project: project, zone: zone, service: service}
+}
+
+// RecordsPages lists all record sets in the managed zone and calls the given
+// function for each "page" of results.
+func (d *DNSImpl) RecordsPages(ctx context.Context, f func(r *dns.ResourceRecordSetsListResponse) error) error {
+	return apicall.Pages(ctx, api,
+		func(ctx context.Context, token string) (*dns.ResourceRecordSetsListResponse, error) {
+			return d.service.ResourceRecordSets.List(d.project, d.zone).Fields(recordFields).PageToken(token).Context(ctx).Do()
+		},
+		func(r *dns.ResourceRecordSetsListResponse) (http.Header, string) {
+			return r.ServerResponse.Header, r.NextPageToken
+		},
+		f)
+}
+
+// Change applies the additions and deletions of change to the managed zone.
+// Cloud DNS applies all changes together, or none. Changes are not retried,
+// since a repeated change fails if the first one was applied.
+func (d *DNSImpl) Change(ctx context.Context, change *dns.Change) error {
+	_, err := apicall.Once(ctx, api,
+		func(ctx context.Context) (*dns.Change, error) {
+			return d.service.Changes.Create(d.project, d.zone, change).Context(ctx).Do()
+		},
+		func(r *dns.Change) http.Header { return r.ServerResponse.Header })
+	return err
+}
@@ -0,0 +1,57 @@
+// decrypt_labels reads a target configuration file written by
+// gcp_service_discovery with encrypted label values, decrypts the values using
+// Cloud KMS, and writes the plain target configuration.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/dchest/safefile"
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/labelcrypt"
+)
+
+var (
+	key     = flag.String("kms-key", "", "Cloud KMS key resource name used to encrypt label values.")
+	input   = flag.String("input", "", "Read encrypted targets configuration from given filename.")
+	output  = flag.String("output", "", "Write decrypted targets configuration to given filename. Default is stdout.")
+	timeout = flag.Duration("timeout", time.Minute, "Maximum time allowed for decryption.")
+)
+
+func main() {
+	flag.Parse()
+	if *key == "" || *input == "" {
+		flag.Usage()
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "Error: Specify a KMS key and an input file.\n")
+		os.Exit(1)
+	}
+
+	data, err := ioutil.ReadFile(*input)
+	rtx.Must(err, "Failed to read %q", *input)
+	var configs []discovery.StaticConfig
+	rtx.Must(json.Unmarshal(data, &configs), "Failed to parse %q", *input)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	d, err := labelcrypt.NewDecrypter(ctx, *key)
+	rtx.Must(err, "Failed to create decrypter")
+
+	rtx.Must(d.Decrypt(ctx, configs), "Failed to decrypt %q", *input)
+
+	data, err = json.MarshalIndent(configs, "", "    ")
+	rtx.Must(err, "Failed to marshal StaticConfig")
+	if *output == "" {
+		fmt.Println(string(data))
+		return
+	}
+	rtx.Must(safefile.WriteFile(*output, data, 0644), "Failed to write %q", *output)
+}
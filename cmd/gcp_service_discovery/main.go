@@ -6,38 +6,208 @@
 //  * App Engine Admin API - find AE Flex instances.
 //  * Container Engine API - find clusters annotated for federation scraping.
 //  * Generic HTTP(s) sources - download a pre-generated service discovery file.
+//  * External commands - run a command that prints a service discovery file.
+//  * HTTP push - accept service discovery files pushed by external systems.
+//
+// Other binaries may embed the same discovery using the runner package.
 package main
 
 import (
 	"context"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/m-lab/go/flagx"
 	"github.com/m-lab/go/prometheusx"
-	"github.com/m-lab/go/rtx"
 
 	"github.com/m-lab/gcp-service-discovery/aeflex"
+	"github.com/m-lab/gcp-service-discovery/batch"
+	"github.com/m-lab/gcp-service-discovery/credentials"
 	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/gce"
 	"github.com/m-lab/gcp-service-discovery/gke"
+	"github.com/m-lab/gcp-service-discovery/internal/apicall"
+	"github.com/m-lab/gcp-service-discovery/labeljoin"
+	"github.com/m-lab/gcp-service-discovery/push"
+	"github.com/m-lab/gcp-service-discovery/runner"
+	"github.com/m-lab/gcp-service-discovery/tpu"
+	"github.com/m-lab/gcp-service-discovery/transport"
 	"github.com/m-lab/gcp-service-discovery/web"
 )
 
 var (
 	httpSources  = flagx.StringArray{}
 	httpTargets  = flagx.StringArray{}
-	project      = flag.String("project", "", "GCP project name.")
+	kmsLabels    = flagx.StringArray{}
+	labelJoins   = labeljoin.Specs{}
+	fwRanges     = flagx.StringArray{}
+	aefApps      = flagx.StringArray{}
+	aefCreds     = credentials.Config{}
+	gkeCreds     = credentials.Config{}
+	negCreds     = credentials.Config{}
+	apiCreds     = credentials.Config{}
+	gceCreds     = credentials.Config{}
+	fnCreds      = credentials.Config{}
+	batchCreds   = credentials.Config{}
+	tpuCreds     = credentials.Config{}
+	redisCreds   = credentials.Config{}
+	vertexCreds  = credentials.Config{}
+	gceSelector  = gce.DefaultSelector
+	execSources  = flagx.StringArray{}
+	execTargets  = flagx.StringArray{}
+	execEnv      = flagx.StringArray{}
+	pushSources  = flagx.StringArray{}
+	pushTargets  = flagx.StringArray{}
+	emptyTargets = flagx.StringArray{}
+	bestEffort   = flagx.StringArray{}
+	outputOrder  = discovery.OutputOrder{}
+	durBuckets   = discovery.DurationBuckets{}
+	fleetLabels  = discovery.FleetLabels{}
+	scrapeHints  = discovery.ScrapeHints{}
+	owners       = discovery.Owners{}
+	rewrites     = discovery.AddressRewrites{}
+	maintenance  = discovery.MaintenanceWindows{}
+	gkeAnnots    = gke.Annotations{}
+	gkeCtlPlane  = gke.ControlPlane{}
+	paused       = flagx.StringArray{}
+	aefKey       = aeflex.KeyID
+	profile      = discovery.ProfilePrometheus
+	labelStyle   = discovery.LabelStyleLegacy
+	conflicts    = discovery.ConflictError
+	sanitize     = discovery.SanitizeReplace
+	faults       = apicall.Faults{}
+	project      = flag.String("project", "", "GCP project ID, or project number resolved to the ID with the Resource Manager API.")
+	projectLbls  = flag.Bool("project-labels", false, "Label the targets of -project sources with the project ID and number as __gcp_project_id and __gcp_project_number, even if -project is a project ID. Targets are always labeled when -project is a project number.")
 	aefTarget    = flag.String("aef-target", "", "Write targets configuration to given filename.")
+	aefAuditSub  = flag.String("aef-audit-subscription", "", "Refresh immediately after App Engine deployments reported by audit logs in the given Pub/Sub subscription, e.g. projects/<project>/subscriptions/<name>.")
+	aefCollapse  = flag.Bool("aef-collapse-ips", false, "Keep only the most recently started App Engine instance when instances share a VM address, e.g. during restarts.")
 	gkeTarget    = flag.String("gke-target", "", "Write targets configuration to given filename.")
+	negTarget    = flag.String("neg-target", "", "Write targets of the endpoints of zonal network endpoint groups to given filename.")
+	apiTarget    = flag.String("api-target", "", "Write targets of the hostnames of API Gateway gateways and Cloud Endpoints services to given filename.")
+	gceTarget    = flag.String("gce-target", "", "Write targets of the GCE instances selected by -gce-label to given filename.")
+	gcePort      = flag.Int("gce-port", gce.DefaultPort, "Port of the targets of GCE instances.")
+	fnTarget     = flag.String("functions-target", "", "Write targets of the trigger URLs of HTTP Cloud Functions, 1st and 2nd gen, to given filename.")
+	batchTarget  = flag.String("batch-target", "", "Write targets of the VMs of scheduled and running Batch jobs to given filename.")
+	batchPort    = flag.Int("batch-port", batch.DefaultPort, "Port of the targets of Batch job VMs.")
+	tpuTarget    = flag.String("tpu-target", "", "Write targets of the workers of ready Cloud TPU VM nodes to given filename.")
+	tpuPort      = flag.Int("tpu-port", tpu.DefaultPort, "Port of the targets of Cloud TPU VMs.")
+	redisTarget  = flag.String("redis-target", "", "Write targets of the endpoints of Memorystore for Redis instances to given filename.")
+	vertexTarget = flag.String("vertex-target", "", "Write targets of the URLs of Vertex AI endpoints with deployed models and of active Workbench instances to given filename.")
 	refresh      = flag.Duration("refresh", time.Minute, "Number of seconds between refreshing.")
+	gkeZoneTTL   = flag.Duration("gke-zone-cache-ttl", gke.DefaultZoneCacheTTL, "Time to reuse the list of compute zones. Zero lists zones on every refresh. Reloading lists zones again.")
+	gkeAggList   = flag.Bool("gke-aggregated-list", false, "List GKE clusters in all locations with one API call instead of scanning every zone.")
+	gkeProxy     = flag.Bool("gke-apiserver-proxy", false, "Emit GKE targets that scrape every annotated service through the Kubernetes API server proxy of its cluster.")
+	gkePods      = flag.Bool("gke-pods", false, "Also emit GKE targets for running pods annotated with prometheus.io/scrape=true, at the port and path of their prometheus.io/port and prometheus.io/path annotations.")
+	gkeNodes     = flag.Bool("gke-nodes", false, "Also emit GKE targets for the internal IP of every cluster node at -gke-node-port, e.g. for the node exporter.")
+	gkeNodePort  = flag.Int("gke-node-port", gke.DefaultNodePort, "Port of the targets of GKE nodes.")
+	gkeMCS       = flag.Bool("gke-mcs", false, "Add an mcs_service label to GKE targets of services exported or imported as multi-cluster services.")
+	gkeMCSDedup  = flag.Bool("gke-mcs-dedup", false, "Skip GKE services derived from a ServiceImport, which would scrape the exporting clusters twice.")
+	gkeEndpoint  = flag.Bool("gke-endpoint-labels", false, "Add the API server endpoint and CA certificate SHA-256 fingerprint of its cluster to every GKE target.")
+	readyLabel   = flag.Bool("ready-label", false, "Add a "+discovery.LabelReady+" label reporting upstream readiness to aeflex and gke targets.")
+	gkeMaxConc   = flag.Int("gke-max-concurrency", 1, "Maximum number of GKE zones, or clusters with -gke-aggregated-list, checked at the same time.")
+	gkeKubeTO    = flag.Duration("gke-kube-timeout", gke.DefaultKubeTimeout, "Timeout of every Kubernetes API call. Zero limits calls only by -max-discovery.")
+	maxParallel  = flag.Int("max-parallel-sources", 1, "Maximum number of sources that run discovery at the same time.")
+	maxAPIReqs   = flag.Int("max-api-requests", 0, "Maximum number of concurrent GCP and Kubernetes API requests across all sources. Zero is unlimited.")
+	apiRate      = flag.Float64("api-rate", 0, "Maximum number of requests per second to every GCP API across all sources. Zero is unlimited.")
+	apiBurst     = flag.Int("api-burst", 10, "Maximum burst of requests to every GCP API with -api-rate.")
+	pushTTL      = flag.Duration("push-ttl", 10*time.Minute, "Time that targets pushed to a -push-source remain valid unless pushed again.")
+	pushToken    = flag.String("push-token-file", "", "File with the bearer token required to push targets to a -push-source.")
+	execTimeout  = flag.Duration("exec-timeout", time.Minute, "Maximum run time of every -exec-source command.")
+	dialTimeout  = flag.Duration("dial-timeout", transport.DefaultDialTimeout, "Maximum time to connect to GCP, Kubernetes, and HTTP(S) sources.")
+	keepAlive    = flag.Duration("keep-alive", transport.DefaultKeepAlive, "TCP keep-alive period of connections to sources. Negative disables keep-alives.")
 	maxDiscovery = flag.Duration("max-discovery", 10*time.Minute, "Maximum time allowed for service discovery.")
+	hardDeadline = flag.Duration("hard-deadline", 0, "Maximum time to wait for the discovery of a source that ignores -max-discovery before abandoning the pass. Zero waits -max-discovery plus 1m.")
+	costAPICalls = flag.Int("cost-max-api-calls", 0, "Stretch the refresh interval of a source whose last pass made more than this many API calls, in proportion to the excess. Zero disables the limit.")
+	costDuration = flag.Duration("cost-max-duration", 0, "Stretch the refresh interval of a source whose last pass took longer than this, in proportion to the excess. Zero disables the limit.")
+	costMinIntvl = flag.Duration("cost-min-interval", 0, "Minimum refresh interval of a source stretched by -cost-max-api-calls or -cost-max-duration.")
+	costMaxIntvl = flag.Duration("cost-max-interval", time.Hour, "Maximum refresh interval of a source stretched by -cost-max-api-calls or -cost-max-duration. Zero is unlimited.")
+	setupTimeout = flag.Duration("setup-timeout", time.Minute, "Maximum time allowed to set up sources, including finding credentials.")
+	writeMeta    = flag.Bool("write-metadata", false, "Write a metadata file with the generation time alongside each target file.")
+	writeSum     = flag.Bool("write-checksum", false, "Write a SHA256 checksum file alongside each target file.")
+	writeLife    = flag.Bool("write-lifecycle", false, "Write a lifecycle file with the targets of each target file that are draining, upgrading, or deleting, for alert inhibition.")
+	httpPassthru = flag.Bool("http-passthrough", false, "Write HTTP(S) sources exactly as downloaded, after validation, instead of re-serializing them.")
+	httpResolve  = flag.Bool("http-resolve", false, "Replace the hostnames of HTTP(S) source targets with their IP addresses, labeled with the original hostname as "+web.LabelHostname+".")
+	resolveTTL   = flag.Duration("http-resolve-ttl", web.DefaultResolveTTL, "Time to reuse the address of a hostname with -http-resolve before resolving it again.")
+	resolveStale = flag.Duration("http-resolve-max-stale", web.DefaultMaxStale, "Time to keep using the address of a hostname after -http-resolve-ttl while it cannot be resolved.")
+	compact      = flag.Bool("compact", false, "Write target files as compact JSON without indentation.")
+	indent       = flag.Int("indent", 4, "Number of spaces used to indent target files.")
+	tempDir      = flag.String("temp-dir", "", "Directory for writing target files before renaming them into place. Must be on the same filesystem as the targets. Defaults to the directory of each target.")
+	anomalyPct   = flag.Float64("anomaly-threshold", 0, "Report a target count anomaly when a source finds more than this percent more or fewer targets than its recent baseline. Zero disables detection.")
+	anomalyHook  = flag.String("anomaly-webhook", "", "POST a JSON description of every target count anomaly to the given URL.")
+	allowEmpty   = flag.Bool("allow-empty", false, "Allow a refresh that finds no targets to replace a target file that has targets.")
+	maxTargets   = flag.Int("max-targets", 0, "Do not replace a target file when its source finds more than this many targets. Zero is unlimited.")
+	maxOutBytes  = flag.Int64("max-output-bytes", 0, "Do not replace a target file with one larger than this many bytes. Zero is unlimited.")
+	atomic       = flag.Bool("atomic", false, "Update all target files together after every refresh. If any source fails, no target files are updated.")
+	mirrorURL    = flag.String("mirror", "", "Replicate every output of the gcp_service_discovery instance serving on the given URL, e.g. http://discovery-1:9373, instead of discovering targets. Requires -mirror-dir.")
+	mirrorDir    = flag.String("mirror-dir", "", "Directory of outputs replicated with -mirror. Outputs keep the path of the primary output below this directory.")
+	crdOutputDir = flag.String("crd-output-dir", "", "Register sources described by DiscoverySource resources, writing targets to the given directory.")
+	crdNamespace = flag.String("crd-namespace", "", "Namespace of DiscoverySource resources. Default is all namespaces.")
+	kubeconfig   = flag.String("kubeconfig", "", "Kubeconfig for the cluster with DiscoverySource resources. Default is the in-cluster config.")
+	verify       = flag.Bool("verify", false, "Verify the checksums of all target files and exit.")
+	schema       = flag.Bool("schema", false, "Print the JSON schema of target files and exit.")
+	decisionLog  = flag.String("decision-log", "", "Append a JSON line for every object included in or excluded from discovery to the given filename.")
+	timelineSize = flag.Int("timeline-size", 0, "Number of changes of the targets of every target file served by /api/v1/diff. Zero disables the history.")
+	timelineDir  = flag.String("timeline-dir", "", "Save the changes of -timeline-size to files in the given directory, so they are kept across restarts.")
+	snapshot     = flag.String("snapshot", "", "Save the target files and state of the process serving on -prometheusx.listen-address to the given tar.gz filename, and exit.")
+	restore      = flag.String("restore", "", "Restore target files and state from the given snapshot before the first refresh.")
+	dryRun       = flag.Int("dry-run", 0, "Run discovery once without updating targets, print the labels of up to this many targets per source at every processing stage as JSON, and exit.")
+	soakTime     = flag.Duration("soak", 0, "Run discovery for the given time with a garbage collection after every pass, then exit with an error if goroutines, heap, or open files grew without bound.")
+	selfTest     = flag.Bool("selftest", false, "Verify that every source can authenticate and read from its API before starting.")
+	logUnchanged = flag.Bool("log-unchanged", false, "Log the summary of every discovery pass, including passes that add and remove no targets.")
+	enableLcycle = flag.Bool("enable-lifecycle", false, "Serve the /-/reload, /-/pause, and /-/resume handlers on -prometheusx.listen-address. Any client that can scrape metrics can use them.")
+	gceEnrich    = flag.Bool("gce-enrich", false, "Add the machine type, network tags, preemptible status, and labels of GCE instances to targets backed by them, e.g. aeflex targets.")
+	gceTTL       = flag.Duration("gce-enrich-ttl", gce.DefaultTTL, "Time to reuse the metadata of a GCE instance with -gce-enrich.")
+	labelJoinTTL = flag.Duration("label-join-ttl", labeljoin.DefaultTTL, "Time to reuse the tables of -label-join before reading them again.")
+	kmsKey       = flag.String("kms-key", "", "Cloud KMS key resource name used to encrypt the values of -kms-label labels. Requires at least one -kms-label.")
 )
 
 func init() {
 	flag.Var(&httpSources, "http-source", "Read configuration from HTTP(S) source.")
 	flag.Var(&httpTargets, "http-target", "Write HTTP(S) source to the given filename.")
+	flag.Var(&execSources, "exec-source", "Run the given command, with space separated arguments, and read configuration from its stdout.")
+	flag.Var(&execTargets, "exec-target", "Write exec source to the given filename.")
+	flag.Var(&execEnv, "exec-env", "Add KEY=value to the environment of every -exec-source command.")
+	flag.Var(&pushSources, "push-source", "Accept targets pushed to "+push.Prefix+"<name> for the given source name.")
+	flag.Var(&pushTargets, "push-target", "Write push source to the given filename.")
+	flag.Var(&kmsLabels, "kms-label", "Encrypt the values of the given label name using -kms-key, which is required.")
+	flag.Var(&labelJoins, "label-join", "Add the columns of a CSV or JSON table to targets whose value of a label matches a row, e.g. __aef_service=/etc/services.csv or __aef_service=https://example.com/services.json. May be repeated.")
+	flag.Var(&aefApps, "aef-app", "App Engine application ID discovered by the aeflex source, e.g. a domain-scoped example.com:app, or the project of an app in another region. May be repeated. Default is the -project app.")
+	flag.Var(&aefKey, "aef-instance-key", "Labels identifying the instance of aeflex targets: id for __aef_instance, ip for __aef_vm_ip, which is stable while a VM keeps its address, or both.")
+	flag.Var(&aefCreds, "aef-credentials", "Credentials of the aeflex source, e.g. file=key.json or impersonate=sa@project.iam.gserviceaccount.com. Default is Application Default Credentials.")
+	flag.Var(&gkeCreds, "gke-credentials", "Credentials of the gke source, like -aef-credentials.")
+	flag.Var(&negCreds, "neg-credentials", "Credentials of the neg source, like -aef-credentials.")
+	flag.Var(&apiCreds, "api-credentials", "Credentials of the apis source, like -aef-credentials.")
+	flag.Var(&gceCreds, "gce-credentials", "Credentials of the gce source, like -aef-credentials.")
+	flag.Var(&fnCreds, "functions-credentials", "Credentials of the functions source, like -aef-credentials.")
+	flag.Var(&batchCreds, "batch-credentials", "Credentials of the batch source, like -aef-credentials.")
+	flag.Var(&tpuCreds, "tpu-credentials", "Credentials of the tpu source, like -aef-credentials.")
+	flag.Var(&redisCreds, "redis-credentials", "Credentials of the redis source, like -aef-credentials.")
+	flag.Var(&vertexCreds, "vertex-credentials", "Credentials of the vertex source, like -aef-credentials.")
+	flag.Var(&gceSelector, "gce-label", "Scrape GCE instances with the given label, e.g. prometheus-scrape=true. A missing value matches true.")
+	flag.Var(&fwRanges, "firewall-source-range", "With -gce-enrich, label targets with probably_unreachable if firewall rules do not allow TCP connections from the given CIDR range, e.g. of Prometheus nodes. May be repeated.")
+	flag.Var(&emptyTargets, "allow-empty-target", "Allow a refresh that finds no targets to replace the given target filename. May be repeated.")
+	flag.Var(&bestEffort, "best-effort-target", "Do not fail a refresh, or systemd readiness, when the source of the given target filename fails. May be repeated.")
+	flag.Var(&outputOrder, "output-after", "Write a target file only after the given target files in every refresh, e.g. /targets/all.json=/targets/aeflex.json,/targets/gke.json. May be repeated.")
+	flag.Var(&profile, "output-profile", "Label conventions of target files: prometheus, or victoriametrics for vmagent.")
+	flag.Var(&faults, "inject-faults", "For testing only: inject faults into GCP API requests, e.g. error=0.1,delay=0.2,latency=2s,truncate=0.05 fails 10% of requests with a retriable error, delays 20% by 2s, and stops listing after 5% of pages.")
+	flag.Var(&labelStyle, "label-style", "Names of source labels: legacy, e.g. __aef_service, meta for the __meta_gcp_<source>_ prefix, e.g. __meta_gcp_aeflex_service, or both.")
+	flag.Var(&sanitize, "label-sanitize", "Handling of labels that Prometheus rejects, with names other than [a-zA-Z_][a-zA-Z0-9_]* or values that are not valid UTF-8: replace invalid characters, drop the labels, or error to keep the previous targets.")
+	flag.Var(&conflicts, "label-conflicts", "Handling of label names emitted by more than one source written to the same target: error, or rename to prefix them with the source name.")
+	flag.Var(&durBuckets, "duration-buckets", "Discovery duration histogram buckets for a source, e.g. web.Service=0.1,0.5,1,5. May be repeated.")
+	flag.Var(&fleetLabels, "fleet-labels", "Count the written targets of a source by the values of the given labels in gcp_manager_fleet_targets, e.g. aeflex.Service=__aef_service,__aef_version. May be repeated.")
+	flag.Var(&rewrites, "address-rewrite", "Rewrite the addresses of the targets of a source named by type or target filename before writing them, for Prometheus servers behind NAT or a bastion, e.g. gke.Service=from=10.0.0.0/8,to=100.64.0.0,port-offset=10000. The first matching rule of a source is used. May be repeated.")
+	flag.Var(&owners, "source-owner", "Add "+discovery.LabelOwner+", "+discovery.LabelTeam+", and "+discovery.LabelContact+" labels to the targets of a source named by type or target filename, e.g. gke.Service=team=platform,contact=platform-oncall@example.com, and report them in /api/v1/status. Labels set by the source are kept. May be repeated.")
+	flag.Var(&scrapeHints, "scrape-hints", "Add "+discovery.LabelScrapeInterval+" and "+discovery.LabelScrapeTimeout+" labels to the targets of a source, e.g. web.Service=interval=2m,timeout=90s. Labels set by the source are kept. May be repeated.")
+	flag.Var(&maintenance, "maintenance-window", "Pause discovery of a source, keeping its targets, for a duration starting at every time of a cron schedule in UTC, e.g. gke.Service=2h@0 3 * * 6. May be repeated.")
+	flag.Var(&gkeAnnots, "gke-annotation", "Scrape GKE services with the given annotation, e.g. prometheus.io/federate=true, instead of "+gke.DefaultAnnotation.String()+". A missing value matches true. May be repeated.")
+	flag.Var(&gkeCtlPlane, "gke-control-plane", "Emit GKE targets for the metrics endpoints of the given control plane components of every cluster, scraped through its API server: apiserver, scheduler, or controller-manager. Accepts a comma separated list. May be repeated.")
+	flag.Var(&paused, "pause", "Start with discovery of a source named by type or target filename paused, keeping its targets, until resumed with /-/resume, e.g. gke.Service, or "+discovery.AllServices+" for all sources. Unknown names are an error. May be repeated.")
 
 	// Override default because port is allocated from:
 	// https://github.com/prometheus/prometheus/wiki/Default-port-allocations
@@ -47,52 +217,182 @@ func init() {
 
 func main() {
 	flag.Parse()
-	manager := discovery.NewManager(*maxDiscovery)
-
-	if len(httpSources) != len(httpTargets) {
-		fmt.Fprintf(os.Stderr, "\n")
-		fmt.Fprintf(os.Stderr, "Error: http sources and targets must match.\n")
-		os.Exit(1)
+	if *snapshot != "" {
+		os.Exit(saveSnapshot(*snapshot))
+	}
+	if *schema {
+		fmt.Print(discovery.Schema)
+		return
 	}
-	if (*aefTarget != "" && *project == "") || (*gkeTarget != "" && *project == "") {
+	cfg := config()
+	if err := cfg.Validate(); err != nil {
 		flag.Usage()
 		fmt.Fprintf(os.Stderr, "\n")
-		fmt.Fprintf(os.Stderr, "Error: Specify a GCP project.\n")
+		fmt.Fprintf(os.Stderr, "Error: %s.\n", err)
 		os.Exit(1)
 	}
+	if err := runner.Run(context.Background(), cfg); err != nil {
+		log.Fatalf("Error: %s", err)
+	}
+}
 
-	// TODO(p2, soltesz): add timeout parameter to aeflex and gke NewSourceFactory.
+// config returns the runner configuration given by flags.
+func config() runner.Config {
+	costLimits := discovery.CostLimits{
+		MaxAPICalls: *costAPICalls,
+		MaxDuration: *costDuration,
+		MinInterval: *costMinIntvl,
+		MaxInterval: *costMaxIntvl,
+	}
+	return runner.Config{
+		Project:              *project,
+		ProjectLabels:        *projectLbls,
+		AEFTarget:            *aefTarget,
+		AEFApps:              aefApps,
+		AEFCredentials:       aefCreds,
+		AEFAuditSubscription: *aefAuditSub,
+		AEFInstanceKey:       aefKey,
+		AEFCollapseIPs:       *aefCollapse,
+		GKETarget:            *gkeTarget,
+		GKECredentials:       gkeCreds,
+		GKEZoneCacheTTL:      *gkeZoneTTL,
+		GKEAggregatedList:    *gkeAggList,
+		GKEAPIServerProxy:    *gkeProxy,
+		GKEPods:              *gkePods,
+		GKENodes:             *gkeNodes,
+		GKENodePort:          *gkeNodePort,
+		GKEMCS:               *gkeMCS,
+		GKEMCSDedup:          *gkeMCSDedup,
+		GKEControlPlane:      gkeCtlPlane,
+		GKEEndpointLabels:    *gkeEndpoint,
+		GKEMaxConcurrency:    *gkeMaxConc,
+		GKEKubeTimeout:       *gkeKubeTO,
+		GKEAnnotations:       gkeAnnots,
+		NEGTarget:            *negTarget,
+		NEGCredentials:       negCreds,
+		APITarget:            *apiTarget,
+		APICredentials:       apiCreds,
+		GCETarget:            *gceTarget,
+		GCECredentials:       gceCreds,
+		GCESelector:          gceSelector,
+		GCEPort:              *gcePort,
+		FunctionsTarget:      *fnTarget,
+		FunctionsCredentials: fnCreds,
+		BatchTarget:          *batchTarget,
+		BatchCredentials:     batchCreds,
+		BatchPort:            *batchPort,
+		TPUTarget:            *tpuTarget,
+		TPUCredentials:       tpuCreds,
+		TPUPort:              *tpuPort,
+		RedisTarget:          *redisTarget,
+		RedisCredentials:     redisCreds,
+		VertexTarget:         *vertexTarget,
+		VertexCredentials:    vertexCreds,
+		ReadyLabel:           *readyLabel,
+		HTTPSources:          httpSources,
+		HTTPTargets:          httpTargets,
+		HTTPPassthrough:      *httpPassthru,
+		HTTPResolve:          *httpResolve,
+		HTTPResolveTTL:       *resolveTTL,
+		HTTPResolveMaxStale:  *resolveStale,
+		ExecSources:          execSources,
+		ExecTargets:          execTargets,
+		ExecEnv:              execEnv,
+		ExecTimeout:          *execTimeout,
+		PushSources:          pushSources,
+		PushTargets:          pushTargets,
+		PushTTL:              *pushTTL,
+		PushTokenFile:        *pushToken,
+		Mirror:               *mirrorURL,
+		MirrorDir:            *mirrorDir,
+		CRDOutputDir:         *crdOutputDir,
+		CRDNamespace:         *crdNamespace,
+		Kubeconfig:           *kubeconfig,
+		GCEEnrich:            *gceEnrich,
+		GCEEnrichTTL:         *gceTTL,
+		FirewallSourceRanges: fwRanges,
+		KMSKey:               *kmsKey,
+		KMSLabels:            kmsLabels,
+		LabelJoins:           labelJoins,
+		LabelJoinTTL:         *labelJoinTTL,
+		Refresh:              *refresh,
+		MaxDiscovery:         *maxDiscovery,
+		HardDeadline:         *hardDeadline,
+		CostLimits:           costLimits,
+		SetupTimeout:         *setupTimeout,
+		MaxParallelSources:   *maxParallel,
+		MaxAPIRequests:       *maxAPIReqs,
+		APIRate:              *apiRate,
+		APIBurst:             *apiBurst,
+		Faults:               faults,
+		DialTimeout:          *dialTimeout,
+		KeepAlive:            *keepAlive,
+		WriteMetadata:        *writeMeta,
+		WriteChecksum:        *writeSum,
+		WriteLifecycle:       *writeLife,
+		Compact:              *compact,
+		Indent:               *indent,
+		TempDir:              *tempDir,
+		AnomalyThreshold:     *anomalyPct,
+		AnomalyWebhook:       *anomalyHook,
+		AllowEmpty:           *allowEmpty,
+		AllowEmptyTargets:    emptyTargets,
+		BestEffortTargets:    bestEffort,
+		OutputOrder:          outputOrder,
+		MaxTargets:           *maxTargets,
+		MaxOutputBytes:       *maxOutBytes,
+		Atomic:               *atomic,
+		DurationBuckets:      durBuckets,
+		FleetLabels:          fleetLabels,
+		ScrapeHints:          scrapeHints,
+		Owners:               owners,
+		AddressRewrites:      rewrites,
+		MaintenanceWindows:   maintenance,
+		Paused:               paused,
+		LogUnchanged:         *logUnchanged,
+		Profile:              profile,
+		LabelStyle:           labelStyle,
+		LabelConflicts:       conflicts,
+		LabelSanitize:        sanitize,
+		DecisionLog:          *decisionLog,
+		TimelineSize:         *timelineSize,
+		TimelineDir:          *timelineDir,
+		Restore:              *restore,
+		SelfTest:             *selfTest,
+		Verify:               *verify,
+		DryRun:               *dryRun,
+		Soak:                 *soakTime,
+		ListenAddress:        *prometheusx.ListenAddress,
+		EnableLifecycle:      *enableLcycle,
+		Signals:              true,
+		Systemd:              true,
+	}
+}
 
-	// Allocate every relevant source factories.
-	if *aefTarget != "" {
-		// Allocate a new authenticated client for App Engine API.
-		s, err := aeflex.NewService(*project)
-		rtx.Must(err, "Failed to create an aeflex.Service for project: %q", *project)
-		manager.Register(s, *aefTarget)
+// saveSnapshot downloads a snapshot from the admin handlers of the process
+// serving on the prometheusx listen address, and writes it to filename.
+func saveSnapshot(filename string) int {
+	addr := *prometheusx.ListenAddress
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
 	}
-	if *gkeTarget != "" {
-		// Allocate a new authenticated client for GCE & GKE API.
-		s := gke.MustNewService(*project)
-		manager.Register(s, *gkeTarget)
+	resp, err := http.Get("http://" + addr + "/api/v1/snapshot")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
 	}
-	for i := range httpSources {
-		// Allocate a new client for downloading an HTTP(S) source.
-		manager.Register(web.NewService(httpSources[i]), httpTargets[i])
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err == nil && resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
 	}
-
-	// Verify that there is at least one source factory allocated before continuing.
-	if manager.Count() == 0 {
-		flag.Usage()
-		fmt.Fprintf(os.Stderr, "\n")
-		fmt.Fprintf(os.Stderr, "Error: Specify at least one output target file.\n")
-		os.Exit(1)
+	if err == nil {
+		err = ioutil.WriteFile(filename, data, 0644)
 	}
-
-	srv := prometheusx.MustServeMetrics()
-	defer srv.Close()
-
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	// Run discovery forever.
-	manager.Run(ctx, *refresh)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	fmt.Printf("%s: OK\n", filename)
+	return 0
 }
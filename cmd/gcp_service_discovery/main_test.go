@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	appengine "google.golang.org/api/appengine/v1"
+	compute "google.golang.org/api/compute/v1"
+
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/internal/fakegcp"
+)
+
+// TestMain_dryRun runs the aeflex, gke, and GCE enrichment wiring of main
+// against fake GCP APIs.
+func TestMain_dryRun(t *testing.T) {
+	dir := t.TempDir()
+	creds := filepath.Join(dir, "creds.json")
+	err := ioutil.WriteFile(creds, []byte(`{"type": "authorized_user", "client_id": "id",
+		"client_secret": "secret", "refresh_token": "token"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", creds)
+
+	s := fakegcp.NewServer()
+	defer s.Close()
+	s.PageSize = 1
+	s.AddApp(&appengine.Application{Id: "mlab-sandbox", LocationId: "us-east1"})
+	s.AddService("mlab-sandbox", &appengine.Service{
+		Id: "etl", Name: "apps/mlab-sandbox/services/etl",
+		Split: &appengine.TrafficSplit{Allocations: map[string]float64{"v1": 1}},
+	})
+	s.AddService("mlab-sandbox", &appengine.Service{Id: "default", Name: "apps/mlab-sandbox/services/default"})
+	s.AddVersion("mlab-sandbox", "etl", &appengine.Version{
+		Id: "v1", ServingStatus: "SERVING", CreateTime: time.Now().UTC().Format(time.RFC3339),
+		Network: &appengine.Network{ForwardedPorts: []string{"9090/tcp"}},
+	})
+	for _, vm := range []string{"aef-etl-v1-a", "aef-etl-v1-b"} {
+		s.AddInstance("mlab-sandbox", "etl", "v1", &appengine.Instance{
+			Id: vm, VmIp: "10.0.0." + vm[len(vm)-1:], VmStatus: "RUNNING", VmName: vm, VmZoneName: "us-east1-b",
+		})
+		s.AddVM("mlab-sandbox", "us-east1-b", &compute.Instance{
+			Name: vm, MachineType: "zones/us-east1-b/machineTypes/e2-small",
+		})
+	}
+	s.AddZone("mlab-sandbox", &compute.Zone{Name: "us-east1-b"})
+	// The first page of services is retried.
+	s.Fail("/v1/apps/mlab-sandbox/services", 503, 1)
+	if err = s.Redirect(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Capture the dry run results written to stdout.
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	os.Args = []string{"gcp_service_discovery",
+		"-project=mlab-sandbox", "-gce-enrich", "-dry-run=10",
+		"-aef-target=" + filepath.Join(dir, "aeflex.json"),
+		"-gke-target=" + filepath.Join(dir, "gke.json"),
+	}
+	main()
+	w.Close()
+	os.Stdout = stdout
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	traces := []discovery.Trace{}
+	if err = json.Unmarshal(out, &traces); err != nil {
+		t.Fatalf("main() wrote invalid dry run results: %v\n%s", err, out)
+	}
+	targets := map[string]map[string]string{}
+	for _, tr := range traces {
+		for _, st := range tr.Stages {
+			if st.Name == discovery.StageProcessed {
+				targets[tr.Target] = st.Labels
+			}
+		}
+	}
+	if len(targets) != 2 {
+		t.Fatalf("main() dry run targets = %v, want 2 aeflex targets", targets)
+	}
+	labels := targets["10.0.0.a:9090"]
+	if labels["__aef_service"] != "etl" || labels["__gce_machine_type"] != "e2-small" ||
+		labels["__aef_location"] != "us-east1" {
+		t.Errorf("main() dry run labels = %v, want enriched aeflex labels", labels)
+	}
+}
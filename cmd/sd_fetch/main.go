@@ -0,0 +1,257 @@
+// sd_fetch downloads the target files of a gcp_service_discovery instance and
+// writes them as local files for Prometheus file_sd_configs, on hosts that do
+// not run discovery themselves.
+//
+// Targets are downloaded from the HTTP SD admin handlers of the instance, e.g.
+// http://discovery-1:9373/api/v1/targets?output=/targets/gke.json, from any
+// other HTTP(S) URL, or from Cloud Storage objects, e.g.
+// gs://bucket/targets/gke.json. Gzip compressed responses and objects are
+// decompressed. Every download is verified before the local file is replaced
+// atomically: with the X-Checksum-Sha256 header of HTTP responses when
+// present, with the MD5 hash of Cloud Storage objects, and by parsing the
+// targets.
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dchest/safefile"
+	"github.com/m-lab/go/flagx"
+	storage "google.golang.org/api/storage/v1"
+
+	"github.com/m-lab/gcp-service-discovery/admin"
+	"github.com/m-lab/gcp-service-discovery/credentials"
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/transport"
+)
+
+var (
+	sources = flagx.StringArray{}
+	outputs = flagx.StringArray{}
+	creds   = credentials.Config{}
+	refresh = flag.Duration("refresh", 0, "Time between downloads. Zero downloads every source once and exits.")
+	timeout = flag.Duration("timeout", time.Minute, "Maximum time allowed to download every source.")
+)
+
+func init() {
+	flag.Var(&sources, "source", "Download targets from the given HTTP(S) or gs:// URL. May be repeated.")
+	flag.Var(&outputs, "output", "Write the targets of the source with the same position to the given filename. May be repeated.")
+	flag.Var(&creds, "credentials", "Credentials for gs:// sources: file=<key file>, impersonate=<service account email>, or empty for Application Default Credentials.")
+}
+
+// fetcher downloads targets from HTTP(S) and Cloud Storage URLs.
+type fetcher struct {
+	client *http.Client
+
+	// storage is created by the first download from Cloud Storage.
+	storage *storage.Service
+}
+
+// fetch downloads the targets at src, verifies them, and returns them
+// decompressed.
+func (f *fetcher) fetch(ctx context.Context, src string) ([]byte, error) {
+	u, err := url.Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	switch u.Scheme {
+	case "http", "https":
+		data, err = f.fetchHTTP(ctx, src)
+	case "gs":
+		data, err = f.fetchGCS(ctx, u.Host, strings.TrimPrefix(u.Path, "/"))
+	default:
+		return nil, fmt.Errorf("unsupported source %q: want an http, https, or gs URL", src)
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err = decompress(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress %q: %w", src, err)
+	}
+	var configs []discovery.StaticConfig
+	if err = json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("invalid targets from %q: %w", src, err)
+	}
+	return data, nil
+}
+
+// fetchHTTP downloads src and verifies its checksum header, if any. Responses
+// with a gzip Content-Encoding are decompressed by the HTTP client.
+func (f *fetcher) fetchHTTP(ctx context.Context, src string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, src, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := f.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("cannot download %q: bad HTTP status code: %d: %s",
+			src, resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	if want := resp.Header.Get(admin.ChecksumHeader); want != "" {
+		sum := sha256.Sum256(data)
+		if got := hex.EncodeToString(sum[:]); got != want {
+			return nil, fmt.Errorf("%q failed the integrity check: checksum %q, want %q", src, got, want)
+		}
+	}
+	return data, nil
+}
+
+// fetchGCS downloads the stored bytes of a Cloud Storage object and verifies
+// its MD5 hash. Objects stored with a gzip Content-Encoding are returned
+// compressed, as stored.
+func (f *fetcher) fetchGCS(ctx context.Context, bucket, object string) ([]byte, error) {
+	if f.storage == nil {
+		client, err := creds.Client(ctx, storage.DevstorageReadOnlyScope)
+		if err != nil {
+			return nil, fmt.Errorf("cannot set up Cloud Storage credentials: %w", err)
+		}
+		f.storage, err = newStorage(client)
+		if err != nil {
+			return nil, fmt.Errorf("cannot set up a Cloud Storage client: %w", err)
+		}
+	}
+	obj, err := f.storage.Objects.Get(bucket, object).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read gs://%s/%s: %w", bucket, object, err)
+	}
+	call := f.storage.Objects.Get(bucket, object).Generation(obj.Generation).Context(ctx)
+	resp, err := call.Download()
+	if err != nil {
+		return nil, fmt.Errorf("cannot download gs://%s/%s: %w", bucket, object, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if obj.Md5Hash != "" {
+		sum := md5.Sum(data)
+		if got := base64.StdEncoding.EncodeToString(sum[:]); got != obj.Md5Hash {
+			return nil, fmt.Errorf("gs://%s/%s failed the integrity check: MD5 %q, want %q", bucket, object, got, obj.Md5Hash)
+		}
+	}
+	return data, nil
+}
+
+// newStorage creates a Cloud Storage client that downloads objects as stored,
+// so their MD5 hash can be verified.
+func newStorage(client *http.Client) (*storage.Service, error) {
+	c := *client
+	c.Transport = &storedEncoding{base: c.Transport}
+	return storage.New(&c)
+}
+
+// storedEncoding requests gzip encoded responses, which disables the
+// decompressive transcoding of objects stored with a gzip Content-Encoding.
+// Since the header is set explicitly, the HTTP client does not decompress the
+// responses either.
+type storedEncoding struct {
+	base http.RoundTripper
+}
+
+func (t *storedEncoding) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Accept-Encoding", "gzip")
+	return base.RoundTrip(req)
+}
+
+// decompress returns data decompressed if it is gzip compressed, and data
+// otherwise.
+func decompress(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+		return data, nil
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	return io.ReadAll(gz)
+}
+
+// update atomically replaces the named file with data, unless the file already
+// has the same contents. update returns true if the file was written.
+func update(filename string, data []byte) (bool, error) {
+	current, err := os.ReadFile(filename)
+	if err == nil && bytes.Equal(current, data) {
+		return false, nil
+	}
+	return true, safefile.WriteFile(filename, data, 0644)
+}
+
+// fetchAll downloads every source and writes its output, and returns the
+// number of sources that failed.
+func fetchAll(ctx context.Context, f *fetcher, sources, outputs []string) int {
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+	failed := 0
+	for i := range sources {
+		data, err := f.fetch(ctx, sources[i])
+		if err == nil {
+			var written bool
+			written, err = update(outputs[i], data)
+			if written && err == nil {
+				log.Printf("Updated %s from %s", outputs[i], sources[i])
+			}
+		}
+		if err != nil {
+			log.Printf("Error: %s: %s", outputs[i], err)
+			failed++
+		}
+	}
+	return failed
+}
+
+func main() {
+	flag.Parse()
+	if len(sources) == 0 || len(sources) != len(outputs) {
+		flag.Usage()
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "Error: Specify one -output for every -source.\n")
+		os.Exit(1)
+	}
+	f := &fetcher{client: &http.Client{Transport: transport.New()}}
+	ctx := context.Background()
+	if *refresh == 0 {
+		if fetchAll(ctx, f, sources, outputs) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	ticker := time.NewTicker(*refresh)
+	defer ticker.Stop()
+	for {
+		fetchAll(ctx, f, sources, outputs)
+		<-ticker.C
+	}
+}
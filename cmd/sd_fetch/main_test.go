@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	storage "google.golang.org/api/storage/v1"
+
+	"github.com/m-lab/gcp-service-discovery/admin"
+)
+
+const targets = `[{"targets": ["1.2.3.4:9090"], "labels": {"service": "fake"}}]`
+
+func gzipped(t *testing.T, s string) []byte {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	gz.Write([]byte(s))
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func Test_fetcher_fetchHTTP(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     []byte
+		checksum string
+		code     int
+		wantErr  bool
+	}{
+		{
+			name: "success",
+			body: []byte(targets),
+			code: http.StatusOK,
+		},
+		{
+			name:     "success-checksum",
+			body:     []byte(targets),
+			checksum: sha256Hex([]byte(targets)),
+			code:     http.StatusOK,
+		},
+		{
+			name: "success-gzip-file",
+			body: gzipped(t, targets),
+			code: http.StatusOK,
+		},
+		{
+			name:     "failure-checksum",
+			body:     []byte(targets),
+			checksum: sha256Hex([]byte("other")),
+			code:     http.StatusOK,
+			wantErr:  true,
+		},
+		{
+			name:    "failure-status",
+			body:    []byte("not found"),
+			code:    http.StatusNotFound,
+			wantErr: true,
+		},
+		{
+			name:    "failure-invalid-targets",
+			body:    []byte(`{"targets": []}`),
+			code:    http.StatusOK,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.checksum != "" {
+					w.Header().Set(admin.ChecksumHeader, tt.checksum)
+				}
+				w.WriteHeader(tt.code)
+				w.Write(tt.body)
+			}))
+			defer srv.Close()
+			f := &fetcher{client: srv.Client()}
+			got, err := f.fetch(context.Background(), srv.URL+"/api/v1/targets?output=/targets/gke.json")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("fetcher.fetch() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(got) != targets {
+				t.Errorf("fetcher.fetch() = %q, want %q", got, targets)
+			}
+		})
+	}
+}
+
+func Test_fetcher_fetchGCS(t *testing.T) {
+	stored := gzipped(t, targets)
+	sum := md5.Sum(stored)
+	tests := []struct {
+		name    string
+		md5     []byte
+		wantErr bool
+	}{
+		{
+			name: "success",
+			md5:  sum[:],
+		},
+		{
+			name:    "failure-md5",
+			md5:     []byte("0123456789abcdef"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/storage/v1/b/bucket/o/targets/gke.json" {
+					http.NotFound(w, r)
+					return
+				}
+				if r.URL.Query().Get("alt") == "media" {
+					if r.Header.Get("Accept-Encoding") != "gzip" {
+						t.Errorf("download Accept-Encoding = %q, want gzip", r.Header.Get("Accept-Encoding"))
+					}
+					w.Header().Set("Content-Encoding", "gzip")
+					w.Write(stored)
+					return
+				}
+				json.NewEncoder(w).Encode(&storage.Object{
+					Bucket:     "bucket",
+					Name:       "targets/gke.json",
+					Generation: 1,
+					Md5Hash:    base64.StdEncoding.EncodeToString(tt.md5),
+				})
+			}))
+			defer srv.Close()
+			s, err := newStorage(srv.Client())
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.BasePath = srv.URL + "/storage/v1/"
+			f := &fetcher{client: srv.Client(), storage: s}
+			got, err := f.fetch(context.Background(), "gs://bucket/targets/gke.json")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("fetcher.fetch() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(got) != targets {
+				t.Errorf("fetcher.fetch() = %q, want %q", got, targets)
+			}
+		})
+	}
+}
+
+func Test_update(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "gke.json")
+	for i, want := range []bool{true, false} {
+		written, err := update(filename, []byte(targets))
+		if err != nil || written != want {
+			t.Errorf("update() #%d = %v, %v; want %v, nil", i, written, err, want)
+		}
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil || string(data) != targets {
+		t.Errorf("update() wrote %q, %v; want %q", data, err, targets)
+	}
+}
+
+func Test_fetchAll(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(targets))
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	f := &fetcher{client: srv.Client()}
+	failed := fetchAll(context.Background(), f,
+		[]string{srv.URL, "ftp://example.com/gke.json"},
+		[]string{filepath.Join(dir, "ok.json"), filepath.Join(dir, "failed.json")})
+	if failed != 1 {
+		t.Errorf("fetchAll() = %d, want 1", failed)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "failed.json")); !os.IsNotExist(err) {
+		t.Errorf("fetchAll() wrote the output of a failed source: %v", err)
+	}
+}
@@ -0,0 +1,280 @@
+// Package consul publishes discovered targets as services registered with a
+// Consul agent, so tools that resolve dependencies using Consul share the same
+// source of truth as Prometheus.
+//
+// Every target is registered as an instance of a single Consul service, with
+// tags derived from the target labels and a TTL health check that passes after
+// every successful write. Registrations of removed targets are deregistered.
+// If gcp-service-discovery stops, the checks become critical and Consul
+// deregisters the instances after the deregister_after period.
+package consul
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/transport"
+)
+
+// Scheme is the URL scheme of Consul outputs, which name the agent address
+// and service, e.g.
+//
+//	consul://localhost:8500/gke?ttl=5m&deregister_after=1h
+//
+// Set the https=true parameter to contact the agent using HTTPS. The agent ACL
+// token is read from the CONSUL_HTTP_TOKEN environment variable.
+const Scheme = "consul"
+
+// Defaults used when the output URL does not set ttl or deregister_after.
+const (
+	DefaultTTL             = 5 * time.Minute
+	DefaultDeregisterAfter = time.Hour
+)
+
+// ownerMeta is the service metadata key that identifies registrations owned by
+// a Writer. Registrations without it are never modified.
+const ownerMeta = "gcp_service_discovery"
+
+// check is a Consul agent check definition.
+type check struct {
+	TTL                            string `json:"TTL"`
+	DeregisterCriticalServiceAfter string `json:"DeregisterCriticalServiceAfter"`
+}
+
+// service is a Consul agent service definition.
+type service struct {
+	ID      string            `json:"ID"`
+	Name    string            `json:"Service"`
+	Address string            `json:"Address"`
+	Port    int               `json:"Port"`
+	Tags    []string          `json:"Tags"`
+	Meta    map[string]string `json:"Meta"`
+}
+
+// registration is the request body of /v1/agent/service/register, which names
+// the service "Name" rather than "Service".
+type registration struct {
+	ID      string
+	Name    string
+	Address string
+	Port    int
+	Tags    []string
+	Meta    map[string]string
+	Check   *check
+}
+
+// Writer registers targets as instances of a Consul service. Writer implements
+// the discovery.Writer interface.
+type Writer struct {
+	base            string
+	host            string
+	name            string
+	token           string
+	ttl             time.Duration
+	deregisterAfter time.Duration
+	client          *http.Client
+}
+
+// New creates a Writer for the agent and service named by a URL with the
+// Scheme. New is a discovery.WriterFactory.
+func New(u *url.URL) (discovery.Writer, error) {
+	name := strings.Trim(u.Path, "/")
+	if u.Host == "" || name == "" || strings.Contains(name, "/") {
+		return nil, fmt.Errorf("consul output must name an agent and a service: %q", u.String())
+	}
+	q := u.Query()
+	w := &Writer{
+		base:            "http://" + u.Host,
+		host:            u.Host,
+		name:            name,
+		token:           os.Getenv("CONSUL_HTTP_TOKEN"),
+		ttl:             DefaultTTL,
+		deregisterAfter: DefaultDeregisterAfter,
+		client:          &http.Client{Transport: transport.New(), Timeout: time.Minute},
+	}
+	if q.Get("https") == "true" {
+		w.base = "https://" + u.Host
+	}
+	for param, d := range map[string]*time.Duration{"ttl": &w.ttl, "deregister_after": &w.deregisterAfter} {
+		if v := q.Get(param); v != "" {
+			var err error
+			*d, err = time.ParseDuration(v)
+			if err != nil || *d <= 0 {
+				return nil, fmt.Errorf("invalid %s: %q", param, v)
+			}
+		}
+	}
+	return w, nil
+}
+
+// String returns the output URL of the Writer.
+func (w *Writer) String() string {
+	return Scheme + "://" + w.host + "/" + w.name
+}
+
+// Write reconciles the registered instances of the service with the targets in
+// configs, and passes the TTL check of every instance.
+func (w *Writer) Write(ctx context.Context, configs []discovery.StaticConfig) error {
+	want := map[string]*registration{}
+	for _, config := range configs {
+		for _, target := range config.Targets {
+			r, err := w.newRegistration(target, config.Labels)
+			if err != nil {
+				return err
+			}
+			want[r.ID] = r
+		}
+	}
+	current, err := w.services(ctx)
+	if err != nil {
+		return err
+	}
+	ids := []string{}
+	for id := range want {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		r := want[id]
+		if s, ok := current[id]; !ok || !equalTags(s.Tags, r.Tags) {
+			err = w.put(ctx, "/v1/agent/service/register", r)
+			if err != nil {
+				return err
+			}
+		}
+		err = w.put(ctx, "/v1/agent/check/pass/"+url.PathEscape("service:"+id), nil)
+		if err != nil {
+			return err
+		}
+	}
+	for id := range current {
+		if want[id] == nil {
+			err = w.put(ctx, "/v1/agent/service/deregister/"+url.PathEscape(id), nil)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// newRegistration returns the registration of a host:port target. Labels that
+// do not start with "__" become tags of the form "name=value".
+func (w *Writer) newRegistration(target string, labels map[string]string) (*registration, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, fmt.Errorf("consul target %q must be host:port: %s", target, err)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("consul target %q has invalid port: %s", target, err)
+	}
+	tags := []string{}
+	for k, v := range labels {
+		if !strings.HasPrefix(k, "__") {
+			tags = append(tags, k+"="+v)
+		}
+	}
+	sort.Strings(tags)
+	return &registration{
+		ID:      w.name + ":" + target,
+		Name:    w.name,
+		Address: host,
+		Port:    p,
+		Tags:    tags,
+		Meta:    map[string]string{ownerMeta: w.name},
+		Check: &check{
+			TTL:                            w.ttl.String(),
+			DeregisterCriticalServiceAfter: w.deregisterAfter.String(),
+		},
+	}, nil
+}
+
+// services returns the instances registered with the agent by this Writer.
+func (w *Writer) services(ctx context.Context) (map[string]*service, error) {
+	req, err := w.newRequest(ctx, http.MethodGet, "/v1/agent/services", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("cannot list consul services: %s", resp.Status)
+	}
+	all := map[string]*service{}
+	err = json.NewDecoder(resp.Body).Decode(&all)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse consul services: %s", err)
+	}
+	owned := map[string]*service{}
+	for id, s := range all {
+		if s.Name == w.name && s.Meta[ownerMeta] == w.name {
+			sort.Strings(s.Tags)
+			owned[id] = s
+		}
+	}
+	return owned, nil
+}
+
+// put sends a PUT request with the JSON encoded body to the agent.
+func (w *Writer) put(ctx context.Context, path string, body interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+	req, err := w.newRequest(ctx, http.MethodPut, path, data)
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("consul request %s failed: %s", path, resp.Status)
+	}
+	return nil
+}
+
+func (w *Writer) newRequest(ctx context.Context, method, path string, data []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, w.base+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if w.token != "" {
+		req.Header.Set("X-Consul-Token", w.token)
+	}
+	return req, nil
+}
+
+// equalTags returns true if the sorted tags a and b are equal.
+func equalTags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
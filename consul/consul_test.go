@@ -0,0 +1,161 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/m-lab/gcp-service-discovery/discovery"
+)
+
+// fakeAgent implements the Consul agent endpoints used by the Writer.
+type fakeAgent struct {
+	mu       sync.Mutex
+	services map[string]*service
+	passed   map[string]int
+	token    string
+}
+
+func (f *fakeAgent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.token = r.Header.Get("X-Consul-Token")
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/v1/agent/services":
+		json.NewEncoder(w).Encode(f.services)
+	case r.Method == http.MethodPut && r.URL.Path == "/v1/agent/service/register":
+		reg := registration{}
+		json.NewDecoder(r.Body).Decode(&reg)
+		f.services[reg.ID] = &service{
+			ID: reg.ID, Name: reg.Name, Address: reg.Address, Port: reg.Port, Tags: reg.Tags, Meta: reg.Meta,
+		}
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/v1/agent/service/deregister/"):
+		delete(f.services, strings.TrimPrefix(r.URL.Path, "/v1/agent/service/deregister/"))
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/v1/agent/check/pass/service:"):
+		f.passed[strings.TrimPrefix(r.URL.Path, "/v1/agent/check/pass/service:")]++
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeAgent) ids() []string {
+	ids := []string{}
+	for id := range f.services {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestWriter_Write(t *testing.T) {
+	t.Setenv("CONSUL_HTTP_TOKEN", "secret")
+	agent := &fakeAgent{
+		services: map[string]*service{
+			// A service registered by someone else must not be removed.
+			"other": {ID: "other", Name: "gke", Port: 1},
+		},
+		passed: map[string]int{},
+	}
+	srv := httptest.NewServer(agent)
+	defer srv.Close()
+
+	u, _ := url.Parse("consul://" + strings.TrimPrefix(srv.URL, "http://") + "/gke?ttl=2m")
+	w, err := New(u)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	ctx := context.Background()
+	passes := []struct {
+		name    string
+		configs []discovery.StaticConfig
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "register",
+			configs: []discovery.StaticConfig{
+				{Targets: []string{"10.0.0.1:9090", "10.0.0.2:9090"}, Labels: map[string]string{"cluster": "a", "__meta_ready": "true"}},
+			},
+			want: []string{"gke:10.0.0.1:9090", "gke:10.0.0.2:9090", "other"},
+		},
+		{
+			name: "update",
+			configs: []discovery.StaticConfig{
+				{Targets: []string{"10.0.0.2:9090", "10.0.0.3:9090"}, Labels: map[string]string{"cluster": "b"}},
+			},
+			want: []string{"gke:10.0.0.2:9090", "gke:10.0.0.3:9090", "other"},
+		},
+		{
+			name: "failure-no-port",
+			configs: []discovery.StaticConfig{
+				{Targets: []string{"10.0.0.4"}},
+			},
+			want:    []string{"gke:10.0.0.2:9090", "gke:10.0.0.3:9090", "other"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range passes {
+		err := w.Write(ctx, tt.configs)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: Writer.Write() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+		if got := agent.ids(); strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s: Writer.Write() services = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if tags := agent.services["gke:10.0.0.2:9090"].Tags; len(tags) != 1 || tags[0] != "cluster=b" {
+		t.Errorf("Writer.Write() tags = %v, want [cluster=b]", tags)
+	}
+	if agent.passed["gke:10.0.0.2:9090"] != 2 {
+		t.Errorf("Writer.Write() passed check %d times, want 2", agent.passed["gke:10.0.0.2:9090"])
+	}
+	if agent.token != "secret" {
+		t.Errorf("Writer.Write() token = %q, want secret", agent.token)
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "success",
+			output: "consul://localhost:8500/gke?https=true&deregister_after=2h",
+			want:   "consul://localhost:8500/gke",
+		},
+		{
+			name:    "failure-no-service",
+			output:  "consul://localhost:8500",
+			wantErr: true,
+		},
+		{
+			name:    "failure-bad-ttl",
+			output:  "consul://localhost:8500/gke?ttl=-1s",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.output)
+			if err != nil {
+				t.Fatalf("url.Parse() error = %v", err)
+			}
+			w, err := New(u)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && w.String() != tt.want {
+				t.Errorf("New() = %q, want %q", w.String(), tt.want)
+			}
+		})
+	}
+}
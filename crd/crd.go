@@ -0,0 +1,222 @@
+// Package crd registers discovery services described by DiscoverySource custom
+// resources in a Kubernetes cluster. Teams may add, change, or remove discovery
+// sources by applying resources, without changing command line flags.
+//
+// A DiscoverySource looks like:
+//
+//	apiVersion: gcp-service-discovery.measurementlab.net/v1alpha1
+//	kind: DiscoverySource
+//	metadata:
+//	  name: sandbox-gke
+//	spec:
+//	  type: gke
+//	  project: mlab-sandbox
+//	  output: sandbox-gke.json
+//	  annotations:
+//	  - prometheus.io/federate=true
+//	  credentials:
+//	    impersonate: discovery@mlab-sandbox.iam.gserviceaccount.com
+//
+// Outputs are file names relative to the output directory of the Controller.
+package crd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+
+	"github.com/m-lab/gcp-service-discovery/credentials"
+	"github.com/m-lab/gcp-service-discovery/discovery"
+)
+
+// Resource identifies DiscoverySource resources.
+var Resource = schema.GroupVersionResource{
+	Group:    "gcp-service-discovery.measurementlab.net",
+	Version:  "v1alpha1",
+	Resource: "discoverysources",
+}
+
+// Spec describes a single discovery source.
+type Spec struct {
+	// Type names the kind of source, e.g. "aeflex", "gke", "neg", "apis", "gce",
+	// "functions", "batch", "tpu", "redis", "vertex", or "web".
+	Type string `json:"type"`
+
+	// Project is the GCP project of aeflex and gke sources, by project ID or
+	// project number.
+	Project string `json:"project,omitempty"`
+
+	// Apps are the App Engine application IDs of aeflex sources. Default is
+	// the application of Project.
+	Apps []string `json:"apps,omitempty"`
+
+	// Credentials are the credentials of aeflex and gke sources. Default is
+	// Application Default Credentials.
+	Credentials credentials.Config `json:"credentials,omitempty"`
+
+	// URL is the address of web sources.
+	URL string `json:"url,omitempty"`
+
+	// Annotations select the services of gke sources by annotation, like
+	// -gke-annotation, e.g. "prometheus.io/federate=true". A missing value
+	// matches true. Default is the annotations of the command line.
+	Annotations []string `json:"annotations,omitempty"`
+
+	// Selector selects the instances of gce sources by label, like
+	// -gce-label, e.g. "prometheus=true". Default is the selector of the
+	// command line.
+	Selector string `json:"selector,omitempty"`
+
+	// Output is the file name, without directory, that targets are written to.
+	Output string `json:"output"`
+}
+
+// Factory creates a service for the given spec. The Factory should give up
+// when ctx is done.
+type Factory func(ctx context.Context, spec Spec) (discovery.Service, error)
+
+// Registry is the subset of the discovery.Manager interface used by the
+// Controller.
+type Registry interface {
+	Register(s discovery.Service, output string)
+	Unregister(output string) bool
+}
+
+// Controller reconciles the services registered with a Registry to match the
+// DiscoverySources in a Kubernetes cluster.
+type Controller struct {
+	client    dynamic.Interface
+	namespace string
+	outputDir string
+	registry  Registry
+	factory   Factory
+
+	// active saves the spec of every service registered by the Controller,
+	// keyed by output path.
+	active map[string]Spec
+}
+
+// NewController creates a Controller that reads DiscoverySources from the given
+// namespace, or all namespaces if empty, and writes targets to outputDir.
+// Services registered with registry by other means are not modified, so their
+// outputs must not be reused by DiscoverySources.
+func NewController(client dynamic.Interface, namespace, outputDir string, registry Registry, factory Factory) *Controller {
+	return &Controller{
+		client:    client,
+		namespace: namespace,
+		outputDir: outputDir,
+		registry:  registry,
+		factory:   factory,
+		active:    map[string]Spec{},
+	}
+}
+
+// Run reconciles every interval until ctx is canceled.
+func (c *Controller) Run(ctx context.Context, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		err := c.Reconcile(ctx)
+		if err != nil {
+			log.Printf("Failed to reconcile DiscoverySources: %s", err)
+		}
+		select {
+		case <-tick.C:
+			continue
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Reconcile lists all DiscoverySources and registers or unregisters services
+// so that every valid DiscoverySource has exactly one registered service.
+// Invalid DiscoverySources are logged and skipped.
+func (c *Controller) Reconcile(ctx context.Context) error {
+	list, err := c.client.Resource(Resource).Namespace(c.namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	desired := map[string]Spec{}
+	for i := range list.Items {
+		item := &list.Items[i]
+		spec, err := parseSpec(item)
+		if err != nil {
+			log.Printf("Skipping DiscoverySource %s/%s: %s", item.GetNamespace(), item.GetName(), err)
+			continue
+		}
+		output := filepath.Join(c.outputDir, spec.Output)
+		if _, ok := desired[output]; ok {
+			log.Printf("Skipping DiscoverySource %s/%s: duplicate output %q",
+				item.GetNamespace(), item.GetName(), spec.Output)
+			continue
+		}
+		desired[output] = spec
+	}
+
+	// Unregister services that were removed or changed.
+	for output, spec := range c.active {
+		if d, ok := desired[output]; ok && reflect.DeepEqual(d, spec) {
+			continue
+		}
+		c.registry.Unregister(output)
+		delete(c.active, output)
+		log.Printf("Unregistered %s source for %s", spec.Type, output)
+	}
+	// Register services that were added or changed.
+	for output, spec := range desired {
+		if _, ok := c.active[output]; ok {
+			continue
+		}
+		s, err := c.factory(ctx, spec)
+		if err != nil {
+			log.Printf("Failed to create %s source for %s: %s", spec.Type, output, err)
+			continue
+		}
+		c.registry.Register(s, output)
+		c.active[output] = spec
+		log.Printf("Registered %s source for %s", spec.Type, output)
+	}
+	return nil
+}
+
+// parseSpec extracts and validates the spec of the given DiscoverySource.
+func parseSpec(u *unstructured.Unstructured) (Spec, error) {
+	spec := Spec{}
+	obj, ok := u.Object["spec"]
+	if !ok {
+		return spec, fmt.Errorf("missing spec")
+	}
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return spec, err
+	}
+	err = json.Unmarshal(data, &spec)
+	if err != nil {
+		return spec, err
+	}
+	if spec.Type == "" {
+		return spec, fmt.Errorf("missing spec.type")
+	}
+	if spec.Output == "" || spec.Output != filepath.Base(spec.Output) ||
+		spec.Output == "." || spec.Output == ".." || strings.ContainsAny(spec.Output, `/\`) {
+		return spec, fmt.Errorf("invalid spec.output %q: must be a file name without directory", spec.Output)
+	}
+	if len(spec.Annotations) > 0 && spec.Type != "gke" {
+		return spec, fmt.Errorf("spec.annotations are only supported by gke sources")
+	}
+	if spec.Selector != "" && spec.Type != "gce" {
+		return spec, fmt.Errorf("spec.selector is only supported by gce sources")
+	}
+	return spec, nil
+}
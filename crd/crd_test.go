@@ -0,0 +1,132 @@
+package crd
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+
+	"github.com/m-lab/gcp-service-discovery/discovery"
+)
+
+type fakeService struct {
+	spec Spec
+}
+
+func (f *fakeService) Discover(ctx context.Context) ([]discovery.StaticConfig, error) {
+	return nil, nil
+}
+
+type fakeRegistry struct {
+	services map[string]discovery.Service
+}
+
+func (f *fakeRegistry) Register(s discovery.Service, output string) {
+	f.services[output] = s
+}
+
+func (f *fakeRegistry) Unregister(output string) bool {
+	_, ok := f.services[output]
+	delete(f.services, output)
+	return ok
+}
+
+func (f *fakeRegistry) outputs() []string {
+	o := []string{}
+	for output := range f.services {
+		o = append(o, output)
+	}
+	sort.Strings(o)
+	return o
+}
+
+func fakeFactory(ctx context.Context, spec Spec) (discovery.Service, error) {
+	if spec.Type == "unsupported" {
+		return nil, fmt.Errorf("unsupported source type")
+	}
+	return &fakeService{spec: spec}, nil
+}
+
+func newSource(name string, spec map[string]interface{}) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "gcp-service-discovery.measurementlab.net/v1alpha1",
+		"kind":       "DiscoverySource",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": "default",
+		},
+	}}
+	if spec != nil {
+		u.Object["spec"] = spec
+	}
+	return u
+}
+
+func newClient(objects ...runtime.Object) *dynamicfake.FakeDynamicClient {
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{Resource: "DiscoverySourceList"}, objects...)
+}
+
+func TestController_Reconcile(t *testing.T) {
+	gke := newSource("gke", map[string]interface{}{"type": "gke", "project": "fake", "output": "gke.json"})
+	client := newClient(
+		gke,
+		newSource("web", map[string]interface{}{"type": "web", "url": "http://fake", "output": "web.json"}),
+		newSource("no-spec", nil),
+		newSource("no-type", map[string]interface{}{"output": "x.json"}),
+		newSource("bad-output", map[string]interface{}{"type": "gke", "output": "../x.json"}),
+		newSource("duplicate", map[string]interface{}{"type": "web", "output": "web.json"}),
+		newSource("unsupported", map[string]interface{}{"type": "unsupported", "output": "u.json"}),
+		newSource("misplaced-selector", map[string]interface{}{"type": "gke", "selector": "a=b", "output": "s.json"}),
+		newSource("misplaced-annotations", map[string]interface{}{
+			"type": "web", "annotations": []interface{}{"a=b"}, "output": "a.json"}),
+	)
+	r := &fakeRegistry{services: map[string]discovery.Service{}}
+	c := NewController(client, "", "/targets", r, fakeFactory)
+
+	err := c.Reconcile(context.Background())
+	if err != nil {
+		t.Fatalf("Controller.Reconcile() error = %v", err)
+	}
+	want := []string{filepath.Join("/targets", "gke.json"), filepath.Join("/targets", "web.json")}
+	if !reflect.DeepEqual(r.outputs(), want) {
+		t.Errorf("Controller.Reconcile() registered %v, want %v", r.outputs(), want)
+	}
+	before := r.services[want[0]]
+
+	// Change the gke source and remove the web source.
+	gke.Object["spec"] = map[string]interface{}{"type": "gke", "project": "other", "output": "gke.json",
+		"apps":        []interface{}{"example.com:app"},
+		"annotations": []interface{}{"prometheus.io/federate=true"},
+		"credentials": map[string]interface{}{"impersonate": "sa@other.iam.gserviceaccount.com"}}
+	client = newClient(gke)
+	c.client = client
+	err = c.Reconcile(context.Background())
+	if err != nil {
+		t.Fatalf("Controller.Reconcile() error = %v", err)
+	}
+	if !reflect.DeepEqual(r.outputs(), want[:1]) {
+		t.Errorf("Controller.Reconcile() registered %v, want %v", r.outputs(), want[:1])
+	}
+	after := r.services[want[0]].(*fakeService)
+	if after == before || after.spec.Project != "other" || after.spec.Credentials.Impersonate != "sa@other.iam.gserviceaccount.com" ||
+		!reflect.DeepEqual(after.spec.Annotations, []string{"prometheus.io/federate=true"}) {
+		t.Errorf("Controller.Reconcile() did not replace changed source: %#v", after.spec)
+	}
+
+	// Unchanged sources are not replaced.
+	err = c.Reconcile(context.Background())
+	if err != nil {
+		t.Fatalf("Controller.Reconcile() error = %v", err)
+	}
+	if r.services[want[0]] != after {
+		t.Errorf("Controller.Reconcile() replaced an unchanged source")
+	}
+}
@@ -0,0 +1,241 @@
+// Package credentials selects the identity used by a discovery source, so
+// sources that discover different projects may use different credentials:
+// Application Default Credentials, a service account key file, or an
+// impersonated service account.
+//
+// Credentials are configured with a comma separated list of options, e.g.
+//
+//	file=/etc/keys/sandbox.json
+//	impersonate=discovery@mlab-staging.iam.gserviceaccount.com
+//	file=/etc/keys/base.json,impersonate=discovery@mlab-oti.iam.gserviceaccount.com
+//
+// An empty configuration uses Application Default Credentials.
+//
+// Tokens may stop refreshing while the process runs, e.g. when a workload
+// identity binding expires. Sources detect these failures with IsAuthError, and
+// recreate their clients with Retry.
+package credentials
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+
+	"github.com/m-lab/gcp-service-discovery/metrics"
+	"github.com/m-lab/gcp-service-discovery/transport"
+)
+
+var (
+	// AuthRefreshCount counts the clients of a source that were recreated
+	// after an authentication error.
+	//
+	// Provides metrics:
+	//   gcp_auth_refresh_total{source="aeflex"}
+	// Example usage:
+	//   AuthRefreshCount.WithLabelValues("aeflex").Inc()
+	AuthRefreshCount = metrics.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gcp_auth_refresh_total",
+			Help: "Number of times the clients of a source were recreated after an authentication error.",
+		},
+		[]string{"source"},
+	)
+)
+
+// AuthError is returned when a token source fails to return a token.
+type AuthError struct {
+	Err error
+}
+
+func (e *AuthError) Error() string {
+	return "failed to get a token: " + e.Err.Error()
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// authTokenSource returns token errors as an *AuthError.
+type authTokenSource struct {
+	ts oauth2.TokenSource
+}
+
+func (a *authTokenSource) Token() (*oauth2.Token, error) {
+	t, err := a.ts.Token()
+	if err != nil {
+		return nil, &AuthError{Err: err}
+	}
+	return t, nil
+}
+
+// IsAuthError returns true if err was caused by a failure to get a token, or
+// if an API rejected the credentials of a request.
+func IsAuthError(err error) bool {
+	var authErr *AuthError
+	if errors.As(err, &authErr) {
+		return true
+	}
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusUnauthorized
+}
+
+// Retry calls f. When f fails with an authentication error and rebuild is not
+// nil, Retry counts an auth refresh of the named source, calls rebuild to
+// recreate the clients of the source with fresh credentials, and calls f once
+// more.
+func Retry(ctx context.Context, source string, rebuild func(context.Context) error, f func() error) error {
+	err := f()
+	if rebuild == nil || !IsAuthError(err) {
+		return err
+	}
+	log.Printf("Recreating %s clients after authentication error: %s", source, err)
+	AuthRefreshCount.WithLabelValues(source).Inc()
+	if rerr := rebuild(ctx); rerr != nil {
+		return fmt.Errorf("failed to recreate clients after %w: %s", err, rerr)
+	}
+	return f()
+}
+
+// Config describes the credentials of a source. The zero Config uses
+// Application Default Credentials. Config implements the flag.Value interface.
+type Config struct {
+	// File is a service account key file. When empty, Application Default
+	// Credentials are used.
+	File string `json:"file,omitempty"`
+
+	// Impersonate is the email of a service account to impersonate, using
+	// the credentials from File or Application Default Credentials. The
+	// base identity needs the Service Account Token Creator role.
+	Impersonate string `json:"impersonate,omitempty"`
+}
+
+// Parse parses a comma separated list of key=value options. The keys are
+// "file" and "impersonate".
+func Parse(s string) (Config, error) {
+	c := Config{}
+	if s == "" {
+		return c, nil
+	}
+	for _, opt := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(opt, "=")
+		if !ok || v == "" {
+			return c, fmt.Errorf("invalid credentials option: %q", opt)
+		}
+		switch k {
+		case "file":
+			c.File = v
+		case "impersonate":
+			c.Impersonate = v
+		default:
+			return c, fmt.Errorf("unknown credentials option: %q", k)
+		}
+	}
+	return c, nil
+}
+
+// String returns the configuration in the format accepted by Parse.
+func (c *Config) String() string {
+	var opts []string
+	if c.File != "" {
+		opts = append(opts, "file="+c.File)
+	}
+	if c.Impersonate != "" {
+		opts = append(opts, "impersonate="+c.Impersonate)
+	}
+	return strings.Join(opts, ",")
+}
+
+// Set parses s and replaces the configuration.
+func (c *Config) Set(s string) error {
+	parsed, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*c = parsed
+	return nil
+}
+
+// IsDefault returns true if c uses Application Default Credentials.
+func (c Config) IsDefault() bool {
+	return c.File == "" && c.Impersonate == ""
+}
+
+// TokenSource returns a token source for the given scopes. Finding the
+// credentials may contact the metadata server or the IAM API, so TokenSource
+// returns an error when ctx is done first. The token source itself does not
+// use ctx, and remains valid after ctx is canceled. Token errors are returned
+// as an *AuthError.
+func (c Config) TokenSource(ctx context.Context, scopes ...string) (oauth2.TokenSource, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("failed to find credentials: %w", err)
+	}
+	type result struct {
+		ts  oauth2.TokenSource
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		ts, err := c.tokenSource(transport.Context(context.Background()), scopes...)
+		done <- result{ts, err}
+	}()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return nil, r.err
+		}
+		return &authTokenSource{ts: r.ts}, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("failed to find credentials: %w", ctx.Err())
+	}
+}
+
+// tokenSource finds the credentials of c. The returned token source uses ctx
+// to refresh tokens.
+func (c Config) tokenSource(ctx context.Context, scopes ...string) (oauth2.TokenSource, error) {
+	if c.Impersonate != "" {
+		var opts []option.ClientOption
+		if c.File != "" {
+			opts = append(opts, option.WithCredentialsFile(c.File))
+		}
+		cfg := impersonate.CredentialsConfig{TargetPrincipal: c.Impersonate, Scopes: scopes}
+		return impersonate.CredentialsTokenSource(ctx, cfg, opts...)
+	}
+	if c.File != "" {
+		data, err := os.ReadFile(c.File)
+		if err != nil {
+			return nil, err
+		}
+		creds, err := google.CredentialsFromJSON(ctx, data, scopes...)
+		if err != nil {
+			return nil, err
+		}
+		return creds.TokenSource, nil
+	}
+	creds, err := google.FindDefaultCredentials(ctx, scopes...)
+	if err != nil {
+		return nil, err
+	}
+	return creds.TokenSource, nil
+}
+
+// Client returns an HTTP client authenticated for the given scopes, which
+// connects using the settings of the transport package. Like TokenSource, the
+// client remains valid after ctx is canceled.
+func (c Config) Client(ctx context.Context, scopes ...string) (*http.Client, error) {
+	ts, err := c.TokenSource(ctx, scopes...)
+	if err != nil {
+		return nil, err
+	}
+	return oauth2.NewClient(transport.Context(context.Background()), ts), nil
+}
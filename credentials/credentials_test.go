@@ -0,0 +1,259 @@
+package credentials
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/m-lab/go/prometheusx/promtest"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    Config
+		wantErr bool
+	}{
+		{
+			name: "success-default",
+			s:    "",
+			want: Config{},
+		},
+		{
+			name: "success-file-and-impersonate",
+			s:    "file=/etc/keys/base.json,impersonate=sa@p.iam.gserviceaccount.com",
+			want: Config{File: "/etc/keys/base.json", Impersonate: "sa@p.iam.gserviceaccount.com"},
+		},
+		{
+			name:    "error-missing-value",
+			s:       "file=",
+			wantErr: true,
+		},
+		{
+			name:    "error-unknown-key",
+			s:       "token=abc",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Parse() = %#v, want %#v", got, tt.want)
+			}
+			if !tt.wantErr && got.String() != tt.s {
+				t.Errorf("Config.String() = %q, want %q", got.String(), tt.s)
+			}
+		})
+	}
+}
+
+func TestConfig_Set(t *testing.T) {
+	c := Config{File: "old.json"}
+	if err := c.Set("impersonate=sa@p.iam.gserviceaccount.com"); err != nil {
+		t.Fatalf("Config.Set() error = %v", err)
+	}
+	if c.File != "" || c.Impersonate != "sa@p.iam.gserviceaccount.com" || c.IsDefault() {
+		t.Errorf("Config.Set() = %#v", c)
+	}
+	if err := c.Set("bad"); err == nil {
+		t.Errorf("Config.Set() error = nil, want error")
+	}
+}
+
+func TestConfig_Client(t *testing.T) {
+	dir := t.TempDir()
+	key := filepath.Join(dir, "key.json")
+	data := `{"type":"authorized_user","client_id":"x","client_secret":"y","refresh_token":"z"}`
+	if err := os.WriteFile(key, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	bad := filepath.Join(dir, "bad.json")
+	if err := os.WriteFile(bad, []byte("not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name    string
+		c       Config
+		ctx     context.Context
+		wantErr bool
+	}{
+		{
+			name: "success-file",
+			c:    Config{File: key},
+		},
+		{
+			name: "success-impersonate",
+			c:    Config{File: key, Impersonate: "sa@p.iam.gserviceaccount.com"},
+		},
+		{
+			name:    "error-missing-file",
+			c:       Config{File: filepath.Join(dir, "missing.json")},
+			wantErr: true,
+		},
+		{
+			name:    "error-invalid-file",
+			c:       Config{File: bad},
+			wantErr: true,
+		},
+		{
+			name:    "error-canceled",
+			c:       Config{},
+			ctx:     canceled,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := tt.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			_, err := tt.c.Client(ctx, "https://www.googleapis.com/auth/cloud-platform")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Config.Client() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+type failingTokenSource struct{}
+
+func (failingTokenSource) Token() (*oauth2.Token, error) {
+	return nil, &oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusBadRequest}}
+}
+
+func TestIsAuthError(t *testing.T) {
+	_, tokenErr := (&authTokenSource{ts: failingTokenSource{}}).Token()
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{
+			name: "token",
+			err:  &url.Error{Op: "Get", URL: "https://appengine.googleapis.com/", Err: tokenErr},
+			want: true,
+		},
+		{
+			name: "unauthorized",
+			err:  fmt.Errorf("cannot list zones: %w", &googleapi.Error{Code: http.StatusUnauthorized}),
+			want: true,
+		},
+		{
+			name: "forbidden",
+			err:  &googleapi.Error{Code: http.StatusForbidden},
+		},
+		{
+			name: "other",
+			err:  errors.New("connection refused"),
+		},
+		{
+			name: "nil",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsAuthError(tt.err); got != tt.want {
+				t.Errorf("IsAuthError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetry(t *testing.T) {
+	authErr := &AuthError{Err: errors.New("token expired")}
+	tests := []struct {
+		name        string
+		errs        []error
+		rebuild     bool
+		rebuildErr  error
+		wantErr     bool
+		wantCalls   int
+		wantRebuild int
+	}{
+		{
+			name:      "success",
+			errs:      []error{nil},
+			rebuild:   true,
+			wantCalls: 1,
+		},
+		{
+			name:        "success-after-rebuild",
+			errs:        []error{authErr, nil},
+			rebuild:     true,
+			wantCalls:   2,
+			wantRebuild: 1,
+		},
+		{
+			name:      "error-other",
+			errs:      []error{errors.New("not found")},
+			rebuild:   true,
+			wantErr:   true,
+			wantCalls: 1,
+		},
+		{
+			name:      "error-without-rebuild",
+			errs:      []error{authErr},
+			wantErr:   true,
+			wantCalls: 1,
+		},
+		{
+			name:        "error-rebuild",
+			errs:        []error{authErr},
+			rebuild:     true,
+			rebuildErr:  errors.New("metadata server unavailable"),
+			wantErr:     true,
+			wantCalls:   1,
+			wantRebuild: 1,
+		},
+		{
+			name:        "error-after-rebuild",
+			errs:        []error{authErr, authErr},
+			rebuild:     true,
+			wantErr:     true,
+			wantCalls:   2,
+			wantRebuild: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls, rebuilds := 0, 0
+			var rebuild func(context.Context) error
+			if tt.rebuild {
+				rebuild = func(ctx context.Context) error {
+					rebuilds++
+					return tt.rebuildErr
+				}
+			}
+			err := Retry(context.Background(), "fake", rebuild, func() error {
+				calls++
+				return tt.errs[calls-1]
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Retry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls || rebuilds != tt.wantRebuild {
+				t.Errorf("Retry() calls = %d, rebuilds = %d, want %d and %d", calls, rebuilds, tt.wantCalls, tt.wantRebuild)
+			}
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	AuthRefreshCount.WithLabelValues("x")
+	promtest.LintMetrics(t)
+}
@@ -0,0 +1,189 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/m-lab/gcp-service-discovery/metrics"
+)
+
+// baselineWindow is the number of recent successful passes used to compute the
+// baseline target count of an output.
+const baselineWindow = 10
+
+// webhookTimeout is the maximum time to deliver an Anomaly to AnomalyWebhook.
+const webhookTimeout = 10 * time.Second
+
+var (
+	// targetAnomalies counts passes where the number of targets deviated from
+	// the baseline by more than the WithAnomalyThreshold option. The metric is labeled
+	// by the output filename.
+	//
+	// Provides metrics:
+	//   gcp_manager_target_anomalies_total{output="/targets/aeflex.json"}
+	// Usage example:
+	//   targetAnomalies.WithLabelValues("/targets/aeflex.json").Inc()
+	targetAnomalies = metrics.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gcp_manager_target_anomalies_total",
+			Help: "Number of passes where the target count deviated from the baseline.",
+		},
+		[]string{"output"},
+	)
+
+	// webhookTotal counts attempts to deliver anomalies to the webhook.
+	//
+	// Provides metrics:
+	//   gcp_manager_anomaly_webhook_total{status="success"}
+	// Usage example:
+	//   webhookTotal.WithLabelValues("success").Inc()
+	webhookTotal = metrics.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gcp_manager_anomaly_webhook_total",
+			Help: "Number of attempts to deliver anomalies to the webhook.",
+		},
+		[]string{"status"},
+	)
+)
+
+// Anomaly describes a pass where the number of targets deviated from the
+// baseline of recent passes.
+type Anomaly struct {
+	// Source is the name of the service.
+	Source string `json:"source"`
+
+	// Output is the output file of the service.
+	Output string `json:"output"`
+
+	// Time is when the anomaly was detected.
+	Time time.Time `json:"time"`
+
+	// Targets is the number of targets found by the pass.
+	Targets int `json:"targets"`
+
+	// Baseline is the mean number of targets found by recent passes.
+	Baseline float64 `json:"baseline"`
+
+	// Deviation is the change from the baseline, as a percentage.
+	Deviation float64 `json:"deviation"`
+}
+
+// baseline records the target counts of recent successful passes.
+type baseline struct {
+	counts []int
+	next   int
+}
+
+// add records the target count of one successful pass.
+func (b *baseline) add(n int) {
+	if len(b.counts) < baselineWindow {
+		b.counts = append(b.counts, n)
+		return
+	}
+	b.counts[b.next] = n
+	b.next = (b.next + 1) % baselineWindow
+}
+
+// mean returns the mean target count, or false if no passes are recorded.
+func (b *baseline) mean() (float64, bool) {
+	if len(b.counts) == 0 {
+		return 0, false
+	}
+	sum := 0
+	for _, n := range b.counts {
+		sum += n
+	}
+	return float64(sum) / float64(len(b.counts)), true
+}
+
+// deviation returns the percent change of n from the mean. A change from a
+// zero mean to any targets is reported as 100 percent.
+func (b *baseline) deviation(n int) (float64, float64, bool) {
+	mean, ok := b.mean()
+	if !ok {
+		return 0, 0, false
+	}
+	if mean == 0 {
+		if n == 0 {
+			return 0, 0, true
+		}
+		return 0, 100, true
+	}
+	return mean, 100 * (float64(n) - mean) / mean, true
+}
+
+// countTargets returns the total number of targets in configs.
+func countTargets(configs []StaticConfig) int {
+	n := 0
+	for _, config := range configs {
+		n += len(config.Targets)
+	}
+	return n
+}
+
+// checkAnomaly compares the target count of r to the baseline of its output,
+// reports an Anomaly if it deviates by more than the anomaly threshold, and adds
+// the count to the baseline. Must be called with m.mu held.
+func (m *Manager) checkAnomaly(r *result) {
+	if m.anomalyThreshold <= 0 {
+		return
+	}
+	n := countTargets(r.configs)
+	mean, dev, ok := r.reg.baseline.deviation(n)
+	r.reg.baseline.add(n)
+	if !ok || math.Abs(dev) <= m.anomalyThreshold {
+		return
+	}
+	a := Anomaly{
+		Source:    r.service,
+		Output:    r.reg.output,
+		Time:      m.clock().Now().UTC(),
+		Targets:   n,
+		Baseline:  mean,
+		Deviation: dev,
+	}
+	m.logger.Printf("Warning: %s: found %d targets, %+.1f%% from baseline of %.1f",
+		a.Output, a.Targets, a.Deviation, a.Baseline)
+	targetAnomalies.WithLabelValues(a.Output).Inc()
+	if m.anomalyWebhook != "" {
+		go m.notifyWebhook(m.anomalyWebhook, a)
+	}
+}
+
+// notifyWebhook posts the JSON encoded Anomaly to url.
+func (m *Manager) notifyWebhook(url string, a Anomaly) {
+	data, err := json.Marshal(a)
+	if err != nil {
+		// This should never happen.
+		m.logger.Printf("Error: failed to marshal anomaly: %s", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		m.logger.Printf("Error: anomaly webhook: %s", err)
+		webhookTotal.WithLabelValues("error-request").Inc()
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		m.logger.Printf("Error: anomaly webhook: %s", err)
+		webhookTotal.WithLabelValues("error-request").Inc()
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		m.logger.Printf("Error: anomaly webhook: %s", resp.Status)
+		webhookTotal.WithLabelValues("error-status").Inc()
+		return
+	}
+	webhookTotal.WithLabelValues("success").Inc()
+}
@@ -0,0 +1,103 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBaseline_deviation(t *testing.T) {
+	tests := []struct {
+		name   string
+		counts []int
+		n      int
+		want   float64
+		wantOK bool
+	}{
+		{
+			name: "empty",
+			n:    10,
+		},
+		{
+			name:   "unchanged",
+			counts: []int{10, 10},
+			n:      10,
+			wantOK: true,
+		},
+		{
+			name:   "drop",
+			counts: []int{10, 10},
+			n:      2,
+			want:   -80,
+			wantOK: true,
+		},
+		{
+			name:   "from-zero",
+			counts: []int{0},
+			n:      5,
+			want:   100,
+			wantOK: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &baseline{}
+			for _, n := range tt.counts {
+				b.add(n)
+			}
+			_, got, ok := b.deviation(tt.n)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("baseline.deviation() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestManager_checkAnomaly(t *testing.T) {
+	anomalies := make(chan Anomaly, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a := Anomaly{}
+		json.NewDecoder(r.Body).Decode(&a)
+		anomalies <- a
+	}))
+	defer srv.Close()
+
+	output := filepath.Join(t.TempDir(), "output.json")
+	m := NewManager(WithTimeout(time.Minute))
+	m.anomalyThreshold = 50
+	m.anomalyWebhook = srv.URL
+	m.Register(&fakeLiteral{}, output)
+	reg := m.registrations[0]
+
+	for _, n := range []int{10, 10, 9} {
+		err := m.commit(context.Background(), &result{reg: reg, service: "fake", configs: syntheticConfigs(n)})
+		if err != nil {
+			t.Fatalf("Manager.commit() error = %v", err)
+		}
+	}
+	if got := testutil.ToFloat64(targetAnomalies.WithLabelValues(output)); got != 0 {
+		t.Fatalf("targetAnomalies = %v, want 0", got)
+	}
+
+	err := m.commit(context.Background(), &result{reg: reg, service: "fake", configs: syntheticConfigs(2)})
+	if err != nil {
+		t.Fatalf("Manager.commit() error = %v", err)
+	}
+	if got := testutil.ToFloat64(targetAnomalies.WithLabelValues(output)); got != 1 {
+		t.Errorf("targetAnomalies = %v, want 1", got)
+	}
+	select {
+	case a := <-anomalies:
+		if a.Output != output || a.Targets != 2 {
+			t.Errorf("webhook got %#v, want 2 targets for %s", a, output)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("webhook did not receive the anomaly")
+	}
+}
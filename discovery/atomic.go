@@ -0,0 +1,89 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// atomicFile is a temporary file that atomically replaces a named file once
+// synced and renamed. Readers of the named file see either the previous or the
+// new contents, and never a partial write, even if the process crashes.
+type atomicFile struct {
+	*os.File
+	// name is the file replaced by rename.
+	name    string
+	renamed bool
+}
+
+// createAtomic creates a temporary file for replacing filename. The temporary
+// file is created in tempDir, or in the same directory as filename when tempDir
+// is empty. tempDir must be on the same filesystem as filename.
+func createAtomic(filename, tempDir string) (*atomicFile, error) {
+	if tempDir == "" {
+		tempDir = filepath.Dir(filename)
+	}
+	f, err := ioutil.TempFile(tempDir, "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return nil, fmt.Errorf("cannot create temporary file for %s: %w", filename, err)
+	}
+	// TempFile creates files readable only by the owner.
+	err = f.Chmod(0644)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("cannot set mode of %s: %w", f.Name(), err)
+	}
+	return &atomicFile{File: f, name: filename}, nil
+}
+
+// sync flushes the temporary file to stable storage and closes it.
+func (f *atomicFile) sync() error {
+	err := f.Sync()
+	if err != nil {
+		return fmt.Errorf("cannot sync %s: %w", f.Name(), err)
+	}
+	err = f.File.Close()
+	if err != nil {
+		return fmt.Errorf("cannot close %s: %w", f.Name(), err)
+	}
+	return nil
+}
+
+// rename replaces the named file with the synced temporary file.
+func (f *atomicFile) rename() error {
+	err := os.Rename(f.Name(), f.name)
+	if errors.Is(err, syscall.EXDEV) {
+		return fmt.Errorf("cannot rename %s to %s: the temporary directory "+
+			"must be on the same filesystem as the output: %w", f.Name(), f.name, err)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot rename %s to %s: %w", f.Name(), f.name, err)
+	}
+	f.renamed = true
+	return nil
+}
+
+// Close removes the temporary file, unless it was renamed. Close is safe to
+// call after rename.
+func (f *atomicFile) Close() error {
+	if f.renamed {
+		return nil
+	}
+	f.File.Close()
+	return os.Remove(f.Name())
+}
+
+// syncDir flushes the directory entry of a renamed file to stable storage.
+// Not all platforms support syncing directories, so errors are ignored.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
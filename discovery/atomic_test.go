@@ -0,0 +1,22 @@
+package discovery
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func Test_atomicFileClose(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "output.json")
+	f, err := createAtomic(filename, "")
+	if err != nil {
+		t.Fatalf("createAtomic() error = %v", err)
+	}
+	f.Write([]byte("partial"))
+	f.Close()
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 0 {
+		t.Errorf("atomicFile.Close() left %d files, want 0", len(files))
+	}
+}
@@ -0,0 +1,128 @@
+package discovery
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/m-lab/gcp-service-discovery/metrics"
+)
+
+// DurationBuckets maps service names, e.g. "web.Service", to the
+// gcp_manager_discovery_seconds histogram buckets used for that service.
+// DurationBuckets implements the flag.Value interface, so it may be set from
+// the command line with values like:
+//
+//	web.Service=0.1,0.25,0.5,1,2.5,5
+type DurationBuckets map[string][]float64
+
+// String formats the buckets as a space separated list of flag values.
+func (b DurationBuckets) String() string {
+	names := []string{}
+	for name := range b {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	values := []string{}
+	for _, name := range names {
+		bounds := []string{}
+		for _, v := range b[name] {
+			bounds = append(bounds, strconv.FormatFloat(v, 'g', -1, 64))
+		}
+		values = append(values, name+"="+strings.Join(bounds, ","))
+	}
+	return strings.Join(values, " ")
+}
+
+// Set parses a value of the form "service=bound,bound,..." and saves the
+// buckets for the named service. Bounds must be increasing.
+func (b *DurationBuckets) Set(value string) error {
+	fields := strings.SplitN(value, "=", 2)
+	if len(fields) != 2 || fields[0] == "" || fields[1] == "" {
+		return fmt.Errorf("invalid duration buckets %q: want service=bound,bound,...", value)
+	}
+	buckets := []float64{}
+	for _, s := range strings.Split(fields[1], ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil {
+			return fmt.Errorf("invalid duration bucket %q: %s", s, err)
+		}
+		if len(buckets) > 0 && v <= buckets[len(buckets)-1] {
+			return fmt.Errorf("invalid duration buckets %q: bounds must be increasing", value)
+		}
+		buckets = append(buckets, v)
+	}
+	if *b == nil {
+		*b = DurationBuckets{}
+	}
+	(*b)[fields[0]] = buckets
+	return nil
+}
+
+// defaultDurationBuckets are the discovery duration histogram buckets used for
+// services without DurationBuckets. They suit slow GKE sweeps.
+var defaultDurationBuckets = []float64{
+	10, 15, 25, 40, 60,
+	100, 150, 250, 400, 600,
+	1000, 1500, 2500, 4000, 6000,
+}
+
+func init() {
+	metrics.MustRegister(discoveryDurationHist)
+}
+
+// durationHist is a histogram labeled by service. Unlike a HistogramVec, every
+// service may use different buckets.
+type durationHist struct {
+	name string
+	help string
+
+	mu    sync.Mutex
+	hists map[string]prometheus.Histogram
+}
+
+// Describe sends no descriptors, which registers durationHist as an unchecked
+// collector. The descriptors depend on the services observed.
+func (d *durationHist) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect sends the histograms of every observed service.
+func (d *durationHist) Collect(ch chan<- prometheus.Metric) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, h := range d.hists {
+		h.Collect(ch)
+	}
+}
+
+// With returns the histogram for the named service. The histogram is created
+// with the given buckets the first time the service is observed.
+func (d *durationHist) With(service string, buckets []float64) prometheus.Observer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	h, ok := d.hists[service]
+	if !ok {
+		h = prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Name:        d.name,
+				Help:        d.help,
+				Buckets:     buckets,
+				ConstLabels: prometheus.Labels{"service": service},
+			},
+		)
+		d.hists[service] = h
+	}
+	return h
+}
+
+// observeDuration records the discovery duration of the named service.
+func (m *Manager) observeDuration(service string, seconds float64) {
+	buckets, ok := m.durationBuckets[service]
+	if !ok {
+		buckets = defaultDurationBuckets
+	}
+	discoveryDurationHist.With(service, buckets).Observe(seconds)
+}
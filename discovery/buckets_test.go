@@ -0,0 +1,104 @@
+package discovery
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestDurationBuckets_Set(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  []string
+		want    DurationBuckets
+		wantStr string
+		wantErr bool
+	}{
+		{
+			name:    "success",
+			values:  []string{"web.Service=0.1,0.5,1", "gke.Service=10,100"},
+			want:    DurationBuckets{"web.Service": {0.1, 0.5, 1}, "gke.Service": {10, 100}},
+			wantStr: "gke.Service=10,100 web.Service=0.1,0.5,1",
+		},
+		{
+			name:    "error-missing-buckets",
+			values:  []string{"web.Service"},
+			wantErr: true,
+		},
+		{
+			name:    "error-bad-float",
+			values:  []string{"web.Service=0.1,x"},
+			wantErr: true,
+		},
+		{
+			name:    "error-not-increasing",
+			values:  []string{"web.Service=1,0.5"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b DurationBuckets
+			var err error
+			for _, v := range tt.values {
+				err = b.Set(v)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DurationBuckets.Set() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(b, tt.want) {
+				t.Errorf("DurationBuckets.Set() = %v, want %v", b, tt.want)
+			}
+			if b.String() != tt.wantStr {
+				t.Errorf("DurationBuckets.String() = %q, want %q", b.String(), tt.wantStr)
+			}
+		})
+	}
+}
+
+// fakeBuckets is only used by TestManager_observeDuration, so that its custom
+// histogram does not collide with series created by other tests.
+type fakeBuckets struct {
+	fakeLiteral
+}
+
+func TestManager_observeDuration(t *testing.T) {
+	m := NewManager(WithTimeout(time.Minute))
+	m.durationBuckets = DurationBuckets{"discovery.fakeBuckets": {0.001, 0.01}}
+	m.Register(&fakeBuckets{}, filepath.Join(t.TempDir(), "output.json"))
+	m.discoverAll(context.Background())
+
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Gather() error = %v", err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != "gcp_manager_discovery_seconds" {
+			continue
+		}
+		for _, metric := range mf.GetMetric() {
+			if metric.GetLabel()[0].GetValue() != "discovery.fakeBuckets" {
+				continue
+			}
+			got := []float64{}
+			for _, b := range metric.GetHistogram().GetBucket() {
+				got = append(got, b.GetUpperBound())
+			}
+			if !reflect.DeepEqual(got, []float64{0.001, 0.01}) {
+				t.Errorf("observeDuration() buckets = %v, want [0.001 0.01]", got)
+			}
+			if metric.GetHistogram().GetSampleCount() != 1 {
+				t.Errorf("observeDuration() count = %d, want 1", metric.GetHistogram().GetSampleCount())
+			}
+			return
+		}
+	}
+	t.Errorf("observeDuration() did not export a histogram for discovery.fakeBuckets")
+}
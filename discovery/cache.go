@@ -0,0 +1,131 @@
+package discovery
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Cache wraps a Service and saves the most recent discovery result for a
+// configurable TTL. Concurrent callers share a single in-flight discovery, so
+// several consumers in one process do not each trigger separate API sweeps.
+//
+// Cache implements the Service interface. Callers must not modify the returned
+// StaticConfigs, since the same values are returned to every caller.
+type Cache struct {
+	service Service
+	ttl     time.Duration
+
+	// clk provides the time used to expire results.
+	clk Clock
+
+	mu      sync.Mutex
+	configs []StaticConfig
+	updated time.Time
+	// valid is true if configs is the result of a successful discovery,
+	// which may be nil or empty, since the most recent Invalidate.
+	valid bool
+	call  *cacheCall
+	// gen counts calls to Invalidate, so results of calls started before
+	// the most recent Invalidate are not cached.
+	gen uint64
+}
+
+// CacheOption configures a Cache created by NewCache.
+type CacheOption func(c *Cache)
+
+// WithCacheClock sets the clock used to expire cached results. The default is
+// RealClock.
+func WithCacheClock(clock Clock) CacheOption {
+	return func(c *Cache) { c.clk = clock }
+}
+
+// cacheCall represents an in-flight or completed call to Discover.
+type cacheCall struct {
+	done    chan struct{}
+	gen     uint64
+	configs []StaticConfig
+	err     error
+	// canceled is true if the context of the caller running discovery was
+	// done when it returned, so its result does not apply to other callers.
+	canceled bool
+}
+
+// NewCache creates a new Cache for the given service. Results are reused for
+// ttl after a successful discovery, even if it found no targets. Failed
+// discoveries are not cached.
+func NewCache(s Service, ttl time.Duration, opts ...CacheOption) *Cache {
+	c := &Cache{service: s, ttl: ttl}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Discover returns the cached targets if they are younger than the TTL.
+// Otherwise, Discover runs discovery on the underlying service, or waits for an
+// already running discovery to complete. If that discovery fails because the
+// context of its caller is done, Discover runs discovery again with ctx.
+func (c *Cache) Discover(ctx context.Context) ([]StaticConfig, error) {
+	for {
+		c.mu.Lock()
+		if c.valid && clockOrReal(c.clk).Now().Sub(c.updated) < c.ttl {
+			configs := c.configs
+			c.mu.Unlock()
+			return configs, nil
+		}
+		call := c.call
+		if call == nil {
+			break
+		}
+		// Another caller is running discovery; wait for it to finish.
+		c.mu.Unlock()
+		select {
+		case <-call.done:
+			if call.canceled && ctx.Err() == nil {
+				continue
+			}
+			return call.configs, call.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	call := &cacheCall{done: make(chan struct{}), gen: c.gen}
+	c.call = call
+	c.mu.Unlock()
+
+	call.configs, call.err = c.service.Discover(ctx)
+	call.canceled = call.err != nil && ctx.Err() != nil
+
+	c.mu.Lock()
+	// Results of discovery started before Invalidate may be stale.
+	if call.err == nil && call.gen == c.gen {
+		c.configs = call.configs
+		c.updated = clockOrReal(c.clk).Now()
+		c.valid = true
+	}
+	if c.call == call {
+		c.call = nil
+	}
+	c.mu.Unlock()
+	close(call.done)
+	return call.configs, call.err
+}
+
+// Invalidate discards the cached result. The next call to Discover runs
+// discovery on the underlying service, even if a discovery started before
+// Invalidate is still running.
+func (c *Cache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.configs = nil
+	c.updated = time.Time{}
+	c.valid = false
+	c.gen++
+	c.call = nil
+}
+
+// Unwrap returns the underlying Service.
+func (c *Cache) Unwrap() Service {
+	return c.service
+}
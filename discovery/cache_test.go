@@ -0,0 +1,271 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeCounter struct {
+	calls   int32
+	wait    chan struct{}
+	failing bool
+}
+
+func (f *fakeCounter) Discover(ctx context.Context) ([]StaticConfig, error) {
+	atomic.AddInt32(&f.calls, 1)
+	if f.wait != nil {
+		<-f.wait
+	}
+	if f.failing {
+		return nil, fmt.Errorf("Failed to discover")
+	}
+	return []StaticConfig{{Targets: []string{"output"}}}, nil
+}
+
+func TestCache_Discover(t *testing.T) {
+	tests := []struct {
+		name      string
+		ttl       time.Duration
+		failing   bool
+		calls     int
+		wantCalls int32
+		wantErr   bool
+	}{
+		{
+			name:      "success-cached",
+			ttl:       time.Hour,
+			calls:     3,
+			wantCalls: 1,
+		},
+		{
+			name:      "success-expired",
+			ttl:       0,
+			calls:     3,
+			wantCalls: 3,
+		},
+		{
+			name:      "failure-not-cached",
+			ttl:       time.Hour,
+			failing:   true,
+			calls:     2,
+			wantCalls: 2,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeCounter{failing: tt.failing}
+			c := NewCache(f, tt.ttl)
+			for i := 0; i < tt.calls; i++ {
+				_, err := c.Discover(context.Background())
+				if (err != nil) != tt.wantErr {
+					t.Errorf("Cache.Discover() error = %v, wantErr %v", err, tt.wantErr)
+				}
+			}
+			if f.calls != tt.wantCalls {
+				t.Errorf("Cache.Discover() calls = %d, want %d", f.calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestCache_DiscoverConcurrent(t *testing.T) {
+	f := &fakeCounter{wait: make(chan struct{})}
+	c := NewCache(f, time.Hour)
+	want := []StaticConfig{{Targets: []string{"output"}}}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := c.Discover(context.Background())
+			if err != nil || !reflect.DeepEqual(got, want) {
+				t.Errorf("Cache.Discover() = %v, %v; want %v", got, err, want)
+			}
+		}()
+	}
+	// Wait for the first caller to begin discovery before releasing it.
+	for atomic.LoadInt32(&f.calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(f.wait)
+	wg.Wait()
+	if f.calls != 1 {
+		t.Errorf("Cache.Discover() calls = %d, want 1", f.calls)
+	}
+
+	// After invalidation, the next call runs discovery again.
+	c.Invalidate()
+	c.Discover(context.Background())
+	if f.calls != 2 {
+		t.Errorf("Cache.Discover() calls = %d, want 2", f.calls)
+	}
+}
+
+func TestCache_DiscoverCanceled(t *testing.T) {
+	f := &fakeCounter{wait: make(chan struct{})}
+	c := NewCache(f, time.Hour)
+	go c.Discover(context.Background())
+	for atomic.LoadInt32(&f.calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := c.Discover(ctx)
+	if err != context.Canceled {
+		t.Errorf("Cache.Discover() error = %v, want %v", err, context.Canceled)
+	}
+	close(f.wait)
+}
+
+func Test_serviceName(t *testing.T) {
+	got := serviceName(NewCache(NewCache(&fakeLiteral{}, time.Hour), time.Hour))
+	if got != "discovery.fakeLiteral" {
+		t.Errorf("serviceName() = %q, want %q", got, "discovery.fakeLiteral")
+	}
+}
+
+func TestCache_DiscoverExpires(t *testing.T) {
+	clock := newFakeClock()
+	f := &fakeCounter{}
+	c := NewCache(f, time.Minute, WithCacheClock(clock))
+	c.Discover(context.Background())
+	clock.Advance(59 * time.Second)
+	c.Discover(context.Background())
+	if f.calls != 1 {
+		t.Errorf("Cache.Discover() before ttl calls = %d, want 1", f.calls)
+	}
+	clock.Advance(time.Second)
+	c.Discover(context.Background())
+	if f.calls != 2 {
+		t.Errorf("Cache.Discover() after ttl calls = %d, want 2", f.calls)
+	}
+}
+
+func TestCache_DiscoverEmpty(t *testing.T) {
+	// A successful discovery without targets is cached too.
+	f := &fakeEmptyCounter{}
+	c := NewCache(f, time.Hour)
+	for i := 0; i < 2; i++ {
+		configs, err := c.Discover(context.Background())
+		if err != nil || configs != nil {
+			t.Fatalf("Cache.Discover() = %v, %v, want nil, nil", configs, err)
+		}
+	}
+	if f.calls != 1 {
+		t.Errorf("Cache.Discover() calls = %d, want 1", f.calls)
+	}
+	c.Invalidate()
+	c.Discover(context.Background())
+	if f.calls != 2 {
+		t.Errorf("Cache.Discover() after Invalidate calls = %d, want 2", f.calls)
+	}
+}
+
+// fakeEmptyCounter counts calls to Discover, and finds no targets.
+type fakeEmptyCounter struct {
+	calls int
+}
+
+func (f *fakeEmptyCounter) Discover(ctx context.Context) ([]StaticConfig, error) {
+	f.calls++
+	return nil, nil
+}
+
+// fakeGated blocks the first call to Discover until release is closed or its
+// context is done. Later calls return immediately.
+type fakeGated struct {
+	calls   int32
+	started chan struct{}
+	release chan struct{}
+}
+
+func newFakeGated() *fakeGated {
+	return &fakeGated{started: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (f *fakeGated) Discover(ctx context.Context) ([]StaticConfig, error) {
+	if atomic.AddInt32(&f.calls, 1) == 1 {
+		close(f.started)
+		select {
+		case <-f.release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return []StaticConfig{{Targets: []string{"output"}}}, nil
+}
+
+// waitingContext closes waiting when Done is first called, i.e. when a caller
+// of Cache.Discover starts waiting for another caller.
+type waitingContext struct {
+	context.Context
+	once    sync.Once
+	waiting chan struct{}
+}
+
+func (c *waitingContext) Done() <-chan struct{} {
+	c.once.Do(func() { close(c.waiting) })
+	return c.Context.Done()
+}
+
+func TestCache_DiscoverLeaderCanceled(t *testing.T) {
+	f := newFakeGated()
+	c := NewCache(f, time.Hour)
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	leaderErr := make(chan error, 1)
+	go func() {
+		_, err := c.Discover(leaderCtx)
+		leaderErr <- err
+	}()
+	<-f.started
+
+	// The waiter runs discovery again, instead of returning the error of the
+	// canceled leader.
+	ctx := &waitingContext{Context: context.Background(), waiting: make(chan struct{})}
+	go func() {
+		<-ctx.waiting
+		cancel()
+	}()
+	got, err := c.Discover(ctx)
+	if err != nil || len(got) != 1 {
+		t.Errorf("Cache.Discover() = %v, %v, want 1 target", got, err)
+	}
+	if err := <-leaderErr; err != context.Canceled {
+		t.Errorf("Cache.Discover() of leader error = %v, want %v", err, context.Canceled)
+	}
+	if n := atomic.LoadInt32(&f.calls); n != 2 {
+		t.Errorf("Cache.Discover() calls = %d, want 2", n)
+	}
+}
+
+func TestCache_DiscoverInvalidated(t *testing.T) {
+	f := newFakeGated()
+	c := NewCache(f, time.Hour)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Discover(context.Background())
+	}()
+	<-f.started
+
+	// The result of the discovery started before Invalidate is not cached.
+	c.Invalidate()
+	close(f.release)
+	<-done
+	c.Discover(context.Background())
+	if n := atomic.LoadInt32(&f.calls); n != 2 {
+		t.Errorf("Cache.Discover() calls = %d, want 2", n)
+	}
+	c.Discover(context.Background())
+	if n := atomic.LoadInt32(&f.calls); n != 2 {
+		t.Errorf("Cache.Discover() after caching calls = %d, want 2", n)
+	}
+}
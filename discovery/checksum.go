@@ -0,0 +1,49 @@
+package discovery
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// ChecksumSuffix is appended to an output filename to name the checksum file
+// written alongside it. The checksum file uses the same format as sha256sum, so
+// it may also be checked with `sha256sum -c`.
+const ChecksumSuffix = ".sha256"
+
+// VerifyChecksum reads the named output file and its checksum file, and returns
+// an error if the file contents do not match the recorded checksum.
+func VerifyChecksum(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	sum, err := ioutil.ReadFile(filename + ChecksumSuffix)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(sum))
+	if len(fields) == 0 {
+		return fmt.Errorf("%s: checksum file is empty", filename)
+	}
+	if fields[0] != checksum(data) {
+		return fmt.Errorf("%s: checksum mismatch: got %s, want %s", filename, checksum(data), fields[0])
+	}
+	return nil
+}
+
+// checksum returns the hex encoded SHA256 digest of data.
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// writeChecksum stages the given hex encoded SHA256 checksum to be written
+// alongside the named output file when tx is committed.
+func writeChecksum(tx *transaction, sum, filename string) error {
+	line := fmt.Sprintf("%s  %s\n", sum, filepath.Base(filename))
+	return tx.writeFile(filename+ChecksumSuffix, []byte(line))
+}
@@ -0,0 +1,75 @@
+package discovery
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyChecksum(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name     string
+		data     string
+		modified string
+		noSum    bool
+		emptySum bool
+		wantErr  bool
+	}{
+		{
+			name: "success",
+			data: "[]",
+		},
+		{
+			name:     "failure-modified",
+			data:     "[]",
+			modified: "[{}]",
+			wantErr:  true,
+		},
+		{
+			name:    "failure-missing-checksum",
+			data:    "[]",
+			noSum:   true,
+			wantErr: true,
+		},
+		{
+			name:     "failure-empty-checksum",
+			data:     "[]",
+			emptySum: true,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(dir, tt.name+".json")
+			ioutil.WriteFile(filename, []byte(tt.data), 0644)
+			if !tt.noSum {
+				tx := newTransaction("")
+				err := writeChecksum(tx, checksum([]byte(tt.data)), filename)
+				if err == nil {
+					err = tx.commit()
+				}
+				if err != nil {
+					t.Fatalf("writeChecksum() error = %v", err)
+				}
+			}
+			if tt.emptySum {
+				ioutil.WriteFile(filename+ChecksumSuffix, nil, 0644)
+			}
+			if tt.modified != "" {
+				ioutil.WriteFile(filename, []byte(tt.modified), 0644)
+			}
+			err := VerifyChecksum(filename)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("VerifyChecksum() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyChecksum_missingFile(t *testing.T) {
+	err := VerifyChecksum(filepath.Join(t.TempDir(), "does-not-exist.json"))
+	if err == nil {
+		t.Errorf("VerifyChecksum() error = nil, want error")
+	}
+}
@@ -0,0 +1,54 @@
+package discovery
+
+import "time"
+
+// Clock provides the current time and tickers. The Manager and Cache use a
+// Clock for all timing, so tests can control time without real sleeps.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// NewTicker returns a Ticker that ticks every period d.
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks at intervals, like a time.Ticker.
+type Ticker interface {
+	// C returns the channel on which ticks are delivered.
+	C() <-chan time.Time
+
+	// Stop turns off the ticker.
+	Stop()
+}
+
+// RealClock is the Clock used by default. RealClock uses the time package.
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+// Now returns time.Now().
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// NewTicker returns a Ticker backed by a time.Ticker.
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+// C returns the ticker channel.
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// clockOrReal returns c, or RealClock if c is nil.
+func clockOrReal(c Clock) Clock {
+	if c == nil {
+		return RealClock
+	}
+	return c
+}
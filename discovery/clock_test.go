@@ -0,0 +1,81 @@
+package discovery
+
+import (
+	"sync"
+	"time"
+)
+
+// fakeClock is a Clock whose time only changes when advanced by the test.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+	// created is signaled when a ticker is created.
+	created *sync.Cond
+}
+
+func newFakeClock() *fakeClock {
+	c := &fakeClock{now: time.Date(2018, 10, 27, 21, 1, 26, 0, time.UTC)}
+	c.created = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTicker{clock: c, c: make(chan time.Time, 1), period: d, next: c.now.Add(d)}
+	c.tickers = append(c.tickers, t)
+	c.created.Broadcast()
+	return t
+}
+
+// waitTickers blocks until at least n tickers were created, so the test can
+// advance the time after another goroutine starts waiting on a ticker.
+func (c *fakeClock) waitTickers(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.tickers) < n {
+		c.created.Wait()
+	}
+}
+
+// Advance moves the time forward by d and delivers ticks to every ticker that
+// is due. Like a time.Ticker, ticks are dropped if the receiver is behind.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.tickers {
+		for !t.stopped && !t.next.After(c.now) {
+			select {
+			case t.c <- t.next:
+			default:
+			}
+			t.next = t.next.Add(t.period)
+		}
+	}
+}
+
+type fakeTicker struct {
+	clock   *fakeClock
+	c       chan time.Time
+	period  time.Duration
+	next    time.Time
+	stopped bool
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.stopped = true
+}
@@ -0,0 +1,130 @@
+package discovery
+
+import (
+	"math"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/m-lab/gcp-service-discovery/metrics"
+)
+
+var (
+	// effectiveInterval reports the interval between discovery passes of a
+	// service, after it is stretched by CostLimits. The metric is labeled by
+	// service name.
+	//
+	// Provides metrics:
+	//   gcp_manager_effective_interval_seconds
+	// Usage example:
+	//   effectiveInterval.WithLabelValues("gke.Service").Set(300)
+	effectiveInterval = metrics.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gcp_manager_effective_interval_seconds",
+			Help: "Interval between discovery passes of a service, after cost limits are applied.",
+		},
+		[]string{"service"},
+	)
+)
+
+// CostLimits stretch the interval between discovery passes of services whose
+// passes are expensive, so large projects do not use up their API quota. When
+// the last pass of a service made more than MaxAPICalls API calls, or took
+// longer than MaxDuration, the interval is multiplied by the ratio of the cost
+// to the limit, so the cost per unit of time stays within the limit.
+//
+// The stretched interval is at least MinInterval and at most MaxInterval, and
+// is rounded up to a multiple of the interval of Run.
+type CostLimits struct {
+	// MaxAPICalls is the number of API calls counted by CountAPICall above
+	// which the interval is stretched. Zero disables the limit.
+	MaxAPICalls int
+
+	// MaxDuration is the pass duration above which the interval is stretched.
+	// Zero disables the limit.
+	MaxDuration time.Duration
+
+	// MinInterval is the floor of a stretched interval.
+	MinInterval time.Duration
+
+	// MaxInterval is the ceiling of a stretched interval. When zero, the
+	// interval is not limited.
+	MaxInterval time.Duration
+}
+
+// enabled returns true if any limit is set.
+func (c CostLimits) enabled() bool {
+	return c.MaxAPICalls > 0 || c.MaxDuration > 0
+}
+
+// interval returns the interval until the next pass of a service whose last
+// pass made apiCalls API calls and took d, given the interval of Run.
+func (c CostLimits) interval(base time.Duration, apiCalls int, d time.Duration) time.Duration {
+	scale := 0.0
+	if c.MaxAPICalls > 0 {
+		scale = math.Max(scale, float64(apiCalls)/float64(c.MaxAPICalls))
+	}
+	if c.MaxDuration > 0 {
+		scale = math.Max(scale, float64(d)/float64(c.MaxDuration))
+	}
+	if scale <= 1 {
+		return base
+	}
+	stretched := time.Duration(float64(base) * scale)
+	if stretched < c.MinInterval {
+		stretched = c.MinInterval
+	}
+	if c.MaxInterval > 0 && stretched > c.MaxInterval {
+		stretched = c.MaxInterval
+	}
+	if stretched < base {
+		return base
+	}
+	return stretched
+}
+
+// schedule sets the number of passes of Run that reg skips after a pass with
+// the given stats, and updates the interval metric.
+func (m *Manager) schedule(reg *registration, service string, stats *passStats, d time.Duration) {
+	if !m.costLimits.enabled() {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	base := m.interval
+	if base <= 0 {
+		// Run is not running, so there is nothing to skip.
+		return
+	}
+	stats.mu.Lock()
+	apiCalls := stats.apiCalls
+	stats.mu.Unlock()
+	passes := int(math.Ceil(float64(m.costLimits.interval(base, apiCalls, d)) / float64(base)))
+	if passes > 1 {
+		m.logger.Printf("%s: stretching the refresh interval to %s after a pass with %d API calls in %s",
+			reg.output, time.Duration(passes)*base, apiCalls, d.Round(time.Millisecond))
+	}
+	reg.skip = passes - 1
+	reg.interval = time.Duration(passes) * base
+	effectiveInterval.WithLabelValues(service).Set(reg.interval.Seconds())
+}
+
+// throttled returns true if reg skips the current pass because of CostLimits.
+func (m *Manager) throttled(reg *registration) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if reg.skip <= 0 {
+		return false
+	}
+	reg.skip--
+	return true
+}
+
+// staleInterval returns the interval used to detect a stale output of reg,
+// which is the stretched interval of reg, if any. The caller must hold m.mu.
+func (m *Manager) staleInterval(reg *registration) time.Duration {
+	if reg.interval > m.interval {
+		return reg.interval
+	}
+	return m.interval
+}
@@ -0,0 +1,124 @@
+package discovery
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCostLimits_interval(t *testing.T) {
+	tests := []struct {
+		name     string
+		limits   CostLimits
+		apiCalls int
+		d        time.Duration
+		want     time.Duration
+	}{
+		{
+			name:     "disabled",
+			apiCalls: 1000,
+			d:        time.Hour,
+			want:     time.Minute,
+		},
+		{
+			name:     "within-limits",
+			limits:   CostLimits{MaxAPICalls: 100, MaxDuration: time.Minute},
+			apiCalls: 100,
+			d:        time.Minute,
+			want:     time.Minute,
+		},
+		{
+			name:     "api-calls",
+			limits:   CostLimits{MaxAPICalls: 100},
+			apiCalls: 300,
+			want:     3 * time.Minute,
+		},
+		{
+			name:   "duration",
+			limits: CostLimits{MaxAPICalls: 100, MaxDuration: 10 * time.Second},
+			d:      25 * time.Second,
+			want:   150 * time.Second,
+		},
+		{
+			name:     "floor",
+			limits:   CostLimits{MaxAPICalls: 100, MinInterval: 5 * time.Minute},
+			apiCalls: 101,
+			want:     5 * time.Minute,
+		},
+		{
+			name:     "ceiling",
+			limits:   CostLimits{MaxAPICalls: 100, MaxInterval: 10 * time.Minute},
+			apiCalls: 100000,
+			want:     10 * time.Minute,
+		},
+		{
+			name:     "ceiling-below-base",
+			limits:   CostLimits{MaxAPICalls: 100, MaxInterval: time.Second},
+			apiCalls: 1000,
+			want:     time.Minute,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.limits.interval(time.Minute, tt.apiCalls, tt.d); got != tt.want {
+				t.Errorf("CostLimits.interval() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeExpensive makes calls API calls in every pass.
+type fakeExpensive struct {
+	calls  int
+	passes int
+}
+
+func (f *fakeExpensive) Discover(ctx context.Context) ([]StaticConfig, error) {
+	f.passes++
+	for i := 0; i < f.calls; i++ {
+		CountAPICall(ctx)
+	}
+	return []StaticConfig{{Targets: []string{"a"}}}, nil
+}
+
+func TestManager_CostLimits(t *testing.T) {
+	m := NewManager(WithTimeout(time.Minute), WithCostLimits(CostLimits{MaxAPICalls: 10}))
+	m.clk = newFakeClock()
+	m.interval = time.Minute
+	expensive := &fakeExpensive{calls: 25}
+	m.Register(expensive, filepath.Join(t.TempDir(), "output.json"))
+
+	// 25 API calls stretch the interval to 2.5m, rounded up to 3 passes.
+	for i := 0; i < 6; i++ {
+		m.discoverAll(context.Background())
+	}
+	if expensive.passes != 2 {
+		t.Errorf("Manager.discoverAll() ran %d passes of 6, want 2", expensive.passes)
+	}
+	if v := testutil.ToFloat64(effectiveInterval.WithLabelValues("discovery.fakeExpensive")); v != 180 {
+		t.Errorf("effective interval metric = %v, want 180", v)
+	}
+	if status := m.Status(); status[0].Health != HealthOK {
+		t.Errorf("Manager.Status() health = %s, want ok", status[0].Health)
+	}
+
+	// Reload runs the next pass without waiting.
+	m.discoverAll(context.Background())
+	m.Reload()
+	m.discoverAll(context.Background())
+	if expensive.passes != 4 {
+		t.Errorf("Manager.discoverAll() after Reload ran %d passes, want 4", expensive.passes)
+	}
+
+	// Cheap passes restore the interval of Run.
+	expensive.calls = 0
+	m.Reload()
+	m.discoverAll(context.Background())
+	m.discoverAll(context.Background())
+	if expensive.passes != 6 {
+		t.Errorf("Manager.discoverAll() after cheap pass ran %d passes, want 6", expensive.passes)
+	}
+}
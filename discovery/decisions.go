@@ -0,0 +1,105 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Decision records whether a candidate object seen during discovery was
+// included in or excluded from the discovered targets, and why.
+type Decision struct {
+	// Time is when the decision was made.
+	Time time.Time `json:"time"`
+
+	// Pass is the start time of the discovery pass that made the decision.
+	Pass time.Time `json:"pass"`
+
+	// Source is the name of the service that made the decision.
+	Source string `json:"source"`
+
+	// Object identifies the upstream object, e.g. "service/version/instance".
+	Object string `json:"object"`
+
+	// Included is true when the object produced a target.
+	Included bool `json:"included"`
+
+	// Reason explains the decision, e.g. "not serving".
+	Reason string `json:"reason"`
+}
+
+// DecisionLog writes Decisions as JSON lines. DecisionLog is safe for
+// concurrent use.
+type DecisionLog struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+// NewDecisionLog opens the named file for appending decisions.
+func NewDecisionLog(filename string) (*DecisionLog, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &DecisionLog{w: f}, nil
+}
+
+// Record writes the given decision to the log.
+func (l *DecisionLog) Record(d Decision) {
+	data, err := json.Marshal(d)
+	if err != nil {
+		log.Printf("Failed to marshal decision: %s", err)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.w.Write(append(data, '\n'))
+	if err != nil {
+		log.Printf("Failed to write decision: %s", err)
+	}
+}
+
+// Close closes the underlying file.
+func (l *DecisionLog) Close() error {
+	return l.w.Close()
+}
+
+type decisionKey struct{}
+
+// decisionRecorder annotates decisions with the current pass and source.
+type decisionRecorder struct {
+	log    *DecisionLog
+	pass   time.Time
+	source string
+}
+
+// WithDecisionLog returns a copy of ctx that records Decide calls for the named
+// source to the given log.
+func WithDecisionLog(ctx context.Context, l *DecisionLog, source string, pass time.Time) context.Context {
+	return context.WithValue(ctx, decisionKey{}, &decisionRecorder{log: l, pass: pass, source: source})
+}
+
+// Decide records a decision about the named object, if ctx was created by
+// WithDecisionLog. Otherwise, Decide does nothing. Services should call Decide
+// for every candidate object considered during discovery.
+func Decide(ctx context.Context, object string, included bool, reason string) {
+	if ctx == nil {
+		return
+	}
+	r, ok := ctx.Value(decisionKey{}).(*decisionRecorder)
+	if !ok {
+		return
+	}
+	r.log.Record(Decision{
+		Time:     time.Now().UTC(),
+		Pass:     r.pass,
+		Source:   r.source,
+		Object:   object,
+		Included: included,
+		Reason:   reason,
+	})
+}
@@ -0,0 +1,74 @@
+package discovery
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type fakeDecider struct{}
+
+func (f *fakeDecider) Discover(ctx context.Context) ([]StaticConfig, error) {
+	Decide(ctx, "a", true, "serving")
+	Decide(ctx, "b", false, "not serving")
+	return []StaticConfig{{Targets: []string{"a"}}}, nil
+}
+
+func TestManager_RunDecisionLog(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "decisions.jsonl")
+	l, err := NewDecisionLog(filename)
+	if err != nil {
+		t.Fatalf("NewDecisionLog() error = %v", err)
+	}
+	m := NewManager(WithTimeout(time.Minute))
+	m.decisionLog = l
+	m.Register(&fakeDecider{}, filepath.Join(dir, "output.json"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m.Run(ctx, time.Minute)
+	l.Close()
+
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("os.Open() error = %v", err)
+	}
+	defer f.Close()
+	var got []Decision
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		d := Decision{}
+		err := json.Unmarshal(s.Bytes(), &d)
+		if err != nil {
+			t.Fatalf("json.Unmarshal() error = %v", err)
+		}
+		got = append(got, d)
+	}
+	if len(got) != 2 {
+		t.Fatalf("DecisionLog got %d decisions, want 2", len(got))
+	}
+	if got[0].Source != "discovery.fakeDecider" || got[0].Object != "a" || !got[0].Included {
+		t.Errorf("DecisionLog got %#v, want included object a", got[0])
+	}
+	if got[1].Object != "b" || got[1].Included || got[1].Reason != "not serving" {
+		t.Errorf("DecisionLog got %#v, want excluded object b", got[1])
+	}
+}
+
+func TestDecide_withoutLog(t *testing.T) {
+	// Neither call should panic.
+	Decide(nil, "a", true, "serving")
+	Decide(context.Background(), "a", true, "serving")
+}
+
+func TestNewDecisionLog_failure(t *testing.T) {
+	_, err := NewDecisionLog("/path/does/not/exist/decisions.jsonl")
+	if err == nil {
+		t.Errorf("NewDecisionLog() error = nil, want error")
+	}
+}
@@ -0,0 +1,80 @@
+package discovery
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// maxDiffTargets limits the number of targets named in a Diff summary.
+const maxDiffTargets = 10
+
+// Diff describes the targets added and removed between two sets of configs.
+type Diff struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+}
+
+// DiffTargets compares the targets in prev and cur and returns the sorted
+// targets that were added and removed.
+func DiffTargets(prev, cur []StaticConfig) Diff {
+	before := targetSet(prev)
+	after := targetSet(cur)
+	d := Diff{Added: []string{}, Removed: []string{}}
+	for t := range after {
+		if !before[t] {
+			d.Added = append(d.Added, t)
+		}
+	}
+	for t := range before {
+		if !after[t] {
+			d.Removed = append(d.Removed, t)
+		}
+	}
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	return d
+}
+
+// Empty returns true when no targets were added or removed.
+func (d Diff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0
+}
+
+// String returns a concise summary of the diff, e.g.
+//
+//	+3 targets (-1): added [a b c], removed [d]
+func (d Diff) String() string {
+	s := fmt.Sprintf("+%d targets (-%d)", len(d.Added), len(d.Removed))
+	parts := []string{}
+	if len(d.Added) > 0 {
+		parts = append(parts, "added "+summarize(d.Added))
+	}
+	if len(d.Removed) > 0 {
+		parts = append(parts, "removed "+summarize(d.Removed))
+	}
+	if len(parts) == 0 {
+		return s
+	}
+	return s + ": " + strings.Join(parts, ", ")
+}
+
+// summarize formats the given targets, truncating long lists.
+func summarize(targets []string) string {
+	if len(targets) <= maxDiffTargets {
+		return "[" + strings.Join(targets, " ") + "]"
+	}
+	return fmt.Sprintf("[%s ... %d more]",
+		strings.Join(targets[:maxDiffTargets], " "), len(targets)-maxDiffTargets)
+}
+
+// targetSet returns the set of all targets in configs.
+func targetSet(configs []StaticConfig) map[string]bool {
+	set := map[string]bool{}
+	for i := range configs {
+		for _, t := range configs[i].Targets {
+			set[t] = true
+		}
+	}
+	return set
+}
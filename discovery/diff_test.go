@@ -0,0 +1,63 @@
+package discovery
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestDiffTargets(t *testing.T) {
+	tests := []struct {
+		name string
+		prev []StaticConfig
+		cur  []StaticConfig
+		want Diff
+		str  string
+	}{
+		{
+			name: "success-first-pass",
+			cur:  []StaticConfig{{Targets: []string{"b", "a"}}},
+			want: Diff{Added: []string{"a", "b"}, Removed: []string{}},
+			str:  "+2 targets (-0): added [a b]",
+		},
+		{
+			name: "success-added-and-removed",
+			prev: []StaticConfig{{Targets: []string{"a"}}, {Targets: []string{"d"}}},
+			cur:  []StaticConfig{{Targets: []string{"a", "b"}}, {Targets: []string{"c"}}},
+			want: Diff{Added: []string{"b", "c"}, Removed: []string{"d"}},
+			str:  "+2 targets (-1): added [b c], removed [d]",
+		},
+		{
+			name: "success-unchanged",
+			prev: []StaticConfig{{Targets: []string{"a"}}},
+			cur:  []StaticConfig{{Targets: []string{"a"}}},
+			want: Diff{Added: []string{}, Removed: []string{}},
+			str:  "+0 targets (-0)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := DiffTargets(tt.prev, tt.cur)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DiffTargets() = %#v, want %#v", got, tt.want)
+			}
+			if got.String() != tt.str {
+				t.Errorf("Diff.String() = %q, want %q", got.String(), tt.str)
+			}
+			if got.Empty() != (len(tt.want.Added)+len(tt.want.Removed) == 0) {
+				t.Errorf("Diff.Empty() = %t, want %t", got.Empty(), !got.Empty())
+			}
+		})
+	}
+}
+
+func TestDiff_StringTruncated(t *testing.T) {
+	d := Diff{}
+	for i := 0; i < maxDiffTargets+2; i++ {
+		d.Added = append(d.Added, fmt.Sprintf("t%02d", i))
+	}
+	want := "+12 targets (-0): added [t00 t01 t02 t03 t04 t05 t06 t07 t08 t09 ... 2 more]"
+	if d.String() != want {
+		t.Errorf("Diff.String() = %q, want %q", d.String(), want)
+	}
+}
@@ -0,0 +1,36 @@
+package discovery
+
+import "encoding/json"
+
+// MarshalTargets serializes configs as indented JSON, the format of the
+// targets served by the admin handlers. Digests are computed over this format,
+// so a digest matches the checksum of the served targets.
+func MarshalTargets(configs []StaticConfig) ([]byte, error) {
+	return json.MarshalIndent(configs, "", "    ")
+}
+
+// digest returns the hex encoded SHA256 digest of configs of reg after the
+// Profile is applied, or an empty string if configs cannot be serialized.
+func (m *Manager) digest(reg *registration, configs []StaticConfig) string {
+	data, err := MarshalTargets(m.profileOf(reg).apply(configs))
+	if err != nil {
+		return ""
+	}
+	return checksum(data)
+}
+
+// Digests returns the hex encoded SHA256 digest of the targets most recently
+// written to every output, keyed by output. A digest changes exactly when the
+// targets returned by Targets change, so pollers may detect changes without
+// downloading the targets. Outputs without written targets are omitted.
+func (m *Manager) Digests() map[string]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	digests := map[string]string{}
+	for _, reg := range m.registrations {
+		if reg.last != nil && reg.digest != "" {
+			digests[reg.output] = reg.digest
+		}
+	}
+	return digests
+}
@@ -0,0 +1,30 @@
+package discovery
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestManager_Digests(t *testing.T) {
+	dir := t.TempDir()
+	m := NewManager(WithTimeout(time.Minute))
+	m.Register(&fakeLiteral{}, filepath.Join(dir, "a.json"))
+	m.Register(&fakeFailure{}, filepath.Join(dir, "b.json"))
+	if got := m.Digests(); len(got) != 0 {
+		t.Errorf("Manager.Digests() = %v before discovery, want none", got)
+	}
+	m.discoverAll(context.Background())
+	got := m.Digests()
+	targets, _ := m.Targets(filepath.Join(dir, "a.json"))
+	data, _ := MarshalTargets(targets)
+	if len(got) != 1 || got[filepath.Join(dir, "a.json")] != checksum(data) {
+		t.Errorf("Manager.Digests() = %v, want the checksum %s of a.json only", got, checksum(data))
+	}
+	first := got[filepath.Join(dir, "a.json")]
+	m.discoverAll(context.Background())
+	if d := m.Digests()[filepath.Join(dir, "a.json")]; d != first {
+		t.Errorf("Manager.Digests() changed to %s for unchanged targets, want %s", d, first)
+	}
+}
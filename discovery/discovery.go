@@ -2,13 +2,25 @@
 package discovery
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"sort"
+	"strings"
 )
 
+// LabelReady is the label that reports whether the upstream system considers a
+// target ready, with values "true", "false", or "unknown". Prometheus
+// relabeling may use it to skip targets that are not ready.
+const LabelReady = "__meta_ready"
+
 //- Legacy Interfaces -//
 
 // Source defines the interface for collecting targets from various
-// services. New services should implement this interface.
+// services.
+//
+// Deprecated: Implement Service and register it with a Manager, which
+// collects and saves targets. Source is removed in v2.
 type Source interface {
 	// Collect retrieves all targets from a source.
 	Collect() error
@@ -18,6 +30,9 @@ type Source interface {
 }
 
 // Factory defines the interface for creating new Source instances.
+//
+// Deprecated: Create a Service with the NewService function of its package.
+// Factory is removed in v2.
 type Factory interface {
 	// Create creates a new Source ready for collection.
 	Create() (Source, error)
@@ -32,6 +47,16 @@ type Service interface {
 	Discover(ctx context.Context) ([]StaticConfig, error)
 }
 
+// RawSource is an optional interface implemented by services that discover
+// pre-serialized target documents. When a registered service implements
+// RawSource and Raw returns a non-nil document, the Manager writes the original
+// document instead of re-serializing the discovered StaticConfigs.
+type RawSource interface {
+	// Raw returns the original document validated by the most recent
+	// successful call to Discover, or nil.
+	Raw() []byte
+}
+
 // StaticConfig represents a set of targets and associated labels. StaticConfig
 // serializes to the "file_sd_config" format.
 // https://prometheus.io/docs/prometheus/latest/configuration/configuration/#<file_sd_config>
@@ -43,4 +68,75 @@ type StaticConfig struct {
 	// Labels is a set of keys/values that are common across all targets in the
 	// StaticConfig.
 	Labels map[string]string `json:"labels,omitempty"`
+
+	// Extra preserves any additional fields found when parsing a StaticConfig,
+	// so they are written again when the StaticConfig is serialized. Extra is
+	// nil when there are no additional fields. Fields named like the standard
+	// fields, in any case, and fields without a value are not serialized.
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// staticConfig has the same fields as StaticConfig without its methods.
+type staticConfig StaticConfig
+
+// MarshalJSON serializes the StaticConfig, including any Extra fields in
+// sorted order after the standard fields.
+func (c StaticConfig) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(staticConfig(c))
+	if err != nil || len(c.Extra) == 0 {
+		return data, err
+	}
+	keys := make([]string, 0, len(c.Extra))
+	for k, v := range c.Extra {
+		if !standardField(k) && len(v) > 0 {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	// Append extra fields before the closing brace.
+	buf := bytes.NewBuffer(data[:len(data)-1])
+	for _, k := range keys {
+		key, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteByte(',')
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(c.Extra[k])
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// standardField returns true if k names a standard field of StaticConfig, as
+// matched by encoding/json.
+func standardField(k string) bool {
+	return strings.EqualFold(k, "targets") || strings.EqualFold(k, "labels")
+}
+
+// UnmarshalJSON parses a StaticConfig, saving any additional fields in Extra.
+func (c *StaticConfig) UnmarshalJSON(data []byte) error {
+	var sc staticConfig
+	err := json.Unmarshal(data, &sc)
+	if err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(data, &fields)
+	if err != nil {
+		return err
+	}
+	// Like encoding/json, match the standard fields case-insensitively.
+	for k := range fields {
+		if standardField(k) {
+			delete(fields, k)
+		}
+	}
+	if len(fields) > 0 {
+		sc.Extra = fields
+	}
+	*c = StaticConfig(sc)
+	return nil
 }
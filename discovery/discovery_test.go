@@ -0,0 +1,93 @@
+package discovery
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestStaticConfig_JSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    StaticConfig
+		output  string
+		wantErr bool
+	}{
+		{
+			name:   "success-standard-fields",
+			input:  `{"targets":["a:1"],"labels":{"x":"y"}}`,
+			want:   StaticConfig{Targets: []string{"a:1"}, Labels: map[string]string{"x": "y"}},
+			output: `{"targets":["a:1"],"labels":{"x":"y"}}`,
+		},
+		{
+			name:  "success-extra-fields",
+			input: `{"zeta":{"a":1},"targets":["a:1"],"alpha":"b"}`,
+			want: StaticConfig{
+				Targets: []string{"a:1"},
+				Extra: map[string]json.RawMessage{
+					"alpha": json.RawMessage(`"b"`),
+					"zeta":  json.RawMessage(`{"a":1}`),
+				},
+			},
+			output: `{"targets":["a:1"],"alpha":"b","zeta":{"a":1}}`,
+		},
+		{
+			name:   "success-standard-fields-case",
+			input:  `{"Targets":["a:1"],"LABELS":{"x":"y"}}`,
+			want:   StaticConfig{Targets: []string{"a:1"}, Labels: map[string]string{"x": "y"}},
+			output: `{"targets":["a:1"],"labels":{"x":"y"}}`,
+		},
+		{
+			name:    "failure-bad-type",
+			input:   `{"targets":"a:1"}`,
+			wantErr: true,
+		},
+		{
+			name:    "failure-not-an-object",
+			input:   `["a:1"]`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := StaticConfig{}
+			err := json.Unmarshal([]byte(tt.input), &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("json.Unmarshal() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("json.Unmarshal() = %#v, want %#v", got, tt.want)
+			}
+			data, err := json.Marshal(got)
+			if err != nil {
+				t.Fatalf("json.Marshal() error = %v", err)
+			}
+			if string(data) != tt.output {
+				t.Errorf("json.Marshal() = %s, want %s", data, tt.output)
+			}
+		})
+	}
+}
+
+func TestStaticConfig_MarshalJSONSkipsExtra(t *testing.T) {
+	c := StaticConfig{
+		Targets: []string{"a:1"},
+		Extra: map[string]json.RawMessage{
+			"Targets": json.RawMessage(`["b:1"]`),
+			"Labels":  json.RawMessage(`{}`),
+			"empty":   nil,
+			"alpha":   json.RawMessage(`"b"`),
+		},
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+	if want := `{"targets":["a:1"],"alpha":"b"}`; string(data) != want {
+		t.Errorf("json.Marshal() = %s, want %s", data, want)
+	}
+}
@@ -0,0 +1,105 @@
+package discovery
+
+import (
+	"context"
+	"sort"
+)
+
+// Pipeline stages reported by DryRun, in order.
+const (
+	// StageDiscovered is the label set reported by the source with
+	// RecordOrigin, before processing by wrapping services.
+	StageDiscovered = "discovered"
+
+	// StageProcessed is the label set after processing by wrapping services,
+	// such as label encryption and merging.
+	StageProcessed = "processed"
+
+	// StageWritten is the label set written to the output, after the output
+	// Profile is applied.
+	StageWritten = "written"
+)
+
+// Stage is the label set of a target after one stage of the pipeline.
+type Stage struct {
+	// Name is the stage name, e.g. StageProcessed.
+	Name string `json:"name"`
+
+	// Labels are the target labels after the stage.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Dropped is true when the stage removed the target.
+	Dropped bool `json:"dropped,omitempty"`
+}
+
+// Trace describes how one discovered target moves through the pipeline.
+type Trace struct {
+	// Source is the name of the service that produced the target.
+	Source string `json:"source"`
+
+	// Output is the output that would contain the target.
+	Output string `json:"output"`
+
+	// Target is the target address.
+	Target string `json:"target"`
+
+	// Stages are the label sets of the target after every stage, in order.
+	// Sources that do not call RecordOrigin have no StageDiscovered.
+	Stages []Stage `json:"stages"`
+}
+
+// DryRun runs discovery once for every registered service without updating
+// any output, and returns a Trace for up to sample targets from every service,
+// in target order. DryRun fails if discovery fails for any service.
+func (m *Manager) DryRun(ctx context.Context, sample int) ([]Trace, error) {
+	traces := []Trace{}
+	for _, reg := range m.registered() {
+		r, err := m.discover(ctx, reg)
+		if err != nil {
+			return nil, err
+		}
+		traces = append(traces, m.trace(r, sample)...)
+	}
+	return traces, nil
+}
+
+// trace returns a Trace for up to sample targets of the given result.
+func (m *Manager) trace(r *result, sample int) []Trace {
+	processed := map[string]map[string]string{}
+	written := map[string]map[string]string{}
+	for i, c := range m.profileOf(r.reg).apply(r.configs) {
+		for _, t := range c.Targets {
+			processed[t] = r.configs[i].Labels
+			written[t] = c.Labels
+		}
+	}
+	targets := []string{}
+	for t := range processed {
+		targets = append(targets, t)
+	}
+	for t := range r.origins {
+		if _, ok := processed[t]; !ok {
+			targets = append(targets, t)
+		}
+	}
+	sort.Strings(targets)
+	if len(targets) > sample {
+		targets = targets[:sample]
+	}
+	traces := []Trace{}
+	for _, t := range targets {
+		trace := Trace{Source: r.service, Output: r.reg.output, Target: t}
+		if o, ok := r.origins[t]; ok {
+			trace.Stages = append(trace.Stages, Stage{Name: StageDiscovered, Labels: o.Labels})
+		}
+		if labels, ok := processed[t]; ok {
+			trace.Stages = append(trace.Stages,
+				Stage{Name: StageProcessed, Labels: labels},
+				Stage{Name: StageWritten, Labels: written[t]})
+		} else {
+			trace.Stages = append(trace.Stages, Stage{Name: StageProcessed, Dropped: true})
+		}
+		traces = append(traces, trace)
+	}
+	return traces
+}
@@ -0,0 +1,72 @@
+package discovery
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeFiltered reports two objects with RecordOrigin, and drops one of them.
+type fakeFiltered struct{}
+
+func (f *fakeFiltered) Discover(ctx context.Context) ([]StaticConfig, error) {
+	kept := StaticConfig{Targets: []string{"a:1"}, Labels: map[string]string{"__project": "p"}}
+	dropped := StaticConfig{Targets: []string{"b:1"}, Labels: map[string]string{"__project": "q"}}
+	RecordOrigin(ctx, kept, "kept")
+	RecordOrigin(ctx, dropped, "dropped")
+	return []StaticConfig{
+		{Targets: kept.Targets, Labels: map[string]string{"__project": "p", "x": "y"}},
+	}, nil
+}
+
+func TestManager_DryRun(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "output.json")
+	m := NewManager(WithTimeout(time.Minute))
+	m.profile = ProfileVictoriaMetrics
+	m.Register(&fakeFiltered{}, output)
+	got, err := m.DryRun(context.Background(), 10)
+	if err != nil {
+		t.Fatalf("Manager.DryRun() error = %v", err)
+	}
+	want := []Trace{
+		{
+			Source: "discovery.fakeFiltered",
+			Output: output,
+			Target: "a:1",
+			Stages: []Stage{
+				{Name: StageDiscovered, Labels: map[string]string{"__project": "p"}},
+				{Name: StageProcessed, Labels: map[string]string{"__project": "p", "x": "y"}},
+				{Name: StageWritten, Labels: map[string]string{"__meta_project": "p", "x": "y"}},
+			},
+		},
+		{
+			Source: "discovery.fakeFiltered",
+			Output: output,
+			Target: "b:1",
+			Stages: []Stage{
+				{Name: StageDiscovered, Labels: map[string]string{"__project": "q"}},
+				{Name: StageProcessed, Dropped: true},
+			},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Manager.DryRun() = %#v, want %#v", got, want)
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Errorf("Manager.DryRun() wrote %s", output)
+	}
+
+	got, err = m.DryRun(context.Background(), 1)
+	if err != nil || len(got) != 1 {
+		t.Errorf("Manager.DryRun(1) = %d traces, %v; want 1 trace", len(got), err)
+	}
+
+	m.Register(&fakeFailure{}, output)
+	_, err = m.DryRun(context.Background(), 10)
+	if err == nil {
+		t.Errorf("Manager.DryRun() error = nil, want error")
+	}
+}
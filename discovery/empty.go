@@ -0,0 +1,66 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/m-lab/gcp-service-discovery/metrics"
+)
+
+var (
+	// emptyWritesBlocked counts discovery passes that found no targets and were
+	// not written because the output previously had targets. The metric is
+	// labeled by the output filename.
+	//
+	// Provides metrics:
+	//   gcp_manager_empty_writes_blocked_total{output="/targets/aeflex.json"}
+	// Usage example:
+	//   emptyWritesBlocked.WithLabelValues("/targets/aeflex.json").Inc()
+	emptyWritesBlocked = metrics.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gcp_manager_empty_writes_blocked_total",
+			Help: "Number of empty results not written over an output with targets.",
+		},
+		[]string{"output"},
+	)
+)
+
+// checkEmpty returns an error if r has no targets and would replace an output
+// that has targets, unless empty outputs are allowed for the output. Before the
+// first successful write, the existing output file is read to decide.
+func (m *Manager) checkEmpty(r *result) error {
+	output := r.reg.output
+	if m.allowEmpty || contains(m.allowEmptyOutputs, output) || countTargets(r.configs) > 0 {
+		return nil
+	}
+	m.mu.Lock()
+	last := r.reg.last
+	m.mu.Unlock()
+	if last == nil {
+		// Unreadable or missing outputs are replaced.
+		last, _ = readConfigs(output)
+	}
+	n := countTargets(last)
+	if n == 0 {
+		return nil
+	}
+	emptyWritesBlocked.WithLabelValues(output).Inc()
+	return fmt.Errorf("found no targets; not replacing %d previous targets", n)
+}
+
+// readConfigs reads the configs from the output filename.
+func readConfigs(filename string) ([]StaticConfig, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var configs []StaticConfig
+	err = json.Unmarshal(data, &configs)
+	if err != nil {
+		return nil, err
+	}
+	return configs, nil
+}
@@ -0,0 +1,82 @@
+package discovery
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestManager_checkEmpty(t *testing.T) {
+	tests := []struct {
+		name        string
+		previous    string
+		last        []StaticConfig
+		configs     []StaticConfig
+		allowEmpty  bool
+		allowOutput bool
+		wantErr     bool
+	}{
+		{
+			name:    "success-targets",
+			last:    syntheticConfigs(2),
+			configs: syntheticConfigs(1),
+		},
+		{
+			name:     "success-no-previous-output",
+			previous: "",
+		},
+		{
+			name:     "success-previous-output-empty",
+			previous: "[]",
+		},
+		{
+			name:       "success-allow-empty",
+			last:       syntheticConfigs(2),
+			allowEmpty: true,
+		},
+		{
+			name:        "success-allow-empty-output",
+			last:        syntheticConfigs(2),
+			allowOutput: true,
+		},
+		{
+			name:    "failure-last-had-targets",
+			last:    syntheticConfigs(2),
+			configs: []StaticConfig{},
+			wantErr: true,
+		},
+		{
+			name:     "failure-previous-output-had-targets",
+			previous: `[{"targets": ["a:9090"], "labels": {}}]`,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := filepath.Join(t.TempDir(), "output.json")
+			if tt.previous != "" {
+				ioutil.WriteFile(output, []byte(tt.previous), 0644)
+			}
+			m := NewManager(WithTimeout(time.Minute))
+			m.allowEmpty = tt.allowEmpty
+			if tt.allowOutput {
+				m.allowEmptyOutputs = []string{output}
+			}
+			m.Register(&fakeLiteral{}, output)
+			reg := m.registrations[0]
+			reg.last = tt.last
+			err := m.commit(context.Background(), &result{reg: reg, service: "fake", configs: tt.configs})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Manager.commit() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.previous != "" && tt.wantErr {
+				data, _ := ioutil.ReadFile(output)
+				if string(data) != tt.previous {
+					t.Errorf("Manager.commit() replaced output with %q", data)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package discovery
+
+import (
+	"context"
+	"sync"
+)
+
+// Origin describes the upstream object that produced a target.
+type Origin struct {
+	// Object is the raw upstream object, e.g. an AppEngine instance or a
+	// Kubernetes service.
+	Object interface{} `json:"object"`
+
+	// Labels are the target labels as originally discovered, before any
+	// processing by wrapping services.
+	Labels map[string]string `json:"labels"`
+
+	// Lifecycle is the lifecycle state of the object, if it was reported.
+	Lifecycle *Lifecycle `json:"lifecycle,omitempty"`
+}
+
+// Explanation describes where a target came from.
+type Explanation struct {
+	// Source is the name of the service that produced the target.
+	Source string `json:"source"`
+
+	// Output is the output file that contains the target.
+	Output string `json:"output"`
+
+	// Object is the raw upstream object reported by the source, if any.
+	Object interface{} `json:"object,omitempty"`
+
+	// LabelsBefore are the labels originally discovered by the source.
+	LabelsBefore map[string]string `json:"labels_before,omitempty"`
+
+	// LabelsAfter are the labels written to the output.
+	LabelsAfter map[string]string `json:"labels_after"`
+
+	// Lifecycle is the lifecycle state of the upstream object, if any.
+	Lifecycle *Lifecycle `json:"lifecycle,omitempty"`
+}
+
+type originKey struct{}
+
+// originRecorder collects the origins reported during one discovery pass.
+type originRecorder struct {
+	mu      sync.Mutex
+	origins map[string]Origin
+}
+
+// withOrigins returns a copy of ctx that collects RecordOrigin calls in r.
+func withOrigins(ctx context.Context, r *originRecorder) context.Context {
+	return context.WithValue(ctx, originKey{}, r)
+}
+
+// RecordOrigin saves the raw upstream object that produced every target in
+// config, if ctx was created by the Manager. Otherwise, RecordOrigin does
+// nothing. Services should call RecordOrigin for every emitted StaticConfig.
+func RecordOrigin(ctx context.Context, config StaticConfig, object interface{}) {
+	if ctx == nil {
+		return
+	}
+	r, ok := ctx.Value(originKey{}).(*originRecorder)
+	if !ok {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, t := range config.Targets {
+		o := r.origins[t]
+		o.Object, o.Labels = object, config.Labels
+		r.origins[t] = o
+	}
+}
+
+// Explain returns an Explanation for every output that contains the given
+// target as of the most recent successful discovery pass.
+func (m *Manager) Explain(target string) []Explanation {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := []Explanation{}
+	for _, reg := range m.registrations {
+		for _, config := range reg.last {
+			if !contains(config.Targets, target) {
+				continue
+			}
+			e := Explanation{
+				Source:      serviceName(reg.service),
+				Output:      reg.output,
+				LabelsAfter: config.Labels,
+			}
+			if o, ok := reg.origins[target]; ok {
+				e.Object = o.Object
+				e.LabelsBefore = o.Labels
+				e.Lifecycle = o.Lifecycle
+			}
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package discovery
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/m-lab/gcp-service-discovery/metrics"
+)
+
+// FleetLabels maps service names, e.g. "aeflex.Service", to the label names
+// used to summarize the targets of that service in the gcp_manager_fleet_targets
+// metric. FleetLabels implements the flag.Value interface, so it may be set
+// from the command line with values like:
+//
+//	aeflex.Service=__aef_service,__aef_version
+type FleetLabels map[string][]string
+
+// String formats the label names as a space separated list of flag values.
+func (f FleetLabels) String() string {
+	names := []string{}
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	values := []string{}
+	for _, name := range names {
+		values = append(values, name+"="+strings.Join(f[name], ","))
+	}
+	return strings.Join(values, " ")
+}
+
+// Set parses a value of the form "service=label,label,..." and saves the label
+// names for the named service.
+func (f *FleetLabels) Set(value string) error {
+	fields := strings.SplitN(value, "=", 2)
+	if len(fields) != 2 || fields[0] == "" || fields[1] == "" {
+		return fmt.Errorf("invalid fleet labels %q: want service=label,label,...", value)
+	}
+	labels := []string{}
+	for _, s := range strings.Split(fields[1], ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			return fmt.Errorf("invalid fleet labels %q: empty label name", value)
+		}
+		labels = append(labels, s)
+	}
+	if *f == nil {
+		*f = FleetLabels{}
+	}
+	(*f)[fields[0]] = labels
+	return nil
+}
+
+func init() {
+	metrics.MustRegister(fleetTargets)
+}
+
+// fleetKey identifies a value of a label name.
+type fleetKey struct {
+	label string
+	value string
+}
+
+// fleetCounts are the target counts of one output by label value.
+type fleetCounts struct {
+	service string
+	counts  map[fleetKey]int
+}
+
+// fleetGauge reports the target counts of the most recent write of every
+// output. Unlike a GaugeVec, the label values of an output are replaced
+// together, so values that disappear from the fleet are not reported.
+type fleetGauge struct {
+	desc *prometheus.Desc
+
+	mu      sync.Mutex
+	outputs map[string]*fleetCounts
+}
+
+var (
+	// fleetTargets counts the written targets of every output by the values
+	// of the label names selected for its service by WithFleetLabels.
+	//
+	// Provides metrics:
+	//   gcp_manager_fleet_targets{service="aeflex.Service", output="/targets/aeflex.json", label="__aef_service", value="etl"}
+	// Usage example:
+	//   fleetTargets.set("aeflex.Service", "/targets/aeflex.json", []string{"__aef_service"}, configs)
+	fleetTargets = &fleetGauge{
+		desc: prometheus.NewDesc(
+			"gcp_manager_fleet_targets",
+			"Number of written targets by the value of selected labels.",
+			[]string{"service", "output", "label", "value"}, nil),
+		outputs: map[string]*fleetCounts{},
+	}
+)
+
+// Describe sends the descriptor of the metric.
+func (g *fleetGauge) Describe(ch chan<- *prometheus.Desc) {
+	ch <- g.desc
+}
+
+// Collect sends the target counts of every output.
+func (g *fleetGauge) Collect(ch chan<- prometheus.Metric) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for output, fc := range g.outputs {
+		for k, n := range fc.counts {
+			ch <- prometheus.MustNewConstMetric(
+				g.desc, prometheus.GaugeValue, float64(n), fc.service, output, k.label, k.value)
+		}
+	}
+}
+
+// set replaces the counts of output with the number of targets in configs for
+// every value of the given label names. Configs without a label are not
+// counted for that label.
+func (g *fleetGauge) set(service, output string, labels []string, configs []StaticConfig) {
+	counts := map[fleetKey]int{}
+	for _, c := range configs {
+		for _, label := range labels {
+			if v, ok := c.Labels[label]; ok {
+				counts[fleetKey{label: label, value: v}] += len(c.Targets)
+			}
+		}
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.outputs[output] = &fleetCounts{service: service, counts: counts}
+}
+
+// remove stops reporting the counts of output.
+func (g *fleetGauge) remove(output string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.outputs, output)
+}
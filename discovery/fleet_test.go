@@ -0,0 +1,122 @@
+package discovery
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestFleetLabels_Set(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  []string
+		want    FleetLabels
+		wantStr string
+		wantErr bool
+	}{
+		{
+			name:    "success",
+			values:  []string{"aeflex.Service=__aef_service, __aef_version", "gke.Service=cluster"},
+			want:    FleetLabels{"aeflex.Service": {"__aef_service", "__aef_version"}, "gke.Service": {"cluster"}},
+			wantStr: "aeflex.Service=__aef_service,__aef_version gke.Service=cluster",
+		},
+		{
+			name:    "error-missing-labels",
+			values:  []string{"gke.Service"},
+			wantErr: true,
+		},
+		{
+			name:    "error-empty-label",
+			values:  []string{"gke.Service=cluster,"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var f FleetLabels
+			var err error
+			for _, v := range tt.values {
+				err = f.Set(v)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("FleetLabels.Set() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(f, tt.want) {
+				t.Errorf("FleetLabels.Set() = %v, want %v", f, tt.want)
+			}
+			if got := f.String(); got != tt.wantStr {
+				t.Errorf("FleetLabels.String() = %q, want %q", got, tt.wantStr)
+			}
+		})
+	}
+}
+
+// collectFleet returns the values of the fleet metric of output by label and
+// value.
+func collectFleet(t *testing.T, output string) map[string]float64 {
+	ch := make(chan prometheus.Metric, 100)
+	fleetTargets.Collect(ch)
+	close(ch)
+	got := map[string]float64{}
+	for m := range ch {
+		pb := &dto.Metric{}
+		if err := m.Write(pb); err != nil {
+			t.Fatal(err)
+		}
+		labels := map[string]string{}
+		for _, l := range pb.Label {
+			labels[l.GetName()] = l.GetValue()
+		}
+		if labels["output"] == output {
+			got[labels["label"]+"="+labels["value"]] = pb.Gauge.GetValue()
+		}
+	}
+	return got
+}
+
+func TestManager_FleetLabels(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "fleet.json")
+	m := NewManager(WithTimeout(time.Minute))
+	m.fleetLabels = FleetLabels{"discovery.fakeLabels": {"cluster", "missing"}}
+	m.Register(&fakeLabels{labels: map[string]string{"cluster": "prometheus-federation"}}, output)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m.Run(ctx, time.Minute)
+
+	want := map[string]float64{"cluster=prometheus-federation": 1}
+	if got := collectFleet(t, output); !reflect.DeepEqual(got, want) {
+		t.Errorf("fleet targets = %v, want %v", got, want)
+	}
+	m.Unregister(output)
+	if got := collectFleet(t, output); len(got) != 0 {
+		t.Errorf("fleet targets after Unregister = %v, want none", got)
+	}
+}
+
+func Test_fleetGauge_set(t *testing.T) {
+	configs := []StaticConfig{
+		{Targets: []string{"a:1", "b:1"}, Labels: map[string]string{"service": "etl", "version": "v1"}},
+		{Targets: []string{"c:1"}, Labels: map[string]string{"service": "etl", "version": "v2"}},
+		{Targets: []string{"d:1"}, Labels: map[string]string{"service": "gardener"}},
+	}
+	fleetTargets.set("test.Service", "set.json", []string{"service", "version"}, configs)
+	want := map[string]float64{"service=etl": 3, "service=gardener": 1, "version=v1": 2, "version=v2": 1}
+	if got := collectFleet(t, "set.json"); !reflect.DeepEqual(got, want) {
+		t.Errorf("fleetGauge.set() = %v, want %v", got, want)
+	}
+	// Values that disappear are not reported.
+	fleetTargets.set("test.Service", "set.json", []string{"service"}, configs[2:])
+	want = map[string]float64{"service=gardener": 1}
+	if got := collectFleet(t, "set.json"); !reflect.DeepEqual(got, want) {
+		t.Errorf("fleetGauge.set() = %v, want %v", got, want)
+	}
+	fleetTargets.remove("set.json")
+}
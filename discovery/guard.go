@@ -0,0 +1,49 @@
+package discovery
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/m-lab/gcp-service-discovery/metrics"
+)
+
+var (
+	// oversizedWritesBlocked counts discovery passes that were not written
+	// because they exceeded the target or size limit of the Manager. The metric
+	// is labeled by the output filename and the exceeded limit, "targets" or
+	// "bytes".
+	//
+	// Provides metrics:
+	//   gcp_manager_oversized_writes_blocked_total{output="/targets/gke.json", limit="targets"}
+	// Usage example:
+	//   oversizedWritesBlocked.WithLabelValues("/targets/gke.json", "targets").Inc()
+	oversizedWritesBlocked = metrics.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gcp_manager_oversized_writes_blocked_total",
+			Help: "Number of results not written because they exceeded a target or size limit.",
+		},
+		[]string{"output", "limit"},
+	)
+)
+
+// checkMaxTargets returns an error if r has more targets than the limit set by
+// WithMaxTargets.
+func (m *Manager) checkMaxTargets(r *result) error {
+	n := countTargets(r.configs)
+	if m.maxTargets <= 0 || n <= m.maxTargets {
+		return nil
+	}
+	oversizedWritesBlocked.WithLabelValues(r.reg.output, "targets").Inc()
+	return fmt.Errorf("found %d targets, more than the limit of %d; not replacing the previous targets", n, m.maxTargets)
+}
+
+// checkOutputSize returns an error if an output of the given size in bytes is
+// larger than the limit set by WithMaxOutputSize.
+func (m *Manager) checkOutputSize(output string, size int64) error {
+	if m.maxOutputSize <= 0 || size <= m.maxOutputSize {
+		return nil
+	}
+	oversizedWritesBlocked.WithLabelValues(output, "bytes").Inc()
+	return fmt.Errorf("targets of %d bytes are larger than the limit of %d; not replacing the previous targets", size, m.maxOutputSize)
+}
@@ -0,0 +1,73 @@
+package discovery
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestManager_commitLimits(t *testing.T) {
+	tests := []struct {
+		name          string
+		maxTargets    int
+		maxOutputSize int64
+		configs       []StaticConfig
+		wantErr       bool
+		wantLimit     string
+	}{
+		{
+			name:    "success-unlimited",
+			configs: syntheticConfigs(100),
+		},
+		{
+			name:          "success-within-limits",
+			maxTargets:    100,
+			maxOutputSize: 1 << 20,
+			configs:       syntheticConfigs(100),
+		},
+		{
+			name:       "failure-targets",
+			maxTargets: 99,
+			configs:    syntheticConfigs(100),
+			wantErr:    true,
+			wantLimit:  "targets",
+		},
+		{
+			name:          "failure-bytes",
+			maxOutputSize: 100,
+			configs:       syntheticConfigs(100),
+			wantErr:       true,
+			wantLimit:     "bytes",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := filepath.Join(t.TempDir(), "output.json")
+			previous := `[{"targets": ["a:9090"], "labels": {}}]`
+			ioutil.WriteFile(output, []byte(previous), 0644)
+			m := NewManager(WithTimeout(time.Minute), WithMaxTargets(tt.maxTargets), WithMaxOutputSize(tt.maxOutputSize))
+			m.Register(&fakeLiteral{}, output)
+			reg := m.registrations[0]
+			err := m.commit(context.Background(), &result{reg: reg, service: "fake", configs: tt.configs})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Manager.commit() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			data, _ := ioutil.ReadFile(output)
+			if tt.wantErr && string(data) != previous {
+				t.Errorf("Manager.commit() replaced output with %q", data)
+			}
+			if !tt.wantErr && string(data) == previous {
+				t.Errorf("Manager.commit() did not replace output")
+			}
+			if tt.wantLimit != "" {
+				if v := testutil.ToFloat64(oversizedWritesBlocked.WithLabelValues(output, tt.wantLimit)); v != 1 {
+					t.Errorf("gcp_manager_oversized_writes_blocked_total = %v, want 1", v)
+				}
+			}
+		})
+	}
+}
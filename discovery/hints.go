@@ -0,0 +1,146 @@
+package discovery
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Scrape hint label names. Prometheus uses the values of these labels as the
+// scrape interval and timeout of a target, instead of those of its job.
+const (
+	LabelScrapeInterval = "__scrape_interval__"
+	LabelScrapeTimeout  = "__scrape_timeout__"
+)
+
+// ScrapeHint is the scrape interval and timeout stamped onto the targets of a
+// service. Zero values are not stamped.
+type ScrapeHint struct {
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// ScrapeHints maps service names, e.g. "web.Service", to the scrape hint
+// labels added to every target of that service. ScrapeHints implements the
+// flag.Value interface, so it may be set from the command line with values
+// like:
+//
+//	aeflex.Service=interval=2m,timeout=90s
+type ScrapeHints map[string]ScrapeHint
+
+// String formats the hints as a space separated list of flag values.
+func (h ScrapeHints) String() string {
+	names := []string{}
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	values := []string{}
+	for _, name := range names {
+		opts := []string{}
+		if h[name].Interval > 0 {
+			opts = append(opts, "interval="+promDuration(h[name].Interval))
+		}
+		if h[name].Timeout > 0 {
+			opts = append(opts, "timeout="+promDuration(h[name].Timeout))
+		}
+		values = append(values, name+"="+strings.Join(opts, ","))
+	}
+	return strings.Join(values, " ")
+}
+
+// Set parses a value of the form "service=interval=<duration>,timeout=<duration>"
+// and saves the hints for the named service. Either option may be omitted, but
+// the timeout may not be longer than the interval, since Prometheus drops such
+// targets.
+func (h *ScrapeHints) Set(value string) error {
+	fields := strings.SplitN(value, "=", 2)
+	if len(fields) != 2 || fields[0] == "" || fields[1] == "" {
+		return fmt.Errorf("invalid scrape hints %q: want service=interval=<duration>,timeout=<duration>", value)
+	}
+	hint := ScrapeHint{}
+	for _, opt := range strings.Split(fields[1], ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(opt), "=")
+		if !ok {
+			return fmt.Errorf("invalid scrape hint %q: want key=duration", opt)
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid scrape hint %q: %s", opt, err)
+		}
+		if d <= 0 || d%time.Millisecond != 0 {
+			return fmt.Errorf("invalid scrape hint %q: want a positive number of milliseconds", opt)
+		}
+		switch k {
+		case "interval":
+			hint.Interval = d
+		case "timeout":
+			hint.Timeout = d
+		default:
+			return fmt.Errorf("unknown scrape hint %q: want interval or timeout", k)
+		}
+	}
+	if hint.Interval > 0 && hint.Timeout > hint.Interval {
+		return fmt.Errorf("invalid scrape hints %q: timeout is longer than interval", value)
+	}
+	if *h == nil {
+		*h = ScrapeHints{}
+	}
+	(*h)[fields[0]] = hint
+	return nil
+}
+
+// apply returns copies of configs with the hint labels added. Labels already
+// set by the service are kept, so a source may choose its own settings. The
+// given configs are not modified.
+func (s ScrapeHint) apply(configs []StaticConfig) []StaticConfig {
+	hints := map[string]string{}
+	if s.Interval > 0 {
+		hints[LabelScrapeInterval] = promDuration(s.Interval)
+	}
+	if s.Timeout > 0 {
+		hints[LabelScrapeTimeout] = promDuration(s.Timeout)
+	}
+	return stampLabels(configs, hints)
+}
+
+// stampLabels returns copies of configs with the given labels added, unless
+// already set. The given configs are not modified.
+func stampLabels(configs []StaticConfig, labels map[string]string) []StaticConfig {
+	if len(labels) == 0 || configs == nil {
+		return configs
+	}
+	result := make([]StaticConfig, len(configs))
+	for i, c := range configs {
+		result[i] = StaticConfig{Targets: c.Targets, Extra: c.Extra}
+		result[i].Labels = make(map[string]string, len(c.Labels)+len(labels))
+		for k, v := range labels {
+			result[i].Labels[k] = v
+		}
+		for k, v := range c.Labels {
+			result[i].Labels[k] = v
+		}
+	}
+	return result
+}
+
+// promDuration formats d in the duration format of Prometheus, e.g. "1m30s".
+// Unlike time.Duration.String, fractional seconds are written in milliseconds,
+// which Prometheus can parse.
+func promDuration(d time.Duration) string {
+	if d == 0 {
+		return "0s"
+	}
+	var b strings.Builder
+	for _, u := range []struct {
+		name string
+		d    time.Duration
+	}{{"h", time.Hour}, {"m", time.Minute}, {"s", time.Second}, {"ms", time.Millisecond}} {
+		if n := d / u.d; n > 0 {
+			fmt.Fprintf(&b, "%d%s", n, u.name)
+			d -= n * u.d
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,139 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestScrapeHints_Set(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  []string
+		want    ScrapeHints
+		wantStr string
+		wantErr bool
+	}{
+		{
+			name:   "success",
+			values: []string{"aeflex.Service=interval=2m, timeout=1m30s", "web.Service=timeout=1500ms"},
+			want: ScrapeHints{
+				"aeflex.Service": {Interval: 2 * time.Minute, Timeout: 90 * time.Second},
+				"web.Service":    {Timeout: 1500 * time.Millisecond},
+			},
+			wantStr: "aeflex.Service=interval=2m,timeout=1m30s web.Service=timeout=1s500ms",
+		},
+		{
+			name:    "error-missing-hints",
+			values:  []string{"web.Service"},
+			wantErr: true,
+		},
+		{
+			name:    "error-unknown-hint",
+			values:  []string{"web.Service=deadline=1m"},
+			wantErr: true,
+		},
+		{
+			name:    "error-invalid-duration",
+			values:  []string{"web.Service=interval=often"},
+			wantErr: true,
+		},
+		{
+			name:    "error-sub-millisecond",
+			values:  []string{"web.Service=interval=1.0001ms"},
+			wantErr: true,
+		},
+		{
+			name:    "error-timeout-too-long",
+			values:  []string{"web.Service=interval=1m,timeout=2m"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h ScrapeHints
+			var err error
+			for _, v := range tt.values {
+				err = h.Set(v)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ScrapeHints.Set() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(h, tt.want) {
+				t.Errorf("ScrapeHints.Set() = %v, want %v", h, tt.want)
+			}
+			if got := h.String(); got != tt.wantStr {
+				t.Errorf("ScrapeHints.String() = %q, want %q", got, tt.wantStr)
+			}
+		})
+	}
+}
+
+func TestScrapeHint_apply(t *testing.T) {
+	configs := []StaticConfig{
+		{Targets: []string{"a:1"}, Labels: map[string]string{"x": "1"}},
+		{Targets: []string{"b:1"}, Labels: map[string]string{LabelScrapeTimeout: "5s"}},
+		{Targets: []string{"c:1"}},
+	}
+	hint := ScrapeHint{Interval: 2 * time.Minute, Timeout: 10 * time.Second}
+	want := []StaticConfig{
+		{Targets: []string{"a:1"}, Labels: map[string]string{"x": "1", LabelScrapeInterval: "2m", LabelScrapeTimeout: "10s"}},
+		{Targets: []string{"b:1"}, Labels: map[string]string{LabelScrapeInterval: "2m", LabelScrapeTimeout: "5s"}},
+		{Targets: []string{"c:1"}, Labels: map[string]string{LabelScrapeInterval: "2m", LabelScrapeTimeout: "10s"}},
+	}
+	if got := hint.apply(configs); !reflect.DeepEqual(got, want) {
+		t.Errorf("ScrapeHint.apply() = %v, want %v", got, want)
+	}
+	if len(configs[0].Labels) != 1 {
+		t.Errorf("ScrapeHint.apply() modified the given configs: %v", configs[0].Labels)
+	}
+	if got := (ScrapeHint{}).apply(configs); !reflect.DeepEqual(got, configs) {
+		t.Errorf("ScrapeHint{}.apply() = %v, want %v", got, configs)
+	}
+}
+
+func TestManager_ScrapeHints(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "output.json")
+	m := NewManager(WithTimeout(time.Minute))
+	m.scrapeHints = ScrapeHints{"discovery.fakeRaw": {Interval: 5 * time.Minute}}
+	m.Register(&fakeRaw{}, output)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m.Run(ctx, time.Minute)
+
+	data, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	got := []StaticConfig{}
+	if err = json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if len(got) != 1 || got[0].Labels[LabelScrapeInterval] != "5m" {
+		t.Errorf("Manager.Run() wrote %s, want a %s label", data, LabelScrapeInterval)
+	}
+}
+
+func Test_promDuration(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{d: 0, want: "0s"},
+		{d: 90 * time.Second, want: "1m30s"},
+		{d: 2 * time.Hour, want: "2h"},
+		{d: 250 * time.Millisecond, want: "250ms"},
+	}
+	for _, tt := range tests {
+		if got := promDuration(tt.d); got != tt.want {
+			t.Errorf("promDuration(%v) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package discovery
+
+import (
+	"fmt"
+	"strings"
+)
+
+// LabelStyle selects the names of the labels that describe the source of a
+// target, e.g. its App Engine service or GKE cluster. LabelStyle implements the
+// flag.Value interface.
+type LabelStyle string
+
+// Supported label styles.
+const (
+	// LabelStyleLegacy writes source labels with their original names, e.g.
+	// __aef_service, __gke_autopilot, and cluster.
+	LabelStyleLegacy LabelStyle = "legacy"
+
+	// LabelStyleMeta writes source labels with the __meta_gcp_<source>_
+	// prefix of Prometheus service discovery conventions, e.g.
+	// __meta_gcp_aeflex_service and __meta_gcp_gke_cluster. Prometheus drops
+	// these labels after relabeling, unless they are explicitly mapped to
+	// target labels.
+	LabelStyleMeta LabelStyle = "meta"
+
+	// LabelStyleBoth writes source labels with both names, so relabeling
+	// rules may move to the new names before the legacy names are removed.
+	LabelStyleBoth LabelStyle = "both"
+)
+
+// metaPrefixes maps the legacy label prefix of every source to its
+// LabelStyleMeta prefix.
+var metaPrefixes = []struct {
+	legacy, meta string
+}{
+	{"__aef_", "__meta_gcp_aeflex_"},
+	{"__gke_", "__meta_gcp_gke_"},
+	{"__neg_", "__meta_gcp_neg_"},
+	{"__api_", "__meta_gcp_api_"},
+	{"__gce_", "__meta_gcp_gce_"},
+}
+
+// plainLabels maps service names to the source labels they write without a
+// prefix, and the LabelStyleMeta names of those labels.
+var plainLabels = map[string]map[string]string{
+	"gke.Service": {
+		"cluster": "__meta_gcp_gke_cluster",
+		"zone":    "__meta_gcp_gke_zone",
+		"service": "__meta_gcp_gke_service",
+	},
+}
+
+// String returns the style name.
+func (s LabelStyle) String() string {
+	return string(s)
+}
+
+// Set parses a style name.
+func (s *LabelStyle) Set(value string) error {
+	switch v := LabelStyle(strings.ToLower(value)); v {
+	case LabelStyleLegacy, LabelStyleMeta, LabelStyleBoth:
+		*s = v
+		return nil
+	}
+	return fmt.Errorf("unknown label style %q: want %q, %q, or %q", value, LabelStyleLegacy, LabelStyleMeta, LabelStyleBoth)
+}
+
+// rewrites returns true if the style changes the labels of targets.
+func (s LabelStyle) rewrites() bool {
+	return s == LabelStyleMeta || s == LabelStyleBoth
+}
+
+// apply returns copies of configs discovered by the named service, with source
+// labels named by the style. The given configs are not modified.
+func (s LabelStyle) apply(service string, configs []StaticConfig) []StaticConfig {
+	if !s.rewrites() || configs == nil {
+		return configs
+	}
+	result := make([]StaticConfig, len(configs))
+	for i, c := range configs {
+		result[i] = StaticConfig{Targets: c.Targets, Extra: c.Extra}
+		if c.Labels == nil {
+			continue
+		}
+		result[i].Labels = make(map[string]string, len(c.Labels))
+		for k, v := range c.Labels {
+			meta, ok := metaLabel(service, k)
+			if !ok || s == LabelStyleBoth {
+				result[i].Labels[k] = v
+			}
+			if ok {
+				result[i].Labels[meta] = v
+			}
+		}
+	}
+	return result
+}
+
+// metaLabel returns the LabelStyleMeta name of label k written by the named
+// service, and false if k is not a source label.
+func metaLabel(service, k string) (string, bool) {
+	for _, p := range metaPrefixes {
+		if strings.HasPrefix(k, p.legacy) {
+			return p.meta + strings.TrimPrefix(k, p.legacy), true
+		}
+	}
+	meta, ok := plainLabels[service][k]
+	return meta, ok
+}
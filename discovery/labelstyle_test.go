@@ -0,0 +1,171 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLabelStyle_Set(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    LabelStyle
+		wantErr bool
+	}{
+		{
+			name:  "legacy",
+			value: "legacy",
+			want:  LabelStyleLegacy,
+		},
+		{
+			name:  "meta",
+			value: "Meta",
+			want:  LabelStyleMeta,
+		},
+		{
+			name:  "both",
+			value: "both",
+			want:  LabelStyleBoth,
+		},
+		{
+			name:    "failure-unknown",
+			value:   "kubernetes",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s LabelStyle
+			err := s.Set(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("LabelStyle.Set() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if s != tt.want {
+				t.Errorf("LabelStyle.Set() = %q, want %q", s, tt.want)
+			}
+		})
+	}
+}
+
+func TestLabelStyle_apply(t *testing.T) {
+	labels := map[string]string{
+		"__address__":     "5.6.7.8:9090",
+		"__aef_service":   "etl",
+		"__gce_label_env": "prod",
+		"__meta_ready":    "true",
+		"cluster":         "prometheus-federation",
+	}
+	tests := []struct {
+		name    string
+		style   LabelStyle
+		service string
+		want    map[string]string
+	}{
+		{
+			name:    "legacy",
+			style:   LabelStyleLegacy,
+			service: "gke.Service",
+			want:    labels,
+		},
+		{
+			name:    "default",
+			service: "gke.Service",
+			want:    labels,
+		},
+		{
+			name:    "meta",
+			style:   LabelStyleMeta,
+			service: "gke.Service",
+			want: map[string]string{
+				"__address__":               "5.6.7.8:9090",
+				"__meta_gcp_aeflex_service": "etl",
+				"__meta_gcp_gce_label_env":  "prod",
+				"__meta_ready":              "true",
+				"__meta_gcp_gke_cluster":    "prometheus-federation",
+			},
+		},
+		{
+			name:    "meta-other-service",
+			style:   LabelStyleMeta,
+			service: "web.Service",
+			want: map[string]string{
+				"__address__":               "5.6.7.8:9090",
+				"__meta_gcp_aeflex_service": "etl",
+				"__meta_gcp_gce_label_env":  "prod",
+				"__meta_ready":              "true",
+				"cluster":                   "prometheus-federation",
+			},
+		},
+		{
+			name:    "both",
+			style:   LabelStyleBoth,
+			service: "gke.Service",
+			want: map[string]string{
+				"__address__":               "5.6.7.8:9090",
+				"__aef_service":             "etl",
+				"__meta_gcp_aeflex_service": "etl",
+				"__gce_label_env":           "prod",
+				"__meta_gcp_gce_label_env":  "prod",
+				"__meta_ready":              "true",
+				"cluster":                   "prometheus-federation",
+				"__meta_gcp_gke_cluster":    "prometheus-federation",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configs := []StaticConfig{{Targets: []string{"1.2.3.4:9090"}, Labels: labels}, {Targets: []string{"a"}}}
+			got := tt.style.apply(tt.service, configs)
+			if !reflect.DeepEqual(got[0].Labels, tt.want) {
+				t.Errorf("LabelStyle.apply() = %v, want %v", got[0].Labels, tt.want)
+			}
+			if got[1].Labels != nil {
+				t.Errorf("LabelStyle.apply() = %v, want no labels", got[1].Labels)
+			}
+			if _, ok := labels["__aef_service"]; !ok {
+				t.Errorf("LabelStyle.apply() modified the given labels")
+			}
+		})
+	}
+}
+
+type fakeSourceLabels struct{}
+
+func (f *fakeSourceLabels) Discover(ctx context.Context) ([]StaticConfig, error) {
+	return []StaticConfig{
+		{Targets: []string{"output"}, Labels: map[string]string{"__aef_service": "etl"}},
+	}, nil
+}
+
+func (f *fakeSourceLabels) Raw() []byte {
+	return []byte(`[{"targets": ["output"], "labels": {"__aef_service": "etl"}}]`)
+}
+
+func TestManager_LabelStyle(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "output.json")
+	m := NewManager(WithTimeout(time.Minute), WithLabelStyle(LabelStyleMeta))
+	m.Register(&fakeSourceLabels{}, output)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m.Run(ctx, time.Minute)
+
+	data, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	got := []StaticConfig{}
+	if err = json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	// The raw data of the service is not written, since it has the legacy
+	// labels.
+	want := []StaticConfig{{Targets: []string{"output"}, Labels: map[string]string{"__meta_gcp_aeflex_service": "etl"}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Manager.Run() wrote %s, want %v", data, want)
+	}
+}
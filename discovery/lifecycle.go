@@ -0,0 +1,112 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"time"
+)
+
+// LifecycleSuffix is appended to an output filename to name the lifecycle file
+// written alongside it.
+const LifecycleSuffix = ".lifecycle.json"
+
+// Lifecycle states of the upstream objects of targets. Downtime of targets in
+// these states is expected.
+const (
+	// LifecycleDraining is the state of targets that refuse new connections
+	// before they are stopped, e.g. AppEngine instances of a version that no
+	// longer receives traffic.
+	LifecycleDraining = "draining"
+
+	// LifecycleUpgrading is the state of targets that may be restarted or
+	// replaced by an upgrade, e.g. the nodes of a GKE node pool.
+	LifecycleUpgrading = "upgrading"
+
+	// LifecycleDeleting is the state of targets that are being deleted.
+	LifecycleDeleting = "deleting"
+)
+
+// Lifecycle describes the state of the upstream object of a target that is
+// expected to make the target unavailable.
+type Lifecycle struct {
+	// State is one of the Lifecycle states, e.g. LifecycleDraining.
+	State string `json:"state"`
+
+	// Reason describes the upstream object and its state as reported by the
+	// source API, e.g. "node pool default-pool RECONCILING".
+	Reason string `json:"reason,omitempty"`
+}
+
+// Lifecycles is the content of a lifecycle file. Alertmanager inhibition rules
+// may use it to silence alerts for targets with expected downtime.
+type Lifecycles struct {
+	// Generated is the time the lifecycle file was written.
+	Generated time.Time `json:"generated"`
+
+	// Source is the name of the service that discovered the targets.
+	Source string `json:"source"`
+
+	// Targets maps the targets of the output file to their lifecycle. Targets
+	// without a reported lifecycle are omitted.
+	Targets map[string]Lifecycle `json:"targets"`
+}
+
+// RecordLifecycle saves the lifecycle of the upstream object that produced
+// every target in config, if ctx was created by the Manager. Otherwise,
+// RecordLifecycle does nothing. Services should call RecordLifecycle only for
+// targets with expected downtime.
+func RecordLifecycle(ctx context.Context, config StaticConfig, state, reason string) {
+	if ctx == nil {
+		return
+	}
+	r, ok := ctx.Value(originKey{}).(*originRecorder)
+	if !ok {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, t := range config.Targets {
+		o := r.origins[t]
+		o.Lifecycle = &Lifecycle{State: state, Reason: reason}
+		r.origins[t] = o
+	}
+}
+
+// ReadLifecycles reads the lifecycle file written alongside the named output
+// file.
+func ReadLifecycles(filename string) (*Lifecycles, error) {
+	data, err := ioutil.ReadFile(filename + LifecycleSuffix)
+	if err != nil {
+		return nil, err
+	}
+	l := &Lifecycles{}
+	err = json.Unmarshal(data, l)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// lifecycles returns the lifecycles of the targets written for r.
+func (r *result) lifecycles() map[string]Lifecycle {
+	targets := map[string]Lifecycle{}
+	for _, c := range r.configs {
+		for _, t := range c.Targets {
+			if o, ok := r.origins[t]; ok && o.Lifecycle != nil {
+				targets[t] = *o.Lifecycle
+			}
+		}
+	}
+	return targets
+}
+
+// writeLifecycles serializes the given lifecycles and stages them to be written
+// alongside the named output file when tx is committed.
+func writeLifecycles(tx *transaction, l Lifecycles, filename string) error {
+	data, err := json.MarshalIndent(l, "", "    ")
+	if err != nil {
+		return err
+	}
+	return tx.writeFile(filename+LifecycleSuffix, data)
+}
@@ -0,0 +1,84 @@
+package discovery
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeDraining discovers two targets, one of which is draining.
+type fakeDraining struct{}
+
+func (f *fakeDraining) Discover(ctx context.Context) ([]StaticConfig, error) {
+	serving := StaticConfig{Targets: []string{"10.0.0.1:9100"}, Labels: map[string]string{"version": "v2"}}
+	draining := StaticConfig{Targets: []string{"10.0.0.2:9100"}, Labels: map[string]string{"version": "v1"}}
+	// The lifecycle is kept whether it is recorded before or after the origin.
+	RecordLifecycle(ctx, draining, LifecycleDraining, "instance aef-v1 DRAINING")
+	RecordOrigin(ctx, draining, "v1")
+	RecordOrigin(ctx, serving, "v2")
+	return []StaticConfig{serving, draining}, nil
+}
+
+func TestManager_RunWriteLifecycle(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "foo.json")
+	m := NewManager(WithTimeout(time.Minute), WithLifecycle(true))
+	m.Register(&fakeDraining{}, output)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m.Run(ctx, time.Minute)
+
+	l, err := ReadLifecycles(output)
+	if err != nil {
+		t.Fatalf("ReadLifecycles() error = %v", err)
+	}
+	want := map[string]Lifecycle{
+		"10.0.0.2:9100": {State: LifecycleDraining, Reason: "instance aef-v1 DRAINING"},
+	}
+	if l.Source != "discovery.fakeDraining" || !reflect.DeepEqual(l.Targets, want) {
+		t.Errorf("ReadLifecycles() = %#v, want source discovery.fakeDraining and targets %v", l, want)
+	}
+
+	e := m.Explain("10.0.0.2:9100")
+	if len(e) != 1 || e[0].Object != "v1" || e[0].Lifecycle == nil || e[0].Lifecycle.State != LifecycleDraining {
+		t.Errorf("Manager.Explain() = %#v, want the draining lifecycle of v1", e)
+	}
+	e = m.Explain("10.0.0.1:9100")
+	if len(e) != 1 || e[0].Lifecycle != nil {
+		t.Errorf("Manager.Explain() = %#v, want no lifecycle", e)
+	}
+}
+
+func TestManager_RunWriteLifecycleDisabled(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "foo.json")
+	m := NewManager(WithTimeout(time.Minute))
+	m.Register(&fakeDraining{}, output)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m.Run(ctx, time.Minute)
+
+	if _, err := ReadLifecycles(output); err == nil {
+		t.Errorf("ReadLifecycles() error = nil, want an error without WithLifecycle")
+	}
+}
+
+func TestRecordLifecycle(t *testing.T) {
+	// RecordLifecycle does nothing outside of the Manager.
+	RecordLifecycle(nil, StaticConfig{Targets: []string{"a"}}, LifecycleDraining, "")
+	RecordLifecycle(context.Background(), StaticConfig{Targets: []string{"a"}}, LifecycleDraining, "")
+
+	r := &originRecorder{origins: map[string]Origin{}}
+	ctx := withOrigins(context.Background(), r)
+	config := StaticConfig{Targets: []string{"a", "b"}, Labels: map[string]string{"key": "value"}}
+	RecordOrigin(ctx, config, "object")
+	RecordLifecycle(ctx, config, LifecycleUpgrading, "node pool default-pool RECONCILING")
+	for _, target := range config.Targets {
+		o := r.origins[target]
+		if o.Object != "object" || o.Lifecycle == nil || o.Lifecycle.State != LifecycleUpgrading {
+			t.Errorf("origins[%q] = %#v, want object with the upgrading lifecycle", target, o)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package discovery
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/m-lab/gcp-service-discovery/metrics"
+)
+
+var (
+	// maintenanceActive reports whether discovery of a service is paused by a
+	// maintenance window. The metric is labeled by service name.
+	//
+	// Provides metrics:
+	//   gcp_manager_maintenance
+	// Usage example:
+	//   maintenanceActive.WithLabelValues("gke.Service").Set(1)
+	maintenanceActive = metrics.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gcp_manager_maintenance",
+			Help: "Whether discovery of a service is paused by a maintenance window.",
+		},
+		[]string{"service"},
+	)
+)
+
+// Schedule is a parsed cron expression with five fields: minute, hour, day of
+// month, month, and day of week. Every field is "*", a value, a range "a-b",
+// or a comma separated list of them, each optionally with a step "/n". Like
+// cron, when both the day of month and day of week are restricted, a time
+// matches if either matches. Times are matched in UTC.
+type Schedule struct {
+	spec   string
+	minute [60]bool
+	hour   [24]bool
+	dom    [32]bool
+	month  [13]bool
+	dow    [7]bool
+
+	// anyDay is true if the day of month or the day of week is "*".
+	anyDay bool
+}
+
+// cronField describes the allowed values of a cron field.
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var cronFields = []cronField{
+	{"minute", 0, 59}, {"hour", 0, 23}, {"day of month", 1, 31}, {"month", 1, 12}, {"day of week", 0, 7},
+}
+
+// ParseSchedule parses a cron expression, e.g. "0 3 * * 6" for 03:00 UTC
+// every Saturday.
+func ParseSchedule(spec string) (*Schedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("invalid schedule %q: want 5 fields", spec)
+	}
+	s := &Schedule{spec: strings.Join(fields, " ")}
+	sets := [][]bool{s.minute[:], s.hour[:], s.dom[:], s.month[:], make([]bool, 8)}
+	for i, f := range fields {
+		if err := parseCronField(f, cronFields[i], sets[i]); err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %w", spec, err)
+		}
+	}
+	// Both 0 and 7 are Sunday.
+	copy(s.dow[:], sets[4])
+	s.dow[0] = s.dow[0] || sets[4][7]
+	s.anyDay = fields[2] == "*" || fields[4] == "*"
+	return s, nil
+}
+
+// parseCronField sets the values of set matched by the cron field f.
+func parseCronField(f string, c cronField, set []bool) error {
+	for _, part := range strings.Split(f, ",") {
+		expr, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepStr)
+			if err != nil || step < 1 {
+				return fmt.Errorf("invalid %s step %q", c.name, stepStr)
+			}
+		}
+		lo, hi := c.min, c.max
+		if expr != "*" {
+			a, b, isRange := strings.Cut(expr, "-")
+			var err error
+			if lo, err = strconv.Atoi(a); err != nil {
+				return fmt.Errorf("invalid %s %q", c.name, part)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(b); err != nil {
+					return fmt.Errorf("invalid %s %q", c.name, part)
+				}
+			} else if hasStep {
+				hi = c.max
+			}
+			if lo < c.min || hi > c.max || lo > hi {
+				return fmt.Errorf("%s %q is out of range %d-%d", c.name, part, c.min, c.max)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return nil
+}
+
+// String returns the cron expression.
+func (s *Schedule) String() string {
+	return s.spec
+}
+
+// Matches returns true if the schedule matches the minute of t.
+func (s *Schedule) Matches(t time.Time) bool {
+	t = t.UTC()
+	if !s.minute[t.Minute()] || !s.hour[t.Hour()] || !s.month[t.Month()] {
+		return false
+	}
+	if s.anyDay {
+		return s.dom[t.Day()] && s.dow[t.Weekday()]
+	}
+	return s.dom[t.Day()] || s.dow[t.Weekday()]
+}
+
+// MaintenanceWindow is a period that starts at every time matched by its
+// Schedule and lasts for Duration.
+type MaintenanceWindow struct {
+	Schedule *Schedule
+	Duration time.Duration
+}
+
+// Active returns true if t is within a window, i.e. the schedule matched a
+// minute that started less than Duration before t.
+func (w MaintenanceWindow) Active(t time.Time) bool {
+	start := t.Truncate(time.Minute)
+	for ; t.Sub(start) < w.Duration; start = start.Add(-time.Minute) {
+		if w.Schedule.Matches(start) {
+			return true
+		}
+	}
+	return false
+}
+
+// String formats the window as a flag value, e.g. "2h@0 3 * * 6".
+func (w MaintenanceWindow) String() string {
+	return promDuration(w.Duration) + "@" + w.Schedule.String()
+}
+
+// MaintenanceWindows maps service names, e.g. "gke.Service", to the windows
+// during which discovery of that service is paused. MaintenanceWindows
+// implements the flag.Value interface, so it may be set from the command line
+// with values like:
+//
+//	gke.Service=2h@0 3 * * 6
+type MaintenanceWindows map[string][]MaintenanceWindow
+
+// String formats the windows as a semicolon separated list of flag values.
+func (m MaintenanceWindows) String() string {
+	names := []string{}
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	values := []string{}
+	for _, name := range names {
+		for _, w := range m[name] {
+			values = append(values, name+"="+w.String())
+		}
+	}
+	return strings.Join(values, "; ")
+}
+
+// Set parses a value of the form "service=duration@schedule" and adds the
+// window to the named service.
+func (m *MaintenanceWindows) Set(value string) error {
+	fields := strings.SplitN(value, "=", 2)
+	if len(fields) != 2 || fields[0] == "" {
+		return fmt.Errorf("invalid maintenance window %q: want service=duration@schedule", value)
+	}
+	d, spec, ok := strings.Cut(fields[1], "@")
+	if !ok {
+		return fmt.Errorf("invalid maintenance window %q: want service=duration@schedule", value)
+	}
+	duration, err := time.ParseDuration(strings.TrimSpace(d))
+	if err != nil || duration < time.Minute {
+		return fmt.Errorf("invalid maintenance window duration %q: want at least 1m", d)
+	}
+	schedule, err := ParseSchedule(spec)
+	if err != nil {
+		return err
+	}
+	if *m == nil {
+		*m = MaintenanceWindows{}
+	}
+	(*m)[fields[0]] = append((*m)[fields[0]], MaintenanceWindow{Schedule: schedule, Duration: duration})
+	return nil
+}
+
+// active returns true if any window of the named service contains t.
+func (m MaintenanceWindows) active(service string, t time.Time) bool {
+	for _, w := range m[service] {
+		if w.Active(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,189 @@
+package discovery
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseSchedule(t *testing.T) {
+	// Saturday.
+	sat := time.Date(2021, 7, 10, 3, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		spec      string
+		matches   []time.Time
+		unmatched []time.Time
+		wantErr   bool
+	}{
+		{
+			name:      "success-weekly",
+			spec:      "0 3 * * 6",
+			matches:   []time.Time{sat, sat.Add(7 * 24 * time.Hour)},
+			unmatched: []time.Time{sat.Add(time.Minute), sat.Add(24 * time.Hour)},
+		},
+		{
+			name:      "success-lists-ranges-steps",
+			spec:      "*/15 1-3,22 * 6-8 *",
+			matches:   []time.Time{sat.Add(45 * time.Minute), sat.Add(19 * time.Hour)},
+			unmatched: []time.Time{sat.Add(10 * time.Minute), sat.Add(time.Hour), sat.AddDate(0, 6, 0)},
+		},
+		{
+			name:      "success-sunday-is-seven",
+			spec:      "0 3 * * 7",
+			matches:   []time.Time{sat.Add(24 * time.Hour)},
+			unmatched: []time.Time{sat},
+		},
+		{
+			name:      "success-day-of-month-or-week",
+			spec:      "0 3 1 * 6",
+			matches:   []time.Time{sat, time.Date(2021, 7, 1, 3, 0, 0, 0, time.UTC)},
+			unmatched: []time.Time{time.Date(2021, 7, 2, 3, 0, 0, 0, time.UTC)},
+		},
+		{
+			name:      "success-utc",
+			spec:      "0 3 * * *",
+			matches:   []time.Time{sat.In(time.FixedZone("EST", -5*3600))},
+			unmatched: []time.Time{time.Date(2021, 7, 10, 3, 0, 0, 0, time.FixedZone("EST", -5*3600))},
+		},
+		{
+			name:    "error-fields",
+			spec:    "0 3 * *",
+			wantErr: true,
+		},
+		{
+			name:    "error-out-of-range",
+			spec:    "60 3 * * *",
+			wantErr: true,
+		},
+		{
+			name:    "error-step",
+			spec:    "*/0 3 * * *",
+			wantErr: true,
+		},
+		{
+			name:    "error-value",
+			spec:    "0 3 * * sat",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := ParseSchedule(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSchedule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for _, m := range tt.matches {
+				if !s.Matches(m) {
+					t.Errorf("Schedule.Matches(%v) = false, want true", m)
+				}
+			}
+			for _, m := range tt.unmatched {
+				if s.Matches(m) {
+					t.Errorf("Schedule.Matches(%v) = true, want false", m)
+				}
+			}
+		})
+	}
+}
+
+func TestMaintenanceWindow_Active(t *testing.T) {
+	s, err := ParseSchedule("0 3 * * 6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := MaintenanceWindow{Schedule: s, Duration: 2 * time.Hour}
+	start := time.Date(2021, 7, 10, 3, 0, 0, 0, time.UTC)
+	tests := []struct {
+		t    time.Time
+		want bool
+	}{
+		{t: start.Add(-time.Second), want: false},
+		{t: start, want: true},
+		{t: start.Add(119*time.Minute + 59*time.Second), want: true},
+		{t: start.Add(2 * time.Hour), want: false},
+	}
+	for _, tt := range tests {
+		if got := w.Active(tt.t); got != tt.want {
+			t.Errorf("MaintenanceWindow.Active(%v) = %v, want %v", tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestMaintenanceWindows_Set(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  []string
+		wantStr string
+		wantErr bool
+	}{
+		{
+			name:    "success",
+			values:  []string{"gke.Service=2h@0 3 * * 6", "gke.Service=30m@0 12 1 * *", "web.Service=1h@*/30 * * * *"},
+			wantStr: "gke.Service=2h@0 3 * * 6; gke.Service=30m@0 12 1 * *; web.Service=1h@*/30 * * * *",
+		},
+		{
+			name:    "error-missing-schedule",
+			values:  []string{"gke.Service=2h"},
+			wantErr: true,
+		},
+		{
+			name:    "error-short-duration",
+			values:  []string{"gke.Service=30s@0 3 * * 6"},
+			wantErr: true,
+		},
+		{
+			name:    "error-schedule",
+			values:  []string{"gke.Service=2h@0 3 * *"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m MaintenanceWindows
+			var err error
+			for _, v := range tt.values {
+				err = m.Set(v)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("MaintenanceWindows.Set() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := m.String(); got != tt.wantStr {
+				t.Errorf("MaintenanceWindows.String() = %q, want %q", got, tt.wantStr)
+			}
+		})
+	}
+}
+
+func TestManager_MaintenanceWindows(t *testing.T) {
+	for _, atomic := range []bool{false, true} {
+		dir := t.TempDir()
+		clock := newFakeClock()
+		m := NewManager(WithTimeout(time.Minute))
+		m.clk = clock
+		m.atomic = atomic
+		m.maintenanceWindows = MaintenanceWindows{}
+		m.maintenanceWindows.Set("discovery.fakeCounter=1h@* * * * *")
+		paused := &fakeCounter{failing: true}
+		m.Register(paused, filepath.Join(dir, "paused.json"))
+		m.Register(&fakeLiteral{}, filepath.Join(dir, "output.json"))
+
+		ok := m.discoverAll(context.Background())
+		if !ok || paused.calls != 0 {
+			t.Errorf("Manager.discoverAll(atomic=%v) = %v after %d calls, want true without calls", atomic, ok, paused.calls)
+		}
+		status := m.Status()
+		if status[0].Health != HealthUnknown || status[1].Health != HealthOK {
+			t.Errorf("Manager.discoverAll(atomic=%v) health = %s, %s; want unknown, ok", atomic, status[0].Health, status[1].Health)
+		}
+		if v := testutil.ToFloat64(maintenanceActive.WithLabelValues("discovery.fakeCounter")); v != 1 {
+			t.Errorf("maintenance metric = %v, want 1", v)
+		}
+	}
+}
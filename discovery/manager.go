@@ -4,40 +4,34 @@ package discovery
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/dchest/safefile"
-	"github.com/m-lab/go/rtx"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/m-lab/gcp-service-discovery/metrics"
 )
 
 var (
 	// discoveryDurationHist provides a histogram of the time to run service discovery.
-	// The metric is labeled by the output filename, which is unique for each service.
+	// The metric is labeled by service name. Buckets may be set per service
+	// using WithDurationBuckets.
 	//
 	// Provides metrics:
 	//   gcp_manager_discovery_seconds_bucket
 	//   gcp_manager_discovery_seconds_count
 	//   gcp_manager_discovery_seconds_sum
 	// Usage example:
-	//   discoveryDurationHist.WithLabelValues("aeflex.Service").Observe(tDiff)
-	discoveryDurationHist = promauto.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name: "gcp_manager_discovery_seconds",
-			Help: "Histogram of service discovery run times.",
-			Buckets: []float64{
-				10, 15, 25, 40, 60,
-				100, 150, 250, 400, 600,
-				1000, 1500, 2500, 4000, 6000,
-			},
-		},
-		[]string{"service"},
-	)
+	//   discoveryDurationHist.With("aeflex.Service", defaultDurationBuckets).Observe(tDiff)
+	discoveryDurationHist = &durationHist{
+		name:  "gcp_manager_discovery_seconds",
+		help:  "Histogram of service discovery run times.",
+		hists: map[string]prometheus.Histogram{},
+	}
 
 	// discoveryTotal counts the total number of calls to service discovery. The
 	// metric is labeled by the output filename and whether the discovery succeeded
@@ -47,73 +41,250 @@ var (
 	//   gcp_manager_discovery_total
 	// Usage example:
 	//   discoveryTotal.WithLabelValues("aeflex.Service", "success").Inc()
-	discoveryTotal = promauto.NewCounterVec(
+	discoveryTotal = metrics.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "gcp_manager_discovery_total",
 			Help: "Number of discovery runs.",
 		},
 		[]string{"service", "status"},
 	)
+
+	// outputLastWrite records the time of the last successful write for each
+	// output. The metric is labeled by the output filename.
+	//
+	// Provides metrics:
+	//   gcp_manager_output_last_write_timestamp_seconds
+	// Usage example:
+	//   outputLastWrite.WithLabelValues("/targets/aeflex.json").SetToCurrentTime()
+	outputLastWrite = metrics.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gcp_manager_output_last_write_timestamp_seconds",
+			Help: "Time of the last successful write of each output.",
+		},
+		[]string{"output"},
+	)
+
+	// outputSize records the size of the last successful write for each
+	// output. The metric is labeled by the output filename.
+	//
+	// Provides metrics:
+	//   gcp_manager_output_size_bytes
+	// Usage example:
+	//   outputSize.WithLabelValues("/targets/aeflex.json").Set(len(data))
+	outputSize = metrics.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gcp_manager_output_size_bytes",
+			Help: "Size of the last successful write of each output.",
+		},
+		[]string{"output"},
+	)
 )
 
+// registration is a registered service and the state of its most recent
+// successful discovery.
+type registration struct {
+	service Service
+	output  string
+
+	// writer publishes targets when not nil. Otherwise, targets are written to
+	// the output file.
+	writer Writer
+
+	// verbatim is true if targets are written exactly as discovered, without
+	// the label style, scrape hints, owners, address rewrites, sanitization,
+	// or Profile of the Manager.
+	verbatim bool
+
+	// last saves the most recently written configs, and digest their digest
+	// reported by Digests. Protected by Manager.mu.
+	last   []StaticConfig
+	digest string
+
+	// origins saves the upstream objects reported for each target during the
+	// most recent successful discovery. Protected by Manager.mu.
+	origins map[string]Origin
+
+	// history records the results of recent passes. Protected by Manager.mu.
+	history history
+
+	// baseline records the target counts of recent successful passes.
+	// Protected by Manager.mu.
+	baseline baseline
+
+	// skip is the number of passes of Run to skip, and interval the interval
+	// between passes, after CostLimits are applied. Protected by Manager.mu.
+	skip     int
+	interval time.Duration
+
+	// timeline records recent changes of the written targets, if enabled by
+	// WithTimeline. Protected by Manager.mu.
+	timeline *timeline
+
+	// overdue is closed when the most recent abandoned call to Discover
+	// returns, and nil if no call was abandoned. Protected by Manager.mu.
+	overdue chan struct{}
+}
+
 // Manager executes service discovery then serializes and writes targets to disk.
+// A Manager is configured with Options when it is created.
 type Manager struct {
-	services []Service
-	output   []string
-	Timeout  time.Duration
+	// timeout is the maximum time of the discovery of each service.
+	timeout time.Duration
+
+	// hardDeadline is the maximum time to wait for the discovery of each
+	// service to return, even if it ignores the timeout.
+	hardDeadline time.Duration
+
+	// mu protects registrations and their state, which are read by HTTP
+	// handlers and may change while Run is running.
+	mu            sync.Mutex
+	registrations []*registration
+
+	// interval is the period of Run, used to detect stale outputs. Protected
+	// by mu.
+	interval time.Duration
+
+	// pausedServices are the outputs and service names paused by Pause,
+	// including AllServices. Protected by mu.
+	pausedServices map[string]bool
+
+	// reload requests an immediate discovery pass from Run.
+	reload chan struct{}
+
+	// logger reports the results of discovery passes and errors.
+	logger *log.Logger
+
+	// The settings of options, documented by the option of each.
+	writeMetadata      bool
+	writeChecksum      bool
+	writeLifecycle     bool
+	logUnchanged       bool
+	indent             string
+	decisionLog        *DecisionLog
+	maxParallel        int
+	tempDir            string
+	atomic             bool
+	durationBuckets    DurationBuckets
+	fleetLabels        FleetLabels
+	scrapeHints        ScrapeHints
+	owners             Owners
+	addressRewrites    AddressRewrites
+	maintenanceWindows MaintenanceWindows
+	costLimits         CostLimits
+	anomalyThreshold   float64
+	anomalyWebhook     string
+	allowEmpty         bool
+	allowEmptyOutputs  []string
+	bestEffortOutputs  []string
+	outputOrder        OutputOrder
+	maxTargets         int
+	maxOutputSize      int64
+	timelineSize       int
+	timelineDir        string
+	clk                Clock
+	profile            Profile
+	labelStyle         LabelStyle
+	sanitize           SanitizePolicy
+	afterPass          func(ok bool)
+	registerer         prometheus.Registerer
 }
 
-// NewManager creates a new manager instance. When calling Run, each registered
-// service should take no longer than Timeout.
-func NewManager(timeout time.Duration) *Manager {
-	return &Manager{Timeout: timeout}
+// DefaultTimeout is the maximum time of the discovery of each service, unless
+// changed by WithTimeout.
+const DefaultTimeout = 10 * time.Minute
+
+// NewManager creates a new manager instance configured by the given options.
+// Like prometheus.MustRegister, NewManager panics if the metrics cannot be
+// registered with the registerer given to WithRegisterer.
+func NewManager(opts ...Option) *Manager {
+	m := &Manager{
+		timeout: DefaultTimeout,
+		indent:  defaultIndent,
+		reload:  make(chan struct{}, 1),
+		logger:  log.Default(),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.registerer != nil {
+		if err := metrics.SetRegisterer(m.registerer); err != nil {
+			panic(err)
+		}
+	}
+	return m
 }
 
 // Register accepts a new service. Future calls to Run will discover targets
-// from this service and write them to the file named by output.
+// from this service and write them to the file named by output. Register is
+// safe to call while Run is running.
 func (m *Manager) Register(s Service, output string) {
-	m.services = append(m.services, s)
-	m.output = append(m.output, output)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.registrations = append(m.registrations, &registration{service: s, output: output})
 	return
 }
 
+// RegisterVerbatim accepts a new service like Register, but writes its targets
+// exactly as discovered: the label style, scrape hints, owners, address
+// rewrites, sanitization and Profile of the Manager are not applied, and the
+// raw document of a RawSource is always written. RegisterVerbatim is for
+// services that replicate the outputs of another instance, which were already
+// processed there.
+func (m *Manager) RegisterVerbatim(s Service, output string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.registrations = append(m.registrations, &registration{service: s, output: output, verbatim: true})
+}
+
+// Unregister removes the service registered for the named output. The output
+// file is not removed. Unregister returns false if no service was registered
+// for output. Unregister is safe to call while Run is running.
+func (m *Manager) Unregister(output string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, r := range m.registrations {
+		if r.output == output {
+			m.registrations = append(m.registrations[:i:i], m.registrations[i+1:]...)
+			fleetTargets.remove(output)
+			return true
+		}
+	}
+	return false
+}
+
 // Count returns the number of services registered.
 func (m *Manager) Count() int {
-	return len(m.services)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.registrations)
 }
 
-// Run executes discovery for all registered services every interval period. Run
-// returns once ctx is canceled.
+// registered returns a copy of the current registrations.
+func (m *Manager) registered() []*registration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*registration{}, m.registrations...)
+}
+
+// Run executes discovery for all registered services every interval period, and
+// after every call to Reload. Run returns once ctx is canceled.
 func (m *Manager) Run(ctx context.Context, interval time.Duration) {
-	tick := time.Tick(interval)
+	m.mu.Lock()
+	m.interval = interval
+	m.mu.Unlock()
+	ticker := m.clock().NewTicker(interval)
+	defer ticker.Stop()
 	for {
-		// TODO: add waitgroup and run discovery in parallel.
-		for i := range m.services {
-			// Label the discoveryDurationHist by service name. Labeling by service
-			// provides better histogram fidelity.
-			service := strings.TrimPrefix(fmt.Sprintf("%T", m.services[i]), "*")
-			startTime := time.Now()
-			disCtx, cancel := context.WithTimeout(ctx, m.Timeout)
-			configs, err := m.services[i].Discover(disCtx)
-			cancel()
-			if err != nil {
-				log.Printf("Error: %T: %s", m.services[i], err)
-				discoveryTotal.WithLabelValues(service, "error-discovery").Inc()
-				continue
-			}
-			discoveryDurationHist.WithLabelValues(service).Observe(time.Since(startTime).Seconds())
-			err = writeConfigToFile(configs, m.output[i])
-			if err != nil {
-				log.Printf("Error: %s: %s", m.output[i], err)
-				discoveryTotal.WithLabelValues(service, "error-write").Inc()
-				continue
-			}
-			discoveryTotal.WithLabelValues(service, "success").Inc()
+		ok := m.discoverAll(ctx)
+		if m.afterPass != nil {
+			m.afterPass(ok)
 		}
 
-		// Wait for ticker or exit when ctx is closed.
+		// Wait for ticker or reload, or exit when ctx is closed.
 		select {
-		case <-tick:
+		case <-ticker.C():
+			continue
+		case <-m.reload:
 			continue
 		case <-ctx.Done():
 			return
@@ -121,17 +292,386 @@ func (m *Manager) Run(ctx context.Context, interval time.Duration) {
 	}
 }
 
-// writeConfigToFile serializes and writes the given configs as JSON to the output filename.
-func writeConfigToFile(configs []StaticConfig, filename string) error {
-	// Convert to JSON.
-	data, err := json.MarshalIndent(configs, "", "    ")
-	rtx.Must(err, "Failed to marshal StaticConfig")
+// clock returns the Clock of the Manager.
+func (m *Manager) clock() Clock {
+	return clockOrReal(m.clk)
+}
 
-	// Write to file.
-	err = safefile.WriteFile(filename, data, 0644)
+// Reload discards cached results and causes Run to start a new discovery pass
+// without waiting for the next interval. If a pass is running, the new pass
+// starts after it completes. Reload does not block.
+func (m *Manager) Reload() {
+	for _, reg := range m.registered() {
+		invalidate(reg.service)
+	}
+	// Passes skipped because of CostLimits are not skipped after a reload.
+	m.mu.Lock()
+	for _, reg := range m.registrations {
+		reg.skip = 0
+	}
+	m.mu.Unlock()
+	select {
+	case m.reload <- struct{}{}:
+	default:
+		// A reload is already pending.
+	}
+}
+
+// invalidate calls Invalidate on s, or any service wrapped by s, that
+// implements it, such as a Cache.
+func invalidate(s Service) {
+	for {
+		if c, ok := s.(interface{ Invalidate() }); ok {
+			c.Invalidate()
+		}
+		w, ok := s.(interface{ Unwrap() Service })
+		if !ok {
+			return
+		}
+		s = w.Unwrap()
+	}
+}
+
+// discoverAll runs discovery for every registered service, running at most
+// MaxParallel services at once, and returns once all have completed. Services
+// run in stages, so outputs are written after the outputs ordered before them
+// by WithOutputOrder. discoverAll returns true if every critical output was
+// updated.
+func (m *Manager) discoverAll(ctx context.Context) bool {
+	parallel := m.maxParallel
+	if parallel < 1 {
+		parallel = 1
+	}
+	regs := m.registered()
+	results := make([]*result, len(regs))
+	paused := m.paused(regs)
+	for i, reg := range regs {
+		paused[i] = paused[i] || m.throttled(reg)
+	}
+	sem := make(chan struct{}, parallel)
+	failed := make([]bool, len(regs))
+	stages := m.outputOrder.stages(regs)
+	for _, stage := range stages {
+		wg := sync.WaitGroup{}
+		for _, i := range stage {
+			if paused[i] {
+				continue
+			}
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(i int) {
+				defer wg.Done()
+				r, err := m.discover(ctx, regs[i])
+				if err != nil {
+					m.record(regs[i], err)
+				} else if !m.atomic {
+					err = m.commit(ctx, r)
+				}
+				results[i] = r
+				failed[i] = err != nil
+				<-sem
+			}(i)
+		}
+		// Later stages wait until the outputs ordered before them are written.
+		wg.Wait()
+	}
+	if !m.atomic {
+		for i := range failed {
+			if failed[i] && m.critical(regs[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	// Outputs are renamed into place in the order of the stages.
+	updates := []*result{}
+	for _, stage := range stages {
+		for _, i := range stage {
+			if paused[i] {
+				continue
+			}
+			if results[i] == nil && !m.critical(regs[i]) {
+				m.logger.Printf("Error: %s: keeping previous targets of best-effort output", regs[i].output)
+				continue
+			}
+			if results[i] == nil {
+				m.logger.Printf("Error: %s: skipping update of all outputs after discovery failed", regs[i].output)
+				for _, r := range results {
+					if r != nil {
+						m.record(r.reg, errAtomicSkipped)
+					}
+				}
+				return false
+			}
+			updates = append(updates, results[i])
+		}
+	}
+	if len(updates) == 0 {
+		return true
+	}
+	return m.commit(ctx, updates...) == nil
+}
+
+// paused returns whether each of regs is paused by Pause or is in a
+// maintenance window, and updates the maintenance metric of every service with
+// windows.
+func (m *Manager) paused(regs []*registration) []bool {
+	paused := make([]bool, len(regs))
+	m.mu.Lock()
+	for i, reg := range regs {
+		if m.isPaused(reg) {
+			m.logger.Printf("%s: skipping discovery while paused", reg.output)
+			paused[i] = true
+		}
+	}
+	m.mu.Unlock()
+	if len(m.maintenanceWindows) == 0 {
+		return paused
+	}
+	now := m.clock().Now()
+	active := map[string]bool{}
+	for service := range m.maintenanceWindows {
+		active[service] = m.maintenanceWindows.active(service, now)
+		v := 0.0
+		if active[service] {
+			v = 1
+		}
+		maintenanceActive.WithLabelValues(service).Set(v)
+	}
+	for i, reg := range regs {
+		if active[serviceName(reg.service)] && !paused[i] {
+			m.logger.Printf("%s: skipping discovery during a maintenance window", reg.output)
+			paused[i] = true
+		}
+	}
+	return paused
+}
+
+// errAtomicSkipped is recorded for services whose outputs were not updated
+// because discovery failed for another service with WithAtomic.
+var errAtomicSkipped = errors.New("atomic update skipped after another service failed")
+
+// result holds the targets discovered from one registered service.
+type result struct {
+	reg     *registration
+	service string
+	configs []StaticConfig
+	raw     []byte
+	origins map[string]Origin
+
+	// stats and duration describe the work done by the discovery pass.
+	stats    *passStats
+	duration time.Duration
+}
+
+// discover runs discovery for the given registered service.
+func (m *Manager) discover(ctx context.Context, reg *registration) (*result, error) {
+	// Label the discoveryDurationHist by service name. Labeling by service
+	// provides better histogram fidelity.
+	service := serviceName(reg.service)
+	startTime := m.clock().Now()
+	disCtx, cancel := context.WithTimeout(ctx, m.timeout)
+	if m.decisionLog != nil {
+		disCtx = WithDecisionLog(disCtx, m.decisionLog, service, startTime.UTC())
+	}
+	recorder := &originRecorder{origins: map[string]Origin{}}
+	disCtx = withOrigins(disCtx, recorder)
+	stats := &passStats{}
+	disCtx = withStats(disCtx, stats)
+	configs, err := m.watch(disCtx, reg, service)
+	cancel()
+	duration := m.clock().Now().Sub(startTime)
+	m.schedule(reg, service, stats, duration)
+	if err != nil {
+		m.logger.Printf("Error: %T: %s", reg.service, err)
+		m.logger.Printf("%s: failed pass %s", service, stats.summary(duration, nil, nil))
+		reason := "error-discovery"
+		if errors.Is(err, errAbandoned) || errors.Is(err, errStillRunning) {
+			reason = "error-deadline"
+		}
+		discoveryTotal.WithLabelValues(service, reason).Inc()
+		return nil, err
+	}
+	m.observeDuration(service, duration.Seconds())
+	r := &result{
+		reg:      reg,
+		service:  service,
+		configs:  configs,
+		origins:  recorder.origins,
+		stats:    stats,
+		duration: duration,
+	}
+	if reg.verbatim {
+		if s, ok := reg.service.(RawSource); ok {
+			r.raw = s.Raw()
+		}
+		return r, nil
+	}
+	r.configs = m.labelStyle.apply(service, configs)
+	hint, hinted := m.scrapeHints[service]
+	if hinted {
+		r.configs = hint.apply(r.configs)
+	}
+	owner, owned := m.owners.lookup(service, reg.output)
+	if owned {
+		r.configs = owner.apply(r.configs)
+	}
+	rules, rewritten := m.addressRewrites.lookup(service, reg.output)
+	if rewritten {
+		r.configs = rewriteAddresses(rules, r.configs, r.origins)
+	}
+	var sanitized bool
+	r.configs, sanitized, err = m.sanitize.apply(service, r.configs)
+	if err != nil {
+		m.logger.Printf("Error: %T: %s", reg.service, err)
+		discoveryTotal.WithLabelValues(service, "error-sanitize").Inc()
+		return nil, err
+	}
+	// Raw data is not written when labels were added, renamed, or sanitized,
+	// or addresses were rewritten.
+	if s, ok := reg.service.(RawSource); ok && !hinted && !owned && !rewritten && !sanitized && !m.labelStyle.rewrites() {
+		r.raw = s.Raw()
+	}
+	return r, nil
+}
+
+// commit writes the given results to their outputs. Output files are updated
+// in a single transaction, so either all files are updated or none are.
+// Results for Writers are published after the files, and are not rolled back
+// if another Writer fails.
+func (m *Manager) commit(ctx context.Context, results ...*result) error {
+	for _, r := range results {
+		reason := "error-empty"
+		err := m.checkEmpty(r)
+		if err == nil {
+			reason = "error-limit"
+			err = m.checkMaxTargets(r)
+		}
+		if err != nil {
+			m.logger.Printf("Error: %s: %s", r.reg.output, err)
+			discoveryTotal.WithLabelValues(r.service, reason).Inc()
+			for _, r := range results {
+				m.record(r.reg, err)
+			}
+			return err
+		}
+	}
+	tx := newTransaction(m.tempDir)
+	infos := make([]*fileInfo, len(results))
+	var err error
+	for j, r := range results {
+		if r.reg.writer != nil {
+			continue
+		}
+		infos[j], err = m.write(tx, r)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = tx.commit()
+	} else {
+		tx.abort()
+	}
 	if err != nil {
-		log.Printf("Failed to write %s: %s", filename, err)
+		for _, r := range results {
+			m.logger.Printf("Error: %s: %s", r.reg.output, err)
+			discoveryTotal.WithLabelValues(r.service, "error-write").Inc()
+			m.record(r.reg, err)
+		}
 		return err
 	}
-	return nil
+	var failed error
+	for j, r := range results {
+		output := r.reg.output
+		if r.reg.writer != nil {
+			err := r.reg.writer.Write(ctx, m.profileOf(r.reg).apply(r.configs))
+			if err != nil {
+				m.logger.Printf("Error: %s: %s", output, err)
+				discoveryTotal.WithLabelValues(r.service, "error-write").Inc()
+				m.record(r.reg, err)
+				failed = err
+				continue
+			}
+		} else {
+			outputSize.WithLabelValues(output).Set(float64(infos[j].size))
+		}
+		outputLastWrite.WithLabelValues(output).SetToCurrentTime()
+		if labels, ok := m.fleetLabels[r.service]; ok {
+			fleetTargets.set(r.service, output, labels, r.configs)
+		}
+		digest := m.digest(r.reg, r.configs)
+		m.mu.Lock()
+		diff := DiffTargets(r.reg.last, r.configs)
+		if !diff.Empty() || m.logUnchanged {
+			m.logger.Printf("%s: pass %s", r.service, r.stats.summary(r.duration, r.configs, &diff))
+		}
+		m.checkAnomaly(r)
+		m.recordTimeline(r.reg, r.configs, m.clock().Now())
+		r.reg.last = r.configs
+		r.reg.digest = digest
+		r.reg.origins = r.origins
+		m.mu.Unlock()
+		discoveryTotal.WithLabelValues(r.service, "success").Inc()
+		m.record(r.reg, nil)
+	}
+	return failed
+}
+
+// write stages the configs in r to the output file, along with any configured
+// checksum, metadata, or lifecycle files. When r has raw data, it is written in place of
+// the serialized configs, unless the Profile changes labels.
+func (m *Manager) write(tx *transaction, r *result) (*fileInfo, error) {
+	var info *fileInfo
+	var err error
+	output := r.reg.output
+	profile := m.profileOf(r.reg)
+	if r.raw != nil && !profile.rewrites() {
+		info, err = writeRaw(tx, r.raw, output)
+	} else {
+		info, err = writeConfigs(tx, profile.apply(r.configs), output, m.indent)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = m.checkOutputSize(output, info.size); err != nil {
+		return nil, err
+	}
+	if m.writeChecksum {
+		err = writeChecksum(tx, info.checksum, output)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if m.writeMetadata {
+		md := Metadata{Generated: m.clock().Now().UTC(), Source: r.service, Targets: len(r.configs)}
+		if !profile.rewrites() {
+			md.Schema = SchemaID
+		}
+		err = writeMetadata(tx, md, output)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if m.writeLifecycle {
+		l := Lifecycles{Generated: m.clock().Now().UTC(), Source: r.service, Targets: r.lifecycles()}
+		err = writeLifecycles(tx, l, output)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+// serviceName returns the type name of the given service. Wrappers like Cache
+// are unwrapped so that metrics are labeled by the underlying service.
+func serviceName(s Service) string {
+	for {
+		w, ok := s.(interface{ Unwrap() Service })
+		if !ok {
+			break
+		}
+		s = w.Unwrap()
+	}
+	return strings.TrimPrefix(fmt.Sprintf("%T", s), "*")
 }
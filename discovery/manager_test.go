@@ -5,8 +5,18 @@ package discovery
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/m-lab/go/prometheusx/promtest"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/m-lab/gcp-service-discovery/metrics"
 )
 
 type fakeLiteral struct{}
@@ -55,7 +65,7 @@ func TestManager_Run(t *testing.T) {
 			name:    "failure-timeout",
 			service: &fakeTimeout{},
 			output:  "foo.txt",
-			timeout: time.Second,
+			timeout: time.Millisecond,
 		},
 		{
 			name:    "failure-to-discovery",
@@ -65,17 +75,309 @@ func TestManager_Run(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-
-			m := NewManager(tt.timeout)
-			m.Register(tt.service, tt.output)
+			output := tt.output
+			if output != "" && !filepath.IsAbs(output) {
+				// Write relative outputs to a temporary directory.
+				output = filepath.Join(t.TempDir(), output)
+			}
+			m := NewManager(WithTimeout(tt.timeout))
+			m.Register(tt.service, output)
 			if m.Count() != 1 {
 				t.Errorf("Wrong manager count; got %q, want 1", m.Count())
 				return
 			}
 
-			ctx, cancel := context.WithTimeout(context.Background(), time.Second/2)
+			// Stop after the first pass.
+			ctx, cancel := context.WithCancel(context.Background())
 			defer cancel()
-			m.Run(ctx, time.Second/2)
+			m.afterPass = func(bool) { cancel() }
+			m.Run(ctx, time.Minute)
 		})
 	}
 }
+
+func TestManager_RunInterval(t *testing.T) {
+	clock := newFakeClock()
+	m := NewManager(WithTimeout(time.Minute))
+	m.clk = clock
+	svc := &fakeCounter{}
+	m.Register(svc, filepath.Join(t.TempDir(), "output.json"))
+	passes := make(chan bool)
+	m.afterPass = func(ok bool) {
+		passes <- ok
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx, time.Minute)
+
+	<-passes
+	clock.Advance(59 * time.Second)
+	select {
+	case <-passes:
+		t.Fatalf("Manager.Run() started a pass before the interval elapsed")
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(time.Second)
+	<-passes
+	if n := atomic.LoadInt32(&svc.calls); n != 2 {
+		t.Errorf("Manager.Run() ran discovery %d times, want 2", n)
+	}
+	s := m.Status()[0]
+	if !s.LastSuccess.Equal(clock.Now()) {
+		t.Errorf("Manager.Status() LastSuccess = %v, want %v", s.LastSuccess, clock.Now())
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	discoveryDurationHist.With("x", defaultDurationBuckets)
+	discoveryTotal.WithLabelValues("x", "x")
+	outputLastWrite.WithLabelValues("x")
+	outputSize.WithLabelValues("x")
+	sourceHealth.WithLabelValues("x", "x")
+	targetAnomalies.WithLabelValues("x")
+	webhookTotal.WithLabelValues("x")
+	emptyWritesBlocked.WithLabelValues("x")
+	oversizedWritesBlocked.WithLabelValues("x", "x")
+	labelConflicts.WithLabelValues("x")
+	maintenanceActive.WithLabelValues("x")
+	sanitizedLabels.WithLabelValues("x", "x")
+	abandonedPasses.WithLabelValues("x")
+	promtest.LintMetrics(t)
+}
+
+func BenchmarkManager_commit(b *testing.B) {
+	m := NewManager(WithTimeout(time.Minute))
+	m.Register(&fakeLiteral{}, filepath.Join(b.TempDir(), "output.json"))
+	r := &result{reg: m.registrations[0], service: "bench", configs: syntheticConfigs(20000)}
+	m.writeChecksum = true
+	m.writeMetadata = true
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := m.commit(context.Background(), r)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+type fakeRaw struct {
+	fakeLiteral
+}
+
+func (f *fakeRaw) Raw() []byte {
+	return []byte(`[{"targets": ["output"], "extra": true}]`)
+}
+
+func TestManager_RunRawSource(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "output.json")
+	m := NewManager(WithTimeout(time.Minute))
+	f := &fakeRaw{}
+	m.Register(f, output)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m.Run(ctx, time.Minute)
+
+	got, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if string(got) != string(f.Raw()) {
+		t.Errorf("Manager.Run() wrote %q, want %q", got, f.Raw())
+	}
+}
+
+func TestManager_RunRegisterVerbatim(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "output.json")
+	m := NewManager(WithTimeout(time.Minute), WithProfile(ProfileVictoriaMetrics),
+		WithOwners(Owners{"discovery.fakeRaw": {Team: "platform"}}),
+		WithScrapeHints(ScrapeHints{"discovery.fakeRaw": {Interval: 5 * time.Minute}}))
+	f := &fakeRaw{}
+	m.RegisterVerbatim(f, output)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m.Run(ctx, time.Minute)
+
+	got, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if string(got) != string(f.Raw()) {
+		t.Errorf("Manager.Run() wrote %q, want %q", got, f.Raw())
+	}
+	targets, _ := m.Targets(output)
+	if len(targets) != 1 || !reflect.DeepEqual(targets[0].Labels, map[string]string{"key": "value"}) {
+		t.Errorf("Manager.Targets() = %v, want the discovered targets", targets)
+	}
+}
+
+type fakeSlow struct {
+	running *int32
+	max     *int32
+}
+
+func (f *fakeSlow) Discover(ctx context.Context) ([]StaticConfig, error) {
+	n := atomic.AddInt32(f.running, 1)
+	defer atomic.AddInt32(f.running, -1)
+	for {
+		m := atomic.LoadInt32(f.max)
+		if n <= m || atomic.CompareAndSwapInt32(f.max, m, n) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	return []StaticConfig{}, nil
+}
+
+func TestManager_discoverAllParallel(t *testing.T) {
+	tests := []struct {
+		name     string
+		parallel int
+		want     int32
+	}{
+		{name: "sequential", parallel: 0, want: 1},
+		{name: "parallel", parallel: 3, want: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var running, max int32
+			m := NewManager(WithTimeout(time.Minute))
+			m.maxParallel = tt.parallel
+			dir := t.TempDir()
+			for i := 0; i < 6; i++ {
+				m.Register(&fakeSlow{running: &running, max: &max}, filepath.Join(dir, fmt.Sprintf("%d.json", i)))
+			}
+			m.discoverAll(context.Background())
+			if max != tt.want {
+				t.Errorf("Manager.discoverAll() ran %d services at once, want %d", max, tt.want)
+			}
+		})
+	}
+}
+
+func TestManager_discoverAllAtomic(t *testing.T) {
+	dir := t.TempDir()
+	m := NewManager(WithTimeout(time.Minute))
+	m.atomic = true
+	m.Register(&fakeLiteral{}, filepath.Join(dir, "a.json"))
+	m.Register(&fakeFailure{}, filepath.Join(dir, "b.json"))
+	m.discoverAll(context.Background())
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 0 {
+		t.Errorf("Manager.discoverAll() wrote %d files after a failure, want 0", len(files))
+	}
+
+	m = NewManager(WithTimeout(time.Minute))
+	m.atomic = true
+	m.Register(&fakeLiteral{}, filepath.Join(dir, "a.json"))
+	m.Register(&fakeLiteral{}, filepath.Join(dir, "b.json"))
+	m.discoverAll(context.Background())
+	files, _ = ioutil.ReadDir(dir)
+	if len(files) != 2 {
+		t.Errorf("Manager.discoverAll() wrote %d files, want 2", len(files))
+	}
+}
+
+func TestManager_Unregister(t *testing.T) {
+	m := NewManager(WithTimeout(time.Minute))
+	m.Register(&fakeLiteral{}, "a.json")
+	m.Register(&fakeLiteral{}, "b.json")
+	if !m.Unregister("a.json") {
+		t.Errorf("Manager.Unregister(a.json) = false, want true")
+	}
+	if m.Unregister("a.json") {
+		t.Errorf("Manager.Unregister(a.json) = true, want false")
+	}
+	if m.Count() != 1 || m.registrations[0].output != "b.json" {
+		t.Errorf("Manager.Unregister() left %d services, want only b.json", m.Count())
+	}
+}
+
+func TestManager_RunAfterPass(t *testing.T) {
+	tests := []struct {
+		name    string
+		service Service
+		want    bool
+	}{
+		{
+			name:    "success",
+			service: &fakeLiteral{},
+			want:    true,
+		},
+		{
+			name:    "failure-discovery",
+			service: &fakeFailure{},
+			want:    false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManager(WithTimeout(time.Minute))
+			m.Register(tt.service, filepath.Join(t.TempDir(), "output.json"))
+			passes := []bool{}
+			m.afterPass = func(ok bool) {
+				passes = append(passes, ok)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			m.Run(ctx, time.Minute)
+			if len(passes) != 1 || passes[0] != tt.want {
+				t.Errorf("Manager.Run() AfterPass calls = %v, want [%v]", passes, tt.want)
+			}
+		})
+	}
+}
+
+func TestManager_Reload(t *testing.T) {
+	m := NewManager(WithTimeout(time.Minute))
+	svc := &fakeCounter{}
+	c := NewCache(svc, time.Hour)
+	m.Register(c, filepath.Join(t.TempDir(), "output.json"))
+	passes := make(chan bool, 10)
+	m.afterPass = func(ok bool) {
+		passes <- ok
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx, time.Hour)
+
+	<-passes
+	m.Reload()
+	select {
+	case <-passes:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Manager.Reload() did not start a new pass")
+	}
+	if n := atomic.LoadInt32(&svc.calls); n != 2 {
+		t.Errorf("Manager.Reload() ran discovery %d times, want 2", n)
+	}
+}
+
+func TestManager_WithRegisterer(t *testing.T) {
+	defer metrics.SetRegisterer(nil)
+	reg := prometheus.NewRegistry()
+	m := NewManager(WithTimeout(time.Minute), WithRegisterer(reg))
+	m.Register(&fakeLiteral{}, filepath.Join(t.TempDir(), "output.json"))
+	if !m.discoverAll(context.Background()) {
+		t.Fatalf("Manager.discoverAll() = false, want true")
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Registry.Gather() error = %v", err)
+	}
+	found := false
+	for _, f := range families {
+		found = found || strings.HasPrefix(f.GetName(), "gcp_manager_")
+	}
+	if !found {
+		t.Errorf("Manager metrics are not registered with the registerer")
+	}
+
+	// A second registerer would take the metrics of the first Manager.
+	defer func() {
+		if recover() == nil {
+			t.Errorf("NewManager() did not panic for a second registerer")
+		}
+	}()
+	NewManager(WithRegisterer(prometheus.NewRegistry()))
+}
@@ -0,0 +1,183 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/m-lab/gcp-service-discovery/metrics"
+)
+
+var (
+	// labelConflicts counts label names emitted by more than one service merged
+	// into the same output. The metric is labeled by the label name.
+	//
+	// Provides metrics:
+	//   gcp_manager_label_conflicts_total{label="service"}
+	// Usage example:
+	//   labelConflicts.WithLabelValues("service").Inc()
+	labelConflicts = metrics.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gcp_manager_label_conflicts_total",
+			Help: "Number of label names emitted by more than one merged service.",
+		},
+		[]string{"label"},
+	)
+)
+
+// ConflictPolicy determines how Merge handles label names emitted by more than
+// one of its services. ConflictPolicy implements the flag.Value interface.
+type ConflictPolicy string
+
+// Supported conflict policies.
+const (
+	// ConflictError fails discovery when services emit the same label name.
+	ConflictError ConflictPolicy = "error"
+
+	// ConflictRename prefixes conflicting label names with the name of each
+	// service, e.g. "service" from "aeflex" becomes "aeflex_service", and
+	// "__project" becomes "__aeflex_project".
+	ConflictRename ConflictPolicy = "rename"
+)
+
+// String returns the policy name.
+func (p ConflictPolicy) String() string {
+	return string(p)
+}
+
+// Set parses a policy name.
+func (p *ConflictPolicy) Set(value string) error {
+	switch v := ConflictPolicy(value); v {
+	case ConflictError, ConflictRename:
+		*p = v
+		return nil
+	}
+	return fmt.Errorf("unknown label conflict policy %q: want %q or %q", value, ConflictError, ConflictRename)
+}
+
+// sharedLabels have the same meaning for every service, so they never
+// conflict.
+var sharedLabels = map[string]bool{
+	LabelReady:         true,
+	"__address__":      true,
+	"__scheme__":       true,
+	"__metrics_path__": true,
+}
+
+// MergedSource is a named service merged into one output by Merge.
+type MergedSource struct {
+	// Name identifies the service in errors and renamed labels.
+	Name string
+
+	// Service discovers the targets of the source.
+	Service Service
+}
+
+// Merge discovers targets from several services and returns all of them, so
+// the services may share one output. Merge implements the Service interface.
+type Merge struct {
+	policy  ConflictPolicy
+	sources []MergedSource
+}
+
+// NewMerge creates a Merge of the given sources, which handles label conflicts
+// using policy.
+func NewMerge(policy ConflictPolicy, sources ...MergedSource) *Merge {
+	return &Merge{policy: policy, sources: sources}
+}
+
+// Discover runs discovery for every source, in order, and returns the
+// combined configs. If discovery fails for any source, Discover fails, so the
+// output never silently loses the targets of one source.
+func (m *Merge) Discover(ctx context.Context) ([]StaticConfig, error) {
+	results := make([][]StaticConfig, len(m.sources))
+	for i, s := range m.sources {
+		configs, err := s.Service.Discover(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", s.Name, err)
+		}
+		results[i] = configs
+	}
+	conflicts := m.conflicts(results)
+	if len(conflicts) > 0 && m.policy != ConflictRename {
+		desc := []string{}
+		for _, k := range sortedLabels(conflicts) {
+			desc = append(desc, k+" ("+strings.Join(conflicts[k], ", ")+")")
+		}
+		return nil, fmt.Errorf("label conflict: %s", strings.Join(desc, "; "))
+	}
+	var all []StaticConfig
+	for i, configs := range results {
+		for _, c := range configs {
+			if len(conflicts) > 0 {
+				c = renameLabels(c, m.sources[i].Name, conflicts)
+			}
+			all = append(all, c)
+		}
+	}
+	return all, nil
+}
+
+// Invalidate invalidates every merged service that caches results, so the
+// next Discover contacts every source.
+func (m *Merge) Invalidate() {
+	for _, s := range m.sources {
+		invalidate(s.Service)
+	}
+}
+
+// conflicts returns the names of the sources emitting each label name emitted
+// by more than one source, and counts them in the labelConflicts metric.
+func (m *Merge) conflicts(results [][]StaticConfig) map[string][]string {
+	emitters := map[string][]string{}
+	for i, configs := range results {
+		seen := map[string]bool{}
+		for _, c := range configs {
+			for k := range c.Labels {
+				if !sharedLabels[k] && !seen[k] {
+					seen[k] = true
+					emitters[k] = append(emitters[k], m.sources[i].Name)
+				}
+			}
+		}
+	}
+	conflicts := map[string][]string{}
+	for k, names := range emitters {
+		if len(names) > 1 {
+			labelConflicts.WithLabelValues(k).Inc()
+			conflicts[k] = names
+		}
+	}
+	return conflicts
+}
+
+// sortedLabels returns the label names of conflicts in order.
+func sortedLabels(conflicts map[string][]string) []string {
+	keys := make([]string, 0, len(conflicts))
+	for k := range conflicts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// renameLabels returns a copy of c with the label names in conflicts prefixed
+// by name.
+func renameLabels(c StaticConfig, name string, conflicts map[string][]string) StaticConfig {
+	labels := make(map[string]string, len(c.Labels))
+	for k, v := range c.Labels {
+		switch {
+		case conflicts[k] == nil:
+			labels[k] = v
+		case strings.HasPrefix(k, "__"):
+			labels["__"+name+"_"+strings.TrimPrefix(k, "__")] = v
+		default:
+			labels[name+"_"+k] = v
+		}
+	}
+	c.Labels = labels
+	return c
+}
@@ -0,0 +1,103 @@
+package discovery
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type fakeLabels struct {
+	labels map[string]string
+}
+
+func (f *fakeLabels) Discover(ctx context.Context) ([]StaticConfig, error) {
+	return []StaticConfig{{Targets: []string{"a:1"}, Labels: f.labels}}, nil
+}
+
+func TestMerge_Discover(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  ConflictPolicy
+		sources []MergedSource
+		want    []StaticConfig
+		wantErr bool
+	}{
+		{
+			name:   "no-conflict",
+			policy: ConflictError,
+			sources: []MergedSource{
+				{Name: "a", Service: &fakeLabels{labels: map[string]string{"x": "1", LabelReady: "true"}}},
+				{Name: "b", Service: &fakeLabels{labels: map[string]string{"y": "2", LabelReady: "false"}}},
+			},
+			want: []StaticConfig{
+				{Targets: []string{"a:1"}, Labels: map[string]string{"x": "1", LabelReady: "true"}},
+				{Targets: []string{"a:1"}, Labels: map[string]string{"y": "2", LabelReady: "false"}},
+			},
+		},
+		{
+			name:   "conflict-error",
+			policy: ConflictError,
+			sources: []MergedSource{
+				{Name: "a", Service: &fakeLabels{labels: map[string]string{"service": "1"}}},
+				{Name: "b", Service: &fakeLabels{labels: map[string]string{"service": "2"}}},
+			},
+			wantErr: true,
+		},
+		{
+			name:   "conflict-rename",
+			policy: ConflictRename,
+			sources: []MergedSource{
+				{Name: "a", Service: &fakeLabels{labels: map[string]string{"service": "1", "__project": "p", "x": "1"}}},
+				{Name: "b", Service: &fakeLabels{labels: map[string]string{"service": "2", "__project": "q"}}},
+			},
+			want: []StaticConfig{
+				{Targets: []string{"a:1"}, Labels: map[string]string{"a_service": "1", "__a_project": "p", "x": "1"}},
+				{Targets: []string{"a:1"}, Labels: map[string]string{"b_service": "2", "__b_project": "q"}},
+			},
+		},
+		{
+			name:   "source-failure",
+			policy: ConflictRename,
+			sources: []MergedSource{
+				{Name: "a", Service: &fakeLiteral{}},
+				{Name: "b", Service: &fakeFailure{}},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMerge(tt.policy, tt.sources...)
+			got, err := m.Discover(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Merge.Discover() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Merge.Discover() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMerge_Invalidate(t *testing.T) {
+	f := &fakeCounter{}
+	m := NewMerge(ConflictError, MergedSource{Name: "a", Service: NewCache(f, time.Hour)})
+	m.Discover(context.Background())
+	m.Invalidate()
+	m.Discover(context.Background())
+	if f.calls != 2 {
+		t.Errorf("Merge.Invalidate() calls = %d, want 2", f.calls)
+	}
+}
+
+func TestConflictPolicy_Set(t *testing.T) {
+	var p ConflictPolicy
+	if err := p.Set("rename"); err != nil || p != ConflictRename {
+		t.Errorf("ConflictPolicy.Set(rename) = %v, %q", err, p)
+	}
+	if err := p.Set("ignore"); err == nil {
+		t.Errorf("ConflictPolicy.Set(ignore) error = nil, want error")
+	}
+}
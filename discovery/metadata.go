@@ -0,0 +1,67 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// MetadataSuffix is appended to an output filename to name the metadata file
+// written alongside it.
+const MetadataSuffix = ".meta.json"
+
+// Metadata describes when and how a target output file was generated. Consumers
+// may read the metadata file to detect and refuse stale target files.
+type Metadata struct {
+	// Generated is the time the target file was written.
+	Generated time.Time `json:"generated"`
+
+	// Source is the name of the service that discovered the targets.
+	Source string `json:"source"`
+
+	// Targets is the number of StaticConfigs written to the target file.
+	Targets int `json:"targets"`
+
+	// Schema is the SchemaID of the target file. It is empty when the output
+	// profile changes labels, since the schema does not apply.
+	Schema string `json:"schema,omitempty"`
+}
+
+// ReadMetadata reads the metadata file written alongside the named output file.
+func ReadMetadata(filename string) (*Metadata, error) {
+	data, err := ioutil.ReadFile(filename + MetadataSuffix)
+	if err != nil {
+		return nil, err
+	}
+	md := &Metadata{}
+	err = json.Unmarshal(data, md)
+	if err != nil {
+		return nil, err
+	}
+	return md, nil
+}
+
+// CheckFreshness returns an error if the metadata for the named output file
+// cannot be read or if the output file was generated longer than maxAge ago.
+func CheckFreshness(filename string, maxAge time.Duration) error {
+	md, err := ReadMetadata(filename)
+	if err != nil {
+		return err
+	}
+	age := time.Since(md.Generated)
+	if age > maxAge {
+		return fmt.Errorf("%s is stale: generated %s ago by %s", filename, age.Round(time.Second), md.Source)
+	}
+	return nil
+}
+
+// writeMetadata serializes the given metadata and stages it to be written
+// alongside the named output file when tx is committed.
+func writeMetadata(tx *transaction, md Metadata, filename string) error {
+	data, err := json.MarshalIndent(md, "", "    ")
+	if err != nil {
+		return err
+	}
+	return tx.writeFile(filename+MetadataSuffix, data)
+}
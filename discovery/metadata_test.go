@@ -0,0 +1,83 @@
+package discovery
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestManager_RunWriteSidecars(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "foo.json")
+	m := NewManager(WithTimeout(time.Minute))
+	m.writeMetadata = true
+	m.writeChecksum = true
+	m.Register(&fakeLiteral{}, output)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m.Run(ctx, time.Minute)
+
+	md, err := ReadMetadata(output)
+	if err != nil {
+		t.Fatalf("ReadMetadata() error = %v", err)
+	}
+	if md.Source != "discovery.fakeLiteral" || md.Targets != 1 {
+		t.Errorf("ReadMetadata() = %#v, want source discovery.fakeLiteral and 1 target", md)
+	}
+	err = VerifyChecksum(output)
+	if err != nil {
+		t.Errorf("VerifyChecksum() error = %v", err)
+	}
+}
+
+func TestCheckFreshness(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name      string
+		filename  string
+		generated time.Time
+		maxAge    time.Duration
+		noFile    bool
+		wantErr   bool
+	}{
+		{
+			name:      "success",
+			filename:  filepath.Join(dir, "fresh.json"),
+			generated: time.Now(),
+			maxAge:    time.Minute,
+		},
+		{
+			name:      "failure-stale",
+			filename:  filepath.Join(dir, "stale.json"),
+			generated: time.Now().Add(-time.Hour),
+			maxAge:    time.Minute,
+			wantErr:   true,
+		},
+		{
+			name:     "failure-missing-metadata",
+			filename: filepath.Join(dir, "missing.json"),
+			noFile:   true,
+			maxAge:   time.Minute,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !tt.noFile {
+				tx := newTransaction("")
+				err := writeMetadata(tx, Metadata{Generated: tt.generated, Source: "fake"}, tt.filename)
+				if err == nil {
+					err = tx.commit()
+				}
+				if err != nil {
+					t.Fatalf("writeMetadata() error = %v", err)
+				}
+			}
+			err := CheckFreshness(tt.filename, tt.maxAge)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CheckFreshness() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package discovery
+
+import (
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Option configures a Manager created by NewManager.
+type Option func(m *Manager)
+
+// WithTimeout sets the maximum time of the discovery of each service. The
+// default is DefaultTimeout.
+func WithTimeout(timeout time.Duration) Option {
+	return func(m *Manager) { m.timeout = timeout }
+}
+
+// WithHardDeadline sets the maximum time to wait for the discovery of each
+// service to return, even if the service ignores the cancellation of its
+// context after the timeout. Overdue passes are abandoned and fail. The default
+// is the timeout plus DefaultDeadlineGrace.
+func WithHardDeadline(deadline time.Duration) Option {
+	return func(m *Manager) { m.hardDeadline = deadline }
+}
+
+// WithLogger sets the logger that reports the results of discovery passes and
+// errors. The default is the standard logger.
+func WithLogger(logger *log.Logger) Option {
+	return func(m *Manager) { m.logger = logger }
+}
+
+// WithLogUnchanged logs the summary of every successful pass. By default,
+// passes that add and remove no targets are not logged, so the log shows only
+// changes and failures.
+func WithLogUnchanged(enabled bool) Option {
+	return func(m *Manager) { m.logUnchanged = enabled }
+}
+
+// WithClock sets the Clock that provides the time and schedules the passes of
+// Run. The default is RealClock.
+func WithClock(clock Clock) Option {
+	return func(m *Manager) { m.clk = clock }
+}
+
+// WithMaxParallel sets the maximum number of services that run discovery at
+// the same time. Values less than one, the default, run services sequentially.
+func WithMaxParallel(n int) Option {
+	return func(m *Manager) { m.maxParallel = n }
+}
+
+// WithAfterPass sets a function called by Run after every discovery pass. ok
+// is true if the outputs of all services were updated.
+func WithAfterPass(f func(ok bool)) Option {
+	return func(m *Manager) { m.afterPass = f }
+}
+
+// WithMetadata writes a Metadata file alongside every output file, so
+// consumers can detect stale targets.
+func WithMetadata(enabled bool) Option {
+	return func(m *Manager) { m.writeMetadata = enabled }
+}
+
+// WithLifecycle writes a Lifecycles file alongside every output file, so
+// alert inhibition rules can silence targets with expected downtime.
+func WithLifecycle(enabled bool) Option {
+	return func(m *Manager) { m.writeLifecycle = enabled }
+}
+
+// WithChecksum writes a SHA256 checksum file alongside every output file, so
+// file integrity may be verified later.
+func WithChecksum(enabled bool) Option {
+	return func(m *Manager) { m.writeChecksum = enabled }
+}
+
+// WithIndent sets the indent of serialized output files. When empty, output
+// files are written as compact JSON. The default is four spaces.
+func WithIndent(indent string) Option {
+	return func(m *Manager) { m.indent = indent }
+}
+
+// WithTempDir sets the directory where output files are written before they
+// are renamed to replace the previous output. The directory must be on the
+// same filesystem as every output. By default, temporary files are written to
+// the directory of each output.
+func WithTempDir(dir string) Option {
+	return func(m *Manager) { m.tempDir = dir }
+}
+
+// WithAtomic updates the outputs of all services together at the end of every
+// discovery pass. If discovery fails for any service, or any output cannot be
+// written, no outputs are updated.
+func WithAtomic(enabled bool) Option {
+	return func(m *Manager) { m.atomic = enabled }
+}
+
+// WithProfile selects the label conventions of output files. The default is
+// ProfilePrometheus.
+func WithProfile(p Profile) Option {
+	return func(m *Manager) { m.profile = p }
+}
+
+// WithLabelStyle names the source labels of every target using the given
+// style. The default is LabelStyleLegacy.
+func WithLabelStyle(s LabelStyle) Option {
+	return func(m *Manager) { m.labelStyle = s }
+}
+
+// WithSanitize handles discovered labels with invalid names or values using
+// the given policy before they are written. By default, labels are written
+// unchanged.
+func WithSanitize(p SanitizePolicy) Option {
+	return func(m *Manager) { m.sanitize = p }
+}
+
+// WithTimeline remembers the last size changes of the targets of every output
+// for Changes. When dir is not empty, the changes of every output are also
+// saved to a file in dir, and loaded again after a restart.
+func WithTimeline(size int, dir string) Option {
+	return func(m *Manager) {
+		m.timelineSize = size
+		m.timelineDir = dir
+	}
+}
+
+// WithDecisions records why every candidate object was included in or
+// excluded from discovery results to the given log.
+func WithDecisions(l *DecisionLog) Option {
+	return func(m *Manager) { m.decisionLog = l }
+}
+
+// WithDurationBuckets overrides the discovery duration histogram buckets for
+// the named services. The default buckets suit slow GKE sweeps.
+func WithDurationBuckets(b DurationBuckets) Option {
+	return func(m *Manager) { m.durationBuckets = b }
+}
+
+// WithFleetLabels selects the label names whose values summarize the written
+// targets of the named services in the gcp_manager_fleet_targets metric, e.g.
+// the targets of every App Engine service.
+func WithFleetLabels(f FleetLabels) Option {
+	return func(m *Manager) { m.fleetLabels = f }
+}
+
+// WithScrapeHints adds scrape interval and timeout hint labels to the targets
+// of the named services, e.g. to scrape slow exporters less often.
+func WithScrapeHints(h ScrapeHints) Option {
+	return func(m *Manager) { m.scrapeHints = h }
+}
+
+// WithOwners adds ownership labels to the targets of the named sources, and
+// reports the owners in their Status.
+func WithOwners(o Owners) Option {
+	return func(m *Manager) { m.owners = o }
+}
+
+// WithAddressRewrites rewrites the addresses of the targets of the named
+// sources before they are written, e.g. to reach them through NAT.
+func WithAddressRewrites(a AddressRewrites) Option {
+	return func(m *Manager) { m.addressRewrites = a }
+}
+
+// WithMaintenanceWindows pauses discovery of the named services during planned
+// maintenance, e.g. GKE master upgrades. Outputs keep the targets of the last
+// pass before the window, and failures are not recorded.
+func WithMaintenanceWindows(w MaintenanceWindows) Option {
+	return func(m *Manager) { m.maintenanceWindows = w }
+}
+
+// WithPaused starts the Manager with discovery of the named sources paused, as
+// if by Pause. Use AllServices to pause every service. Services are registered
+// after the Manager is created, so names are not checked; call Pause after
+// registration to reject unknown names.
+func WithPaused(names ...string) Option {
+	return func(m *Manager) {
+		for _, name := range names {
+			m.pause(name)
+		}
+	}
+}
+
+// WithCostLimits stretches the interval between the discovery passes of
+// services whose last pass exceeded the given limits. By default, every service
+// runs discovery on every pass of Run.
+func WithCostLimits(c CostLimits) Option {
+	return func(m *Manager) { m.costLimits = c }
+}
+
+// WithAnomalyThreshold sets the percent change from the baseline target count
+// of recent passes above which a pass is reported as an Anomaly. Outputs are
+// still updated. Zero, the default, disables anomaly detection.
+func WithAnomalyThreshold(percent float64) Option {
+	return func(m *Manager) { m.anomalyThreshold = percent }
+}
+
+// WithAnomalyWebhook sets a URL that receives a JSON encoded Anomaly in a POST
+// request for every anomaly detected.
+func WithAnomalyWebhook(url string) Option {
+	return func(m *Manager) { m.anomalyWebhook = url }
+}
+
+// WithAllowEmpty allows discovery results with no targets to replace outputs
+// that have targets. By default such results are not written, since an empty
+// output usually means discovery failed silently.
+func WithAllowEmpty(enabled bool) Option {
+	return func(m *Manager) { m.allowEmpty = enabled }
+}
+
+// WithAllowEmptyOutputs lists outputs that may be replaced by results with no
+// targets, even without WithAllowEmpty.
+func WithAllowEmptyOutputs(outputs []string) Option {
+	return func(m *Manager) { m.allowEmptyOutputs = outputs }
+}
+
+// WithMaxTargets limits the number of targets of every service. Results with
+// more targets are not written, and the previous outputs are kept. Zero, the
+// default, is unlimited.
+func WithMaxTargets(n int) Option {
+	return func(m *Manager) { m.maxTargets = n }
+}
+
+// WithMaxOutputSize limits the size in bytes of every output file. Results
+// that serialize to larger files are not written, and the previous files are
+// kept. Zero, the default, is unlimited.
+func WithMaxOutputSize(bytes int64) Option {
+	return func(m *Manager) { m.maxOutputSize = bytes }
+}
+
+// WithOutputOrder writes outputs after the outputs listed before them by o in
+// every discovery pass. Services whose outputs do not depend on each other
+// still run in parallel, up to WithMaxParallel. By default, all services start
+// together.
+func WithOutputOrder(o OutputOrder) Option {
+	return func(m *Manager) { m.outputOrder = o }
+}
+
+// WithBestEffort lists outputs whose sources are best-effort. A failure to
+// update them is logged and recorded, but does not fail the pass reported to
+// WithAfterPass, and with WithAtomic a failed discovery of them does not
+// prevent the update of other outputs. By default, every output is critical.
+func WithBestEffort(outputs []string) Option {
+	return func(m *Manager) { m.bestEffortOutputs = outputs }
+}
+
+// WithRegisterer registers the metrics of the Manager and of every source with
+// reg instead of the default registerer, e.g. a prometheus.Registry that
+// isolates them, or a registerer from prometheus.WrapRegistererWith that adds
+// constant labels. Metrics are shared by the whole process, so every Manager of
+// a process must use the same registerer, and NewManager panics if metrics
+// cannot be registered with reg. See metrics.SetRegisterer.
+func WithRegisterer(reg prometheus.Registerer) Option {
+	return func(m *Manager) { m.registerer = reg }
+}
@@ -0,0 +1,113 @@
+package discovery
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"log"
+)
+
+// defaultIndent is the default indentation used for output files.
+const defaultIndent = "    "
+
+// fileInfo describes a written output file.
+type fileInfo struct {
+	// size is the number of bytes written.
+	size int64
+	// checksum is the hex encoded SHA256 digest of the written bytes.
+	checksum string
+}
+
+// countingHash counts and hashes all bytes written to it.
+type countingHash struct {
+	hash.Hash
+	size int64
+}
+
+func (c *countingHash) Write(p []byte) (int, error) {
+	c.size += int64(len(p))
+	return c.Hash.Write(p)
+}
+
+// writeConfigs serializes the given configs as JSON and stages them to replace
+// the output filename when tx is committed. Configs are encoded one at a time,
+// so the complete serialized document is never held in memory. An empty indent
+// produces compact output.
+func writeConfigs(tx *transaction, configs []StaticConfig, filename, indent string) (*fileInfo, error) {
+	f, err := tx.create(filename)
+	if err != nil {
+		log.Printf("Failed to write %s: %s", filename, err)
+		return nil, err
+	}
+
+	h := &countingHash{Hash: sha256.New()}
+	w := bufio.NewWriter(io.MultiWriter(f, h))
+	err = encodeConfigs(w, configs, indent)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		log.Printf("Failed to write %s: %s", filename, err)
+		return nil, err
+	}
+	return &fileInfo{size: h.size, checksum: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// writeRaw stages the given pre-serialized document to replace the output
+// filename when tx is committed.
+func writeRaw(tx *transaction, data []byte, filename string) (*fileInfo, error) {
+	err := tx.writeFile(filename, data)
+	if err != nil {
+		log.Printf("Failed to write %s: %s", filename, err)
+		return nil, err
+	}
+	return &fileInfo{size: int64(len(data)), checksum: checksum(data)}, nil
+}
+
+// encodeConfigs writes configs to w as a JSON array. The output is identical to
+// json.MarshalIndent(configs, "", indent), or json.Marshal(configs) when
+// indent is empty.
+func encodeConfigs(w io.Writer, configs []StaticConfig, indent string) error {
+	if configs == nil {
+		_, err := io.WriteString(w, "null")
+		return err
+	}
+	if len(configs) == 0 {
+		_, err := io.WriteString(w, "[]")
+		return err
+	}
+	start, sep, end := "[", ",", "]"
+	if indent != "" {
+		start, sep, end = "[\n"+indent, ",\n"+indent, "\n]"
+	}
+	_, err := io.WriteString(w, start)
+	if err != nil {
+		return err
+	}
+	for i := range configs {
+		if i > 0 {
+			_, err = io.WriteString(w, sep)
+			if err != nil {
+				return err
+			}
+		}
+		var data []byte
+		if indent != "" {
+			data, err = json.MarshalIndent(&configs[i], indent, indent)
+		} else {
+			data, err = json.Marshal(&configs[i])
+		}
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(w, end)
+	return err
+}
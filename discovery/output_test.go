@@ -0,0 +1,158 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEncodeConfigs(t *testing.T) {
+	tests := []struct {
+		name    string
+		configs []StaticConfig
+	}{
+		{
+			name: "nil",
+		},
+		{
+			name:    "empty",
+			configs: []StaticConfig{},
+		},
+		{
+			name: "several",
+			configs: []StaticConfig{
+				{Targets: []string{"a:1", "b:2"}, Labels: map[string]string{"x": "y", "a": "b"}},
+				{Targets: []string{"c:3"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, indent := range []string{"", "  ", defaultIndent} {
+				var want []byte
+				if indent == "" {
+					want, _ = json.Marshal(tt.configs)
+				} else {
+					want, _ = json.MarshalIndent(tt.configs, "", indent)
+				}
+				buf := &bytes.Buffer{}
+				err := encodeConfigs(buf, tt.configs, indent)
+				if err != nil {
+					t.Fatalf("encodeConfigs() error = %v", err)
+				}
+				if buf.String() != string(want) {
+					t.Errorf("encodeConfigs(%q) = %q, want %q", indent, buf.String(), want)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteConfigs(t *testing.T) {
+	configs := []StaticConfig{{Targets: []string{"a:1"}}}
+	filename := filepath.Join(t.TempDir(), "output.json")
+	tx := newTransaction("")
+	info, err := writeConfigs(tx, configs, filename, defaultIndent)
+	if err != nil {
+		t.Fatalf("writeConfigs() error = %v", err)
+	}
+	err = tx.commit()
+	if err != nil {
+		t.Fatalf("transaction.commit() error = %v", err)
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if info.size != int64(len(data)) || info.checksum != checksum(data) {
+		t.Errorf("writeConfigs() = %#v, want size %d and checksum %s", info, len(data), checksum(data))
+	}
+}
+
+// syntheticConfigs returns n StaticConfigs with labels similar to aeflex targets.
+func syntheticConfigs(n int) []StaticConfig {
+	configs := make([]StaticConfig, n)
+	for i := range configs {
+		configs[i] = StaticConfig{
+			Targets: []string{fmt.Sprintf("10.%d.%d.%d:9090", i>>16&0xff, i>>8&0xff, i&0xff)},
+			Labels: map[string]string{
+				"__aef_project":  "mlab-sandbox",
+				"__aef_service":  fmt.Sprintf("service-%d", i%100),
+				"__aef_version":  "20181027t210126",
+				"__aef_instance": fmt.Sprintf("aef-service-20181027t210126-%06d", i),
+			},
+		}
+	}
+	return configs
+}
+
+func BenchmarkWriteConfigs(b *testing.B) {
+	configs := syntheticConfigs(20000)
+	filename := filepath.Join(b.TempDir(), "output.json")
+	for _, bm := range []struct {
+		name   string
+		indent string
+	}{
+		{name: "indent", indent: defaultIndent},
+		{name: "compact", indent: ""},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				tx := newTransaction("")
+				_, err := writeConfigs(tx, configs, filename, bm.indent)
+				if err == nil {
+					err = tx.commit()
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkMarshalIndent measures the previous approach, which serialized the
+// complete document in memory before writing, for comparison.
+func BenchmarkMarshalIndent(b *testing.B) {
+	configs := syntheticConfigs(20000)
+	filename := filepath.Join(b.TempDir(), "output.json")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		data, err := json.MarshalIndent(configs, "", defaultIndent)
+		if err != nil {
+			b.Fatal(err)
+		}
+		err = ioutil.WriteFile(filename, data, 0644)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestManager_writeIndent(t *testing.T) {
+	configs := []StaticConfig{{Targets: []string{"a:1"}}}
+	output := filepath.Join(t.TempDir(), "output.json")
+	for _, indent := range []string{"", "  ", defaultIndent} {
+		m := NewManager(WithTimeout(time.Minute))
+		m.Register(&fakeLiteral{}, output)
+		m.indent = indent
+		err := m.commit(context.Background(), &result{reg: m.registrations[0], service: "fake", configs: configs})
+		if err != nil {
+			t.Fatalf("Manager.commit() error = %v", err)
+		}
+		got, _ := ioutil.ReadFile(output)
+		want, _ := json.MarshalIndent(configs, "", indent)
+		if indent == "" {
+			want, _ = json.Marshal(configs)
+		}
+		if string(got) != string(want) {
+			t.Errorf("Manager.write() with indent %q = %q, want %q", indent, got, want)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package discovery
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Ownership label names. Unlike source labels, these labels are kept by
+// Prometheus after relabeling, so alerts on discovered targets name the team
+// responsible for their source.
+const (
+	LabelOwner   = "owner"
+	LabelTeam    = "team"
+	LabelContact = "contact"
+)
+
+// Owner describes who is responsible for a source. Empty fields are not
+// stamped.
+type Owner struct {
+	Owner   string `json:"owner,omitempty"`
+	Team    string `json:"team,omitempty"`
+	Contact string `json:"contact,omitempty"`
+}
+
+// labels returns the ownership labels of o.
+func (o Owner) labels() map[string]string {
+	labels := map[string]string{}
+	for k, v := range map[string]string{LabelOwner: o.Owner, LabelTeam: o.Team, LabelContact: o.Contact} {
+		if v != "" {
+			labels[k] = v
+		}
+	}
+	return labels
+}
+
+// String formats o as a comma separated list of key=value options.
+func (o Owner) String() string {
+	opts := []string{}
+	labels := o.labels()
+	for _, k := range []string{LabelOwner, LabelTeam, LabelContact} {
+		if v, ok := labels[k]; ok {
+			opts = append(opts, k+"="+v)
+		}
+	}
+	return strings.Join(opts, ",")
+}
+
+// apply returns copies of configs with the ownership labels added. Labels
+// already set by the service are kept. The given configs are not modified.
+func (o Owner) apply(configs []StaticConfig) []StaticConfig {
+	return stampLabels(configs, o.labels())
+}
+
+// Owners maps service names, e.g. "gke.Service", or output filenames, e.g.
+// "/targets/web.json", to the Owner of the source. An output filename selects
+// one of several sources of the same type, like HTTP(S) sources. Owners
+// implements the flag.Value interface, so it may be set from the command line
+// with values like:
+//
+//	gke.Service=team=platform,contact=platform-oncall@example.com
+type Owners map[string]Owner
+
+// String formats the owners as a space separated list of flag values.
+func (o Owners) String() string {
+	names := []string{}
+	for name := range o {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	values := []string{}
+	for _, name := range names {
+		values = append(values, name+"="+o[name].String())
+	}
+	return strings.Join(values, " ")
+}
+
+// Set parses a value of the form "source=owner=<name>,team=<name>,contact=<address>"
+// and saves the Owner of the named source. Any option may be omitted, but not
+// all of them.
+func (o *Owners) Set(value string) error {
+	fields := strings.SplitN(value, "=", 2)
+	if len(fields) != 2 || fields[0] == "" || fields[1] == "" {
+		return fmt.Errorf("invalid source owner %q: want source=owner=<name>,team=<name>,contact=<address>", value)
+	}
+	owner := Owner{}
+	for _, opt := range strings.Split(fields[1], ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(opt), "=")
+		if !ok || v == "" {
+			return fmt.Errorf("invalid source owner option %q: want key=value", opt)
+		}
+		switch k {
+		case LabelOwner:
+			owner.Owner = v
+		case LabelTeam:
+			owner.Team = v
+		case LabelContact:
+			owner.Contact = v
+		default:
+			return fmt.Errorf("unknown source owner option %q: want owner, team, or contact", k)
+		}
+	}
+	if *o == nil {
+		*o = Owners{}
+	}
+	(*o)[fields[0]] = owner
+	return nil
+}
+
+// lookup returns the Owner of the source with the given service name and
+// output. An Owner of the output takes precedence over one of the service.
+func (o Owners) lookup(service, output string) (Owner, bool) {
+	if owner, ok := o[output]; ok {
+		return owner, true
+	}
+	owner, ok := o[service]
+	return owner, ok
+}
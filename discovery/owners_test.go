@@ -0,0 +1,134 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOwners_Set(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  []string
+		want    Owners
+		wantStr string
+		wantErr bool
+	}{
+		{
+			name:   "success",
+			values: []string{"gke.Service=team=platform, contact=oncall@example.com", "/targets/web.json=owner=alice"},
+			want: Owners{
+				"gke.Service":       {Team: "platform", Contact: "oncall@example.com"},
+				"/targets/web.json": {Owner: "alice"},
+			},
+			wantStr: "/targets/web.json=owner=alice gke.Service=team=platform,contact=oncall@example.com",
+		},
+		{
+			name:    "error-missing-owner",
+			values:  []string{"gke.Service"},
+			wantErr: true,
+		},
+		{
+			name:    "error-unknown-option",
+			values:  []string{"gke.Service=pager=123"},
+			wantErr: true,
+		},
+		{
+			name:    "error-empty-value",
+			values:  []string{"gke.Service=team="},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var o Owners
+			var err error
+			for _, v := range tt.values {
+				err = o.Set(v)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Owners.Set() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(o, tt.want) {
+				t.Errorf("Owners.Set() = %v, want %v", o, tt.want)
+			}
+			if got := o.String(); got != tt.wantStr {
+				t.Errorf("Owners.String() = %q, want %q", got, tt.wantStr)
+			}
+		})
+	}
+}
+
+func TestOwners_lookup(t *testing.T) {
+	o := Owners{
+		"web.Service":       {Team: "web"},
+		"/targets/api.json": {Team: "api"},
+	}
+	tests := []struct {
+		name    string
+		service string
+		output  string
+		want    Owner
+		wantOK  bool
+	}{
+		{
+			name:    "service",
+			service: "web.Service",
+			output:  "/targets/web.json",
+			want:    Owner{Team: "web"},
+			wantOK:  true,
+		},
+		{
+			name:    "output",
+			service: "web.Service",
+			output:  "/targets/api.json",
+			want:    Owner{Team: "api"},
+			wantOK:  true,
+		},
+		{
+			name:    "unknown",
+			service: "gke.Service",
+			output:  "/targets/gke.json",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := o.lookup(tt.service, tt.output)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("Owners.lookup() = %v, %t, want %v, %t", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestManager_Owners(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "output.json")
+	m := NewManager(WithTimeout(time.Minute), WithOwners(Owners{"discovery.fakeRaw": {Team: "platform"}}))
+	m.Register(&fakeRaw{}, output)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m.Run(ctx, time.Minute)
+
+	data, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	got := []StaticConfig{}
+	if err = json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if len(got) != 1 || got[0].Labels[LabelTeam] != "platform" {
+		t.Errorf("Manager.Run() wrote %s, want a %s label", data, LabelTeam)
+	}
+	status := m.Status()
+	if len(status) != 1 || status[0].Owner == nil || *status[0].Owner != (Owner{Team: "platform"}) {
+		t.Errorf("Manager.Status() = %+v, want owner team platform", status)
+	}
+}
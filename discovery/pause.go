@@ -0,0 +1,120 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/m-lab/gcp-service-discovery/metrics"
+)
+
+// AllServices is the service name that pauses discovery of every service.
+const AllServices = "*"
+
+// ErrUnknownSource is returned by Pause and Resume for names that select no
+// registered service.
+var ErrUnknownSource = errors.New("no registered service or output")
+
+var (
+	// servicePaused reports whether discovery of a service is paused by Pause.
+	// The metric is labeled by the name given to Pause: an output, a service
+	// name, or AllServices.
+	//
+	// Provides metrics:
+	//   gcp_manager_paused
+	// Usage example:
+	//   servicePaused.WithLabelValues("gke.Service").Set(1)
+	servicePaused = metrics.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gcp_manager_paused",
+			Help: "Whether discovery of a service is paused by an operator.",
+		},
+		[]string{"service"},
+	)
+)
+
+// Pause stops discovery of the named source until Resume is called. A source is
+// named by its output, e.g. "gke.json", which selects one registered service,
+// or by its service name, e.g. "gke.Service", which selects every registered
+// service of that type. AllServices selects every service. Outputs keep the
+// targets of the last pass, and failures are not recorded. Pause returns an
+// error wrapping ErrUnknownSource if name selects no registered service. Pause
+// is safe to call while Run is running, and takes effect at the next pass.
+func (m *Manager) Pause(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.selects(name) {
+		return fmt.Errorf("%w: %q", ErrUnknownSource, name)
+	}
+	m.pause(name)
+	return nil
+}
+
+// pause marks name as paused. The caller must hold m.mu.
+func (m *Manager) pause(name string) {
+	if m.pausedServices == nil {
+		m.pausedServices = map[string]bool{}
+	}
+	m.pausedServices[name] = true
+	servicePaused.WithLabelValues(name).Set(1)
+}
+
+// Resume restarts discovery of the source paused by the same name at the next
+// pass. When name is AllServices, Resume restarts discovery of every paused
+// source. Resume returns an error wrapping ErrUnknownSource if name is neither
+// paused nor selects a registered service.
+func (m *Manager) Resume(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.pausedServices[name] && !m.selects(name) {
+		return fmt.Errorf("%w: %q", ErrUnknownSource, name)
+	}
+	resumed := []string{name}
+	if name == AllServices {
+		resumed = resumed[:0]
+		for service := range m.pausedServices {
+			resumed = append(resumed, service)
+		}
+	}
+	for _, service := range resumed {
+		delete(m.pausedServices, service)
+		servicePaused.WithLabelValues(service).Set(0)
+	}
+	return nil
+}
+
+// Paused returns the sorted names given to Pause of the paused sources, which
+// may include AllServices.
+func (m *Manager) Paused() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := []string{}
+	for service := range m.pausedServices {
+		names = append(names, service)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isPaused returns true if discovery of reg is paused by its output or service
+// name. The caller must hold m.mu.
+func (m *Manager) isPaused(reg *registration) bool {
+	return m.pausedServices[AllServices] || m.pausedServices[reg.output] ||
+		m.pausedServices[serviceName(reg.service)]
+}
+
+// selects returns true if name is AllServices, or the output or service
+// name of a registered service. The caller must hold m.mu.
+func (m *Manager) selects(name string) bool {
+	if name == AllServices {
+		return true
+	}
+	for _, reg := range m.registrations {
+		if name == reg.output || name == serviceName(reg.service) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestManager_Pause(t *testing.T) {
+	dir := t.TempDir()
+	m := NewManager(WithTimeout(time.Minute), WithPaused("discovery.fakeCounter"))
+	paused := &fakeCounter{}
+	m.Register(paused, filepath.Join(dir, "paused.json"))
+	m.Register(&fakeLiteral{}, filepath.Join(dir, "output.json"))
+
+	ok := m.discoverAll(context.Background())
+	if !ok || paused.calls != 0 {
+		t.Errorf("Manager.discoverAll() = %v after %d calls, want true without calls", ok, paused.calls)
+	}
+	status := m.Status()
+	if !status[0].Paused || status[1].Paused || status[0].Health != HealthUnknown {
+		t.Errorf("Manager.Status() = %+v, want only the first paused with unknown health", status)
+	}
+	if v := testutil.ToFloat64(servicePaused.WithLabelValues("discovery.fakeCounter")); v != 1 {
+		t.Errorf("paused metric = %v, want 1", v)
+	}
+
+	// Pausing all services also pauses the second service.
+	if err := m.Pause(AllServices); err != nil {
+		t.Fatalf("Manager.Pause(%q) error = %v", AllServices, err)
+	}
+	if status := m.Status(); !status[0].Paused || !status[1].Paused {
+		t.Errorf("Manager.Status() after Pause(%q) = %+v, want all paused", AllServices, status)
+	}
+
+	// Resuming all services resumes every paused service.
+	if err := m.Resume(AllServices); err != nil {
+		t.Fatalf("Manager.Resume(%q) error = %v", AllServices, err)
+	}
+	if got := m.Paused(); !reflect.DeepEqual(got, []string{}) {
+		t.Errorf("Manager.Paused() after Resume(%q) = %q, want none", AllServices, got)
+	}
+	m.discoverAll(context.Background())
+	if paused.calls != 1 {
+		t.Errorf("Manager.discoverAll() after Resume(%q) made %d calls, want 1", AllServices, paused.calls)
+	}
+	if v := testutil.ToFloat64(servicePaused.WithLabelValues("discovery.fakeCounter")); v != 0 {
+		t.Errorf("paused metric = %v, want 0", v)
+	}
+}
+
+func TestManager_PauseOutput(t *testing.T) {
+	dir := t.TempDir()
+	m := NewManager(WithTimeout(time.Minute))
+	first := &fakeCounter{}
+	second := &fakeCounter{}
+	m.Register(first, filepath.Join(dir, "first.json"))
+	m.Register(second, filepath.Join(dir, "second.json"))
+
+	// An output selects only its own service, unlike the shared service name.
+	output := filepath.Join(dir, "first.json")
+	if err := m.Pause(output); err != nil {
+		t.Fatalf("Manager.Pause(%q) error = %v", output, err)
+	}
+	m.discoverAll(context.Background())
+	if first.calls != 0 || second.calls != 1 {
+		t.Errorf("Manager.discoverAll() made %d and %d calls, want 0 and 1", first.calls, second.calls)
+	}
+	if err := m.Resume(output); err != nil {
+		t.Errorf("Manager.Resume(%q) error = %v", output, err)
+	}
+
+	for _, name := range []string{"gke.Service", filepath.Join(dir, "unknown.json")} {
+		if err := m.Pause(name); !errors.Is(err, ErrUnknownSource) {
+			t.Errorf("Manager.Pause(%q) error = %v, want %v", name, err, ErrUnknownSource)
+		}
+		if err := m.Resume(name); !errors.Is(err, ErrUnknownSource) {
+			t.Errorf("Manager.Resume(%q) error = %v, want %v", name, err, ErrUnknownSource)
+		}
+	}
+	if got := m.Paused(); len(got) != 0 {
+		t.Errorf("Manager.Paused() = %q, want none", got)
+	}
+}
@@ -0,0 +1,136 @@
+package discovery
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// OutputOrder maps output filenames to the outputs that must be written before
+// them in every discovery pass, e.g. so a file merging all targets is written
+// only after each per-source file. Outputs that are not registered are
+// ignored. OutputOrder implements the flag.Value interface, so it may be set
+// from the command line with values like:
+//
+//	/targets/all.json=/targets/aeflex.json,/targets/gke.json
+type OutputOrder map[string][]string
+
+// String formats the order as a space separated list of flag values.
+func (o OutputOrder) String() string {
+	outputs := []string{}
+	for output := range o {
+		outputs = append(outputs, output)
+	}
+	sort.Strings(outputs)
+	values := []string{}
+	for _, output := range outputs {
+		values = append(values, output+"="+strings.Join(o[output], ","))
+	}
+	return strings.Join(values, " ")
+}
+
+// Set parses a value of the form "output=before1,before2" and adds the listed
+// outputs to those written before output.
+func (o *OutputOrder) Set(value string) error {
+	output, before, ok := strings.Cut(value, "=")
+	if !ok || output == "" || before == "" {
+		return fmt.Errorf("invalid output order %q: want output=output1,output2", value)
+	}
+	if *o == nil {
+		*o = OutputOrder{}
+	}
+	for _, b := range strings.Split(before, ",") {
+		b = strings.TrimSpace(b)
+		if b == "" || b == output {
+			return fmt.Errorf("invalid output order %q: an output cannot be written before itself", value)
+		}
+		(*o)[output] = append((*o)[output], b)
+	}
+	return nil
+}
+
+// Validate returns an error if the order has a cycle, so no output of the
+// cycle could be written first.
+func (o OutputOrder) Validate() error {
+	visiting := map[string]bool{}
+	done := map[string]bool{}
+	var visit func(output string) error
+	visit = func(output string) error {
+		if done[output] {
+			return nil
+		}
+		if visiting[output] {
+			return fmt.Errorf("output order has a cycle through %q", output)
+		}
+		visiting[output] = true
+		for _, before := range o[output] {
+			if err := visit(before); err != nil {
+				return err
+			}
+		}
+		done[output] = true
+		return nil
+	}
+	for output := range o {
+		if err := visit(output); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stages groups the indexes of regs so that every output is in a later stage
+// than the registered outputs written before it. Registrations keep their
+// relative order within a stage. Dependencies that form a cycle are ignored.
+func (o OutputOrder) stages(regs []*registration) [][]int {
+	if len(o) == 0 {
+		if len(regs) == 0 {
+			return nil
+		}
+		all := make([]int, len(regs))
+		for i := range regs {
+			all[i] = i
+		}
+		return [][]int{all}
+	}
+	registered := map[string]bool{}
+	for _, reg := range regs {
+		registered[reg.output] = true
+	}
+	levels := map[string]int{}
+	visiting := map[string]bool{}
+	var level func(output string) int
+	level = func(output string) int {
+		if l, ok := levels[output]; ok {
+			return l
+		}
+		visiting[output] = true
+		l := 0
+		for _, before := range o[output] {
+			if !registered[before] || visiting[before] {
+				continue
+			}
+			if b := level(before) + 1; b > l {
+				l = b
+			}
+		}
+		visiting[output] = false
+		levels[output] = l
+		return l
+	}
+	var stages [][]int
+	for i, reg := range regs {
+		l := level(reg.output)
+		for len(stages) <= l {
+			stages = append(stages, nil)
+		}
+		stages[l] = append(stages[l], i)
+	}
+	return stages
+}
+
+// critical returns true if a failure to update the output of reg means the
+// discovery pass failed. Outputs set by WithBestEffort are not critical.
+func (m *Manager) critical(reg *registration) bool {
+	return !contains(m.bestEffortOutputs, reg.output)
+}
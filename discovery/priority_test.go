@@ -0,0 +1,141 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeAfter fails unless every file exists when Discover is called.
+type fakeAfter struct {
+	files []string
+}
+
+func (f *fakeAfter) Discover(ctx context.Context) ([]StaticConfig, error) {
+	for _, file := range f.files {
+		if _, err := os.Stat(file); err != nil {
+			return nil, fmt.Errorf("discovered before %s was written", file)
+		}
+	}
+	return []StaticConfig{{Targets: []string{"merged"}}}, nil
+}
+
+func TestOutputOrder_Set(t *testing.T) {
+	o := OutputOrder{}
+	for _, v := range []string{"all.json=a.json,b.json", "all.json=c.json", "b.json=a.json"} {
+		if err := o.Set(v); err != nil {
+			t.Fatalf("OutputOrder.Set(%q) error = %v", v, err)
+		}
+	}
+	want := OutputOrder{"all.json": {"a.json", "b.json", "c.json"}, "b.json": {"a.json"}}
+	if !reflect.DeepEqual(o, want) {
+		t.Errorf("OutputOrder.Set() = %v, want %v", o, want)
+	}
+	if got, want := o.String(), "all.json=a.json,b.json,c.json b.json=a.json"; got != want {
+		t.Errorf("OutputOrder.String() = %q, want %q", got, want)
+	}
+	for _, v := range []string{"all.json", "=a.json", "all.json=", "all.json=a.json,,b.json", "a.json=a.json"} {
+		if err := o.Set(v); err == nil {
+			t.Errorf("OutputOrder.Set(%q) error = nil, want error", v)
+		}
+	}
+}
+
+func TestOutputOrder_Validate(t *testing.T) {
+	o := OutputOrder{"all.json": {"a.json", "b.json"}, "b.json": {"a.json"}}
+	if err := o.Validate(); err != nil {
+		t.Errorf("OutputOrder.Validate() error = %v", err)
+	}
+	o["a.json"] = []string{"all.json"}
+	if err := o.Validate(); err == nil {
+		t.Errorf("OutputOrder.Validate() error = nil, want cycle error")
+	}
+}
+
+func TestOutputOrder_stages(t *testing.T) {
+	regs := []*registration{{output: "all.json"}, {output: "a.json"}, {output: "b.json"}, {output: "c.json"}}
+	tests := []struct {
+		name  string
+		order OutputOrder
+		want  [][]int
+	}{
+		{
+			name: "no-order",
+			want: [][]int{{0, 1, 2, 3}},
+		},
+		{
+			name:  "chain",
+			order: OutputOrder{"all.json": {"b.json", "missing.json"}, "b.json": {"a.json"}},
+			want:  [][]int{{1, 3}, {2}, {0}},
+		},
+		{
+			name:  "cycle-ignored",
+			order: OutputOrder{"a.json": {"b.json"}, "b.json": {"a.json"}},
+			want:  [][]int{{0, 2, 3}, {1}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.order.stages(regs); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("OutputOrder.stages() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestManager_discoverAllOrder(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.json")
+	b := filepath.Join(dir, "b.json")
+	all := filepath.Join(dir, "all.json")
+
+	// The merged output is registered first, and would run first.
+	m := NewManager(WithMaxParallel(3), WithOutputOrder(OutputOrder{all: {a, b}}))
+	m.Register(&fakeAfter{files: []string{a, b}}, all)
+	m.Register(&fakeLiteral{}, a)
+	m.Register(&fakeLiteral{}, b)
+	if !m.discoverAll(context.Background()) {
+		t.Errorf("Manager.discoverAll() = false, want true; status = %v", m.Status())
+	}
+	if _, err := os.Stat(all); err != nil {
+		t.Errorf("Manager.discoverAll() did not write %s: %v", all, err)
+	}
+}
+
+func TestManager_discoverAllBestEffort(t *testing.T) {
+	for _, atomic := range []bool{false, true} {
+		t.Run(fmt.Sprintf("atomic=%t", atomic), func(t *testing.T) {
+			dir := t.TempDir()
+			optional := filepath.Join(dir, "optional.json")
+			required := filepath.Join(dir, "required.json")
+
+			m := NewManager(WithTimeout(time.Minute), WithAtomic(atomic))
+			m.Register(&fakeFailure{}, optional)
+			m.Register(&fakeLiteral{}, required)
+			if m.discoverAll(context.Background()) {
+				t.Errorf("Manager.discoverAll() = true, want false for a critical failure")
+			}
+
+			m = NewManager(WithTimeout(time.Minute), WithAtomic(atomic), WithBestEffort([]string{optional}))
+			m.Register(&fakeFailure{}, optional)
+			m.Register(&fakeLiteral{}, required)
+			if !m.discoverAll(context.Background()) {
+				t.Errorf("Manager.discoverAll() = false, want true for a best-effort failure")
+			}
+			if _, err := os.Stat(required); err != nil {
+				t.Errorf("Manager.discoverAll() did not write %s: %v", required, err)
+			}
+			status := m.Status()
+			if !status[0].BestEffort || status[1].BestEffort {
+				t.Errorf("Manager.Status() BestEffort = %t, %t, want true, false", status[0].BestEffort, status[1].BestEffort)
+			}
+			if status[0].LastError == "" {
+				t.Errorf("Manager.Status() LastError is empty for a best-effort failure")
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package discovery
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Profile selects the label conventions of output files for a particular
+// consumer. Profile implements the flag.Value interface.
+type Profile string
+
+// Supported output profiles.
+const (
+	// ProfilePrometheus writes labels exactly as discovered, for Prometheus
+	// file_sd_configs.
+	ProfilePrometheus Profile = "prometheus"
+
+	// ProfileVictoriaMetrics writes labels for vmagent file_sd_configs:
+	//   - Internal labels, like __aef_project, are renamed with the __meta_
+	//     prefix, e.g. __meta_aef_project, since vmagent only keeps __meta_*
+	//     labels for relabeling and its target debug pages.
+	//   - __address__ labels are removed, since the address of every target
+	//     comes from the targets list, and Prometheus and vmagent disagree on
+	//     which takes precedence.
+	// Raw documents from RawSource services are re-serialized with the
+	// converted labels.
+	ProfileVictoriaMetrics Profile = "victoriametrics"
+)
+
+// String returns the profile name.
+func (p Profile) String() string {
+	return string(p)
+}
+
+// Set parses a profile name.
+func (p *Profile) Set(value string) error {
+	switch v := Profile(strings.ToLower(value)); v {
+	case ProfilePrometheus, ProfileVictoriaMetrics:
+		*p = v
+		return nil
+	}
+	return fmt.Errorf("unknown output profile %q: want %q or %q", value, ProfilePrometheus, ProfileVictoriaMetrics)
+}
+
+// reservedLabels are internal labels with special meaning to scrapers, which
+// are written unchanged by every profile.
+var reservedLabels = map[string]bool{
+	"__address__":         true,
+	"__scheme__":          true,
+	"__metrics_path__":    true,
+	"__scrape_interval__": true,
+	"__scrape_timeout__":  true,
+}
+
+// rewrites returns true if the profile changes the configs written to outputs.
+func (p Profile) rewrites() bool {
+	return p == ProfileVictoriaMetrics
+}
+
+// profileOf returns the Profile of the outputs of reg. Verbatim registrations
+// are written with ProfilePrometheus, i.e. unchanged.
+func (m *Manager) profileOf(reg *registration) Profile {
+	if reg.verbatim {
+		return ProfilePrometheus
+	}
+	return m.profile
+}
+
+// apply returns copies of configs with labels converted for the profile. The
+// given configs are not modified.
+func (p Profile) apply(configs []StaticConfig) []StaticConfig {
+	if !p.rewrites() || configs == nil {
+		return configs
+	}
+	result := make([]StaticConfig, len(configs))
+	for i, c := range configs {
+		result[i] = StaticConfig{Targets: c.Targets, Extra: c.Extra}
+		if c.Labels == nil {
+			continue
+		}
+		result[i].Labels = make(map[string]string, len(c.Labels))
+		for k, v := range c.Labels {
+			if k == "__address__" {
+				continue
+			}
+			result[i].Labels[vmLabel(k)] = v
+		}
+	}
+	return result
+}
+
+// vmLabel returns the name of label k for vmagent.
+func vmLabel(k string) string {
+	if !strings.HasPrefix(k, "__") || strings.HasPrefix(k, "__meta_") ||
+		strings.HasPrefix(k, "__param_") || reservedLabels[k] {
+		return k
+	}
+	return "__meta_" + strings.TrimPrefix(k, "__")
+}
@@ -0,0 +1,95 @@
+package discovery
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProfile_Set(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    Profile
+		wantErr bool
+	}{
+		{
+			name:  "prometheus",
+			value: "prometheus",
+			want:  ProfilePrometheus,
+		},
+		{
+			name:  "victoriametrics",
+			value: "VictoriaMetrics",
+			want:  ProfileVictoriaMetrics,
+		},
+		{
+			name:    "failure-unknown",
+			value:   "thanos",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p Profile
+			err := p.Set(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Profile.Set() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if p != tt.want {
+				t.Errorf("Profile.Set() = %q, want %q", p, tt.want)
+			}
+		})
+	}
+}
+
+func TestProfile_apply(t *testing.T) {
+	configs := []StaticConfig{
+		{
+			Targets: []string{"1.2.3.4:9090"},
+			Labels: map[string]string{
+				"__address__":      "5.6.7.8:9090",
+				"__aef_project":    "mlab-sandbox",
+				"__meta_ready":     "true",
+				"__metrics_path__": "/metrics",
+				"__param_module":   "icmp",
+				"service":          "etl",
+			},
+		},
+	}
+	tests := []struct {
+		name    string
+		profile Profile
+		want    map[string]string
+	}{
+		{
+			name:    "prometheus",
+			profile: ProfilePrometheus,
+			want:    configs[0].Labels,
+		},
+		{
+			name:    "victoriametrics",
+			profile: ProfileVictoriaMetrics,
+			want: map[string]string{
+				"__meta_aef_project": "mlab-sandbox",
+				"__meta_ready":       "true",
+				"__metrics_path__":   "/metrics",
+				"__param_module":     "icmp",
+				"service":            "etl",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.profile.apply(configs)
+			if !reflect.DeepEqual(got[0].Labels, tt.want) {
+				t.Errorf("Profile.apply() = %v, want %v", got[0].Labels, tt.want)
+			}
+			if !reflect.DeepEqual(got[0].Targets, configs[0].Targets) {
+				t.Errorf("Profile.apply() targets = %v, want %v", got[0].Targets, configs[0].Targets)
+			}
+		})
+	}
+	if _, ok := configs[0].Labels["__aef_project"]; !ok {
+		t.Errorf("Profile.apply() modified the given configs")
+	}
+}
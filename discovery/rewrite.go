@@ -0,0 +1,211 @@
+package discovery
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// AddressRewrite changes the addresses of targets, for Prometheus servers that
+// reach targets through NAT or a bastion, rather than at their discovered
+// addresses.
+type AddressRewrite struct {
+	// From selects the targets with an IP address in the network. When nil,
+	// every target is selected, including targets with hostnames.
+	From *net.IPNet
+
+	// To replaces the network prefix of From in the addresses of targets,
+	// keeping the remaining bits, like 1:1 NAT. When nil, addresses are kept.
+	To net.IP
+
+	// PortOffset is added to the port of targets. Targets without a port, or
+	// whose new port would be out of range, keep their port.
+	PortOffset int
+}
+
+// String formats r as a comma separated list of key=value options.
+func (r AddressRewrite) String() string {
+	opts := []string{}
+	if r.From != nil {
+		opts = append(opts, "from="+r.From.String())
+	}
+	if r.To != nil {
+		opts = append(opts, "to="+r.To.String())
+	}
+	if r.PortOffset != 0 {
+		opts = append(opts, "port-offset="+strconv.Itoa(r.PortOffset))
+	}
+	return strings.Join(opts, ",")
+}
+
+// rewrite returns the rewritten target, and whether r selects the target.
+// Targets that are URLs are never selected.
+func (r AddressRewrite) rewrite(target string) (string, bool) {
+	if strings.Contains(target, "/") {
+		return target, false
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		host, port = target, ""
+	}
+	ip := net.ParseIP(host)
+	if r.From != nil && (ip == nil || !r.From.Contains(ip)) {
+		return target, false
+	}
+	if r.To != nil && ip != nil {
+		host = translate(ip, r.From, r.To).String()
+	}
+	if p, err := strconv.Atoi(port); err == nil && r.PortOffset != 0 {
+		if p += r.PortOffset; p > 0 && p <= 65535 {
+			port = strconv.Itoa(p)
+		}
+	}
+	if port == "" {
+		if strings.Contains(host, ":") {
+			return "[" + host + "]", true
+		}
+		return host, true
+	}
+	return net.JoinHostPort(host, port), true
+}
+
+// translate replaces the prefix of network in ip with the same bits of to.
+func translate(ip net.IP, network *net.IPNet, to net.IP) net.IP {
+	size := len(network.Mask)
+	ip, to = normalize(ip, size), normalize(to, size)
+	result := make(net.IP, size)
+	for i := range result {
+		result[i] = to[i]&network.Mask[i] | ip[i]&^network.Mask[i]
+	}
+	return result
+}
+
+// normalize returns ip in its 4 or 16 byte form, matching size.
+func normalize(ip net.IP, size int) net.IP {
+	if size == net.IPv4len {
+		return ip.To4()
+	}
+	return ip.To16()
+}
+
+// AddressRewrites maps service names, e.g. "gke.Service", or output
+// filenames, e.g. "/targets/web.json", to the rules that rewrite the addresses
+// of their targets before they are written. The first rule that selects a
+// target is used. AddressRewrites implements the flag.Value interface, so
+// rules may be added from the command line with values like:
+//
+//	gke.Service=from=10.0.0.0/8,to=100.64.0.0,port-offset=10000
+type AddressRewrites map[string][]AddressRewrite
+
+// String formats the rules as a space separated list of flag values.
+func (a AddressRewrites) String() string {
+	names := []string{}
+	for name := range a {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	values := []string{}
+	for _, name := range names {
+		for _, r := range a[name] {
+			values = append(values, name+"="+r.String())
+		}
+	}
+	return strings.Join(values, " ")
+}
+
+// Set parses a value of the form
+// "source=from=<cidr>,to=<address>,port-offset=<n>" and adds the rule to those
+// of the named source. The to address must have the family of from, and
+// requires it. Either to or port-offset must be set.
+func (a *AddressRewrites) Set(value string) error {
+	fields := strings.SplitN(value, "=", 2)
+	if len(fields) != 2 || fields[0] == "" || fields[1] == "" {
+		return fmt.Errorf("invalid address rewrite %q: want source=from=<cidr>,to=<address>,port-offset=<n>", value)
+	}
+	r := AddressRewrite{}
+	for _, opt := range strings.Split(fields[1], ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(opt), "=")
+		if !ok || v == "" {
+			return fmt.Errorf("invalid address rewrite option %q: want key=value", opt)
+		}
+		switch k {
+		case "from":
+			_, network, err := net.ParseCIDR(v)
+			if err != nil {
+				return fmt.Errorf("invalid address rewrite option %q: %s", opt, err)
+			}
+			r.From = network
+		case "to":
+			r.To = net.ParseIP(v)
+			if r.To == nil {
+				return fmt.Errorf("invalid address rewrite option %q: not an IP address", opt)
+			}
+		case "port-offset":
+			n, err := strconv.Atoi(strings.TrimPrefix(v, "+"))
+			if err != nil || n == 0 || n < -65535 || n > 65535 {
+				return fmt.Errorf("invalid address rewrite option %q: want a non-zero port offset", opt)
+			}
+			r.PortOffset = n
+		default:
+			return fmt.Errorf("unknown address rewrite option %q: want from, to, or port-offset", k)
+		}
+	}
+	if r.To == nil && r.PortOffset == 0 {
+		return fmt.Errorf("invalid address rewrite %q: want to or port-offset", value)
+	}
+	if r.To != nil {
+		if r.From == nil {
+			return fmt.Errorf("invalid address rewrite %q: to requires from", value)
+		}
+		if (r.To.To4() != nil) != (len(r.From.Mask) == net.IPv4len) {
+			return fmt.Errorf("invalid address rewrite %q: from and to are different address families", value)
+		}
+	}
+	if *a == nil {
+		*a = AddressRewrites{}
+	}
+	(*a)[fields[0]] = append((*a)[fields[0]], r)
+	return nil
+}
+
+// lookup returns the rules of the source with the given service name and
+// output. Rules of the output take precedence over those of the service.
+func (a AddressRewrites) lookup(service, output string) ([]AddressRewrite, bool) {
+	if rules, ok := a[output]; ok {
+		return rules, true
+	}
+	rules, ok := a[service]
+	return rules, ok
+}
+
+// rewriteAddresses returns copies of configs with every target rewritten by
+// the first rule that selects it. The origins of rewritten targets are moved
+// to their new addresses. The given configs are not modified.
+func rewriteAddresses(rules []AddressRewrite, configs []StaticConfig, origins map[string]Origin) []StaticConfig {
+	if configs == nil {
+		return nil
+	}
+	result := make([]StaticConfig, len(configs))
+	for i, c := range configs {
+		result[i] = c
+		result[i].Targets = make([]string, len(c.Targets))
+		for j, target := range c.Targets {
+			result[i].Targets[j] = target
+			for _, r := range rules {
+				rewritten, ok := r.rewrite(target)
+				if !ok {
+					continue
+				}
+				result[i].Targets[j] = rewritten
+				if origin, found := origins[target]; found && rewritten != target {
+					origins[rewritten] = origin
+					delete(origins, target)
+				}
+				break
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,129 @@
+package discovery
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func mustRewrites(t *testing.T, values ...string) AddressRewrites {
+	a := AddressRewrites{}
+	for _, v := range values {
+		if err := a.Set(v); err != nil {
+			t.Fatalf("AddressRewrites.Set(%q) error = %v", v, err)
+		}
+	}
+	return a
+}
+
+func TestAddressRewrites_Set(t *testing.T) {
+	a := mustRewrites(t,
+		"gke.Service=from=10.0.0.0/8, to=100.64.0.0",
+		"gke.Service=port-offset=+10000",
+		"/targets/web.json=from=2001:db8::/32,to=2001:db9::,port-offset=-1",
+	)
+	want := "/targets/web.json=from=2001:db8::/32,to=2001:db9::,port-offset=-1 " +
+		"gke.Service=from=10.0.0.0/8,to=100.64.0.0 gke.Service=port-offset=10000"
+	if got := a.String(); got != want {
+		t.Errorf("AddressRewrites.String() = %q, want %q", got, want)
+	}
+	for _, v := range []string{
+		"gke.Service",
+		"gke.Service=from=10.0.0.0/8",
+		"gke.Service=to=100.64.0.0",
+		"gke.Service=from=10.0.0.0/8,to=2001:db8::",
+		"gke.Service=from=10.0.0.0,to=100.64.0.0",
+		"gke.Service=port-offset=0",
+		"gke.Service=port-offset=70000",
+		"gke.Service=via=bastion",
+	} {
+		if err := a.Set(v); err == nil {
+			t.Errorf("AddressRewrites.Set(%q) error = nil, want error", v)
+		}
+	}
+}
+
+func TestAddressRewrite_rewrite(t *testing.T) {
+	rules := mustRewrites(t,
+		"s=from=10.0.0.0/8,to=100.64.0.0,port-offset=10000",
+		"s=from=2001:db8::/32,to=2001:db9::",
+		"s=port-offset=1",
+	)["s"]
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{target: "10.1.2.3:9100", want: "100.1.2.3:19100"},
+		{target: "10.1.2.3", want: "100.1.2.3"},
+		{target: "10.1.2.3:60000", want: "100.1.2.3:60000"},
+		{target: "[2001:db8::1]:80", want: "[2001:db9::1]:80"},
+		{target: "2001:db8::1", want: "[2001:db9::1]"},
+		{target: "192.0.2.1:9100", want: "192.0.2.1:9101"},
+		{target: "example.com:443", want: "example.com:444"},
+		{target: "https://example.com/metrics", want: "https://example.com/metrics"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			got := tt.target
+			for _, r := range rules {
+				if rewritten, ok := r.rewrite(tt.target); ok {
+					got = rewritten
+					break
+				}
+			}
+			if got != tt.want {
+				t.Errorf("AddressRewrite.rewrite(%q) = %q, want %q", tt.target, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddressRewrites_lookup(t *testing.T) {
+	a := mustRewrites(t, "web.Service=port-offset=1", "/targets/api.json=port-offset=2")
+	if rules, ok := a.lookup("web.Service", "/targets/api.json"); !ok || rules[0].PortOffset != 2 {
+		t.Errorf("AddressRewrites.lookup() = %v, %t, want the rules of the output", rules, ok)
+	}
+	if rules, ok := a.lookup("web.Service", "/targets/web.json"); !ok || rules[0].PortOffset != 1 {
+		t.Errorf("AddressRewrites.lookup() = %v, %t, want the rules of the service", rules, ok)
+	}
+	if _, ok := a.lookup("gke.Service", "/targets/gke.json"); ok {
+		t.Errorf("AddressRewrites.lookup() found rules for an unknown source")
+	}
+}
+
+func TestManager_discoverAddressRewrites(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "output.json")
+	m := NewManager(WithTimeout(time.Minute), WithAddressRewrites(mustRewrites(t, "discovery.fakeLiteral=from=0.0.0.0/0,to=192.0.2.1")))
+	m.Register(&fakeIP{}, output)
+	r, err := m.discover(context.Background(), m.registrations[0])
+	if err != nil {
+		t.Fatalf("Manager.discover() error = %v", err)
+	}
+	if !reflect.DeepEqual(r.configs[0].Targets, []string{"10.0.0.1:9100"}) {
+		t.Errorf("Manager.discover() rewrote the targets of another source: %v", r.configs)
+	}
+
+	m = NewManager(WithTimeout(time.Minute), WithAddressRewrites(mustRewrites(t, output+"=from=10.0.0.0/24,to=192.0.2.0,port-offset=1")))
+	m.Register(&fakeIP{}, output)
+	r, err = m.discover(context.Background(), m.registrations[0])
+	if err != nil {
+		t.Fatalf("Manager.discover() error = %v", err)
+	}
+	if !reflect.DeepEqual(r.configs[0].Targets, []string{"192.0.2.1:9101"}) {
+		t.Errorf("Manager.discover() targets = %v, want [192.0.2.1:9101]", r.configs[0].Targets)
+	}
+	if _, ok := r.origins["192.0.2.1:9101"]; !ok {
+		t.Errorf("Manager.discover() origins = %v, want the rewritten target", r.origins)
+	}
+}
+
+// fakeIP discovers one target with an IP address.
+type fakeIP struct{}
+
+func (f *fakeIP) Discover(ctx context.Context) ([]StaticConfig, error) {
+	config := StaticConfig{Targets: []string{"10.0.0.1:9100"}, Labels: map[string]string{"key": "value"}}
+	RecordOrigin(ctx, config, "fake")
+	return []StaticConfig{config}, nil
+}
@@ -0,0 +1,164 @@
+package discovery
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/m-lab/gcp-service-discovery/metrics"
+)
+
+var (
+	// sanitizedLabels counts labels with an invalid name or value found in
+	// discovered targets, by service and by the invalid part of the label:
+	// "name" or "value".
+	//
+	// Provides metrics:
+	//   gcp_manager_sanitized_labels_total
+	// Usage example:
+	//   sanitizedLabels.WithLabelValues("gke.Service", "value").Inc()
+	sanitizedLabels = metrics.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gcp_manager_sanitized_labels_total",
+			Help: "Number of discovered labels with an invalid name or value.",
+		},
+		[]string{"service", "part"},
+	)
+)
+
+// SanitizePolicy determines how the Manager handles discovered labels that
+// Prometheus rejects: names that do not match [a-zA-Z_][a-zA-Z0-9_]*, and
+// values that are not valid UTF-8. One such label, e.g. from an odd
+// Kubernetes annotation, would otherwise make Prometheus reject the whole
+// output file. SanitizePolicy implements the flag.Value interface.
+type SanitizePolicy string
+
+// Supported sanitize policies.
+const (
+	// SanitizeReplace replaces invalid characters of label names with
+	// underscores, and invalid UTF-8 sequences of values with U+FFFD. A
+	// replaced name never overwrites another label of the target.
+	SanitizeReplace SanitizePolicy = "replace"
+
+	// SanitizeDrop removes invalid labels from their targets.
+	SanitizeDrop SanitizePolicy = "drop"
+
+	// SanitizeError fails the discovery pass of a service that returns an
+	// invalid label, so its previous output is kept.
+	SanitizeError SanitizePolicy = "error"
+)
+
+// String returns the policy name.
+func (p SanitizePolicy) String() string {
+	return string(p)
+}
+
+// Set parses a policy name.
+func (p *SanitizePolicy) Set(value string) error {
+	switch v := SanitizePolicy(strings.ToLower(value)); v {
+	case SanitizeReplace, SanitizeDrop, SanitizeError:
+		*p = v
+		return nil
+	}
+	return fmt.Errorf("unknown sanitize policy %q: want %q, %q, or %q", value, SanitizeReplace, SanitizeDrop, SanitizeError)
+}
+
+// apply returns configs discovered by the named service with invalid labels
+// handled by the policy, and true if any label was changed. The given configs
+// are not modified. The empty policy returns configs unchanged.
+func (p SanitizePolicy) apply(service string, configs []StaticConfig) ([]StaticConfig, bool, error) {
+	if p == "" {
+		return configs, false, nil
+	}
+	var result []StaticConfig
+	for i, c := range configs {
+		invalid := []string{}
+		for k, v := range c.Labels {
+			if !validLabelName(k) || !utf8.ValidString(v) {
+				invalid = append(invalid, k)
+			}
+		}
+		if len(invalid) == 0 {
+			continue
+		}
+		// Sort, so collisions between replaced names are resolved the same
+		// way on every pass.
+		sort.Strings(invalid)
+		if p == SanitizeError {
+			k := invalid[0]
+			return nil, false, fmt.Errorf("invalid label %q=%q of targets %v", k, c.Labels[k], c.Targets)
+		}
+		labels := make(map[string]string, len(c.Labels))
+		for k, v := range c.Labels {
+			labels[k] = v
+		}
+		for _, k := range invalid {
+			v := labels[k]
+			delete(labels, k)
+			name := k
+			if !validLabelName(k) {
+				sanitizedLabels.WithLabelValues(service, "name").Inc()
+				name = sanitizeLabelName(k)
+			}
+			if !utf8.ValidString(v) {
+				sanitizedLabels.WithLabelValues(service, "value").Inc()
+				v = strings.ToValidUTF8(v, "\uFFFD")
+			}
+			if _, exists := labels[name]; p == SanitizeReplace && !exists {
+				labels[name] = v
+			}
+		}
+		if result == nil {
+			result = make([]StaticConfig, len(configs))
+			copy(result, configs)
+		}
+		result[i] = StaticConfig{Targets: c.Targets, Labels: labels, Extra: c.Extra}
+	}
+	if result == nil {
+		return configs, false, nil
+	}
+	return result, true, nil
+}
+
+// validLabelName returns true if k is a valid Prometheus label name.
+func validLabelName(k string) bool {
+	if k == "" {
+		return false
+	}
+	for i, r := range k {
+		if !labelNameRune(r, i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// sanitizeLabelName returns k with every invalid character replaced by an
+// underscore, and an underscore prepended if k starts with a digit.
+func sanitizeLabelName(k string) string {
+	if k == "" {
+		return "_"
+	}
+	b := strings.Builder{}
+	if k[0] >= '0' && k[0] <= '9' {
+		b.WriteByte('_')
+	}
+	for _, r := range k {
+		if labelNameRune(r, false) {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// labelNameRune returns true if r may be used in a label name, at its start if
+// first is true.
+func labelNameRune(r rune, first bool) bool {
+	return r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') ||
+		(!first && r >= '0' && r <= '9')
+}
@@ -0,0 +1,194 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSanitizePolicy_Set(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    SanitizePolicy
+		wantErr bool
+	}{
+		{
+			name:  "replace",
+			value: "replace",
+			want:  SanitizeReplace,
+		},
+		{
+			name:  "drop",
+			value: "Drop",
+			want:  SanitizeDrop,
+		},
+		{
+			name:  "error",
+			value: "error",
+			want:  SanitizeError,
+		},
+		{
+			name:    "failure-unknown",
+			value:   "escape",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p SanitizePolicy
+			err := p.Set(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("SanitizePolicy.Set() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if p != tt.want {
+				t.Errorf("SanitizePolicy.Set() = %q, want %q", p, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizePolicy_apply(t *testing.T) {
+	labels := map[string]string{
+		"__gke_service":           "web",
+		"prometheus.io/port":      "9090",
+		"9lives":                  "cat",
+		"owner":                   "ops\xffteam",
+		"prometheus_io_port":      "9091",
+		"prometheus.io/scrape":    "true",
+		"prometheus.io_scrape":    "false",
+		"__gce_label_description": "caf\xc3",
+	}
+	tests := []struct {
+		name        string
+		policy      SanitizePolicy
+		want        map[string]string
+		wantChanged bool
+		wantErr     bool
+	}{
+		{
+			name: "disabled",
+			want: labels,
+		},
+		{
+			name:   "replace",
+			policy: SanitizeReplace,
+			want: map[string]string{
+				"__gke_service":           "web",
+				"prometheus_io_port":      "9091",
+				"_9lives":                 "cat",
+				"owner":                   "ops\uFFFDteam",
+				"prometheus_io_scrape":    "true",
+				"__gce_label_description": "caf\uFFFD",
+			},
+			wantChanged: true,
+		},
+		{
+			name:   "drop",
+			policy: SanitizeDrop,
+			want: map[string]string{
+				"__gke_service":      "web",
+				"prometheus_io_port": "9091",
+			},
+			wantChanged: true,
+		},
+		{
+			name:    "error",
+			policy:  SanitizeError,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configs := []StaticConfig{{Targets: []string{"a"}}, {Targets: []string{"1.2.3.4:9090"}, Labels: labels}}
+			got, changed, err := tt.policy.apply("fake.Service", configs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SanitizePolicy.apply() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if changed != tt.wantChanged {
+				t.Errorf("SanitizePolicy.apply() changed = %t, want %t", changed, tt.wantChanged)
+			}
+			if !reflect.DeepEqual(got[1].Labels, tt.want) {
+				t.Errorf("SanitizePolicy.apply() = %v, want %v", got[1].Labels, tt.want)
+			}
+			if got[0].Labels != nil {
+				t.Errorf("SanitizePolicy.apply() = %v, want no labels", got[0].Labels)
+			}
+			if _, ok := labels["prometheus.io/port"]; !ok {
+				t.Errorf("SanitizePolicy.apply() modified the given labels")
+			}
+		})
+	}
+}
+
+func TestSanitizePolicy_applyValid(t *testing.T) {
+	configs := []StaticConfig{{Targets: []string{"a"}, Labels: map[string]string{"__aef_service": "etl", "zone": "us-central1-a"}}}
+	got, changed, err := SanitizeError.apply("fake.Service", configs)
+	if err != nil || changed {
+		t.Fatalf("SanitizePolicy.apply() = %t, %v, want false, nil", changed, err)
+	}
+	if &got[0] != &configs[0] {
+		t.Errorf("SanitizePolicy.apply() copied valid configs")
+	}
+}
+
+type fakeInvalidLabels struct{}
+
+func (f *fakeInvalidLabels) Discover(ctx context.Context) ([]StaticConfig, error) {
+	return []StaticConfig{
+		{Targets: []string{"output"}, Labels: map[string]string{"app.kubernetes.io/name": "etl"}},
+	}, nil
+}
+
+func (f *fakeInvalidLabels) Raw() []byte {
+	return []byte(`[{"targets": ["output"], "labels": {"app.kubernetes.io/name": "etl"}}]`)
+}
+
+func TestManager_Sanitize(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "output.json")
+	m := NewManager(WithTimeout(time.Minute), WithSanitize(SanitizeReplace))
+	m.Register(&fakeInvalidLabels{}, output)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m.Run(ctx, time.Minute)
+
+	data, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	got := []StaticConfig{}
+	if err = json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	// The raw data of the service is not written, since it has the invalid
+	// label.
+	want := []StaticConfig{{Targets: []string{"output"}, Labels: map[string]string{"app_kubernetes_io_name": "etl"}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Manager.Run() wrote %s, want %v", data, want)
+	}
+	if v := testutil.ToFloat64(sanitizedLabels.WithLabelValues("discovery.fakeInvalidLabels", "name")); v != 1 {
+		t.Errorf("gcp_manager_sanitized_labels_total = %v, want 1", v)
+	}
+}
+
+func TestManager_SanitizeError(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "output.json")
+	m := NewManager(WithTimeout(time.Minute), WithSanitize(SanitizeError))
+	m.Register(&fakeInvalidLabels{}, output)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m.Run(ctx, time.Minute)
+
+	if _, err := ioutil.ReadFile(output); err == nil {
+		t.Errorf("Manager.Run() wrote %s, want no output", output)
+	}
+}
@@ -0,0 +1,21 @@
+package discovery
+
+import (
+	_ "embed" // Embed the schema document.
+)
+
+// SchemaVersion is the version of the format of output files written with
+// ProfilePrometheus. Within a version, labels and fields are only added. The
+// version changes when a label or field is renamed, removed, or changes
+// format, so consumers that parse output files can detect breaking changes.
+const SchemaVersion = 1
+
+// SchemaID identifies the JSON schema of SchemaVersion, and is written to
+// Metadata files.
+const SchemaID = "https://github.com/m-lab/gcp-service-discovery/schema/static-configs.v1.json"
+
+// Schema is the JSON schema of output files. It describes the labels written
+// by every source in this repository; labels of other sources are allowed.
+//
+//go:embed schema.v1.json
+var Schema string
@@ -0,0 +1,131 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/m-lab/gcp-service-discovery/internal/schematest"
+)
+
+type fakeLabeled struct{}
+
+func (f *fakeLabeled) Discover(ctx context.Context) ([]StaticConfig, error) {
+	return []StaticConfig{
+		{
+			Targets: []string{"10.0.0.1:9090"},
+			Labels:  map[string]string{LabelReady: "true", "__metrics_path__": "/metrics", "cluster": "prometheus-federation"},
+		},
+		{
+			Targets: []string{"10.0.0.2:9090", "10.0.0.3:9090"},
+			Extra:   map[string]json.RawMessage{"comment": []byte(`"kept"`)},
+		},
+	}, nil
+}
+
+func TestSchema(t *testing.T) {
+	var s map[string]interface{}
+	if err := json.Unmarshal([]byte(Schema), &s); err != nil {
+		t.Fatalf("Schema is not valid JSON: %v", err)
+	}
+	if s["$id"] != SchemaID {
+		t.Errorf("Schema $id = %v, want %q", s["$id"], SchemaID)
+	}
+	tests := []struct {
+		name    string
+		doc     string
+		wantErr bool
+	}{
+		{
+			name: "success",
+			doc:  `[{"targets": ["a:1"], "labels": {"__aef_public_protocol": "both", "__gke_node_pools": "3", "__scrape_interval__": "1m30s"}}]`,
+		},
+		{
+			name: "success-without-labels",
+			doc:  `[{"targets": []}]`,
+		},
+		{
+			name:    "error-missing-targets",
+			doc:     `[{"labels": {}}]`,
+			wantErr: true,
+		},
+		{
+			name:    "error-label-name",
+			doc:     `[{"targets": ["a:1"], "labels": {"a-b": "c"}}]`,
+			wantErr: true,
+		},
+		{
+			name:    "error-label-value",
+			doc:     `[{"targets": ["a:1"], "labels": {"a": 1}}]`,
+			wantErr: true,
+		},
+		{
+			name:    "error-ready",
+			doc:     `[{"targets": ["a:1"], "labels": {"__meta_ready": "yes"}}]`,
+			wantErr: true,
+		},
+		{
+			name:    "error-duration",
+			doc:     `[{"targets": ["a:1"], "labels": {"__scrape_timeout__": "1.5s"}}]`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := schematest.Validate([]byte(Schema), []byte(tt.doc))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestManager_RunSchema(t *testing.T) {
+	tests := []struct {
+		name       string
+		profile    Profile
+		wantSchema string
+	}{
+		{
+			name:       "prometheus",
+			profile:    ProfilePrometheus,
+			wantSchema: SchemaID,
+		},
+		{
+			name:    "victoriametrics",
+			profile: ProfileVictoriaMetrics,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := filepath.Join(t.TempDir(), "output.json")
+			m := NewManager(WithTimeout(time.Minute), WithMetadata(true), WithProfile(tt.profile),
+				WithScrapeHints(ScrapeHints{"discovery.fakeLabeled": {Interval: 90 * time.Second, Timeout: 1500 * time.Millisecond}}))
+			m.Register(&fakeLabeled{}, output)
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			m.Run(ctx, time.Minute)
+
+			md, err := ReadMetadata(output)
+			if err != nil {
+				t.Fatalf("ReadMetadata() error = %v", err)
+			}
+			if md.Schema != tt.wantSchema {
+				t.Errorf("ReadMetadata() schema = %q, want %q", md.Schema, tt.wantSchema)
+			}
+			if md.Schema == "" {
+				return
+			}
+			data, err := ioutil.ReadFile(output)
+			if err != nil {
+				t.Fatalf("ReadFile() error = %v", err)
+			}
+			if err := schematest.Validate([]byte(Schema), data); err != nil {
+				t.Errorf("Manager.Run() wrote %s, which does not match the schema: %v", data, err)
+			}
+		})
+	}
+}
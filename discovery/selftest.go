@@ -0,0 +1,54 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Checker is an optional interface implemented by services that can verify
+// their credentials and API access with a minimal read, without running a full
+// discovery.
+type Checker interface {
+	// Check returns an error describing why the service cannot discover targets.
+	Check(ctx context.Context) error
+}
+
+// SelfTest runs Check for every registered service that implements Checker.
+// Wrapped services are unwrapped until a Checker is found. SelfTest returns an
+// error describing every failed check.
+func (m *Manager) SelfTest(ctx context.Context) error {
+	failures := []string{}
+	for _, reg := range m.registered() {
+		service := serviceName(reg.service)
+		c, ok := findChecker(reg.service)
+		if !ok {
+			m.logger.Printf("Self-test: %s: skipped; no check available", service)
+			continue
+		}
+		err := c.Check(ctx)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s (%s): %s", service, reg.output, err))
+			continue
+		}
+		m.logger.Printf("Self-test: %s (%s): OK", service, reg.output)
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("self-test failed:\n  %s", strings.Join(failures, "\n  "))
+	}
+	return nil
+}
+
+// findChecker returns the first Checker found by unwrapping the given service.
+func findChecker(s Service) (Checker, bool) {
+	for {
+		if c, ok := s.(Checker); ok {
+			return c, true
+		}
+		w, ok := s.(interface{ Unwrap() Service })
+		if !ok {
+			return nil, false
+		}
+		s = w.Unwrap()
+	}
+}
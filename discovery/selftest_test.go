@@ -0,0 +1,53 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+type fakeChecker struct {
+	fakeLiteral
+	err error
+}
+
+func (f *fakeChecker) Check(ctx context.Context) error {
+	return f.err
+}
+
+func TestManager_SelfTest(t *testing.T) {
+	tests := []struct {
+		name    string
+		service Service
+		wantErr bool
+	}{
+		{
+			name:    "success",
+			service: &fakeChecker{},
+		},
+		{
+			name:    "success-wrapped",
+			service: NewCache(&fakeChecker{}, time.Minute),
+		},
+		{
+			name:    "success-skipped-without-checker",
+			service: &fakeLiteral{},
+		},
+		{
+			name:    "failure",
+			service: NewCache(&fakeChecker{err: fmt.Errorf("permission denied")}, time.Minute),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManager(WithTimeout(time.Minute))
+			m.Register(tt.service, "output.json")
+			err := m.SelfTest(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Manager.SelfTest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,293 @@
+package discovery
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshotVersion identifies the format of snapshots written by Snapshot.
+const snapshotVersion = 1
+
+// snapshotState is the file name of the state within a snapshot.
+const snapshotState = "state.json"
+
+// snapshotSuffixes name the files of an output that are saved in a snapshot.
+var snapshotSuffixes = []string{"", ChecksumSuffix, MetadataSuffix, LifecycleSuffix}
+
+// snapshot is the in-memory state of a Manager.
+type snapshot struct {
+	Version int           `json:"version"`
+	Created time.Time     `json:"created"`
+	Outputs []outputState `json:"outputs"`
+}
+
+// outputState is the state of one registration.
+type outputState struct {
+	Output string `json:"output"`
+	Source string `json:"source"`
+
+	// Targets are the most recently written configs.
+	Targets []StaticConfig `json:"targets"`
+
+	// Outcomes are the results of recent passes, oldest first.
+	Outcomes    []bool    `json:"outcomes"`
+	LastSuccess time.Time `json:"last_success"`
+	LastError   string    `json:"last_error,omitempty"`
+
+	// Baseline are the target counts of recent successful passes, oldest first.
+	Baseline []int `json:"baseline"`
+
+	// Cache is the content of a Cache wrapping the service, if any.
+	Cache *cacheState `json:"cache,omitempty"`
+
+	// Files maps the suffix of every saved output file to its name within the
+	// snapshot.
+	Files map[string]string `json:"files,omitempty"`
+}
+
+// cacheState is the content of a Cache.
+type cacheState struct {
+	Targets []StaticConfig `json:"targets"`
+	Updated time.Time      `json:"updated"`
+}
+
+// Snapshot writes a gzip compressed tar archive to w with the output files of
+// every registered service, and the state of the Manager: recent results, last
+// success times, target count baselines, and the contents of caches. Restore
+// loads a snapshot on another host, so discovery moves without a cold start.
+func (m *Manager) Snapshot(w io.Writer) error {
+	m.mu.Lock()
+	snap := snapshot{Version: snapshotVersion, Created: m.clock().Now().UTC()}
+	writers := map[string]bool{}
+	for _, reg := range m.registrations {
+		writers[reg.output] = reg.writer != nil
+		snap.Outputs = append(snap.Outputs, outputState{
+			Output:      reg.output,
+			Source:      serviceName(reg.service),
+			Targets:     reg.last,
+			Outcomes:    ring(reg.history.outcomes, reg.history.next),
+			LastSuccess: reg.history.lastSuccess,
+			LastError:   reg.history.lastError,
+			Baseline:    ring(reg.baseline.counts, reg.baseline.next),
+			Cache:       findCache(reg.service).state(),
+		})
+	}
+	m.mu.Unlock()
+
+	files := map[string][]byte{}
+	for i := range snap.Outputs {
+		st := &snap.Outputs[i]
+		if writers[st.Output] {
+			continue
+		}
+		for _, suffix := range snapshotSuffixes {
+			data, err := ioutil.ReadFile(st.Output + suffix)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			name := fmt.Sprintf("outputs/%d/%s", i, filepath.Base(st.Output)+suffix)
+			if st.Files == nil {
+				st.Files = map[string]string{}
+			}
+			st.Files[suffix] = name
+			files[name] = data
+		}
+	}
+	state, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	err = writeTarFile(tw, snapshotState, state, snap.Created)
+	if err != nil {
+		return err
+	}
+	for _, st := range snap.Outputs {
+		for _, suffix := range snapshotSuffixes {
+			name, ok := st.Files[suffix]
+			if !ok {
+				continue
+			}
+			err = writeTarFile(tw, name, files[name], snap.Created)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// writeTarFile adds a file with the given name and content to tw.
+func writeTarFile(tw *tar.Writer, name string, data []byte, mod time.Time) error {
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: mod}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// Restore loads a snapshot written by Snapshot. The files and state of every
+// output in the snapshot are restored for the service registered for the same
+// output. Outputs without a registered service are skipped. Restore should be
+// called after registering services and before Run.
+func (m *Manager) Restore(r io.Reader) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("invalid snapshot: %w", err)
+	}
+	files := map[string][]byte{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("invalid snapshot: %w", err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return fmt.Errorf("invalid snapshot: %w", err)
+		}
+		files[hdr.Name] = data
+	}
+	data, ok := files[snapshotState]
+	if !ok {
+		return fmt.Errorf("invalid snapshot: missing %s", snapshotState)
+	}
+	snap := snapshot{}
+	if err = json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("invalid snapshot: %w", err)
+	}
+	if snap.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version: %d", snap.Version)
+	}
+
+	// Match the snapshot to registrations before changing any file.
+	regs := map[string]*registration{}
+	for _, reg := range m.registered() {
+		regs[reg.output] = reg
+	}
+	tx := newTransaction(m.tempDir)
+	var restored []outputState
+	for _, st := range snap.Outputs {
+		reg, ok := regs[st.Output]
+		if !ok {
+			m.logger.Printf("Warning: snapshot output %s is not registered", st.Output)
+			continue
+		}
+		if reg.writer == nil {
+			// Only the files of the output are written, whatever the names
+			// within the snapshot.
+			for _, suffix := range snapshotSuffixes {
+				name, ok := st.Files[suffix]
+				if !ok {
+					continue
+				}
+				content, ok := files[name]
+				if !ok {
+					tx.abort()
+					return fmt.Errorf("invalid snapshot: missing %s", name)
+				}
+				if err = tx.writeFile(st.Output+suffix, content); err != nil {
+					tx.abort()
+					return err
+				}
+			}
+		}
+		restored = append(restored, st)
+	}
+	if err = tx.commit(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, st := range restored {
+		reg := regs[st.Output]
+		reg.last = st.Targets
+		reg.digest = m.digest(reg, st.Targets)
+		reg.history = history{lastSuccess: st.LastSuccess, lastError: st.LastError}
+		for _, ok := range lastN(st.Outcomes, healthWindow) {
+			reg.history.outcomes = append(reg.history.outcomes, ok)
+		}
+		reg.baseline = baseline{}
+		for _, n := range lastN(st.Baseline, baselineWindow) {
+			reg.baseline.add(n)
+		}
+		if c := findCache(reg.service); c != nil && st.Cache != nil {
+			c.restore(st.Cache)
+		}
+	}
+	m.logger.Printf("Restored %d outputs from a snapshot created at %s", len(restored), snap.Created)
+	return nil
+}
+
+// ring returns the values of a ring buffer whose oldest value is at next,
+// oldest first.
+func ring[T any](values []T, next int) []T {
+	if next <= 0 || next >= len(values) {
+		return append([]T{}, values...)
+	}
+	return append(append([]T{}, values[next:]...), values[:next]...)
+}
+
+// lastN returns the last n values.
+func lastN[T any](values []T, n int) []T {
+	if len(values) > n {
+		return values[len(values)-n:]
+	}
+	return values
+}
+
+// findCache returns the first Cache in the chain of wrappers of s, or nil.
+func findCache(s Service) *Cache {
+	for {
+		if c, ok := s.(*Cache); ok {
+			return c
+		}
+		w, ok := s.(interface{ Unwrap() Service })
+		if !ok {
+			return nil
+		}
+		s = w.Unwrap()
+	}
+}
+
+// state returns the content of the cache, or nil if c is nil or empty.
+func (c *Cache) state() *cacheState {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.valid {
+		return nil
+	}
+	return &cacheState{Targets: c.configs, Updated: c.updated}
+}
+
+// restore replaces the content of the cache.
+func (c *Cache) restore(s *cacheState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.configs = s.Targets
+	c.updated = s.Updated
+	c.valid = true
+}
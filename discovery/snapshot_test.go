@@ -0,0 +1,171 @@
+package discovery
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestManager_SnapshotRestore(t *testing.T) {
+	dir := t.TempDir()
+	output := filepath.Join(dir, "output.json")
+	clock := newFakeClock()
+	m := NewManager(WithTimeout(time.Minute))
+	m.clk = clock
+	m.writeChecksum = true
+	m.Register(NewCache(&fakeCounter{}, time.Hour), output)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m.Run(ctx, time.Minute)
+	want, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err = m.Snapshot(buf); err != nil {
+		t.Fatalf("Manager.Snapshot() error = %v", err)
+	}
+
+	// Restore on a "new host" without any output files.
+	os.Remove(output)
+	os.Remove(output + ChecksumSuffix)
+	counter := &fakeCounter{}
+	restored := NewManager(WithTimeout(time.Minute))
+	restored.clk = clock
+	restored.Register(NewCache(counter, time.Hour), output)
+	restored.Register(&fakeCounter{}, filepath.Join(dir, "other.json"))
+	if err = restored.Restore(buf); err != nil {
+		t.Fatalf("Manager.Restore() error = %v", err)
+	}
+	got, err := ioutil.ReadFile(output)
+	if err != nil || !bytes.Equal(got, want) {
+		t.Errorf("Manager.Restore() output = %q, %v; want %q", got, err, want)
+	}
+	if err = VerifyChecksum(output); err != nil {
+		t.Errorf("Manager.Restore() checksum error = %v", err)
+	}
+	status := restored.Status()
+	if status[0].Health != HealthOK || !status[0].LastSuccess.Equal(clock.Now()) || status[0].Targets != 1 {
+		t.Errorf("Manager.Restore() status = %#v, want ok with 1 target", status[0])
+	}
+	if status[1].Health != HealthUnknown {
+		t.Errorf("Manager.Restore() changed an output not in the snapshot: %#v", status[1])
+	}
+	// The restored cache is used without discovery.
+	configs, err := restored.registered()[0].service.Discover(context.Background())
+	if err != nil || len(configs) != 1 || counter.calls != 0 {
+		t.Errorf("Cache.Discover() after restore = %v, %v after %d calls, want 1 config without calls", configs, err, counter.calls)
+	}
+}
+
+func TestManager_SnapshotRestoreLifecycle(t *testing.T) {
+	dir := t.TempDir()
+	output := filepath.Join(dir, "output.json")
+	m := NewManager(WithTimeout(time.Minute), WithLifecycle(true))
+	m.Register(&fakeDraining{}, output)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m.Run(ctx, time.Minute)
+	want, err := ReadLifecycles(output)
+	if err != nil {
+		t.Fatalf("ReadLifecycles() error = %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err = m.Snapshot(buf); err != nil {
+		t.Fatalf("Manager.Snapshot() error = %v", err)
+	}
+	os.Remove(output)
+	os.Remove(output + LifecycleSuffix)
+	restored := NewManager(WithTimeout(time.Minute), WithLifecycle(true))
+	restored.Register(&fakeDraining{}, output)
+	if err = restored.Restore(buf); err != nil {
+		t.Fatalf("Manager.Restore() error = %v", err)
+	}
+	got, err := ReadLifecycles(output)
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadLifecycles() after restore = %#v, %v; want %#v", got, err, want)
+	}
+}
+
+func TestManager_RestoreErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		raw   string
+	}{
+		{
+			name: "failure-not-gzip",
+			raw:  "not a snapshot",
+		},
+		{
+			name:  "failure-missing-state",
+			files: map[string]string{"other.json": "{}"},
+		},
+		{
+			name:  "failure-invalid-state",
+			files: map[string]string{snapshotState: "not json"},
+		},
+		{
+			name:  "failure-unsupported-version",
+			files: map[string]string{snapshotState: `{"version": 99}`},
+		},
+		{
+			name: "failure-missing-file",
+			files: map[string]string{snapshotState: `{"version": 1, "outputs": [
+				{"output": "output.json", "files": {"": "outputs/0/output.json"}}]}`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManager(WithTimeout(time.Minute))
+			m.Register(&fakeCounter{}, "output.json")
+			buf := bytes.NewBufferString(tt.raw)
+			if tt.files != nil {
+				buf = &bytes.Buffer{}
+				gz := gzip.NewWriter(buf)
+				tw := tar.NewWriter(gz)
+				for name, content := range tt.files {
+					if err := writeTarFile(tw, name, []byte(content), time.Now()); err != nil {
+						t.Fatal(err)
+					}
+				}
+				tw.Close()
+				gz.Close()
+			}
+			err := m.Restore(buf)
+			if err == nil || !strings.Contains(err.Error(), "snapshot") {
+				t.Errorf("Manager.Restore() error = %v, want snapshot error", err)
+			}
+		})
+	}
+}
+
+func Test_ring(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []int
+		next   int
+		want   []int
+	}{
+		{name: "success-not-full", values: []int{1, 2}, next: 0, want: []int{1, 2}},
+		{name: "success-wrapped", values: []int{4, 5, 3}, next: 2, want: []int{3, 4, 5}},
+		{name: "success-empty", values: nil, next: 0, want: []int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ring(tt.values, tt.next); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ring() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
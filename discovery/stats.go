@@ -0,0 +1,104 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type statsKey struct{}
+
+// passStats counts the work done by a service during one discovery pass.
+type passStats struct {
+	mu       sync.Mutex
+	apiCalls int
+	scanned  map[string]int
+}
+
+// withStats returns a copy of ctx that collects CountAPICall and CountScanned
+// calls in s.
+func withStats(ctx context.Context, s *passStats) context.Context {
+	return context.WithValue(ctx, statsKey{}, s)
+}
+
+// statsFrom returns the passStats of ctx, or nil if ctx was not created by the
+// Manager.
+func statsFrom(ctx context.Context) *passStats {
+	if ctx == nil {
+		return nil
+	}
+	s, _ := ctx.Value(statsKey{}).(*passStats)
+	return s
+}
+
+// CountAPICall counts one upstream API request made during discovery, if ctx
+// was created by the Manager. Otherwise, CountAPICall does nothing. Requests
+// made with clients from the apilimit package are counted automatically.
+func CountAPICall(ctx context.Context) {
+	s := statsFrom(ctx)
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apiCalls++
+}
+
+// CountScanned adds n to the number of upstream objects of the given kind, e.g.
+// "services" or "instances", read during discovery, if ctx was created by the
+// Manager. Otherwise, CountScanned does nothing.
+func CountScanned(ctx context.Context, kind string, n int) {
+	s := statsFrom(ctx)
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.scanned == nil {
+		s.scanned = map[string]int{}
+	}
+	s.scanned[kind] += n
+}
+
+// summary formats the statistics of a pass as space separated key=value pairs,
+// e.g.
+//
+//	duration=1.5s api_calls=12 scanned_services=3 targets=4 changed=1 added=[a]
+//
+// The target counts are only included when diff is not nil, i.e. when the pass
+// succeeded. A nil passStats has no counts.
+func (s *passStats) summary(d time.Duration, configs []StaticConfig, diff *Diff) string {
+	if s == nil {
+		s = &passStats{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fields := []string{
+		"duration=" + d.Round(time.Millisecond).String(),
+		fmt.Sprintf("api_calls=%d", s.apiCalls),
+	}
+	kinds := []string{}
+	for kind := range s.scanned {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fields = append(fields, fmt.Sprintf("scanned_%s=%d", kind, s.scanned[kind]))
+	}
+	if diff == nil {
+		return strings.Join(fields, " ")
+	}
+	fields = append(fields,
+		fmt.Sprintf("targets=%d", countTargets(configs)),
+		fmt.Sprintf("changed=%d", len(diff.Added)+len(diff.Removed)))
+	if len(diff.Added) > 0 {
+		fields = append(fields, "added="+summarize(diff.Added))
+	}
+	if len(diff.Removed) > 0 {
+		fields = append(fields, "removed="+summarize(diff.Removed))
+	}
+	return strings.Join(fields, " ")
+}
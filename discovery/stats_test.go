@@ -0,0 +1,124 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPassStats_summary(t *testing.T) {
+	tests := []struct {
+		name    string
+		stats   *passStats
+		configs []StaticConfig
+		diff    *Diff
+		want    string
+	}{
+		{
+			name:  "failed",
+			stats: &passStats{apiCalls: 3, scanned: map[string]int{"zones": 2, "clusters": 1}},
+			want:  "duration=1.5s api_calls=3 scanned_clusters=1 scanned_zones=2",
+		},
+		{
+			name:    "changed",
+			stats:   &passStats{apiCalls: 1},
+			configs: []StaticConfig{{Targets: []string{"a", "b"}}},
+			diff:    &Diff{Added: []string{"a"}, Removed: []string{"c"}},
+			want:    "duration=1.5s api_calls=1 targets=2 changed=2 added=[a] removed=[c]",
+		},
+		{
+			name:    "unchanged-nil-stats",
+			configs: []StaticConfig{{Targets: []string{"a"}}},
+			diff:    &Diff{},
+			want:    "duration=1.5s api_calls=0 targets=1 changed=0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.stats.summary(1500*time.Millisecond, tt.configs, tt.diff); got != tt.want {
+				t.Errorf("passStats.summary() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeScanner counts API calls and scanned objects.
+type fakeScanner struct {
+	err error
+}
+
+func (f *fakeScanner) Discover(ctx context.Context) ([]StaticConfig, error) {
+	CountAPICall(ctx)
+	CountAPICall(ctx)
+	CountScanned(ctx, "services", 4)
+	return []StaticConfig{{Targets: []string{"a"}}}, f.err
+}
+
+func TestManager_discoverStats(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		unchanged bool
+		want      string
+		wantErr   bool
+	}{
+		{
+			name: "success",
+			want: "discovery.fakeScanner: pass duration=0s api_calls=2 scanned_services=4 targets=1 changed=1 added=[a]",
+		},
+		{
+			name:      "success-unchanged",
+			unchanged: true,
+			want:      "discovery.fakeScanner: pass duration=0s api_calls=2 scanned_services=4 targets=1 changed=0",
+		},
+		{
+			name:    "failure",
+			err:     fmt.Errorf("failed"),
+			want:    "discovery.fakeScanner: failed pass duration=0s api_calls=2 scanned_services=4",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			m := NewManager(WithTimeout(time.Minute), WithLogUnchanged(tt.unchanged))
+			m.logger = log.New(buf, "", 0)
+			m.clk = newFakeClock()
+			m.Register(&fakeScanner{err: tt.err}, filepath.Join(t.TempDir(), "output.json"))
+			if tt.unchanged {
+				// The second pass finds the same target.
+				m.discoverAll(context.Background())
+			}
+			if ok := m.discoverAll(context.Background()); ok == tt.wantErr {
+				t.Errorf("Manager.discoverAll() = %v, want %v", ok, !tt.wantErr)
+			}
+			if !strings.Contains(buf.String(), tt.want+"\n") {
+				t.Errorf("Manager.discoverAll() logged %q, want line %q", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestCountScanned(t *testing.T) {
+	// Counting without a Manager context does nothing.
+	CountAPICall(context.Background())
+	CountScanned(context.Background(), "services", 1)
+}
+
+func TestManager_discoverUnchanged(t *testing.T) {
+	buf := &bytes.Buffer{}
+	m := NewManager(WithTimeout(time.Minute))
+	m.logger = log.New(buf, "", 0)
+	m.Register(&fakeScanner{}, filepath.Join(t.TempDir(), "output.json"))
+	m.discoverAll(context.Background())
+	m.discoverAll(context.Background())
+	// Only the first pass adds a target.
+	if n := strings.Count(buf.String(), ": pass "); n != 1 {
+		t.Errorf("Manager.discoverAll() logged %d passes, want 1:\n%s", n, buf.String())
+	}
+}
@@ -0,0 +1,196 @@
+package discovery
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/m-lab/gcp-service-discovery/metrics"
+)
+
+// Health summarizes the recent discovery results of a service.
+type Health string
+
+// Health states, from best to worst.
+const (
+	// HealthUnknown means the service has not run discovery yet.
+	HealthUnknown Health = "unknown"
+	// HealthOK means every recent pass succeeded.
+	HealthOK Health = "ok"
+	// HealthDegraded means some recent passes failed.
+	HealthDegraded Health = "degraded"
+	// HealthFailing means most recent passes failed, or the output is stale.
+	HealthFailing Health = "failing"
+)
+
+var healthStates = []Health{HealthUnknown, HealthOK, HealthDegraded, HealthFailing}
+
+const (
+	// healthWindow is the number of recent passes used to compute Health.
+	healthWindow = 10
+
+	// staleIntervals is the number of Run intervals without a successful pass
+	// after which the output is considered stale.
+	staleIntervals = 3
+)
+
+var (
+	// sourceHealth reports the current Health of every output. The gauge is 1
+	// for the current health state and 0 for all others.
+	//
+	// Provides metrics:
+	//   gcp_manager_source_health{output="/targets/aeflex.json", health="ok"}
+	// Usage example:
+	//   sourceHealth.WithLabelValues("/targets/aeflex.json", "ok").Set(1)
+	sourceHealth = metrics.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gcp_manager_source_health",
+			Help: "Current health state of each output.",
+		},
+		[]string{"output", "health"},
+	)
+)
+
+// Status describes the recent discovery results of a registered service.
+type Status struct {
+	// Source is the name of the service.
+	Source string `json:"source"`
+
+	// Output is the output file of the service.
+	Output string `json:"output"`
+
+	// Health summarizes the recent discovery results.
+	Health Health `json:"health"`
+
+	// SuccessRatio is the fraction of recent passes that succeeded.
+	SuccessRatio float64 `json:"success_ratio"`
+
+	// LastSuccess is the time of the most recent successful pass.
+	LastSuccess time.Time `json:"last_success"`
+
+	// LastError is the error of the most recent failed pass, if any.
+	LastError string `json:"last_error,omitempty"`
+
+	// Targets is the number of targets in the output.
+	Targets int `json:"targets"`
+
+	// Paused is true if discovery of the service is paused by Pause.
+	Paused bool `json:"paused,omitempty"`
+
+	// BestEffort is true if failures of the service do not fail discovery
+	// passes, as set by WithBestEffort.
+	BestEffort bool `json:"best_effort,omitempty"`
+
+	// Owner describes who is responsible for the source, if known.
+	Owner *Owner `json:"owner,omitempty"`
+}
+
+// history records the outcomes of recent passes for a registration.
+type history struct {
+	// outcomes is a ring of the most recent pass results.
+	outcomes    []bool
+	next        int
+	lastSuccess time.Time
+	lastError   string
+}
+
+// add records the result of one pass.
+func (h *history) add(err error, now time.Time) {
+	if len(h.outcomes) < healthWindow {
+		h.outcomes = append(h.outcomes, err == nil)
+	} else {
+		h.outcomes[h.next] = err == nil
+		h.next = (h.next + 1) % healthWindow
+	}
+	if err != nil {
+		h.lastError = err.Error()
+		return
+	}
+	h.lastSuccess = now
+}
+
+// ratio returns the fraction of recorded passes that succeeded.
+func (h *history) ratio() float64 {
+	if len(h.outcomes) == 0 {
+		return 0
+	}
+	n := 0
+	for _, ok := range h.outcomes {
+		if ok {
+			n++
+		}
+	}
+	return float64(n) / float64(len(h.outcomes))
+}
+
+// health computes the Health of the recorded passes. When interval is not
+// zero, outputs not updated within staleIntervals are failing.
+func (h *history) health(now time.Time, interval time.Duration) Health {
+	if len(h.outcomes) == 0 {
+		return HealthUnknown
+	}
+	stale := interval > 0 && now.Sub(h.lastSuccess) > staleIntervals*interval
+	switch r := h.ratio(); {
+	case r < 0.5 || stale:
+		return HealthFailing
+	case r < 1:
+		return HealthDegraded
+	}
+	return HealthOK
+}
+
+// record saves the result of a pass for reg and updates the health metric.
+func (m *Manager) record(reg *registration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.clock().Now()
+	reg.history.add(err, now)
+	current := reg.history.health(now, m.staleInterval(reg))
+	for _, h := range healthStates {
+		v := 0.0
+		if h == current {
+			v = 1
+		}
+		sourceHealth.WithLabelValues(reg.output, string(h)).Set(v)
+	}
+}
+
+// Status returns the Status of every registered service.
+func (m *Manager) Status() []Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.clock().Now()
+	result := []Status{}
+	for _, reg := range m.registrations {
+		s := Status{
+			Source:       serviceName(reg.service),
+			Output:       reg.output,
+			Health:       reg.history.health(now, m.staleInterval(reg)),
+			SuccessRatio: reg.history.ratio(),
+			LastSuccess:  reg.history.lastSuccess,
+			LastError:    reg.history.lastError,
+			Targets:      countTargets(reg.last),
+			Paused:       m.isPaused(reg),
+			BestEffort:   !m.critical(reg),
+		}
+		if owner, ok := m.owners.lookup(s.Source, reg.output); ok {
+			s.Owner = &owner
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+// Targets returns the targets most recently written to the output, after the
+// Profile is applied. Targets returns false if the output is not registered or
+// no targets have been written yet.
+func (m *Manager) Targets(output string) ([]StaticConfig, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, reg := range m.registrations {
+		if reg.output == output && reg.last != nil {
+			return m.profileOf(reg).apply(reg.last), true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,104 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistory_health(t *testing.T) {
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	fail := errors.New("fake error")
+	tests := []struct {
+		name     string
+		results  []error
+		age      time.Duration
+		interval time.Duration
+		want     Health
+	}{
+		{
+			name: "unknown",
+			want: HealthUnknown,
+		},
+		{
+			name:    "ok",
+			results: []error{nil, nil, nil},
+			want:    HealthOK,
+		},
+		{
+			name:    "degraded",
+			results: []error{nil, fail, nil},
+			want:    HealthDegraded,
+		},
+		{
+			name:    "failing",
+			results: []error{nil, fail, fail},
+			want:    HealthFailing,
+		},
+		{
+			name:     "failing-stale",
+			results:  []error{nil},
+			age:      time.Hour,
+			interval: time.Minute,
+			want:     HealthFailing,
+		},
+		{
+			name:    "ok-after-window",
+			results: []error{fail, fail, fail, fail, fail, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil},
+			want:    HealthOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &history{}
+			for _, err := range tt.results {
+				h.add(err, now)
+			}
+			if got := h.health(now.Add(tt.age), tt.interval); got != tt.want {
+				t.Errorf("history.health() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestManager_Status(t *testing.T) {
+	m := NewManager(WithTimeout(time.Minute))
+	m.Register(&fakeLiteral{}, filepath.Join(t.TempDir(), "a.json"))
+	m.Register(&fakeFailure{}, filepath.Join(t.TempDir(), "b.json"))
+	m.discoverAll(context.Background())
+
+	status := m.Status()
+	if len(status) != 2 {
+		t.Fatalf("Manager.Status() returned %d statuses, want 2", len(status))
+	}
+	if status[0].Health != HealthOK || status[0].Targets != 1 || status[0].LastSuccess.IsZero() {
+		t.Errorf("Manager.Status()[0] = %#v, want ok with 1 target", status[0])
+	}
+	if status[1].Health != HealthFailing || status[1].LastError == "" {
+		t.Errorf("Manager.Status()[1] = %#v, want failing with an error", status[1])
+	}
+}
+
+func TestManager_Targets(t *testing.T) {
+	dir := t.TempDir()
+	written := filepath.Join(dir, "written.json")
+	m := NewManager(WithTimeout(time.Minute))
+	m.profile = ProfileVictoriaMetrics
+	m.Register(&fakeLabels{labels: map[string]string{"__aef_service": "etl"}}, written)
+	m.Register(&fakeFailure{}, filepath.Join(dir, "failed.json"))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m.Run(ctx, time.Minute)
+
+	got, ok := m.Targets(written)
+	if !ok || len(got) != 1 || got[0].Labels["__aef_service"] != "" || len(got[0].Labels) != 1 {
+		t.Errorf("Manager.Targets() = %v, %v; want targets after the profile", got, ok)
+	}
+	for _, output := range []string{filepath.Join(dir, "failed.json"), "unknown.json"} {
+		if got, ok = m.Targets(output); ok {
+			t.Errorf("Manager.Targets(%q) = %v, true; want false", output, got)
+		}
+	}
+}
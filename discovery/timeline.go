@@ -0,0 +1,194 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// timelineEntry is the set of targets written at a time.
+type timelineEntry struct {
+	Time    time.Time `json:"time"`
+	Targets []string  `json:"targets"`
+}
+
+// timeline records the target sets of an output, oldest first. A new entry is
+// only added when the targets change, so the size of a timeline limits the
+// number of changes it remembers, not the number of passes.
+type timeline struct {
+	entries []timelineEntry
+}
+
+// TimelineDiff describes the targets of an output added and removed between
+// two times.
+type TimelineDiff struct {
+	Source string `json:"source"`
+	Output string `json:"output"`
+
+	// From and To are the times of the target sets that were compared, i.e.
+	// the most recent changes before the requested times.
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+
+	Diff
+}
+
+// timelineOf returns the timeline of reg, and loads it from the timeline
+// directory when first used. The caller must hold m.mu.
+func (m *Manager) timelineOf(reg *registration) *timeline {
+	if reg.timeline != nil {
+		return reg.timeline
+	}
+	reg.timeline = &timeline{}
+	if m.timelineDir == "" {
+		return reg.timeline
+	}
+	data, err := os.ReadFile(m.timelineFile(reg.output))
+	if os.IsNotExist(err) {
+		return reg.timeline
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &reg.timeline.entries)
+	}
+	if err != nil {
+		m.logger.Printf("Error: %s: cannot load the target timeline: %s", reg.output, err)
+	}
+	return reg.timeline
+}
+
+// timelineFile returns the name of the file that saves the timeline of output.
+func (m *Manager) timelineFile(output string) string {
+	return filepath.Join(m.timelineDir, url.PathEscape(output)+".json")
+}
+
+// recordTimeline adds the targets of configs written at the given time to the
+// timeline of reg, if they changed, and saves the timeline to the timeline
+// directory. The caller must hold m.mu.
+func (m *Manager) recordTimeline(reg *registration, configs []StaticConfig, now time.Time) {
+	if m.timelineSize <= 0 {
+		return
+	}
+	tl := m.timelineOf(reg)
+	targets := []string{}
+	for t := range targetSet(configs) {
+		targets = append(targets, t)
+	}
+	sort.Strings(targets)
+	if n := len(tl.entries); n > 0 && equalStrings(tl.entries[n-1].Targets, targets) {
+		return
+	}
+	tl.entries = lastN(append(tl.entries, timelineEntry{Time: now, Targets: targets}), m.timelineSize)
+	if m.timelineDir == "" {
+		return
+	}
+	if err := m.saveTimeline(reg.output, tl); err != nil {
+		m.logger.Printf("Error: %s: cannot save the target timeline: %s", reg.output, err)
+	}
+}
+
+// saveTimeline atomically replaces the timeline file of output.
+func (m *Manager) saveTimeline(output string, tl *timeline) error {
+	data, err := json.Marshal(tl.entries)
+	if err != nil {
+		return err
+	}
+	f, err := createAtomic(m.timelineFile(output), "")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = f.Write(data); err != nil {
+		return fmt.Errorf("cannot write %s: %w", f.Name(), err)
+	}
+	if err = f.sync(); err != nil {
+		return err
+	}
+	return f.rename()
+}
+
+// at returns the index of the last entry written at or before t, or -1.
+func (tl *timeline) at(t time.Time) int {
+	return sort.Search(len(tl.entries), func(i int) bool {
+		return tl.entries[i].Time.After(t)
+	}) - 1
+}
+
+// Changes returns the targets added and removed between the given times for
+// every output of the named source, or of every source for AllServices. A
+// source is named by its service name, e.g. "gke.Service", or by its output.
+// When from precedes the oldest change remembered, the diff starts at the
+// oldest change, as reported by TimelineDiff.From. Outputs without changes
+// before to are omitted. Changes requires WithTimeline.
+func (m *Manager) Changes(source string, from, to time.Time) []TimelineDiff {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := []TimelineDiff{}
+	if m.timelineSize <= 0 {
+		return result
+	}
+	for _, reg := range m.registrations {
+		name := serviceName(reg.service)
+		if source != AllServices && source != name && source != reg.output {
+			continue
+		}
+		tl := m.timelineOf(reg)
+		j := tl.at(to)
+		if j < 0 {
+			continue
+		}
+		i := tl.at(from)
+		if i < 0 {
+			i = 0
+		}
+		if i > j {
+			i = j
+		}
+		before, after := tl.entries[i], tl.entries[j]
+		result = append(result, TimelineDiff{
+			Source: name,
+			Output: reg.output,
+			From:   before.Time,
+			To:     after.Time,
+			Diff:   diffSorted(before.Targets, after.Targets),
+		})
+	}
+	return result
+}
+
+// diffSorted returns the targets added and removed between the sorted lists of
+// targets prev and cur.
+func diffSorted(prev, cur []string) Diff {
+	d := Diff{Added: []string{}, Removed: []string{}}
+	i, j := 0, 0
+	for i < len(prev) || j < len(cur) {
+		switch {
+		case j == len(cur) || (i < len(prev) && prev[i] < cur[j]):
+			d.Removed = append(d.Removed, prev[i])
+			i++
+		case i == len(prev) || cur[j] < prev[i]:
+			d.Added = append(d.Added, cur[j])
+			j++
+		default:
+			i++
+			j++
+		}
+	}
+	return d
+}
+
+// equalStrings returns true if a and b have the same elements in order.
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
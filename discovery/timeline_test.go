@@ -0,0 +1,133 @@
+package discovery
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func targetConfigs(targets ...string) []StaticConfig {
+	return []StaticConfig{{Targets: targets}}
+}
+
+func TestManager_Changes(t *testing.T) {
+	clock := newFakeClock()
+	start := clock.Now()
+	dir := t.TempDir()
+	output := filepath.Join(t.TempDir(), "output.json")
+	m := NewManager(WithTimeout(time.Minute), WithClock(clock), WithTimeline(3, dir))
+	m.Register(&fakeLiteral{}, output)
+	reg := m.registrations[0]
+	for _, targets := range [][]string{
+		{"a:1"},               // start
+		{"a:1"},               // +1m, unchanged
+		{"a:1", "b:1"},        // +2m
+		{"b:1", "c:1"},        // +3m
+		{"b:1", "c:1", "d:1"}, // +4m
+	} {
+		err := m.commit(context.Background(), &result{reg: reg, service: "fake", configs: targetConfigs(targets...)})
+		if err != nil {
+			t.Fatalf("Manager.commit() error = %v", err)
+		}
+		clock.Advance(time.Minute)
+	}
+
+	tests := []struct {
+		name   string
+		source string
+		from   time.Time
+		to     time.Time
+		want   []TimelineDiff
+	}{
+		{
+			name:   "between-changes",
+			source: "discovery.fakeLiteral",
+			from:   start.Add(2*time.Minute + time.Second),
+			to:     start.Add(10 * time.Minute),
+			want: []TimelineDiff{{
+				Source: "discovery.fakeLiteral",
+				Output: output,
+				From:   start.Add(2 * time.Minute),
+				To:     start.Add(4 * time.Minute),
+				Diff:   Diff{Added: []string{"c:1", "d:1"}, Removed: []string{"a:1"}},
+			}},
+		},
+		{
+			name:   "before-oldest-change",
+			source: output,
+			from:   start,
+			to:     start.Add(3 * time.Minute),
+			want: []TimelineDiff{{
+				Source: "discovery.fakeLiteral",
+				Output: output,
+				From:   start.Add(2 * time.Minute),
+				To:     start.Add(3 * time.Minute),
+				Diff:   Diff{Added: []string{"c:1"}, Removed: []string{"a:1"}},
+			}},
+		},
+		{
+			name:   "unchanged",
+			source: AllServices,
+			from:   start.Add(4 * time.Minute),
+			to:     start.Add(5 * time.Minute),
+			want: []TimelineDiff{{
+				Source: "discovery.fakeLiteral",
+				Output: output,
+				From:   start.Add(4 * time.Minute),
+				To:     start.Add(4 * time.Minute),
+				Diff:   Diff{Added: []string{}, Removed: []string{}},
+			}},
+		},
+		{
+			name:   "before-history",
+			source: AllServices,
+			from:   start.Add(-time.Hour),
+			to:     start.Add(time.Minute),
+			want:   []TimelineDiff{},
+		},
+		{
+			name:   "unknown-source",
+			source: "gke.Service",
+			from:   start,
+			to:     start.Add(time.Hour),
+			want:   []TimelineDiff{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := m.Changes(tt.source, tt.from, tt.to)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Manager.Changes() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	// A new Manager loads the saved changes.
+	m2 := NewManager(WithTimeout(time.Minute), WithTimeline(3, dir))
+	m2.Register(&fakeLiteral{}, output)
+	got := m2.Changes(AllServices, start, start.Add(time.Hour))
+	if len(got) != 1 || !reflect.DeepEqual(got[0].Diff, Diff{Added: []string{"c:1", "d:1"}, Removed: []string{"a:1"}}) {
+		t.Errorf("Manager.Changes() after restart = %+v, want the saved changes", got)
+	}
+}
+
+func TestManager_ChangesDisabled(t *testing.T) {
+	m := NewManager(WithTimeout(time.Minute))
+	m.Register(&fakeLiteral{}, filepath.Join(t.TempDir(), "output.json"))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m.Run(ctx, time.Minute)
+	if got := m.Changes(AllServices, time.Time{}, time.Now()); len(got) != 0 {
+		t.Errorf("Manager.Changes() = %v, want no changes", got)
+	}
+}
+
+func Test_diffSorted(t *testing.T) {
+	got := diffSorted([]string{"a", "c", "e"}, []string{"b", "c", "d", "f"})
+	want := Diff{Added: []string{"b", "d", "f"}, Removed: []string{"a", "e"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diffSorted() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,168 @@
+package discovery
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// transaction atomically replaces a set of files. Every file is first written
+// to a temporary file. Only after all temporary files are written and synced
+// does commit rename them into place. If any rename fails, the files already
+// replaced are restored, so readers never observe a partially updated set.
+type transaction struct {
+	tempDir string
+
+	mu    sync.Mutex
+	files []*atomicFile
+}
+
+// newTransaction creates a transaction that writes temporary files to tempDir.
+// See createAtomic.
+func newTransaction(tempDir string) *transaction {
+	return &transaction{tempDir: tempDir}
+}
+
+// create returns a new temporary file that replaces filename on commit. create
+// is safe for concurrent use.
+func (t *transaction) create(filename string) (*atomicFile, error) {
+	f, err := createAtomic(filename, t.tempDir)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.files = append(t.files, f)
+	return f, nil
+}
+
+// writeFile stages data to replace filename on commit.
+func (t *transaction) writeFile(filename string, data []byte) error {
+	f, err := t.create(filename)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err != nil {
+		return fmt.Errorf("cannot write %s: %w", f.Name(), err)
+	}
+	return nil
+}
+
+// commit replaces every staged file. On error, the previous files are left in
+// place, or restored.
+func (t *transaction) commit() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer t.abort()
+
+	for _, f := range t.files {
+		err := f.sync()
+		if err != nil {
+			return err
+		}
+	}
+	backups := make([]string, len(t.files))
+	for i, f := range t.files {
+		b, err := backup(f.name)
+		if err != nil {
+			removeAll(backups)
+			return err
+		}
+		backups[i] = b
+	}
+	for i, f := range t.files {
+		err := f.rename()
+		if err != nil {
+			t.rollback(backups, i)
+			removeAll(backups)
+			return err
+		}
+	}
+	for _, f := range t.files {
+		syncDir(filepath.Dir(f.name))
+	}
+	removeAll(backups)
+	return nil
+}
+
+// rollback restores the previous contents of the first n staged files, which
+// were already renamed into place.
+func (t *transaction) rollback(backups []string, n int) {
+	for i := n - 1; i >= 0; i-- {
+		var err error
+		if backups[i] == "" {
+			// The file did not exist before the transaction.
+			err = os.Remove(t.files[i].name)
+		} else {
+			err = os.Rename(backups[i], t.files[i].name)
+			backups[i] = ""
+		}
+		if err != nil {
+			log.Printf("Failed to roll back %s: %s", t.files[i].name, err)
+		}
+	}
+}
+
+// abort removes all uncommitted temporary files.
+func (t *transaction) abort() {
+	for _, f := range t.files {
+		f.Close()
+	}
+}
+
+// backup preserves the current contents of filename so it can be restored by
+// rollback, and returns the name of the backup file. backup returns an empty
+// name if filename does not exist.
+func backup(filename string) (string, error) {
+	_, err := os.Lstat(filename)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	name := filepath.Join(filepath.Dir(filename), "."+filepath.Base(filename)+".bak")
+	os.Remove(name)
+	if os.Link(filename, name) == nil {
+		return name, nil
+	}
+	// Not all filesystems support hard links.
+	err = copyFile(filename, name)
+	if err != nil {
+		return "", fmt.Errorf("cannot back up %s: %w", filename, err)
+	}
+	return name, nil
+}
+
+// copyFile copies the contents of src to a new file named dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// removeAll removes the named files, ignoring empty names.
+func removeAll(names []string) {
+	for _, name := range names {
+		if name != "" {
+			os.Remove(name)
+		}
+	}
+}
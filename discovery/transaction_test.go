@@ -0,0 +1,108 @@
+package discovery
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTransaction_commit(t *testing.T) {
+	tests := []struct {
+		name    string
+		tempDir func(dir string) string
+		wantErr bool
+	}{
+		{
+			name:    "success-output-dir",
+			tempDir: func(dir string) string { return "" },
+		},
+		{
+			name:    "success-temp-dir",
+			tempDir: func(dir string) string { return filepath.Join(dir, "tmp") },
+		},
+		{
+			name:    "error-missing-temp-dir",
+			tempDir: func(dir string) string { return filepath.Join(dir, "missing") },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			outDir := filepath.Join(dir, "out")
+			for _, d := range []string{outDir, filepath.Join(dir, "tmp")} {
+				if err := os.Mkdir(d, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			a := filepath.Join(outDir, "a.json")
+			b := filepath.Join(outDir, "b.json")
+			ioutil.WriteFile(a, []byte("old"), 0644)
+
+			tx := newTransaction(tt.tempDir(dir))
+			err := tx.writeFile(a, []byte("new-a"))
+			if err == nil {
+				err = tx.writeFile(b, []byte("new-b"))
+			}
+			if err == nil {
+				err = tx.commit()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("transaction.commit() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			for filename, want := range map[string]string{a: "new-a", b: "new-b"} {
+				data, err := ioutil.ReadFile(filename)
+				if err != nil || string(data) != want {
+					t.Errorf("transaction.commit() wrote %q, %v; want %q", data, err, want)
+				}
+			}
+			// No temporary or backup files should remain.
+			for _, d := range []string{outDir, filepath.Join(dir, "tmp")} {
+				files, _ := ioutil.ReadDir(d)
+				for _, f := range files {
+					if f.Name() != "a.json" && f.Name() != "b.json" {
+						t.Errorf("transaction.commit() left file %s", f.Name())
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestTransaction_commitRollback(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.json")
+	b := filepath.Join(dir, "b.json")
+	c := filepath.Join(dir, "c.json")
+	ioutil.WriteFile(a, []byte("old-a"), 0644)
+
+	tx := newTransaction("")
+	for _, filename := range []string{a, b, c} {
+		err := tx.writeFile(filename, []byte("new"))
+		if err != nil {
+			t.Fatalf("transaction.writeFile() error = %v", err)
+		}
+	}
+	// Renaming the last file fails once its temporary file is removed.
+	os.Remove(tx.files[2].Name())
+
+	err := tx.commit()
+	if err == nil {
+		t.Fatalf("transaction.commit() error = nil, want error")
+	}
+	data, err := ioutil.ReadFile(a)
+	if err != nil || string(data) != "old-a" {
+		t.Errorf("transaction.commit() did not restore a.json: %q, %v", data, err)
+	}
+	if _, err := os.Stat(b); !os.IsNotExist(err) {
+		t.Errorf("transaction.commit() did not remove new file b.json: %v", err)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("transaction.commit() left %d files, want 1", len(files))
+	}
+}
@@ -0,0 +1,100 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/m-lab/gcp-service-discovery/metrics"
+)
+
+var (
+	// abandonedPasses counts discovery passes that did not return before the
+	// hard deadline, by service name.
+	//
+	// Provides metrics:
+	//   gcp_manager_abandoned_passes_total
+	// Usage example:
+	//   abandonedPasses.WithLabelValues("aeflex.Service").Inc()
+	abandonedPasses = metrics.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gcp_manager_abandoned_passes_total",
+			Help: "Number of discovery passes abandoned after the hard deadline.",
+		},
+		[]string{"service"},
+	)
+)
+
+// DefaultDeadlineGrace is how long the Manager waits for a service to return
+// after its discovery timeout, unless the hard deadline is set by
+// WithHardDeadline.
+const DefaultDeadlineGrace = time.Minute
+
+var (
+	// errAbandoned is returned for passes that did not return before the hard
+	// deadline.
+	errAbandoned = errors.New("discovery abandoned after the hard deadline")
+
+	// errStillRunning is returned for passes that are not started because an
+	// abandoned pass of the same service has not returned yet.
+	errStillRunning = errors.New("abandoned discovery pass is still running")
+)
+
+// deadline returns the maximum time the Manager waits for the discovery of
+// each service.
+func (m *Manager) deadline() time.Duration {
+	if m.hardDeadline > 0 {
+		return m.hardDeadline
+	}
+	return m.timeout + DefaultDeadlineGrace
+}
+
+// watch calls Discover on the service of reg, and returns its result, or an
+// error once the hard deadline passes, even if Discover ignores the
+// cancellation of ctx. An abandoned call keeps running in the background.
+// Until it returns, later passes of the service fail without calling Discover,
+// so a stuck service does not accumulate goroutines.
+func (m *Manager) watch(ctx context.Context, reg *registration, service string) ([]StaticConfig, error) {
+	m.mu.Lock()
+	overdue := reg.overdue
+	m.mu.Unlock()
+	if overdue != nil {
+		select {
+		case <-overdue:
+			m.mu.Lock()
+			reg.overdue = nil
+			m.mu.Unlock()
+		default:
+			return nil, errStillRunning
+		}
+	}
+
+	type reply struct {
+		configs []StaticConfig
+		err     error
+	}
+	done := make(chan reply, 1)
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		configs, err := reg.service.Discover(ctx)
+		done <- reply{configs, err}
+	}()
+	// The first tick of the Clock marks the deadline.
+	deadline := m.deadline()
+	timer := m.clock().NewTicker(deadline)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.configs, r.err
+	case <-timer.C():
+		abandonedPasses.WithLabelValues(service).Inc()
+		m.mu.Lock()
+		reg.overdue = finished
+		m.mu.Unlock()
+		return nil, fmt.Errorf("%w of %s", errAbandoned, deadline)
+	}
+}
@@ -0,0 +1,84 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeStuck ignores the cancellation of its context, and returns once release
+// is closed. Every call is sent to started, if not full.
+type fakeStuck struct {
+	release chan struct{}
+	started chan struct{}
+	calls   int32
+}
+
+func (f *fakeStuck) Discover(ctx context.Context) ([]StaticConfig, error) {
+	atomic.AddInt32(&f.calls, 1)
+	select {
+	case f.started <- struct{}{}:
+	default:
+	}
+	<-f.release
+	return []StaticConfig{{Targets: []string{"late"}}}, nil
+}
+
+func TestManager_discoverHardDeadline(t *testing.T) {
+	f := &fakeStuck{release: make(chan struct{}), started: make(chan struct{}, 1)}
+	clock := newFakeClock()
+	m := NewManager(WithTimeout(time.Minute), WithHardDeadline(time.Hour))
+	m.clk = clock
+	m.Register(f, filepath.Join(t.TempDir(), "stuck.json"))
+	reg := m.registrations[0]
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := m.discover(context.Background(), reg)
+		errc <- err
+	}()
+	// Pass the hard deadline once Discover is stuck and the pass waits for it.
+	<-f.started
+	clock.waitTickers(1)
+	clock.Advance(time.Hour)
+	err := <-errc
+	if !errors.Is(err, errAbandoned) {
+		t.Fatalf("Manager.discover() error = %v, want %v", err, errAbandoned)
+	}
+	// The abandoned call has not returned, so it is not called again.
+	_, err = m.discover(context.Background(), reg)
+	if !errors.Is(err, errStillRunning) {
+		t.Fatalf("Manager.discover() error = %v, want %v", err, errStillRunning)
+	}
+	if n := atomic.LoadInt32(&f.calls); n != 1 {
+		t.Errorf("Manager.discover() called Discover %d times, want 1", n)
+	}
+
+	// Once the abandoned call returns, passes run again.
+	close(f.release)
+	m.mu.Lock()
+	overdue := reg.overdue
+	m.mu.Unlock()
+	<-overdue
+	r, err := m.discover(context.Background(), reg)
+	if err != nil {
+		t.Fatalf("Manager.discover() error = %v", err)
+	}
+	if n := atomic.LoadInt32(&f.calls); len(r.configs) != 1 || n != 2 {
+		t.Errorf("Manager.discover() = %v after %d calls, want 1 target after 2 calls", r.configs, n)
+	}
+}
+
+func TestManager_deadline(t *testing.T) {
+	m := NewManager(WithTimeout(time.Minute))
+	if got := m.deadline(); got != time.Minute+DefaultDeadlineGrace {
+		t.Errorf("Manager.deadline() = %s, want %s", got, time.Minute+DefaultDeadlineGrace)
+	}
+	m = NewManager(WithTimeout(time.Minute), WithHardDeadline(time.Hour))
+	if got := m.deadline(); got != time.Hour {
+		t.Errorf("Manager.deadline() = %s, want %s", got, time.Hour)
+	}
+}
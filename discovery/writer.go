@@ -0,0 +1,118 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sync"
+)
+
+// Writer publishes discovered targets to a destination other than a local
+// file, such as a service registry. Register a Writer with RegisterWriter.
+type Writer interface {
+	// Write publishes configs, replacing the targets published by the previous
+	// call to Write.
+	Write(ctx context.Context, configs []StaticConfig) error
+
+	// String describes the destination. It is used in place of the output
+	// filename in logs, metrics, and the Manager Status.
+	String() string
+}
+
+// WriterFactory creates a Writer for an output URL.
+type WriterFactory func(u *url.URL) (Writer, error)
+
+var (
+	writerMu        sync.Mutex
+	writerFactories = map[string]WriterFactory{}
+)
+
+// RegisterWriterScheme causes NewWriter to use f for outputs that are URLs with
+// the given scheme, e.g. "zk".
+func RegisterWriterScheme(scheme string, f WriterFactory) {
+	writerMu.Lock()
+	defer writerMu.Unlock()
+	writerFactories[scheme] = f
+}
+
+// writerFactory returns the WriterFactory for output, if output is a URL with
+// a registered scheme.
+func writerFactory(output string) (*url.URL, WriterFactory) {
+	u, err := url.Parse(output)
+	if err != nil || u.Scheme == "" {
+		return nil, nil
+	}
+	writerMu.Lock()
+	defer writerMu.Unlock()
+	return u, writerFactories[u.Scheme]
+}
+
+// IsWriterOutput returns true if output is Stdout or a URL with a scheme
+// registered using RegisterWriterScheme, rather than a filename.
+func IsWriterOutput(output string) bool {
+	_, f := writerFactory(output)
+	return f != nil || output == Stdout
+}
+
+// NewWriter creates a Writer for output using the factory registered for the
+// output URL scheme, or a Writer to standard output for Stdout. NewWriter
+// returns nil without error when output is a filename.
+func NewWriter(output string) (Writer, error) {
+	if output == Stdout {
+		return &streamWriter{w: os.Stdout, name: Stdout}, nil
+	}
+	u, f := writerFactory(output)
+	if f == nil {
+		return nil, nil
+	}
+	w, err := f(u)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create writer for %q: %s", output, err)
+	}
+	return w, nil
+}
+
+// RegisterWriter accepts a new service whose targets are published using w
+// instead of written to a file. The output of the registration is w.String().
+// RegisterWriter is safe to call while Run is running.
+func (m *Manager) RegisterWriter(s Service, w Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.registrations = append(m.registrations, &registration{service: s, output: w.String(), writer: w})
+}
+
+// Stdout is the output name that writes targets to standard output.
+const Stdout = "-"
+
+// streamMu serializes writes by all streamWriters, so documents from different
+// services are never interleaved.
+var streamMu sync.Mutex
+
+// streamWriter writes every pass to w as one line of compact JSON, so
+// consumers may read one document per line.
+type streamWriter struct {
+	w    io.Writer
+	name string
+}
+
+// Write writes configs as a JSON array followed by a newline.
+func (s *streamWriter) Write(ctx context.Context, configs []StaticConfig) error {
+	buf := &bytes.Buffer{}
+	err := encodeConfigs(buf, configs, "")
+	if err != nil {
+		return err
+	}
+	buf.WriteByte('\n')
+	streamMu.Lock()
+	defer streamMu.Unlock()
+	_, err = s.w.Write(buf.Bytes())
+	return err
+}
+
+// String returns the output name.
+func (s *streamWriter) String() string {
+	return s.name
+}
@@ -0,0 +1,132 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+)
+
+type fakeWriter struct {
+	configs []StaticConfig
+	err     error
+}
+
+func (f *fakeWriter) Write(ctx context.Context, configs []StaticConfig) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.configs = configs
+	return nil
+}
+
+func (f *fakeWriter) String() string {
+	return "fake://writer"
+}
+
+func TestManager_RegisterWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		writer *fakeWriter
+		want   Health
+	}{
+		{
+			name:   "success",
+			writer: &fakeWriter{},
+			want:   HealthOK,
+		},
+		{
+			name:   "failure-write",
+			writer: &fakeWriter{err: errors.New("fake error")},
+			want:   HealthFailing,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManager(WithTimeout(time.Minute))
+			m.RegisterWriter(&fakeLiteral{}, tt.writer)
+			ok := m.discoverAll(context.Background())
+			if ok != (tt.writer.err == nil) {
+				t.Errorf("Manager.discoverAll() = %v, want %v", ok, tt.writer.err == nil)
+			}
+			if tt.writer.err == nil && countTargets(tt.writer.configs) != 1 {
+				t.Errorf("Writer.Write() got %v, want 1 target", tt.writer.configs)
+			}
+			status := m.Status()
+			if status[0].Output != "fake://writer" || status[0].Health != tt.want {
+				t.Errorf("Manager.Status() = %#v, want output fake://writer and %s", status[0], tt.want)
+			}
+		})
+	}
+}
+
+func TestNewWriter(t *testing.T) {
+	RegisterWriterScheme("fake", func(u *url.URL) (Writer, error) {
+		if u.Host == "" {
+			return nil, errors.New("missing host")
+		}
+		return &fakeWriter{}, nil
+	})
+	tests := []struct {
+		name       string
+		output     string
+		wantWriter bool
+		wantErr    bool
+	}{
+		{
+			name:   "file",
+			output: "/targets/output.json",
+		},
+		{
+			name:   "unregistered-scheme",
+			output: "other://host/path",
+		},
+		{
+			name:       "stdout",
+			output:     Stdout,
+			wantWriter: true,
+		},
+		{
+			name:       "writer",
+			output:     "fake://host/path",
+			wantWriter: true,
+		},
+		{
+			name:    "failure-factory",
+			output:  "fake:///path",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := NewWriter(tt.output)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewWriter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (w != nil) != tt.wantWriter {
+				t.Errorf("NewWriter() = %v, want writer %v", w, tt.wantWriter)
+			}
+			if IsWriterOutput(tt.output) != (tt.wantWriter || tt.wantErr) {
+				t.Errorf("IsWriterOutput() = %v", IsWriterOutput(tt.output))
+			}
+		})
+	}
+}
+
+func TestStreamWriter_Write(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := &streamWriter{w: buf, name: Stdout}
+	configs := []StaticConfig{{Targets: []string{"a:9090"}, Labels: map[string]string{"b": "c"}}}
+	for i := 0; i < 2; i++ {
+		err := w.Write(context.Background(), configs)
+		if err != nil {
+			t.Fatalf("streamWriter.Write() error = %v", err)
+		}
+	}
+	want := `[{"targets":["a:9090"],"labels":{"b":"c"}}]` + "\n"
+	if buf.String() != want+want {
+		t.Errorf("streamWriter.Write() wrote %q, want two lines of %q", buf.String(), want)
+	}
+}
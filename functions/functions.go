@@ -0,0 +1,265 @@
+// Package functions implements service discovery for the HTTP functions of a
+// project, of both generations of Cloud Functions. Every trigger URL is
+// returned as a target, for probing with the blackbox exporter.
+//
+// 1st gen functions are listed with the Cloud Functions API. 2nd gen functions
+// run as Cloud Run services managed by Cloud Functions, and are listed with the
+// Cloud Run API.
+package functions
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	cloudfunctions "google.golang.org/api/cloudfunctions/v1"
+	run "google.golang.org/api/run/v1"
+
+	"github.com/m-lab/gcp-service-discovery/apilimit"
+	"github.com/m-lab/gcp-service-discovery/credentials"
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/functions/iface"
+	"github.com/m-lab/gcp-service-discovery/internal/apicall"
+	"github.com/m-lab/gcp-service-discovery/metrics"
+)
+
+const (
+	functionLabel   = "__cf_"
+	labelFunction   = functionLabel + "function"
+	labelRuntime    = functionLabel + "runtime"
+	labelRegion     = functionLabel + "region"
+	labelGeneration = functionLabel + "generation"
+
+	// Labels of the Cloud Run services of 2nd gen functions.
+	runManagedBy = "goog-managed-by"
+	runRuntime   = "goog-cloudfunctions-runtime"
+	runLocation  = "cloud.googleapis.com/location"
+
+	// managedSelector selects the Cloud Run services of 2nd gen functions.
+	managedSelector = runManagedBy + "=cloudfunctions"
+)
+
+var (
+	// newFunctionsClient and newRunClient allocate new API clients. The
+	// indirection facilitates testing.
+	newFunctionsClient = cloudfunctions.New
+	newRunClient       = run.New
+)
+
+var (
+	// TargetCount is the number of discovered function URLs by generation.
+	//
+	// Provides metrics:
+	//   gcp_functions_targets{generation="1"}
+	// Example usage:
+	//   TargetCount.WithLabelValues("1").Set(count)
+	TargetCount = metrics.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gcp_functions_targets",
+			Help: "Number of discovered Cloud Functions URLs by generation.",
+		},
+		[]string{"generation"},
+	)
+)
+
+// Service discovers the HTTP functions of a project.
+type Service struct {
+	project string
+	api     iface.Functions
+
+	// connect creates api. It is called again to recreate the clients after
+	// an authentication error.
+	connect func(ctx context.Context) error
+}
+
+// NewService returns a Service initialized with Cloud Functions and Cloud Run
+// API clients authenticated by creds. The Service implements the
+// discovery.Service interface. NewService fails if the credentials are not
+// found before ctx is done.
+func NewService(ctx context.Context, project string, creds credentials.Config) (*Service, error) {
+	s := &Service{project: project}
+	s.connect = func(ctx context.Context) error {
+		client, err := creds.Client(ctx, cloudfunctions.CloudPlatformScope)
+		if err != nil {
+			return fmt.Errorf("Error setting up API clients: %s", err)
+		}
+		client = apilimit.Client(client)
+		functions, err := newFunctionsClient(client)
+		if err != nil {
+			return fmt.Errorf("Error setting up Cloud Functions client: %s", err)
+		}
+		runClient, err := newRunClient(client)
+		if err != nil {
+			return fmt.Errorf("Error setting up Cloud Run client: %s", err)
+		}
+		s.api = iface.NewFunctions(project, functions, runClient)
+		return nil
+	}
+	if err := s.connect(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Discover lists every active 1st gen function with an HTTPS trigger, and
+// every ready 2nd gen function. After an authentication error, Discover
+// recreates its clients and tries once more.
+func (s *Service) Discover(ctx context.Context) ([]discovery.StaticConfig, error) {
+	var targets []discovery.StaticConfig
+	err := credentials.Retry(ctx, "functions", s.connect, func() error {
+		var err error
+		targets, err = s.discover(ctx)
+		return err
+	})
+	return targets, err
+}
+
+// discover lists every function once.
+func (s *Service) discover(ctx context.Context) ([]discovery.StaticConfig, error) {
+	targets := []discovery.StaticConfig{}
+	err := s.api.FunctionPages(ctx, func(list *cloudfunctions.ListFunctionsResponse) error {
+		discovery.CountScanned(ctx, "functions", len(list.Functions))
+		for _, fn := range list.Functions {
+			object := fn.Name
+			if fn.Status != "ACTIVE" {
+				discovery.Decide(ctx, object, false, "function status "+fn.Status)
+				continue
+			}
+			if fn.HttpsTrigger == nil || fn.HttpsTrigger.Url == "" {
+				discovery.Decide(ctx, object, false, "no HTTPS trigger")
+				continue
+			}
+			config := functionLabels(fn)
+			discovery.RecordOrigin(ctx, config, fn)
+			discovery.Decide(ctx, object, true, "active HTTPS function")
+			targets = append(targets, config)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	gen1 := len(targets)
+
+	err = s.api.ServicePages(ctx, managedSelector, func(list *run.ListServicesResponse) error {
+		discovery.CountScanned(ctx, "services", len(list.Items))
+		for _, svc := range list.Items {
+			if svc.Metadata == nil {
+				continue
+			}
+			object := svc.Metadata.Name
+			if !ready(svc) {
+				discovery.Decide(ctx, object, false, "service not ready")
+				continue
+			}
+			config := serviceLabels(svc)
+			discovery.RecordOrigin(ctx, config, svc)
+			discovery.Decide(ctx, object, true, "ready 2nd gen function")
+			targets = append(targets, config)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	TargetCount.WithLabelValues("1").Set(float64(gen1))
+	TargetCount.WithLabelValues("2").Set(float64(len(targets) - gen1))
+	return targets, nil
+}
+
+// ready returns true if the Ready condition of svc is true, and it has a URL.
+func ready(svc *run.Service) bool {
+	if svc.Status == nil || svc.Status.Url == "" {
+		return false
+	}
+	for _, c := range svc.Status.Conditions {
+		if c.Type == "Ready" {
+			return c.Status == "True"
+		}
+	}
+	return false
+}
+
+// functionLabels creates a target configuration for the HTTPS trigger URL of a
+// 1st gen function.
+//
+// In serialized form, the label set look like:
+//
+//	{
+//	    "labels": {
+//	        "__cf_function": "locate-heartbeat",
+//	        "__cf_generation": "1",
+//	        "__cf_region": "us-central1",
+//	        "__cf_runtime": "go116"
+//	    },
+//	    "targets": [
+//	        "https://us-central1-mlab-sandbox.cloudfunctions.net/locate-heartbeat"
+//	    ]
+//	}
+func functionLabels(fn *cloudfunctions.CloudFunction) discovery.StaticConfig {
+	// Function names look like projects/p/locations/l/functions/f.
+	region := ""
+	if parts := strings.Split(fn.Name, "/"); len(parts) == 6 {
+		region = parts[3]
+	}
+	return discovery.StaticConfig{
+		Targets: []string{fn.HttpsTrigger.Url},
+		Labels: map[string]string{
+			labelFunction:   path.Base(fn.Name),
+			labelRuntime:    fn.Runtime,
+			labelRegion:     region,
+			labelGeneration: "1",
+		},
+	}
+}
+
+// serviceLabels creates a target configuration for the URL of the Cloud Run
+// service of a 2nd gen function.
+//
+// In serialized form, the label set look like:
+//
+//	{
+//	    "labels": {
+//	        "__cf_function": "locate-signer",
+//	        "__cf_generation": "2",
+//	        "__cf_region": "us-east1",
+//	        "__cf_runtime": "go121"
+//	    },
+//	    "targets": [
+//	        "https://locate-signer-1a2b3c4d5e-ue.a.run.app"
+//	    ]
+//	}
+func serviceLabels(svc *run.Service) discovery.StaticConfig {
+	return discovery.StaticConfig{
+		Targets: []string{svc.Status.Url},
+		Labels: map[string]string{
+			labelFunction:   svc.Metadata.Name,
+			labelRuntime:    svc.Metadata.Labels[runRuntime],
+			labelRegion:     svc.Metadata.Labels[runLocation],
+			labelGeneration: "2",
+		},
+	}
+}
+
+// Check verifies access to the Cloud Functions and Cloud Run APIs by reading
+// the first page of functions and services. Check implements the
+// discovery.Checker interface.
+func (s *Service) Check(ctx context.Context) error {
+	err := apicall.FirstPage(ctx, s.api.FunctionPages)
+	if err != nil {
+		return fmt.Errorf("cannot list Cloud Functions in project %q; "+
+			"verify the Cloud Functions API is enabled and the credentials "+
+			"have the Cloud Functions Viewer role: %s", s.project, err)
+	}
+	err = apicall.FirstPage(ctx, func(ctx context.Context, f func(*run.ListServicesResponse) error) error {
+		return s.api.ServicePages(ctx, managedSelector, f)
+	})
+	if err != nil {
+		return fmt.Errorf("cannot list Cloud Run services in project %q; "+
+			"verify the Cloud Run API is enabled and the credentials have "+
+			"the Cloud Run Viewer role: %s", s.project, err)
+	}
+	return nil
+}
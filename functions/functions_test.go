@@ -0,0 +1,216 @@
+package functions
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/m-lab/go/prometheusx/promtest"
+	cloudfunctions "google.golang.org/api/cloudfunctions/v1"
+	"google.golang.org/api/googleapi"
+	run "google.golang.org/api/run/v1"
+
+	"github.com/m-lab/gcp-service-discovery/credentials"
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/internal/schematest"
+)
+
+type fakeFunctions struct {
+	functions   []*cloudfunctions.CloudFunction
+	services    []*run.Service
+	functionErr error
+	serviceErr  error
+	selector    string
+}
+
+func (f *fakeFunctions) FunctionPages(ctx context.Context, fn func(list *cloudfunctions.ListFunctionsResponse) error) error {
+	if f.functionErr != nil {
+		return f.functionErr
+	}
+	return fn(&cloudfunctions.ListFunctionsResponse{Functions: f.functions})
+}
+
+func (f *fakeFunctions) ServicePages(ctx context.Context, selector string, fn func(list *run.ListServicesResponse) error) error {
+	f.selector = selector
+	if f.serviceErr != nil {
+		return f.serviceErr
+	}
+	return fn(&run.ListServicesResponse{Items: f.services})
+}
+
+func newService(name, location, runtime string, ready string) *run.Service {
+	return &run.Service{
+		Metadata: &run.ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				"goog-managed-by":               "cloudfunctions",
+				"goog-cloudfunctions-runtime":   runtime,
+				"cloud.googleapis.com/location": location,
+			},
+		},
+		Status: &run.ServiceStatus{
+			Url:        "https://" + name + "-1a2b3c4d5e-ue.a.run.app",
+			Conditions: []*run.GoogleCloudRunV1Condition{{Type: "Ready", Status: ready}},
+		},
+	}
+}
+
+func newFakeFunctions() *fakeFunctions {
+	return &fakeFunctions{
+		functions: []*cloudfunctions.CloudFunction{
+			{
+				Name:         "projects/mlab-sandbox/locations/us-central1/functions/locate-heartbeat",
+				Runtime:      "go116",
+				Status:       "ACTIVE",
+				HttpsTrigger: &cloudfunctions.HttpsTrigger{Url: "https://us-central1-mlab-sandbox.cloudfunctions.net/locate-heartbeat"},
+			},
+			{
+				Name:         "projects/mlab-sandbox/locations/us-central1/functions/on-upload",
+				Runtime:      "python39",
+				Status:       "ACTIVE",
+				EventTrigger: &cloudfunctions.EventTrigger{EventType: "google.storage.object.finalize"},
+			},
+			{
+				Name:         "projects/mlab-sandbox/locations/us-central1/functions/broken",
+				Runtime:      "go116",
+				Status:       "OFFLINE",
+				HttpsTrigger: &cloudfunctions.HttpsTrigger{Url: "https://us-central1-mlab-sandbox.cloudfunctions.net/broken"},
+			},
+		},
+		services: []*run.Service{
+			newService("locate-signer", "us-east1", "go121", "True"),
+			newService("deploying", "us-east1", "go121", "Unknown"),
+			{Metadata: &run.ObjectMeta{Name: "no-status"}},
+		},
+	}
+}
+
+func TestService_Discover(t *testing.T) {
+	tests := []struct {
+		name    string
+		api     *fakeFunctions
+		want    []discovery.StaticConfig
+		wantErr bool
+	}{
+		{
+			name: "success",
+			api:  newFakeFunctions(),
+			want: []discovery.StaticConfig{
+				{
+					Targets: []string{"https://us-central1-mlab-sandbox.cloudfunctions.net/locate-heartbeat"},
+					Labels: map[string]string{
+						"__cf_function":   "locate-heartbeat",
+						"__cf_runtime":    "go116",
+						"__cf_region":     "us-central1",
+						"__cf_generation": "1",
+					},
+				},
+				{
+					Targets: []string{"https://locate-signer-1a2b3c4d5e-ue.a.run.app"},
+					Labels: map[string]string{
+						"__cf_function":   "locate-signer",
+						"__cf_runtime":    "go121",
+						"__cf_region":     "us-east1",
+						"__cf_generation": "2",
+					},
+				},
+			},
+		},
+		{
+			name: "success-empty",
+			api:  &fakeFunctions{},
+			want: []discovery.StaticConfig{},
+		},
+		{
+			name:    "failure-functions",
+			api:     &fakeFunctions{functionErr: fmt.Errorf("forbidden")},
+			wantErr: true,
+		},
+		{
+			name:    "failure-services",
+			api:     &fakeFunctions{serviceErr: fmt.Errorf("forbidden")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Service{project: "mlab-sandbox", api: tt.api}
+			got, err := s.Discover(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Service.Discover() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Service.Discover() = %v, want %v", got, tt.want)
+			}
+			if err == nil {
+				if tt.api.selector != "goog-managed-by=cloudfunctions" {
+					t.Errorf("Service.Discover() listed services with selector %q", tt.api.selector)
+				}
+				data, _ := json.Marshal(got)
+				if err := schematest.Validate([]byte(discovery.Schema), data); err != nil {
+					t.Errorf("Service.Discover() = %s, which does not match the schema: %v", data, err)
+				}
+			}
+		})
+	}
+}
+
+func TestService_Check(t *testing.T) {
+	s := &Service{project: "mlab-sandbox", api: newFakeFunctions()}
+	if err := s.Check(context.Background()); err != nil {
+		t.Errorf("Service.Check() error = %v", err)
+	}
+	s.api = &fakeFunctions{functionErr: fmt.Errorf("forbidden")}
+	if err := s.Check(context.Background()); err == nil {
+		t.Errorf("Service.Check() error = nil, want error")
+	}
+	s.api = &fakeFunctions{serviceErr: fmt.Errorf("forbidden")}
+	if err := s.Check(context.Background()); err == nil {
+		t.Errorf("Service.Check() error = nil, want error")
+	}
+}
+
+func TestNewService(t *testing.T) {
+	origFunctions, origRun := newFunctionsClient, newRunClient
+	defer func() { newFunctionsClient, newRunClient = origFunctions, origRun }()
+	if _, err := NewService(context.Background(), "mlab-sandbox", credentials.Config{}); err != nil {
+		t.Errorf("NewService() error = %v", err)
+	}
+	newRunClient = func(client *http.Client) (*run.APIService, error) {
+		return nil, fmt.Errorf("failed to create client")
+	}
+	if _, err := NewService(context.Background(), "mlab-sandbox", credentials.Config{}); err == nil {
+		t.Errorf("NewService() error = nil, want error")
+	}
+	newFunctionsClient = func(client *http.Client) (*cloudfunctions.Service, error) {
+		return nil, fmt.Errorf("failed to create client")
+	}
+	if _, err := NewService(context.Background(), "mlab-sandbox", credentials.Config{}); err == nil {
+		t.Errorf("NewService() error = nil, want error")
+	}
+}
+
+func TestService_DiscoverAuthRefresh(t *testing.T) {
+	s := &Service{project: "mlab-sandbox", api: &fakeFunctions{functionErr: &googleapi.Error{Code: http.StatusUnauthorized}}}
+	connects := 0
+	s.connect = func(ctx context.Context) error {
+		connects++
+		s.api = newFakeFunctions()
+		return nil
+	}
+	got, err := s.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("Service.Discover() error = %v", err)
+	}
+	if connects != 1 || len(got) == 0 {
+		t.Errorf("Service.Discover() connected %d times and found %d targets, want 1 and more than 0", connects, len(got))
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	TargetCount.WithLabelValues("x")
+	promtest.LintMetrics(t)
+}
@@ -0,0 +1,69 @@
+// Package iface defines an interface for accessing the Cloud Functions and
+// Cloud Run APIs. This is helpful for creating testable packages.
+package iface
+
+import (
+	"context"
+	"net/http"
+
+	cloudfunctions "google.golang.org/api/cloudfunctions/v1"
+	run "google.golang.org/api/run/v1"
+
+	"github.com/m-lab/gcp-service-discovery/internal/apicall"
+)
+
+// The names of the APIs in quota metrics.
+const (
+	functionsAPI = "cloudfunctions"
+	runAPI       = "run"
+)
+
+// Functions defines the interface used by the functions logic.
+type Functions interface {
+	FunctionPages(ctx context.Context, f func(list *cloudfunctions.ListFunctionsResponse) error) error
+	ServicePages(ctx context.Context, selector string, f func(list *run.ListServicesResponse) error) error
+}
+
+// FunctionsImpl implements the Functions interface.
+type FunctionsImpl struct {
+	project   string
+	functions *cloudfunctions.Service
+	run       *run.APIService
+}
+
+// NewFunctions creates a new Functions for the given project.
+func NewFunctions(project string, functions *cloudfunctions.Service, run *run.APIService) *FunctionsImpl {
+	return &FunctionsImpl{project: project, functions: functions, run: run}
+}
+
+// FunctionPages lists the 1st gen Cloud Functions of every location and calls
+// the given function for each "page" of results.
+func (a *FunctionsImpl) FunctionPages(ctx context.Context, f func(list *cloudfunctions.ListFunctionsResponse) error) error {
+	parent := "projects/" + a.project + "/locations/-"
+	return apicall.Pages(ctx, functionsAPI,
+		func(ctx context.Context, token string) (*cloudfunctions.ListFunctionsResponse, error) {
+			return a.functions.Projects.Locations.Functions.List(parent).PageToken(token).Context(ctx).Do()
+		},
+		func(list *cloudfunctions.ListFunctionsResponse) (http.Header, string) {
+			return list.Header, list.NextPageToken
+		},
+		f)
+}
+
+// ServicePages lists the Cloud Run services of every region that match the
+// given label selector, and calls the given function for each "page" of
+// results.
+func (a *FunctionsImpl) ServicePages(ctx context.Context, selector string, f func(list *run.ListServicesResponse) error) error {
+	parent := "namespaces/" + a.project
+	return apicall.Pages(ctx, runAPI,
+		func(ctx context.Context, token string) (*run.ListServicesResponse, error) {
+			return a.run.Namespaces.Services.List(parent).LabelSelector(selector).Continue(token).Context(ctx).Do()
+		},
+		func(list *run.ListServicesResponse) (http.Header, string) {
+			if list.Metadata == nil {
+				return list.Header, ""
+			}
+			return list.Header, list.Metadata.Continue
+		},
+		f)
+}
@@ -0,0 +1,221 @@
+// Package gce implements service discovery for labeled GCE instances, adds
+// metadata from the Compute API to targets backed by GCE instances, such as App
+// Engine Flex VMs, and analyzes whether their firewall rules allow Prometheus
+// to reach them.
+//
+// Sources identify the instance of a target with the LabelInstance and
+// LabelZone labels, and optionally LabelProject. The Enricher adds labels like:
+//
+//	"__gce_machine_type": "n1-standard-2",
+//	"__gce_tags": ",http-server,prometheus,",
+//	"__gce_preemptible": "false",
+//	"__gce_network": "default",
+//	"__gce_label_team": "measurement"
+package gce
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+
+	"github.com/m-lab/gcp-service-discovery/apilimit"
+	"github.com/m-lab/gcp-service-discovery/credentials"
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/gce/iface"
+)
+
+// Labels that identify the GCE instance of a target.
+const (
+	LabelProject  = "__gce_project"
+	LabelZone     = "__gce_zone"
+	LabelInstance = "__gce_instance"
+)
+
+// Labels added by the Enricher.
+const (
+	labelMachineType = "__gce_machine_type"
+	labelTags        = "__gce_tags"
+	labelPreemptible = "__gce_preemptible"
+	labelNetwork     = "__gce_network"
+	labelPrefix      = "__gce_label_"
+)
+
+// DefaultTTL is how long instance metadata is reused by default. Machine
+// types, tags, and labels change rarely.
+const DefaultTTL = 10 * time.Minute
+
+// now returns the current time. The indirection facilitates testing.
+var now = time.Now
+
+// Enricher looks up the GCE instance of every target and adds its metadata as
+// labels. Results are cached, so every instance is read at most once per TTL.
+// Enricher is safe for concurrent use by several services.
+type Enricher struct {
+	api     iface.Compute
+	project string
+	ttl     time.Duration
+
+	mu    sync.Mutex
+	cache map[string]*entry
+}
+
+// entry is the cached metadata of one instance.
+type entry struct {
+	labels  map[string]string
+	updated time.Time
+}
+
+// NewEnricher creates an Enricher that reuses instance metadata for ttl. The
+// project is used for targets without a LabelProject label. NewEnricher fails
+// if default credentials are not found before ctx is done.
+func NewEnricher(ctx context.Context, project string, ttl time.Duration) (*Enricher, error) {
+	client, err := credentials.Config{}.Client(ctx, compute.ComputeReadonlyScope)
+	if err != nil {
+		return nil, fmt.Errorf("Error setting up Compute client: %s", err)
+	}
+	service, err := compute.New(apilimit.Client(client))
+	if err != nil {
+		return nil, fmt.Errorf("Error setting up Compute client: %s", err)
+	}
+	return newEnricher(iface.NewCompute(service), project, ttl), nil
+}
+
+func newEnricher(api iface.Compute, project string, ttl time.Duration) *Enricher {
+	return &Enricher{api: api, project: project, ttl: ttl, cache: map[string]*entry{}}
+}
+
+// Enrich returns a copy of configs with the metadata of the instance of every
+// config added to its labels. Configs without instance labels, or whose
+// instance cannot be read, are returned unchanged, so enrichment never causes
+// discovery to fail.
+func (e *Enricher) Enrich(ctx context.Context, configs []discovery.StaticConfig) []discovery.StaticConfig {
+	e.expire()
+	result := make([]discovery.StaticConfig, len(configs))
+	for i, c := range configs {
+		result[i] = c
+		extra := e.lookup(ctx, c.Labels)
+		if len(extra) == 0 {
+			continue
+		}
+		result[i].Labels = make(map[string]string, len(c.Labels)+len(extra))
+		for k, v := range c.Labels {
+			result[i].Labels[k] = v
+		}
+		for k, v := range extra {
+			result[i].Labels[k] = v
+		}
+	}
+	return result
+}
+
+// lookup returns the metadata labels of the instance named by labels.
+func (e *Enricher) lookup(ctx context.Context, labels map[string]string) map[string]string {
+	name, zone := labels[LabelInstance], labels[LabelZone]
+	if name == "" || zone == "" {
+		return nil
+	}
+	project := labels[LabelProject]
+	if project == "" {
+		project = e.project
+	}
+	key := project + "/" + zone + "/" + name
+	e.mu.Lock()
+	cached := e.cache[key]
+	e.mu.Unlock()
+	if cached != nil {
+		return cached.labels
+	}
+
+	instance, err := e.api.InstanceGet(ctx, project, zone, name)
+	if err != nil && !isNotFound(err) {
+		// Try again during the next pass.
+		log.Printf("Failed to read GCE instance %s: %s", key, err)
+		return nil
+	}
+	// Deleted instances are cached as having no metadata.
+	var extra map[string]string
+	if instance != nil {
+		extra = instanceLabels(instance)
+	}
+	e.mu.Lock()
+	e.cache[key] = &entry{labels: extra, updated: now()}
+	e.mu.Unlock()
+	return extra
+}
+
+// expire removes cache entries older than the TTL.
+func (e *Enricher) expire() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for k, c := range e.cache {
+		if now().Sub(c.updated) >= e.ttl {
+			delete(e.cache, k)
+		}
+	}
+}
+
+// instanceLabels returns the metadata labels of an instance.
+func instanceLabels(instance *compute.Instance) map[string]string {
+	labels := map[string]string{
+		labelMachineType: path.Base(instance.MachineType),
+		labelPreemptible: "false",
+	}
+	// Spot VMs are also reported as preemptible.
+	if instance.Scheduling != nil {
+		labels[labelPreemptible] = strconv.FormatBool(instance.Scheduling.Preemptible)
+	}
+	if instance.Tags != nil && len(instance.Tags.Items) > 0 {
+		// Like Prometheus GCE discovery, surround tags with separators so
+		// relabeling can match ",tag,".
+		labels[labelTags] = "," + strings.Join(instance.Tags.Items, ",") + ","
+	}
+	if len(instance.NetworkInterfaces) > 0 {
+		// Prometheus reaches targets through the primary interface.
+		labels[labelNetwork] = path.Base(instance.NetworkInterfaces[0].Network)
+	}
+	for k, v := range instance.Labels {
+		labels[labelPrefix+strings.ReplaceAll(k, "-", "_")] = v
+	}
+	return labels
+}
+
+// isNotFound returns true if err is an HTTP 404 response from the API.
+func isNotFound(err error) bool {
+	apiErr, ok := err.(*googleapi.Error)
+	return ok && apiErr.Code == http.StatusNotFound
+}
+
+// Wrap returns a discovery.Service that enriches the targets discovered by s.
+func (e *Enricher) Wrap(s discovery.Service) *Service {
+	return &Service{service: s, process: e.Enrich}
+}
+
+// Service enriches or analyzes the targets discovered by another service.
+// Service implements the discovery.Service interface.
+type Service struct {
+	service discovery.Service
+	process func(context.Context, []discovery.StaticConfig) []discovery.StaticConfig
+}
+
+// Discover runs discovery on the underlying service and processes the result.
+func (s *Service) Discover(ctx context.Context) ([]discovery.StaticConfig, error) {
+	configs, err := s.service.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.process(ctx, configs), nil
+}
+
+// Unwrap returns the underlying discovery.Service.
+func (s *Service) Unwrap() discovery.Service {
+	return s.service
+}
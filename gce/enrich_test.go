@@ -0,0 +1,179 @@
+package gce
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+
+	"github.com/m-lab/gcp-service-discovery/discovery"
+)
+
+type fakeCompute struct {
+	instances     map[string]*compute.Instance
+	list          []*compute.Instance
+	listFilter    string
+	listErr       error
+	err           error
+	calls         int
+	firewalls     []*compute.Firewall
+	firewallErr   error
+	firewallCalls int
+}
+
+func (f *fakeCompute) InstanceGet(ctx context.Context, project, zone, name string) (*compute.Instance, error) {
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	i, ok := f.instances[project+"/"+zone+"/"+name]
+	if !ok {
+		return nil, &googleapi.Error{Code: http.StatusNotFound}
+	}
+	return i, nil
+}
+
+func (f *fakeCompute) FirewallList(ctx context.Context, project string) ([]*compute.Firewall, error) {
+	f.firewallCalls++
+	return f.firewalls, f.firewallErr
+}
+
+func (f *fakeCompute) InstancePages(ctx context.Context, project, filter string, fn func(list *compute.InstanceAggregatedList) error) error {
+	f.listFilter = filter
+	if f.listErr != nil {
+		return f.listErr
+	}
+	return fn(&compute.InstanceAggregatedList{
+		Items: map[string]compute.InstancesScopedList{"zones/us-central1-a": {Instances: f.list}},
+	})
+}
+
+type fakeService struct {
+	configs []discovery.StaticConfig
+	err     error
+}
+
+func (f *fakeService) Discover(ctx context.Context) ([]discovery.StaticConfig, error) {
+	return f.configs, f.err
+}
+
+func TestEnricher_Enrich(t *testing.T) {
+	instance := &compute.Instance{
+		MachineType: "https://www.googleapis.com/compute/v1/projects/p/zones/us-central1-a/machineTypes/n1-standard-2",
+		Tags:        &compute.Tags{Items: []string{"http-server", "prometheus"}},
+		Labels:      map[string]string{"team": "measurement", "cost-center": "m-lab"},
+		Scheduling:  &compute.Scheduling{Preemptible: true},
+		NetworkInterfaces: []*compute.NetworkInterface{
+			{Network: "https://www.googleapis.com/compute/v1/projects/p/global/networks/default"},
+		},
+	}
+	tests := []struct {
+		name   string
+		labels map[string]string
+		err    error
+		want   map[string]string
+	}{
+		{
+			name:   "success",
+			labels: map[string]string{LabelInstance: "vm", LabelZone: "us-central1-a", "x": "y"},
+			want: map[string]string{
+				LabelInstance:             "vm",
+				LabelZone:                 "us-central1-a",
+				"x":                       "y",
+				"__gce_machine_type":      "n1-standard-2",
+				"__gce_tags":              ",http-server,prometheus,",
+				"__gce_preemptible":       "true",
+				"__gce_network":           "default",
+				"__gce_label_team":        "measurement",
+				"__gce_label_cost_center": "m-lab",
+			},
+		},
+		{
+			name:   "success-other-project",
+			labels: map[string]string{LabelInstance: "vm", LabelZone: "us-central1-a", LabelProject: "other"},
+			want:   map[string]string{LabelInstance: "vm", LabelZone: "us-central1-a", LabelProject: "other"},
+		},
+		{
+			name:   "success-no-instance-labels",
+			labels: map[string]string{"x": "y"},
+			want:   map[string]string{"x": "y"},
+		},
+		{
+			name:   "success-api-error-unchanged",
+			labels: map[string]string{LabelInstance: "vm", LabelZone: "us-central1-a"},
+			err:    fmt.Errorf("permission denied"),
+			want:   map[string]string{LabelInstance: "vm", LabelZone: "us-central1-a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeCompute{instances: map[string]*compute.Instance{"p/us-central1-a/vm": instance}, err: tt.err}
+			e := newEnricher(f, "p", time.Minute)
+			configs := []discovery.StaticConfig{{Targets: []string{"a:1"}, Labels: tt.labels}}
+			got := e.Enrich(context.Background(), configs)
+			if !reflect.DeepEqual(got[0].Labels, tt.want) {
+				t.Errorf("Enricher.Enrich() = %v, want %v", got[0].Labels, tt.want)
+			}
+			if !reflect.DeepEqual(configs[0].Labels, tt.labels) {
+				t.Errorf("Enricher.Enrich() modified its input: %v", configs[0].Labels)
+			}
+		})
+	}
+}
+
+func TestEnricher_cache(t *testing.T) {
+	current := time.Date(2018, 10, 27, 21, 1, 26, 0, time.UTC)
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+
+	f := &fakeCompute{instances: map[string]*compute.Instance{"p/z/vm": {MachineType: "e2-small"}}}
+	e := newEnricher(f, "p", time.Minute)
+	configs := []discovery.StaticConfig{
+		{Targets: []string{"a:1"}, Labels: map[string]string{LabelInstance: "vm", LabelZone: "z"}},
+		{Targets: []string{"b:1"}, Labels: map[string]string{LabelInstance: "deleted", LabelZone: "z"}},
+	}
+	e.Enrich(context.Background(), configs)
+	e.Enrich(context.Background(), configs)
+	if f.calls != 2 {
+		t.Errorf("Enricher.Enrich() read %d instances, want 2", f.calls)
+	}
+	current = current.Add(time.Minute)
+	e.Enrich(context.Background(), configs)
+	if f.calls != 4 {
+		t.Errorf("Enricher.Enrich() after ttl read %d instances, want 4", f.calls)
+	}
+}
+
+func TestService_Discover(t *testing.T) {
+	f := &fakeCompute{instances: map[string]*compute.Instance{"p/z/vm": {MachineType: "e2-small"}}}
+	e := newEnricher(f, "p", time.Minute)
+	s := e.Wrap(&fakeService{configs: []discovery.StaticConfig{
+		{Targets: []string{"a:1"}, Labels: map[string]string{LabelInstance: "vm", LabelZone: "z"}},
+	}})
+	got, err := s.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("Service.Discover() error = %v", err)
+	}
+	if got[0].Labels["__gce_machine_type"] != "e2-small" {
+		t.Errorf("Service.Discover() = %v, want machine type e2-small", got[0].Labels)
+	}
+	_, err = e.Wrap(&fakeService{err: fmt.Errorf("failed")}).Discover(context.Background())
+	if err == nil {
+		t.Errorf("Service.Discover() error = nil, want error")
+	}
+	if _, ok := s.Unwrap().(*fakeService); !ok {
+		t.Errorf("Service.Unwrap() = %T, want *fakeService", s.Unwrap())
+	}
+}
+
+func TestNewEnricher(t *testing.T) {
+	_, err := NewEnricher(context.Background(), "p", DefaultTTL)
+	if err != nil {
+		t.Errorf("NewEnricher() error = %v", err)
+	}
+}
@@ -0,0 +1,327 @@
+package gce
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	compute "google.golang.org/api/compute/v1"
+
+	"github.com/m-lab/gcp-service-discovery/apilimit"
+	"github.com/m-lab/gcp-service-discovery/credentials"
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/gce/iface"
+	"github.com/m-lab/gcp-service-discovery/metrics"
+)
+
+// LabelUnreachable is set to "true" for targets that the firewall rules of
+// their network probably do not allow Prometheus to reach, and "false" for
+// other analyzed targets.
+const LabelUnreachable = "probably_unreachable"
+
+// FirewallTTL is how long the firewall rules of a project are reused. It is
+// short, so fixed rules are noticed soon.
+const FirewallTTL = time.Minute
+
+var (
+	// unreachableTotal counts targets that the firewall rules of their network
+	// probably block, every time they are analyzed.
+	//
+	// Provides metrics:
+	//   gcp_gce_unreachable_targets_total{network="default"}
+	// Example usage:
+	//   unreachableTotal.WithLabelValues("default").Inc()
+	unreachableTotal = metrics.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gcp_gce_unreachable_targets_total",
+			Help: "Number of discovered targets probably blocked by firewall rules.",
+		},
+		[]string{"network"},
+	)
+)
+
+// Analyzer labels targets backed by GCE instances with LabelUnreachable,
+// based on the ingress firewall rules of the network of every instance.
+// Targets must already have the network and tag labels added by an Enricher.
+//
+// The analysis is a heuristic: rules that target service accounts, or that
+// allow sources by tag, are ignored, and a source range only matches rules
+// with a source range that contains all of it.
+type Analyzer struct {
+	api     iface.Compute
+	project string
+	sources []*net.IPNet
+	ttl     time.Duration
+
+	mu    sync.Mutex
+	rules map[string]*rules
+}
+
+// rules are the cached firewall rules of one project, ordered by evaluation.
+type rules struct {
+	firewalls []*compute.Firewall
+	updated   time.Time
+}
+
+// NewAnalyzer creates an Analyzer that checks whether TCP connections from
+// every CIDR range in sources reach the discovered targets. The project is used
+// for targets without a LabelProject label. NewAnalyzer fails if default
+// credentials are not found before ctx is done.
+func NewAnalyzer(ctx context.Context, project string, sources []string) (*Analyzer, error) {
+	nets, err := parseRanges(sources)
+	if err != nil {
+		return nil, err
+	}
+	client, err := credentials.Config{}.Client(ctx, compute.ComputeReadonlyScope)
+	if err != nil {
+		return nil, fmt.Errorf("Error setting up Compute client: %s", err)
+	}
+	service, err := compute.New(apilimit.Client(client))
+	if err != nil {
+		return nil, fmt.Errorf("Error setting up Compute client: %s", err)
+	}
+	return newAnalyzer(iface.NewCompute(service), project, nets, FirewallTTL), nil
+}
+
+func newAnalyzer(api iface.Compute, project string, sources []*net.IPNet, ttl time.Duration) *Analyzer {
+	return &Analyzer{api: api, project: project, sources: sources, ttl: ttl, rules: map[string]*rules{}}
+}
+
+// parseRanges parses CIDR ranges, or single IP addresses.
+func parseRanges(ranges []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, r := range ranges {
+		n := parseRange(r)
+		if n == nil {
+			return nil, fmt.Errorf("invalid source range: %q", r)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// parseRange parses a CIDR range or a single IP address, and returns nil if r
+// is neither.
+func parseRange(r string) *net.IPNet {
+	if _, n, err := net.ParseCIDR(r); err == nil {
+		return n
+	}
+	ip := net.ParseIP(r)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// Analyze returns a copy of configs with LabelUnreachable added to the labels
+// of every config backed by a GCE instance. Configs without a network label,
+// or whose firewall rules cannot be read, are returned unchanged.
+func (a *Analyzer) Analyze(ctx context.Context, configs []discovery.StaticConfig) []discovery.StaticConfig {
+	a.expire()
+	result := make([]discovery.StaticConfig, len(configs))
+	for i, c := range configs {
+		result[i] = c
+		network := c.Labels[labelNetwork]
+		if network == "" {
+			continue
+		}
+		project := c.Labels[LabelProject]
+		if project == "" {
+			project = a.project
+		}
+		firewalls, err := a.firewalls(ctx, project)
+		if err != nil {
+			// Try again during the next pass.
+			log.Printf("Failed to read firewall rules of project %s: %s", project, err)
+			continue
+		}
+		tags := splitTags(c.Labels[labelTags])
+		unreachable := false
+		for _, target := range c.Targets {
+			_, port, err := net.SplitHostPort(target)
+			if err != nil {
+				continue
+			}
+			if !a.reachable(firewalls, network, tags, port) {
+				log.Printf("Warning: firewall rules of network %s probably block %s from %v", network, target, a.sources)
+				unreachableTotal.WithLabelValues(network).Inc()
+				unreachable = true
+			}
+		}
+		result[i].Labels = make(map[string]string, len(c.Labels)+1)
+		for k, v := range c.Labels {
+			result[i].Labels[k] = v
+		}
+		result[i].Labels[LabelUnreachable] = strconv.FormatBool(unreachable)
+	}
+	return result
+}
+
+// firewalls returns the firewall rules of the project, reading them if they
+// are not cached.
+func (a *Analyzer) firewalls(ctx context.Context, project string) ([]*compute.Firewall, error) {
+	a.mu.Lock()
+	cached := a.rules[project]
+	a.mu.Unlock()
+	if cached != nil {
+		return cached.firewalls, nil
+	}
+	firewalls, err := a.api.FirewallList(ctx, project)
+	if err != nil {
+		return nil, err
+	}
+	// Evaluate rules in priority order. For equal priorities, deny rules take
+	// precedence over allow rules.
+	sort.SliceStable(firewalls, func(i, j int) bool {
+		if firewalls[i].Priority != firewalls[j].Priority {
+			return firewalls[i].Priority < firewalls[j].Priority
+		}
+		return len(firewalls[i].Denied) > 0 && len(firewalls[j].Denied) == 0
+	})
+	a.mu.Lock()
+	a.rules[project] = &rules{firewalls: firewalls, updated: now()}
+	a.mu.Unlock()
+	return firewalls, nil
+}
+
+// expire removes cached rules older than the TTL.
+func (a *Analyzer) expire() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for k, r := range a.rules {
+		if now().Sub(r.updated) >= a.ttl {
+			delete(a.rules, k)
+		}
+	}
+}
+
+// reachable returns true if the firewalls allow TCP connections to the port of
+// an instance with the given network and tags from every source range.
+func (a *Analyzer) reachable(firewalls []*compute.Firewall, network string, tags map[string]bool, port string) bool {
+	for _, source := range a.sources {
+		if !allowed(firewalls, network, tags, source, port) {
+			return false
+		}
+	}
+	return true
+}
+
+// allowed returns true if the first matching rule of the ordered firewalls
+// allows the connection. Without a matching rule, the implied rule denies all
+// ingress.
+func allowed(firewalls []*compute.Firewall, network string, tags map[string]bool, source *net.IPNet, port string) bool {
+	for _, f := range firewalls {
+		if matches(f, network, tags, source, port) {
+			return len(f.Allowed) > 0
+		}
+	}
+	return false
+}
+
+// matches returns true if the firewall rule applies to a TCP connection from
+// the source range to the port of the instance.
+func matches(f *compute.Firewall, network string, tags map[string]bool, source *net.IPNet, port string) bool {
+	if f.Disabled || (f.Direction != "" && f.Direction != "INGRESS") {
+		return false
+	}
+	if path.Base(f.Network) != network || len(f.TargetServiceAccounts) > 0 {
+		return false
+	}
+	if len(f.TargetTags) > 0 && !anyTag(f.TargetTags, tags) {
+		return false
+	}
+	if !anyContains(f.SourceRanges, source) {
+		return false
+	}
+	for _, a := range f.Allowed {
+		if protocolMatches(a.IPProtocol, a.Ports, port) {
+			return true
+		}
+	}
+	for _, d := range f.Denied {
+		if protocolMatches(d.IPProtocol, d.Ports, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// anyTag returns true if any of the targets is in tags.
+func anyTag(targets []string, tags map[string]bool) bool {
+	for _, t := range targets {
+		if tags[t] {
+			return true
+		}
+	}
+	return false
+}
+
+// anyContains returns true if any of the ranges contains all of source.
+func anyContains(ranges []string, source *net.IPNet) bool {
+	sourceOnes, sourceBits := source.Mask.Size()
+	for _, r := range ranges {
+		n := parseRange(r)
+		if n == nil {
+			continue
+		}
+		ones, bits := n.Mask.Size()
+		if bits == sourceBits && ones <= sourceOnes && n.Contains(source.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// protocolMatches returns true if the protocol and ports of a rule include TCP
+// connections to port. A rule without ports applies to all ports.
+func protocolMatches(protocol string, ports []string, port string) bool {
+	if protocol != "tcp" && protocol != "all" && protocol != "6" {
+		return false
+	}
+	if len(ports) == 0 {
+		return true
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return false
+	}
+	for _, r := range ports {
+		lo, hi, found := strings.Cut(r, "-")
+		if !found {
+			hi = lo
+		}
+		min, err1 := strconv.Atoi(lo)
+		max, err2 := strconv.Atoi(hi)
+		if err1 == nil && err2 == nil && min <= p && p <= max {
+			return true
+		}
+	}
+	return false
+}
+
+// splitTags returns the set of tags in a tag label like ",tag1,tag2,".
+func splitTags(label string) map[string]bool {
+	tags := map[string]bool{}
+	for _, t := range strings.Split(label, ",") {
+		if t != "" {
+			tags[t] = true
+		}
+	}
+	return tags
+}
+
+// Wrap returns a discovery.Service that analyzes the targets discovered by s.
+func (a *Analyzer) Wrap(s discovery.Service) *Service {
+	return &Service{service: s, process: a.Analyze}
+}
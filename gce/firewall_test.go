@@ -0,0 +1,227 @@
+package gce
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/prometheusx/promtest"
+	compute "google.golang.org/api/compute/v1"
+
+	"github.com/m-lab/gcp-service-discovery/discovery"
+)
+
+func TestAnalyzer_Analyze(t *testing.T) {
+	network := "https://www.googleapis.com/compute/v1/projects/p/global/networks/default"
+	allowTagged := &compute.Firewall{
+		Name: "allow-prometheus", Network: network, Priority: 1000, Direction: "INGRESS",
+		SourceRanges: []string{"10.128.0.0/9"},
+		TargetTags:   []string{"prometheus"},
+		Allowed:      []*compute.FirewallAllowed{{IPProtocol: "tcp", Ports: []string{"9090", "9100-9200"}}},
+	}
+	denyAll := &compute.Firewall{
+		Name: "deny-all", Network: network, Priority: 100, Direction: "INGRESS",
+		SourceRanges: []string{"0.0.0.0/0"},
+		Denied:       []*compute.FirewallDenied{{IPProtocol: "all"}},
+	}
+	tests := []struct {
+		name      string
+		firewalls []*compute.Firewall
+		err       error
+		labels    map[string]string
+		target    string
+		want      string
+	}{
+		{
+			name:      "success-allowed-by-tag-and-port-range",
+			firewalls: []*compute.Firewall{allowTagged},
+			labels:    map[string]string{labelNetwork: "default", labelTags: ",http-server,prometheus,"},
+			target:    "10.0.0.1:9150",
+			want:      "false",
+		},
+		{
+			name:      "success-wrong-port",
+			firewalls: []*compute.Firewall{allowTagged},
+			labels:    map[string]string{labelNetwork: "default", labelTags: ",prometheus,"},
+			target:    "10.0.0.1:8080",
+			want:      "true",
+		},
+		{
+			name:      "success-missing-tag",
+			firewalls: []*compute.Firewall{allowTagged},
+			labels:    map[string]string{labelNetwork: "default", labelTags: ",http-server,"},
+			target:    "10.0.0.1:9090",
+			want:      "true",
+		},
+		{
+			name:      "success-other-network",
+			firewalls: []*compute.Firewall{allowTagged},
+			labels:    map[string]string{labelNetwork: "other", labelTags: ",prometheus,"},
+			target:    "10.0.0.1:9090",
+			want:      "true",
+		},
+		{
+			name:      "success-denied-by-higher-priority",
+			firewalls: []*compute.Firewall{allowTagged, denyAll},
+			labels:    map[string]string{labelNetwork: "default", labelTags: ",prometheus,"},
+			target:    "10.0.0.1:9090",
+			want:      "true",
+		},
+		{
+			name: "success-disabled-deny",
+			firewalls: []*compute.Firewall{allowTagged, {
+				Name: "deny-all", Network: network, Priority: 100, Disabled: true,
+				SourceRanges: []string{"0.0.0.0/0"},
+				Denied:       []*compute.FirewallDenied{{IPProtocol: "all"}},
+			}},
+			labels: map[string]string{labelNetwork: "default", labelTags: ",prometheus,"},
+			target: "10.0.0.1:9090",
+			want:   "false",
+		},
+		{
+			name: "success-source-range-too-small",
+			firewalls: []*compute.Firewall{{
+				Name: "allow-some", Network: network, Priority: 1000,
+				SourceRanges: []string{"10.128.0.0/20"},
+				Allowed:      []*compute.FirewallAllowed{{IPProtocol: "tcp"}},
+			}},
+			labels: map[string]string{labelNetwork: "default"},
+			target: "10.0.0.1:9090",
+			want:   "true",
+		},
+		{
+			name: "success-egress-rule-ignored",
+			firewalls: []*compute.Firewall{{
+				Name: "allow-egress", Network: network, Priority: 1000, Direction: "EGRESS",
+				SourceRanges: []string{"0.0.0.0/0"},
+				Allowed:      []*compute.FirewallAllowed{{IPProtocol: "all"}},
+			}},
+			labels: map[string]string{labelNetwork: "default"},
+			target: "10.0.0.1:9090",
+			want:   "true",
+		},
+		{
+			name:   "success-no-network-unchanged",
+			labels: map[string]string{labelTags: ",prometheus,"},
+			target: "10.0.0.1:9090",
+		},
+		{
+			name:   "success-api-error-unchanged",
+			err:    fmt.Errorf("permission denied"),
+			labels: map[string]string{labelNetwork: "default"},
+			target: "10.0.0.1:9090",
+		},
+	}
+	_, source, _ := net.ParseCIDR("10.128.0.0/16")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeCompute{firewalls: tt.firewalls, firewallErr: tt.err}
+			a := newAnalyzer(f, "p", []*net.IPNet{source}, time.Minute)
+			configs := []discovery.StaticConfig{{Targets: []string{tt.target}, Labels: tt.labels}}
+			got := a.Analyze(context.Background(), configs)
+			value, ok := got[0].Labels[LabelUnreachable]
+			if tt.want == "" && ok {
+				t.Errorf("Analyzer.Analyze() = %v, want no %s label", got[0].Labels, LabelUnreachable)
+			}
+			if value != tt.want {
+				t.Errorf("Analyzer.Analyze() %s = %q, want %q", LabelUnreachable, value, tt.want)
+			}
+			if _, ok := configs[0].Labels[LabelUnreachable]; ok {
+				t.Errorf("Analyzer.Analyze() modified its input: %v", configs[0].Labels)
+			}
+		})
+	}
+}
+
+func TestAnalyzer_cache(t *testing.T) {
+	current := time.Date(2018, 10, 27, 21, 1, 26, 0, time.UTC)
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+
+	f := &fakeCompute{}
+	a := newAnalyzer(f, "p", nil, time.Minute)
+	configs := []discovery.StaticConfig{
+		{Targets: []string{"a:1"}, Labels: map[string]string{labelNetwork: "default"}},
+		{Targets: []string{"b:1"}, Labels: map[string]string{labelNetwork: "default"}},
+	}
+	a.Analyze(context.Background(), configs)
+	a.Analyze(context.Background(), configs)
+	if f.firewallCalls != 1 {
+		t.Errorf("Analyzer.Analyze() listed firewalls %d times, want 1", f.firewallCalls)
+	}
+	current = current.Add(time.Minute)
+	a.Analyze(context.Background(), configs)
+	if f.firewallCalls != 2 {
+		t.Errorf("Analyzer.Analyze() after ttl listed firewalls %d times, want 2", f.firewallCalls)
+	}
+}
+
+func TestAnalyzer_Wrap(t *testing.T) {
+	a := newAnalyzer(&fakeCompute{}, "p", nil, time.Minute)
+	s := a.Wrap(&fakeService{configs: []discovery.StaticConfig{
+		{Targets: []string{"a:1"}, Labels: map[string]string{labelNetwork: "default"}},
+	}})
+	got, err := s.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("Service.Discover() error = %v", err)
+	}
+	// Without source ranges, every target is reachable.
+	if got[0].Labels[LabelUnreachable] != "false" {
+		t.Errorf("Service.Discover() = %v, want reachable", got[0].Labels)
+	}
+}
+
+func Test_parseRanges(t *testing.T) {
+	tests := []struct {
+		name    string
+		ranges  []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:   "success",
+			ranges: []string{"10.128.0.0/9", "192.168.1.1", "2001:db8::/32"},
+			want:   []string{"10.128.0.0/9", "192.168.1.1/32", "2001:db8::/32"},
+		},
+		{
+			name:    "error-invalid",
+			ranges:  []string{"10.128.0.0/40"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRanges(tt.ranges)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseRanges() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("parseRanges() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i].String() != tt.want[i] {
+					t.Errorf("parseRanges()[%d] = %s, want %s", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestNewAnalyzer(t *testing.T) {
+	_, err := NewAnalyzer(context.Background(), "p", []string{"10.128.0.0/9"})
+	if err != nil {
+		t.Errorf("NewAnalyzer() error = %v", err)
+	}
+	_, err = NewAnalyzer(context.Background(), "p", []string{"not-a-range"})
+	if err == nil {
+		t.Errorf("NewAnalyzer() error = nil, want error")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	unreachableTotal.WithLabelValues("x")
+	InstanceCount.WithLabelValues("x")
+	promtest.LintMetrics(t)
+}
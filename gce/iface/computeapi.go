@@ -0,0 +1,84 @@
+// Package iface defines an interface for accessing the Compute API. This is
+// helpful for creating testable packages.
+package iface
+
+import (
+	"context"
+	"net/http"
+
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+
+	"github.com/m-lab/gcp-service-discovery/internal/apicall"
+)
+
+// api names the Compute API in quota metrics.
+const api = "compute"
+
+// instanceFields limits instance responses to the fields used by the gce logic.
+const instanceFields = googleapi.Field("machineType,tags/items,labels,scheduling/preemptible,networkInterfaces/network")
+
+// instanceListFields limits instance list responses to the fields used by the
+// gce logic.
+const instanceListFields = googleapi.Field("nextPageToken,items/*/instances(name,zone,status,machineType,tags/items,labels,scheduling/preemptible,networkInterfaces(network,networkIP))")
+
+// firewallFields limits firewall responses to the fields used by the gce logic.
+const firewallFields = googleapi.Field("nextPageToken,items(name,network,priority,direction,disabled,sourceRanges,targetTags,targetServiceAccounts,allowed,denied)")
+
+// Compute defines the interface used by the gce logic.
+type Compute interface {
+	InstanceGet(ctx context.Context, project, zone, name string) (*compute.Instance, error)
+	FirewallList(ctx context.Context, project string) ([]*compute.Firewall, error)
+	InstancePages(ctx context.Context, project, filter string, f func(list *compute.InstanceAggregatedList) error) error
+}
+
+// ComputeImpl implements the Compute interface.
+type ComputeImpl struct {
+	service *compute.Service
+}
+
+// NewCompute creates a new Compute instance.
+func NewCompute(service *compute.Service) *ComputeImpl {
+	return &ComputeImpl{service: service}
+}
+
+// InstanceGet wraps the Instances.Get method for the named instance.
+func (c *ComputeImpl) InstanceGet(ctx context.Context, project, zone, name string) (*compute.Instance, error) {
+	return apicall.Get(ctx, api,
+		func(ctx context.Context) (*compute.Instance, error) {
+			return c.service.Instances.Get(project, zone, name).Fields(instanceFields).Context(ctx).Do()
+		},
+		func(i *compute.Instance) http.Header { return i.Header })
+}
+
+// FirewallList wraps the Firewalls.List method and returns the firewall rules
+// of every page.
+func (c *ComputeImpl) FirewallList(ctx context.Context, project string) ([]*compute.Firewall, error) {
+	var rules []*compute.Firewall
+	err := apicall.Pages(ctx, api,
+		func(ctx context.Context, token string) (*compute.FirewallList, error) {
+			return c.service.Firewalls.List(project).Fields(firewallFields).PageToken(token).Context(ctx).Do()
+		},
+		func(list *compute.FirewallList) (http.Header, string) { return list.Header, list.NextPageToken },
+		func(list *compute.FirewallList) error {
+			rules = append(rules, list.Items...)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// InstancePages lists the instances of every zone that match filter and calls
+// the given function for each "page" of results.
+func (c *ComputeImpl) InstancePages(ctx context.Context, project, filter string, f func(list *compute.InstanceAggregatedList) error) error {
+	return apicall.Pages(ctx, api,
+		func(ctx context.Context, token string) (*compute.InstanceAggregatedList, error) {
+			return c.service.Instances.AggregatedList(project).Filter(filter).Fields(instanceListFields).PageToken(token).Context(ctx).Do()
+		},
+		func(list *compute.InstanceAggregatedList) (http.Header, string) {
+			return list.Header, list.NextPageToken
+		},
+		f)
+}
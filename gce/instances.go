@@ -0,0 +1,243 @@
+package gce
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	compute "google.golang.org/api/compute/v1"
+
+	"github.com/m-lab/gcp-service-discovery/apilimit"
+	"github.com/m-lab/gcp-service-discovery/credentials"
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/gce/iface"
+	"github.com/m-lab/gcp-service-discovery/internal/apicall"
+	"github.com/m-lab/gcp-service-discovery/metrics"
+)
+
+// DefaultPort is the port of instance targets unless changed by
+// Instances.Port, the port of the Prometheus node exporter.
+const DefaultPort = 9100
+
+// DefaultSelector selects the instances discovered by Instances unless
+// changed by Instances.Selector.
+var DefaultSelector = Selector{Key: "prometheus-scrape", Value: "true"}
+
+var (
+	// newComputeClient allocates a new Compute client. The indirection
+	// facilitates testing.
+	newComputeClient = compute.New
+)
+
+var (
+	// InstanceCount is the number of selected instances by status.
+	//
+	// Provides metrics:
+	//   gcp_gce_instances{status="RUNNING"}
+	// Example usage:
+	//   InstanceCount.WithLabelValues("RUNNING").Set(count)
+	InstanceCount = metrics.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gcp_gce_instances",
+			Help: "Number of selected GCE instances by status.",
+		},
+		[]string{"status"},
+	)
+)
+
+// Selector selects instances by the value of one of their GCE labels.
+// Selector implements the flag.Value interface.
+type Selector struct {
+	Key   string
+	Value string
+}
+
+// String formats the selector as key=value.
+func (s Selector) String() string {
+	return s.Key + "=" + s.Value
+}
+
+// Set parses a value of the form "key=value" or "key". A missing value
+// matches "true".
+func (s *Selector) Set(value string) error {
+	key, v, ok := strings.Cut(value, "=")
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return fmt.Errorf("invalid instance label %q: want key=value", value)
+	}
+	if !ok {
+		v = "true"
+	}
+	*s = Selector{Key: key, Value: v}
+	return nil
+}
+
+// filter returns a Compute API list filter for instances with the selected
+// label.
+func (s Selector) filter() string {
+	return fmt.Sprintf("labels.%s = %q", s.Key, s.Value)
+}
+
+// Instances discovers the Compute Engine instances of a project with a
+// selected label. Instances implements the discovery.Service interface.
+type Instances struct {
+	project string
+	api     iface.Compute
+
+	// connect creates api. It is called again to recreate the client after
+	// an authentication error.
+	connect func(ctx context.Context) error
+
+	// Selector selects the instances that are scraped. The zero value is
+	// equivalent to DefaultSelector.
+	Selector Selector
+
+	// Port is the port of every target. When zero, DefaultPort is used.
+	Port int
+}
+
+// NewInstances returns an Instances initialized with a Compute API client
+// authenticated by creds. NewInstances fails if the credentials are not found
+// before ctx is done.
+func NewInstances(ctx context.Context, project string, creds credentials.Config) (*Instances, error) {
+	s := &Instances{project: project}
+	s.connect = func(ctx context.Context) error {
+		client, err := creds.Client(ctx, compute.ComputeReadonlyScope)
+		if err != nil {
+			return fmt.Errorf("Error setting up Compute client: %s", err)
+		}
+		c, err := newComputeClient(apilimit.Client(client))
+		if err != nil {
+			return fmt.Errorf("Error setting up Compute client: %s", err)
+		}
+		s.api = iface.NewCompute(c)
+		return nil
+	}
+	if err := s.connect(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Discover lists the instances of every zone with the selected label, and
+// returns a target for the primary internal address of every running instance.
+// After an authentication error, Discover recreates its client and tries once
+// more.
+func (s *Instances) Discover(ctx context.Context) ([]discovery.StaticConfig, error) {
+	var targets []discovery.StaticConfig
+	err := credentials.Retry(ctx, "gce", s.connect, func() error {
+		var err error
+		targets, err = s.discover(ctx)
+		return err
+	})
+	return targets, err
+}
+
+// discover lists every selected instance once.
+func (s *Instances) discover(ctx context.Context) ([]discovery.StaticConfig, error) {
+	selector := s.selector()
+	var instances []*compute.Instance
+	err := s.api.InstancePages(ctx, s.project, selector.filter(), func(list *compute.InstanceAggregatedList) error {
+		// Sort scopes, so targets are returned in a stable order.
+		scopes := make([]string, 0, len(list.Items))
+		for scope := range list.Items {
+			scopes = append(scopes, scope)
+		}
+		sort.Strings(scopes)
+		for _, scope := range scopes {
+			instances = append(instances, list.Items[scope].Instances...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	discovery.CountScanned(ctx, "instances", len(instances))
+
+	InstanceCount.Reset()
+	targets := []discovery.StaticConfig{}
+	for _, instance := range instances {
+		zone := path.Base(instance.Zone)
+		object := zone + "/" + instance.Name
+		// The filter is applied again, in case the API ignored it.
+		if instance.Labels[selector.Key] != selector.Value {
+			discovery.Decide(ctx, object, false, "label missing")
+			continue
+		}
+		InstanceCount.WithLabelValues(instance.Status).Inc()
+		if instance.Status != "RUNNING" {
+			discovery.Decide(ctx, object, false, "instance "+instance.Status)
+			continue
+		}
+		if len(instance.NetworkInterfaces) == 0 || instance.NetworkInterfaces[0].NetworkIP == "" {
+			discovery.Decide(ctx, object, false, "no internal address")
+			continue
+		}
+		config := s.getLabels(instance, zone)
+		discovery.RecordOrigin(ctx, config, instance)
+		discovery.Decide(ctx, object, true, "labeled "+selector.String())
+		targets = append(targets, config)
+	}
+	return targets, nil
+}
+
+// selector returns the Selector, or DefaultSelector if it is not set.
+func (s *Instances) selector() Selector {
+	if s.Selector.Key == "" {
+		return DefaultSelector
+	}
+	return s.Selector
+}
+
+// getLabels creates a target configuration for the primary internal address of
+// an instance.
+//
+// In serialized form, the label set look like:
+//
+//	{
+//	    "labels": {
+//	        "__gce_instance": "ndt-mlab1-lga0t",
+//	        "__gce_label_prometheus_scrape": "true",
+//	        "__gce_machine_type": "n1-standard-2",
+//	        "__gce_network": "default",
+//	        "__gce_preemptible": "false",
+//	        "__gce_project": "mlab-sandbox",
+//	        "__gce_tags": ",http-server,prometheus,",
+//	        "__gce_zone": "us-central1-a"
+//	    },
+//	    "targets": [
+//	        "10.128.0.7:9100"
+//	    ]
+//	}
+func (s *Instances) getLabels(instance *compute.Instance, zone string) discovery.StaticConfig {
+	labels := instanceLabels(instance)
+	labels[LabelProject] = s.project
+	labels[LabelInstance] = instance.Name
+	labels[LabelZone] = zone
+	port := s.Port
+	if port == 0 {
+		port = DefaultPort
+	}
+	return discovery.StaticConfig{
+		Targets: []string{instance.NetworkInterfaces[0].NetworkIP + ":" + strconv.Itoa(port)},
+		Labels:  labels,
+	}
+}
+
+// Check verifies access to the Compute API by reading the first page of
+// instances. Check implements the discovery.Checker interface.
+func (s *Instances) Check(ctx context.Context) error {
+	err := apicall.FirstPage(ctx, func(ctx context.Context, f func(*compute.InstanceAggregatedList) error) error {
+		return s.api.InstancePages(ctx, s.project, s.selector().filter(), f)
+	})
+	if err != nil {
+		return fmt.Errorf("cannot list GCE instances in project %q; "+
+			"verify the Compute API is enabled and the credentials have the "+
+			"Compute Viewer role: %s", s.project, err)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package gce
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+
+	"github.com/m-lab/gcp-service-discovery/credentials"
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/internal/schematest"
+)
+
+func newFakeInstances() []*compute.Instance {
+	return []*compute.Instance{
+		{
+			Name:        "ndt-mlab1-lga0t",
+			Zone:        "https://www.googleapis.com/compute/v1/projects/mlab-sandbox/zones/us-central1-a",
+			Status:      "RUNNING",
+			MachineType: "https://www.googleapis.com/compute/v1/projects/mlab-sandbox/zones/us-central1-a/machineTypes/n1-standard-2",
+			Labels:      map[string]string{"prometheus-scrape": "true"},
+			NetworkInterfaces: []*compute.NetworkInterface{
+				{Network: "https://www.googleapis.com/compute/v1/projects/mlab-sandbox/global/networks/default", NetworkIP: "10.128.0.7"},
+			},
+		},
+		{
+			Name:   "stopped",
+			Zone:   "zones/us-central1-a",
+			Status: "TERMINATED",
+			Labels: map[string]string{"prometheus-scrape": "true"},
+		},
+		{
+			Name:   "unlabeled",
+			Zone:   "zones/us-central1-a",
+			Status: "RUNNING",
+		},
+		{
+			Name:   "no-network",
+			Zone:   "zones/us-central1-a",
+			Status: "RUNNING",
+			Labels: map[string]string{"prometheus-scrape": "true"},
+		},
+	}
+}
+
+func TestInstances_Discover(t *testing.T) {
+	tests := []struct {
+		name       string
+		api        *fakeCompute
+		port       int
+		want       []discovery.StaticConfig
+		wantFilter string
+		wantErr    bool
+	}{
+		{
+			name: "success",
+			api:  &fakeCompute{list: newFakeInstances()},
+			port: 9090,
+			want: []discovery.StaticConfig{
+				{
+					Targets: []string{"10.128.0.7:9090"},
+					Labels: map[string]string{
+						"__gce_project":                 "mlab-sandbox",
+						"__gce_instance":                "ndt-mlab1-lga0t",
+						"__gce_zone":                    "us-central1-a",
+						"__gce_machine_type":            "n1-standard-2",
+						"__gce_preemptible":             "false",
+						"__gce_network":                 "default",
+						"__gce_label_prometheus_scrape": "true",
+					},
+				},
+			},
+			wantFilter: `labels.prometheus-scrape = "true"`,
+		},
+		{
+			name:       "success-empty",
+			api:        &fakeCompute{},
+			want:       []discovery.StaticConfig{},
+			wantFilter: `labels.prometheus-scrape = "true"`,
+		},
+		{
+			name:    "failure",
+			api:     &fakeCompute{listErr: fmt.Errorf("forbidden")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Instances{project: "mlab-sandbox", api: tt.api, Port: tt.port}
+			got, err := s.Discover(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Instances.Discover() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Instances.Discover() = %v, want %v", got, tt.want)
+			}
+			if err != nil {
+				return
+			}
+			if tt.api.listFilter != tt.wantFilter {
+				t.Errorf("Instances.Discover() filter = %q, want %q", tt.api.listFilter, tt.wantFilter)
+			}
+			data, _ := json.Marshal(got)
+			if err := schematest.Validate([]byte(discovery.Schema), data); err != nil {
+				t.Errorf("Instances.Discover() = %s, which does not match the schema: %v", data, err)
+			}
+		})
+	}
+}
+
+func TestInstances_DiscoverSelector(t *testing.T) {
+	instances := newFakeInstances()
+	instances[0].Labels = map[string]string{"monitoring": "node"}
+	api := &fakeCompute{list: instances}
+	s := &Instances{project: "mlab-sandbox", api: api, Selector: Selector{Key: "monitoring", Value: "node"}}
+	got, err := s.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("Instances.Discover() error = %v", err)
+	}
+	if len(got) != 1 || got[0].Targets[0] != "10.128.0.7:9100" {
+		t.Errorf("Instances.Discover() = %v, want one target at the default port", got)
+	}
+	if want := `labels.monitoring = "node"`; api.listFilter != want {
+		t.Errorf("Instances.Discover() filter = %q, want %q", api.listFilter, want)
+	}
+}
+
+func TestInstances_DiscoverAuthRefresh(t *testing.T) {
+	s := &Instances{project: "mlab-sandbox", api: &fakeCompute{listErr: &googleapi.Error{Code: http.StatusUnauthorized}}}
+	connects := 0
+	s.connect = func(ctx context.Context) error {
+		connects++
+		s.api = &fakeCompute{list: newFakeInstances()}
+		return nil
+	}
+	got, err := s.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("Instances.Discover() error = %v", err)
+	}
+	if connects != 1 || len(got) != 1 {
+		t.Errorf("Instances.Discover() connected %d times and found %d targets, want 1 and 1", connects, len(got))
+	}
+}
+
+func TestInstances_Check(t *testing.T) {
+	s := &Instances{project: "mlab-sandbox", api: &fakeCompute{}}
+	if err := s.Check(context.Background()); err != nil {
+		t.Errorf("Instances.Check() error = %v", err)
+	}
+	s.api = &fakeCompute{listErr: fmt.Errorf("forbidden")}
+	if err := s.Check(context.Background()); err == nil {
+		t.Errorf("Instances.Check() error = nil, want error")
+	}
+}
+
+func TestNewInstances(t *testing.T) {
+	orig := newComputeClient
+	defer func() { newComputeClient = orig }()
+	if _, err := NewInstances(context.Background(), "mlab-sandbox", credentials.Config{}); err != nil {
+		t.Errorf("NewInstances() error = %v", err)
+	}
+	newComputeClient = func(client *http.Client) (*compute.Service, error) {
+		return nil, fmt.Errorf("failed to create client")
+	}
+	if _, err := NewInstances(context.Background(), "mlab-sandbox", credentials.Config{}); err == nil {
+		t.Errorf("NewInstances() error = nil, want error")
+	}
+}
+
+func TestSelector_Set(t *testing.T) {
+	s := Selector{}
+	if err := s.Set("prometheus"); err != nil || s != (Selector{"prometheus", "true"}) {
+		t.Errorf("Selector.Set() = %v, %v, want prometheus=true", s, err)
+	}
+	if err := s.Set("monitoring=node"); err != nil || s.String() != "monitoring=node" {
+		t.Errorf("Selector.Set() = %v, %v, want monitoring=node", s, err)
+	}
+	if err := s.Set("=node"); err == nil {
+		t.Errorf("Selector.Set() error = nil, want error")
+	}
+}
@@ -0,0 +1,71 @@
+package gke
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Annotation selects services with an annotation key and value.
+type Annotation struct {
+	Key   string
+	Value string
+}
+
+// String formats the annotation as key=value.
+func (a Annotation) String() string {
+	return a.Key + "=" + a.Value
+}
+
+// DefaultAnnotation selects services for federation scraping unless other
+// annotations are configured.
+var DefaultAnnotation = Annotation{Key: "gke-prometheus-federation/scrape", Value: "true"}
+
+// Annotations are the annotations that select services for scraping. A service
+// is selected when it has any of the annotations. Annotations implements the
+// flag.Value interface, so it may be set from the command line with values
+// like:
+//
+//	prometheus.io/federate=true
+//
+// The value may be omitted, e.g. "prometheus.io/federate", to select
+// annotations with the value "true".
+type Annotations []Annotation
+
+// String formats the annotations as a comma separated list.
+func (a Annotations) String() string {
+	values := make([]string, len(a))
+	for i := range a {
+		values[i] = a[i].String()
+	}
+	return strings.Join(values, ",")
+}
+
+// Set parses a value of the form "key=value" or "key", and adds it to the
+// annotations.
+func (a *Annotations) Set(value string) error {
+	key, v, ok := strings.Cut(value, "=")
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return fmt.Errorf("invalid annotation %q: want key=value", value)
+	}
+	if !ok {
+		v = "true"
+	}
+	*a = append(*a, Annotation{Key: key, Value: v})
+	return nil
+}
+
+// match returns the first of the annotations that is in the given service
+// annotations. When there are no annotations, match uses DefaultAnnotation.
+func (a Annotations) match(annotations map[string]string) (Annotation, bool) {
+	selectors := a
+	if len(selectors) == 0 {
+		selectors = Annotations{DefaultAnnotation}
+	}
+	for _, s := range selectors {
+		if v, ok := annotations[s.Key]; ok && v == s.Value {
+			return s, true
+		}
+	}
+	return Annotation{}, false
+}
@@ -0,0 +1,93 @@
+package gke
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAnnotations_Set(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  []string
+		want    Annotations
+		str     string
+		wantErr bool
+	}{
+		{
+			name:   "success",
+			values: []string{"prometheus.io/federate=yes", "example.com/scrape"},
+			want:   Annotations{{"prometheus.io/federate", "yes"}, {"example.com/scrape", "true"}},
+			str:    "prometheus.io/federate=yes,example.com/scrape=true",
+		},
+		{
+			name:   "success-empty-value",
+			values: []string{"example.com/scrape="},
+			want:   Annotations{{"example.com/scrape", ""}},
+			str:    "example.com/scrape=",
+		},
+		{
+			name:    "failure-missing-key",
+			values:  []string{"=true"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := Annotations{}
+			for _, v := range tt.values {
+				if err := a.Set(v); err != nil {
+					if !tt.wantErr {
+						t.Errorf("Annotations.Set(%q) error = %v", v, err)
+					}
+					return
+				}
+			}
+			if tt.wantErr {
+				t.Fatalf("Annotations.Set() error = nil, want error")
+			}
+			if !reflect.DeepEqual(a, tt.want) {
+				t.Errorf("Annotations.Set() = %#v, want %#v", a, tt.want)
+			}
+			if got := a.String(); got != tt.str {
+				t.Errorf("Annotations.String() = %q, want %q", got, tt.str)
+			}
+		})
+	}
+}
+
+func TestAnnotations_match(t *testing.T) {
+	tests := []struct {
+		name        string
+		selectors   Annotations
+		annotations map[string]string
+		want        bool
+	}{
+		{
+			name:        "default",
+			annotations: map[string]string{"gke-prometheus-federation/scrape": "true"},
+			want:        true,
+		},
+		{
+			name:        "default-wrong-value",
+			annotations: map[string]string{"gke-prometheus-federation/scrape": "false"},
+		},
+		{
+			name:        "any-selector",
+			selectors:   Annotations{DefaultAnnotation, {"prometheus.io/federate", "yes"}},
+			annotations: map[string]string{"prometheus.io/federate": "yes"},
+			want:        true,
+		},
+		{
+			name:        "configured-replaces-default",
+			selectors:   Annotations{{"prometheus.io/federate", "true"}},
+			annotations: map[string]string{"gke-prometheus-federation/scrape": "true"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, got := tt.selectors.match(tt.annotations); got != tt.want {
+				t.Errorf("Annotations.match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package gke
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	container "google.golang.org/api/container/v1"
+
+	"github.com/m-lab/gcp-service-discovery/discovery"
+)
+
+// labelControlPlane names the control plane component scraped by a target.
+const labelControlPlane = "__gke_control_plane"
+
+// controlPlanePaths are the metrics paths of the control plane components
+// exposed by the API server of GKE clusters. The scheduler and controller
+// manager paths are only served by clusters with control plane metrics
+// enabled.
+var controlPlanePaths = map[string]string{
+	"apiserver":          "/metrics",
+	"scheduler":          "/k8s/scheduler/metrics",
+	"controller-manager": "/k8s/controller-manager/metrics",
+}
+
+// ControlPlane names the control plane components for which targets are
+// emitted for every cluster: "apiserver", "scheduler", or
+// "controller-manager". ControlPlane implements the flag.Value interface.
+type ControlPlane []string
+
+// String formats the components as a comma separated list.
+func (c ControlPlane) String() string {
+	return strings.Join(c, ",")
+}
+
+// Set parses a comma separated list of components and adds them.
+func (c *ControlPlane) Set(value string) error {
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, ok := controlPlanePaths[name]; !ok {
+			return fmt.Errorf("unknown control plane component %q: want apiserver, scheduler, or controller-manager", name)
+		}
+		*c = append(*c, name)
+	}
+	return nil
+}
+
+// targets returns a target configuration for every component, scraped through
+// the API server endpoint of the cluster, or nil if the cluster has no
+// endpoint.
+//
+// In serialized form, the label set of the scheduler looks like:
+//
+//	{
+//	    "labels": {
+//	        "__gke_control_plane": "scheduler",
+//	        "__metrics_path__": "/k8s/scheduler/metrics",
+//	        "__scheme__": "https",
+//	        "cluster": "prometheus-federation",
+//	        "service": "kube-scheduler",
+//	        "zone": "us-central1"
+//	    },
+//	    "targets": [
+//	        "35.184.1.2:443"
+//	    ]
+//	}
+func (c ControlPlane) targets(zoneName string, cluster *container.Cluster) []discovery.StaticConfig {
+	if len(c) == 0 || cluster.Endpoint == "" {
+		return nil
+	}
+	// The GKE API reports the endpoint as an IP address without a port.
+	endpoint := strings.TrimPrefix(cluster.Endpoint, "https://")
+	if _, _, err := net.SplitHostPort(endpoint); err != nil {
+		endpoint = net.JoinHostPort(endpoint, "443")
+	}
+	configs := []discovery.StaticConfig{}
+	seen := map[string]bool{}
+	for _, component := range c {
+		if seen[component] {
+			continue
+		}
+		seen[component] = true
+		configs = append(configs, discovery.StaticConfig{
+			Targets: []string{endpoint},
+			Labels: map[string]string{
+				"service":          "kube-" + component,
+				"cluster":          cluster.Name,
+				"zone":             zoneName,
+				"__scheme__":       "https",
+				"__metrics_path__": controlPlanePaths[component],
+				labelControlPlane:  component,
+			},
+		})
+	}
+	return configs
+}
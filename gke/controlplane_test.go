@@ -0,0 +1,125 @@
+package gke
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	container "google.golang.org/api/container/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/internal/schematest"
+)
+
+func TestControlPlane_Set(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  []string
+		want    ControlPlane
+		str     string
+		wantErr bool
+	}{
+		{
+			name:   "success",
+			values: []string{"apiserver", "Scheduler, controller-manager"},
+			want:   ControlPlane{"apiserver", "scheduler", "controller-manager"},
+			str:    "apiserver,scheduler,controller-manager",
+		},
+		{
+			name:    "failure-unknown-component",
+			values:  []string{"etcd"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := ControlPlane{}
+			for _, v := range tt.values {
+				if err := c.Set(v); err != nil {
+					if !tt.wantErr {
+						t.Errorf("ControlPlane.Set(%q) error = %v", v, err)
+					}
+					return
+				}
+			}
+			if tt.wantErr {
+				t.Fatalf("ControlPlane.Set() error = nil, want error")
+			}
+			if !reflect.DeepEqual(c, tt.want) {
+				t.Errorf("ControlPlane.Set() = %#v, want %#v", c, tt.want)
+			}
+			if got := c.String(); got != tt.str {
+				t.Errorf("ControlPlane.String() = %q, want %q", got, tt.str)
+			}
+		})
+	}
+}
+
+func TestControlPlane_targets(t *testing.T) {
+	cluster := &container.Cluster{Name: "fake-cluster", Endpoint: "35.1.2.3"}
+	if got := (ControlPlane{}).targets("us-central1", cluster); got != nil {
+		t.Errorf("ControlPlane.targets() = %v, want nil", got)
+	}
+	c := ControlPlane{"apiserver"}
+	if got := c.targets("us-central1", &container.Cluster{Name: "new-cluster"}); got != nil {
+		t.Errorf("ControlPlane.targets() = %v, want nil", got)
+	}
+	c = ControlPlane{"apiserver", "apiserver"}
+	got := c.targets("us-central1", &container.Cluster{Name: "fake-cluster", Endpoint: "https://35.1.2.3:8443"})
+	want := []discovery.StaticConfig{
+		{
+			Targets: []string{"35.1.2.3:8443"},
+			Labels: map[string]string{
+				"zone":                "us-central1",
+				"service":             "kube-apiserver",
+				"cluster":             "fake-cluster",
+				"__scheme__":          "https",
+				"__metrics_path__":    "/metrics",
+				"__gke_control_plane": "apiserver",
+			},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ControlPlane.targets() = %v, want %v", got, want)
+	}
+}
+
+func TestService_DiscoverControlPlane(t *testing.T) {
+	f := &fakeGKEImpl{
+		clusters: &container.ListClustersResponse{
+			Clusters: []*container.Cluster{{Name: "fake-cluster", Location: "us-central1", Endpoint: "35.1.2.3"}},
+		},
+		Interface: fake.NewSimpleClientset(),
+	}
+	s := &Service{
+		project:        "fake-project",
+		gke:            f,
+		AggregatedList: true,
+		ControlPlane:   ControlPlane{"apiserver", "scheduler", "controller-manager"},
+	}
+	got, err := s.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("Service.Discover() error = %v", err)
+	}
+	paths := map[string]string{}
+	for _, c := range got {
+		if c.Targets[0] != "35.1.2.3:443" || c.Labels["cluster"] != "fake-cluster" || c.Labels["__gke_release_channel"] != "UNSPECIFIED" {
+			t.Errorf("Service.Discover() returned unexpected target %v", c)
+		}
+		paths[c.Labels["__gke_control_plane"]] = c.Labels["__metrics_path__"]
+	}
+	wantPaths := map[string]string{
+		"apiserver":          "/metrics",
+		"scheduler":          "/k8s/scheduler/metrics",
+		"controller-manager": "/k8s/controller-manager/metrics",
+	}
+	if !reflect.DeepEqual(paths, wantPaths) {
+		t.Errorf("Service.Discover() metrics paths = %v, want %v", paths, wantPaths)
+	}
+	data, _ := json.Marshal(got)
+	if err := schematest.Validate([]byte(discovery.Schema), data); err != nil {
+		t.Errorf("Service.Discover() = %s, which does not match the schema: %v", data, err)
+	}
+}
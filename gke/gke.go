@@ -4,17 +4,31 @@ package gke
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/m-lab/go/rtx"
+	"github.com/prometheus/client_golang/prometheus"
 
+	"github.com/m-lab/gcp-service-discovery/apilimit"
+	"github.com/m-lab/gcp-service-discovery/credentials"
 	"github.com/m-lab/gcp-service-discovery/gke/iface"
+	"github.com/m-lab/gcp-service-discovery/internal/apicall"
+	"github.com/m-lab/gcp-service-discovery/transport"
 
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
 	compute "google.golang.org/api/compute/v1"
 	container "google.golang.org/api/container/v1"
 	typesv1 "k8s.io/api/core/v1"
@@ -25,6 +39,7 @@ import (
 	"k8s.io/client-go/tools/clientcmd/api"
 
 	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/metrics"
 )
 
 var (
@@ -33,6 +48,38 @@ var (
 	gkeScopes = []string{compute.CloudPlatformScope}
 )
 
+var (
+	// ClusterInfo reports the type and release channel of every cluster
+	// checked during the most recent successful discovery of every Service,
+	// with a value of 1.
+	//
+	// Provides metrics:
+	//   gcp_gke_cluster_info{cluster="prometheus-federation", location="us-central1", autopilot="false", release_channel="REGULAR"}
+	// Example usage:
+	//   ClusterInfo.WithLabelValues("prometheus-federation", "us-central1", "false", "REGULAR").Set(1)
+	ClusterInfo = metrics.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gcp_gke_cluster_info",
+			Help: "Type and release channel of every GKE cluster.",
+		},
+		[]string{"cluster", "location", "autopilot", "release_channel"},
+	)
+
+	// NodePoolCount is the current number of node pools in every cluster.
+	//
+	// Provides metrics:
+	//   gcp_gke_cluster_node_pools{cluster="prometheus-federation", location="us-central1"}
+	// Example usage:
+	//   NodePoolCount.WithLabelValues("prometheus-federation", "us-central1").Set(count)
+	NodePoolCount = metrics.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gcp_gke_cluster_node_pools",
+			Help: "Number of node pools in every GKE cluster.",
+		},
+		[]string{"cluster", "location"},
+	)
+)
+
 // Service contains necessary data for service discovery in GKE.
 type Service struct {
 	// The GCP project id.
@@ -43,31 +90,175 @@ type Service struct {
 
 	gke iface.GKE
 
+	// connect creates client and gke. It is called again to recreate the
+	// clients after an authentication error.
+	connect func(ctx context.Context) error
+
 	// cache is temporary storage to determine whether to update.
 	cache string
+
+	// ReadyLabel adds the discovery.LabelReady label to every target, which is
+	// "true" when the service has at least one ready endpoint.
+	ReadyLabel bool
+
+	// AggregatedList lists clusters in all locations with a single API call,
+	// instead of listing compute zones and then clusters in every zone.
+	AggregatedList bool
+
+	// ZoneCacheTTL is how long the list of compute zones is reused before it
+	// is listed again. When zero, zones are listed on every call to Discover.
+	ZoneCacheTTL time.Duration
+
+	// MaxConcurrency is the maximum number of zones, or clusters when using
+	// AggregatedList, that are checked at the same time. Values less than one
+	// check them sequentially.
+	MaxConcurrency int
+
+	// APIServerProxy emits targets that scrape every service through the
+	// Kubernetes API server proxy of its cluster, for services that are not
+	// externally reachable. Scrape jobs for these targets must authenticate to
+	// the API server.
+	APIServerProxy bool
+
+	// Pods adds targets for running pods annotated with
+	// prometheus.io/scrape: "true", at the port of the prometheus.io/port
+	// annotation, or the first container port, and the path of the
+	// prometheus.io/path annotation. Pods are scraped at their pod IP, or
+	// through the API server proxy with APIServerProxy.
+	Pods bool
+
+	// Nodes adds a target for the internal IP and NodePort of every node, e.g.
+	// for the node exporter. Nodes are scraped through the API server proxy
+	// with APIServerProxy.
+	Nodes bool
+
+	// NodePort is the port of node targets. When zero, DefaultNodePort is used.
+	NodePort int
+
+	// MCS labels the targets of Services that belong to multi-cluster
+	// services, i.e. Services with a ServiceExport, and Services derived from
+	// a ServiceImport, with the namespace/name of their multi-cluster service.
+	MCS bool
+
+	// MCSDedup skips Services derived from a ServiceImport. A derived Service
+	// load balances across the exporting clusters, whose Services are already
+	// scraped, so scraping it too counts their metrics twice.
+	MCSDedup bool
+
+	// ControlPlane adds targets for the metrics endpoints of the named control
+	// plane components of every cluster, scraped through its API server.
+	// Scrape jobs for these targets must authenticate to the API server.
+	ControlPlane ControlPlane
+
+	// EndpointLabels adds the API server endpoint and the SHA-256 fingerprint
+	// of the CA certificate of its cluster to every target, so consumers can
+	// choose the credentials to connect back to the cluster.
+	EndpointLabels bool
+
+	// Annotations select the services that are scraped. When empty, services
+	// with DefaultAnnotation are scraped.
+	Annotations Annotations
+
+	// KubeTimeout limits every Kubernetes API call, so that a hung API server
+	// does not use the whole discovery deadline. When zero, calls are only
+	// limited by the context passed to Discover.
+	KubeTimeout time.Duration
+
+	// clientsMu protects clients, which are used by concurrent cluster checks.
+	clientsMu sync.Mutex
+	// clients caches a Kubernetes client for every cluster, by location and
+	// name, so connections are reused between calls to Discover.
+	clients map[string]*kubeClient
+
+	// zonesMu protects zones and zonesUpdated, which are discarded by
+	// Invalidate during Discover.
+	zonesMu sync.Mutex
+	// zones caches the most recent list of compute zones.
+	zones []string
+	// zonesUpdated is when zones was last listed.
+	zonesUpdated time.Time
+
+	// seriesMu protects series and checked, which are updated by concurrent
+	// cluster checks.
+	seriesMu sync.Mutex
+	// series are the clusters in ClusterInfo and NodePoolCount after the most
+	// recent successful discovery, and checked the clusters of the current
+	// discovery. The metrics are shared by every Service, so only the series
+	// of this Service are deleted when its clusters disappear.
+	series  map[clusterSeries]bool
+	checked map[clusterSeries]bool
+}
+
+// clusterSeries are the label values of a cluster in ClusterInfo.
+type clusterSeries struct {
+	cluster, location, autopilot, releaseChannel string
 }
 
-// MustNewService creates a new GKE service discovery instance. The function
-// exits if an error occurs during setup.
-func MustNewService(project string) *Service {
-	var err error
+// DefaultZoneCacheTTL is the default ZoneCacheTTL. The list of compute zones
+// changes very rarely.
+const DefaultZoneCacheTTL = 24 * time.Hour
 
+// DefaultKubeTimeout is the default KubeTimeout.
+const DefaultKubeTimeout = time.Minute
+
+// NewService creates a new GKE service discovery instance that authenticates
+// to the GCP and Kubernetes APIs with creds. NewService fails if the
+// credentials are not found before ctx is done.
+func NewService(ctx context.Context, project string, creds credentials.Config) (*Service, error) {
 	s := &Service{
-		project: project,
+		project:      project,
+		ZoneCacheTTL: DefaultZoneCacheTTL,
+		KubeTimeout:  DefaultKubeTimeout,
 	}
-	// Create a new authenticated HTTP client.
-	s.client, err = google.DefaultClient(oauth2.NoContext, gkeScopes...)
-	rtx.Must(err, "Error setting up default client")
+	s.connect = func(ctx context.Context) error {
+		// Create a new authenticated HTTP client.
+		ts, err := creds.TokenSource(ctx, gkeScopes...)
+		if err != nil {
+			return fmt.Errorf("Error setting up credentials: %w", err)
+		}
+		client := apilimit.Client(oauth2.NewClient(transport.Context(context.Background()), ts))
 
-	// Create a new Compute service instance.
-	computeService, err := compute.New(s.client)
-	rtx.Must(err, "Error setting up a Compute API client")
+		// Create a new Compute service instance.
+		computeService, err := compute.New(client)
+		if err != nil {
+			return fmt.Errorf("Error setting up a Compute API client: %w", err)
+		}
 
-	// Create a new Container Engine service object.
-	containerService, err := container.New(s.client)
-	rtx.Must(err, "Error setting up a Container API client")
+		// Create a new Container Engine service object.
+		containerService, err := container.New(client)
+		if err != nil {
+			return fmt.Errorf("Error setting up a Container API client: %w", err)
+		}
+
+		// Kubernetes clients use the gcp auth provider for default credentials.
+		if creds.IsDefault() {
+			ts = nil
+		}
+		s.client = client
+		s.gke = iface.NewGKE(project, computeService, containerService,
+			func(c *container.Cluster) (kubernetes.Interface, error) {
+				return getKubeClient(ts, c)
+			})
+		// Forget Kubernetes clients that use the previous credentials.
+		s.clientsMu.Lock()
+		s.clients = nil
+		s.clientsMu.Unlock()
+		return nil
+	}
+	if err := s.connect(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
 
-	s.gke = iface.NewGKE(project, computeService, containerService, getKubeClient)
+// MustNewService is like NewService, but exits if an error occurs during
+// setup.
+//
+// Deprecated: Use NewService and handle the error. No other source has a Must
+// constructor, and MustNewService is removed in v2.
+func MustNewService(ctx context.Context, project string, creds credentials.Config) *Service {
+	s, err := NewService(ctx, project, creds)
+	rtx.Must(err, "Failed to create a GKE service")
 	return s
 }
 
@@ -75,27 +266,81 @@ func MustNewService(project string) *Service {
 // check every GCE zone for Container Engine (gke) clusters, and checks each
 // cluster for services annotated for federated scraping.
 //
-// Collect returns every gke cluster with a k8s service annotation that equals:
+// Collect returns every gke cluster with a k8s service annotation that matches
+// one of Annotations, by default:
 //    gke-prometheus-federation/scrape: true
+//
+// After an authentication error, Discover recreates its clients and tries once
+// more.
 func (s *Service) Discover(ctx context.Context) ([]discovery.StaticConfig, error) {
-	targets := []discovery.StaticConfig{}
+	var targets []discovery.StaticConfig
+	err := credentials.Retry(ctx, "gke", s.connect, func() error {
+		var err error
+		targets, err = s.discover(ctx)
+		return err
+	})
+	return targets, err
+}
+
+// discover checks every cluster once, and then forgets the metrics of clusters
+// that no longer exist.
+func (s *Service) discover(ctx context.Context) ([]discovery.StaticConfig, error) {
+	s.seriesMu.Lock()
+	s.checked = map[clusterSeries]bool{}
+	s.seriesMu.Unlock()
+	targets, err := s.discoverClusters(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.deleteStaleSeries()
+	return targets, nil
+}
+
+// discoverClusters checks every cluster in every location.
+func (s *Service) discoverClusters(ctx context.Context) ([]discovery.StaticConfig, error) {
+	if s.AggregatedList {
+		return s.findTargetsFromAllLocations(ctx)
+	}
 
 	// Get all zones in a project.
 	zones, err := s.getZoneList(ctx)
 	if err != nil {
 		return nil, err
 	}
-	for _, zone := range zones {
-		t, err := s.findTargetsFromZone(ctx, zone)
-		if err != nil {
-			return nil, err
-		}
-		targets = append(targets, t...)
+	discovery.CountScanned(ctx, "zones", len(zones))
+	return s.collect(len(zones), func(i int) ([]discovery.StaticConfig, error) {
+		return s.findTargetsFromZone(ctx, zones[i])
+	})
+}
+
+// Check verifies access to the Compute and Container Engine APIs by reading the
+// first page of zones and the clusters in all locations. Check implements the
+// discovery.Checker interface.
+func (s *Service) Check(ctx context.Context) error {
+	err := apicall.FirstPage(ctx, s.gke.ZonePages)
+	if err != nil {
+		return fmt.Errorf("cannot list compute zones in project %q; "+
+			"verify the Compute Engine API is enabled and the credentials "+
+			"have the Compute Viewer role: %s", s.project, err)
 	}
-	return targets, err
+	// The "-" zone matches clusters in all locations.
+	_, err = s.gke.ClusterList(ctx, "-")
+	if err != nil {
+		return fmt.Errorf("cannot list GKE clusters in project %q; "+
+			"verify the Kubernetes Engine API is enabled and the credentials "+
+			"have the Kubernetes Engine Cluster Viewer role: %s", s.project, err)
+	}
+	return nil
 }
 
+// getZoneList returns the names of all compute zones in the project. The list
+// is cached for ZoneCacheTTL.
 func (s *Service) getZoneList(ctx context.Context) ([]string, error) {
+	s.zonesMu.Lock()
+	defer s.zonesMu.Unlock()
+	if s.zones != nil && time.Since(s.zonesUpdated) < s.ZoneCacheTTL {
+		return s.zones, nil
+	}
 	zoneNames := []string{}
 	err := s.gke.ZonePages(ctx, func(zones *compute.ZoneList) error {
 		for _, zone := range zones.Items {
@@ -103,7 +348,21 @@ func (s *Service) getZoneList(ctx context.Context) ([]string, error) {
 		}
 		return nil
 	})
-	return zoneNames, err
+	if err != nil {
+		return nil, err
+	}
+	s.zones = zoneNames
+	s.zonesUpdated = time.Now()
+	return zoneNames, nil
+}
+
+// Invalidate discards the cached list of compute zones, so the next call to
+// Discover lists zones again. The discovery Manager calls Invalidate on
+// reload, so new zones are found without waiting for ZoneCacheTTL.
+func (s *Service) Invalidate() {
+	s.zonesMu.Lock()
+	defer s.zonesMu.Unlock()
+	s.zones = nil
 }
 
 func (s *Service) findTargetsFromZone(ctx context.Context, zoneName string) ([]discovery.StaticConfig, error) {
@@ -114,17 +373,11 @@ func (s *Service) findTargetsFromZone(ctx context.Context, zoneName string) ([]d
 	if err != nil {
 		return nil, err
 	}
+	discovery.CountScanned(ctx, "clusters", len(clusters.Clusters))
 
 	// Look for targets from every cluster.
 	for _, cluster := range clusters.Clusters {
-		// Use information from the GKE cluster to create a k8s API client.
-
-		// TODO: consider using new interface, like getKubeClient(cluster *container.Cluster)
-		kubeClient, err := s.gke.GetKubeClient(cluster)
-		if err != nil {
-			return nil, err
-		}
-		t, err := checkCluster(kubeClient, zoneName, cluster.Name)
+		t, err := s.findTargetsFromCluster(ctx, zoneName, cluster)
 		if err != nil {
 			return nil, err
 		}
@@ -133,33 +386,362 @@ func (s *Service) findTargetsFromZone(ctx context.Context, zoneName string) ([]d
 	return targets, nil
 }
 
+// findTargetsFromAllLocations lists clusters in every zone and region with a
+// single API call and checks each for targets.
+func (s *Service) findTargetsFromAllLocations(ctx context.Context) ([]discovery.StaticConfig, error) {
+	// The "-" zone matches clusters in all locations.
+	clusters, err := s.gke.ClusterList(ctx, "-")
+	if err != nil {
+		return nil, err
+	}
+	discovery.CountScanned(ctx, "clusters", len(clusters.Clusters))
+	return s.collect(len(clusters.Clusters), func(i int) ([]discovery.StaticConfig, error) {
+		cluster := clusters.Clusters[i]
+		return s.findTargetsFromCluster(ctx, cluster.Location, cluster)
+	})
+}
+
+// collect calls find for every index less than n, running at most
+// MaxConcurrency calls at once, and returns all results in index order. If any
+// call fails, collect returns the first error.
+func (s *Service) collect(n int, find func(i int) ([]discovery.StaticConfig, error)) ([]discovery.StaticConfig, error) {
+	limit := s.MaxConcurrency
+	if limit < 1 {
+		limit = 1
+	}
+	results := make([][]discovery.StaticConfig, n)
+	errs := make([]error, n)
+	sem := make(chan struct{}, limit)
+	wg := sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = find(i)
+			<-sem
+		}(i)
+	}
+	wg.Wait()
+	targets := []discovery.StaticConfig{}
+	for i := range results {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		targets = append(targets, results[i]...)
+	}
+	return targets, nil
+}
+
+func (s *Service) findTargetsFromCluster(ctx context.Context, zoneName string, cluster *container.Cluster) ([]discovery.StaticConfig, error) {
+	// Use information from the GKE cluster to create a k8s API client.
+	client, err := s.getKubeClient(zoneName, cluster)
+	if err != nil {
+		return nil, err
+	}
+	targets, err := s.checkCluster(ctx, client, zoneName, cluster)
+	if err == nil || !isRotationError(err) {
+		return targets, err
+	}
+
+	// The cluster CA certificate or endpoint may have changed since the
+	// cluster was listed. Read the cluster again and retry once.
+	log.Printf("%s - %s - Refreshing cluster credentials after error: %s", zoneName, cluster.Name, err)
+	s.forgetKubeClient(zoneName, cluster)
+	cluster, err = s.gke.ClusterGet(ctx, clusterLocation(zoneName, cluster), cluster.Name)
+	if err != nil {
+		return nil, err
+	}
+	client, err = s.getKubeClient(zoneName, cluster)
+	if err != nil {
+		return nil, err
+	}
+	return s.checkCluster(ctx, client, zoneName, cluster)
+}
+
+// kubeClient is a cached Kubernetes client, and the cluster endpoint and CA
+// certificate used to create it.
+type kubeClient struct {
+	endpoint string
+	caCert   string
+	client   kubernetes.Interface
+}
+
+// clusterLocation returns the zone or region of the cluster.
+func clusterLocation(zoneName string, cluster *container.Cluster) string {
+	if cluster.Location != "" {
+		return cluster.Location
+	}
+	return zoneName
+}
+
+// getKubeClient returns the cached client for the cluster, or creates a new
+// client if none is cached or the cluster endpoint or CA certificate changed.
+func (s *Service) getKubeClient(zoneName string, cluster *container.Cluster) (kubernetes.Interface, error) {
+	key := clusterLocation(zoneName, cluster) + "/" + cluster.Name
+	caCert := ""
+	if cluster.MasterAuth != nil {
+		caCert = cluster.MasterAuth.ClusterCaCertificate
+	}
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	if c := s.clients[key]; c != nil && c.endpoint == cluster.Endpoint && c.caCert == caCert {
+		return c.client, nil
+	}
+	client, err := s.gke.GetKubeClient(cluster)
+	if err != nil {
+		return nil, err
+	}
+	if s.clients == nil {
+		s.clients = map[string]*kubeClient{}
+	}
+	s.clients[key] = &kubeClient{endpoint: cluster.Endpoint, caCert: caCert, client: client}
+	return client, nil
+}
+
+// forgetKubeClient discards the cached client for the cluster.
+func (s *Service) forgetKubeClient(zoneName string, cluster *container.Cluster) {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	delete(s.clients, clusterLocation(zoneName, cluster)+"/"+cluster.Name)
+}
+
+// isRotationError returns true if err suggests that the cluster CA certificate
+// or endpoint changed since the client was created.
+func isRotationError(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	var op *net.OpError
+	return errors.As(err, &unknownAuthority) || errors.As(err, &invalid) ||
+		errors.As(err, &hostname) || (errors.As(err, &op) && op.Op == "dial")
+}
+
+// setClusterMetrics sets the metrics of a cluster, and records it as checked by
+// the current discovery.
+func (s *Service) setClusterMetrics(c clusterSeries, nodePools int) {
+	ClusterInfo.WithLabelValues(c.cluster, c.location, c.autopilot, c.releaseChannel).Set(1)
+	NodePoolCount.WithLabelValues(c.cluster, c.location).Set(float64(nodePools))
+	s.seriesMu.Lock()
+	defer s.seriesMu.Unlock()
+	if s.checked != nil {
+		s.checked[c] = true
+	}
+}
+
+// deleteStaleSeries deletes the metrics of clusters that were set by a
+// previous discovery, but not checked by the current one.
+func (s *Service) deleteStaleSeries() {
+	s.seriesMu.Lock()
+	defer s.seriesMu.Unlock()
+	locations := map[[2]string]bool{}
+	for c := range s.checked {
+		locations[[2]string{c.cluster, c.location}] = true
+	}
+	for c := range s.series {
+		if s.checked[c] {
+			continue
+		}
+		ClusterInfo.DeleteLabelValues(c.cluster, c.location, c.autopilot, c.releaseChannel)
+		// A cluster that changed type or release channel keeps its node pools.
+		if !locations[[2]string{c.cluster, c.location}] {
+			NodePoolCount.DeleteLabelValues(c.cluster, c.location)
+		}
+	}
+	s.series, s.checked = s.checked, nil
+}
+
 // checkCluster uses the kubernetes API to search for GKE targets.
-func checkCluster(k kubernetes.Interface, zoneName, clusterName string) ([]discovery.StaticConfig, error) {
+func (s *Service) checkCluster(ctx context.Context, k kubernetes.Interface, zoneName string, cluster *container.Cluster) ([]discovery.StaticConfig, error) {
 	configs := []discovery.StaticConfig{}
+	clusterName := cluster.Name
+	labels := clusterLabels(cluster)
+	if s.EndpointLabels {
+		for k, v := range endpointLabels(cluster) {
+			labels[k] = v
+		}
+	}
+	s.setClusterMetrics(clusterSeries{clusterName, zoneName, labels[labelAutopilot], labels[labelReleaseChannel]}, len(cluster.NodePools))
+
+	var mcs *mcsServices
+	if s.MCS || s.MCSDedup {
+		var err error
+		mcs, err = s.checkMCS(ctx, k)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	// List all services in the k8s cluster.
-	services, err := k.CoreV1().Services("").List(context.Background(), metav1.ListOptions{})
+	listCtx, cancel := s.kubeContext(ctx)
+	services, err := k.CoreV1().Services("").List(listCtx, metav1.ListOptions{})
+	cancel()
 	if err != nil {
 		return nil, err
 	}
 
 	log.Printf("%s - %s - There are %d services in the cluster\n",
 		zoneName, clusterName, len(services.Items))
+	discovery.CountScanned(ctx, "services", len(services.Items))
 
 	// Check each service, and collect targets that have matching annotations.
 	for _, service := range services.Items {
+		object := zoneName + "/" + clusterName + "/" + service.Namespace + "/" + service.Name
 		// Federation scraping is opt-in only.
-		if service.ObjectMeta.Annotations["gke-prometheus-federation/scrape"] != "true" {
+		annotation, ok := s.Annotations.match(service.ObjectMeta.Annotations)
+		if !ok {
+			discovery.Decide(ctx, object, false, "annotation missing")
+			continue
+		}
+		mcsService, derived := "", false
+		if mcs != nil {
+			mcsService, derived = mcs.lookup(service.Namespace, service.Name)
+		}
+		if derived && s.MCSDedup {
+			discovery.Decide(ctx, object, false, "derived from ServiceImport "+mcsService)
 			continue
 		}
 		target := findTargetAndLabels(zoneName, clusterName, service)
-		if target != nil {
-			configs = append(configs, *target)
+		reason := "no external address"
+		if s.APIServerProxy {
+			target = findProxyTarget(zoneName, cluster, service)
+			reason = "no ports"
+		}
+		if target == nil {
+			discovery.Decide(ctx, object, false, reason)
+			continue
+		}
+		for k, v := range labels {
+			target.Labels[k] = v
+		}
+		if s.MCS && mcsService != "" {
+			target.Labels[labelMCSService] = mcsService
+		}
+		if s.ReadyLabel {
+			readyCtx, cancel := s.kubeContext(ctx)
+			target.Labels[discovery.LabelReady] = serviceReady(readyCtx, k, service)
+			cancel()
+		}
+		discovery.Decide(ctx, object, true, "annotated "+annotation.String())
+		discovery.RecordOrigin(ctx, *target, service)
+		configs = append(configs, *target)
+	}
+
+	if s.Pods {
+		pods, err := s.checkPods(ctx, k, zoneName, cluster, labels)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, pods...)
+	}
+
+	if s.Nodes {
+		nodes, err := s.checkNodes(ctx, k, zoneName, cluster, labels)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, nodes...)
+	}
+
+	// Targets scraped through the API server proxy are unavailable while the
+	// control plane is upgraded.
+	if s.APIServerProxy {
+		for _, target := range configs {
+			recordLifecycle(ctx, target, "cluster "+clusterName, cluster.Status)
+		}
+	}
+
+	for _, target := range s.ControlPlane.targets(zoneName, cluster) {
+		for k, v := range labels {
+			target.Labels[k] = v
 		}
+		object := zoneName + "/" + clusterName + "/control-plane/" + target.Labels[labelControlPlane]
+		discovery.Decide(ctx, object, true, "control plane component")
+		discovery.RecordOrigin(ctx, target, map[string]string{"cluster": clusterName, "endpoint": cluster.Endpoint})
+		recordLifecycle(ctx, target, "cluster "+clusterName, cluster.Status)
+		configs = append(configs, target)
 	}
 	return configs, nil
 }
 
+// kubeContext returns a context for a single Kubernetes API call, which is
+// canceled when ctx is done or after KubeTimeout.
+func (s *Service) kubeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.KubeTimeout > 0 {
+		return context.WithTimeout(ctx, s.KubeTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// Labels added to every target describing its cluster.
+const (
+	labelAutopilot      = "__gke_autopilot"
+	labelReleaseChannel = "__gke_release_channel"
+	labelNodePools      = "__gke_node_pools"
+	labelEndpoint       = "__gke_endpoint"
+	labelCAFingerprint  = "__gke_ca_sha256"
+)
+
+// clusterLabels returns labels describing whether the cluster is an Autopilot
+// or Standard cluster, its release channel, and its number of node pools.
+func clusterLabels(cluster *container.Cluster) map[string]string {
+	autopilot := cluster.Autopilot != nil && cluster.Autopilot.Enabled
+	channel := "UNSPECIFIED"
+	if cluster.ReleaseChannel != nil && cluster.ReleaseChannel.Channel != "" {
+		channel = cluster.ReleaseChannel.Channel
+	}
+	return map[string]string{
+		labelAutopilot:      strconv.FormatBool(autopilot),
+		labelReleaseChannel: channel,
+		labelNodePools:      strconv.Itoa(len(cluster.NodePools)),
+	}
+}
+
+// endpointLabels returns labels with the API server endpoint of the cluster and
+// the SHA-256 fingerprint of its CA certificate in lowercase hex. Labels are
+// omitted if the cluster has no endpoint, or no valid CA certificate.
+func endpointLabels(cluster *container.Cluster) map[string]string {
+	labels := map[string]string{}
+	if cluster.Endpoint != "" {
+		labels[labelEndpoint] = cluster.Endpoint
+	}
+	if cluster.MasterAuth == nil {
+		return labels
+	}
+	// The cluster CA certificate is base64 encoded PEM from the GKE API.
+	data, err := base64.StdEncoding.DecodeString(cluster.MasterAuth.ClusterCaCertificate)
+	if err != nil {
+		data, err = base64.URLEncoding.DecodeString(cluster.MasterAuth.ClusterCaCertificate)
+	}
+	if err != nil {
+		return labels
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return labels
+	}
+	sum := sha256.Sum256(block.Bytes)
+	labels[labelCAFingerprint] = hex.EncodeToString(sum[:])
+	return labels
+}
+
+// serviceReady returns "true" when the given service has at least one ready
+// endpoint, "false" when it has none, and "unknown" if the endpoints cannot be
+// read.
+func serviceReady(ctx context.Context, k kubernetes.Interface, service typesv1.Service) string {
+	ep, err := k.CoreV1().Endpoints(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+	if err != nil {
+		log.Printf("Failed to get endpoints for %s/%s: %s", service.Namespace, service.Name, err)
+		return "unknown"
+	}
+	for _, subset := range ep.Subsets {
+		if len(subset.Addresses) > 0 {
+			return "true"
+		}
+	}
+	return "false"
+}
+
 // findTargetAndLabels identifies the first target (first port) per service and
 // returns a target configuration for use with Prometheus file service discovery.
 func findTargetAndLabels(zoneName, clusterName string, service typesv1.Service) *discovery.StaticConfig {
@@ -201,9 +783,39 @@ func findTargetAndLabels(zoneName, clusterName string, service typesv1.Service)
 	}
 }
 
+// findProxyTarget returns a target configuration that scrapes the first port of
+// the service through the API server proxy of the cluster. The target is the
+// API server, and the metrics path names the service, e.g.
+//
+//	/api/v1/namespaces/default/services/prometheus:9090/proxy/metrics
+func findProxyTarget(zoneName string, cluster *container.Cluster, service typesv1.Service) *discovery.StaticConfig {
+	if len(service.Spec.Ports) == 0 || cluster.Endpoint == "" {
+		return nil
+	}
+	// The GKE API reports the endpoint as an IP address without a port.
+	endpoint := strings.TrimPrefix(cluster.Endpoint, "https://")
+	if _, _, err := net.SplitHostPort(endpoint); err != nil {
+		endpoint = net.JoinHostPort(endpoint, "443")
+	}
+	path := fmt.Sprintf("/api/v1/namespaces/%s/services/%s:%d/proxy/metrics",
+		service.Namespace, service.Name, service.Spec.Ports[0].Port)
+	return &discovery.StaticConfig{
+		Targets: []string{endpoint},
+		Labels: map[string]string{
+			"service":               service.ObjectMeta.Name,
+			"cluster":               cluster.Name,
+			"zone":                  zoneName,
+			"__scheme__":            "https",
+			"__metrics_path__":      path,
+			"__gke_apiserver_proxy": "true",
+		},
+	}
+}
+
 // getKubeClient converts a container engine API Cluster object into
-// a kubernetes API client instance.
-func getKubeClient(c *container.Cluster) (kubernetes.Interface, error) {
+// a kubernetes API client instance. Requests are authenticated with tokens
+// from ts, or with Application Default Credentials when ts is nil.
+func getKubeClient(ts oauth2.TokenSource, c *container.Cluster) (kubernetes.Interface, error) {
 	// The cluster CA certificate is base64 encoded from the GKE API.
 	rawCaCert, err := base64.URLEncoding.DecodeString(c.MasterAuth.ClusterCaCertificate)
 	if err != nil {
@@ -253,7 +865,18 @@ func getKubeClient(c *container.Cluster) (kubernetes.Interface, error) {
 			ClusterInfo: api.Cluster{Server: ""},
 		})
 	restConfig, err := defClient.ClientConfig()
-	rtx.Must(err, "Failed to get REST config from DefaultClientConfig")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get REST config from DefaultClientConfig: %w", err)
+	}
+	restConfig.Dial = transport.DialContext
+	restConfig.Proxy = http.ProxyFromEnvironment
+	if ts != nil {
+		restConfig.AuthProvider = nil
+		restConfig.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+			return &oauth2.Transport{Source: ts, Base: rt}
+		})
+	}
+	restConfig.Wrap(apilimit.Wrap)
 
 	// Creates the k8s clientset.
 	return kubernetes.NewForConfig(restConfig)
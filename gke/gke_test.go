@@ -2,11 +2,27 @@ package gke
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 
+	"github.com/m-lab/gcp-service-discovery/credentials"
 	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/internal/schematest"
+	"github.com/m-lab/go/prometheusx/promtest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	compute "google.golang.org/api/compute/v1"
 	container "google.golang.org/api/container/v1"
 	apiv1 "k8s.io/api/core/v1"
@@ -14,6 +30,7 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
 	k8stesting "k8s.io/client-go/testing"
 )
 
@@ -25,9 +42,15 @@ type fakeGKEImpl struct {
 	zonePagesError   error
 	clusterListError error
 	kubeClientError  error
+	zonePagesCalls   int
+	kubeClientCalls  int
+	cluster          *container.Cluster
+	clusterGetError  error
+	clusterGetCalls  int
 }
 
 func (f *fakeGKEImpl) ZonePages(ctx context.Context, pageFunc func(zones *compute.ZoneList) error) error {
+	f.zonePagesCalls++
 	if f.zonePagesError != nil {
 		return f.zonePagesError
 	}
@@ -41,15 +64,88 @@ func (f *fakeGKEImpl) ClusterList(ctx context.Context, zone string) (*container.
 	return f.clusters, nil
 }
 
+func (f *fakeGKEImpl) ClusterGet(ctx context.Context, location, name string) (*container.Cluster, error) {
+	f.clusterGetCalls++
+	if f.clusterGetError != nil {
+		return nil, f.clusterGetError
+	}
+	return f.cluster, nil
+}
+
 func (f *fakeGKEImpl) GetKubeClient(c *container.Cluster) (kubernetes.Interface, error) {
+	f.kubeClientCalls++
 	if f.kubeClientError != nil {
 		return nil, f.kubeClientError
 	}
 	return f.Interface, nil
 }
 
+func TestNewService(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		creds   credentials.Config
+		wantErr bool
+	}{
+		{
+			name: "success",
+			ctx:  context.Background(),
+		},
+		{
+			name:    "error-missing-file",
+			ctx:     context.Background(),
+			creds:   credentials.Config{File: "/does-not-exist.json"},
+			wantErr: true,
+		},
+		{
+			name:    "error-canceled",
+			ctx:     canceled,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewService(tt.ctx, "fake-project", tt.creds)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewService() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (s == nil) != tt.wantErr {
+				t.Errorf("NewService() = %v, want nil %v", s, tt.wantErr)
+			}
+		})
+	}
+}
+
 func TestMustNewService(t *testing.T) {
-	_ = MustNewService("fake-project")
+	_ = MustNewService(context.Background(), "fake-project", credentials.Config{})
+}
+
+func TestService_DiscoverAuthRefresh(t *testing.T) {
+	s, err := NewService(context.Background(), "fake-project", credentials.Config{})
+	if err != nil {
+		t.Fatalf("NewService() error = %v", err)
+	}
+	// Recreating the clients forgets cached Kubernetes clients.
+	s.clients = map[string]*kubeClient{"us-central1/fake-cluster": {}}
+	if err := s.connect(context.Background()); err != nil || s.clients != nil {
+		t.Fatalf("Service.connect() error = %v, clients = %v, want nil", err, s.clients)
+	}
+
+	connects := 0
+	s.gke = &fakeGKEImpl{zonePagesError: &credentials.AuthError{Err: fmt.Errorf("token expired")}}
+	s.connect = func(ctx context.Context) error {
+		connects++
+		s.gke = &fakeGKEImpl{zones: &compute.ZoneList{}}
+		return nil
+	}
+	if _, err := s.Discover(context.Background()); err != nil {
+		t.Errorf("Service.Discover() error = %v", err)
+	}
+	if connects != 1 {
+		t.Errorf("Service.Discover() connected %d times, want 1", connects)
+	}
 }
 
 func TestService_Discover(t *testing.T) {
@@ -92,7 +188,6 @@ func TestService_Discover(t *testing.T) {
 		project     string
 		gke         *fakeGKEImpl
 		service     apiv1.Service
-		ctx         context.Context
 		want        []discovery.StaticConfig
 		wantErr     bool
 		wantKubeErr bool
@@ -113,7 +208,7 @@ func TestService_Discover(t *testing.T) {
 			want: []discovery.StaticConfig{
 				{
 					Targets: []string{"192.168.1.1:1122"},
-					Labels:  map[string]string{"zone": "us-central1-z", "service": "", "cluster": "fake-cluster"},
+					Labels:  map[string]string{"zone": "us-central1-z", "service": "", "cluster": "fake-cluster", "__gke_autopilot": "false", "__gke_release_channel": "UNSPECIFIED", "__gke_node_pools": "0"},
 				},
 			},
 		},
@@ -137,7 +232,7 @@ func TestService_Discover(t *testing.T) {
 			want: []discovery.StaticConfig{
 				{
 					Targets: []string{"192.168.1.1:1122"},
-					Labels:  map[string]string{"zone": "us-central1-z", "service": "", "cluster": "fake-cluster"},
+					Labels:  map[string]string{"zone": "us-central1-z", "service": "", "cluster": "fake-cluster", "__gke_autopilot": "false", "__gke_release_channel": "UNSPECIFIED", "__gke_node_pools": "0"},
 				},
 			},
 		},
@@ -213,7 +308,7 @@ func TestService_Discover(t *testing.T) {
 				project: tt.project,
 				gke:     tt.gke,
 			}
-			got, err := s.Discover(tt.ctx)
+			got, err := s.Discover(context.Background())
 			if (err != nil) != tt.wantErr {
 				t.Errorf("Service.Discover() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -255,7 +350,7 @@ func Test_getKubeClient(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			_, err := getKubeClient(tt.c)
+			_, err := getKubeClient(nil, tt.c)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("gkeClusterToKubeClient() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -263,3 +358,555 @@ func Test_getKubeClient(t *testing.T) {
 		})
 	}
 }
+
+func TestService_Check(t *testing.T) {
+	tests := []struct {
+		name    string
+		gke     *fakeGKEImpl
+		wantErr bool
+	}{
+		{
+			name: "success",
+			gke:  &fakeGKEImpl{zones: &compute.ZoneList{}, clusters: &container.ListClustersResponse{}},
+		},
+		{
+			name:    "failure-zone-list",
+			gke:     &fakeGKEImpl{zonePagesError: fmt.Errorf("permission denied")},
+			wantErr: true,
+		},
+		{
+			name:    "failure-cluster-list",
+			gke:     &fakeGKEImpl{zones: &compute.ZoneList{}, clusterListError: fmt.Errorf("permission denied")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Service{project: "fake-project", gke: tt.gke}
+			err := s.Check(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Service.Check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestService_getZoneList(t *testing.T) {
+	tests := []struct {
+		name      string
+		ttl       time.Duration
+		refresh   bool
+		wantCalls int
+	}{
+		{
+			name:      "success-cached",
+			ttl:       time.Hour,
+			wantCalls: 1,
+		},
+		{
+			name:      "success-no-cache",
+			ttl:       0,
+			wantCalls: 2,
+		},
+		{
+			name:      "success-refresh",
+			ttl:       time.Hour,
+			refresh:   true,
+			wantCalls: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeGKEImpl{
+				zones: &compute.ZoneList{Items: []*compute.Zone{{Name: "us-central1-z"}}},
+			}
+			s := &Service{project: "fake-project", gke: f, ZoneCacheTTL: tt.ttl}
+			s.getZoneList(context.Background())
+			if tt.refresh {
+				// Reloading the Manager discards the cached zones.
+				m := discovery.NewManager()
+				m.Register(s, filepath.Join(t.TempDir(), "gke.json"))
+				m.Reload()
+			}
+			got, err := s.getZoneList(context.Background())
+			if err != nil {
+				t.Fatalf("Service.getZoneList() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, []string{"us-central1-z"}) {
+				t.Errorf("Service.getZoneList() = %v, want [us-central1-z]", got)
+			}
+			if f.zonePagesCalls != tt.wantCalls {
+				t.Errorf("Service.getZoneList() calls = %d, want %d", f.zonePagesCalls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestService_DiscoverAggregatedList(t *testing.T) {
+	f := &fakeGKEImpl{
+		clusters: &container.ListClustersResponse{
+			Clusters: []*container.Cluster{
+				{Name: "fake-cluster", Location: "us-central1"},
+			},
+		},
+	}
+	i := fake.NewSimpleClientset()
+	i.Fake.PrependReactor("list", "services", func(action k8stesting.Action) (handled bool, ret runtime.Object, err error) {
+		return true, &apiv1.ServiceList{Items: []apiv1.Service{
+			{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "prometheus",
+					Annotations: map[string]string{"gke-prometheus-federation/scrape": "true"},
+				},
+				Spec: apiv1.ServiceSpec{
+					Ports:       []apiv1.ServicePort{{Port: 9090}},
+					ExternalIPs: []string{"192.168.1.1"},
+				},
+			},
+		}}, nil
+	})
+	f.Interface = i
+	s := &Service{project: "fake-project", gke: f, AggregatedList: true}
+	got, err := s.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("Service.Discover() error = %v", err)
+	}
+	want := []discovery.StaticConfig{
+		{
+			Targets: []string{"192.168.1.1:9090"},
+			Labels:  map[string]string{"zone": "us-central1", "service": "prometheus", "cluster": "fake-cluster", "__gke_autopilot": "false", "__gke_release_channel": "UNSPECIFIED", "__gke_node_pools": "0"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Service.Discover() = %v, want %v", got, want)
+	}
+	data, _ := json.Marshal(got)
+	if err := schematest.Validate([]byte(discovery.Schema), data); err != nil {
+		t.Errorf("Service.Discover() = %s, which does not match the schema: %v", data, err)
+	}
+	if f.zonePagesCalls != 0 {
+		t.Errorf("Service.Discover() listed zones %d times, want 0", f.zonePagesCalls)
+	}
+
+	f.clusterListError = fmt.Errorf("Failed to list clusters")
+	_, err = s.Discover(context.Background())
+	if err == nil {
+		t.Errorf("Service.Discover() error = nil, want error")
+	}
+}
+
+func BenchmarkService_Discover(b *testing.B) {
+	f := &fakeGKEImpl{
+		zones:    &compute.ZoneList{Items: []*compute.Zone{{Name: "us-central1-z"}}},
+		clusters: &container.ListClustersResponse{},
+	}
+	for i := 0; i < 100; i++ {
+		f.clusters.Clusters = append(f.clusters.Clusters, &container.Cluster{
+			Name: fmt.Sprintf("cluster-%03d", i),
+		})
+	}
+	services := &apiv1.ServiceList{}
+	for i := 0; i < 50; i++ {
+		annotations := map[string]string{}
+		if i%5 == 0 {
+			annotations["gke-prometheus-federation/scrape"] = "true"
+		}
+		services.Items = append(services.Items, apiv1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        fmt.Sprintf("service-%02d", i),
+				Annotations: annotations,
+			},
+			Spec: apiv1.ServiceSpec{
+				Ports:       []apiv1.ServicePort{{Port: 9090}},
+				ExternalIPs: []string{fmt.Sprintf("192.168.1.%d", i)},
+			},
+		})
+	}
+	i := fake.NewSimpleClientset()
+	i.Fake.PrependReactor("list", "services", func(action k8stesting.Action) (handled bool, ret runtime.Object, err error) {
+		return true, services, nil
+	})
+	f.Interface = i
+	s := &Service{project: "fake-project", gke: f}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		_, err := s.Discover(context.Background())
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestService_DiscoverReadyLabel(t *testing.T) {
+	i := fake.NewSimpleClientset(
+		&apiv1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Name: "ready", Namespace: "default"},
+			Subsets:    []apiv1.EndpointSubset{{Addresses: []apiv1.EndpointAddress{{IP: "10.0.0.1"}}}},
+		},
+		&apiv1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Name: "not-ready", Namespace: "default"},
+			Subsets:    []apiv1.EndpointSubset{{NotReadyAddresses: []apiv1.EndpointAddress{{IP: "10.0.0.2"}}}},
+		},
+	)
+	svc := func(name, ip string) apiv1.Service {
+		return apiv1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   "default",
+				Annotations: map[string]string{"gke-prometheus-federation/scrape": "true"},
+			},
+			Spec: apiv1.ServiceSpec{
+				Ports:       []apiv1.ServicePort{{Port: 9090}},
+				ExternalIPs: []string{ip},
+			},
+		}
+	}
+	i.Fake.PrependReactor("list", "services", func(action k8stesting.Action) (handled bool, ret runtime.Object, err error) {
+		return true, &apiv1.ServiceList{Items: []apiv1.Service{
+			svc("ready", "192.168.1.1"), svc("not-ready", "192.168.1.2"), svc("missing", "192.168.1.3"),
+		}}, nil
+	})
+	f := &fakeGKEImpl{
+		clusters:  &container.ListClustersResponse{Clusters: []*container.Cluster{{Name: "fake-cluster"}}},
+		Interface: i,
+	}
+	s := &Service{project: "fake-project", gke: f, AggregatedList: true, ReadyLabel: true}
+	got, err := s.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("Service.Discover() error = %v", err)
+	}
+	want := []string{"true", "false", "unknown"}
+	if len(got) != len(want) {
+		t.Fatalf("Service.Discover() got %d targets, want %d", len(got), len(want))
+	}
+	for n := range want {
+		if got[n].Labels[discovery.LabelReady] != want[n] {
+			t.Errorf("Service.Discover() %s ready = %q, want %q",
+				got[n].Labels["service"], got[n].Labels[discovery.LabelReady], want[n])
+		}
+	}
+}
+
+func TestService_DiscoverAPIServerProxy(t *testing.T) {
+	i := fake.NewSimpleClientset()
+	i.Fake.PrependReactor("list", "services", func(action k8stesting.Action) (handled bool, ret runtime.Object, err error) {
+		return true, &apiv1.ServiceList{Items: []apiv1.Service{
+			{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "prometheus",
+					Namespace:   "monitoring",
+					Annotations: map[string]string{"gke-prometheus-federation/scrape": "true"},
+				},
+				Spec: apiv1.ServiceSpec{
+					Ports: []apiv1.ServicePort{{Port: 9090}},
+				},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "headless",
+					Namespace:   "monitoring",
+					Annotations: map[string]string{"gke-prometheus-federation/scrape": "true"},
+				},
+			},
+		}}, nil
+	})
+	f := &fakeGKEImpl{
+		clusters: &container.ListClustersResponse{
+			Clusters: []*container.Cluster{{Name: "fake-cluster", Location: "us-central1", Endpoint: "35.1.2.3"}},
+		},
+		Interface: i,
+	}
+	s := &Service{project: "fake-project", gke: f, AggregatedList: true, APIServerProxy: true}
+	got, err := s.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("Service.Discover() error = %v", err)
+	}
+	want := []discovery.StaticConfig{
+		{
+			Targets: []string{"35.1.2.3:443"},
+			Labels: map[string]string{
+				"zone":                  "us-central1",
+				"service":               "prometheus",
+				"cluster":               "fake-cluster",
+				"__scheme__":            "https",
+				"__metrics_path__":      "/api/v1/namespaces/monitoring/services/prometheus:9090/proxy/metrics",
+				"__gke_apiserver_proxy": "true",
+				"__gke_autopilot":       "false",
+				"__gke_release_channel": "UNSPECIFIED",
+				"__gke_node_pools":      "0",
+			},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Service.Discover() = %v, want %v", got, want)
+	}
+}
+
+func Test_clusterLabels(t *testing.T) {
+	tests := []struct {
+		name    string
+		cluster *container.Cluster
+		want    map[string]string
+	}{
+		{
+			name:    "standard",
+			cluster: &container.Cluster{NodePools: []*container.NodePool{{}, {}}},
+			want:    map[string]string{labelAutopilot: "false", labelReleaseChannel: "UNSPECIFIED", labelNodePools: "2"},
+		},
+		{
+			name: "autopilot",
+			cluster: &container.Cluster{
+				Autopilot:      &container.Autopilot{Enabled: true},
+				ReleaseChannel: &container.ReleaseChannel{Channel: "REGULAR"},
+				NodePools:      []*container.NodePool{{}},
+			},
+			want: map[string]string{labelAutopilot: "true", labelReleaseChannel: "REGULAR", labelNodePools: "1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clusterLabels(tt.cluster); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("clusterLabels() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_endpointLabels(t *testing.T) {
+	cert := base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("fake-der")}))
+	sum := sha256.Sum256([]byte("fake-der"))
+	tests := []struct {
+		name    string
+		cluster *container.Cluster
+		want    map[string]string
+	}{
+		{
+			name:    "success",
+			cluster: &container.Cluster{Endpoint: "35.1.2.3", MasterAuth: &container.MasterAuth{ClusterCaCertificate: cert}},
+			want:    map[string]string{labelEndpoint: "35.1.2.3", labelCAFingerprint: hex.EncodeToString(sum[:])},
+		},
+		{
+			name:    "success-no-master-auth",
+			cluster: &container.Cluster{Endpoint: "35.1.2.3"},
+			want:    map[string]string{labelEndpoint: "35.1.2.3"},
+		},
+		{
+			name:    "invalid-certificate",
+			cluster: &container.Cluster{Endpoint: "35.1.2.3", MasterAuth: &container.MasterAuth{ClusterCaCertificate: "bm90IHBlbQ=="}},
+			want:    map[string]string{labelEndpoint: "35.1.2.3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := endpointLabels(tt.cluster); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("endpointLabels() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	ClusterInfo.WithLabelValues("x", "x", "x", "x")
+	NodePoolCount.WithLabelValues("x", "x")
+	promtest.LintMetrics(t)
+}
+
+func TestService_deleteStaleSeries(t *testing.T) {
+	before := testutil.CollectAndCount(ClusterInfo)
+	s1 := &Service{}
+	s2 := &Service{}
+	s1.checked = map[clusterSeries]bool{}
+	s1.setClusterMetrics(clusterSeries{"stale-a", "us-central1", "false", "REGULAR"}, 1)
+	s1.setClusterMetrics(clusterSeries{"stale-b", "us-central1", "false", "REGULAR"}, 1)
+	s1.deleteStaleSeries()
+	s2.checked = map[clusterSeries]bool{}
+	s2.setClusterMetrics(clusterSeries{"stale-c", "us-east1", "false", "REGULAR"}, 1)
+	s2.deleteStaleSeries()
+
+	// stale-a disappears and stale-b changes release channel.
+	s1.checked = map[clusterSeries]bool{}
+	s1.setClusterMetrics(clusterSeries{"stale-b", "us-central1", "false", "STABLE"}, 2)
+	s1.deleteStaleSeries()
+
+	if got, want := testutil.CollectAndCount(ClusterInfo), before+2; got != want {
+		t.Errorf("ClusterInfo has %d series, want %d", got, want)
+	}
+	if got := testutil.ToFloat64(NodePoolCount.WithLabelValues("stale-b", "us-central1")); got != 2 {
+		t.Errorf("NodePoolCount of stale-b = %v, want 2", got)
+	}
+	// The series of the other Service are kept.
+	if !NodePoolCount.DeleteLabelValues("stale-c", "us-east1") {
+		t.Errorf("NodePoolCount of stale-c was deleted by another Service")
+	}
+	if NodePoolCount.DeleteLabelValues("stale-a", "us-central1") {
+		t.Errorf("NodePoolCount of stale-a was not deleted")
+	}
+}
+
+func TestService_DiscoverRotation(t *testing.T) {
+	tests := []struct {
+		name            string
+		listErr         error
+		clusterGetError error
+		wantGetCalls    int
+		wantErr         bool
+	}{
+		{
+			name:         "success-retry-after-ca-rotation",
+			listErr:      &url.Error{Op: "Get", URL: "https://35.1.2.3", Err: x509.UnknownAuthorityError{}},
+			wantGetCalls: 1,
+		},
+		{
+			name:         "success-retry-after-endpoint-rotation",
+			listErr:      &url.Error{Op: "Get", URL: "https://35.1.2.3", Err: &net.OpError{Op: "dial", Err: fmt.Errorf("connection refused")}},
+			wantGetCalls: 1,
+		},
+		{
+			name:         "failure-not-retried",
+			listErr:      fmt.Errorf("forbidden"),
+			wantGetCalls: 0,
+			wantErr:      true,
+		},
+		{
+			name:            "failure-cluster-get",
+			listErr:         &url.Error{Op: "Get", URL: "https://35.1.2.3", Err: x509.UnknownAuthorityError{}},
+			clusterGetError: fmt.Errorf("Failed to get cluster"),
+			wantGetCalls:    1,
+			wantErr:         true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i := fake.NewSimpleClientset()
+			lists := 0
+			i.Fake.PrependReactor("list", "services", func(action k8stesting.Action) (handled bool, ret runtime.Object, err error) {
+				lists++
+				if lists == 1 {
+					return true, nil, tt.listErr
+				}
+				return true, &apiv1.ServiceList{}, nil
+			})
+			f := &fakeGKEImpl{
+				clusters: &container.ListClustersResponse{
+					Clusters: []*container.Cluster{{Name: "fake-cluster", Location: "us-central1", Endpoint: "35.1.2.3"}},
+				},
+				cluster:         &container.Cluster{Name: "fake-cluster", Location: "us-central1", Endpoint: "35.4.5.6"},
+				clusterGetError: tt.clusterGetError,
+				Interface:       i,
+			}
+			s := &Service{project: "fake-project", gke: f, AggregatedList: true}
+			_, err := s.Discover(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Service.Discover() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if f.clusterGetCalls != tt.wantGetCalls {
+				t.Errorf("Service.Discover() got cluster %d times, want %d", f.clusterGetCalls, tt.wantGetCalls)
+			}
+		})
+	}
+}
+
+func TestService_getKubeClient(t *testing.T) {
+	f := &fakeGKEImpl{Interface: fake.NewSimpleClientset()}
+	s := &Service{project: "fake-project", gke: f}
+	cluster := &container.Cluster{Name: "c", Location: "us-central1", Endpoint: "35.1.2.3"}
+	s.getKubeClient("", cluster)
+	s.getKubeClient("", cluster)
+	if f.kubeClientCalls != 1 {
+		t.Errorf("Service.getKubeClient() created %d clients, want 1", f.kubeClientCalls)
+	}
+	s.getKubeClient("", &container.Cluster{Name: "c", Location: "us-central1", Endpoint: "35.4.5.6"})
+	if f.kubeClientCalls != 2 {
+		t.Errorf("Service.getKubeClient() after endpoint change created %d clients, want 2", f.kubeClientCalls)
+	}
+}
+
+func TestService_DiscoverKubeTimeout(t *testing.T) {
+	// An API server that never responds.
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	}))
+	defer srv.Close()
+	defer close(done)
+	k, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		ctx     time.Duration
+	}{
+		{
+			name:    "kube-timeout",
+			timeout: 100 * time.Millisecond,
+			ctx:     time.Minute,
+		},
+		{
+			name: "discovery-deadline",
+			ctx:  100 * time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeGKEImpl{
+				clusters:  &container.ListClustersResponse{Clusters: []*container.Cluster{{Name: "fake-cluster"}}},
+				Interface: k,
+			}
+			s := &Service{project: "fake-project", gke: f, AggregatedList: true, KubeTimeout: tt.timeout}
+			ctx, cancel := context.WithTimeout(context.Background(), tt.ctx)
+			defer cancel()
+			start := time.Now()
+			_, err := s.Discover(ctx)
+			if err == nil {
+				t.Fatalf("Service.Discover() error = nil, want timeout")
+			}
+			if d := time.Since(start); d > 10*time.Second {
+				t.Errorf("Service.Discover() took %s, want about 100ms", d)
+			}
+		})
+	}
+}
+
+func TestService_collect(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   int
+		fail    int
+		wantErr bool
+	}{
+		{name: "sequential", limit: 0, fail: -1},
+		{name: "concurrent", limit: 4, fail: -1},
+		{name: "error", limit: 4, fail: 3, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Service{MaxConcurrency: tt.limit}
+			got, err := s.collect(10, func(i int) ([]discovery.StaticConfig, error) {
+				if i == tt.fail {
+					return nil, fmt.Errorf("fake error")
+				}
+				// Finish later calls first to verify results keep their order.
+				time.Sleep(time.Duration(10-i) * time.Millisecond)
+				return []discovery.StaticConfig{{Targets: []string{fmt.Sprint(i)}}}, nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Service.collect() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			for i := range got {
+				if got[i].Targets[0] != fmt.Sprint(i) {
+					t.Errorf("Service.collect() target[%d] = %s, want %d", i, got[i].Targets[0], i)
+				}
+			}
+		})
+	}
+}
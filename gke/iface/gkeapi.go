@@ -5,16 +5,35 @@ package iface
 
 import (
 	"context"
+	"net/http"
 
 	compute "google.golang.org/api/compute/v1"
 	container "google.golang.org/api/container/v1"
+	"google.golang.org/api/googleapi"
 	"k8s.io/client-go/kubernetes"
+
+	"github.com/m-lab/gcp-service-discovery/internal/apicall"
+)
+
+const (
+	// zoneFields limits zone list responses to the fields used by the gke logic.
+	zoneFields = googleapi.Field("nextPageToken,items(name)")
+
+	// clusterFieldNames are the cluster fields used by the gke logic.
+	clusterFieldNames = "name,zone,location,endpoint,masterAuth/clusterCaCertificate,autopilot/enabled,releaseChannel/channel,status,nodePools(name,status)"
+
+	// clusterFields limits cluster list responses to the fields used by the gke logic.
+	clusterFields = googleapi.Field("clusters(" + clusterFieldNames + ")")
+
+	// clusterGetFields limits cluster responses to the fields used by the gke logic.
+	clusterGetFields = googleapi.Field(clusterFieldNames)
 )
 
 // GKE defines the interface used by the gke logic.
 type GKE interface {
 	ZonePages(ctx context.Context, f func(zones *compute.ZoneList) error) error
 	ClusterList(ctx context.Context, zone string) (*container.ListClustersResponse, error)
+	ClusterGet(ctx context.Context, location, name string) (*container.Cluster, error)
 	GetKubeClient(c *container.Cluster) (kubernetes.Interface, error)
 }
 
@@ -35,12 +54,33 @@ func NewGKE(project string, compute *compute.Service, container *container.Servi
 
 // ZonePages wraps the computeService Zones.List().Pages method.
 func (g *GKEImpl) ZonePages(ctx context.Context, f func(zones *compute.ZoneList) error) error {
-	return g.computeService.Zones.List(g.project).Pages(ctx, f)
+	return apicall.Pages(ctx, "compute",
+		func(ctx context.Context, token string) (*compute.ZoneList, error) {
+			return g.computeService.Zones.List(g.project).Fields(zoneFields).PageToken(token).Context(ctx).Do()
+		},
+		func(zones *compute.ZoneList) (http.Header, string) { return zones.Header, zones.NextPageToken },
+		f)
 }
 
-// ClusterList wraps the container service Clusters.List method for the given zone.
+// ClusterList wraps the container service Clusters.List method for the given
+// zone. The zone "-" lists clusters in all zones and regions.
 func (g *GKEImpl) ClusterList(ctx context.Context, zone string) (*container.ListClustersResponse, error) {
-	return g.containerService.Projects.Zones.Clusters.List(g.project, zone).Context(ctx).Do()
+	return apicall.Get(ctx, "container",
+		func(ctx context.Context) (*container.ListClustersResponse, error) {
+			return g.containerService.Projects.Zones.Clusters.List(g.project, zone).Fields(clusterFields).Context(ctx).Do()
+		},
+		func(r *container.ListClustersResponse) http.Header { return r.Header })
+}
+
+// ClusterGet wraps the container service Clusters.Get method for the named
+// cluster in the given zone or region.
+func (g *GKEImpl) ClusterGet(ctx context.Context, location, name string) (*container.Cluster, error) {
+	path := "projects/" + g.project + "/locations/" + location + "/clusters/" + name
+	return apicall.Get(ctx, "container",
+		func(ctx context.Context) (*container.Cluster, error) {
+			return g.containerService.Projects.Locations.Clusters.Get(path).Fields(clusterGetFields).Context(ctx).Do()
+		},
+		func(c *container.Cluster) http.Header { return c.Header })
 }
 
 // GetKubeClient returns a kubernetes interface for the given cluster.
@@ -0,0 +1,37 @@
+package gke
+
+import (
+	"context"
+
+	container "google.golang.org/api/container/v1"
+
+	"github.com/m-lab/gcp-service-discovery/discovery"
+)
+
+// lifecycleStates maps the status of clusters and node pools that is expected
+// to make their targets unavailable to a discovery lifecycle state. Clusters
+// and node pools are RECONCILING while they are upgraded, resized, or
+// repaired.
+var lifecycleStates = map[string]string{
+	"RECONCILING": discovery.LifecycleUpgrading,
+	"STOPPING":    discovery.LifecycleDeleting,
+}
+
+// recordLifecycle reports the lifecycle of target if the status of its
+// upstream object, e.g. "node pool default-pool", is expected to make it
+// unavailable.
+func recordLifecycle(ctx context.Context, target discovery.StaticConfig, object, status string) {
+	if state, ok := lifecycleStates[status]; ok {
+		discovery.RecordLifecycle(ctx, target, state, object+" "+status)
+	}
+}
+
+// nodePoolStatus returns the status of the named node pool of cluster.
+func nodePoolStatus(cluster *container.Cluster, name string) string {
+	for _, pool := range cluster.NodePools {
+		if pool.Name == name {
+			return pool.Status
+		}
+	}
+	return ""
+}
@@ -0,0 +1,92 @@
+package gke
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	container "google.golang.org/api/container/v1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/m-lab/gcp-service-discovery/discovery"
+)
+
+func TestService_DiscoverLifecycle(t *testing.T) {
+	i := fake.NewSimpleClientset(
+		newNode("node-1", map[string]string{nodePoolLabel: "default-pool"},
+			apiv1.NodeAddress{Type: apiv1.NodeInternalIP, Address: "10.128.0.21"}),
+		newNode("node-2", map[string]string{nodePoolLabel: "upgrade-pool"},
+			apiv1.NodeAddress{Type: apiv1.NodeInternalIP, Address: "10.128.0.22"}),
+	)
+	tests := []struct {
+		name    string
+		status  string
+		proxy   bool
+		control bool
+		want    map[string]discovery.Lifecycle
+	}{
+		{
+			name: "node-pool-upgrading",
+			want: map[string]discovery.Lifecycle{
+				"10.128.0.22:9100": {State: discovery.LifecycleUpgrading, Reason: "node pool upgrade-pool RECONCILING"},
+			},
+		},
+		{
+			name:    "control-plane-upgrading",
+			status:  "RECONCILING",
+			control: true,
+			want: map[string]discovery.Lifecycle{
+				"10.128.0.22:9100": {State: discovery.LifecycleUpgrading, Reason: "node pool upgrade-pool RECONCILING"},
+				"35.1.2.3:443":     {State: discovery.LifecycleUpgrading, Reason: "cluster fake-cluster RECONCILING"},
+			},
+		},
+		{
+			name:   "proxy-deleting",
+			status: "STOPPING",
+			proxy:  true,
+			want: map[string]discovery.Lifecycle{
+				"35.1.2.3:443": {State: discovery.LifecycleDeleting, Reason: "cluster fake-cluster STOPPING"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeGKEImpl{
+				clusters: &container.ListClustersResponse{
+					Clusters: []*container.Cluster{{
+						Name:     "fake-cluster",
+						Location: "us-central1",
+						Endpoint: "35.1.2.3",
+						Status:   tt.status,
+						NodePools: []*container.NodePool{
+							{Name: "default-pool", Status: "RUNNING"},
+							{Name: "upgrade-pool", Status: "RECONCILING"},
+						},
+					}},
+				},
+				Interface: i,
+			}
+			s := &Service{project: "fake-project", gke: f, AggregatedList: true, Nodes: true, APIServerProxy: tt.proxy}
+			if tt.control {
+				s.ControlPlane = ControlPlane{"apiserver"}
+			}
+			output := filepath.Join(t.TempDir(), "gke.json")
+			m := discovery.NewManager(discovery.WithTimeout(time.Minute), discovery.WithLifecycle(true))
+			m.Register(s, output)
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			m.Run(ctx, time.Minute)
+
+			l, err := discovery.ReadLifecycles(output)
+			if err != nil {
+				t.Fatalf("ReadLifecycles() error = %v", err)
+			}
+			if !reflect.DeepEqual(l.Targets, tt.want) {
+				t.Errorf("ReadLifecycles() targets = %v, want %v", l.Targets, tt.want)
+			}
+		})
+	}
+}
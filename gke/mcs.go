@@ -0,0 +1,92 @@
+package gke
+
+import (
+	"context"
+	"encoding/json"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Resources of GKE multi-cluster Services (MCS).
+const (
+	mcsExportsPath = "/apis/net.gke.io/v1/serviceexports"
+	mcsImportsPath = "/apis/net.gke.io/v1/serviceimports"
+
+	// mcsDerivedAnnotation names the Service derived from a ServiceImport,
+	// which load balances across the exporting clusters.
+	mcsDerivedAnnotation = "net.gke.io/derived-service"
+
+	// labelMCSService is the namespace/name of the multi-cluster service of a
+	// target.
+	labelMCSService = "mcs_service"
+)
+
+// mcsList is the part of a ServiceExport or ServiceImport list used by the gke
+// logic.
+type mcsList struct {
+	Items []struct {
+		metav1.ObjectMeta `json:"metadata"`
+	} `json:"items"`
+}
+
+// listMCS requests the MCS resource list at path. The indirection facilitates
+// testing, as fake clientsets have no REST client.
+var listMCS = func(ctx context.Context, k kubernetes.Interface, path string) ([]byte, error) {
+	return k.Discovery().RESTClient().Get().AbsPath(path).DoRaw(ctx)
+}
+
+// mcsServices are the Services of a cluster that belong to multi-cluster
+// services, by namespace/name.
+type mcsServices struct {
+	// exported are the Services with a ServiceExport of the same name, which
+	// map to themselves.
+	exported map[string]string
+
+	// derived are the Services derived from a ServiceImport, which map to the
+	// name of the ServiceImport.
+	derived map[string]string
+}
+
+// lookup returns the multi-cluster service of a Service, and whether the
+// Service is derived from a ServiceImport.
+func (m *mcsServices) lookup(namespace, name string) (string, bool) {
+	key := namespace + "/" + name
+	if mcs, ok := m.derived[key]; ok {
+		return mcs, true
+	}
+	return m.exported[key], false
+}
+
+// checkMCS lists the ServiceExports and ServiceImports of a cluster. Clusters
+// without MCS have neither resource, and no multi-cluster services.
+func (s *Service) checkMCS(ctx context.Context, k kubernetes.Interface) (*mcsServices, error) {
+	m := &mcsServices{exported: map[string]string{}, derived: map[string]string{}}
+	for _, path := range []string{mcsExportsPath, mcsImportsPath} {
+		listCtx, cancel := s.kubeContext(ctx)
+		data, err := listMCS(listCtx, k, path)
+		cancel()
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		list := &mcsList{}
+		if err := json.Unmarshal(data, list); err != nil {
+			return nil, err
+		}
+		for _, item := range list.Items {
+			key := item.Namespace + "/" + item.Name
+			if path == mcsExportsPath {
+				m.exported[key] = key
+				continue
+			}
+			if derived := item.Annotations[mcsDerivedAnnotation]; derived != "" {
+				m.derived[item.Namespace+"/"+derived] = key
+			}
+		}
+	}
+	return m, nil
+}
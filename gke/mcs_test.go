@@ -0,0 +1,124 @@
+package gke
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	container "google.golang.org/api/container/v1"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeMCS replaces listMCS with responses by path until the test ends. Paths
+// without a response are not found.
+func fakeMCS(t *testing.T, responses map[string]string, err error) {
+	orig := listMCS
+	t.Cleanup(func() { listMCS = orig })
+	listMCS = func(ctx context.Context, k kubernetes.Interface, path string) ([]byte, error) {
+		if err != nil {
+			return nil, err
+		}
+		data, ok := responses[path]
+		if !ok {
+			return nil, apierrors.NewNotFound(schema.GroupResource{Group: "net.gke.io"}, "")
+		}
+		return []byte(data), nil
+	}
+}
+
+const (
+	fakeExports = `{"items": [{"metadata": {"name": "prometheus", "namespace": "monitoring"}}]}`
+	fakeImports = `{"items": [{"metadata": {"name": "prometheus", "namespace": "monitoring",
+		"annotations": {"net.gke.io/derived-service": "gke-mcs-1a2b3c4d"}}}]}`
+)
+
+func TestService_checkMCS(t *testing.T) {
+	s := &Service{}
+	fakeMCS(t, nil, nil)
+	m, err := s.checkMCS(context.Background(), nil)
+	if err != nil || len(m.exported) != 0 || len(m.derived) != 0 {
+		t.Errorf("Service.checkMCS() = %v, %v, want no services without MCS", m, err)
+	}
+
+	fakeMCS(t, map[string]string{mcsExportsPath: fakeExports, mcsImportsPath: fakeImports}, nil)
+	m, err = s.checkMCS(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("Service.checkMCS() error = %v", err)
+	}
+	tests := []struct {
+		name        string
+		want        string
+		wantDerived bool
+	}{
+		{name: "prometheus", want: "monitoring/prometheus"},
+		{name: "gke-mcs-1a2b3c4d", want: "monitoring/prometheus", wantDerived: true},
+		{name: "grafana"},
+	}
+	for _, tt := range tests {
+		got, derived := m.lookup("monitoring", tt.name)
+		if got != tt.want || derived != tt.wantDerived {
+			t.Errorf("mcsServices.lookup(%q) = %q, %t, want %q, %t", tt.name, got, derived, tt.want, tt.wantDerived)
+		}
+	}
+
+	fakeMCS(t, nil, fmt.Errorf("forbidden"))
+	if _, err := s.checkMCS(context.Background(), nil); err == nil {
+		t.Errorf("Service.checkMCS() error = nil, want error")
+	}
+}
+
+func TestService_DiscoverMCS(t *testing.T) {
+	svc := func(name, ip string) *apiv1.Service {
+		return &apiv1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   "monitoring",
+				Annotations: map[string]string{"gke-prometheus-federation/scrape": "true"},
+			},
+			Spec: apiv1.ServiceSpec{
+				Ports:       []apiv1.ServicePort{{Port: 9090}},
+				ExternalIPs: []string{ip},
+			},
+		}
+	}
+	f := &fakeGKEImpl{
+		clusters: &container.ListClustersResponse{Clusters: []*container.Cluster{{Name: "fake-cluster"}}},
+		Interface: fake.NewSimpleClientset(
+			svc("prometheus", "192.168.1.1"), svc("gke-mcs-1a2b3c4d", "192.168.1.2"), svc("grafana", "192.168.1.3"),
+		),
+	}
+	fakeMCS(t, map[string]string{mcsExportsPath: fakeExports, mcsImportsPath: fakeImports}, nil)
+	mcsLabels := func(s *Service) map[string]string {
+		got, err := s.Discover(context.Background())
+		if err != nil {
+			t.Fatalf("Service.Discover() error = %v", err)
+		}
+		labels := map[string]string{}
+		for _, c := range got {
+			labels[c.Labels["service"]] = c.Labels[labelMCSService]
+		}
+		return labels
+	}
+
+	s := &Service{project: "fake-project", gke: f, AggregatedList: true, MCS: true}
+	want := map[string]string{
+		"prometheus":       "monitoring/prometheus",
+		"gke-mcs-1a2b3c4d": "monitoring/prometheus",
+		"grafana":          "",
+	}
+	if got := mcsLabels(s); !reflect.DeepEqual(got, want) {
+		t.Errorf("Service.Discover() mcs_service labels = %v, want %v", got, want)
+	}
+
+	s.MCSDedup = true
+	delete(want, "gke-mcs-1a2b3c4d")
+	if got := mcsLabels(s); !reflect.DeepEqual(got, want) {
+		t.Errorf("Service.Discover() with MCSDedup mcs_service labels = %v, want %v", got, want)
+	}
+}
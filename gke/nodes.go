@@ -0,0 +1,138 @@
+package gke
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	container "google.golang.org/api/container/v1"
+	typesv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/m-lab/gcp-service-discovery/discovery"
+)
+
+// DefaultNodePort is the default NodePort, the port of the Prometheus node
+// exporter.
+const DefaultNodePort = 9100
+
+// Labels of GKE nodes.
+const (
+	nodePoolLabel   = "cloud.google.com/gke-nodepool"
+	nodeZoneLabel   = "topology.kubernetes.io/zone"
+	legacyZoneLabel = "failure-domain.beta.kubernetes.io/zone"
+)
+
+// checkNodes lists the nodes of a cluster, and returns a target for every node
+// with an internal IP. The cluster labels are added to every target.
+func (s *Service) checkNodes(ctx context.Context, k kubernetes.Interface, zoneName string, cluster *container.Cluster, labels map[string]string) ([]discovery.StaticConfig, error) {
+	listCtx, cancel := s.kubeContext(ctx)
+	nodes, err := k.CoreV1().Nodes().List(listCtx, metav1.ListOptions{})
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	discovery.CountScanned(ctx, "nodes", len(nodes.Items))
+
+	port := s.NodePort
+	if port == 0 {
+		port = DefaultNodePort
+	}
+	configs := []discovery.StaticConfig{}
+	for _, node := range nodes.Items {
+		object := zoneName + "/" + cluster.Name + "/nodes/" + node.Name
+		target, reason := findNodeTarget(zoneName, cluster, node, port, s.APIServerProxy)
+		if target == nil {
+			discovery.Decide(ctx, object, false, reason)
+			continue
+		}
+		for k, v := range labels {
+			target.Labels[k] = v
+		}
+		discovery.Decide(ctx, object, true, "node")
+		discovery.RecordOrigin(ctx, *target, node)
+		// Proxied targets share the address of the API server, so only the
+		// cluster status applies to them.
+		if !s.APIServerProxy {
+			pool := node.Labels[nodePoolLabel]
+			recordLifecycle(ctx, *target, "node pool "+pool, nodePoolStatus(cluster, pool))
+		}
+		configs = append(configs, *target)
+	}
+	return configs, nil
+}
+
+// findNodeTarget returns a target configuration for the given port of a node,
+// or nil and the reason why the node cannot be scraped. The zone label is the
+// zone of the node, or else the location of its cluster. When proxy is true,
+// the node is scraped through the API server proxy of the cluster.
+//
+// In serialized form, the label set of a node looks like:
+//
+//	{
+//	    "labels": {
+//	        "cluster": "prometheus-federation",
+//	        "kubernetes_version": "v1.20.8-gke.900",
+//	        "node": "gke-prometheus-federation-default-pool-3f2a1b0c-x1z2",
+//	        "nodepool": "default-pool",
+//	        "zone": "us-central1-b"
+//	    },
+//	    "targets": [
+//	        "10.128.0.21:9100"
+//	    ]
+//	}
+func findNodeTarget(zoneName string, cluster *container.Cluster, node typesv1.Node, port int, proxy bool) (*discovery.StaticConfig, string) {
+	zone := node.Labels[nodeZoneLabel]
+	if zone == "" {
+		zone = node.Labels[legacyZoneLabel]
+	}
+	if zone == "" {
+		zone = zoneName
+	}
+	labels := map[string]string{
+		"node":               node.Name,
+		"nodepool":           node.Labels[nodePoolLabel],
+		"cluster":            cluster.Name,
+		"zone":               zone,
+		"kubernetes_version": node.Status.NodeInfo.KubeletVersion,
+	}
+	if !proxy {
+		ip := nodeInternalIP(node)
+		if ip == "" {
+			return nil, "no internal IP"
+		}
+		return &discovery.StaticConfig{
+			Targets: []string{net.JoinHostPort(ip, strconv.Itoa(port))},
+			Labels:  labels,
+		}, ""
+	}
+
+	if cluster.Endpoint == "" {
+		return nil, "no cluster endpoint"
+	}
+	// The GKE API reports the endpoint as an IP address without a port.
+	endpoint := strings.TrimPrefix(cluster.Endpoint, "https://")
+	if _, _, err := net.SplitHostPort(endpoint); err != nil {
+		endpoint = net.JoinHostPort(endpoint, "443")
+	}
+	labels["__scheme__"] = "https"
+	labels["__metrics_path__"] = fmt.Sprintf("/api/v1/nodes/%s:%d/proxy/metrics", node.Name, port)
+	labels["__gke_apiserver_proxy"] = "true"
+	return &discovery.StaticConfig{
+		Targets: []string{endpoint},
+		Labels:  labels,
+	}, ""
+}
+
+// nodeInternalIP returns the first internal IP address of the node, or "".
+func nodeInternalIP(node typesv1.Node) string {
+	for _, a := range node.Status.Addresses {
+		if a.Type == typesv1.NodeInternalIP && a.Address != "" {
+			return a.Address
+		}
+	}
+	return ""
+}
@@ -0,0 +1,153 @@
+package gke
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	container "google.golang.org/api/container/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/internal/schematest"
+)
+
+func newNode(name string, labels map[string]string, addresses ...apiv1.NodeAddress) *apiv1.Node {
+	return &apiv1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+		Status: apiv1.NodeStatus{
+			Addresses: addresses,
+			NodeInfo:  apiv1.NodeSystemInfo{KubeletVersion: "v1.20.8-gke.900"},
+		},
+	}
+}
+
+func Test_findNodeTarget(t *testing.T) {
+	cluster := &container.Cluster{Name: "fake-cluster", Endpoint: "35.1.2.3"}
+	labels := map[string]string{nodePoolLabel: "default-pool", nodeZoneLabel: "us-central1-b"}
+	internal := apiv1.NodeAddress{Type: apiv1.NodeInternalIP, Address: "10.128.0.21"}
+	external := apiv1.NodeAddress{Type: apiv1.NodeExternalIP, Address: "34.1.2.3"}
+	tests := []struct {
+		name       string
+		node       *apiv1.Node
+		proxy      bool
+		want       *discovery.StaticConfig
+		wantReason string
+	}{
+		{
+			name: "success",
+			node: newNode("node-1", labels, external, internal),
+			want: &discovery.StaticConfig{
+				Targets: []string{"10.128.0.21:9100"},
+				Labels: map[string]string{
+					"node":               "node-1",
+					"nodepool":           "default-pool",
+					"cluster":            "fake-cluster",
+					"zone":               "us-central1-b",
+					"kubernetes_version": "v1.20.8-gke.900",
+				},
+			},
+		},
+		{
+			name: "success-legacy-zone",
+			node: newNode("node-1", map[string]string{legacyZoneLabel: "us-central1-c"}, internal),
+			want: &discovery.StaticConfig{
+				Targets: []string{"10.128.0.21:9100"},
+				Labels: map[string]string{
+					"node":               "node-1",
+					"nodepool":           "",
+					"cluster":            "fake-cluster",
+					"zone":               "us-central1-c",
+					"kubernetes_version": "v1.20.8-gke.900",
+				},
+			},
+		},
+		{
+			name:  "success-proxy",
+			node:  newNode("node-1", nil),
+			proxy: true,
+			want: &discovery.StaticConfig{
+				Targets: []string{"35.1.2.3:443"},
+				Labels: map[string]string{
+					"node":                  "node-1",
+					"nodepool":              "",
+					"cluster":               "fake-cluster",
+					"zone":                  "us-central1",
+					"kubernetes_version":    "v1.20.8-gke.900",
+					"__scheme__":            "https",
+					"__metrics_path__":      "/api/v1/nodes/node-1:9100/proxy/metrics",
+					"__gke_apiserver_proxy": "true",
+				},
+			},
+		},
+		{
+			name:       "failure-no-internal-ip",
+			node:       newNode("node-1", labels, external),
+			wantReason: "no internal IP",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, reason := findNodeTarget("us-central1", cluster, *tt.node, 9100, tt.proxy)
+			if !reflect.DeepEqual(got, tt.want) || reason != tt.wantReason {
+				t.Errorf("findNodeTarget() = %v, %q, want %v, %q", got, reason, tt.want, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestService_DiscoverNodes(t *testing.T) {
+	i := fake.NewSimpleClientset(
+		newNode("node-1", map[string]string{nodePoolLabel: "default-pool", nodeZoneLabel: "us-central1-b"},
+			apiv1.NodeAddress{Type: apiv1.NodeInternalIP, Address: "10.128.0.21"}),
+		newNode("no-address", nil),
+	)
+	f := &fakeGKEImpl{
+		clusters: &container.ListClustersResponse{
+			Clusters: []*container.Cluster{{Name: "fake-cluster", Location: "us-central1", Endpoint: "35.1.2.3"}},
+		},
+		Interface: i,
+	}
+	s := &Service{project: "fake-project", gke: f, AggregatedList: true}
+	got, err := s.Discover(context.Background())
+	if err != nil || len(got) != 0 {
+		t.Fatalf("Service.Discover() = %v, %v, want no targets without Nodes", got, err)
+	}
+
+	s.Nodes = true
+	got, err = s.Discover(context.Background())
+	if err != nil || len(got) != 1 || got[0].Targets[0] != "10.128.0.21:9100" {
+		t.Fatalf("Service.Discover() = %v, %v, want one target at the default port", got, err)
+	}
+
+	s.NodePort = 9101
+	got, err = s.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("Service.Discover() error = %v", err)
+	}
+	want := []discovery.StaticConfig{
+		{
+			Targets: []string{"10.128.0.21:9101"},
+			Labels: map[string]string{
+				"node":                  "node-1",
+				"nodepool":              "default-pool",
+				"cluster":               "fake-cluster",
+				"zone":                  "us-central1-b",
+				"kubernetes_version":    "v1.20.8-gke.900",
+				"__gke_autopilot":       "false",
+				"__gke_release_channel": "UNSPECIFIED",
+				"__gke_node_pools":      "0",
+			},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Service.Discover() = %v, want %v", got, want)
+	}
+	data, _ := json.Marshal(got)
+	if err := schematest.Validate([]byte(discovery.Schema), data); err != nil {
+		t.Errorf("Service.Discover() = %s, which does not match the schema: %v", data, err)
+	}
+}
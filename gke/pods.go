@@ -0,0 +1,149 @@
+package gke
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	container "google.golang.org/api/container/v1"
+	typesv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/m-lab/gcp-service-discovery/discovery"
+)
+
+// Annotations of pods scraped by Prometheus, by the common convention of the
+// Prometheus Kubernetes example configuration.
+const (
+	podScrapeAnnotation = "prometheus.io/scrape"
+	podPortAnnotation   = "prometheus.io/port"
+	podPathAnnotation   = "prometheus.io/path"
+)
+
+// checkPods lists the running pods of a cluster, and returns a target for
+// every pod annotated with prometheus.io/scrape: "true". The cluster labels are
+// added to every target.
+func (s *Service) checkPods(ctx context.Context, k kubernetes.Interface, zoneName string, cluster *container.Cluster, labels map[string]string) ([]discovery.StaticConfig, error) {
+	listCtx, cancel := s.kubeContext(ctx)
+	pods, err := k.CoreV1().Pods("").List(listCtx, metav1.ListOptions{
+		FieldSelector: "status.phase=Running",
+	})
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	discovery.CountScanned(ctx, "pods", len(pods.Items))
+
+	configs := []discovery.StaticConfig{}
+	for _, pod := range pods.Items {
+		object := zoneName + "/" + cluster.Name + "/" + pod.Namespace + "/pods/" + pod.Name
+		if pod.Annotations[podScrapeAnnotation] != "true" {
+			discovery.Decide(ctx, object, false, "annotation missing")
+			continue
+		}
+		target, reason := findPodTarget(zoneName, cluster, pod, s.APIServerProxy)
+		if target == nil {
+			discovery.Decide(ctx, object, false, reason)
+			continue
+		}
+		for k, v := range labels {
+			target.Labels[k] = v
+		}
+		discovery.Decide(ctx, object, true, "annotated "+podScrapeAnnotation+"=true")
+		discovery.RecordOrigin(ctx, *target, pod)
+		configs = append(configs, *target)
+	}
+	return configs, nil
+}
+
+// findPodTarget returns a target configuration for the port and path of a
+// pod, or nil and the reason why the pod cannot be scraped. The port is the
+// prometheus.io/port annotation, or the first declared container port. When
+// proxy is true, the pod is scraped through the API server proxy of the
+// cluster.
+//
+// In serialized form, the label set of a pod looks like:
+//
+//	{
+//	    "labels": {
+//	        "__metrics_path__": "/federate",
+//	        "cluster": "prometheus-federation",
+//	        "namespace": "default",
+//	        "pod": "prometheus-0",
+//	        "zone": "us-central1"
+//	    },
+//	    "targets": [
+//	        "10.4.0.12:9090"
+//	    ]
+//	}
+func findPodTarget(zoneName string, cluster *container.Cluster, pod typesv1.Pod, proxy bool) (*discovery.StaticConfig, string) {
+	if pod.Status.Phase != typesv1.PodRunning {
+		return nil, "pod not running"
+	}
+	port, err := podPort(pod)
+	if err != nil {
+		return nil, err.Error()
+	}
+	path := pod.Annotations[podPathAnnotation]
+	labels := map[string]string{
+		"pod":       pod.Name,
+		"namespace": pod.Namespace,
+		"cluster":   cluster.Name,
+		"zone":      zoneName,
+	}
+	if !proxy {
+		if pod.Status.PodIP == "" {
+			return nil, "no pod IP"
+		}
+		if path != "" {
+			labels["__metrics_path__"] = path
+		}
+		return &discovery.StaticConfig{
+			Targets: []string{net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(port))},
+			Labels:  labels,
+		}, ""
+	}
+
+	if cluster.Endpoint == "" {
+		return nil, "no cluster endpoint"
+	}
+	// The GKE API reports the endpoint as an IP address without a port.
+	endpoint := strings.TrimPrefix(cluster.Endpoint, "https://")
+	if _, _, err := net.SplitHostPort(endpoint); err != nil {
+		endpoint = net.JoinHostPort(endpoint, "443")
+	}
+	if path == "" {
+		path = "/metrics"
+	}
+	labels["__scheme__"] = "https"
+	labels["__metrics_path__"] = fmt.Sprintf("/api/v1/namespaces/%s/pods/%s:%d/proxy/%s",
+		pod.Namespace, pod.Name, port, strings.TrimPrefix(path, "/"))
+	labels["__gke_apiserver_proxy"] = "true"
+	return &discovery.StaticConfig{
+		Targets: []string{endpoint},
+		Labels:  labels,
+	}, ""
+}
+
+// podPort returns the port of the prometheus.io/port annotation of the pod, or
+// else its first declared container port.
+func podPort(pod typesv1.Pod) (int, error) {
+	if value, ok := pod.Annotations[podPortAnnotation]; ok {
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 1 || port > 65535 {
+			return 0, fmt.Errorf("invalid port annotation %q", value)
+		}
+		return port, nil
+	}
+	for _, c := range pod.Spec.Containers {
+		for _, p := range c.Ports {
+			if p.ContainerPort > 0 && (p.Protocol == "" || p.Protocol == typesv1.ProtocolTCP) {
+				return int(p.ContainerPort), nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("no ports")
+}
@@ -0,0 +1,167 @@
+package gke
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	container "google.golang.org/api/container/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/internal/schematest"
+)
+
+func newPod(name string, annotations map[string]string, ports ...int32) *apiv1.Pod {
+	pod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "monitoring", Annotations: annotations},
+		Status:     apiv1.PodStatus{Phase: apiv1.PodRunning, PodIP: "10.4.0.12"},
+	}
+	c := apiv1.Container{Name: "exporter"}
+	for _, p := range ports {
+		c.Ports = append(c.Ports, apiv1.ContainerPort{ContainerPort: p})
+	}
+	pod.Spec.Containers = []apiv1.Container{c}
+	return pod
+}
+
+func Test_findPodTarget(t *testing.T) {
+	cluster := &container.Cluster{Name: "fake-cluster", Endpoint: "35.1.2.3"}
+	scrape := map[string]string{"prometheus.io/scrape": "true"}
+	tests := []struct {
+		name       string
+		pod        *apiv1.Pod
+		proxy      bool
+		want       *discovery.StaticConfig
+		wantReason string
+	}{
+		{
+			name: "success-annotations",
+			pod: newPod("node-exporter", map[string]string{
+				"prometheus.io/scrape": "true",
+				"prometheus.io/port":   "9100",
+				"prometheus.io/path":   "/probe",
+			}, 8080),
+			want: &discovery.StaticConfig{
+				Targets: []string{"10.4.0.12:9100"},
+				Labels: map[string]string{
+					"pod":              "node-exporter",
+					"namespace":        "monitoring",
+					"cluster":          "fake-cluster",
+					"zone":             "us-central1",
+					"__metrics_path__": "/probe",
+				},
+			},
+		},
+		{
+			name: "success-container-port",
+			pod:  newPod("node-exporter", scrape, 9100),
+			want: &discovery.StaticConfig{
+				Targets: []string{"10.4.0.12:9100"},
+				Labels: map[string]string{
+					"pod":       "node-exporter",
+					"namespace": "monitoring",
+					"cluster":   "fake-cluster",
+					"zone":      "us-central1",
+				},
+			},
+		},
+		{
+			name:  "success-proxy",
+			pod:   newPod("node-exporter", scrape, 9100),
+			proxy: true,
+			want: &discovery.StaticConfig{
+				Targets: []string{"35.1.2.3:443"},
+				Labels: map[string]string{
+					"pod":                   "node-exporter",
+					"namespace":             "monitoring",
+					"cluster":               "fake-cluster",
+					"zone":                  "us-central1",
+					"__scheme__":            "https",
+					"__metrics_path__":      "/api/v1/namespaces/monitoring/pods/node-exporter:9100/proxy/metrics",
+					"__gke_apiserver_proxy": "true",
+				},
+			},
+		},
+		{
+			name:       "failure-no-ports",
+			pod:        newPod("node-exporter", scrape),
+			wantReason: "no ports",
+		},
+		{
+			name:       "failure-invalid-port",
+			pod:        newPod("node-exporter", map[string]string{"prometheus.io/port": "metrics"}, 9100),
+			wantReason: `invalid port annotation "metrics"`,
+		},
+		{
+			name: "failure-no-pod-ip",
+			pod: &apiv1.Pod{
+				Spec:   apiv1.PodSpec{Containers: []apiv1.Container{{Ports: []apiv1.ContainerPort{{ContainerPort: 9100}}}}},
+				Status: apiv1.PodStatus{Phase: apiv1.PodRunning},
+			},
+			wantReason: "no pod IP",
+		},
+		{
+			name:       "failure-not-running",
+			pod:        &apiv1.Pod{Status: apiv1.PodStatus{Phase: apiv1.PodPending}},
+			wantReason: "pod not running",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, reason := findPodTarget("us-central1", cluster, *tt.pod, tt.proxy)
+			if !reflect.DeepEqual(got, tt.want) || reason != tt.wantReason {
+				t.Errorf("findPodTarget() = %v, %q, want %v, %q", got, reason, tt.want, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestService_DiscoverPods(t *testing.T) {
+	i := fake.NewSimpleClientset(
+		newPod("node-exporter", map[string]string{"prometheus.io/scrape": "true"}, 9100),
+		newPod("opted-out", map[string]string{"prometheus.io/scrape": "false"}, 9100),
+		newPod("unannotated", nil, 9100),
+	)
+	f := &fakeGKEImpl{
+		clusters: &container.ListClustersResponse{
+			Clusters: []*container.Cluster{{Name: "fake-cluster", Location: "us-central1", Endpoint: "35.1.2.3"}},
+		},
+		Interface: i,
+	}
+	s := &Service{project: "fake-project", gke: f, AggregatedList: true}
+	got, err := s.Discover(context.Background())
+	if err != nil || len(got) != 0 {
+		t.Fatalf("Service.Discover() = %v, %v, want no targets without Pods", got, err)
+	}
+
+	s.Pods = true
+	got, err = s.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("Service.Discover() error = %v", err)
+	}
+	want := []discovery.StaticConfig{
+		{
+			Targets: []string{"10.4.0.12:9100"},
+			Labels: map[string]string{
+				"pod":                   "node-exporter",
+				"namespace":             "monitoring",
+				"cluster":               "fake-cluster",
+				"zone":                  "us-central1",
+				"__gke_autopilot":       "false",
+				"__gke_release_channel": "UNSPECIFIED",
+				"__gke_node_pools":      "0",
+			},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Service.Discover() = %v, want %v", got, want)
+	}
+	data, _ := json.Marshal(got)
+	if err := schematest.Validate([]byte(discovery.Schema), data); err != nil {
+		t.Errorf("Service.Discover() = %s, which does not match the schema: %v", data, err)
+	}
+}
@@ -0,0 +1,232 @@
+// Package apicall performs GCP API requests for the iface packages of every
+// source with consistent resilience: requests are rate limited per API,
+// retried with exponential backoff after transient errors, paged one page at a
+// time, and recorded in request and quota metrics. For testing, SetFaults
+// injects errors, delays, and truncated lists into requests.
+//
+// Generated API calls are adapted with small closures, e.g.
+//
+//	cluster, err := apicall.Get(ctx, "container",
+//		func(ctx context.Context) (*container.Cluster, error) {
+//			return service.Projects.Locations.Clusters.Get(name).Context(ctx).Do()
+//		},
+//		func(c *container.Cluster) http.Header { return c.Header })
+package apicall
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+	"google.golang.org/api/googleapi"
+
+	"github.com/m-lab/gcp-service-discovery/metrics"
+	"github.com/m-lab/gcp-service-discovery/quota"
+)
+
+// Retry parameters. Requests are attempted at most maxAttempts times, waiting
+// about initialBackoff before the first retry and doubling the wait up to
+// maxBackoff.
+var (
+	maxAttempts    = 4
+	initialBackoff = time.Second
+	maxBackoff     = 16 * time.Second
+)
+
+var (
+	limitsMu sync.Mutex
+	limit    rate.Limit = rate.Inf
+	burst    int
+	limiters = map[string]*rate.Limiter{}
+)
+
+var (
+	// requestsTotal counts API requests by result. Every attempt of a
+	// retried request is counted.
+	//
+	// Provides metrics:
+	//   gcp_api_requests_total{api="appengine", result="ok"}
+	// Usage example:
+	//   requestsTotal.WithLabelValues("appengine", "ok").Inc()
+	requestsTotal = metrics.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gcp_api_requests_total",
+			Help: "Number of GCP API requests by result.",
+		},
+		[]string{"api", "result"},
+	)
+
+	// requestDuration records the duration of every API request attempt.
+	//
+	// Provides metrics:
+	//   gcp_api_request_duration_seconds{api="appengine"}
+	// Usage example:
+	//   requestDuration.WithLabelValues("appengine").Observe(seconds)
+	requestDuration = metrics.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "gcp_api_request_duration_seconds",
+			Help:    "Duration of GCP API requests.",
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+		},
+		[]string{"api"},
+	)
+)
+
+// SetRateLimit limits the requests made to every API to qps requests per
+// second, with bursts of up to burst requests. A qps of zero or less removes
+// the limit. SetRateLimit should be called before discovery starts.
+func SetRateLimit(qps float64, b int) {
+	limitsMu.Lock()
+	defer limitsMu.Unlock()
+	limit, burst = rate.Limit(qps), b
+	if qps <= 0 {
+		limit = rate.Inf
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	limiters = map[string]*rate.Limiter{}
+}
+
+// limiter returns the rate limiter of the named api.
+func limiter(api string) *rate.Limiter {
+	limitsMu.Lock()
+	defer limitsMu.Unlock()
+	l, ok := limiters[api]
+	if !ok {
+		l = rate.NewLimiter(limit, burst)
+		limiters[api] = l
+	}
+	return l
+}
+
+// Get performs an idempotent request with call, and returns its response.
+// Transient errors are retried. The header function returns the HTTP headers of
+// a response, e.g. for quota metrics.
+func Get[T any](ctx context.Context, api string, call func(ctx context.Context) (T, error), header func(T) http.Header) (T, error) {
+	var result T
+	var err error
+	for attempt := 1; ; attempt++ {
+		result, err = Once(ctx, api, call, header)
+		if err == nil || attempt >= maxAttempts || !Retriable(err) {
+			return result, err
+		}
+		if werr := wait(ctx, attempt); werr != nil {
+			return result, err
+		}
+	}
+}
+
+// Once performs a single request with call, and returns its response. Once is
+// used for requests that are not safe to retry, e.g. changes.
+func Once[T any](ctx context.Context, api string, call func(ctx context.Context) (T, error), header func(T) http.Header) (T, error) {
+	var result T
+	if err := limiter(api).Wait(ctx); err != nil {
+		return result, err
+	}
+	start := time.Now()
+	err := injectRequest(ctx, api)
+	if err == nil {
+		result, err = call(ctx)
+	}
+	requestDuration.WithLabelValues(api).Observe(time.Since(start).Seconds())
+	if err != nil {
+		requestsTotal.WithLabelValues(api, "error").Inc()
+		quota.ObserveError(api, err)
+		return result, err
+	}
+	requestsTotal.WithLabelValues(api, "ok").Inc()
+	quota.Observe(api, header(result))
+	return result, nil
+}
+
+// Pages lists every page of a paged API method. The list function requests the
+// page with the given page token, where the first page has an empty token, and
+// next returns the HTTP headers and the next page token of a page. Pages calls
+// f for every page, in order. Every page request is retried independently, so
+// f is never called twice for the same page.
+func Pages[T any](ctx context.Context, api string,
+	list func(ctx context.Context, token string) (T, error),
+	next func(T) (http.Header, string),
+	f func(T) error) error {
+	header := func(page T) http.Header {
+		h, _ := next(page)
+		return h
+	}
+	token := ""
+	for {
+		page, err := Get(ctx, api, func(ctx context.Context) (T, error) {
+			return list(ctx, token)
+		}, header)
+		if err != nil {
+			return err
+		}
+		if err = f(page); err != nil {
+			return err
+		}
+		if _, token = next(page); token == "" || injectTruncate(api) {
+			return nil
+		}
+	}
+}
+
+// errStopPaging stops paging after the first page in FirstPage.
+var errStopPaging = errors.New("stop paging")
+
+// FirstPage requests only the first page of a paged API method, e.g. to verify
+// access to the API in a Check method, and returns the error of the request.
+// The pages function is usually a method of an iface package that calls
+// Pages, and calls f for every page.
+func FirstPage[T any](ctx context.Context, pages func(ctx context.Context, f func(T) error) error) error {
+	err := pages(ctx, func(T) error {
+		return errStopPaging
+	})
+	if errors.Is(err, errStopPaging) {
+		return nil
+	}
+	return err
+}
+
+// Retriable returns true if err is a transient error that may succeed when the
+// request is repeated: rate limit, server, and network timeout errors.
+func Retriable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		switch gerr.Code {
+		case http.StatusTooManyRequests, http.StatusInternalServerError,
+			http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
+}
+
+// wait sleeps before retrying after the given attempt, and returns an error if
+// ctx is done first.
+func wait(ctx context.Context, attempt int) error {
+	d := initialBackoff << (attempt - 1)
+	if d > maxBackoff || d <= 0 {
+		d = maxBackoff
+	}
+	// Add up to 50% jitter, so parallel sources do not retry together.
+	d += time.Duration(rand.Int63n(int64(d)/2 + 1))
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,267 @@
+package apicall
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/prometheusx/promtest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/api/googleapi"
+)
+
+func init() {
+	initialBackoff = time.Millisecond
+	maxBackoff = 2 * time.Millisecond
+}
+
+type page struct {
+	items  []string
+	next   string
+	header http.Header
+}
+
+func pageHeader(p *page) http.Header {
+	return p.header
+}
+
+func TestGet(t *testing.T) {
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable}
+	tests := []struct {
+		name      string
+		errs      []error
+		wantCalls int
+		wantErr   bool
+	}{
+		{
+			name:      "success",
+			wantCalls: 1,
+		},
+		{
+			name:      "success-after-retries",
+			errs:      []error{unavailable, &googleapi.Error{Code: http.StatusTooManyRequests}},
+			wantCalls: 3,
+		},
+		{
+			name:      "error-not-retriable",
+			errs:      []error{&googleapi.Error{Code: http.StatusForbidden}},
+			wantCalls: 1,
+			wantErr:   true,
+		},
+		{
+			name:      "error-too-many-attempts",
+			errs:      []error{unavailable, unavailable, unavailable, unavailable, unavailable},
+			wantCalls: 4,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			got, err := Get(context.Background(), "test",
+				func(ctx context.Context) (*page, error) {
+					calls++
+					if calls <= len(tt.errs) {
+						return nil, tt.errs[calls-1]
+					}
+					return &page{items: []string{"a"}}, nil
+				}, pageHeader)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got.items, []string{"a"}) {
+				t.Errorf("Get() = %v, want [a]", got)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("Get() calls = %d, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestGet_canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	_, err := Get(ctx, "test", func(ctx context.Context) (*page, error) {
+		calls++
+		cancel()
+		return nil, &googleapi.Error{Code: http.StatusServiceUnavailable}
+	}, pageHeader)
+	if err == nil || calls != 1 {
+		t.Errorf("Get() = %v after %d calls, want error after 1 call", err, calls)
+	}
+}
+
+func TestOnce(t *testing.T) {
+	before := testutil.ToFloat64(requestsTotal.WithLabelValues("once", "error"))
+	calls := 0
+	_, err := Once(context.Background(), "once", func(ctx context.Context) (*page, error) {
+		calls++
+		return nil, &googleapi.Error{Code: http.StatusServiceUnavailable}
+	}, pageHeader)
+	if err == nil || calls != 1 {
+		t.Errorf("Once() = %v after %d calls, want error after 1 call", err, calls)
+	}
+	if v := testutil.ToFloat64(requestsTotal.WithLabelValues("once", "error")) - before; v != 1 {
+		t.Errorf("Once() counted %v requests, want 1", v)
+	}
+}
+
+func TestPages(t *testing.T) {
+	pages := map[string]*page{
+		"":   {items: []string{"a", "b"}, next: "p2"},
+		"p2": {items: []string{"c"}, next: "p3"},
+		"p3": {items: []string{"d"}},
+	}
+	tests := []struct {
+		name    string
+		failing string
+		fErr    error
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "success",
+			want: []string{"a", "b", "c", "d"},
+		},
+		{
+			name:    "success-retry-one-page",
+			failing: "p2",
+			want:    []string{"a", "b", "c", "d"},
+		},
+		{
+			name:    "error-from-f",
+			fErr:    fmt.Errorf("stop"),
+			want:    []string{"a", "b"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			failed := false
+			var got []string
+			err := Pages(context.Background(), "test",
+				func(ctx context.Context, token string) (*page, error) {
+					if token == tt.failing && !failed {
+						failed = true
+						return nil, &googleapi.Error{Code: http.StatusBadGateway}
+					}
+					return pages[token], nil
+				},
+				func(p *page) (http.Header, string) { return p.header, p.next },
+				func(p *page) error {
+					got = append(got, p.items...)
+					return tt.fErr
+				})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Pages() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Pages() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFirstPage(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		wantErr bool
+	}{
+		{
+			name: "success",
+		},
+		{
+			name:    "error",
+			err:     &googleapi.Error{Code: http.StatusForbidden},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := FirstPage(context.Background(), func(ctx context.Context, f func(*page) error) error {
+				if tt.err != nil {
+					return tt.err
+				}
+				for _, p := range []*page{{items: []string{"a"}}, {items: []string{"b"}}} {
+					calls++
+					if err := f(p); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("FirstPage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && calls != 1 {
+				t.Errorf("FirstPage() read %d pages, want 1", calls)
+			}
+		})
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRetriable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "server-error", err: &googleapi.Error{Code: http.StatusInternalServerError}, want: true},
+		{name: "wrapped-rate-limit", err: fmt.Errorf("list: %w", &googleapi.Error{Code: http.StatusTooManyRequests}), want: true},
+		{name: "not-found", err: &googleapi.Error{Code: http.StatusNotFound}},
+		{name: "timeout", err: &net.OpError{Op: "dial", Err: timeoutError{}}, want: true},
+		{name: "canceled", err: context.Canceled},
+		{name: "other", err: fmt.Errorf("bad request")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Retriable(tt.err); got != tt.want {
+				t.Errorf("Retriable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetRateLimit(t *testing.T) {
+	defer SetRateLimit(0, 0)
+	SetRateLimit(1, 1)
+	if l := limiter("limited"); l.Limit() != 1 || l.Burst() != 1 {
+		t.Errorf("limiter() = %v/%d, want 1/1", l.Limit(), l.Burst())
+	}
+	_, err := Once(context.Background(), "limited", func(ctx context.Context) (*page, error) {
+		return &page{}, nil
+	}, pageHeader)
+	if err != nil {
+		t.Errorf("Once() with burst error = %v", err)
+	}
+	// The second request would wait longer than the deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = Once(ctx, "limited", func(ctx context.Context) (*page, error) {
+		t.Errorf("Once() made a request beyond the rate limit")
+		return &page{}, nil
+	}, pageHeader)
+	if err == nil {
+		t.Errorf("Once() beyond the rate limit error = nil, want error")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	requestsTotal.WithLabelValues("x", "ok")
+	requestDuration.WithLabelValues("x")
+	injectedFaults.WithLabelValues("x", "x")
+	promtest.LintMetrics(t)
+}
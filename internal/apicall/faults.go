@@ -0,0 +1,163 @@
+package apicall
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/api/googleapi"
+
+	"github.com/m-lab/gcp-service-discovery/metrics"
+)
+
+var (
+	// injectedFaults counts faults injected by SetFaults, by API and kind of
+	// fault: "error", "delay", or "truncate".
+	//
+	// Provides metrics:
+	//   gcp_api_injected_faults_total{api="appengine", fault="error"}
+	// Usage example:
+	//   injectedFaults.WithLabelValues("appengine", "error").Inc()
+	injectedFaults = metrics.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gcp_api_injected_faults_total",
+			Help: "Number of faults injected into GCP API requests for testing.",
+		},
+		[]string{"api", "fault"},
+	)
+)
+
+var (
+	faultsMu sync.Mutex
+	faults   Faults
+
+	// chance returns a random number in [0, 1). The indirection facilitates
+	// testing.
+	chance = rand.Float64
+)
+
+// Faults configures faults injected into API requests, to test the resilience
+// of discovery to realistic failures in staging. The zero value injects no
+// faults. Faults implements the flag.Value interface.
+type Faults struct {
+	// ErrorRate is the fraction of request attempts that fail with an HTTP
+	// 503 error, which is retried like a real transient error.
+	ErrorRate float64
+
+	// DelayRate is the fraction of request attempts delayed by Delay before
+	// they are sent.
+	DelayRate float64
+	Delay     time.Duration
+
+	// TruncateRate is the fraction of pages after which paging stops early,
+	// as if the page were the last, so lists are silently incomplete.
+	TruncateRate float64
+}
+
+// Enabled returns true if any fault may be injected.
+func (f Faults) Enabled() bool {
+	return f.ErrorRate > 0 || (f.DelayRate > 0 && f.Delay > 0) || f.TruncateRate > 0
+}
+
+// String formats the faults like "error=0.1,delay=0.2,latency=2s,truncate=0.05".
+func (f Faults) String() string {
+	if !f.Enabled() {
+		return ""
+	}
+	return fmt.Sprintf("error=%g,delay=%g,latency=%s,truncate=%g", f.ErrorRate, f.DelayRate, f.Delay, f.TruncateRate)
+}
+
+// Set parses a comma separated list of faults, like
+// "error=0.1,delay=0.2,latency=2s,truncate=0.05". Rates are fractions between
+// 0 and 1.
+func (f *Faults) Set(value string) error {
+	result := Faults{}
+	for _, opt := range strings.Split(value, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(opt), "=")
+		if !ok {
+			return fmt.Errorf("invalid fault %q: want name=value", opt)
+		}
+		if k == "latency" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return fmt.Errorf("invalid fault latency %q", v)
+			}
+			result.Delay = d
+			continue
+		}
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return fmt.Errorf("invalid fault rate %q=%q: want a fraction between 0 and 1", k, v)
+		}
+		switch k {
+		case "error":
+			result.ErrorRate = rate
+		case "delay":
+			result.DelayRate = rate
+		case "truncate":
+			result.TruncateRate = rate
+		default:
+			return fmt.Errorf("unknown fault %q: want error, delay, latency, or truncate", k)
+		}
+	}
+	*f = result
+	return nil
+}
+
+// SetFaults injects the given faults into every later API request. The zero
+// Faults stops injecting faults. SetFaults should be called before discovery
+// starts, and only in testing environments.
+func SetFaults(f Faults) {
+	faultsMu.Lock()
+	defer faultsMu.Unlock()
+	faults = f
+}
+
+// currentFaults returns the faults set by SetFaults.
+func currentFaults() Faults {
+	faultsMu.Lock()
+	defer faultsMu.Unlock()
+	return faults
+}
+
+// injectRequest delays a request attempt, or returns an error for it, as
+// configured by SetFaults. injectRequest returns an error if ctx is done
+// during the delay.
+func injectRequest(ctx context.Context, api string) error {
+	f := currentFaults()
+	if !f.Enabled() {
+		return nil
+	}
+	if f.Delay > 0 && chance() < f.DelayRate {
+		injectedFaults.WithLabelValues(api, "delay").Inc()
+		t := time.NewTimer(f.Delay)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if chance() < f.ErrorRate {
+		injectedFaults.WithLabelValues(api, "error").Inc()
+		return &googleapi.Error{Code: http.StatusServiceUnavailable, Message: "injected fault"}
+	}
+	return nil
+}
+
+// injectTruncate returns true if paging should stop after the current page, as
+// configured by SetFaults.
+func injectTruncate(api string) bool {
+	f := currentFaults()
+	if f.TruncateRate <= 0 || chance() >= f.TruncateRate {
+		return false
+	}
+	injectedFaults.WithLabelValues(api, "truncate").Inc()
+	return true
+}
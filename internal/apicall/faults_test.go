@@ -0,0 +1,119 @@
+package apicall
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestFaults_Set(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    Faults
+		wantErr bool
+	}{
+		{
+			name:  "success",
+			value: "error=0.1, delay=0.2,latency=2s,truncate=0.05",
+			want:  Faults{ErrorRate: 0.1, DelayRate: 0.2, Delay: 2 * time.Second, TruncateRate: 0.05},
+		},
+		{
+			name:    "failure-rate-too-large",
+			value:   "error=2",
+			wantErr: true,
+		},
+		{
+			name:    "failure-unknown-fault",
+			value:   "panic=0.1",
+			wantErr: true,
+		},
+		{
+			name:    "failure-invalid-latency",
+			value:   "latency=soon",
+			wantErr: true,
+		},
+		{
+			name:    "failure-missing-value",
+			value:   "error",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := Faults{}
+			err := f.Set(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Faults.Set() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if f != tt.want {
+				t.Errorf("Faults.Set() = %#v, want %#v", f, tt.want)
+			}
+		})
+	}
+	f := Faults{ErrorRate: 0.5}
+	if got, want := f.String(), "error=0.5,delay=0,latency=0s,truncate=0"; got != want {
+		t.Errorf("Faults.String() = %q, want %q", got, want)
+	}
+	if got := (Faults{}).String(); got != "" {
+		t.Errorf("Faults.String() = %q, want empty", got)
+	}
+}
+
+func TestSetFaults(t *testing.T) {
+	origChance := chance
+	defer func() {
+		chance = origChance
+		SetFaults(Faults{})
+	}()
+	chance = func() float64 { return 0.25 }
+
+	// Every attempt fails with a retriable error, until the attempts run out.
+	SetFaults(Faults{ErrorRate: 0.5})
+	calls := 0
+	_, err := Get(context.Background(), "test", func(ctx context.Context) (*page, error) {
+		calls++
+		return &page{}, nil
+	}, pageHeader)
+	gerr, ok := err.(*googleapi.Error)
+	if !ok || gerr.Code != http.StatusServiceUnavailable || calls != 0 {
+		t.Errorf("Get() = %v after %d calls, want an injected 503 error after 0 calls", err, calls)
+	}
+
+	// Attempts are delayed.
+	SetFaults(Faults{DelayRate: 0.5, Delay: 10 * time.Millisecond})
+	start := time.Now()
+	if _, err := Once(context.Background(), "test", func(ctx context.Context) (*page, error) {
+		return &page{}, nil
+	}, pageHeader); err != nil {
+		t.Errorf("Once() error = %v", err)
+	}
+	if d := time.Since(start); d < 10*time.Millisecond {
+		t.Errorf("Once() returned after %s, want at least 10ms", d)
+	}
+
+	// Paging stops after the first page.
+	SetFaults(Faults{TruncateRate: 0.5})
+	pages := 0
+	err = Pages(context.Background(), "test",
+		func(ctx context.Context, token string) (*page, error) {
+			return &page{next: "more"}, nil
+		},
+		func(p *page) (http.Header, string) { return p.header, p.next },
+		func(p *page) error {
+			pages++
+			return nil
+		})
+	if err != nil || pages != 1 {
+		t.Errorf("Pages() = %v after %d pages, want nil after 1 page", err, pages)
+	}
+
+	// Faults with lower rates are not injected.
+	SetFaults(Faults{ErrorRate: 0.1, TruncateRate: 0.1})
+	if err := injectRequest(context.Background(), "test"); err != nil || injectTruncate("test") {
+		t.Errorf("injectRequest() = %v, want no faults", err)
+	}
+}
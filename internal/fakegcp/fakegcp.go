@@ -0,0 +1,344 @@
+// Package fakegcp serves fake App Engine Admin, Compute, and Container API
+// responses over HTTP, so tests exercise the generated client libraries and
+// the iface packages of every source end to end: request paths, pagination,
+// field masks, and error responses.
+//
+// A Server is populated with the resources it returns, e.g.
+//
+//	s := fakegcp.NewServer()
+//	defer s.Close()
+//	s.AddApp(&appengine.Application{Id: "mlab-sandbox", LocationId: "us-central"})
+//	s.AddService("mlab-sandbox", &appengine.Service{Id: "etl"})
+//	s.Redirect()
+//
+// Redirect sends requests for Google APIs made by clients built with the
+// transport package to the Server, including OAuth2 token requests.
+package fakegcp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+
+	appengine "google.golang.org/api/appengine/v1"
+	compute "google.golang.org/api/compute/v1"
+	container "google.golang.org/api/container/v1"
+
+	"github.com/m-lab/gcp-service-discovery/transport"
+)
+
+// Hosts are the API hosts served by a Server.
+var Hosts = []string{
+	"appengine.googleapis.com",
+	"compute.googleapis.com",
+	"container.googleapis.com",
+	"oauth2.googleapis.com",
+}
+
+// Request describes a request received by a Server.
+type Request struct {
+	Method    string
+	Path      string
+	Fields    string
+	PageToken string
+}
+
+// failure is an error response returned for a path.
+type failure struct {
+	code  int
+	times int
+}
+
+// Server is a fake GCP API server.
+type Server struct {
+	*httptest.Server
+
+	// PageSize is the maximum number of items in every page of a list
+	// response. Zero returns all items in one page.
+	PageSize int
+
+	mu        sync.Mutex
+	apps      map[string]*appengine.Application
+	services  map[string][]*appengine.Service
+	versions  map[string][]*appengine.Version
+	instances map[string][]*appengine.Instance
+	zones     map[string][]*compute.Zone
+	vms       map[string]*compute.Instance
+	firewalls map[string][]*compute.Firewall
+	clusters  map[string][]*container.Cluster
+	failures  map[string]*failure
+	requests  []Request
+}
+
+// NewServer starts a new Server. The caller must call Close when finished.
+func NewServer() *Server {
+	s := &Server{
+		apps:      map[string]*appengine.Application{},
+		services:  map[string][]*appengine.Service{},
+		versions:  map[string][]*appengine.Version{},
+		instances: map[string][]*appengine.Instance{},
+		zones:     map[string][]*compute.Zone{},
+		vms:       map[string]*compute.Instance{},
+		firewalls: map[string][]*compute.Firewall{},
+		clusters:  map[string][]*container.Cluster{},
+		failures:  map[string]*failure{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Redirect redirects the requests for all Hosts made by clients built with the
+// transport package to the Server.
+func (s *Server) Redirect() error {
+	for _, h := range Hosts {
+		if err := transport.Redirect(h, s.URL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close removes the redirects of the Server and shuts it down.
+func (s *Server) Close() {
+	for _, h := range Hosts {
+		transport.Redirect(h, "")
+	}
+	s.Server.Close()
+}
+
+// AddApp adds an App Engine application. The application Id names its project.
+func (s *Server) AddApp(app *appengine.Application) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apps[app.Id] = app
+}
+
+// AddService adds an App Engine service to the project.
+func (s *Server) AddService(project string, svc *appengine.Service) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.services[project] = append(s.services[project], svc)
+}
+
+// AddVersion adds a version to the App Engine service.
+func (s *Server) AddVersion(project, service string, v *appengine.Version) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := project + "/" + service
+	s.versions[key] = append(s.versions[key], v)
+}
+
+// AddInstance adds an instance to the App Engine version.
+func (s *Server) AddInstance(project, service, version string, i *appengine.Instance) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := project + "/" + service + "/" + version
+	s.instances[key] = append(s.instances[key], i)
+}
+
+// AddZone adds a Compute zone to the project.
+func (s *Server) AddZone(project string, z *compute.Zone) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.zones[project] = append(s.zones[project], z)
+}
+
+// AddVM adds a Compute instance to the zone of the project.
+func (s *Server) AddVM(project, zone string, i *compute.Instance) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.vms[project+"/"+zone+"/"+i.Name] = i
+}
+
+// AddFirewall adds a firewall rule to the project.
+func (s *Server) AddFirewall(project string, f *compute.Firewall) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.firewalls[project] = append(s.firewalls[project], f)
+}
+
+// AddCluster adds a GKE cluster to the project. The cluster Location and Zone
+// should name its zone or region.
+func (s *Server) AddCluster(project string, c *container.Cluster) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clusters[project] = append(s.clusters[project], c)
+}
+
+// Fail causes the next times requests for path, e.g.
+// "/compute/v1/projects/mlab-sandbox/zones", to fail with an error response
+// with the given HTTP status code. When times is zero or less, every request
+// fails.
+func (s *Server) Fail(path string, code, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[path] = &failure{code: code, times: times}
+}
+
+// Requests returns every request received by the Server, in order.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request{}, s.requests...)
+}
+
+// serve routes requests to the fake APIs.
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := r.URL.Query()
+	s.requests = append(s.requests, Request{
+		Method: r.Method, Path: r.URL.Path, Fields: q.Get("fields"), PageToken: q.Get("pageToken"),
+	})
+	if f, ok := s.failures[r.URL.Path]; ok {
+		if f.times > 0 {
+			f.times--
+			if f.times == 0 {
+				delete(s.failures, r.URL.Path)
+			}
+		}
+		writeError(w, f.code, "injected failure")
+		return
+	}
+	if r.URL.Path == "/token" {
+		writeJSON(w, map[string]interface{}{
+			"access_token": "fake-token", "token_type": "Bearer", "expires_in": 3600,
+		}, "")
+		return
+	}
+	p := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	fields := q.Get("fields")
+	switch {
+	// App Engine Admin API.
+	case match(p, "v1", "apps", "*"):
+		app, ok := s.apps[p[2]]
+		if !ok {
+			writeError(w, http.StatusNotFound, "application not found")
+			return
+		}
+		s.write(w, app, nil, fields)
+	case match(p, "v1", "apps", "*", "services"):
+		items, next, err := page(s.services[p[2]], q.Get("pageToken"), s.PageSize)
+		s.write(w, &appengine.ListServicesResponse{Services: items, NextPageToken: next}, err, fields)
+	case match(p, "v1", "apps", "*", "services", "*", "versions"):
+		items, next, err := page(s.versions[p[2]+"/"+p[4]], q.Get("pageToken"), s.PageSize)
+		s.write(w, &appengine.ListVersionsResponse{Versions: items, NextPageToken: next}, err, fields)
+	case match(p, "v1", "apps", "*", "services", "*", "versions", "*", "instances"):
+		items, next, err := page(s.instances[p[2]+"/"+p[4]+"/"+p[6]], q.Get("pageToken"), s.PageSize)
+		s.write(w, &appengine.ListInstancesResponse{Instances: items, NextPageToken: next}, err, fields)
+
+	// Compute API.
+	case match(p, "compute", "v1", "projects", "*", "zones"):
+		items, next, err := page(s.zones[p[3]], q.Get("pageToken"), s.PageSize)
+		s.write(w, &compute.ZoneList{Items: items, NextPageToken: next}, err, fields)
+	case match(p, "compute", "v1", "projects", "*", "zones", "*", "instances", "*"):
+		vm, ok := s.vms[p[3]+"/"+p[5]+"/"+p[7]]
+		if !ok {
+			writeError(w, http.StatusNotFound, "instance not found")
+			return
+		}
+		s.write(w, vm, nil, fields)
+	case match(p, "compute", "v1", "projects", "*", "global", "firewalls"):
+		items, next, err := page(s.firewalls[p[3]], q.Get("pageToken"), s.PageSize)
+		s.write(w, &compute.FirewallList{Items: items, NextPageToken: next}, err, fields)
+
+	// Container API.
+	case match(p, "v1", "projects", "*", "zones", "*", "clusters"):
+		var clusters []*container.Cluster
+		for _, c := range s.clusters[p[2]] {
+			if p[4] == "-" || c.Zone == p[4] || c.Location == p[4] {
+				clusters = append(clusters, c)
+			}
+		}
+		s.write(w, &container.ListClustersResponse{Clusters: clusters}, nil, fields)
+	case match(p, "v1", "projects", "*", "locations", "*", "clusters", "*"):
+		for _, c := range s.clusters[p[2]] {
+			if c.Name == p[6] && (c.Location == p[4] || c.Zone == p[4]) {
+				s.write(w, c, nil, fields)
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, "cluster not found")
+	default:
+		writeError(w, http.StatusNotFound, "unknown method: "+r.URL.Path)
+	}
+}
+
+// write writes v as a JSON response, limited to the fields of the field mask,
+// or an error response if err is not nil.
+func (s *Server) write(w http.ResponseWriter, v interface{}, err error, fields string) {
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, v, fields)
+}
+
+// match returns true if path has the segments of pattern, where "*" matches
+// any segment.
+func match(path []string, pattern ...string) bool {
+	if len(path) != len(pattern) {
+		return false
+	}
+	for i := range pattern {
+		if pattern[i] != "*" && pattern[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// page returns the page of items starting at the offset in token, and the
+// token of the next page.
+func page[T any](items []T, token string, size int) ([]T, string, error) {
+	start := 0
+	if token != "" {
+		var err error
+		start, err = strconv.Atoi(token)
+		if err != nil || start < 0 || start > len(items) {
+			return nil, "", fmt.Errorf("invalid page token: %q", token)
+		}
+	}
+	if size <= 0 || start+size >= len(items) {
+		return items[start:], "", nil
+	}
+	return items[start : start+size], strconv.Itoa(start + size), nil
+}
+
+// writeJSON writes v limited to the fields of the field mask.
+func writeJSON(w http.ResponseWriter, v interface{}, fields string) {
+	data, err := json.Marshal(v)
+	if err == nil && fields != "" {
+		var m mask
+		m, err = parseMask(fields)
+		if err == nil {
+			var obj interface{}
+			json.Unmarshal(data, &obj)
+			data, err = json.Marshal(m.apply(obj))
+		}
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// writeError writes an error response in the format of Google APIs.
+func writeError(w http.ResponseWriter, code int, message string) {
+	data, _ := json.Marshal(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": message,
+			"errors":  []map[string]string{{"reason": http.StatusText(code), "message": message}},
+		},
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
@@ -0,0 +1,218 @@
+package fakegcp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	appengine "google.golang.org/api/appengine/v1"
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+
+	aeiface "github.com/m-lab/gcp-service-discovery/aeflex/iface"
+	"github.com/m-lab/gcp-service-discovery/credentials"
+	gceiface "github.com/m-lab/gcp-service-discovery/gce/iface"
+)
+
+// setupClient returns a client authenticated with fake user credentials, whose
+// tokens are fetched from s.
+func setupClient(t *testing.T, s *Server) *http.Client {
+	creds := filepath.Join(t.TempDir(), "creds.json")
+	err := os.WriteFile(creds, []byte(`{"type": "authorized_user", "client_id": "id",
+		"client_secret": "secret", "refresh_token": "token"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Redirect(); err != nil {
+		t.Fatal(err)
+	}
+	client, err := credentials.Config{File: creds}.Client(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestServer_AppEngine(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.PageSize = 2
+	for _, id := range []string{"etl", "gardener", "annotator"} {
+		s.AddService("mlab-sandbox", &appengine.Service{Id: id, Name: "apps/mlab-sandbox/services/" + id})
+	}
+	s.AddVersion("mlab-sandbox", "etl", &appengine.Version{Id: "v1", ServingStatus: "SERVING", Runtime: "go"})
+	aec, err := appengine.New(setupClient(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := aeiface.NewAppAPI("mlab-sandbox", aec)
+
+	var services []string
+	err = api.ServicesPages(context.Background(), func(r *appengine.ListServicesResponse) error {
+		for _, svc := range r.Services {
+			services = append(services, svc.Id)
+		}
+		return nil
+	})
+	if err != nil || !reflect.DeepEqual(services, []string{"etl", "gardener", "annotator"}) {
+		t.Errorf("ServicesPages() = %v, %v; want all services", services, err)
+	}
+	var pages []string
+	for _, r := range s.Requests() {
+		if r.Path == "/v1/apps/mlab-sandbox/services" {
+			pages = append(pages, r.PageToken)
+		}
+	}
+	if !reflect.DeepEqual(pages, []string{"", "2"}) {
+		t.Errorf("ServicesPages() page tokens = %q, want two pages", pages)
+	}
+
+	var versions []*appengine.Version
+	err = api.VersionsPages(context.Background(), "etl", func(r *appengine.ListVersionsResponse) error {
+		versions = append(versions, r.Versions...)
+		return nil
+	})
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("VersionsPages() = %v, %v; want 1 version", versions, err)
+	}
+	// The field mask of the request excludes the runtime.
+	if versions[0].ServingStatus != "SERVING" || versions[0].Runtime != "" {
+		t.Errorf("VersionsPages() = %#v, want fields limited by the field mask", versions[0])
+	}
+}
+
+func TestServer_Compute(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.AddVM("mlab-sandbox", "us-east1-b", &compute.Instance{
+		Name: "prometheus", Description: "not in the field mask",
+		Labels: map[string]string{"team": "platform"},
+	})
+	s.AddFirewall("mlab-sandbox", &compute.Firewall{Name: "allow-all", SourceRanges: []string{"0.0.0.0/0"}})
+	svc, err := compute.New(setupClient(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := gceiface.NewCompute(svc)
+
+	vm, err := api.InstanceGet(context.Background(), "mlab-sandbox", "us-east1-b", "prometheus")
+	if err != nil || vm.Labels["team"] != "platform" || vm.Description != "" {
+		t.Errorf("InstanceGet() = %#v, %v; want masked instance", vm, err)
+	}
+	_, err = api.InstanceGet(context.Background(), "mlab-sandbox", "us-east1-b", "missing")
+	if !isCode(err, http.StatusNotFound) {
+		t.Errorf("InstanceGet() error = %v, want not found", err)
+	}
+
+	s.Fail("/compute/v1/projects/mlab-sandbox/global/firewalls", http.StatusForbidden, 1)
+	if _, err = api.FirewallList(context.Background(), "mlab-sandbox"); !isCode(err, http.StatusForbidden) {
+		t.Errorf("FirewallList() error = %v, want forbidden", err)
+	}
+	rules, err := api.FirewallList(context.Background(), "mlab-sandbox")
+	if err != nil || len(rules) != 1 || rules[0].Name != "allow-all" {
+		t.Errorf("FirewallList() after failure = %v, %v; want 1 rule", rules, err)
+	}
+}
+
+func TestServer_Fail(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.AddZone("mlab-sandbox", &compute.Zone{Name: "us-east1-b"})
+	path := "/compute/v1/projects/mlab-sandbox/zones"
+	get := func() int {
+		resp, err := http.Get(s.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	s.Fail(path, http.StatusServiceUnavailable, 2)
+	got := []int{get(), get(), get()}
+	if want := []int{503, 503, 200}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Fail(2) status codes = %v, want %v", got, want)
+	}
+	s.Fail(path, http.StatusInternalServerError, 0)
+	got = []int{get(), get(), get()}
+	if want := []int{500, 500, 500}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Fail(0) status codes = %v, want %v", got, want)
+	}
+}
+
+func isCode(err error, code int) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == code
+}
+
+func Test_mask(t *testing.T) {
+	obj := map[string]interface{}{
+		"nextPageToken": "2",
+		"kind":          "list",
+		"items": []interface{}{
+			map[string]interface{}{"name": "a", "zone": "z", "tags": map[string]interface{}{"items": []interface{}{"x"}, "fingerprint": "f"}},
+		},
+	}
+	tests := []struct {
+		name    string
+		fields  string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "success-top-level",
+			fields: "nextPageToken,kind",
+			want:   `{"kind":"list","nextPageToken":"2"}`,
+		},
+		{
+			name:   "success-sub-selection",
+			fields: "items(name,tags/items)",
+			want:   `{"items":[{"name":"a","tags":{"items":["x"]}}]}`,
+		},
+		{
+			name:   "success-merged-paths",
+			fields: "items/tags/fingerprint,items/name,items/tags",
+			want:   `{"items":[{"name":"a","tags":{"fingerprint":"f","items":["x"]}}]}`,
+		},
+		{
+			name:   "success-missing-field",
+			fields: "items(id)",
+			want:   `{"items":[{}]}`,
+		},
+		{
+			name:    "failure-empty-name",
+			fields:  "items(,name)",
+			wantErr: true,
+		},
+		{
+			name:    "failure-unbalanced",
+			fields:  "items(name",
+			wantErr: true,
+		},
+		{
+			name:    "failure-trailing",
+			fields:  "items)",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := parseMask(tt.fields)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseMask() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got, _ := json.Marshal(m.apply(obj))
+			if string(got) != tt.want {
+				t.Errorf("mask.apply() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package fakegcp
+
+import (
+	"fmt"
+	"strings"
+)
+
+// mask is a parsed field mask, like "nextPageToken,items(name,tags/items)".
+// Every key selects a field, and its value selects the subfields of that
+// field. A nil value selects all subfields.
+type mask map[string]mask
+
+// parseMask parses a field mask in the syntax of the "fields" parameter of
+// Google APIs.
+func parseMask(s string) (mask, error) {
+	p := &maskParser{s: s}
+	m, err := p.list()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(s) {
+		return nil, fmt.Errorf("invalid field mask %q at %d", s, p.pos)
+	}
+	return m, nil
+}
+
+type maskParser struct {
+	s   string
+	pos int
+}
+
+// list parses comma separated paths.
+func (p *maskParser) list() (mask, error) {
+	m := mask{}
+	for {
+		name, sub, err := p.path()
+		if err != nil {
+			return nil, err
+		}
+		m.merge(name, sub)
+		if p.pos >= len(p.s) || p.s[p.pos] != ',' {
+			return m, nil
+		}
+		p.pos++
+	}
+}
+
+// path parses a field name followed by an optional "/path" or "(list)".
+func (p *maskParser) path() (string, mask, error) {
+	end := p.pos
+	for end < len(p.s) && !strings.ContainsRune(",()/", rune(p.s[end])) {
+		end++
+	}
+	name := p.s[p.pos:end]
+	if name == "" {
+		return "", nil, fmt.Errorf("invalid field mask %q at %d", p.s, p.pos)
+	}
+	p.pos = end
+	if p.pos >= len(p.s) {
+		return name, nil, nil
+	}
+	switch p.s[p.pos] {
+	case '/':
+		p.pos++
+		subName, sub, err := p.path()
+		if err != nil {
+			return "", nil, err
+		}
+		m := mask{}
+		m.merge(subName, sub)
+		return name, m, nil
+	case '(':
+		p.pos++
+		sub, err := p.list()
+		if err != nil {
+			return "", nil, err
+		}
+		if p.pos >= len(p.s) || p.s[p.pos] != ')' {
+			return "", nil, fmt.Errorf("invalid field mask %q: missing )", p.s)
+		}
+		p.pos++
+		return name, sub, nil
+	}
+	return name, nil, nil
+}
+
+// merge adds the field name with the subfields of sub to m.
+func (m mask) merge(name string, sub mask) {
+	current, ok := m[name]
+	switch {
+	case !ok:
+		m[name] = sub
+	case current == nil || sub == nil:
+		m[name] = nil
+	default:
+		for k, v := range sub {
+			current.merge(k, v)
+		}
+	}
+}
+
+// apply returns the fields of the decoded JSON value v selected by m.
+func (m mask) apply(v interface{}) interface{} {
+	if m == nil {
+		return v
+	}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		result := map[string]interface{}{}
+		for k, sub := range m {
+			if value, ok := t[k]; ok {
+				result[k] = sub.apply(value)
+			}
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(t))
+		for i := range t {
+			result[i] = m.apply(t[i])
+		}
+		return result
+	}
+	return v
+}
@@ -0,0 +1,164 @@
+// Package schematest validates JSON documents against a JSON schema, so tests
+// can check that outputs match the published schema of the discovery package.
+//
+// Only the keywords used by that schema are supported: $ref to local $defs,
+// type, enum, pattern, minLength, items, required, properties,
+// additionalProperties, and propertyNames. Other keywords are ignored.
+package schematest
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Validate returns an error describing the first value of doc that does not
+// match schema.
+func Validate(schema, doc []byte) error {
+	var root, v interface{}
+	if err := json.Unmarshal(schema, &root); err != nil {
+		return fmt.Errorf("invalid schema: %w", err)
+	}
+	if err := json.Unmarshal(doc, &v); err != nil {
+		return fmt.Errorf("invalid document: %w", err)
+	}
+	r, ok := root.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("invalid schema: not an object")
+	}
+	return (&validator{root: r}).validate("$", r, v)
+}
+
+type validator struct {
+	root map[string]interface{}
+}
+
+// resolve returns the schema referenced by s, or s if it has no $ref.
+func (c *validator) resolve(s map[string]interface{}) (map[string]interface{}, error) {
+	ref, ok := s["$ref"].(string)
+	if !ok {
+		return s, nil
+	}
+	name := strings.TrimPrefix(ref, "#/$defs/")
+	defs, _ := c.root["$defs"].(map[string]interface{})
+	def, ok := defs[name].(map[string]interface{})
+	if !ok || name == ref {
+		return nil, fmt.Errorf("unsupported $ref %q", ref)
+	}
+	return def, nil
+}
+
+func (c *validator) validate(path string, schema interface{}, v interface{}) error {
+	if b, ok := schema.(bool); ok {
+		if !b {
+			return fmt.Errorf("%s: not allowed", path)
+		}
+		return nil
+	}
+	s, ok := schema.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s: invalid schema %v", path, schema)
+	}
+	s, err := c.resolve(s)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if t, ok := s["type"].(string); ok && typeOf(v) != t && !(t == "number" && typeOf(v) == "integer") {
+		return fmt.Errorf("%s: got %s, want %s", path, typeOf(v), t)
+	}
+	if enum, ok := s["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			found = found || reflect.DeepEqual(e, v)
+		}
+		if !found {
+			return fmt.Errorf("%s: %v is not one of %v", path, v, enum)
+		}
+	}
+	switch v := v.(type) {
+	case string:
+		if p, ok := s["pattern"].(string); ok {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return fmt.Errorf("%s: invalid pattern: %w", path, err)
+			}
+			if !re.MatchString(v) {
+				return fmt.Errorf("%s: %q does not match %q", path, v, p)
+			}
+		}
+		if n, ok := s["minLength"].(float64); ok && len(v) < int(n) {
+			return fmt.Errorf("%s: %q is shorter than %v", path, v, n)
+		}
+	case []interface{}:
+		if items, ok := s["items"]; ok {
+			for i, item := range v {
+				if err := c.validate(fmt.Sprintf("%s[%d]", path, i), items, item); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]interface{}:
+		return c.validateObject(path, s, v)
+	}
+	return nil
+}
+
+func (c *validator) validateObject(path string, s map[string]interface{}, v map[string]interface{}) error {
+	required, _ := s["required"].([]interface{})
+	for _, r := range required {
+		if _, ok := v[r.(string)]; !ok {
+			return fmt.Errorf("%s: missing %q", path, r)
+		}
+	}
+	props, _ := s["properties"].(map[string]interface{})
+	keys := make([]string, 0, len(v))
+	for k := range v {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		p := path + "." + k
+		if names, ok := s["propertyNames"]; ok {
+			if err := c.validate(p+" (name)", names, k); err != nil {
+				return err
+			}
+		}
+		if prop, ok := props[k]; ok {
+			if err := c.validate(p, prop, v[k]); err != nil {
+				return err
+			}
+			continue
+		}
+		if extra, ok := s["additionalProperties"]; ok {
+			if err := c.validate(p, extra, v[k]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// typeOf returns the JSON schema type of a decoded JSON value.
+func typeOf(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == float64(int64(v)) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
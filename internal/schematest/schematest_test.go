@@ -0,0 +1,100 @@
+package schematest
+
+import (
+	"testing"
+)
+
+const schema = `{
+    "type": "array",
+    "items": {"$ref": "#/$defs/item"},
+    "$defs": {
+        "item": {
+            "type": "object",
+            "required": ["name"],
+            "properties": {
+                "name": {"type": "string", "minLength": 1},
+                "kind": {"enum": ["a", "b"]},
+                "size": {"type": "number"}
+            },
+            "propertyNames": {"pattern": "^[a-z]+$"},
+            "additionalProperties": {"type": "string", "pattern": "^x"}
+        }
+    }
+}`
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		doc     string
+		wantErr bool
+	}{
+		{
+			name: "success",
+			doc:  `[{"name": "n", "kind": "a", "size": 1, "extra": "xyz"}, {"name": "m", "size": 1.5}]`,
+		},
+		{
+			name: "success-empty",
+			doc:  `[]`,
+		},
+		{
+			name:    "error-type",
+			doc:     `{}`,
+			wantErr: true,
+		},
+		{
+			name:    "error-required",
+			doc:     `[{"kind": "a"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "error-min-length",
+			doc:     `[{"name": ""}]`,
+			wantErr: true,
+		},
+		{
+			name:    "error-enum",
+			doc:     `[{"name": "n", "kind": "c"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "error-additional-pattern",
+			doc:     `[{"name": "n", "extra": "abc"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "error-property-name",
+			doc:     `[{"name": "n", "Extra": "xyz"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "error-invalid-document",
+			doc:     `[`,
+			wantErr: true,
+		},
+		{
+			name:    "error-invalid-schema",
+			schema:  `[]`,
+			doc:     `[]`,
+			wantErr: true,
+		},
+		{
+			name:    "error-unsupported-ref",
+			schema:  `{"items": {"$ref": "other.json"}}`,
+			doc:     `[1]`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.schema
+			if s == "" {
+				s = schema
+			}
+			err := Validate([]byte(s), []byte(tt.doc))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+// Package jsonl appends discovered targets to a file or named pipe as JSON
+// Lines, one StaticConfig per line, so stream processors can tail discovery
+// results instead of re-reading whole documents. Regular files are rotated
+// when they grow larger than a maximum size.
+package jsonl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/m-lab/gcp-service-discovery/discovery"
+)
+
+// Scheme is the URL scheme of JSON Lines outputs, which name an absolute path,
+// e.g.
+//
+//	jsonl:///var/log/targets/gke.jsonl?max_bytes=104857600&max_files=5
+//
+// With max_bytes, a file that would grow larger than max_bytes is renamed with
+// the suffix ".1", earlier files are renamed ".2" and so on, and at most
+// max_files old files are kept. Named pipes are never rotated, and writes
+// block until a reader opens the pipe.
+const Scheme = "jsonl"
+
+// DefaultMaxFiles is the number of rotated files kept when the output URL does
+// not set max_files.
+const DefaultMaxFiles = 5
+
+// Writer appends targets to a file. Writer implements the discovery.Writer
+// interface.
+type Writer struct {
+	path     string
+	maxBytes int64
+	maxFiles int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// New creates a Writer for the path of a URL with the Scheme. New is a
+// discovery.WriterFactory.
+func New(u *url.URL) (discovery.Writer, error) {
+	if u.Host != "" || u.Path == "" {
+		return nil, fmt.Errorf("jsonl output must name an absolute path, like jsonl:///path: %q", u.String())
+	}
+	w := &Writer{path: u.Path, maxFiles: DefaultMaxFiles}
+	q := u.Query()
+	if v := q.Get("max_bytes"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid max_bytes: %q", v)
+		}
+		w.maxBytes = n
+	}
+	if v := q.Get("max_files"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid max_files: %q", v)
+		}
+		w.maxFiles = n
+	}
+	return w, nil
+}
+
+// String returns the output URL of the Writer.
+func (w *Writer) String() string {
+	return Scheme + "://" + w.path
+}
+
+// Write appends one line for every config. The lines of one call are always
+// written to the same file.
+func (w *Writer) Write(ctx context.Context, configs []discovery.StaticConfig) error {
+	data := []byte{}
+	for _, config := range configs {
+		line, err := json.Marshal(config)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	err := w.open()
+	if err != nil {
+		return err
+	}
+	if w.maxBytes > 0 && w.size > 0 && w.size+int64(len(data)) > w.maxBytes {
+		err = w.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	_, err = w.file.Write(data)
+	w.size += int64(len(data))
+	if err != nil {
+		// Reopen the file on the next call.
+		w.close()
+		return fmt.Errorf("cannot write %s: %s", w.path, err)
+	}
+	return nil
+}
+
+// Close closes the file.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.close()
+}
+
+// open opens the file for appending, if it is not already open.
+func (w *Writer) open() error {
+	if w.file != nil {
+		return nil
+	}
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file = f
+	w.size = info.Size()
+	if !info.Mode().IsRegular() {
+		// Pipes and devices have no size, and are never rotated.
+		w.size = 0
+	}
+	return nil
+}
+
+// rotate renames the current file with a ".1" suffix, shifts older files, and
+// opens a new file. Only regular files are rotated.
+func (w *Writer) rotate() error {
+	info, err := w.file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return err
+	}
+	w.close()
+	os.Remove(fmt.Sprintf("%s.%d", w.path, w.maxFiles))
+	for i := w.maxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+	}
+	err = os.Rename(w.path, w.path+".1")
+	if err != nil {
+		return fmt.Errorf("cannot rotate %s: %s", w.path, err)
+	}
+	return w.open()
+}
+
+func (w *Writer) close() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	w.size = 0
+	return err
+}
@@ -0,0 +1,126 @@
+package jsonl
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/m-lab/gcp-service-discovery/discovery"
+)
+
+// readLines parses the configs in the named file.
+func readLines(t *testing.T, name string) []discovery.StaticConfig {
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatalf("os.Open() error = %v", err)
+	}
+	defer f.Close()
+	configs := []discovery.StaticConfig{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		c := discovery.StaticConfig{}
+		err := json.Unmarshal(s.Bytes(), &c)
+		if err != nil {
+			t.Fatalf("json.Unmarshal(%q) error = %v", s.Text(), err)
+		}
+		configs = append(configs, c)
+	}
+	return configs
+}
+
+func TestWriter_Write(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "targets.jsonl")
+	u, _ := url.Parse("jsonl://" + filepath.ToSlash(name) + "?max_bytes=100&max_files=2")
+	dw, err := New(u)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	w := dw.(*Writer)
+	defer w.Close()
+
+	configs := []discovery.StaticConfig{
+		{Targets: []string{"10.0.0.1:9090"}, Labels: map[string]string{"a": "b"}},
+		{Targets: []string{"10.0.0.2:9090"}},
+	}
+	ctx := context.Background()
+	// Every pass writes about 80 bytes, so every pass after the first rotates.
+	for i := 0; i < 4; i++ {
+		err = w.Write(ctx, configs)
+		if err != nil {
+			t.Fatalf("Writer.Write() error = %v", err)
+		}
+	}
+	for _, n := range []string{name, name + ".1", name + ".2"} {
+		got := readLines(t, n)
+		if len(got) != 2 || got[0].Targets[0] != "10.0.0.1:9090" || got[0].Labels["a"] != "b" {
+			t.Errorf("Writer.Write() wrote %v to %s, want 2 configs", got, n)
+		}
+	}
+	if _, err := os.Stat(name + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Writer.Write() kept more than max_files rotated files")
+	}
+}
+
+func TestWriter_WriteAppend(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "targets.jsonl")
+	u, _ := url.Parse("jsonl://" + filepath.ToSlash(name))
+	configs := []discovery.StaticConfig{{Targets: []string{"10.0.0.1:9090"}}}
+	for i := 0; i < 2; i++ {
+		w, err := New(u)
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		err = w.Write(context.Background(), configs)
+		if err != nil {
+			t.Fatalf("Writer.Write() error = %v", err)
+		}
+		w.(*Writer).Close()
+	}
+	if got := readLines(t, name); len(got) != 2 {
+		t.Errorf("Writer.Write() wrote %d lines, want 2 appended lines", len(got))
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		wantErr bool
+	}{
+		{
+			name:   "success",
+			output: "jsonl:///var/log/targets.jsonl",
+		},
+		{
+			name:    "failure-relative",
+			output:  "jsonl://targets.jsonl",
+			wantErr: true,
+		},
+		{
+			name:    "failure-max-bytes",
+			output:  "jsonl:///targets.jsonl?max_bytes=lots",
+			wantErr: true,
+		},
+		{
+			name:    "failure-max-files",
+			output:  "jsonl:///targets.jsonl?max_files=0",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.output)
+			if err != nil {
+				t.Fatalf("url.Parse() error = %v", err)
+			}
+			_, err = New(u)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
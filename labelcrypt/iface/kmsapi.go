@@ -0,0 +1,50 @@
+// Package iface defines an interface for accessing the Cloud KMS API. This is
+// helpful for creating testable packages.
+package iface
+
+import (
+	"context"
+	"encoding/base64"
+
+	cloudkms "google.golang.org/api/cloudkms/v1"
+)
+
+// KMS defines the interface used by the labelcrypt logic.
+type KMS interface {
+	Encrypt(ctx context.Context, key string, plaintext []byte) ([]byte, error)
+	Decrypt(ctx context.Context, key string, ciphertext []byte) ([]byte, error)
+}
+
+// KMSImpl implements the KMS interface.
+type KMSImpl struct {
+	apis *cloudkms.Service
+}
+
+// NewKMS creates a new KMS instance.
+func NewKMS(apis *cloudkms.Service) *KMSImpl {
+	return &KMSImpl{apis: apis}
+}
+
+// Encrypt wraps the CryptoKeys.Encrypt method for the given key resource name.
+func (k *KMSImpl) Encrypt(ctx context.Context, key string, plaintext []byte) ([]byte, error) {
+	req := &cloudkms.EncryptRequest{
+		Plaintext: base64.StdEncoding.EncodeToString(plaintext),
+	}
+	resp, err := k.apis.Projects.Locations.KeyRings.CryptoKeys.Encrypt(key, req).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(resp.Ciphertext)
+}
+
+// Decrypt wraps the CryptoKeys.Decrypt method for the given key resource name.
+func (k *KMSImpl) Decrypt(ctx context.Context, key string, ciphertext []byte) ([]byte, error) {
+	req := &cloudkms.DecryptRequest{
+		Ciphertext: base64.StdEncoding.EncodeToString(ciphertext),
+	}
+	resp, err := k.apis.Projects.Locations.KeyRings.CryptoKeys.Decrypt(key, req).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(resp.Plaintext)
+}
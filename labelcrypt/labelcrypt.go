@@ -0,0 +1,302 @@
+// Package labelcrypt encrypts sensitive label values of discovered targets
+// using Cloud KMS envelope encryption.
+//
+// A random data encryption key (DEK) encrypts the configured label values with
+// AES-GCM, using the label name as additional data, so a value cannot be moved
+// to another label. The DEK is itself encrypted by a Cloud KMS key and embedded
+// in every encrypted value, so each value can be decrypted independently by
+// anyone with decrypt access to the KMS key.
+//
+// The DEK is reused by later discovery passes until it is rotated, and values
+// that did not change keep their ciphertext, so the targets written to disk
+// only change when labels change, and the KMS is only contacted on rotation.
+//
+// In serialized form, an encrypted value looks like:
+//
+//	kms:v1:<base64 encrypted DEK>:<base64 nonce and ciphertext>
+package labelcrypt
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	cloudkms "google.golang.org/api/cloudkms/v1"
+
+	"github.com/m-lab/gcp-service-discovery/apilimit"
+	"github.com/m-lab/gcp-service-discovery/credentials"
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/labelcrypt/iface"
+)
+
+// Prefix identifies label values encrypted by this package.
+const Prefix = "kms:v1:"
+
+var (
+	// newKMSClient allocates a new Cloud KMS client. The indirection facilitates testing.
+	newKMSClient = cloudkms.New
+
+	// randReader is the source of DEKs and nonces. The indirection facilitates testing.
+	randReader = rand.Reader
+
+	// now returns the current time. The indirection facilitates testing.
+	now = time.Now
+)
+
+// DefaultKeyRotation is the default KeyRotation.
+const DefaultKeyRotation = 24 * time.Hour
+
+// newKMS returns a KMS instance authenticated with default credentials.
+func newKMS(ctx context.Context) (iface.KMS, error) {
+	client, err := credentials.Config{}.Client(ctx, cloudkms.CloudPlatformScope)
+	if err != nil {
+		return nil, fmt.Errorf("Error setting up KMS client: %s", err)
+	}
+	kms, err := newKMSClient(apilimit.Client(client))
+	if err != nil {
+		return nil, fmt.Errorf("Error setting up KMS client: %s", err)
+	}
+	return iface.NewKMS(kms), nil
+}
+
+// Encrypter encrypts the values of configured labels.
+type Encrypter struct {
+	// KeyRotation is how long a DEK is used before Encrypt creates a new one.
+	// When zero, DefaultKeyRotation is used.
+	KeyRotation time.Duration
+
+	kms    iface.KMS
+	key    string
+	labels map[string]bool
+
+	// mu protects the current DEK and the values encrypted with it.
+	mu sync.Mutex
+	// gcm encrypts with the current DEK, which was created at created, and
+	// prefix is the encryption prefix and encrypted form of the DEK.
+	gcm     cipher.AEAD
+	prefix  string
+	created time.Time
+	// sealed caches the encrypted values of the most recent pass, so values
+	// that did not change keep their ciphertext.
+	sealed map[sealedKey]string
+}
+
+// sealedKey identifies an encrypted value by its target group, label and value.
+type sealedKey struct {
+	targets, label, value string
+}
+
+// NewEncrypter creates a new Encrypter that encrypts the values of the named
+// labels using the named Cloud KMS key. The key should be a full resource name,
+// e.g. projects/<p>/locations/<l>/keyRings/<r>/cryptoKeys/<k>. NewEncrypter
+// fails if default credentials are not found before ctx is done.
+func NewEncrypter(ctx context.Context, key string, labels []string) (*Encrypter, error) {
+	kms, err := newKMS(ctx)
+	if err != nil {
+		return nil, err
+	}
+	e := &Encrypter{kms: kms, key: key, labels: map[string]bool{}}
+	for _, l := range labels {
+		e.labels[l] = true
+	}
+	return e, nil
+}
+
+// Encrypt returns a copy of configs with the values of all configured labels
+// encrypted. A single DEK is used for all values, and a value that was in the
+// same target group and label during the previous call keeps its ciphertext,
+// until the DEK is rotated.
+func (e *Encrypter) Encrypt(ctx context.Context, configs []discovery.StaticConfig) ([]discovery.StaticConfig, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	err := e.rotate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := map[sealedKey]string{}
+	result := make([]discovery.StaticConfig, len(configs))
+	for i := range configs {
+		result[i] = discovery.StaticConfig{Targets: configs[i].Targets, Extra: configs[i].Extra}
+		if configs[i].Labels == nil {
+			continue
+		}
+		result[i].Labels = make(map[string]string, len(configs[i].Labels))
+		for k, v := range configs[i].Labels {
+			if !e.labels[k] {
+				result[i].Labels[k] = v
+				continue
+			}
+			key := sealedKey{targets: strings.Join(configs[i].Targets, ","), label: k, value: v}
+			s, ok := e.sealed[key]
+			if !ok {
+				s, err = e.seal(k, v)
+				if err != nil {
+					return nil, err
+				}
+			}
+			sealed[key] = s
+			result[i].Labels[k] = s
+		}
+	}
+	e.sealed = sealed
+	return result, nil
+}
+
+// rotate creates a new DEK if there is none, or if the current one is older
+// than KeyRotation. Values encrypted with the previous DEK are forgotten.
+func (e *Encrypter) rotate(ctx context.Context) error {
+	rotation := e.KeyRotation
+	if rotation == 0 {
+		rotation = DefaultKeyRotation
+	}
+	if e.gcm != nil && now().Sub(e.created) < rotation {
+		return nil
+	}
+	dek := make([]byte, 32)
+	_, err := io.ReadFull(randReader, dek)
+	if err != nil {
+		return err
+	}
+	gcm, err := newGCM(dek)
+	if err != nil {
+		return err
+	}
+	wrapped, err := e.kms.Encrypt(ctx, e.key, dek)
+	if err != nil {
+		return err
+	}
+	e.gcm = gcm
+	e.prefix = Prefix + base64.StdEncoding.EncodeToString(wrapped) + ":"
+	e.created = now()
+	e.sealed = nil
+	return nil
+}
+
+// seal encrypts the value of the named label with the current DEK.
+func (e *Encrypter) seal(label, value string) (string, error) {
+	nonce := make([]byte, e.gcm.NonceSize())
+	_, err := io.ReadFull(randReader, nonce)
+	if err != nil {
+		return "", err
+	}
+	sealed := e.gcm.Seal(nonce, nonce, []byte(value), []byte(label))
+	return e.prefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Wrap returns a discovery.Service that encrypts the targets discovered by s.
+func (e *Encrypter) Wrap(s discovery.Service) *Service {
+	return &Service{service: s, encrypter: e}
+}
+
+// Service encrypts label values of targets discovered by another service.
+// Service implements the discovery.Service interface.
+type Service struct {
+	service   discovery.Service
+	encrypter *Encrypter
+}
+
+// Discover runs discovery on the underlying service and encrypts the result.
+func (s *Service) Discover(ctx context.Context) ([]discovery.StaticConfig, error) {
+	configs, err := s.service.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.encrypter.Encrypt(ctx, configs)
+}
+
+// Unwrap returns the underlying discovery.Service.
+func (s *Service) Unwrap() discovery.Service {
+	return s.service
+}
+
+// Decrypter decrypts label values encrypted by an Encrypter.
+type Decrypter struct {
+	kms iface.KMS
+	key string
+
+	// deks caches decrypted DEKs by their encrypted form, so the KMS is
+	// contacted once per discovery pass rather than once per value.
+	deks map[string][]byte
+}
+
+// NewDecrypter creates a new Decrypter using the named Cloud KMS key.
+// NewDecrypter fails if default credentials are not found before ctx is done.
+func NewDecrypter(ctx context.Context, key string) (*Decrypter, error) {
+	kms, err := newKMS(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Decrypter{kms: kms, key: key, deks: map[string][]byte{}}, nil
+}
+
+// Decrypt decrypts all encrypted label values in configs in place. Values
+// without the encryption prefix are left unchanged.
+func (d *Decrypter) Decrypt(ctx context.Context, configs []discovery.StaticConfig) error {
+	for i := range configs {
+		for k, v := range configs[i].Labels {
+			if !strings.HasPrefix(v, Prefix) {
+				continue
+			}
+			plain, err := d.decryptValue(ctx, k, v)
+			if err != nil {
+				return fmt.Errorf("failed to decrypt label %q: %s", k, err)
+			}
+			configs[i].Labels[k] = plain
+		}
+	}
+	return nil
+}
+
+// decryptValue decrypts the encrypted value of the named label.
+func (d *Decrypter) decryptValue(ctx context.Context, label, value string) (string, error) {
+	fields := strings.Split(strings.TrimPrefix(value, Prefix), ":")
+	if len(fields) != 2 {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+	dek, ok := d.deks[fields[0]]
+	if !ok {
+		wrapped, err := base64.StdEncoding.DecodeString(fields[0])
+		if err != nil {
+			return "", err
+		}
+		dek, err = d.kms.Decrypt(ctx, d.key, wrapped)
+		if err != nil {
+			return "", err
+		}
+		d.deks[fields[0]] = dek
+	}
+	sealed, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newGCM(dek)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plain, err := gcm.Open(nil, nonce, ciphertext, []byte(label))
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// newGCM creates an AES-GCM cipher from the given key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
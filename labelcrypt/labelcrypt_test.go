@@ -0,0 +1,274 @@
+package labelcrypt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	cloudkms "google.golang.org/api/cloudkms/v1"
+)
+
+// fakeKMS implements the labelcrypt/iface.KMS interface by reversing bytes.
+type fakeKMS struct {
+	encryptErr error
+	decryptErr error
+	encrypts   int
+	decrypts   int
+}
+
+func reverse(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return r
+}
+
+func (f *fakeKMS) Encrypt(ctx context.Context, key string, plaintext []byte) ([]byte, error) {
+	f.encrypts++
+	if f.encryptErr != nil {
+		return nil, f.encryptErr
+	}
+	return reverse(plaintext), nil
+}
+
+func (f *fakeKMS) Decrypt(ctx context.Context, key string, ciphertext []byte) ([]byte, error) {
+	f.decrypts++
+	if f.decryptErr != nil {
+		return nil, f.decryptErr
+	}
+	return reverse(ciphertext), nil
+}
+
+type fakeService struct {
+	configs []discovery.StaticConfig
+	err     error
+}
+
+func (f *fakeService) Discover(ctx context.Context) ([]discovery.StaticConfig, error) {
+	return f.configs, f.err
+}
+
+type failingReader struct{}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("fake read error")
+}
+
+func TestService_Discover(t *testing.T) {
+	configs := []discovery.StaticConfig{
+		{
+			Targets: []string{"10.0.0.1:9090"},
+			Labels:  map[string]string{"host": "internal.example.com", "service": "etl"},
+		},
+		{
+			Targets: []string{"10.0.0.2:9090"},
+		},
+	}
+	tests := []struct {
+		name       string
+		service    *fakeService
+		kms        *fakeKMS
+		rand       io.Reader
+		wantErr    bool
+		wantDecErr bool
+	}{
+		{
+			name:    "success",
+			service: &fakeService{configs: configs},
+			kms:     &fakeKMS{},
+		},
+		{
+			name:    "failure-discover",
+			service: &fakeService{err: fmt.Errorf("fake discovery error")},
+			kms:     &fakeKMS{},
+			wantErr: true,
+		},
+		{
+			name:    "failure-kms-encrypt",
+			service: &fakeService{configs: configs},
+			kms:     &fakeKMS{encryptErr: fmt.Errorf("fake kms error")},
+			wantErr: true,
+		},
+		{
+			name:    "failure-random",
+			service: &fakeService{configs: configs},
+			kms:     &fakeKMS{},
+			rand:    &failingReader{},
+			wantErr: true,
+		},
+		{
+			name:       "failure-kms-decrypt",
+			service:    &fakeService{configs: configs},
+			kms:        &fakeKMS{decryptErr: fmt.Errorf("fake kms error")},
+			wantDecErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.rand != nil {
+				orig := randReader
+				randReader = tt.rand
+				defer func() { randReader = orig }()
+			}
+			e := &Encrypter{kms: tt.kms, key: "fake-key", labels: map[string]bool{"host": true}}
+			got, err := e.Wrap(tt.service).Discover(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Service.Discover() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !strings.HasPrefix(got[0].Labels["host"], Prefix) {
+				t.Errorf("Service.Discover() host = %q, want encrypted value", got[0].Labels["host"])
+			}
+			if got[0].Labels["service"] != "etl" {
+				t.Errorf("Service.Discover() service = %q, want etl", got[0].Labels["service"])
+			}
+			if configs[0].Labels["host"] != "internal.example.com" {
+				t.Errorf("Service.Discover() modified the original configs")
+			}
+			d := &Decrypter{kms: tt.kms, key: "fake-key", deks: map[string][]byte{}}
+			err = d.Decrypt(context.Background(), got)
+			if (err != nil) != tt.wantDecErr {
+				t.Fatalf("Decrypter.Decrypt() error = %v, wantErr %v", err, tt.wantDecErr)
+			}
+			if tt.wantDecErr {
+				return
+			}
+			if !reflect.DeepEqual(got, configs) {
+				t.Errorf("Decrypter.Decrypt() = %v, want %v", got, configs)
+			}
+		})
+	}
+}
+
+func TestDecrypter_DecryptMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{name: "missing-fields", value: Prefix + "abcd"},
+		{name: "bad-dek-encoding", value: Prefix + "!!!:abcd"},
+		{name: "bad-value-encoding", value: Prefix + "YWJj:!!!"},
+		{name: "bad-dek-size", value: Prefix + "YWJj:YWJj"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Decrypter{kms: &fakeKMS{}, key: "fake-key", deks: map[string][]byte{}}
+			configs := []discovery.StaticConfig{{Labels: map[string]string{"host": tt.value}}}
+			err := d.Decrypt(context.Background(), configs)
+			if err == nil {
+				t.Errorf("Decrypter.Decrypt() error = nil, want error")
+			}
+		})
+	}
+}
+
+func TestDecrypter_DecryptCachesDEK(t *testing.T) {
+	kms := &fakeKMS{}
+	e := &Encrypter{kms: kms, key: "fake-key", labels: map[string]bool{"host": true}}
+	configs := []discovery.StaticConfig{
+		{Labels: map[string]string{"host": "a"}},
+		{Labels: map[string]string{"host": "b"}},
+	}
+	got, err := e.Encrypt(context.Background(), configs)
+	if err != nil {
+		t.Fatalf("Encrypter.Encrypt() error = %v", err)
+	}
+	d := &Decrypter{kms: kms, key: "fake-key", deks: map[string][]byte{}}
+	err = d.Decrypt(context.Background(), got)
+	if err != nil {
+		t.Fatalf("Decrypter.Decrypt() error = %v", err)
+	}
+	if kms.decrypts != 1 {
+		t.Errorf("Decrypter.Decrypt() kms calls = %d, want 1", kms.decrypts)
+	}
+}
+
+func TestEncrypter_EncryptReusesValues(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return start }
+	defer func() { now = time.Now }()
+	kms := &fakeKMS{}
+	e := &Encrypter{kms: kms, key: "fake-key", labels: map[string]bool{"host": true}, KeyRotation: time.Hour}
+	configs := []discovery.StaticConfig{
+		{Targets: []string{"a:9090"}, Labels: map[string]string{"host": "a"}},
+		{Targets: []string{"b:9090"}, Labels: map[string]string{"host": "a"}},
+	}
+	first, err := e.Encrypt(context.Background(), configs)
+	if err != nil {
+		t.Fatalf("Encrypter.Encrypt() error = %v", err)
+	}
+	if first[0].Labels["host"] == first[1].Labels["host"] {
+		t.Errorf("Encrypter.Encrypt() reused a value of another target group")
+	}
+
+	// An unchanged value keeps its ciphertext, without a KMS call.
+	configs[1].Labels = map[string]string{"host": "b"}
+	second, err := e.Encrypt(context.Background(), configs)
+	if err != nil {
+		t.Fatalf("Encrypter.Encrypt() error = %v", err)
+	}
+	if second[0].Labels["host"] != first[0].Labels["host"] {
+		t.Errorf("Encrypter.Encrypt() changed the ciphertext of an unchanged value")
+	}
+	if second[1].Labels["host"] == first[1].Labels["host"] {
+		t.Errorf("Encrypter.Encrypt() kept the ciphertext of a changed value")
+	}
+	if kms.encrypts != 1 {
+		t.Errorf("Encrypter.Encrypt() kms calls = %d, want 1", kms.encrypts)
+	}
+
+	// After KeyRotation, a new DEK encrypts every value.
+	now = func() time.Time { return start.Add(time.Hour) }
+	third, err := e.Encrypt(context.Background(), configs)
+	if err != nil {
+		t.Fatalf("Encrypter.Encrypt() error = %v", err)
+	}
+	if third[0].Labels["host"] == second[0].Labels["host"] {
+		t.Errorf("Encrypter.Encrypt() kept a ciphertext after rotation")
+	}
+	if kms.encrypts != 2 {
+		t.Errorf("Encrypter.Encrypt() kms calls = %d, want 2", kms.encrypts)
+	}
+}
+
+func TestDecrypter_DecryptOtherLabel(t *testing.T) {
+	kms := &fakeKMS{}
+	e := &Encrypter{kms: kms, key: "fake-key", labels: map[string]bool{"host": true}}
+	got, err := e.Encrypt(context.Background(), []discovery.StaticConfig{{Labels: map[string]string{"host": "a"}}})
+	if err != nil {
+		t.Fatalf("Encrypter.Encrypt() error = %v", err)
+	}
+	// A value moved to another label does not authenticate.
+	moved := []discovery.StaticConfig{{Labels: map[string]string{"owner": got[0].Labels["host"]}}}
+	d := &Decrypter{kms: kms, key: "fake-key", deks: map[string][]byte{}}
+	if err := d.Decrypt(context.Background(), moved); err == nil {
+		t.Errorf("Decrypter.Decrypt() error = nil, want error")
+	}
+}
+
+func TestNewEncrypterDecrypter(t *testing.T) {
+	orig := newKMSClient
+	newKMSClient = func(client *http.Client) (*cloudkms.Service, error) {
+		return nil, fmt.Errorf("Failing to create client")
+	}
+	defer func() { newKMSClient = orig }()
+
+	_, err := NewEncrypter(context.Background(), "fake-key", []string{"host"})
+	if err == nil {
+		t.Errorf("NewEncrypter() error = nil, want error")
+	}
+	_, err = NewDecrypter(context.Background(), "fake-key")
+	if err == nil {
+		t.Errorf("NewDecrypter() error = nil, want error")
+	}
+}
@@ -0,0 +1,289 @@
+// Package labeljoin adds labels from external metadata tables to discovered
+// targets, like a join on the value of one of their labels. For example, a
+// table keyed by __aef_service may add the tier and oncall of every App Engine
+// service, instead of recording rules that join them at query time.
+//
+// Tables are read from local files or HTTP(S) URLs, in CSV or JSON format. In
+// CSV tables, the first row names the labels, and the first column holds the
+// key values:
+//
+//	service,tier,oncall
+//	etl,1,data-eng
+//	annotator,2,data-eng
+//
+// JSON tables are objects from key values to labels:
+//
+//	{
+//	    "etl": {"tier": "1", "oncall": "data-eng"},
+//	    "annotator": {"tier": "2", "oncall": "data-eng"}
+//	}
+package labeljoin
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/metrics"
+	"github.com/m-lab/gcp-service-discovery/transport"
+)
+
+// DefaultTTL is how long a table is reused before it is read again.
+const DefaultTTL = 5 * time.Minute
+
+// now returns the current time. The indirection facilitates testing.
+var now = time.Now
+
+var (
+	// unmatchedTargets is the number of targets of the most recent join whose
+	// key label had no row in the table, by table source.
+	//
+	// Provides metrics:
+	//   gcp_labeljoin_unmatched_targets{table="/etc/services.csv"}
+	// Example usage:
+	//   unmatchedTargets.WithLabelValues("/etc/services.csv").Set(count)
+	unmatchedTargets = metrics.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gcp_labeljoin_unmatched_targets",
+			Help: "Number of targets of the most recent join without a row in the table.",
+		},
+		[]string{"table"},
+	)
+
+	// loadErrors counts failed reads of a table, by table source.
+	//
+	// Provides metrics:
+	//   gcp_labeljoin_load_errors_total{table="/etc/services.csv"}
+	// Example usage:
+	//   loadErrors.WithLabelValues("/etc/services.csv").Inc()
+	loadErrors = metrics.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gcp_labeljoin_load_errors_total",
+			Help: "Number of failed reads of a metadata table.",
+		},
+		[]string{"table"},
+	)
+)
+
+// Spec names the key label and the table of a join.
+type Spec struct {
+	Label  string
+	Source string
+}
+
+// String formats the spec as label=source.
+func (s Spec) String() string {
+	return s.Label + "=" + s.Source
+}
+
+// Specs are the joins applied to discovered targets, in order. Specs
+// implements the flag.Value interface, so it may be set from the command line
+// with values like:
+//
+//	__aef_service=/etc/gcp-service-discovery/services.csv
+//	__gke_cluster=https://example.com/clusters.json
+type Specs []Spec
+
+// String formats the specs as a comma separated list.
+func (s Specs) String() string {
+	values := make([]string, len(s))
+	for i := range s {
+		values[i] = s[i].String()
+	}
+	return strings.Join(values, ",")
+}
+
+// Set parses a value of the form "label=source" and adds it to the specs.
+func (s *Specs) Set(value string) error {
+	label, source, ok := strings.Cut(value, "=")
+	label = strings.TrimSpace(label)
+	source = strings.TrimSpace(source)
+	if !ok || label == "" || source == "" {
+		return fmt.Errorf("invalid label join %q: want label=<file or URL>", value)
+	}
+	*s = append(*s, Spec{Label: label, Source: source})
+	return nil
+}
+
+// Joiner adds the columns of a table to every target whose key label matches a
+// row. The table is read again after its TTL. When a read fails, the previous
+// table is used until the next read. Joiner is safe for concurrent use by
+// several services.
+type Joiner struct {
+	spec   Spec
+	ttl    time.Duration
+	client *http.Client
+
+	mu     sync.Mutex
+	table  map[string]map[string]string
+	loaded time.Time
+}
+
+// NewJoiner creates a Joiner for the given spec that reuses its table for ttl.
+func NewJoiner(spec Spec, ttl time.Duration) *Joiner {
+	return &Joiner{
+		spec:   spec,
+		ttl:    ttl,
+		client: &http.Client{Transport: transport.New()},
+	}
+}
+
+// Join returns copies of configs with the labels of the matching table rows
+// added. Labels already set by the source are kept. The given configs are not
+// modified. Join fails if the table has never been read successfully.
+func (j *Joiner) Join(ctx context.Context, configs []discovery.StaticConfig) ([]discovery.StaticConfig, error) {
+	table, err := j.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if configs == nil {
+		return nil, nil
+	}
+	unmatched := 0
+	result := make([]discovery.StaticConfig, len(configs))
+	for i, c := range configs {
+		result[i] = c
+		row, ok := table[c.Labels[j.spec.Label]]
+		if !ok {
+			unmatched++
+			continue
+		}
+		labels := make(map[string]string, len(c.Labels)+len(row))
+		for k, v := range row {
+			labels[k] = v
+		}
+		for k, v := range c.Labels {
+			labels[k] = v
+		}
+		result[i].Labels = labels
+	}
+	unmatchedTargets.WithLabelValues(j.spec.Source).Set(float64(unmatched))
+	return result, nil
+}
+
+// load returns the table, and reads it again if it is older than the TTL.
+func (j *Joiner) load(ctx context.Context) (map[string]map[string]string, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.table != nil && now().Sub(j.loaded) < j.ttl {
+		return j.table, nil
+	}
+	table, err := j.read(ctx)
+	if err != nil {
+		loadErrors.WithLabelValues(j.spec.Source).Inc()
+		if j.table == nil {
+			return nil, fmt.Errorf("cannot read label join table %q: %w", j.spec.Source, err)
+		}
+		log.Printf("Error: cannot read label join table %q, using the previous table: %s", j.spec.Source, err)
+		return j.table, nil
+	}
+	j.table = table
+	j.loaded = now()
+	return table, nil
+}
+
+// read downloads or reads the table and parses it.
+func (j *Joiner) read(ctx context.Context) (map[string]map[string]string, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(j.spec.Source, "http://") || strings.HasPrefix(j.spec.Source, "https://") {
+		data, err = j.download(ctx)
+	} else {
+		data, err = os.ReadFile(j.spec.Source)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parse(data)
+}
+
+// download reads the table from an HTTP(S) URL.
+func (j *Joiner) download(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, j.spec.Source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := j.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad HTTP status code: %d", resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// parse parses a JSON table if data starts with an object, and a CSV table
+// otherwise.
+func parse(data []byte) (map[string]map[string]string, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		table := map[string]map[string]string{}
+		if err := json.Unmarshal(data, &table); err != nil {
+			return nil, err
+		}
+		return table, nil
+	}
+	r := csv.NewReader(bytes.NewReader(data))
+	r.TrimLeadingSpace = true
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("empty table: want a header row")
+	}
+	header := rows[0]
+	for _, name := range header[1:] {
+		if name == "" {
+			return nil, fmt.Errorf("empty label name in header %q", header)
+		}
+	}
+	table := map[string]map[string]string{}
+	for _, row := range rows[1:] {
+		labels := make(map[string]string, len(header)-1)
+		for i := 1; i < len(header); i++ {
+			labels[header[i]] = row[i]
+		}
+		table[row[0]] = labels
+	}
+	return table, nil
+}
+
+// Wrap returns a discovery.Service that joins the targets discovered by s.
+func (j *Joiner) Wrap(s discovery.Service) *Service {
+	return &Service{service: s, joiner: j}
+}
+
+// Service joins the targets discovered by another service with a table.
+// Service implements the discovery.Service interface.
+type Service struct {
+	service discovery.Service
+	joiner  *Joiner
+}
+
+// Discover runs discovery on the underlying service and joins the result.
+func (s *Service) Discover(ctx context.Context) ([]discovery.StaticConfig, error) {
+	configs, err := s.service.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.joiner.Join(ctx, configs)
+}
+
+// Unwrap returns the underlying discovery.Service.
+func (s *Service) Unwrap() discovery.Service {
+	return s.service
+}
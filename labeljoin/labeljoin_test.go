@@ -0,0 +1,219 @@
+package labeljoin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/prometheusx/promtest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/m-lab/gcp-service-discovery/discovery"
+)
+
+const servicesCSV = `service,tier,oncall
+etl, 1, data-eng
+annotator,2,data-eng
+`
+
+const servicesJSON = `{
+    "etl": {"tier": "1", "oncall": "data-eng"},
+    "annotator": {"tier": "2", "oncall": "data-eng"}
+}`
+
+type fakeService struct {
+	configs []discovery.StaticConfig
+	err     error
+}
+
+func (f *fakeService) Discover(ctx context.Context) ([]discovery.StaticConfig, error) {
+	return f.configs, f.err
+}
+
+func writeTable(t *testing.T, name, data string) string {
+	filename := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(filename, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestSpecs_Set(t *testing.T) {
+	var s Specs
+	if err := s.Set("__aef_service=/etc/services.csv"); err != nil {
+		t.Fatalf("Specs.Set() error = %v", err)
+	}
+	if err := s.Set("__gke_cluster = https://example.com/a=b.json"); err != nil {
+		t.Fatalf("Specs.Set() error = %v", err)
+	}
+	want := Specs{{"__aef_service", "/etc/services.csv"}, {"__gke_cluster", "https://example.com/a=b.json"}}
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("Specs.Set() = %v, want %v", s, want)
+	}
+	if got := s.String(); got != "__aef_service=/etc/services.csv,__gke_cluster=https://example.com/a=b.json" {
+		t.Errorf("Specs.String() = %q", got)
+	}
+	for _, v := range []string{"__aef_service", "=/etc/services.csv", "__aef_service="} {
+		if err := s.Set(v); err == nil {
+			t.Errorf("Specs.Set(%q) error = nil, want error", v)
+		}
+	}
+}
+
+func TestJoiner_Join(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/services.json":
+			fmt.Fprint(w, servicesJSON)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	tests := []struct {
+		name    string
+		source  string
+		wantErr bool
+	}{
+		{
+			name:   "success-csv",
+			source: writeTable(t, "services.csv", servicesCSV),
+		},
+		{
+			name:   "success-json",
+			source: writeTable(t, "services.json", servicesJSON),
+		},
+		{
+			name:   "success-url",
+			source: srv.URL + "/services.json",
+		},
+		{
+			name:    "failure-missing-file",
+			source:  filepath.Join(t.TempDir(), "missing.csv"),
+			wantErr: true,
+		},
+		{
+			name:    "failure-missing-url",
+			source:  srv.URL + "/missing.csv",
+			wantErr: true,
+		},
+		{
+			name:    "failure-ragged-csv",
+			source:  writeTable(t, "ragged.csv", "service,tier\netl\n"),
+			wantErr: true,
+		},
+		{
+			name:    "failure-empty-csv",
+			source:  writeTable(t, "empty.csv", ""),
+			wantErr: true,
+		},
+		{
+			name:    "failure-empty-label-name",
+			source:  writeTable(t, "noname.csv", "service,,oncall\netl,1,data-eng\n"),
+			wantErr: true,
+		},
+		{
+			name:    "failure-invalid-json",
+			source:  writeTable(t, "invalid.json", `{"etl": "1"}`),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configs := []discovery.StaticConfig{
+				{Targets: []string{"a:1"}, Labels: map[string]string{"__aef_service": "etl"}},
+				{Targets: []string{"b:1"}, Labels: map[string]string{"__aef_service": "annotator", "tier": "0"}},
+				{Targets: []string{"c:1"}, Labels: map[string]string{"__aef_service": "unknown"}},
+			}
+			j := NewJoiner(Spec{Label: "__aef_service", Source: tt.source}, DefaultTTL)
+			got, err := j.Join(context.Background(), configs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Joiner.Join() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			want := []discovery.StaticConfig{
+				{Targets: []string{"a:1"}, Labels: map[string]string{"__aef_service": "etl", "tier": "1", "oncall": "data-eng"}},
+				{Targets: []string{"b:1"}, Labels: map[string]string{"__aef_service": "annotator", "tier": "0", "oncall": "data-eng"}},
+				{Targets: []string{"c:1"}, Labels: map[string]string{"__aef_service": "unknown"}},
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Joiner.Join() = %v, want %v", got, want)
+			}
+			if len(configs[0].Labels) != 1 {
+				t.Errorf("Joiner.Join() modified the given configs: %v", configs[0].Labels)
+			}
+			if v := testutil.ToFloat64(unmatchedTargets.WithLabelValues(tt.source)); v != 1 {
+				t.Errorf("gcp_labeljoin_unmatched_targets = %v, want 1", v)
+			}
+		})
+	}
+}
+
+func TestJoiner_load(t *testing.T) {
+	current := time.Date(2018, 10, 27, 21, 1, 26, 0, time.UTC)
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+
+	source := writeTable(t, "services.csv", servicesCSV)
+	j := NewJoiner(Spec{Label: "__aef_service", Source: source}, time.Minute)
+	configs := []discovery.StaticConfig{{Targets: []string{"a:1"}, Labels: map[string]string{"__aef_service": "etl"}}}
+	if _, err := j.Join(context.Background(), configs); err != nil {
+		t.Fatalf("Joiner.Join() error = %v", err)
+	}
+
+	// The table is reused until the TTL, and kept when it cannot be read.
+	os.WriteFile(source, []byte("service,tier\netl,2\n"), 0644)
+	got, _ := j.Join(context.Background(), configs)
+	if got[0].Labels["tier"] != "1" {
+		t.Errorf("Joiner.Join() before ttl = %v, want tier 1", got[0].Labels)
+	}
+	current = current.Add(time.Minute)
+	got, _ = j.Join(context.Background(), configs)
+	if got[0].Labels["tier"] != "2" {
+		t.Errorf("Joiner.Join() after ttl = %v, want tier 2", got[0].Labels)
+	}
+	os.Remove(source)
+	current = current.Add(time.Minute)
+	got, err := j.Join(context.Background(), configs)
+	if err != nil || got[0].Labels["tier"] != "2" {
+		t.Errorf("Joiner.Join() after a failed read = %v, %v, want tier 2", got[0].Labels, err)
+	}
+	if v := testutil.ToFloat64(loadErrors.WithLabelValues(source)); v != 1 {
+		t.Errorf("gcp_labeljoin_load_errors_total = %v, want 1", v)
+	}
+}
+
+func TestService_Discover(t *testing.T) {
+	j := NewJoiner(Spec{Label: "__aef_service", Source: writeTable(t, "services.json", servicesJSON)}, DefaultTTL)
+	s := j.Wrap(&fakeService{configs: []discovery.StaticConfig{
+		{Targets: []string{"a:1"}, Labels: map[string]string{"__aef_service": "etl"}},
+	}})
+	got, err := s.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("Service.Discover() error = %v", err)
+	}
+	if got[0].Labels["tier"] != "1" {
+		t.Errorf("Service.Discover() = %v, want tier 1", got[0].Labels)
+	}
+	_, err = j.Wrap(&fakeService{err: fmt.Errorf("failed")}).Discover(context.Background())
+	if err == nil {
+		t.Errorf("Service.Discover() error = nil, want error")
+	}
+	if _, ok := s.Unwrap().(*fakeService); !ok {
+		t.Errorf("Service.Unwrap() = %T, want *fakeService", s.Unwrap())
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	unmatchedTargets.WithLabelValues("x")
+	loadErrors.WithLabelValues("x")
+	promtest.LintMetrics(t)
+}
@@ -0,0 +1,144 @@
+// Package metrics creates the Prometheus metrics of every package of
+// gcp-service-discovery, and controls where they are registered.
+//
+// Like promauto, metrics are registered with the default registerer as they
+// are created, so they are served by promhttp.Handler without any setup.
+// Applications that embed discovery may move every metric to one registerer of
+// their own with SetRegisterer, e.g. a prometheus.Registry that isolates them
+// from other libraries, or a registerer from prometheus.WrapRegistererWith
+// that adds constant labels. Metrics are shared by the whole process, so there
+// is only one such registerer.
+package metrics
+
+import (
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrRegistererSet is returned by SetRegisterer when metrics are already moved
+// to a different registerer.
+var ErrRegistererSet = errors.New("metrics are already registered with another registerer")
+
+var (
+	// mu protects registerer and collectors.
+	mu         sync.Mutex
+	registerer prometheus.Registerer = prometheus.DefaultRegisterer
+
+	// collectors are every created or registered collector, and whether it is
+	// registered with registerer.
+	collectors []*collector
+)
+
+// collector is a collector and its registration state.
+type collector struct {
+	prometheus.Collector
+	registered bool
+}
+
+// MustRegister registers c with the current registerer, and later moves it to
+// every registerer set by SetRegisterer. MustRegister panics if c cannot be
+// registered with a registerer set by SetRegisterer.
+//
+// Registration with the default registerer may fail because another copy of
+// this module, e.g. of a different version embedded in the same binary,
+// registered metrics with the same names. Then c is only exported after
+// SetRegisterer, and a warning is logged instead.
+func MustRegister(c prometheus.Collector) {
+	mu.Lock()
+	defer mu.Unlock()
+	registered, err := register(registerer, c)
+	if err != nil {
+		panic(err)
+	}
+	collectors = append(collectors, &collector{Collector: c, registered: registered})
+}
+
+// register registers c with reg, and returns whether it was registered. Errors
+// of the default registerer are logged instead of returned.
+func register(reg prometheus.Registerer, c prometheus.Collector) (bool, error) {
+	err := reg.Register(c)
+	if err == nil {
+		return true, nil
+	}
+	if reg != prometheus.DefaultRegisterer {
+		return false, err
+	}
+	log.Printf("Warning: metric not registered with the default registerer: %s", err)
+	return false, nil
+}
+
+// SetRegisterer moves every metric, including metrics created later, to reg.
+// When reg is nil, metrics are moved back to the default registerer. Metrics
+// are shared by the whole process, so there is one process-wide registerer:
+// SetRegisterer returns ErrRegistererSet if metrics were already moved to a
+// different registerer, which must first be reset with SetRegisterer(nil).
+// SetRegisterer also returns an error, and leaves metrics in place, if any
+// metric cannot be registered with reg, unless reg is the default registerer.
+func SetRegisterer(reg prometheus.Registerer) error {
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if reg == registerer {
+		return nil
+	}
+	if reg != prometheus.DefaultRegisterer && registerer != prometheus.DefaultRegisterer {
+		return ErrRegistererSet
+	}
+	registered := make([]bool, len(collectors))
+	for i, c := range collectors {
+		ok, err := register(reg, c.Collector)
+		if err != nil {
+			for j, r := range collectors[:i] {
+				if registered[j] {
+					reg.Unregister(r.Collector)
+				}
+			}
+			return err
+		}
+		registered[i] = ok
+	}
+	for i, c := range collectors {
+		// Only unregister collectors registered here. Another collector with
+		// the same descriptors may have been registered by another copy of
+		// this module.
+		if c.registered {
+			registerer.Unregister(c.Collector)
+		}
+		c.registered = registered[i]
+	}
+	registerer = reg
+	return nil
+}
+
+// NewCounterVec creates and registers a CounterVec, like promauto.
+func NewCounterVec(opts prometheus.CounterOpts, labelNames []string) *prometheus.CounterVec {
+	c := prometheus.NewCounterVec(opts, labelNames)
+	MustRegister(c)
+	return c
+}
+
+// NewGauge creates and registers a Gauge, like promauto.
+func NewGauge(opts prometheus.GaugeOpts) prometheus.Gauge {
+	g := prometheus.NewGauge(opts)
+	MustRegister(g)
+	return g
+}
+
+// NewGaugeVec creates and registers a GaugeVec, like promauto.
+func NewGaugeVec(opts prometheus.GaugeOpts, labelNames []string) *prometheus.GaugeVec {
+	g := prometheus.NewGaugeVec(opts, labelNames)
+	MustRegister(g)
+	return g
+}
+
+// NewHistogramVec creates and registers a HistogramVec, like promauto.
+func NewHistogramVec(opts prometheus.HistogramOpts, labelNames []string) *prometheus.HistogramVec {
+	h := prometheus.NewHistogramVec(opts, labelNames)
+	MustRegister(h)
+	return h
+}
@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// gathered returns true if g has a metric family with the given name.
+func gathered(t *testing.T, g prometheus.Gatherer, name string) bool {
+	families, err := g.Gather()
+	if err != nil {
+		t.Fatalf("Gather() error = %v", err)
+	}
+	for _, f := range families {
+		if f.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSetRegisterer(t *testing.T) {
+	defer SetRegisterer(nil)
+	gauge := NewGauge(prometheus.GaugeOpts{Name: "gcp_metrics_test_gauge", Help: "Test gauge."})
+	gauge.Set(1)
+	if !gathered(t, prometheus.DefaultGatherer, "gcp_metrics_test_gauge") {
+		t.Fatalf("NewGauge() did not register with the default registerer")
+	}
+
+	reg := prometheus.NewRegistry()
+	if err := SetRegisterer(reg); err != nil {
+		t.Fatalf("SetRegisterer() error = %v", err)
+	}
+	counter := NewCounterVec(prometheus.CounterOpts{Name: "gcp_metrics_test_total", Help: "Test counter."}, []string{"type"})
+	counter.WithLabelValues("x").Inc()
+	if !gathered(t, reg, "gcp_metrics_test_gauge") || !gathered(t, reg, "gcp_metrics_test_total") {
+		t.Errorf("SetRegisterer() did not move metrics to the registry")
+	}
+	if gathered(t, prometheus.DefaultGatherer, "gcp_metrics_test_gauge") {
+		t.Errorf("SetRegisterer() left metrics in the default registerer")
+	}
+
+	// A second registerer is rejected, and metrics stay.
+	other := prometheus.NewRegistry()
+	if err := SetRegisterer(other); err != ErrRegistererSet {
+		t.Errorf("SetRegisterer() error = %v, want %v", err, ErrRegistererSet)
+	}
+	if gathered(t, other, "gcp_metrics_test_gauge") || !gathered(t, reg, "gcp_metrics_test_gauge") {
+		t.Errorf("SetRegisterer() moved metrics to a second registerer")
+	}
+
+	if err := SetRegisterer(nil); err != nil {
+		t.Fatalf("SetRegisterer(nil) error = %v", err)
+	}
+	if !gathered(t, prometheus.DefaultGatherer, "gcp_metrics_test_total") || gathered(t, reg, "gcp_metrics_test_total") {
+		t.Errorf("SetRegisterer(nil) did not move metrics back to the default registerer")
+	}
+
+	// A registry with a conflicting metric is rejected, and metrics stay.
+	conflict := prometheus.NewRegistry()
+	conflict.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "gcp_metrics_test_total", Help: "Other."}))
+	if err := SetRegisterer(conflict); err == nil {
+		t.Errorf("SetRegisterer() error = nil, want conflict error")
+	}
+	if gathered(t, conflict, "gcp_metrics_test_gauge") || !gathered(t, prometheus.DefaultGatherer, "gcp_metrics_test_gauge") {
+		t.Errorf("SetRegisterer() moved metrics after a conflict")
+	}
+}
+
+func TestMustRegister(t *testing.T) {
+	// A duplicate of a metric of another copy of this module is not fatal.
+	prometheus.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "gcp_metrics_test_duplicate", Help: "Test gauge."}))
+	NewGauge(prometheus.GaugeOpts{Name: "gcp_metrics_test_duplicate", Help: "Test gauge."})
+
+	reg := prometheus.NewRegistry()
+	if err := SetRegisterer(reg); err != nil {
+		t.Fatalf("SetRegisterer() error = %v", err)
+	}
+	defer SetRegisterer(nil)
+	if !gathered(t, reg, "gcp_metrics_test_duplicate") {
+		t.Errorf("SetRegisterer() did not register the duplicate metric")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("MustRegister() did not panic for a duplicate in a registry")
+		}
+	}()
+	NewGauge(prometheus.GaugeOpts{Name: "gcp_metrics_test_duplicate", Help: "Test gauge."})
+}
+
+func TestSetRegisterer_default(t *testing.T) {
+	// Metrics move back to the default registerer, despite a duplicate.
+	NewGauge(prometheus.GaugeOpts{Name: "gcp_metrics_test_default", Help: "Test gauge."})
+	prometheus.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "gcp_metrics_test_other", Help: "Test gauge."}))
+	reg := prometheus.NewRegistry()
+	if err := SetRegisterer(reg); err != nil {
+		t.Fatalf("SetRegisterer() error = %v", err)
+	}
+	NewGauge(prometheus.GaugeOpts{Name: "gcp_metrics_test_other", Help: "Test gauge."})
+	if err := SetRegisterer(nil); err != nil {
+		t.Fatalf("SetRegisterer(nil) error = %v", err)
+	}
+	if !gathered(t, prometheus.DefaultGatherer, "gcp_metrics_test_default") || gathered(t, reg, "gcp_metrics_test_default") {
+		t.Errorf("SetRegisterer(nil) did not move metrics back to the default registerer")
+	}
+}
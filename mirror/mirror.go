@@ -0,0 +1,201 @@
+// Package mirror replicates the outputs of another gcp_service_discovery
+// instance, the primary, so a second instance provides the same target files
+// without repeating the discovery requests to GCP APIs.
+//
+// The primary serves the targets of every output as Prometheus HTTP SD on its
+// admin listen address, with a SHA256 checksum of every response. A Source
+// downloads one output, verifies the checksum, and returns the targets
+// exactly as served. Downloads are skipped while the digest of the output
+// served by the primary is unchanged.
+package mirror
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/m-lab/gcp-service-discovery/admin"
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/metrics"
+	"github.com/m-lab/gcp-service-discovery/transport"
+)
+
+var (
+	// integrityErrors counts responses from the primary whose checksum is
+	// missing or does not match the response body.
+	//
+	// Provides metrics:
+	//   gcp_mirror_integrity_errors_total{output="/targets/aeflex.json"}
+	// Usage example:
+	//   integrityErrors.WithLabelValues("/targets/aeflex.json").Inc()
+	integrityErrors = metrics.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gcp_mirror_integrity_errors_total",
+			Help: "Number of mirrored responses that failed the checksum verification.",
+		},
+		[]string{"output"},
+	)
+
+	// unchangedOutputs counts passes that skipped the download of an output
+	// because its digest on the primary was unchanged.
+	//
+	// Provides metrics:
+	//   gcp_mirror_unchanged_total{output="/targets/aeflex.json"}
+	// Usage example:
+	//   unchangedOutputs.WithLabelValues("/targets/aeflex.json").Inc()
+	unchangedOutputs = metrics.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gcp_mirror_unchanged_total",
+			Help: "Number of mirrored downloads skipped because the output digest was unchanged.",
+		},
+		[]string{"output"},
+	)
+)
+
+// Source downloads the targets of one output of the primary. Source implements
+// the discovery.Service, discovery.RawSource, and discovery.Checker
+// interfaces.
+type Source struct {
+	primary string
+	output  string
+	client  http.Client
+
+	// raw is the document downloaded by the most recent successful Discover,
+	// configs its targets, and digest its checksum.
+	raw     []byte
+	configs []discovery.StaticConfig
+	digest  string
+}
+
+// NewSource creates a Source for the named output of the primary, e.g.
+// "http://discovery-1:9373" and "/targets/aeflex.json".
+func NewSource(primary, output string) *Source {
+	return &Source{
+		primary: strings.TrimSuffix(primary, "/"),
+		output:  output,
+		client:  http.Client{Transport: transport.New()},
+	}
+}
+
+// get downloads u and returns the response and its body.
+func get(ctx context.Context, client *http.Client, u string) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("cannot download %q: bad HTTP status code: %d: %s",
+			u, resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return resp, data, nil
+}
+
+// targetsURL returns the URL of the targets of the output.
+func (s *Source) targetsURL() string {
+	return s.primary + "/api/v1/targets?output=" + url.QueryEscape(s.output)
+}
+
+// unchanged returns true if the digest of the output served by the primary
+// matches the digest of the last download. Primaries without the digest
+// endpoint are never unchanged.
+func (s *Source) unchanged(ctx context.Context) bool {
+	if s.raw == nil {
+		return false
+	}
+	_, data, err := get(ctx, &s.client, s.primary+"/api/v1/digest")
+	if err != nil {
+		return false
+	}
+	digests := map[string]string{}
+	if err = json.Unmarshal(data, &digests); err != nil {
+		return false
+	}
+	return digests[s.output] == s.digest
+}
+
+// Discover downloads the targets of the output and verifies their checksum.
+// When the digest of the output is unchanged, Discover returns the targets of
+// the last download instead.
+func (s *Source) Discover(ctx context.Context) ([]discovery.StaticConfig, error) {
+	if s.unchanged(ctx) {
+		unchangedOutputs.WithLabelValues(s.output).Inc()
+		s.recordOrigins(ctx, s.configs)
+		return s.configs, nil
+	}
+	resp, data, err := get(ctx, &s.client, s.targetsURL())
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	if want := resp.Header.Get(admin.ChecksumHeader); want != digest {
+		integrityErrors.WithLabelValues(s.output).Inc()
+		return nil, fmt.Errorf("targets of %q from %s failed the integrity check: checksum %q, want %q",
+			s.output, s.primary, digest, want)
+	}
+	var configs []discovery.StaticConfig
+	if err = json.Unmarshal(data, &configs); err != nil {
+		return nil, err
+	}
+	s.recordOrigins(ctx, configs)
+	s.raw = data
+	s.configs = configs
+	s.digest = digest
+	return configs, nil
+}
+
+// recordOrigins records the primary and output as the origin of configs.
+func (s *Source) recordOrigins(ctx context.Context, configs []discovery.StaticConfig) {
+	for i := range configs {
+		discovery.RecordOrigin(ctx, configs[i], map[string]string{"primary": s.primary, "output": s.output})
+	}
+}
+
+// Raw returns the document downloaded by the most recent successful call to
+// Discover, so mirrored outputs are written exactly as served by the primary.
+// Raw implements the discovery.RawSource interface.
+func (s *Source) Raw() []byte {
+	return s.raw
+}
+
+// Check verifies that the primary serves the output. Check implements the
+// discovery.Checker interface.
+func (s *Source) Check(ctx context.Context) error {
+	_, _, err := get(ctx, &s.client, s.targetsURL())
+	return err
+}
+
+// Outputs returns the outputs registered with the primary.
+func Outputs(ctx context.Context, primary string) ([]string, error) {
+	client := &http.Client{Transport: transport.New()}
+	_, data, err := get(ctx, client, strings.TrimSuffix(primary, "/")+"/api/v1/status")
+	if err != nil {
+		return nil, err
+	}
+	status := []discovery.Status{}
+	if err = json.Unmarshal(data, &status); err != nil {
+		return nil, fmt.Errorf("invalid status from %s: %w", primary, err)
+	}
+	outputs := []string{}
+	for _, s := range status {
+		outputs = append(outputs, s.Output)
+	}
+	return outputs, nil
+}
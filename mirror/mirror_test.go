@@ -0,0 +1,164 @@
+package mirror
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/prometheusx/promtest"
+
+	"github.com/m-lab/gcp-service-discovery/admin"
+	"github.com/m-lab/gcp-service-discovery/discovery"
+)
+
+type fakeService struct{}
+
+func (f *fakeService) Discover(ctx context.Context) ([]discovery.StaticConfig, error) {
+	return []discovery.StaticConfig{
+		{Targets: []string{"1.2.3.4:9090"}, Labels: map[string]string{"service": "fake"}},
+	}, nil
+}
+
+// newPrimary returns a server for the admin handlers of a Manager that has
+// written the targets of one output.
+func newPrimary(t *testing.T) (*httptest.Server, string) {
+	output := filepath.Join(t.TempDir(), "aeflex.json")
+	m := discovery.NewManager(discovery.WithTimeout(time.Minute))
+	m.Register(&fakeService{}, output)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m.Run(ctx, time.Minute)
+	return httptest.NewServer(admin.NewServeMux(m)), output
+}
+
+func TestSource(t *testing.T) {
+	primary, output := newPrimary(t)
+	defer primary.Close()
+
+	outputs, err := Outputs(context.Background(), primary.URL+"/")
+	if err != nil || !reflect.DeepEqual(outputs, []string{output}) {
+		t.Fatalf("Outputs() = %v, %v; want [%s]", outputs, err, output)
+	}
+	s := NewSource(primary.URL, output)
+	if err = s.Check(context.Background()); err != nil {
+		t.Errorf("Source.Check() error = %v", err)
+	}
+	got, err := s.Discover(context.Background())
+	want := []discovery.StaticConfig{{Targets: []string{"1.2.3.4:9090"}, Labels: map[string]string{"service": "fake"}}}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Source.Discover() = %v, %v; want %v", got, err, want)
+	}
+	if len(s.Raw()) == 0 {
+		t.Errorf("Source.Raw() is empty after Discover")
+	}
+
+	// Mirror the output with a local Manager.
+	local := filepath.Join(t.TempDir(), "aeflex.json")
+	ctx, cancel := context.WithCancel(context.Background())
+	// Stop after one pass. Unlike the primary, discovery needs ctx.
+	m := discovery.NewManager(discovery.WithTimeout(time.Minute), discovery.WithAfterPass(func(bool) { cancel() }))
+	m.Register(s, local)
+	m.Run(ctx, time.Minute)
+	mirrored, err := ioutil.ReadFile(local)
+	if err != nil || string(mirrored) != string(s.Raw()) {
+		t.Errorf("mirrored output = %q, %v; want %q", mirrored, err, s.Raw())
+	}
+
+	s = NewSource(primary.URL, "unknown.json")
+	if err = s.Check(context.Background()); err == nil {
+		t.Errorf("Source.Check() error = nil for unknown output, want error")
+	}
+}
+
+func TestSource_unchanged(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "aeflex.json")
+	m := discovery.NewManager(discovery.WithTimeout(time.Minute))
+	m.Register(&fakeService{}, output)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m.Run(ctx, time.Minute)
+	mux := admin.NewServeMux(m)
+	downloads := 0
+	digest := true
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/targets":
+			downloads++
+		case "/api/v1/digest":
+			if !digest {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer primary.Close()
+
+	s := NewSource(primary.URL, output)
+	for i := 0; i < 3; i++ {
+		got, err := s.Discover(context.Background())
+		if err != nil || len(got) != 1 {
+			t.Fatalf("Source.Discover() = %v, %v; want 1 config", got, err)
+		}
+	}
+	if downloads != 1 {
+		t.Errorf("Source.Discover() downloaded targets %d times, want 1", downloads)
+	}
+
+	// Targets are downloaded on every pass from primaries without digests.
+	digest = false
+	s.Discover(context.Background())
+	if downloads != 2 {
+		t.Errorf("Source.Discover() downloaded targets %d times, want 2", downloads)
+	}
+}
+
+func TestSource_integrity(t *testing.T) {
+	tests := []struct {
+		name     string
+		checksum string
+	}{
+		{name: "failure-missing-checksum"},
+		{name: "failure-wrong-checksum", checksum: "0123"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.checksum != "" {
+					w.Header().Set(admin.ChecksumHeader, tt.checksum)
+				}
+				w.Write([]byte(`[{"targets": ["1.2.3.4:9090"]}]`))
+			}))
+			defer srv.Close()
+			s := NewSource(srv.URL, "aeflex.json")
+			if _, err := s.Discover(context.Background()); err == nil {
+				t.Errorf("Source.Discover() error = nil, want integrity error")
+			}
+		})
+	}
+}
+
+func TestOutputs_errors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not json"))
+	}))
+	defer srv.Close()
+	if _, err := Outputs(context.Background(), srv.URL); err == nil {
+		t.Errorf("Outputs() error = nil for invalid status, want error")
+	}
+	srv.Close()
+	if _, err := Outputs(context.Background(), srv.URL); err == nil {
+		t.Errorf("Outputs() error = nil for unreachable primary, want error")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	integrityErrors.WithLabelValues("x")
+	unchangedOutputs.WithLabelValues("x")
+	promtest.LintMetrics(t)
+}
@@ -0,0 +1,79 @@
+// Package iface defines an interface for accessing the network endpoint groups
+// of the Compute API. This is helpful for creating testable packages.
+package iface
+
+import (
+	"context"
+	"net/http"
+
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+
+	"github.com/m-lab/gcp-service-discovery/internal/apicall"
+)
+
+// api names the Compute API in quota metrics.
+const api = "compute"
+
+// endpointFields limits network endpoint responses to the fields used by the
+// neg logic.
+const endpointFields = googleapi.Field("nextPageToken,items(networkEndpoint(ipAddress,port,instance))")
+
+// NEG defines the interface used by the neg logic.
+type NEG interface {
+	GroupPages(ctx context.Context, f func(list *compute.NetworkEndpointGroupAggregatedList) error) error
+	EndpointPages(ctx context.Context, zone, name string, f func(list *compute.NetworkEndpointGroupsListNetworkEndpoints) error) error
+	BackendServicePages(ctx context.Context, f func(list *compute.BackendServiceAggregatedList) error) error
+}
+
+// NEGImpl implements the NEG interface.
+type NEGImpl struct {
+	project string
+	service *compute.Service
+}
+
+// NewNEG creates a new NEG for the given project.
+func NewNEG(project string, service *compute.Service) *NEGImpl {
+	return &NEGImpl{project: project, service: service}
+}
+
+// GroupPages lists the network endpoint groups of every zone and region and
+// calls the given function for each "page" of results.
+func (n *NEGImpl) GroupPages(ctx context.Context, f func(list *compute.NetworkEndpointGroupAggregatedList) error) error {
+	return apicall.Pages(ctx, api,
+		func(ctx context.Context, token string) (*compute.NetworkEndpointGroupAggregatedList, error) {
+			return n.service.NetworkEndpointGroups.AggregatedList(n.project).PageToken(token).Context(ctx).Do()
+		},
+		func(list *compute.NetworkEndpointGroupAggregatedList) (http.Header, string) {
+			return list.Header, list.NextPageToken
+		},
+		f)
+}
+
+// EndpointPages lists the network endpoints of the named zonal network
+// endpoint group and calls the given function for each "page" of results.
+func (n *NEGImpl) EndpointPages(ctx context.Context, zone, name string, f func(list *compute.NetworkEndpointGroupsListNetworkEndpoints) error) error {
+	return apicall.Pages(ctx, api,
+		func(ctx context.Context, token string) (*compute.NetworkEndpointGroupsListNetworkEndpoints, error) {
+			return n.service.NetworkEndpointGroups.ListNetworkEndpoints(
+				n.project, zone, name, &compute.NetworkEndpointGroupsListEndpointsRequest{},
+			).Fields(endpointFields).PageToken(token).Context(ctx).Do()
+		},
+		func(list *compute.NetworkEndpointGroupsListNetworkEndpoints) (http.Header, string) {
+			return list.Header, list.NextPageToken
+		},
+		f)
+}
+
+// BackendServicePages lists the backend services of every region, and global
+// backend services, and calls the given function for each "page" of results.
+func (n *NEGImpl) BackendServicePages(ctx context.Context, f func(list *compute.BackendServiceAggregatedList) error) error {
+	return apicall.Pages(ctx, api,
+		func(ctx context.Context, token string) (*compute.BackendServiceAggregatedList, error) {
+			return n.service.BackendServices.AggregatedList(n.project).PageToken(token).Context(ctx).Do()
+		},
+		func(list *compute.BackendServiceAggregatedList) (http.Header, string) {
+			return list.Header, list.NextPageToken
+		},
+		f)
+}
@@ -0,0 +1,281 @@
+// Package neg implements service discovery for the network endpoints of GCE
+// network endpoint groups (NEGs). GKE container-native load balancing
+// registers the IP and port of every serving pod in zonal NEGs, so NEGs are a
+// complete inventory of the pods behind every load balanced service.
+package neg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	compute "google.golang.org/api/compute/v1"
+
+	"github.com/m-lab/gcp-service-discovery/apilimit"
+	"github.com/m-lab/gcp-service-discovery/credentials"
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/gce"
+	"github.com/m-lab/gcp-service-discovery/internal/apicall"
+	"github.com/m-lab/gcp-service-discovery/metrics"
+	"github.com/m-lab/gcp-service-discovery/neg/iface"
+)
+
+const (
+	negLabel            = "__neg_"
+	labelName           = negLabel + "name"
+	labelLocation       = negLabel + "location"
+	labelType           = negLabel + "type"
+	labelNetwork        = negLabel + "network"
+	labelBackendService = negLabel + "backend_service"
+	labelK8sNamespace   = negLabel + "k8s_namespace"
+	labelK8sService     = negLabel + "k8s_service"
+	labelK8sPort        = negLabel + "k8s_port"
+)
+
+var (
+	// newComputeClient allocates a new Compute client. The indirection
+	// facilitates testing.
+	newComputeClient = compute.New
+)
+
+var (
+	// GroupCount is the number of network endpoint groups by type.
+	//
+	// Provides metrics:
+	//   gcp_neg_groups{type="GCE_VM_IP_PORT"}
+	// Example usage:
+	//   GroupCount.WithLabelValues("GCE_VM_IP_PORT").Set(count)
+	GroupCount = metrics.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gcp_neg_groups",
+			Help: "Number of network endpoint groups by type.",
+		},
+		[]string{"type"},
+	)
+)
+
+// Service discovers the network endpoints of every NEG in a project.
+type Service struct {
+	project string
+	api     iface.NEG
+
+	// connect creates api. It is called again to recreate the client after
+	// an authentication error.
+	connect func(ctx context.Context) error
+}
+
+// NewService returns a Service initialized with a Compute API client
+// authenticated by creds. The Service implements the discovery.Service
+// interface. NewService fails if the credentials are not found before ctx is
+// done.
+func NewService(ctx context.Context, project string, creds credentials.Config) (*Service, error) {
+	s := &Service{project: project}
+	s.connect = func(ctx context.Context) error {
+		client, err := creds.Client(ctx, compute.ComputeReadonlyScope)
+		if err != nil {
+			return fmt.Errorf("Error setting up Compute client: %s", err)
+		}
+		c, err := newComputeClient(apilimit.Client(client))
+		if err != nil {
+			return fmt.Errorf("Error setting up Compute client: %s", err)
+		}
+		s.api = iface.NewNEG(project, c)
+		return nil
+	}
+	if err := s.connect(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// gkeDescription is the description GKE writes to the NEGs it manages.
+type gkeDescription struct {
+	Namespace   string `json:"namespace"`
+	ServiceName string `json:"service-name"`
+	Port        string `json:"port"`
+}
+
+// Discover lists every NEG, and the network endpoints of every zonal NEG. A
+// target is returned for every endpoint with a port. Serverless and other
+// regional NEGs have no network endpoints, and are only counted. After an
+// authentication error, Discover recreates its client and tries once more.
+func (s *Service) Discover(ctx context.Context) ([]discovery.StaticConfig, error) {
+	var targets []discovery.StaticConfig
+	err := credentials.Retry(ctx, "neg", s.connect, func() error {
+		var err error
+		targets, err = s.discover(ctx)
+		return err
+	})
+	return targets, err
+}
+
+// discover lists every NEG once.
+func (s *Service) discover(ctx context.Context) ([]discovery.StaticConfig, error) {
+	backends, err := s.backendServices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var groups []*compute.NetworkEndpointGroup
+	err = s.api.GroupPages(ctx, func(list *compute.NetworkEndpointGroupAggregatedList) error {
+		// Sort scopes, so targets are returned in a stable order.
+		scopes := make([]string, 0, len(list.Items))
+		for scope := range list.Items {
+			scopes = append(scopes, scope)
+		}
+		sort.Strings(scopes)
+		for _, scope := range scopes {
+			groups = append(groups, list.Items[scope].NetworkEndpointGroups...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	discovery.CountScanned(ctx, "groups", len(groups))
+
+	GroupCount.Reset()
+	targets := []discovery.StaticConfig{}
+	for _, g := range groups {
+		GroupCount.WithLabelValues(g.NetworkEndpointType).Inc()
+		object := g.Name
+		if g.Zone == "" {
+			discovery.Decide(ctx, object, false, "no network endpoints: "+g.NetworkEndpointType)
+			continue
+		}
+		zone := path.Base(g.Zone)
+		found := 0
+		err = s.api.EndpointPages(ctx, zone, g.Name, func(list *compute.NetworkEndpointGroupsListNetworkEndpoints) error {
+			discovery.CountScanned(ctx, "endpoints", len(list.Items))
+			for _, item := range list.Items {
+				ep := item.NetworkEndpoint
+				if ep == nil || ep.IpAddress == "" {
+					continue
+				}
+				port := ep.Port
+				if port == 0 {
+					port = g.DefaultPort
+				}
+				if port == 0 {
+					discovery.Decide(ctx, object+"/"+ep.IpAddress, false, "no port")
+					continue
+				}
+				config := s.getLabels(g, zone, backends[resourcePath(g.SelfLink)], ep, port)
+				discovery.RecordOrigin(ctx, config, map[string]interface{}{
+					"neg":      g.Name,
+					"zone":     zone,
+					"endpoint": ep,
+				})
+				targets = append(targets, config)
+				found++
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		discovery.Decide(ctx, object, found > 0, fmt.Sprintf("%d endpoints", found))
+	}
+	return targets, nil
+}
+
+// backendServices returns the names of the backend services of every NEG,
+// keyed by the resource path of the NEG.
+func (s *Service) backendServices(ctx context.Context) (map[string][]string, error) {
+	backends := map[string][]string{}
+	err := s.api.BackendServicePages(ctx, func(list *compute.BackendServiceAggregatedList) error {
+		for _, scoped := range list.Items {
+			for _, bs := range scoped.BackendServices {
+				for _, b := range bs.Backends {
+					key := resourcePath(b.Group)
+					backends[key] = append(backends[key], bs.Name)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, names := range backends {
+		sort.Strings(names)
+	}
+	return backends, nil
+}
+
+// resourcePath returns the path of a resource URL starting at "projects/", so
+// URLs of different API versions or hosts are equal.
+func resourcePath(url string) string {
+	if i := strings.Index(url, "projects/"); i >= 0 {
+		return url[i:]
+	}
+	return url
+}
+
+// getLabels creates a target configuration for a network endpoint of g.
+//
+// In serialized form, the label set look like:
+//
+//	{
+//	    "labels": {
+//	        "__neg_backend_service": "k8s1-1a2b3c4d-default-web-80-5e6f7a8b",
+//	        "__neg_k8s_namespace": "default",
+//	        "__neg_k8s_port": "80",
+//	        "__neg_k8s_service": "web",
+//	        "__neg_location": "us-central1-a",
+//	        "__neg_name": "k8s1-1a2b3c4d-default-web-80-5e6f7a8b",
+//	        "__neg_network": "default",
+//	        "__neg_type": "GCE_VM_IP_PORT"
+//	    },
+//	    "targets": [
+//	        "10.8.0.12:8080"
+//	    ]
+//	}
+func (s *Service) getLabels(
+	g *compute.NetworkEndpointGroup, zone string, backends []string,
+	ep *compute.NetworkEndpoint, port int64) discovery.StaticConfig {
+	labels := map[string]string{
+		labelName:     g.Name,
+		labelLocation: zone,
+		labelType:     g.NetworkEndpointType,
+	}
+	if g.Network != "" {
+		labels[labelNetwork] = path.Base(g.Network)
+	}
+	if len(backends) > 0 {
+		labels[labelBackendService] = strings.Join(backends, ",")
+	}
+	// GKE describes the Kubernetes service of the NEGs it manages.
+	desc := gkeDescription{}
+	if json.Unmarshal([]byte(g.Description), &desc) == nil && desc.ServiceName != "" {
+		labels[labelK8sNamespace] = desc.Namespace
+		labels[labelK8sService] = desc.ServiceName
+		labels[labelK8sPort] = desc.Port
+	}
+	// Identify the VM, so gce.Enricher can add its metadata.
+	if ep.Instance != "" {
+		labels[gce.LabelProject] = s.project
+		labels[gce.LabelInstance] = path.Base(ep.Instance)
+		labels[gce.LabelZone] = zone
+	}
+	return discovery.StaticConfig{
+		Targets: []string{ep.IpAddress + ":" + strconv.FormatInt(port, 10)},
+		Labels:  labels,
+	}
+}
+
+// Check verifies access to the Compute API by reading the first page of NEGs.
+// Check implements the discovery.Checker interface.
+func (s *Service) Check(ctx context.Context) error {
+	err := apicall.FirstPage(ctx, s.api.GroupPages)
+	if err != nil {
+		return fmt.Errorf("cannot list network endpoint groups in project %q; "+
+			"verify the Compute API is enabled and the credentials have the "+
+			"Compute Viewer role: %s", s.project, err)
+	}
+	return nil
+}
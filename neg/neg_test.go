@@ -0,0 +1,245 @@
+package neg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/m-lab/go/prometheusx/promtest"
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+
+	"github.com/m-lab/gcp-service-discovery/credentials"
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/internal/schematest"
+)
+
+const negURL = "https://www.googleapis.com/compute/v1/projects/mlab-sandbox/zones/us-central1-a/networkEndpointGroups/"
+
+type fakeNEG struct {
+	groups       map[string][]*compute.NetworkEndpointGroup
+	endpoints    map[string][]*compute.NetworkEndpoint
+	backends     []*compute.BackendService
+	groupErr     error
+	endpointErr  error
+	backendErr   error
+	endpointZone []string
+}
+
+func (f *fakeNEG) GroupPages(ctx context.Context, fn func(list *compute.NetworkEndpointGroupAggregatedList) error) error {
+	if f.groupErr != nil {
+		return f.groupErr
+	}
+	list := &compute.NetworkEndpointGroupAggregatedList{Items: map[string]compute.NetworkEndpointGroupsScopedList{}}
+	for scope, groups := range f.groups {
+		list.Items[scope] = compute.NetworkEndpointGroupsScopedList{NetworkEndpointGroups: groups}
+	}
+	return fn(list)
+}
+
+func (f *fakeNEG) EndpointPages(ctx context.Context, zone, name string, fn func(list *compute.NetworkEndpointGroupsListNetworkEndpoints) error) error {
+	f.endpointZone = append(f.endpointZone, zone+"/"+name)
+	if f.endpointErr != nil {
+		return f.endpointErr
+	}
+	list := &compute.NetworkEndpointGroupsListNetworkEndpoints{}
+	for _, ep := range f.endpoints[name] {
+		list.Items = append(list.Items, &compute.NetworkEndpointWithHealthStatus{NetworkEndpoint: ep})
+	}
+	return fn(list)
+}
+
+func (f *fakeNEG) BackendServicePages(ctx context.Context, fn func(list *compute.BackendServiceAggregatedList) error) error {
+	if f.backendErr != nil {
+		return f.backendErr
+	}
+	return fn(&compute.BackendServiceAggregatedList{Items: map[string]compute.BackendServicesScopedList{
+		"global": {BackendServices: f.backends},
+	}})
+}
+
+func newFakeNEG() *fakeNEG {
+	return &fakeNEG{
+		groups: map[string][]*compute.NetworkEndpointGroup{
+			"zones/us-central1-a": {
+				{
+					Name: "k8s1-web", Zone: negURL[:len(negURL)-len("/networkEndpointGroups/")],
+					SelfLink:            negURL + "k8s1-web",
+					Network:             "https://www.googleapis.com/compute/v1/projects/mlab-sandbox/global/networks/default",
+					NetworkEndpointType: "GCE_VM_IP_PORT",
+					Description:         `{"cluster-uid":"1a2b","namespace":"default","service-name":"web","port":"80"}`,
+				},
+				{
+					Name: "vms", Zone: "us-central1-a", DefaultPort: 9090,
+					SelfLink:            negURL + "vms",
+					NetworkEndpointType: "GCE_VM_IP_PORT",
+					Description:         "not json",
+				},
+			},
+			"regions/us-central1": {
+				{Name: "run", Region: "us-central1", NetworkEndpointType: "SERVERLESS"},
+			},
+		},
+		endpoints: map[string][]*compute.NetworkEndpoint{
+			"k8s1-web": {
+				{IpAddress: "10.8.0.12", Port: 8080, Instance: "gke-node-1"},
+				{Port: 8080},
+			},
+			"vms": {
+				{IpAddress: "10.0.0.2", Instance: "vm-1"},
+			},
+		},
+		backends: []*compute.BackendService{
+			{Name: "web-b", Backends: []*compute.Backend{{Group: "https://compute.googleapis.com/compute/beta/projects/mlab-sandbox/zones/us-central1-a/networkEndpointGroups/k8s1-web"}}},
+			{Name: "web-a", Backends: []*compute.Backend{{Group: negURL + "k8s1-web"}}},
+		},
+	}
+}
+
+func TestService_Discover(t *testing.T) {
+	tests := []struct {
+		name    string
+		api     *fakeNEG
+		want    []discovery.StaticConfig
+		wantErr bool
+	}{
+		{
+			name: "success",
+			api:  newFakeNEG(),
+			want: []discovery.StaticConfig{
+				{
+					Targets: []string{"10.8.0.12:8080"},
+					Labels: map[string]string{
+						"__neg_name":            "k8s1-web",
+						"__neg_location":        "us-central1-a",
+						"__neg_type":            "GCE_VM_IP_PORT",
+						"__neg_network":         "default",
+						"__neg_backend_service": "web-a,web-b",
+						"__neg_k8s_namespace":   "default",
+						"__neg_k8s_service":     "web",
+						"__neg_k8s_port":        "80",
+						"__gce_project":         "mlab-sandbox",
+						"__gce_instance":        "gke-node-1",
+						"__gce_zone":            "us-central1-a",
+					},
+				},
+				{
+					Targets: []string{"10.0.0.2:9090"},
+					Labels: map[string]string{
+						"__neg_name":     "vms",
+						"__neg_location": "us-central1-a",
+						"__neg_type":     "GCE_VM_IP_PORT",
+						"__gce_project":  "mlab-sandbox",
+						"__gce_instance": "vm-1",
+						"__gce_zone":     "us-central1-a",
+					},
+				},
+			},
+		},
+		{
+			name:    "failure-backend-services",
+			api:     &fakeNEG{backendErr: fmt.Errorf("forbidden")},
+			wantErr: true,
+		},
+		{
+			name:    "failure-groups",
+			api:     &fakeNEG{groupErr: fmt.Errorf("forbidden")},
+			wantErr: true,
+		},
+		{
+			name: "failure-endpoints",
+			api: func() *fakeNEG {
+				f := newFakeNEG()
+				f.endpointErr = fmt.Errorf("unavailable")
+				return f
+			}(),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Service{project: "mlab-sandbox", api: tt.api}
+			got, err := s.Discover(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Service.Discover() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Service.Discover() = %v, want %v", got, tt.want)
+			}
+			if err == nil {
+				data, _ := json.Marshal(got)
+				if err := schematest.Validate([]byte(discovery.Schema), data); err != nil {
+					t.Errorf("Service.Discover() = %s, which does not match the schema: %v", data, err)
+				}
+			}
+		})
+	}
+}
+
+func TestService_DiscoverSkipsRegional(t *testing.T) {
+	api := newFakeNEG()
+	s := &Service{project: "mlab-sandbox", api: api}
+	if _, err := s.Discover(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"us-central1-a/k8s1-web", "us-central1-a/vms"}
+	if !reflect.DeepEqual(api.endpointZone, want) {
+		t.Errorf("Service.Discover() listed endpoints of %v, want %v", api.endpointZone, want)
+	}
+}
+
+func TestService_Check(t *testing.T) {
+	s := &Service{project: "mlab-sandbox", api: newFakeNEG()}
+	if err := s.Check(context.Background()); err != nil {
+		t.Errorf("Service.Check() error = %v", err)
+	}
+	s.api = &fakeNEG{groupErr: fmt.Errorf("forbidden")}
+	if err := s.Check(context.Background()); err == nil {
+		t.Errorf("Service.Check() error = nil, want error")
+	}
+}
+
+func TestNewService(t *testing.T) {
+	orig := newComputeClient
+	defer func() { newComputeClient = orig }()
+	if _, err := NewService(context.Background(), "mlab-sandbox", credentials.Config{}); err != nil {
+		t.Errorf("NewService() error = %v", err)
+	}
+	newComputeClient = func(client *http.Client) (*compute.Service, error) {
+		return nil, fmt.Errorf("failed to create client")
+	}
+	if _, err := NewService(context.Background(), "mlab-sandbox", credentials.Config{}); err == nil {
+		t.Errorf("NewService() error = nil, want error")
+	}
+}
+
+func TestService_DiscoverAuthRefresh(t *testing.T) {
+	s := &Service{project: "mlab-sandbox", api: &fakeNEG{groupErr: &googleapi.Error{Code: http.StatusUnauthorized}}}
+	connects := 0
+	s.connect = func(ctx context.Context) error {
+		connects++
+		s.api = newFakeNEG()
+		return nil
+	}
+	got, err := s.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("Service.Discover() error = %v", err)
+	}
+	if connects != 1 || len(got) == 0 {
+		t.Errorf("Service.Discover() connected %d times and found %d targets, want 1 and more than 0", connects, len(got))
+	}
+
+	// Other errors do not recreate the client.
+	s.api = &fakeNEG{groupErr: &googleapi.Error{Code: http.StatusForbidden}}
+	if _, err := s.Discover(context.Background()); err == nil || connects != 1 {
+		t.Errorf("Service.Discover() error = %v and connected %d times, want error and 1", err, connects)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	GroupCount.WithLabelValues("x")
+	promtest.LintMetrics(t)
+}
@@ -0,0 +1,111 @@
+// Package exec implements service discovery by running an external command.
+// The command must write a JSON formatted Prometheus static_config to stdout,
+// i.e. a list of objects with "targets" and "labels". This allows bespoke
+// discovery logic to be written in any language without changes to this
+// repository.
+package exec
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/metrics"
+)
+
+// maxStderr limits the amount of stderr included in error messages.
+const maxStderr = 1024
+
+// waitDelay limits the time Discover waits for the output of a killed command
+// to close, e.g. when a process that inherited stdout is still running.
+const waitDelay = time.Second
+
+var (
+	// runTotal counts the runs of every external command, labeled by the
+	// command name and the run status.
+	//
+	// Provides metrics:
+	//   gcp_exec_runs_total{command="discover.sh", status="success"}
+	// Example usage:
+	//   runTotal.WithLabelValues("discover.sh", "success").Inc()
+	runTotal = metrics.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gcp_exec_runs_total",
+			Help: "Number of external discovery command runs.",
+		},
+		[]string{"command", "status"},
+	)
+)
+
+// Service runs an external command to discover targets.
+type Service struct {
+	// command is the path of the command to run.
+	command string
+	// args are passed to the command.
+	args []string
+
+	// Timeout limits the run time of the command. The command, and on Unix
+	// every process it started in its process group, is killed once Timeout
+	// or the Discover context expires. When zero, only the Discover context
+	// applies.
+	Timeout time.Duration
+
+	// Env adds "KEY=value" entries to the environment of the command, which
+	// otherwise inherits the environment of this process.
+	Env []string
+}
+
+// NewService creates a new Service that runs command with the given args.
+func NewService(command string, args ...string) *Service {
+	return &Service{command: command, args: args}
+}
+
+// Discover runs the command and parses its stdout as a list of StaticConfigs.
+// A command that exits with a non-zero status, or writes invalid JSON, fails.
+func (s *Service) Discover(ctx context.Context) ([]discovery.StaticConfig, error) {
+	name := filepath.Base(s.command)
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+	cmd := osexec.CommandContext(ctx, s.command, s.args...)
+	cmd.Env = append(os.Environ(), s.Env...)
+	cmd.WaitDelay = waitDelay
+	killProcessGroup(cmd)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	data, err := cmd.Output()
+	if ctx.Err() != nil {
+		runTotal.WithLabelValues(name, "error-timeout").Inc()
+		return nil, fmt.Errorf("%s: %s", s.command, ctx.Err())
+	}
+	if err != nil {
+		runTotal.WithLabelValues(name, "error-exec").Inc()
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) > maxStderr {
+			msg = msg[:maxStderr] + "..."
+		}
+		return nil, fmt.Errorf("%s: %s: %s", s.command, err, msg)
+	}
+	var configs []discovery.StaticConfig
+	err = json.Unmarshal(data, &configs)
+	if err != nil {
+		runTotal.WithLabelValues(name, "error-parse").Inc()
+		return nil, fmt.Errorf("%s: invalid output: %s", s.command, err)
+	}
+	for i := range configs {
+		discovery.RecordOrigin(ctx, configs[i], map[string]string{"command": s.command})
+	}
+	runTotal.WithLabelValues(name, "success").Inc()
+	return configs, nil
+}
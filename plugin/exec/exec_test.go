@@ -0,0 +1,96 @@
+package exec
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/prometheusx/promtest"
+
+	"github.com/m-lab/gcp-service-discovery/discovery"
+)
+
+// TestHelperProcess is not a real test. It is run as the external command by
+// the other tests, and behaves according to its first argument.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	switch args[1] {
+	case "success":
+		fmt.Printf(`[{"targets": ["a:9090"], "labels": {"env": %q}}]`, os.Getenv("ENV"))
+	case "fail":
+		fmt.Fprint(os.Stderr, "permission denied")
+		os.Exit(1)
+	case "invalid":
+		fmt.Print("not json")
+	case "sleep":
+		time.Sleep(time.Minute)
+	}
+	os.Exit(0)
+}
+
+func helper(mode string) *Service {
+	s := NewService(os.Args[0], "-test.run=TestHelperProcess", "--", mode)
+	s.Env = []string{"GO_WANT_HELPER_PROCESS=1", "ENV=test"}
+	return s
+}
+
+func TestService_Discover(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		timeout time.Duration
+		want    []discovery.StaticConfig
+		wantErr bool
+	}{
+		{
+			name: "success",
+			mode: "success",
+			want: []discovery.StaticConfig{
+				{Targets: []string{"a:9090"}, Labels: map[string]string{"env": "test"}},
+			},
+		},
+		{
+			name:    "error-exit-status",
+			mode:    "fail",
+			wantErr: true,
+		},
+		{
+			name:    "error-invalid-json",
+			mode:    "invalid",
+			wantErr: true,
+		},
+		{
+			name:    "error-timeout",
+			mode:    "sleep",
+			timeout: 100 * time.Millisecond,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := helper(tt.mode)
+			s.Timeout = tt.timeout
+			got, err := s.Discover(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Service.Discover() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Service.Discover() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	runTotal.WithLabelValues("x", "x")
+	promtest.LintMetrics(t)
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+
+package exec
+
+import (
+	osexec "os/exec"
+	"syscall"
+)
+
+// killProcessGroup runs cmd in a new process group, and kills the whole group
+// when the context of cmd is done, so that processes started by a shell script
+// do not outlive the timeout.
+func killProcessGroup(cmd *osexec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		// A negative pid signals every process of the group.
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+
+package exec
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestService_DiscoverTimeoutChild(t *testing.T) {
+	// The shell forks sleep, which keeps stdout open after the shell is killed.
+	s := NewService("/bin/sh", "-c", "sleep 5; echo []")
+	s.Timeout = 200 * time.Millisecond
+	start := time.Now()
+	_, err := s.Discover(context.Background())
+	if err == nil {
+		t.Errorf("Service.Discover() error = nil, want timeout")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Service.Discover() returned after %s, want about %s", d, s.Timeout)
+	}
+}
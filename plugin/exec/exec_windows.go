@@ -0,0 +1,12 @@
+//go:build windows
+
+package exec
+
+import (
+	osexec "os/exec"
+)
+
+// killProcessGroup does nothing, since Windows has no process groups that can
+// be killed at once. Only the command is killed when the context of cmd is
+// done, and waitDelay limits the wait for the processes it started.
+func killProcessGroup(cmd *osexec.Cmd) {}
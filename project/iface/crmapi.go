@@ -0,0 +1,41 @@
+// Package iface defines an interface for accessing the Resource Manager API.
+// This is helpful for creating testable packages.
+package iface
+
+import (
+	"context"
+	"net/http"
+
+	"google.golang.org/api/cloudresourcemanager/v1"
+	"google.golang.org/api/googleapi"
+
+	"github.com/m-lab/gcp-service-discovery/internal/apicall"
+)
+
+// projectFields limits project responses to the fields used by the project
+// logic.
+const projectFields = googleapi.Field("projectId,projectNumber")
+
+// ResourceManager defines the interface used by the project logic.
+type ResourceManager interface {
+	ProjectGet(ctx context.Context, project string) (*cloudresourcemanager.Project, error)
+}
+
+// ResourceManagerImpl implements the ResourceManager interface.
+type ResourceManagerImpl struct {
+	service *cloudresourcemanager.Service
+}
+
+// NewResourceManager creates a new ResourceManager instance.
+func NewResourceManager(service *cloudresourcemanager.Service) *ResourceManagerImpl {
+	return &ResourceManagerImpl{service: service}
+}
+
+// ProjectGet wraps the Projects.Get method for the given project ID or number.
+func (r *ResourceManagerImpl) ProjectGet(ctx context.Context, project string) (*cloudresourcemanager.Project, error) {
+	return apicall.Get(ctx, "cloudresourcemanager",
+		func(ctx context.Context) (*cloudresourcemanager.Project, error) {
+			return r.service.Projects.Get(project).Fields(projectFields).Context(ctx).Do()
+		},
+		func(p *cloudresourcemanager.Project) http.Header { return p.Header })
+}
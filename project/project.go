@@ -0,0 +1,122 @@
+// Package project resolves GCP projects given by either project ID or project
+// number, as copied from the Cloud Console or returned by some GCP APIs, and
+// labels discovered targets with both.
+package project
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"google.golang.org/api/cloudresourcemanager/v1"
+
+	"github.com/m-lab/gcp-service-discovery/apilimit"
+	"github.com/m-lab/gcp-service-discovery/credentials"
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/project/iface"
+)
+
+// Labels added to every target by a Project.
+const (
+	LabelID     = "__gcp_project_id"
+	LabelNumber = "__gcp_project_number"
+)
+
+var (
+	// newCRMClient allocates a new Resource Manager client. The indirection
+	// facilitates testing.
+	newCRMClient = cloudresourcemanager.New
+
+	// newResourceManager returns a ResourceManager authenticated with creds.
+	// The indirection facilitates testing.
+	newResourceManager = func(ctx context.Context, creds credentials.Config) (iface.ResourceManager, error) {
+		client, err := creds.Client(ctx, cloudresourcemanager.CloudPlatformReadOnlyScope)
+		if err != nil {
+			return nil, fmt.Errorf("Error setting up Resource Manager client: %s", err)
+		}
+		crm, err := newCRMClient(apilimit.Client(client))
+		if err != nil {
+			return nil, fmt.Errorf("Error setting up Resource Manager client: %s", err)
+		}
+		return iface.NewResourceManager(crm), nil
+	}
+)
+
+// IsNumber reports whether p is a project number rather than a project ID.
+// Project IDs must start with a letter, so they are never numeric.
+func IsNumber(p string) bool {
+	_, err := strconv.ParseUint(p, 10, 64)
+	return err == nil
+}
+
+// Project identifies a GCP project.
+type Project struct {
+	// ID is the unique name of the project, e.g. "mlab-sandbox".
+	ID string
+
+	// Number is the unique number assigned to the project by GCP, e.g.
+	// "123456789012".
+	Number string
+}
+
+// Resolve looks up the project with the given ID or number using the Resource
+// Manager API and creds, which are usually those of the sources of the project.
+// The credentials need the resourcemanager.projects.get permission on the
+// project. Resolve fails if the project is not found before ctx is done.
+func Resolve(ctx context.Context, p string, creds credentials.Config) (*Project, error) {
+	crm, err := newResourceManager(ctx, creds)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := crm.ProjectGet(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	if resp.ProjectId == "" || resp.ProjectNumber == 0 {
+		return nil, fmt.Errorf("project %q has no ID or number", p)
+	}
+	return &Project{ID: resp.ProjectId, Number: strconv.FormatInt(resp.ProjectNumber, 10)}, nil
+}
+
+// Label returns a copy of configs with the ID and number of the project added
+// to every target. Existing labels with the same names are replaced.
+func (p *Project) Label(configs []discovery.StaticConfig) []discovery.StaticConfig {
+	result := make([]discovery.StaticConfig, len(configs))
+	for i, c := range configs {
+		result[i] = c
+		result[i].Labels = make(map[string]string, len(c.Labels)+2)
+		for k, v := range c.Labels {
+			result[i].Labels[k] = v
+		}
+		result[i].Labels[LabelID] = p.ID
+		result[i].Labels[LabelNumber] = p.Number
+	}
+	return result
+}
+
+// Wrap returns a discovery.Service that labels the targets discovered by s
+// with the ID and number of the project.
+func (p *Project) Wrap(s discovery.Service) *Service {
+	return &Service{service: s, project: p}
+}
+
+// Service labels the targets discovered by another service with a project.
+// Service implements the discovery.Service interface.
+type Service struct {
+	service discovery.Service
+	project *Project
+}
+
+// Discover runs discovery on the underlying service and labels the result.
+func (s *Service) Discover(ctx context.Context) ([]discovery.StaticConfig, error) {
+	configs, err := s.service.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.project.Label(configs), nil
+}
+
+// Unwrap returns the underlying discovery.Service.
+func (s *Service) Unwrap() discovery.Service {
+	return s.service
+}
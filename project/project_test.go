@@ -0,0 +1,199 @@
+package project
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"google.golang.org/api/cloudresourcemanager/v1"
+	"google.golang.org/api/option"
+
+	"github.com/m-lab/gcp-service-discovery/credentials"
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/project/iface"
+)
+
+// fakeCRM implements the project/iface.ResourceManager interface for the
+// mlab-sandbox project.
+type fakeCRM struct {
+	err error
+}
+
+func (f *fakeCRM) ProjectGet(ctx context.Context, project string) (*cloudresourcemanager.Project, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if project != "mlab-sandbox" && project != "123456789012" {
+		return &cloudresourcemanager.Project{}, nil
+	}
+	return &cloudresourcemanager.Project{ProjectId: "mlab-sandbox", ProjectNumber: 123456789012}, nil
+}
+
+// fakeResourceManager replaces newResourceManager with f until the test ends,
+// and returns the credentials of the last call.
+func fakeResourceManager(t *testing.T, f iface.ResourceManager, err error) *credentials.Config {
+	orig := newResourceManager
+	t.Cleanup(func() { newResourceManager = orig })
+	got := &credentials.Config{}
+	newResourceManager = func(ctx context.Context, creds credentials.Config) (iface.ResourceManager, error) {
+		*got = creds
+		return f, err
+	}
+	return got
+}
+
+type fakeService struct {
+	configs []discovery.StaticConfig
+	err     error
+}
+
+func (f *fakeService) Discover(ctx context.Context) ([]discovery.StaticConfig, error) {
+	return f.configs, f.err
+}
+
+func TestIsNumber(t *testing.T) {
+	tests := []struct {
+		project string
+		want    bool
+	}{
+		{project: "123456789012", want: true},
+		{project: "mlab-sandbox"},
+		{project: "example.com:mlab-sandbox"},
+		{project: "-1"},
+		{project: ""},
+	}
+	for _, tt := range tests {
+		if got := IsNumber(tt.project); got != tt.want {
+			t.Errorf("IsNumber(%q) = %t, want %t", tt.project, got, tt.want)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	want := &Project{ID: "mlab-sandbox", Number: "123456789012"}
+	creds := credentials.Config{Impersonate: "discovery@mlab-sandbox.iam.gserviceaccount.com"}
+	tests := []struct {
+		name    string
+		project string
+		crm     *fakeCRM
+		crmErr  error
+		wantErr bool
+	}{
+		{
+			name:    "success-id",
+			project: "mlab-sandbox",
+			crm:     &fakeCRM{},
+		},
+		{
+			name:    "success-number",
+			project: "123456789012",
+			crm:     &fakeCRM{},
+		},
+		{
+			name:    "failure-client",
+			project: "mlab-sandbox",
+			crmErr:  fmt.Errorf("no credentials"),
+			wantErr: true,
+		},
+		{
+			name:    "failure-get",
+			project: "mlab-sandbox",
+			crm:     &fakeCRM{err: fmt.Errorf("forbidden")},
+			wantErr: true,
+		},
+		{
+			name:    "failure-empty",
+			project: "mlab-staging",
+			crm:     &fakeCRM{},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotCreds := fakeResourceManager(t, tt.crm, tt.crmErr)
+			got, err := Resolve(context.Background(), tt.project, creds)
+			if *gotCreds != creds {
+				t.Errorf("Resolve() used credentials %v, want %v", gotCreds, &creds)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Resolve() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got, want) {
+				t.Errorf("Resolve() = %#v, want %#v", got, want)
+			}
+		})
+	}
+}
+
+func TestProject_Wrap(t *testing.T) {
+	p := &Project{ID: "mlab-sandbox", Number: "123456789012"}
+	f := &fakeService{configs: []discovery.StaticConfig{
+		{Targets: []string{"a:9090"}, Labels: map[string]string{"service": "a"}},
+		{Targets: []string{"b:9090"}},
+	}}
+	s := p.Wrap(f)
+	got, err := s.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("Service.Discover() error = %v", err)
+	}
+	want := []discovery.StaticConfig{
+		{Targets: []string{"a:9090"}, Labels: map[string]string{"service": "a", LabelID: "mlab-sandbox", LabelNumber: "123456789012"}},
+		{Targets: []string{"b:9090"}, Labels: map[string]string{LabelID: "mlab-sandbox", LabelNumber: "123456789012"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Service.Discover() = %v, want %v", got, want)
+	}
+	if len(f.configs[0].Labels) != 1 {
+		t.Errorf("Service.Discover() changed the labels of the underlying service: %v", f.configs[0].Labels)
+	}
+	if s.Unwrap() != f {
+		t.Errorf("Service.Unwrap() = %v, want %v", s.Unwrap(), f)
+	}
+
+	f.err = fmt.Errorf("failed to discover")
+	if _, err := s.Discover(context.Background()); err == nil {
+		t.Errorf("Service.Discover() error = nil, want error")
+	}
+}
+
+func TestNewResourceManager(t *testing.T) {
+	orig := newCRMClient
+	defer func() { newCRMClient = orig }()
+	if _, err := newResourceManager(context.Background(), credentials.Config{}); err != nil {
+		t.Errorf("newResourceManager() error = %v", err)
+	}
+	newCRMClient = func(client *http.Client) (*cloudresourcemanager.Service, error) {
+		return nil, fmt.Errorf("failed to create client")
+	}
+	if _, err := newResourceManager(context.Background(), credentials.Config{}); err == nil {
+		t.Errorf("newResourceManager() error = nil, want error")
+	}
+}
+
+func TestResourceManagerImpl_ProjectGet(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/projects/123456789012" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"projectId": "mlab-sandbox", "projectNumber": "123456789012"}`)
+	}))
+	defer srv.Close()
+
+	service, err := cloudresourcemanager.NewService(context.Background(),
+		option.WithHTTPClient(srv.Client()), option.WithEndpoint(srv.URL))
+	if err != nil {
+		t.Fatalf("NewService() error = %v", err)
+	}
+	crm := iface.NewResourceManager(service)
+	got, err := crm.ProjectGet(context.Background(), "123456789012")
+	if err != nil || got.ProjectId != "mlab-sandbox" || got.ProjectNumber != 123456789012 {
+		t.Errorf("ResourceManagerImpl.ProjectGet() = %v, %v, want mlab-sandbox 123456789012", got, err)
+	}
+	if _, err := crm.ProjectGet(context.Background(), "mlab-sandbox"); err == nil {
+		t.Errorf("ResourceManagerImpl.ProjectGet() error = nil, want error")
+	}
+}
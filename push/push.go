@@ -0,0 +1,201 @@
+// Package push implements service discovery for targets pushed over HTTP by
+// external systems, e.g. deployment tooling that knows targets at deploy time
+// and should not need to host its own files for the web source.
+//
+// Clients push a JSON formatted Prometheus static_config to a named source:
+//
+//	curl -X POST -H "Authorization: Bearer $TOKEN" --data-binary @targets.json \
+//	    "http://localhost:9373/api/v1/push/<source>?client=<client>"
+//
+// Every push replaces the previous push from the same client to the same source,
+// and expires after the TTL of the Receiver unless pushed again. A DELETE
+// request removes the push of a client immediately. The targets of all
+// unexpired pushes to a source are merged by Discover.
+package push
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/metrics"
+)
+
+// Prefix is the URL path prefix handled by the Receiver.
+const Prefix = "/api/v1/push/"
+
+// maxBodySize limits the size of every push.
+const maxBodySize = 10 << 20
+
+// Enable unit testing of expiration.
+var timeNow = time.Now
+
+var (
+	// requestTotal counts push requests, labeled by source and status.
+	//
+	// Provides metrics:
+	//   gcp_push_requests_total{source="deploy", status="success"}
+	// Example usage:
+	//   requestTotal.WithLabelValues("deploy", "success").Inc()
+	requestTotal = metrics.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gcp_push_requests_total",
+			Help: "Number of push requests received.",
+		},
+		[]string{"source", "status"},
+	)
+)
+
+// Receiver is an http.Handler that accepts pushed targets for named sources.
+type Receiver struct {
+	// token authenticates requests as a bearer token.
+	token string
+	// ttl is the lifetime of every push.
+	ttl time.Duration
+
+	mu      sync.Mutex
+	sources map[string]*Source
+}
+
+// NewReceiver creates a new Receiver that requires the given bearer token
+// for every request. Pushes expire after ttl. An empty token rejects all
+// requests.
+func NewReceiver(token string, ttl time.Duration) *Receiver {
+	return &Receiver{token: token, ttl: ttl, sources: map[string]*Source{}}
+}
+
+// Source returns the named source, creating it if necessary. Only sources
+// created by Source accept pushes.
+func (r *Receiver) Source(name string) *Source {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.sources[name]
+	if !ok {
+		s = &Source{name: name, ttl: r.ttl, pushes: map[string]pushed{}}
+		r.sources[name] = s
+	}
+	return s
+}
+
+// ServeHTTP accepts POST requests that replace, and DELETE requests that
+// remove, the targets pushed by a client to a source.
+func (r *Receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(req.URL.Path, Prefix)
+	client := req.URL.Query().Get("client")
+	r.mu.Lock()
+	s, ok := r.sources[name]
+	r.mu.Unlock()
+	if !ok {
+		// Avoid labeling metrics with arbitrary names.
+		name = "unknown"
+	}
+	if !r.authorized(req) {
+		requestTotal.WithLabelValues(name, "error-auth").Inc()
+		http.Error(w, "Error: unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !ok {
+		requestTotal.WithLabelValues(name, "error-source").Inc()
+		http.Error(w, "Error: unknown source", http.StatusNotFound)
+		return
+	}
+	switch req.Method {
+	case http.MethodPost:
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxBodySize))
+		if err != nil {
+			requestTotal.WithLabelValues(name, "error-read").Inc()
+			http.Error(w, "Error: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		var configs []discovery.StaticConfig
+		err = json.Unmarshal(data, &configs)
+		if err != nil {
+			requestTotal.WithLabelValues(name, "error-parse").Inc()
+			http.Error(w, "Error: invalid targets: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.push(client, configs)
+	case http.MethodDelete:
+		s.remove(client)
+	default:
+		requestTotal.WithLabelValues(name, "error-method").Inc()
+		http.Error(w, "Error: unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	requestTotal.WithLabelValues(name, "success").Inc()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authorized returns true when the request has the Receiver bearer token.
+func (r *Receiver) authorized(req *http.Request) bool {
+	if r.token == "" {
+		return false
+	}
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	given := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(r.token)) == 1
+}
+
+// pushed saves the targets pushed by one client.
+type pushed struct {
+	configs []discovery.StaticConfig
+	expires time.Time
+}
+
+// Source merges the unexpired targets pushed by all clients. Source
+// implements the discovery.Service interface.
+type Source struct {
+	name string
+	ttl  time.Duration
+
+	mu     sync.Mutex
+	pushes map[string]pushed
+}
+
+func (s *Source) push(client string, configs []discovery.StaticConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pushes[client] = pushed{configs: configs, expires: timeNow().Add(s.ttl)}
+}
+
+func (s *Source) remove(client string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pushes, client)
+}
+
+// Discover returns the targets of every unexpired push, ordered by client.
+// Expired pushes are discarded.
+func (s *Source) Discover(ctx context.Context) ([]discovery.StaticConfig, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clients := []string{}
+	for client, p := range s.pushes {
+		if timeNow().After(p.expires) {
+			delete(s.pushes, client)
+			continue
+		}
+		clients = append(clients, client)
+	}
+	sort.Strings(clients)
+	configs := []discovery.StaticConfig{}
+	for _, client := range clients {
+		for _, config := range s.pushes[client].configs {
+			discovery.RecordOrigin(ctx, config, map[string]string{"source": s.name, "client": client})
+			configs = append(configs, config)
+		}
+	}
+	return configs, nil
+}
@@ -0,0 +1,129 @@
+package push
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/prometheusx/promtest"
+
+	"github.com/m-lab/gcp-service-discovery/discovery"
+)
+
+func TestReceiver_ServeHTTP(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		token    string
+		body     string
+		wantCode int
+	}{
+		{
+			name:     "success-post",
+			method:   http.MethodPost,
+			path:     Prefix + "deploy?client=a",
+			token:    "secret",
+			body:     `[{"targets": ["a:9090"]}]`,
+			wantCode: http.StatusNoContent,
+		},
+		{
+			name:     "success-delete",
+			method:   http.MethodDelete,
+			path:     Prefix + "deploy?client=a",
+			token:    "secret",
+			wantCode: http.StatusNoContent,
+		},
+		{
+			name:     "error-bad-token",
+			method:   http.MethodPost,
+			path:     Prefix + "deploy?client=a",
+			token:    "wrong",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "error-unknown-source",
+			method:   http.MethodPost,
+			path:     Prefix + "other",
+			token:    "secret",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "error-invalid-json",
+			method:   http.MethodPost,
+			path:     Prefix + "deploy",
+			token:    "secret",
+			body:     "not json",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "error-method",
+			method:   http.MethodGet,
+			path:     Prefix + "deploy",
+			token:    "secret",
+			wantCode: http.StatusMethodNotAllowed,
+		},
+	}
+	r := NewReceiver("secret", time.Minute)
+	r.Source("deploy")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			rw := httptest.NewRecorder()
+			r.ServeHTTP(rw, req)
+			if rw.Code != tt.wantCode {
+				t.Errorf("Receiver.ServeHTTP() code = %d, want %d", rw.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestReceiver_ServeHTTPEmptyToken(t *testing.T) {
+	r := NewReceiver("", time.Minute)
+	r.Source("deploy")
+	req := httptest.NewRequest(http.MethodPost, Prefix+"deploy", strings.NewReader("[]"))
+	req.Header.Set("Authorization", "Bearer ")
+	rw := httptest.NewRecorder()
+	r.ServeHTTP(rw, req)
+	if rw.Code != http.StatusUnauthorized {
+		t.Errorf("Receiver.ServeHTTP() code = %d, want %d", rw.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestSource_Discover(t *testing.T) {
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	r := NewReceiver("secret", time.Minute)
+	s := r.Source("deploy")
+	s.push("b", []discovery.StaticConfig{{Targets: []string{"b:9090"}}})
+	now = now.Add(30 * time.Second)
+	s.push("a", []discovery.StaticConfig{{Targets: []string{"a:9090"}}})
+
+	got, err := s.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("Source.Discover() error = %v", err)
+	}
+	want := []discovery.StaticConfig{{Targets: []string{"a:9090"}}, {Targets: []string{"b:9090"}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Source.Discover() = %v, want %v", got, want)
+	}
+
+	// The push from b expires first.
+	now = now.Add(45 * time.Second)
+	got, _ = s.Discover(context.Background())
+	if !reflect.DeepEqual(got, want[:1]) {
+		t.Errorf("Source.Discover() = %v, want %v", got, want[:1])
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	requestTotal.WithLabelValues("x", "x")
+	promtest.LintMetrics(t)
+}
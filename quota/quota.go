@@ -0,0 +1,104 @@
+// Package quota exports GCP API rate limit and quota information as metrics, so
+// operators may alert before discovery fails due to quota exhaustion.
+//
+// Most GCP APIs do not report remaining quota on every response. When present,
+// the X-RateLimit-Limit and X-RateLimit-Remaining response headers are exported
+// as gauges. Every response rejected for exceeding a rate limit or quota is
+// counted regardless.
+package quota
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/api/googleapi"
+
+	"github.com/m-lab/gcp-service-discovery/metrics"
+)
+
+var (
+	// quotaLimit records the most recent rate limit reported by each API.
+	//
+	// Provides metrics:
+	//   gcp_api_quota_limit
+	// Usage example:
+	//   quotaLimit.WithLabelValues("appengine").Set(limit)
+	quotaLimit = metrics.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gcp_api_quota_limit",
+			Help: "Most recent rate limit reported by GCP API response headers.",
+		},
+		[]string{"api"},
+	)
+
+	// quotaRemaining records the most recent remaining quota reported by each API.
+	//
+	// Provides metrics:
+	//   gcp_api_quota_remaining
+	// Usage example:
+	//   quotaRemaining.WithLabelValues("appengine").Set(remaining)
+	quotaRemaining = metrics.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gcp_api_quota_remaining",
+			Help: "Most recent remaining quota reported by GCP API response headers.",
+		},
+		[]string{"api"},
+	)
+
+	// quotaExceeded counts API requests rejected for exceeding a rate limit
+	// or quota.
+	//
+	// Provides metrics:
+	//   gcp_api_quota_exceeded_total
+	// Usage example:
+	//   quotaExceeded.WithLabelValues("appengine").Inc()
+	quotaExceeded = metrics.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gcp_api_quota_exceeded_total",
+			Help: "Number of GCP API requests rejected for exceeding a rate limit or quota.",
+		},
+		[]string{"api"},
+	)
+)
+
+// exceededReasons are googleapi.ErrorItem reasons that indicate a rate limit
+// or quota was exceeded.
+var exceededReasons = map[string]bool{
+	"rateLimitExceeded":     true,
+	"userRateLimitExceeded": true,
+	"quotaExceeded":         true,
+	"dailyLimitExceeded":    true,
+}
+
+// Observe exports the rate limit headers in h, if any, for the named api.
+func Observe(api string, h http.Header) {
+	if v, err := strconv.ParseFloat(h.Get("X-RateLimit-Limit"), 64); err == nil {
+		quotaLimit.WithLabelValues(api).Set(v)
+	}
+	if v, err := strconv.ParseFloat(h.Get("X-RateLimit-Remaining"), 64); err == nil {
+		quotaRemaining.WithLabelValues(api).Set(v)
+	}
+}
+
+// ObserveError counts err if it reports that the named api rejected a request
+// for exceeding a rate limit or quota. Rate limit headers included with the
+// error are also exported.
+func ObserveError(api string, err error) {
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) {
+		return
+	}
+	Observe(api, gerr.Header)
+	if gerr.Code == http.StatusTooManyRequests {
+		quotaExceeded.WithLabelValues(api).Inc()
+		return
+	}
+	for _, item := range gerr.Errors {
+		if exceededReasons[item.Reason] {
+			quotaExceeded.WithLabelValues(api).Inc()
+			return
+		}
+	}
+}
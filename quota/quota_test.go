@@ -0,0 +1,77 @@
+package quota
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/m-lab/go/prometheusx/promtest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/api/googleapi"
+)
+
+func TestObserve(t *testing.T) {
+	h := http.Header{}
+	h.Set("X-RateLimit-Limit", "100")
+	h.Set("X-RateLimit-Remaining", "42")
+	Observe("observe", h)
+	if v := testutil.ToFloat64(quotaLimit.WithLabelValues("observe")); v != 100 {
+		t.Errorf("Observe() limit = %v, want 100", v)
+	}
+	if v := testutil.ToFloat64(quotaRemaining.WithLabelValues("observe")); v != 42 {
+		t.Errorf("Observe() remaining = %v, want 42", v)
+	}
+
+	// Responses without headers must not reset the previous values.
+	Observe("observe", http.Header{})
+	if v := testutil.ToFloat64(quotaRemaining.WithLabelValues("observe")); v != 42 {
+		t.Errorf("Observe() remaining = %v, want 42", v)
+	}
+}
+
+func TestObserveError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want float64
+	}{
+		{
+			name: "too-many-requests",
+			err:  &googleapi.Error{Code: http.StatusTooManyRequests},
+			want: 1,
+		},
+		{
+			name: "quota-exceeded-reason",
+			err: fmt.Errorf("wrapped: %w", &googleapi.Error{
+				Code:   http.StatusForbidden,
+				Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}},
+			}),
+			want: 1,
+		},
+		{
+			name: "permission-denied",
+			err:  &googleapi.Error{Code: http.StatusForbidden},
+			want: 0,
+		},
+		{
+			name: "other-error",
+			err:  fmt.Errorf("fake error"),
+			want: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ObserveError(tt.name, tt.err)
+			if v := testutil.ToFloat64(quotaExceeded.WithLabelValues(tt.name)); v != tt.want {
+				t.Errorf("ObserveError() = %v, want %v", v, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	quotaLimit.WithLabelValues("x")
+	quotaRemaining.WithLabelValues("x")
+	quotaExceeded.WithLabelValues("x")
+	promtest.LintMetrics(t)
+}
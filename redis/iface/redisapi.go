@@ -0,0 +1,50 @@
+// Package iface defines an interface for accessing the Memorystore for Redis
+// API. This is helpful for creating testable packages.
+package iface
+
+import (
+	"context"
+	"net/http"
+
+	"google.golang.org/api/googleapi"
+	redis "google.golang.org/api/redis/v1"
+
+	"github.com/m-lab/gcp-service-discovery/internal/apicall"
+)
+
+// api names the Memorystore for Redis API in quota metrics.
+const api = "redis"
+
+// instanceListFields limits instance list responses to the fields used by the
+// redis logic.
+const instanceListFields = googleapi.Field("nextPageToken,unreachable,instances(name,host,port,tier,redisVersion,locationId,currentLocationId,state,labels,transitEncryptionMode)")
+
+// Redis defines the interface used by the redis logic.
+type Redis interface {
+	InstancePages(ctx context.Context, f func(list *redis.ListInstancesResponse) error) error
+}
+
+// RedisImpl implements the Redis interface.
+type RedisImpl struct {
+	project string
+	service *redis.Service
+}
+
+// NewRedis creates a new Redis for the given project.
+func NewRedis(project string, service *redis.Service) *RedisImpl {
+	return &RedisImpl{project: project, service: service}
+}
+
+// InstancePages lists the instances of every region and calls the given
+// function for each "page" of results.
+func (r *RedisImpl) InstancePages(ctx context.Context, f func(list *redis.ListInstancesResponse) error) error {
+	parent := "projects/" + r.project + "/locations/-"
+	return apicall.Pages(ctx, api,
+		func(ctx context.Context, token string) (*redis.ListInstancesResponse, error) {
+			return r.service.Projects.Locations.Instances.List(parent).Fields(instanceListFields).PageToken(token).Context(ctx).Do()
+		},
+		func(list *redis.ListInstancesResponse) (http.Header, string) {
+			return list.Header, list.NextPageToken
+		},
+		f)
+}
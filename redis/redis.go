@@ -0,0 +1,204 @@
+// Package redis implements service discovery for the Memorystore for Redis
+// instances of a project. Every instance is returned as a host:port target,
+// for scraping with the redis_exporter.
+package redis
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	redis "google.golang.org/api/redis/v1"
+
+	"github.com/m-lab/gcp-service-discovery/apilimit"
+	"github.com/m-lab/gcp-service-discovery/credentials"
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/internal/apicall"
+	"github.com/m-lab/gcp-service-discovery/metrics"
+	"github.com/m-lab/gcp-service-discovery/redis/iface"
+)
+
+const (
+	redisLabel    = "__redis_"
+	labelProject  = redisLabel + "project"
+	labelInstance = redisLabel + "instance"
+	labelRegion   = redisLabel + "region"
+	labelZone     = redisLabel + "zone"
+	labelTier     = redisLabel + "tier"
+	labelVersion  = redisLabel + "version"
+	labelTLS      = redisLabel + "tls"
+	labelPrefix   = redisLabel + "label_"
+)
+
+// unavailableStates are the instance states in which an instance does not
+// serve clients.
+var unavailableStates = map[string]bool{"CREATING": true, "DELETING": true}
+
+var (
+	// newRedisClient allocates a new Memorystore for Redis client. The
+	// indirection facilitates testing.
+	newRedisClient = redis.New
+)
+
+var (
+	// InstanceCount is the number of Redis instances by state.
+	//
+	// Provides metrics:
+	//   gcp_redis_instances{state="READY"}
+	// Example usage:
+	//   InstanceCount.WithLabelValues("READY").Set(count)
+	InstanceCount = metrics.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gcp_redis_instances",
+			Help: "Number of Memorystore for Redis instances by state.",
+		},
+		[]string{"state"},
+	)
+)
+
+// Service discovers the Redis instances of a project.
+type Service struct {
+	project string
+	api     iface.Redis
+
+	// connect creates api. It is called again to recreate the client after an
+	// authentication error.
+	connect func(ctx context.Context) error
+}
+
+// NewService returns a Service initialized with a Memorystore for Redis API
+// client authenticated by creds. The Service implements the discovery.Service
+// interface. NewService fails if the credentials are not found before ctx is
+// done.
+func NewService(ctx context.Context, project string, creds credentials.Config) (*Service, error) {
+	s := &Service{project: project}
+	s.connect = func(ctx context.Context) error {
+		client, err := creds.Client(ctx, redis.CloudPlatformScope)
+		if err != nil {
+			return fmt.Errorf("Error setting up API clients: %s", err)
+		}
+		r, err := newRedisClient(apilimit.Client(client))
+		if err != nil {
+			return fmt.Errorf("Error setting up Memorystore for Redis client: %s", err)
+		}
+		s.api = iface.NewRedis(project, r)
+		return nil
+	}
+	if err := s.connect(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Discover lists the Redis instances of every region, and returns a target for
+// the endpoint of every instance that serves clients. After an authentication
+// error, Discover recreates its client and tries once more.
+func (s *Service) Discover(ctx context.Context) ([]discovery.StaticConfig, error) {
+	var targets []discovery.StaticConfig
+	err := credentials.Retry(ctx, "redis", s.connect, func() error {
+		var err error
+		targets, err = s.discover(ctx)
+		return err
+	})
+	return targets, err
+}
+
+// discover lists every instance once.
+func (s *Service) discover(ctx context.Context) ([]discovery.StaticConfig, error) {
+	targets := []discovery.StaticConfig{}
+	states := map[string]int{}
+	err := s.api.InstancePages(ctx, func(list *redis.ListInstancesResponse) error {
+		if len(list.Unreachable) > 0 {
+			log.Printf("Redis instances of unreachable locations are missing: %s", strings.Join(list.Unreachable, ", "))
+		}
+		discovery.CountScanned(ctx, "instances", len(list.Instances))
+		for _, instance := range list.Instances {
+			states[instance.State]++
+			object := instance.LocationId + "/" + path.Base(instance.Name)
+			if unavailableStates[instance.State] {
+				discovery.Decide(ctx, object, false, "instance "+instance.State)
+				continue
+			}
+			if instance.Host == "" || instance.Port == 0 {
+				discovery.Decide(ctx, object, false, "no endpoint")
+				continue
+			}
+			config := s.getLabels(instance)
+			discovery.RecordOrigin(ctx, config, instance)
+			discovery.Decide(ctx, object, true, "instance "+instance.State)
+			targets = append(targets, config)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	InstanceCount.Reset()
+	for state, n := range states {
+		InstanceCount.WithLabelValues(state).Set(float64(n))
+	}
+	return targets, nil
+}
+
+// getLabels creates a target configuration for the endpoint of an instance.
+//
+// In serialized form, the label set look like:
+//
+//	{
+//	    "labels": {
+//	        "__redis_instance": "sessions",
+//	        "__redis_label_env": "prod",
+//	        "__redis_project": "mlab-sandbox",
+//	        "__redis_region": "us-central1",
+//	        "__redis_tier": "STANDARD_HA",
+//	        "__redis_tls": "false",
+//	        "__redis_version": "REDIS_6_X",
+//	        "__redis_zone": "us-central1-a"
+//	    },
+//	    "targets": [
+//	        "10.0.0.3:6379"
+//	    ]
+//	}
+func (s *Service) getLabels(instance *redis.Instance) discovery.StaticConfig {
+	// Instance names look like projects/p/locations/r/instances/i.
+	region := ""
+	if parts := strings.Split(instance.Name, "/"); len(parts) == 6 {
+		region = parts[3]
+	}
+	zone := instance.CurrentLocationId
+	if zone == "" {
+		zone = instance.LocationId
+	}
+	labels := map[string]string{
+		labelProject:  s.project,
+		labelInstance: path.Base(instance.Name),
+		labelRegion:   region,
+		labelZone:     zone,
+		labelTier:     instance.Tier,
+		labelVersion:  instance.RedisVersion,
+		labelTLS:      strconv.FormatBool(instance.TransitEncryptionMode == "SERVER_AUTHENTICATION"),
+	}
+	for k, v := range instance.Labels {
+		labels[labelPrefix+strings.ReplaceAll(k, "-", "_")] = v
+	}
+	return discovery.StaticConfig{
+		Targets: []string{instance.Host + ":" + strconv.FormatInt(instance.Port, 10)},
+		Labels:  labels,
+	}
+}
+
+// Check verifies access to the Memorystore for Redis API by reading the first
+// page of instances. Check implements the discovery.Checker interface.
+func (s *Service) Check(ctx context.Context) error {
+	err := apicall.FirstPage(ctx, s.api.InstancePages)
+	if err != nil {
+		return fmt.Errorf("cannot list Redis instances in project %q; "+
+			"verify the Memorystore for Redis API is enabled and the "+
+			"credentials have the Cloud Memorystore Redis Viewer role: %s", s.project, err)
+	}
+	return nil
+}
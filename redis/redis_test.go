@@ -0,0 +1,181 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/m-lab/go/prometheusx/promtest"
+	"google.golang.org/api/googleapi"
+	redis "google.golang.org/api/redis/v1"
+
+	"github.com/m-lab/gcp-service-discovery/credentials"
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/internal/schematest"
+)
+
+type fakeRedis struct {
+	list *redis.ListInstancesResponse
+	err  error
+}
+
+func (f *fakeRedis) InstancePages(ctx context.Context, fn func(list *redis.ListInstancesResponse) error) error {
+	if f.err != nil {
+		return f.err
+	}
+	return fn(f.list)
+}
+
+func newFakeInstances() *redis.ListInstancesResponse {
+	return &redis.ListInstancesResponse{
+		Instances: []*redis.Instance{
+			{
+				Name:                  "projects/mlab-sandbox/locations/us-central1/instances/sessions",
+				Host:                  "10.0.0.3",
+				Port:                  6379,
+				Tier:                  "STANDARD_HA",
+				RedisVersion:          "REDIS_6_X",
+				LocationId:            "us-central1-a",
+				CurrentLocationId:     "us-central1-b",
+				State:                 "READY",
+				Labels:                map[string]string{"team-name": "platform"},
+				TransitEncryptionMode: "SERVER_AUTHENTICATION",
+			},
+			{
+				Name:         "projects/mlab-sandbox/locations/us-east1/instances/cache",
+				Host:         "10.0.1.3",
+				Port:         6379,
+				Tier:         "BASIC",
+				RedisVersion: "REDIS_5_0",
+				LocationId:   "us-east1-b",
+				State:        "MAINTENANCE",
+			},
+			{
+				Name:       "projects/mlab-sandbox/locations/us-east1/instances/new",
+				LocationId: "us-east1-b",
+				State:      "CREATING",
+			},
+		},
+		Unreachable: []string{"europe-west1"},
+	}
+}
+
+func TestService_Discover(t *testing.T) {
+	tests := []struct {
+		name    string
+		api     *fakeRedis
+		want    []discovery.StaticConfig
+		wantErr bool
+	}{
+		{
+			name: "success",
+			api:  &fakeRedis{list: newFakeInstances()},
+			want: []discovery.StaticConfig{
+				{
+					Targets: []string{"10.0.0.3:6379"},
+					Labels: map[string]string{
+						"__redis_project":         "mlab-sandbox",
+						"__redis_instance":        "sessions",
+						"__redis_region":          "us-central1",
+						"__redis_zone":            "us-central1-b",
+						"__redis_tier":            "STANDARD_HA",
+						"__redis_version":         "REDIS_6_X",
+						"__redis_tls":             "true",
+						"__redis_label_team_name": "platform",
+					},
+				},
+				{
+					Targets: []string{"10.0.1.3:6379"},
+					Labels: map[string]string{
+						"__redis_project":  "mlab-sandbox",
+						"__redis_instance": "cache",
+						"__redis_region":   "us-east1",
+						"__redis_zone":     "us-east1-b",
+						"__redis_tier":     "BASIC",
+						"__redis_version":  "REDIS_5_0",
+						"__redis_tls":      "false",
+					},
+				},
+			},
+		},
+		{
+			name: "success-empty",
+			api:  &fakeRedis{list: &redis.ListInstancesResponse{}},
+			want: []discovery.StaticConfig{},
+		},
+		{
+			name:    "failure",
+			api:     &fakeRedis{err: fmt.Errorf("forbidden")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Service{project: "mlab-sandbox", api: tt.api}
+			got, err := s.Discover(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Service.Discover() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Service.Discover() = %v, want %v", got, tt.want)
+			}
+			if err != nil {
+				return
+			}
+			data, _ := json.Marshal(got)
+			if err := schematest.Validate([]byte(discovery.Schema), data); err != nil {
+				t.Errorf("Service.Discover() = %s, which does not match the schema: %v", data, err)
+			}
+		})
+	}
+}
+
+func TestService_DiscoverAuthRefresh(t *testing.T) {
+	s := &Service{project: "mlab-sandbox", api: &fakeRedis{err: &googleapi.Error{Code: http.StatusUnauthorized}}}
+	connects := 0
+	s.connect = func(ctx context.Context) error {
+		connects++
+		s.api = &fakeRedis{list: newFakeInstances()}
+		return nil
+	}
+	got, err := s.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("Service.Discover() error = %v", err)
+	}
+	if connects != 1 || len(got) != 2 {
+		t.Errorf("Service.Discover() connected %d times and found %d targets, want 1 and 2", connects, len(got))
+	}
+}
+
+func TestService_Check(t *testing.T) {
+	s := &Service{project: "mlab-sandbox", api: &fakeRedis{list: newFakeInstances()}}
+	if err := s.Check(context.Background()); err != nil {
+		t.Errorf("Service.Check() error = %v", err)
+	}
+	s.api = &fakeRedis{err: fmt.Errorf("forbidden")}
+	if err := s.Check(context.Background()); err == nil {
+		t.Errorf("Service.Check() error = nil, want error")
+	}
+}
+
+func TestNewService(t *testing.T) {
+	orig := newRedisClient
+	defer func() { newRedisClient = orig }()
+	if _, err := NewService(context.Background(), "mlab-sandbox", credentials.Config{}); err != nil {
+		t.Errorf("NewService() error = %v", err)
+	}
+	newRedisClient = func(client *http.Client) (*redis.Service, error) {
+		return nil, fmt.Errorf("failed to create client")
+	}
+	if _, err := NewService(context.Background(), "mlab-sandbox", credentials.Config{}); err == nil {
+		t.Errorf("NewService() error = nil, want error")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	InstanceCount.WithLabelValues("x")
+	promtest.LintMetrics(t)
+}
@@ -0,0 +1,81 @@
+package runner
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/sdnotify"
+)
+
+// outputs groups sources by output, so that sources sharing an output are
+// merged into one.
+type outputs struct {
+	names   []string
+	sources map[string][]discovery.MergedSource
+}
+
+// add adds a named source writing to output.
+func (o *outputs) add(name string, s discovery.Service, output string) {
+	if o.sources == nil {
+		o.sources = map[string][]discovery.MergedSource{}
+	}
+	if o.sources[output] == nil {
+		o.names = append(o.names, output)
+	}
+	o.sources[output] = append(o.sources[output], discovery.MergedSource{Name: name, Service: s})
+}
+
+// register registers every output with the manager, merging the sources of
+// outputs with more than one source using the given conflict policy. Targets
+// are published using a Writer when an output is a URL with a registered
+// writer scheme, and are written to the named file otherwise.
+func (o *outputs) register(manager *discovery.Manager, policy discovery.ConflictPolicy) error {
+	for _, output := range o.names {
+		sources := o.sources[output]
+		s := sources[0].Service
+		if len(sources) > 1 {
+			s = discovery.NewMerge(policy, sources...)
+		}
+		w, err := discovery.NewWriter(output)
+		if err != nil {
+			return fmt.Errorf("failed to create a writer for output %q: %w", output, err)
+		}
+		if w != nil {
+			manager.RegisterWriter(s, w)
+			continue
+		}
+		manager.Register(s, output)
+	}
+	return nil
+}
+
+// newSystemdNotifier returns a function for discovery.WithAfterPass that tells
+// systemd the service is ready after the first successful discovery pass, and
+// resets the systemd watchdog after every pass.
+func newSystemdNotifier(refresh time.Duration) func(bool) {
+	interval, err := sdnotify.WatchdogInterval()
+	if err != nil {
+		log.Printf("WARNING: ignoring systemd watchdog: %s", err)
+	}
+	if interval > 0 && interval <= refresh {
+		log.Printf("WARNING: systemd WatchdogSec (%s) should be longer than -refresh (%s)", interval, refresh)
+	}
+	ready := false
+	return func(ok bool) {
+		if ok && !ready {
+			_, err := sdnotify.Notify(sdnotify.Ready)
+			if err != nil {
+				log.Printf("Failed to notify systemd: %s", err)
+			}
+			ready = true
+		}
+		if interval > 0 {
+			_, err := sdnotify.Notify(sdnotify.Watchdog)
+			if err != nil {
+				log.Printf("Failed to notify systemd watchdog: %s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,1067 @@
+// Package runner runs service discovery with the same sources, processing, and
+// admin handlers as the gcp_service_discovery command, so other binaries can
+// embed discovery with their own flags or configuration, e.g.
+//
+//	cfg := runner.DefaultConfig()
+//	cfg.Project = "mlab-sandbox"
+//	cfg.AEFTarget = "/targets/aeflex.json"
+//	err := runner.Run(ctx, cfg)
+//
+// Settings that are global to the process, like the API request limits and
+// the connection settings of the transport package, are changed by Run.
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/m-lab/go/httpx"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/m-lab/gcp-service-discovery/admin"
+	"github.com/m-lab/gcp-service-discovery/aeflex"
+	"github.com/m-lab/gcp-service-discovery/apilimit"
+	"github.com/m-lab/gcp-service-discovery/apis"
+	"github.com/m-lab/gcp-service-discovery/auditlog"
+	"github.com/m-lab/gcp-service-discovery/batch"
+	"github.com/m-lab/gcp-service-discovery/clouddns"
+	"github.com/m-lab/gcp-service-discovery/consul"
+	"github.com/m-lab/gcp-service-discovery/crd"
+	"github.com/m-lab/gcp-service-discovery/credentials"
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/functions"
+	"github.com/m-lab/gcp-service-discovery/gce"
+	"github.com/m-lab/gcp-service-discovery/gke"
+	"github.com/m-lab/gcp-service-discovery/internal/apicall"
+	"github.com/m-lab/gcp-service-discovery/jsonl"
+	"github.com/m-lab/gcp-service-discovery/labelcrypt"
+	"github.com/m-lab/gcp-service-discovery/labeljoin"
+	"github.com/m-lab/gcp-service-discovery/metrics"
+	"github.com/m-lab/gcp-service-discovery/mirror"
+	"github.com/m-lab/gcp-service-discovery/neg"
+	"github.com/m-lab/gcp-service-discovery/plugin/exec"
+	"github.com/m-lab/gcp-service-discovery/project"
+	"github.com/m-lab/gcp-service-discovery/push"
+	"github.com/m-lab/gcp-service-discovery/redis"
+	"github.com/m-lab/gcp-service-discovery/sdnotify"
+	"github.com/m-lab/gcp-service-discovery/soak"
+	"github.com/m-lab/gcp-service-discovery/tpu"
+	"github.com/m-lab/gcp-service-discovery/transport"
+	"github.com/m-lab/gcp-service-discovery/vertex"
+	"github.com/m-lab/gcp-service-discovery/web"
+	"github.com/m-lab/gcp-service-discovery/zookeeper"
+)
+
+func init() {
+	// Outputs that are URLs with these schemes are published by a Writer.
+	discovery.RegisterWriterScheme(zookeeper.Scheme, zookeeper.New)
+	discovery.RegisterWriterScheme(consul.Scheme, consul.New)
+	discovery.RegisterWriterScheme(clouddns.Scheme, clouddns.New)
+	discovery.RegisterWriterScheme(jsonl.Scheme, jsonl.New)
+}
+
+// Config describes the sources, processing, and outputs of discovery. Every
+// field corresponds to a flag of the gcp_service_discovery command, which
+// documents it in more detail. Use DefaultConfig for the defaults of the
+// command.
+type Config struct {
+	// Project is the GCP project of the aeflex, gke, neg, apis, gce,
+	// functions, batch, tpu, redis, and vertex sources, and of GCE
+	// enrichment. Project may be a project ID or a project number, which is
+	// resolved to the ID with the Resource Manager API.
+	Project string
+
+	// ProjectLabels labels the targets of the sources of Project with the
+	// project ID and number, even if Project is a project ID. Targets are
+	// always labeled when Project is a project number.
+	ProjectLabels bool
+
+	// App Engine Flex sources.
+	AEFTarget            string
+	AEFApps              []string
+	AEFCredentials       credentials.Config
+	AEFAuditSubscription string
+	AEFInstanceKey       aeflex.InstanceKey
+	AEFCollapseIPs       bool
+
+	// GKE sources.
+	GKETarget         string
+	GKECredentials    credentials.Config
+	GKEZoneCacheTTL   time.Duration
+	GKEAggregatedList bool
+	GKEAPIServerProxy bool
+	GKEPods           bool
+	GKENodes          bool
+	GKENodePort       int
+	GKEMCS            bool
+	GKEMCSDedup       bool
+	GKEControlPlane   gke.ControlPlane
+	GKEEndpointLabels bool
+	GKEMaxConcurrency int
+	GKEKubeTimeout    time.Duration
+	GKEAnnotations    gke.Annotations
+
+	// Network endpoint group sources.
+	NEGTarget      string
+	NEGCredentials credentials.Config
+
+	// API Gateway and Cloud Endpoints sources.
+	APITarget      string
+	APICredentials credentials.Config
+
+	// GCE instance sources.
+	GCETarget      string
+	GCECredentials credentials.Config
+	GCESelector    gce.Selector
+	GCEPort        int
+
+	// Cloud Functions sources.
+	FunctionsTarget      string
+	FunctionsCredentials credentials.Config
+
+	// Batch job sources.
+	BatchTarget      string
+	BatchCredentials credentials.Config
+	BatchPort        int
+
+	// Cloud TPU VM sources.
+	TPUTarget      string
+	TPUCredentials credentials.Config
+	TPUPort        int
+
+	// Memorystore for Redis sources.
+	RedisTarget      string
+	RedisCredentials credentials.Config
+
+	// Vertex AI endpoint and Workbench instance sources.
+	VertexTarget      string
+	VertexCredentials credentials.Config
+
+	// ReadyLabel adds discovery.LabelReady to aeflex and gke targets.
+	ReadyLabel bool
+
+	// HTTP(S) sources. Every source is written to the target with the same
+	// index. HTTPResolve replaces target hostnames with their addresses.
+	HTTPSources         []string
+	HTTPTargets         []string
+	HTTPPassthrough     bool
+	HTTPResolve         bool
+	HTTPResolveTTL      time.Duration
+	HTTPResolveMaxStale time.Duration
+
+	// Exec sources. Every source is a command with space separated arguments,
+	// written to the target with the same index.
+	ExecSources []string
+	ExecTargets []string
+	ExecEnv     []string
+	ExecTimeout time.Duration
+
+	// Push sources. Every source name is written to the target with the same
+	// index.
+	PushSources   []string
+	PushTargets   []string
+	PushTTL       time.Duration
+	PushTokenFile string
+
+	// Mirror is the URL of a primary instance whose outputs are replicated to
+	// MirrorDir, keeping the path of every output below MirrorDir.
+	Mirror    string
+	MirrorDir string
+
+	// DiscoverySource resources.
+	CRDOutputDir string
+	CRDNamespace string
+	Kubeconfig   string
+
+	// Processing of the targets of every source.
+	GCEEnrich            bool
+	GCEEnrichTTL         time.Duration
+	FirewallSourceRanges []string
+	KMSKey               string
+	KMSLabels            []string
+	LabelJoins           labeljoin.Specs
+	LabelJoinTTL         time.Duration
+
+	// Refresh is the time between discovery passes.
+	Refresh time.Duration
+
+	// MaxDiscovery is the maximum time allowed for the discovery of a source.
+	MaxDiscovery time.Duration
+
+	// HardDeadline is the maximum time to wait for the discovery of a source
+	// that ignores MaxDiscovery. When zero, MaxDiscovery plus
+	// discovery.DefaultDeadlineGrace is used.
+	HardDeadline time.Duration
+
+	// CostLimits stretch the time between discovery passes of sources with
+	// expensive passes.
+	CostLimits discovery.CostLimits
+
+	// SetupTimeout is the maximum time allowed to create the sources and
+	// processing steps at startup, and every source of a DiscoverySource,
+	// which includes finding their credentials.
+	SetupTimeout time.Duration
+
+	// Limits of concurrent discovery and API requests.
+	MaxParallelSources int
+	MaxAPIRequests     int
+	APIRate            float64
+	APIBurst           int
+	DialTimeout        time.Duration
+	KeepAlive          time.Duration
+
+	// Faults are injected into GCP API requests to test resilience. Never set
+	// Faults in production.
+	Faults apicall.Faults
+
+	// Outputs.
+	WriteMetadata      bool
+	WriteChecksum      bool
+	WriteLifecycle     bool
+	Compact            bool
+	Indent             int
+	TempDir            string
+	AnomalyThreshold   float64
+	AnomalyWebhook     string
+	AllowEmpty         bool
+	AllowEmptyTargets  []string
+	BestEffortTargets  []string
+	OutputOrder        discovery.OutputOrder
+	MaxTargets         int
+	MaxOutputBytes     int64
+	Atomic             bool
+	DurationBuckets    discovery.DurationBuckets
+	FleetLabels        discovery.FleetLabels
+	ScrapeHints        discovery.ScrapeHints
+	Owners             discovery.Owners
+	AddressRewrites    discovery.AddressRewrites
+	MaintenanceWindows discovery.MaintenanceWindows
+	Paused             []string
+	Profile            discovery.Profile
+	LabelStyle         discovery.LabelStyle
+	LabelConflicts     discovery.ConflictPolicy
+	LabelSanitize      discovery.SanitizePolicy
+	DecisionLog        string
+	LogUnchanged       bool
+
+	// TimelineSize is the number of changes of the targets of every output
+	// served by /api/v1/diff, and TimelineDir saves them across restarts.
+	TimelineSize int
+	TimelineDir  string
+
+	// Restore is a snapshot loaded before the first discovery pass.
+	Restore string
+
+	// SelfTest verifies that every source can read from its API before the
+	// first discovery pass.
+	SelfTest bool
+
+	// Verify checks the checksums of all target files, writes the result of
+	// every file to Stdout, and returns without discovery.
+	Verify bool
+
+	// DryRun, when positive, runs discovery once without updating targets,
+	// writes the labels of up to DryRun targets per source to Stdout as JSON,
+	// and returns.
+	DryRun int
+
+	// Soak, when positive, runs discovery for the given time and returns an
+	// error if resource usage grew without bound.
+	Soak time.Duration
+
+	// ListenAddress is the address of the metrics and admin handlers. When
+	// empty, no handlers are served.
+	ListenAddress string
+
+	// EnableLifecycle serves the /-/reload, /-/pause, and /-/resume handlers
+	// on ListenAddress. Like Prometheus, they are off by default, since any
+	// client that can scrape metrics could otherwise use them.
+	EnableLifecycle bool
+
+	// Signals stops Run on interrupt and termination signals, and starts a
+	// discovery pass on reload signals.
+	Signals bool
+
+	// Systemd reports readiness and liveness to systemd.
+	Systemd bool
+
+	// Stdout receives the results of Verify and DryRun. When nil, os.Stdout
+	// is used.
+	Stdout io.Writer
+
+	// Registerer registers all metrics instead of the default registerer. If
+	// it is also a prometheus.Gatherer, like a prometheus.Registry, the
+	// metrics handler serves its metrics. Metrics are shared by the whole
+	// process, so every Run of a process must use the same Registerer.
+	Registerer prometheus.Registerer
+}
+
+// DefaultConfig returns a Config with the defaults of the gcp_service_discovery
+// command, without any sources.
+func DefaultConfig() Config {
+	return Config{
+		AEFInstanceKey:      aeflex.KeyID,
+		GKEZoneCacheTTL:     gke.DefaultZoneCacheTTL,
+		GKEMaxConcurrency:   1,
+		GKEKubeTimeout:      gke.DefaultKubeTimeout,
+		ExecTimeout:         time.Minute,
+		PushTTL:             10 * time.Minute,
+		GCEEnrichTTL:        gce.DefaultTTL,
+		HTTPResolveTTL:      web.DefaultResolveTTL,
+		HTTPResolveMaxStale: web.DefaultMaxStale,
+		GCESelector:         gce.DefaultSelector,
+		GCEPort:             gce.DefaultPort,
+		GKENodePort:         gke.DefaultNodePort,
+		BatchPort:           batch.DefaultPort,
+		TPUPort:             tpu.DefaultPort,
+		LabelJoinTTL:        labeljoin.DefaultTTL,
+		Refresh:             time.Minute,
+		MaxDiscovery:        10 * time.Minute,
+		SetupTimeout:        time.Minute,
+		MaxParallelSources:  1,
+		APIBurst:            10,
+		DialTimeout:         transport.DefaultDialTimeout,
+		KeepAlive:           transport.DefaultKeepAlive,
+		Indent:              4,
+		Profile:             discovery.ProfilePrometheus,
+		LabelStyle:          discovery.LabelStyleLegacy,
+		LabelConflicts:      discovery.ConflictError,
+		LabelSanitize:       discovery.SanitizeReplace,
+		ListenAddress:       ":9373",
+	}
+}
+
+// Validate returns an error if the configuration is incomplete or inconsistent.
+func (c *Config) Validate() error {
+	if len(c.HTTPSources) != len(c.HTTPTargets) {
+		return errors.New("http sources and targets must match")
+	}
+	if len(c.ExecSources) != len(c.ExecTargets) {
+		return errors.New("exec sources and targets must match")
+	}
+	for _, s := range c.ExecSources {
+		if len(strings.Fields(s)) == 0 {
+			return errors.New("empty exec source")
+		}
+	}
+	if len(c.PushSources) != len(c.PushTargets) {
+		return errors.New("push sources and targets must match")
+	}
+	if len(c.PushSources) > 0 && c.PushTokenFile == "" {
+		return errors.New("specify a push token file for push sources")
+	}
+	if (c.AEFTarget != "" && c.Project == "" && len(c.AEFApps) == 0) ||
+		(c.GKETarget != "" && c.Project == "") || (c.NEGTarget != "" && c.Project == "") ||
+		(c.APITarget != "" && c.Project == "") || (c.GCETarget != "" && c.Project == "") ||
+		(c.FunctionsTarget != "" && c.Project == "") || (c.BatchTarget != "" && c.Project == "") ||
+		(c.TPUTarget != "" && c.Project == "") || (c.RedisTarget != "" && c.Project == "") ||
+		(c.VertexTarget != "" && c.Project == "") {
+		return errors.New("specify a GCP project")
+	}
+	// Without a key, the labels would be written in plaintext.
+	if len(c.KMSLabels) > 0 && c.KMSKey == "" {
+		return errors.New("specify a KMS key to encrypt KMS labels")
+	}
+	if c.KMSKey != "" && len(c.KMSLabels) == 0 {
+		return errors.New("specify at least one KMS label to encrypt with the KMS key")
+	}
+	if err := c.OutputOrder.Validate(); err != nil {
+		return err
+	}
+	if c.Mirror != "" && c.MirrorDir == "" {
+		return errors.New("specify a mirror directory")
+	}
+	if !c.Verify && len(c.outputs()) == 0 && c.Mirror == "" && c.CRDOutputDir == "" {
+		return errors.New("specify at least one output target file")
+	}
+	return nil
+}
+
+// outputs returns the target files of all sources configured directly.
+func (c *Config) outputs() []string {
+	outputs := []string{}
+	for _, o := range [][]string{
+		{c.AEFTarget, c.GKETarget, c.NEGTarget, c.APITarget, c.GCETarget, c.FunctionsTarget, c.BatchTarget, c.TPUTarget, c.RedisTarget, c.VertexTarget}, c.HTTPTargets, c.ExecTargets, c.PushTargets,
+	} {
+		for _, output := range o {
+			if output != "" {
+				outputs = append(outputs, output)
+			}
+		}
+	}
+	return outputs
+}
+
+// projectCredentials returns the credentials of the first source of Project,
+// which are used to resolve it. Sources of one project usually share
+// credentials, and default credentials may not have access to it.
+func (c *Config) projectCredentials() credentials.Config {
+	for _, s := range []struct {
+		target string
+		creds  credentials.Config
+	}{
+		{c.AEFTarget, c.AEFCredentials}, {c.GKETarget, c.GKECredentials}, {c.NEGTarget, c.NEGCredentials},
+		{c.APITarget, c.APICredentials}, {c.GCETarget, c.GCECredentials}, {c.FunctionsTarget, c.FunctionsCredentials},
+		{c.BatchTarget, c.BatchCredentials}, {c.TPUTarget, c.TPUCredentials}, {c.RedisTarget, c.RedisCredentials},
+		{c.VertexTarget, c.VertexCredentials},
+	} {
+		// Applications of AEFApps may be in other projects.
+		if s.target != "" && (s.target != c.AEFTarget || len(c.AEFApps) == 0) {
+			return s.creds
+		}
+	}
+	return credentials.Config{}
+}
+
+// stdout returns the writer for results.
+func (c *Config) stdout() io.Writer {
+	if c.Stdout == nil {
+		return os.Stdout
+	}
+	return c.Stdout
+}
+
+// Run runs discovery as configured by cfg until ctx is canceled, and returns
+// nil. Run returns an error if the configuration is invalid, or if any source,
+// processing, or handler cannot be created. With cfg.Verify, cfg.DryRun, or
+// cfg.Soak, Run returns after the requested check.
+func Run(ctx context.Context, cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if cfg.Verify {
+		return verifyOutputs(&cfg)
+	}
+	apilimit.SetMaxInFlight(cfg.MaxAPIRequests)
+	apicall.SetRateLimit(cfg.APIRate, cfg.APIBurst)
+	if cfg.Faults.Enabled() {
+		log.Printf("Warning: injecting faults into GCP API requests: %s", cfg.Faults)
+	}
+	apicall.SetFaults(cfg.Faults)
+	transport.Configure(cfg.DialTimeout, cfg.KeepAlive)
+	indent := strings.Repeat(" ", cfg.Indent)
+	if cfg.Compact || cfg.Indent <= 0 {
+		indent = ""
+	}
+	// Report readiness and liveness when running under systemd, and sample
+	// resource usage to detect leaks.
+	notify := func(bool) {}
+	if cfg.Systemd {
+		notify = newSystemdNotifier(cfg.Refresh)
+		defer sdnotify.Notify(sdnotify.Stopping)
+	}
+	monitor := &soak.Monitor{}
+	opts := []discovery.Option{
+		discovery.WithTimeout(cfg.MaxDiscovery),
+		discovery.WithHardDeadline(cfg.HardDeadline),
+		discovery.WithCostLimits(cfg.CostLimits),
+		discovery.WithMetadata(cfg.WriteMetadata),
+		discovery.WithChecksum(cfg.WriteChecksum),
+		discovery.WithLifecycle(cfg.WriteLifecycle),
+		discovery.WithLogUnchanged(cfg.LogUnchanged),
+		discovery.WithIndent(indent),
+		discovery.WithMaxParallel(cfg.MaxParallelSources),
+		discovery.WithTempDir(cfg.TempDir),
+		discovery.WithAtomic(cfg.Atomic),
+		discovery.WithDurationBuckets(cfg.DurationBuckets),
+		discovery.WithFleetLabels(cfg.FleetLabels),
+		discovery.WithScrapeHints(cfg.ScrapeHints),
+		discovery.WithOwners(cfg.Owners),
+		discovery.WithAddressRewrites(cfg.AddressRewrites),
+		discovery.WithMaintenanceWindows(cfg.MaintenanceWindows),
+		discovery.WithProfile(cfg.Profile),
+		discovery.WithLabelStyle(cfg.LabelStyle),
+		discovery.WithSanitize(cfg.LabelSanitize),
+		discovery.WithAnomalyThreshold(cfg.AnomalyThreshold),
+		discovery.WithAnomalyWebhook(cfg.AnomalyWebhook),
+		discovery.WithAllowEmpty(cfg.AllowEmpty),
+		discovery.WithAllowEmptyOutputs(cfg.AllowEmptyTargets),
+		discovery.WithBestEffort(cfg.BestEffortTargets),
+		discovery.WithOutputOrder(cfg.OutputOrder),
+		discovery.WithMaxTargets(cfg.MaxTargets),
+		discovery.WithMaxOutputSize(cfg.MaxOutputBytes),
+		discovery.WithTimeline(cfg.TimelineSize, cfg.TimelineDir),
+		discovery.WithRegisterer(cfg.Registerer),
+		discovery.WithAfterPass(func(ok bool) {
+			notify(ok)
+			monitor.Observe(ok)
+		}),
+	}
+	if cfg.DecisionLog != "" {
+		l, err := discovery.NewDecisionLog(cfg.DecisionLog)
+		if err != nil {
+			return fmt.Errorf("failed to open decision log %q: %w", cfg.DecisionLog, err)
+		}
+		defer l.Close()
+		opts = append(opts, discovery.WithDecisions(l))
+	}
+	if cfg.Registerer != nil {
+		if err := metrics.SetRegisterer(cfg.Registerer); err != nil {
+			return fmt.Errorf("failed to register metrics: %w", err)
+		}
+	}
+	manager := discovery.NewManager(opts...)
+
+	// Resolve a project number before any source or processing uses it.
+	projectID, labelProject, err := newProjectWrapper(ctx, &cfg, cfg.Project, cfg.projectCredentials())
+	if err != nil {
+		return err
+	}
+	cfg.Project = projectID
+	wrap, err := newWrapper(ctx, &cfg)
+	if err != nil {
+		return err
+	}
+	receiver, err := register(ctx, &cfg, manager, wrap, labelProject)
+	if err != nil {
+		return err
+	}
+	// Verify that there is at least one source allocated before continuing.
+	if manager.Count() == 0 && cfg.CRDOutputDir == "" {
+		return errors.New("no outputs to discover")
+	}
+
+	if cfg.DryRun > 0 {
+		// Explain how labels are processed without touching any target.
+		dryCtx, dryCancel := context.WithTimeout(ctx, cfg.MaxDiscovery)
+		traces, err := manager.DryRun(dryCtx, cfg.DryRun)
+		dryCancel()
+		if err != nil {
+			return fmt.Errorf("dry run failed: %w", err)
+		}
+		enc := json.NewEncoder(cfg.stdout())
+		enc.SetIndent("", "  ")
+		return enc.Encode(traces)
+	}
+
+	if cfg.ListenAddress != "" {
+		// Serve metrics and debug handlers.
+		gatherer := prometheus.DefaultGatherer
+		if g, ok := cfg.Registerer.(prometheus.Gatherer); ok {
+			gatherer = g
+		}
+		mux := admin.NewServeMuxFor(manager, gatherer)
+		if cfg.EnableLifecycle {
+			admin.HandleLifecycle(mux, manager)
+		}
+		if receiver != nil {
+			mux.Handle(push.Prefix, receiver)
+		}
+		srv := &http.Server{
+			Addr:    cfg.ListenAddress,
+			Handler: mux,
+		}
+		if err = httpx.ListenAndServeAsync(srv); err != nil {
+			return fmt.Errorf("could not start metric server: %w", err)
+		}
+		defer srv.Close()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if cfg.Signals {
+		handleSignals(ctx, cancel, manager.Reload)
+	}
+
+	if cfg.AEFAuditSubscription != "" {
+		// Refresh after deployments instead of waiting for the next period.
+		setupCtx, setupCancel := context.WithTimeout(ctx, cfg.SetupTimeout)
+		l, err := auditlog.New(setupCtx, cfg.AEFAuditSubscription, auditlog.AppEngineMethods)
+		setupCancel()
+		if err != nil {
+			return fmt.Errorf("failed to create an audit log listener for subscription %q: %w", cfg.AEFAuditSubscription, err)
+		}
+		go l.Run(ctx, manager.Reload)
+	}
+
+	if cfg.CRDOutputDir != "" {
+		// Register sources from DiscoverySource resources.
+		config, err := clientcmd.BuildConfigFromFlags("", cfg.Kubeconfig)
+		if err != nil {
+			return fmt.Errorf("failed to load kubeconfig %q: %w", cfg.Kubeconfig, err)
+		}
+		config.Dial = transport.DialContext
+		client, err := dynamic.NewForConfig(config)
+		if err != nil {
+			return fmt.Errorf("failed to create a Kubernetes client: %w", err)
+		}
+		c := crd.NewController(client, cfg.CRDNamespace, cfg.CRDOutputDir, manager, newCRDFactory(&cfg, wrap))
+		if err = c.Reconcile(ctx); err != nil {
+			return fmt.Errorf("failed to read DiscoverySources: %w", err)
+		}
+		go c.Run(ctx, cfg.Refresh)
+	}
+	for _, name := range cfg.Paused {
+		// Pause after registration, so that names of no source are rejected.
+		if err = manager.Pause(name); err != nil {
+			return fmt.Errorf("failed to pause: %w", err)
+		}
+	}
+	if cfg.Restore != "" {
+		// Continue from the state of another host without a cold start.
+		f, err := os.Open(cfg.Restore)
+		if err != nil {
+			return fmt.Errorf("failed to open snapshot %q: %w", cfg.Restore, err)
+		}
+		err = manager.Restore(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to restore snapshot %q: %w", cfg.Restore, err)
+		}
+	}
+	if cfg.SelfTest {
+		// Fail fast when any source is misconfigured.
+		testCtx, testCancel := context.WithTimeout(ctx, cfg.MaxDiscovery)
+		err = manager.SelfTest(testCtx)
+		testCancel()
+		if err != nil {
+			return fmt.Errorf("self-test failed: %w", err)
+		}
+	}
+	if cfg.Soak > 0 {
+		// Run discovery for a limited time and report leaks.
+		monitor.GC = true
+		monitor.Warmup = soak.DefaultWarmup
+		soakCtx, soakCancel := context.WithTimeout(ctx, cfg.Soak)
+		manager.Run(soakCtx, cfg.Refresh)
+		soakCancel()
+		if err = monitor.Check(soak.DefaultLimits); err != nil {
+			return fmt.Errorf("soak test failed: %w", err)
+		}
+		log.Printf("Soak test passed after %d passes", len(monitor.Samples()))
+		return nil
+	}
+
+	// Run discovery until ctx is canceled.
+	manager.Run(ctx, cfg.Refresh)
+	return nil
+}
+
+// newWrapper returns a function that wraps every service with the optional
+// processing of cfg before registration.
+func newWrapper(ctx context.Context, cfg *Config) (func(discovery.Service) discovery.Service, error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.SetupTimeout)
+	defer cancel()
+	wrap := func(s discovery.Service) discovery.Service { return s }
+	if cfg.GCEEnrich {
+		e, err := gce.NewEnricher(ctx, cfg.Project, cfg.GCEEnrichTTL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create a GCE enricher for project %q: %w", cfg.Project, err)
+		}
+		wrap = func(s discovery.Service) discovery.Service { return e.Wrap(s) }
+		if len(cfg.FirewallSourceRanges) > 0 {
+			a, err := gce.NewAnalyzer(ctx, cfg.Project, cfg.FirewallSourceRanges)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create a firewall analyzer for ranges %q: %w", cfg.FirewallSourceRanges, err)
+			}
+			// Analyze firewall rules after enrichment adds network tags.
+			wrap = func(s discovery.Service) discovery.Service { return a.Wrap(e.Wrap(s)) }
+		}
+	}
+	for _, spec := range cfg.LabelJoins {
+		// Join after enrichment, so tables may be keyed by GCE labels.
+		j := labeljoin.NewJoiner(spec, cfg.LabelJoinTTL)
+		inner := wrap
+		wrap = func(s discovery.Service) discovery.Service { return j.Wrap(inner(s)) }
+	}
+	if cfg.KMSKey != "" {
+		enc, err := labelcrypt.NewEncrypter(ctx, cfg.KMSKey, cfg.KMSLabels)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create a label encrypter for key %q: %w", cfg.KMSKey, err)
+		}
+		// Encrypt labels after all other processing.
+		inner := wrap
+		wrap = func(s discovery.Service) discovery.Service { return enc.Wrap(inner(s)) }
+	}
+	return wrap, nil
+}
+
+// newProjectWrapper resolves p, which may be a project number, to its project
+// ID. The returned function wraps the sources of the project to label their
+// targets with its ID and number if p is a project number or
+// cfg.ProjectLabels is set, or else returns them unchanged. The project is
+// only looked up if either is needed, using creds.
+func newProjectWrapper(
+	ctx context.Context, cfg *Config, p string, creds credentials.Config) (string, func(discovery.Service) discovery.Service, error) {
+	if p == "" || (!cfg.ProjectLabels && !project.IsNumber(p)) {
+		return p, func(s discovery.Service) discovery.Service { return s }, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, cfg.SetupTimeout)
+	defer cancel()
+	resolved, err := project.Resolve(ctx, p, creds)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to resolve project %q: %w", p, err)
+	}
+	return resolved.ID, func(s discovery.Service) discovery.Service { return resolved.Wrap(s) }, nil
+}
+
+// register creates every source configured by cfg and registers them with the
+// manager. Sources of cfg.Project are also wrapped by labelProject. register
+// returns the receiver of push sources, if any.
+func register(
+	ctx context.Context, cfg *Config, manager *discovery.Manager,
+	wrap, labelProject func(discovery.Service) discovery.Service) (*push.Receiver, error) {
+	setupCtx, setupCancel := context.WithTimeout(ctx, cfg.SetupTimeout)
+	defer setupCancel()
+	sources := &outputs{}
+	// Add project labels before other processing, so label joins may use them.
+	wrapProject := func(s discovery.Service) discovery.Service { return wrap(labelProject(s)) }
+	if cfg.AEFTarget != "" {
+		// Allocate a new authenticated client for App Engine API.
+		s, err := aeflex.NewService(setupCtx, cfg.Project, cfg.AEFCredentials, cfg.AEFApps...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create an aeflex.Service for project %q: %w", cfg.Project, err)
+		}
+		s.ReadyLabel = cfg.ReadyLabel
+		s.InstanceKey = cfg.AEFInstanceKey
+		s.CollapseIPs = cfg.AEFCollapseIPs
+		// Applications of other projects are not labeled with cfg.Project.
+		if len(cfg.AEFApps) == 0 {
+			sources.add("aeflex", wrapProject(s), cfg.AEFTarget)
+		} else {
+			sources.add("aeflex", wrap(s), cfg.AEFTarget)
+		}
+	}
+	if cfg.GKETarget != "" {
+		// Allocate a new authenticated client for GCE & GKE API.
+		s, err := gke.NewService(setupCtx, cfg.Project, cfg.GKECredentials)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create a gke.Service for project %q: %w", cfg.Project, err)
+		}
+		s.ZoneCacheTTL = cfg.GKEZoneCacheTTL
+		s.AggregatedList = cfg.GKEAggregatedList
+		s.MaxConcurrency = cfg.GKEMaxConcurrency
+		s.KubeTimeout = cfg.GKEKubeTimeout
+		s.Annotations = cfg.GKEAnnotations
+		s.APIServerProxy = cfg.GKEAPIServerProxy
+		s.Pods = cfg.GKEPods
+		s.Nodes = cfg.GKENodes
+		s.NodePort = cfg.GKENodePort
+		s.MCS = cfg.GKEMCS
+		s.MCSDedup = cfg.GKEMCSDedup
+		s.ControlPlane = cfg.GKEControlPlane
+		s.EndpointLabels = cfg.GKEEndpointLabels
+		s.ReadyLabel = cfg.ReadyLabel
+		sources.add("gke", wrapProject(s), cfg.GKETarget)
+	}
+	if cfg.NEGTarget != "" {
+		// Allocate a new authenticated client for the Compute API.
+		s, err := neg.NewService(setupCtx, cfg.Project, cfg.NEGCredentials)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create a neg.Service for project %q: %w", cfg.Project, err)
+		}
+		sources.add("neg", wrapProject(s), cfg.NEGTarget)
+	}
+	if cfg.APITarget != "" {
+		// Allocate new authenticated clients for the API Gateway and Service
+		// Management APIs.
+		s, err := apis.NewService(setupCtx, cfg.Project, cfg.APICredentials)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create an apis.Service for project %q: %w", cfg.Project, err)
+		}
+		sources.add("apis", wrapProject(s), cfg.APITarget)
+	}
+	if cfg.GCETarget != "" {
+		// Allocate a new authenticated client for the Compute API.
+		s, err := gce.NewInstances(setupCtx, cfg.Project, cfg.GCECredentials)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create a gce.Instances for project %q: %w", cfg.Project, err)
+		}
+		s.Selector = cfg.GCESelector
+		s.Port = cfg.GCEPort
+		sources.add("gce", wrapProject(s), cfg.GCETarget)
+	}
+	if cfg.FunctionsTarget != "" {
+		// Allocate new authenticated clients for the Cloud Functions and Cloud
+		// Run APIs.
+		s, err := functions.NewService(setupCtx, cfg.Project, cfg.FunctionsCredentials)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create a functions.Service for project %q: %w", cfg.Project, err)
+		}
+		sources.add("functions", wrapProject(s), cfg.FunctionsTarget)
+	}
+	if cfg.BatchTarget != "" {
+		// Allocate new authenticated clients for the Batch and Compute APIs.
+		s, err := batch.NewService(setupCtx, cfg.Project, cfg.BatchCredentials)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create a batch.Service for project %q: %w", cfg.Project, err)
+		}
+		s.Port = cfg.BatchPort
+		sources.add("batch", wrapProject(s), cfg.BatchTarget)
+	}
+	if cfg.TPUTarget != "" {
+		// Allocate a new authenticated client for the Cloud TPU API.
+		s, err := tpu.NewService(setupCtx, cfg.Project, cfg.TPUCredentials)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create a tpu.Service for project %q: %w", cfg.Project, err)
+		}
+		s.Port = cfg.TPUPort
+		sources.add("tpu", wrapProject(s), cfg.TPUTarget)
+	}
+	if cfg.RedisTarget != "" {
+		// Allocate a new authenticated client for the Memorystore for Redis
+		// API.
+		s, err := redis.NewService(setupCtx, cfg.Project, cfg.RedisCredentials)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create a redis.Service for project %q: %w", cfg.Project, err)
+		}
+		sources.add("redis", wrapProject(s), cfg.RedisTarget)
+	}
+	if cfg.VertexTarget != "" {
+		// Allocate new authenticated clients for the Vertex AI and Notebooks
+		// APIs.
+		s, err := vertex.NewService(setupCtx, cfg.Project, cfg.VertexCredentials)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create a vertex.Service for project %q: %w", cfg.Project, err)
+		}
+		sources.add("vertex", wrapProject(s), cfg.VertexTarget)
+	}
+	resolver := newResolver(cfg)
+	for i := range cfg.HTTPSources {
+		// Allocate a new client for downloading an HTTP(S) source.
+		s := web.NewService(cfg.HTTPSources[i])
+		s.Passthrough = cfg.HTTPPassthrough
+		s.Resolver = resolver
+		sources.add(fmt.Sprintf("http%d", i), wrap(s), cfg.HTTPTargets[i])
+	}
+
+	for i := range cfg.ExecSources {
+		// Allocate a new service for running an external command.
+		args := strings.Fields(cfg.ExecSources[i])
+		s := exec.NewService(args[0], args[1:]...)
+		s.Timeout = cfg.ExecTimeout
+		s.Env = cfg.ExecEnv
+		sources.add(fmt.Sprintf("exec%d", i), wrap(s), cfg.ExecTargets[i])
+	}
+
+	var receiver *push.Receiver
+	if len(cfg.PushSources) > 0 {
+		token, err := ioutil.ReadFile(cfg.PushTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read push token file %q: %w", cfg.PushTokenFile, err)
+		}
+		receiver = push.NewReceiver(strings.TrimSpace(string(token)), cfg.PushTTL)
+	}
+	for i := range cfg.PushSources {
+		// Allocate a new source for targets pushed over HTTP.
+		sources.add(cfg.PushSources[i], wrap(receiver.Source(cfg.PushSources[i])), cfg.PushTargets[i])
+	}
+
+	if err := sources.register(manager, cfg.LabelConflicts); err != nil {
+		return nil, err
+	}
+
+	if cfg.Mirror != "" {
+		// Replicate the outputs of the primary exactly, without processing.
+		listCtx, listCancel := context.WithTimeout(ctx, cfg.MaxDiscovery)
+		primary, err := mirror.Outputs(listCtx, cfg.Mirror)
+		listCancel()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the outputs of the primary %q: %w", cfg.Mirror, err)
+		}
+		mirrored := map[string]string{}
+		for _, output := range primary {
+			local := mirrorPath(cfg.MirrorDir, output)
+			if _, ok := sources.sources[local]; ok {
+				return nil, fmt.Errorf("failed to mirror %q: another output is written to %q", output, local)
+			}
+			if other, ok := mirrored[local]; ok {
+				return nil, fmt.Errorf("failed to mirror %q: %q is also written to %q", output, other, local)
+			}
+			mirrored[local] = output
+			if err = os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+				return nil, fmt.Errorf("failed to mirror %q: %w", output, err)
+			}
+			manager.RegisterVerbatim(mirror.NewSource(cfg.Mirror, output), local)
+		}
+	}
+	return receiver, nil
+}
+
+// mirrorPath returns the file in dir that mirrors the output of the primary.
+// The path of the output is preserved below dir, so outputs with the same base
+// name in different directories do not collide, and relative outputs cannot
+// escape dir.
+func mirrorPath(dir, output string) string {
+	return filepath.Join(dir, filepath.Clean(string(filepath.Separator)+output))
+}
+
+// newResolver returns the Resolver shared by HTTP(S) sources, or nil if their
+// targets are not resolved.
+func newResolver(cfg *Config) *web.Resolver {
+	if !cfg.HTTPResolve {
+		return nil
+	}
+	return web.NewResolver(cfg.HTTPResolveTTL, cfg.HTTPResolveMaxStale)
+}
+
+// newCRDFactory returns a crd.Factory that creates services using the same
+// settings as sources configured by cfg.
+func newCRDFactory(cfg *Config, wrap func(discovery.Service) discovery.Service) crd.Factory {
+	resolver := newResolver(cfg)
+	return func(ctx context.Context, spec crd.Spec) (discovery.Service, error) {
+		ctx, cancel := context.WithTimeout(ctx, cfg.SetupTimeout)
+		defer cancel()
+		var labelProject func(discovery.Service) discovery.Service
+		var err error
+		spec.Project, labelProject, err = newProjectWrapper(ctx, cfg, spec.Project, spec.Credentials)
+		if err != nil {
+			return nil, err
+		}
+		wrapProject := func(s discovery.Service) discovery.Service { return wrap(labelProject(s)) }
+		switch spec.Type {
+		case "aeflex":
+			s, err := aeflex.NewService(ctx, spec.Project, spec.Credentials, spec.Apps...)
+			if err != nil {
+				return nil, err
+			}
+			s.ReadyLabel = cfg.ReadyLabel
+			s.InstanceKey = cfg.AEFInstanceKey
+			s.CollapseIPs = cfg.AEFCollapseIPs
+			if len(spec.Apps) > 0 {
+				return wrap(s), nil
+			}
+			return wrapProject(s), nil
+		case "gke":
+			s, err := gke.NewService(ctx, spec.Project, spec.Credentials)
+			if err != nil {
+				return nil, err
+			}
+			s.ZoneCacheTTL = cfg.GKEZoneCacheTTL
+			s.AggregatedList = cfg.GKEAggregatedList
+			s.MaxConcurrency = cfg.GKEMaxConcurrency
+			s.KubeTimeout = cfg.GKEKubeTimeout
+			s.Annotations, err = specAnnotations(cfg, spec)
+			if err != nil {
+				return nil, err
+			}
+			s.APIServerProxy = cfg.GKEAPIServerProxy
+			s.Pods = cfg.GKEPods
+			s.Nodes = cfg.GKENodes
+			s.NodePort = cfg.GKENodePort
+			s.MCS = cfg.GKEMCS
+			s.MCSDedup = cfg.GKEMCSDedup
+			s.ControlPlane = cfg.GKEControlPlane
+			s.EndpointLabels = cfg.GKEEndpointLabels
+			s.ReadyLabel = cfg.ReadyLabel
+			return wrapProject(s), nil
+		case "neg":
+			s, err := neg.NewService(ctx, spec.Project, spec.Credentials)
+			if err != nil {
+				return nil, err
+			}
+			return wrapProject(s), nil
+		case "apis":
+			s, err := apis.NewService(ctx, spec.Project, spec.Credentials)
+			if err != nil {
+				return nil, err
+			}
+			return wrapProject(s), nil
+		case "gce":
+			s, err := gce.NewInstances(ctx, spec.Project, spec.Credentials)
+			if err != nil {
+				return nil, err
+			}
+			s.Selector, err = specSelector(cfg, spec)
+			if err != nil {
+				return nil, err
+			}
+			s.Port = cfg.GCEPort
+			return wrapProject(s), nil
+		case "functions":
+			s, err := functions.NewService(ctx, spec.Project, spec.Credentials)
+			if err != nil {
+				return nil, err
+			}
+			return wrapProject(s), nil
+		case "batch":
+			s, err := batch.NewService(ctx, spec.Project, spec.Credentials)
+			if err != nil {
+				return nil, err
+			}
+			s.Port = cfg.BatchPort
+			return wrapProject(s), nil
+		case "tpu":
+			s, err := tpu.NewService(ctx, spec.Project, spec.Credentials)
+			if err != nil {
+				return nil, err
+			}
+			s.Port = cfg.TPUPort
+			return wrapProject(s), nil
+		case "redis":
+			s, err := redis.NewService(ctx, spec.Project, spec.Credentials)
+			if err != nil {
+				return nil, err
+			}
+			return wrapProject(s), nil
+		case "vertex":
+			s, err := vertex.NewService(ctx, spec.Project, spec.Credentials)
+			if err != nil {
+				return nil, err
+			}
+			return wrapProject(s), nil
+		case "web":
+			s := web.NewService(spec.URL)
+			s.Passthrough = cfg.HTTPPassthrough
+			s.Resolver = resolver
+			return wrap(s), nil
+		}
+		return nil, fmt.Errorf("unsupported source type %q", spec.Type)
+	}
+}
+
+// specAnnotations returns the annotations of a gke DiscoverySource, or the
+// annotations of cfg if it has none.
+func specAnnotations(cfg *Config, spec crd.Spec) (gke.Annotations, error) {
+	if len(spec.Annotations) == 0 {
+		return cfg.GKEAnnotations, nil
+	}
+	annotations := gke.Annotations{}
+	for _, a := range spec.Annotations {
+		if err := annotations.Set(a); err != nil {
+			return nil, err
+		}
+	}
+	return annotations, nil
+}
+
+// specSelector returns the selector of a gce DiscoverySource, or the selector
+// of cfg if it has none.
+func specSelector(cfg *Config, spec crd.Spec) (gce.Selector, error) {
+	if spec.Selector == "" {
+		return cfg.GCESelector, nil
+	}
+	selector := gce.Selector{}
+	err := selector.Set(spec.Selector)
+	return selector, err
+}
+
+// verifyOutputs checks the checksum of every configured target file, and
+// writes the result of every file to the Stdout of cfg.
+func verifyOutputs(cfg *Config) error {
+	var errs []error
+	for _, output := range cfg.outputs() {
+		if discovery.IsWriterOutput(output) {
+			continue
+		}
+		err := discovery.VerifyChecksum(output)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		fmt.Fprintf(cfg.stdout(), "%s: OK\n", output)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,338 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/gcp-service-discovery/crd"
+	"github.com/m-lab/gcp-service-discovery/credentials"
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/gce"
+	"github.com/m-lab/gcp-service-discovery/gke"
+	"github.com/m-lab/gcp-service-discovery/web"
+)
+
+func TestConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(c *Config)
+		wantErr string
+	}{
+		{
+			name:   "success",
+			modify: func(c *Config) {},
+		},
+		{
+			name:    "error-http-targets",
+			modify:  func(c *Config) { c.HTTPTargets = nil },
+			wantErr: "http sources",
+		},
+		{
+			name: "error-empty-exec-source",
+			modify: func(c *Config) {
+				c.ExecSources = []string{" "}
+				c.ExecTargets = []string{"exec.json"}
+			},
+			wantErr: "empty exec source",
+		},
+		{
+			name: "error-push-token",
+			modify: func(c *Config) {
+				c.PushSources = []string{"batch"}
+				c.PushTargets = []string{"batch.json"}
+			},
+			wantErr: "push token",
+		},
+		{
+			name:    "error-project",
+			modify:  func(c *Config) { c.GKETarget = "gke.json" },
+			wantErr: "GCP project",
+		},
+		{
+			name:    "error-kms-labels-without-key",
+			modify:  func(c *Config) { c.KMSLabels = []string{"owner_email"} },
+			wantErr: "KMS key",
+		},
+		{
+			name:    "error-kms-key-without-labels",
+			modify:  func(c *Config) { c.KMSKey = "projects/p/locations/l/keyRings/r/cryptoKeys/k" },
+			wantErr: "KMS label",
+		},
+		{
+			name:    "error-mirror-dir",
+			modify:  func(c *Config) { c.Mirror = "http://primary:9373" },
+			wantErr: "mirror directory",
+		},
+		{
+			name: "error-output-order-cycle",
+			modify: func(c *Config) {
+				c.OutputOrder = discovery.OutputOrder{"all.json": {"http.json"}, "http.json": {"all.json"}}
+			},
+			wantErr: "cycle",
+		},
+		{
+			name: "error-no-outputs",
+			modify: func(c *Config) {
+				c.HTTPSources = nil
+				c.HTTPTargets = nil
+			},
+			wantErr: "at least one output",
+		},
+		{
+			name: "success-verify-without-outputs",
+			modify: func(c *Config) {
+				c.HTTPSources = nil
+				c.HTTPTargets = nil
+				c.Verify = true
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.HTTPSources = []string{"http://localhost/targets.json"}
+			c.HTTPTargets = []string{"http.json"}
+			tt.modify(&c)
+			err := c.Validate()
+			if (err != nil) != (tt.wantErr != "") || (err != nil && !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Config.Validate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// newTargetsServer returns a server of a target file with one target.
+func newTargetsServer(t *testing.T) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"targets": ["10.0.0.1:9090"], "labels": {"job": "node"}}]`)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestRun(t *testing.T) {
+	s := newTargetsServer(t)
+	dir := t.TempDir()
+	cfg := DefaultConfig()
+	cfg.ListenAddress = ""
+	cfg.HTTPSources = []string{s.URL, s.URL}
+	cfg.HTTPTargets = []string{filepath.Join(dir, "http.json"), filepath.Join(dir, "http.json")}
+	cfg.LabelConflicts = discovery.ConflictRename
+	cfg.WriteChecksum = true
+	cfg.Refresh = time.Hour
+
+	// Stop after the first pass.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for {
+			if _, err := os.Stat(cfg.HTTPTargets[0] + discovery.ChecksumSuffix); err == nil {
+				cancel()
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	if err := Run(ctx, cfg); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	data, err := os.ReadFile(cfg.HTTPTargets[0])
+	if err != nil {
+		t.Fatalf("Run() did not write the target file: %v", err)
+	}
+	configs := []discovery.StaticConfig{}
+	if err = json.Unmarshal(data, &configs); err != nil || len(configs) != 2 {
+		t.Errorf("Run() wrote %s, want 2 merged configs", data)
+	}
+
+	// Verify the written checksum.
+	out := &bytes.Buffer{}
+	cfg.Verify = true
+	cfg.Stdout = out
+	if err = Run(context.Background(), cfg); err != nil {
+		t.Errorf("Run() with Verify error = %v", err)
+	}
+	if !strings.Contains(out.String(), "http.json: OK") {
+		t.Errorf("Run() with Verify wrote %q, want OK", out)
+	}
+	os.WriteFile(cfg.HTTPTargets[0], []byte("[]"), 0644)
+	if err = Run(context.Background(), cfg); err == nil {
+		t.Errorf("Run() with Verify of a changed file error = nil, want error")
+	}
+}
+
+func TestRun_dryRun(t *testing.T) {
+	s := newTargetsServer(t)
+	out := &bytes.Buffer{}
+	cfg := DefaultConfig()
+	cfg.ListenAddress = ""
+	cfg.HTTPSources = []string{s.URL}
+	cfg.HTTPTargets = []string{filepath.Join(t.TempDir(), "http.json")}
+	cfg.DryRun = 10
+	cfg.Stdout = out
+	if err := Run(context.Background(), cfg); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	traces := []discovery.Trace{}
+	if err := json.Unmarshal(out.Bytes(), &traces); err != nil || len(traces) != 1 {
+		t.Errorf("Run() wrote %s, want 1 trace", out)
+	}
+	if _, err := os.Stat(cfg.HTTPTargets[0]); !os.IsNotExist(err) {
+		t.Errorf("Run() with DryRun wrote the target file")
+	}
+}
+
+func TestRun_errors(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+	}{
+		{
+			name:   "invalid-config",
+			modify: func(c *Config) { c.HTTPTargets = nil },
+		},
+		{
+			name: "missing-push-token",
+			modify: func(c *Config) {
+				c.PushSources = []string{"batch"}
+				c.PushTargets = []string{"batch.json"}
+				c.PushTokenFile = "/does/not/exist"
+			},
+		},
+		{
+			name: "invalid-writer-output",
+			modify: func(c *Config) {
+				c.HTTPTargets = []string{"zk://"}
+			},
+		},
+		{
+			name:   "missing-snapshot",
+			modify: func(c *Config) { c.Restore = "/does/not/exist.tar.gz" },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.ListenAddress = ""
+			cfg.HTTPSources = []string{"http://localhost/targets.json"}
+			cfg.HTTPTargets = []string{filepath.Join(t.TempDir(), "http.json")}
+			tt.modify(&cfg)
+			if err := Run(context.Background(), cfg); err == nil {
+				t.Errorf("Run() error = nil, want error")
+			}
+		})
+	}
+}
+
+func Test_newProjectWrapper(t *testing.T) {
+	// Project IDs are used as given without ProjectLabels, and sources are not
+	// wrapped, so no lookup is needed.
+	cfg := DefaultConfig()
+	for _, p := range []string{"", "mlab-sandbox"} {
+		got, wrap, err := newProjectWrapper(context.Background(), &cfg, p, credentials.Config{})
+		if err != nil || got != p {
+			t.Errorf("newProjectWrapper(%q) = %q, %v, want %q", p, got, err, p)
+		}
+		s := web.NewService("http://localhost/targets.json")
+		if wrap(s) != s {
+			t.Errorf("newProjectWrapper(%q) wrapped the source", p)
+		}
+	}
+}
+
+func TestConfig_projectCredentials(t *testing.T) {
+	aef := credentials.Config{Impersonate: "aef@mlab-sandbox.iam.gserviceaccount.com"}
+	gke := credentials.Config{Impersonate: "gke@mlab-sandbox.iam.gserviceaccount.com"}
+	tests := []struct {
+		name string
+		cfg  Config
+		want credentials.Config
+	}{
+		{
+			name: "none",
+		},
+		{
+			name: "first-source",
+			cfg: Config{
+				AEFTarget: "aef.json", AEFCredentials: aef,
+				GKETarget: "gke.json", GKECredentials: gke,
+			},
+			want: aef,
+		},
+		{
+			name: "aef-apps",
+			cfg: Config{
+				AEFTarget: "aef.json", AEFCredentials: aef, AEFApps: []string{"other-project"},
+				GKETarget: "gke.json", GKECredentials: gke,
+			},
+			want: gke,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cfg.projectCredentials(); got != tt.want {
+				t.Errorf("Config.projectCredentials() = %v, want %v", &got, &tt.want)
+			}
+		})
+	}
+}
+
+func Test_specFilters(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.GKEAnnotations = gke.Annotations{{Key: "default", Value: "true"}}
+
+	// Sources without filters use the filters of the command line.
+	got, err := specAnnotations(&cfg, crd.Spec{Type: "gke"})
+	if err != nil || !reflect.DeepEqual(got, cfg.GKEAnnotations) {
+		t.Errorf("specAnnotations() = %v, %v, want %v", got, err, cfg.GKEAnnotations)
+	}
+	sel, err := specSelector(&cfg, crd.Spec{Type: "gce"})
+	if err != nil || sel != cfg.GCESelector {
+		t.Errorf("specSelector() = %v, %v, want %v", sel, err, cfg.GCESelector)
+	}
+
+	got, err = specAnnotations(&cfg, crd.Spec{Type: "gke", Annotations: []string{"prometheus.io/federate", "team=a"}})
+	want := gke.Annotations{{Key: "prometheus.io/federate", Value: "true"}, {Key: "team", Value: "a"}}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("specAnnotations() = %v, %v, want %v", got, err, want)
+	}
+	sel, err = specSelector(&cfg, crd.Spec{Type: "gce", Selector: "role=prometheus"})
+	if err != nil || sel != (gce.Selector{Key: "role", Value: "prometheus"}) {
+		t.Errorf("specSelector() = %v, %v, want role=prometheus", sel, err)
+	}
+
+	if _, err := specAnnotations(&cfg, crd.Spec{Type: "gke", Annotations: []string{"=a"}}); err == nil {
+		t.Errorf("specAnnotations() error = nil, want error")
+	}
+	if _, err := specSelector(&cfg, crd.Spec{Type: "gce", Selector: "=a"}); err == nil {
+		t.Errorf("specSelector() error = nil, want error")
+	}
+}
+
+func Test_mirrorPath(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   string
+	}{
+		{name: "success-absolute", output: "/targets/aeflex.json", want: "/mirror/targets/aeflex.json"},
+		{name: "success-relative", output: "gke/targets.json", want: "/mirror/gke/targets.json"},
+		{name: "success-parent", output: "../../etc/targets.json", want: "/mirror/etc/targets.json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mirrorPath("/mirror", tt.output); got != tt.want {
+				t.Errorf("mirrorPath() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package runner
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+)
+
+// handleSignals calls cancel when the process receives one of stopSignals, and
+// calls reload when it receives one of reloadSignals. The signals supported
+// depend on the platform. handleSignals returns immediately, and stops
+// handling signals after ctx is canceled.
+func handleSignals(ctx context.Context, cancel context.CancelFunc, reload func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, append(append([]os.Signal{}, stopSignals...), reloadSignals...)...)
+	go func() {
+		defer signal.Stop(c)
+		for {
+			select {
+			case sig := <-c:
+				if isReloadSignal(sig) {
+					log.Printf("Received %s; reloading", sig)
+					reload()
+					continue
+				}
+				log.Printf("Received %s; shutting down", sig)
+				cancel()
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// isReloadSignal returns true if sig is one of reloadSignals.
+func isReloadSignal(sig os.Signal) bool {
+	for _, s := range reloadSignals {
+		if s == sig {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package runner
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	// stopSignals cause the process to stop gracefully.
+	stopSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+	// reloadSignals cause an immediate discovery pass, like a POST to the
+	// /-/reload admin endpoint.
+	reloadSignals = []os.Signal{syscall.SIGHUP}
+)
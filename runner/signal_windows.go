@@ -0,0 +1,18 @@
+//go:build windows
+
+package runner
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	// stopSignals cause the process to stop gracefully. On Windows, the
+	// runtime delivers SIGTERM for console close, logoff, and shutdown events.
+	stopSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+	// reloadSignals is empty because Windows has no SIGHUP. Use a POST to the
+	// /-/reload admin endpoint instead.
+	reloadSignals = []os.Signal{}
+)
@@ -0,0 +1,63 @@
+// Package sdnotify implements the systemd service notification protocol, so
+// systemd can wait for the service to become ready and restart it when it
+// stops responding. See sd_notify(3) and systemd.service(5).
+package sdnotify
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// States sent to systemd.
+const (
+	// Ready tells systemd that the service has finished starting up.
+	Ready = "READY=1"
+	// Stopping tells systemd that the service is shutting down.
+	Stopping = "STOPPING=1"
+	// Watchdog resets the systemd watchdog timer.
+	Watchdog = "WATCHDOG=1"
+)
+
+// Notify sends state to the socket named by the NOTIFY_SOCKET environment
+// variable. Notify returns false when NOTIFY_SOCKET is unset, e.g. when the
+// process was not started by systemd with Type=notify.
+func Notify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	// Names starting with "@" are abstract sockets, handled by package net.
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns the watchdog timeout configured by systemd for this
+// process using WatchdogSec. The service must send Watchdog more often than
+// the returned interval. WatchdogInterval returns zero when the watchdog is
+// not enabled.
+func WatchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		// The watchdog is meant for another process.
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid WATCHDOG_USEC: %q", usec)
+	}
+	return time.Duration(n) * time.Microsecond, nil
+}
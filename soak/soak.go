@@ -0,0 +1,199 @@
+// Package soak samples the goroutines, heap, and open file descriptors of the
+// process after every discovery pass, to detect slow leaks, e.g. of clients
+// created during every pass.
+//
+// A Monitor exports every sample as metrics. In a soak test, the process runs
+// many passes and Check reports resources that grow without bound.
+package soak
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/m-lab/gcp-service-discovery/metrics"
+)
+
+var (
+	// passGoroutines is the number of goroutines after the last pass.
+	//
+	// Provides metrics:
+	//   gcp_pass_goroutines
+	// Usage example:
+	//   passGoroutines.Set(float64(s.Goroutines))
+	passGoroutines = metrics.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gcp_pass_goroutines",
+			Help: "Number of goroutines after the last discovery pass.",
+		},
+	)
+
+	// passHeapBytes is the size of allocated heap objects after the last pass.
+	//
+	// Provides metrics:
+	//   gcp_pass_heap_bytes
+	// Usage example:
+	//   passHeapBytes.Set(float64(s.HeapBytes))
+	passHeapBytes = metrics.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gcp_pass_heap_bytes",
+			Help: "Bytes of allocated heap objects after the last discovery pass.",
+		},
+	)
+
+	// passHeapDelta is the change of the heap size during the last pass.
+	//
+	// Provides metrics:
+	//   gcp_pass_heap_delta_bytes
+	// Usage example:
+	//   passHeapDelta.Set(float64(s.HeapBytes - previous.HeapBytes))
+	passHeapDelta = metrics.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gcp_pass_heap_delta_bytes",
+			Help: "Change of allocated heap bytes during the last discovery pass.",
+		},
+	)
+
+	// passOpenFDs is the number of open file descriptors after the last pass.
+	// Only reported on systems with /proc.
+	//
+	// Provides metrics:
+	//   gcp_pass_open_fds
+	// Usage example:
+	//   passOpenFDs.Set(float64(s.OpenFDs))
+	passOpenFDs = metrics.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gcp_pass_open_fds",
+			Help: "Number of open file descriptors after the last discovery pass.",
+		},
+	)
+)
+
+// Sample is the resource usage of the process at one time.
+type Sample struct {
+	Goroutines int
+	HeapBytes  uint64
+	// OpenFDs is -1 when the number of open files is unknown.
+	OpenFDs int
+}
+
+// fdDir lists the open file descriptors of the process. The indirection
+// facilitates testing.
+var fdDir = "/proc/self/fd"
+
+// Read returns the current resource usage of the process. When gc is true,
+// Read runs a garbage collection first, so the heap size excludes garbage.
+func Read(gc bool) Sample {
+	if gc {
+		runtime.GC()
+	}
+	ms := runtime.MemStats{}
+	runtime.ReadMemStats(&ms)
+	s := Sample{Goroutines: runtime.NumGoroutine(), HeapBytes: ms.HeapAlloc, OpenFDs: -1}
+	if entries, err := os.ReadDir(fdDir); err == nil {
+		s.OpenFDs = len(entries)
+	}
+	return s
+}
+
+// Limits are the growth tolerated by Check between the early and late passes
+// of a soak test.
+type Limits struct {
+	Goroutines int
+	HeapBytes  uint64
+	OpenFDs    int
+}
+
+// DefaultLimits tolerate the growth of pools and caches that are filled
+// slowly, e.g. idle HTTP connections.
+var DefaultLimits = Limits{Goroutines: 20, HeapBytes: 16 << 20, OpenFDs: 20}
+
+// DefaultWarmup is the number of passes before clients, caches, and connection
+// pools usually reach their steady state.
+const DefaultWarmup = 3
+
+// Monitor records a Sample after every pass and exports it as metrics.
+type Monitor struct {
+	// GC runs a garbage collection before every sample, so heap sizes are
+	// comparable between passes. Soak tests should set GC.
+	GC bool
+
+	// Warmup is the number of initial passes ignored by Check, while clients,
+	// caches, and connection pools are created.
+	Warmup int
+
+	mu      sync.Mutex
+	samples []Sample
+}
+
+// Observe records a sample of the current resource usage. Observe has the
+// signature of discovery.Manager.AfterPass.
+func (m *Monitor) Observe(ok bool) {
+	s := Read(m.GC)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	passGoroutines.Set(float64(s.Goroutines))
+	passHeapBytes.Set(float64(s.HeapBytes))
+	if n := len(m.samples); n > 0 {
+		passHeapDelta.Set(float64(s.HeapBytes) - float64(m.samples[n-1].HeapBytes))
+	}
+	if s.OpenFDs >= 0 {
+		passOpenFDs.Set(float64(s.OpenFDs))
+	}
+	m.samples = append(m.samples, s)
+}
+
+// Samples returns every recorded sample, oldest first.
+func (m *Monitor) Samples() []Sample {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Sample{}, m.samples...)
+}
+
+// minPasses is the minimum number of passes after warm-up needed by Check.
+const minPasses = 4
+
+// Check returns an error if any resource grew by more than limits during the
+// passes after warm-up. The passes are split in early and late halves, and a
+// resource grew when its lowest usage during the late half exceeds its highest
+// usage during the early half, so usage that rises and falls is not reported.
+func (m *Monitor) Check(limits Limits) error {
+	samples := m.Samples()
+	if len(samples) < m.Warmup+minPasses {
+		return fmt.Errorf("soak test too short: %d passes, want at least %d", len(samples), m.Warmup+minPasses)
+	}
+	samples = samples[m.Warmup:]
+	early, late := samples[:len(samples)/2], samples[len(samples)/2:]
+
+	var leaks []string
+	grew := func(name string, get func(Sample) float64, limit float64) {
+		high := get(early[0])
+		for _, s := range early {
+			if get(s) > high {
+				high = get(s)
+			}
+		}
+		low := get(late[0])
+		for _, s := range late {
+			if get(s) < low {
+				low = get(s)
+			}
+		}
+		if low-high > limit {
+			leaks = append(leaks, fmt.Sprintf("%s grew from %.0f to %.0f", name, high, low))
+		}
+	}
+	grew("goroutines", func(s Sample) float64 { return float64(s.Goroutines) }, float64(limits.Goroutines))
+	grew("heap bytes", func(s Sample) float64 { return float64(s.HeapBytes) }, float64(limits.HeapBytes))
+	if samples[0].OpenFDs >= 0 {
+		grew("open files", func(s Sample) float64 { return float64(s.OpenFDs) }, float64(limits.OpenFDs))
+	}
+	if len(leaks) > 0 {
+		return fmt.Errorf("resources grew during %d passes: %s", len(samples), strings.Join(leaks, ", "))
+	}
+	return nil
+}
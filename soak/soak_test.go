@@ -0,0 +1,99 @@
+package soak
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/m-lab/go/prometheusx/promtest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRead(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"0", "1", "2"} {
+		os.WriteFile(filepath.Join(dir, name), nil, 0644)
+	}
+	orig := fdDir
+	defer func() { fdDir = orig }()
+
+	fdDir = dir
+	s := Read(true)
+	if s.Goroutines < 1 || s.HeapBytes == 0 || s.OpenFDs != 3 {
+		t.Errorf("Read() = %#v, want goroutines, heap, and 3 open files", s)
+	}
+	fdDir = filepath.Join(dir, "missing")
+	if s = Read(false); s.OpenFDs != -1 {
+		t.Errorf("Read() open files = %d without %s, want -1", s.OpenFDs, fdDir)
+	}
+}
+
+func TestMonitor_Observe(t *testing.T) {
+	m := &Monitor{}
+	m.Observe(true)
+	m.Observe(false)
+	if n := len(m.Samples()); n != 2 {
+		t.Errorf("Monitor.Samples() = %d samples, want 2", n)
+	}
+	if v := testutil.ToFloat64(passGoroutines); v < 1 {
+		t.Errorf("Monitor.Observe() goroutines = %v, want at least 1", v)
+	}
+}
+
+func TestMonitor_Check(t *testing.T) {
+	steady := []Sample{{10, 100, 5}, {12, 140, 6}, {10, 90, 5}, {11, 120, 5}, {12, 100, 6}, {10, 130, 5}}
+	tests := []struct {
+		name    string
+		warmup  int
+		samples []Sample
+		wantErr string
+	}{
+		{
+			name:    "success-steady",
+			samples: steady,
+		},
+		{
+			name:    "success-growth-during-warmup",
+			warmup:  2,
+			samples: append([]Sample{{1, 1, 1}, {5, 50, 2}}, steady...),
+		},
+		{
+			name:    "success-unknown-open-files",
+			samples: []Sample{{10, 100, -1}, {10, 100, -1}, {10, 100, -1}, {10, 100, -1}},
+		},
+		{
+			name:    "failure-goroutine-leak",
+			samples: []Sample{{10, 100, 5}, {20, 100, 5}, {40, 100, 5}, {50, 100, 5}},
+			wantErr: "goroutines grew from 20 to 40",
+		},
+		{
+			name:    "failure-heap-and-file-leak",
+			samples: []Sample{{10, 100, 5}, {10, 200, 10}, {10, 300, 40}, {10, 400, 50}},
+			wantErr: "heap bytes grew from 200 to 300, open files grew from 10 to 40",
+		},
+		{
+			name:    "failure-too-short",
+			warmup:  2,
+			samples: steady[:5],
+			wantErr: "too short",
+		},
+	}
+	limits := Limits{Goroutines: 5, HeapBytes: 50, OpenFDs: 5}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Monitor{Warmup: tt.warmup, samples: tt.samples}
+			err := m.Check(limits)
+			if (err != nil) != (tt.wantErr != "") {
+				t.Fatalf("Monitor.Check() error = %v, want %q", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Monitor.Check() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	promtest.LintMetrics(t)
+}
@@ -0,0 +1,172 @@
+// Package iface defines an interface for accessing the Cloud TPU API. This is
+// helpful for creating testable packages.
+//
+// The google.golang.org/api module used by this repository only has the v1 TPU
+// API, which lacks the topology of TPU VMs, so the few Node fields used by the
+// tpu logic are decoded here from the responses of the v2 REST API.
+package iface
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"google.golang.org/api/googleapi"
+
+	"github.com/m-lab/gcp-service-discovery/internal/apicall"
+)
+
+// api names the Cloud TPU API in quota metrics.
+const api = "tpu"
+
+// BasePath is the URL of the Cloud TPU v2 REST API.
+const BasePath = "https://tpu.googleapis.com/v2/"
+
+// locationListFields limits location list responses to the fields used by the
+// tpu logic.
+const locationListFields = "nextPageToken,locations(locationId)"
+
+// nodeListFields limits node list responses to the fields used by the tpu
+// logic.
+const nodeListFields = "nextPageToken,nodes(name,acceleratorType,acceleratorConfig,apiVersion,runtimeVersion,state,health,labels,networkEndpoints(ipAddress))"
+
+// Location is a zone with Cloud TPUs.
+type Location struct {
+	LocationId string `json:"locationId,omitempty"`
+}
+
+// ListLocationsResponse is a page of locations.
+type ListLocationsResponse struct {
+	Locations     []*Location `json:"locations,omitempty"`
+	NextPageToken string      `json:"nextPageToken,omitempty"`
+
+	googleapi.ServerResponse `json:"-"`
+}
+
+// Node is a Cloud TPU node, a single TPU VM or a multi-host slice.
+type Node struct {
+	// Name is the resource name of the node, like
+	// projects/p/locations/z/nodes/n.
+	Name string `json:"name,omitempty"`
+
+	// AcceleratorType is the type of the node, e.g. "v4-32".
+	AcceleratorType string `json:"acceleratorType,omitempty"`
+
+	// AcceleratorConfig is the TPU version and topology of the node.
+	AcceleratorConfig *AcceleratorConfig `json:"acceleratorConfig,omitempty"`
+
+	// ApiVersion is the API version that created the node, "V2_ALPHA1" or
+	// "V2" for TPU VMs.
+	ApiVersion string `json:"apiVersion,omitempty"`
+
+	// RuntimeVersion is the software version of the TPU VMs.
+	RuntimeVersion string `json:"runtimeVersion,omitempty"`
+
+	// State is the state of the node, e.g. "READY".
+	State string `json:"state,omitempty"`
+
+	// Health is the health of the node, e.g. "HEALTHY".
+	Health string `json:"health,omitempty"`
+
+	// Labels are the labels of the node.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// NetworkEndpoints are the internal addresses of the TPU VMs of the node,
+	// one for every worker.
+	NetworkEndpoints []*NetworkEndpoint `json:"networkEndpoints,omitempty"`
+}
+
+// AcceleratorConfig is the TPU version and topology of a node.
+type AcceleratorConfig struct {
+	// Type is the TPU version, e.g. "V4".
+	Type string `json:"type,omitempty"`
+
+	// Topology is the chip topology, e.g. "2x2x4".
+	Topology string `json:"topology,omitempty"`
+}
+
+// NetworkEndpoint is the internal address of a TPU VM.
+type NetworkEndpoint struct {
+	IpAddress string `json:"ipAddress,omitempty"`
+}
+
+// ListNodesResponse is a page of nodes.
+type ListNodesResponse struct {
+	Nodes         []*Node `json:"nodes,omitempty"`
+	NextPageToken string  `json:"nextPageToken,omitempty"`
+
+	googleapi.ServerResponse `json:"-"`
+}
+
+// TPU defines the interface used by the tpu logic.
+type TPU interface {
+	LocationPages(ctx context.Context, f func(list *ListLocationsResponse) error) error
+	NodePages(ctx context.Context, location string, f func(list *ListNodesResponse) error) error
+}
+
+// TPUImpl implements the TPU interface.
+type TPUImpl struct {
+	project  string
+	client   *http.Client
+	basePath string
+}
+
+// NewTPU creates a new TPU for the given project that sends requests with
+// client to basePath, usually BasePath.
+func NewTPU(project string, client *http.Client, basePath string) *TPUImpl {
+	return &TPUImpl{project: project, client: client, basePath: basePath}
+}
+
+// LocationPages lists the locations of the project and calls the given
+// function for each "page" of results.
+func (t *TPUImpl) LocationPages(ctx context.Context, f func(list *ListLocationsResponse) error) error {
+	return apicall.Pages(ctx, api,
+		func(ctx context.Context, token string) (*ListLocationsResponse, error) {
+			list := &ListLocationsResponse{}
+			err := t.list(ctx, "projects/"+url.PathEscape(t.project)+"/locations", locationListFields, token, list, &list.ServerResponse)
+			return list, err
+		},
+		func(list *ListLocationsResponse) (http.Header, string) {
+			return list.Header, list.NextPageToken
+		},
+		f)
+}
+
+// NodePages lists the nodes of the given location and calls the given function
+// for each "page" of results.
+func (t *TPUImpl) NodePages(ctx context.Context, location string, f func(list *ListNodesResponse) error) error {
+	return apicall.Pages(ctx, api,
+		func(ctx context.Context, token string) (*ListNodesResponse, error) {
+			list := &ListNodesResponse{}
+			err := t.list(ctx, "projects/"+url.PathEscape(t.project)+"/locations/"+url.PathEscape(location)+"/nodes", nodeListFields, token, list, &list.ServerResponse)
+			return list, err
+		},
+		func(list *ListNodesResponse) (http.Header, string) {
+			return list.Header, list.NextPageToken
+		},
+		f)
+}
+
+// list requests one page of the collection at path into v, like the Do method
+// of a generated call, and records the response status in sr.
+func (t *TPUImpl) list(ctx context.Context, path, fields, token string, v interface{}, sr *googleapi.ServerResponse) error {
+	params := url.Values{"fields": {fields}}
+	if token != "" {
+		params.Set("pageToken", token)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.basePath+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer googleapi.CloseBody(resp)
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return err
+	}
+	*sr = googleapi.ServerResponse{Header: resp.Header, HTTPStatusCode: resp.StatusCode}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,223 @@
+// Package tpu implements service discovery for Cloud TPU VMs, e.g. v4 and v5
+// slices, emitting a target for the metrics agent of every TPU VM worker.
+package tpu
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	compute "google.golang.org/api/compute/v1"
+
+	"github.com/m-lab/gcp-service-discovery/apilimit"
+	"github.com/m-lab/gcp-service-discovery/credentials"
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/internal/apicall"
+	"github.com/m-lab/gcp-service-discovery/metrics"
+	"github.com/m-lab/gcp-service-discovery/tpu/iface"
+)
+
+// DefaultPort is the port of TPU VM targets unless changed by Service.Port, the
+// port of the Prometheus node exporter.
+const DefaultPort = 9100
+
+const (
+	tpuLabel             = "__tpu_"
+	labelProject         = tpuLabel + "project"
+	labelZone            = tpuLabel + "zone"
+	labelNode            = tpuLabel + "node"
+	labelWorker          = tpuLabel + "worker"
+	labelAcceleratorType = tpuLabel + "accelerator_type"
+	labelVersion         = tpuLabel + "version"
+	labelTopology        = tpuLabel + "topology"
+	labelRuntimeVersion  = tpuLabel + "runtime_version"
+	labelHealth          = tpuLabel + "health"
+	labelPrefix          = tpuLabel + "label_"
+)
+
+var (
+	// NodeCount is the number of TPU VM nodes by state.
+	//
+	// Provides metrics:
+	//   gcp_tpu_nodes{state="READY"}
+	// Example usage:
+	//   NodeCount.WithLabelValues("READY").Set(count)
+	NodeCount = metrics.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gcp_tpu_nodes",
+			Help: "Number of Cloud TPU VM nodes by state.",
+		},
+		[]string{"state"},
+	)
+)
+
+// Service discovers the TPU VMs of a project.
+type Service struct {
+	project string
+	api     iface.TPU
+
+	// connect creates api. It is called again to recreate the client after an
+	// authentication error.
+	connect func(ctx context.Context) error
+
+	// Port is the port of every target. When zero, DefaultPort is used.
+	Port int
+}
+
+// NewService returns a Service initialized with a Cloud TPU API client
+// authenticated by creds. The Service implements the discovery.Service
+// interface. NewService fails if the credentials are not found before ctx is
+// done.
+func NewService(ctx context.Context, project string, creds credentials.Config) (*Service, error) {
+	s := &Service{project: project}
+	s.connect = func(ctx context.Context) error {
+		client, err := creds.Client(ctx, compute.CloudPlatformScope)
+		if err != nil {
+			return fmt.Errorf("Error setting up Cloud TPU client: %s", err)
+		}
+		s.api = iface.NewTPU(project, apilimit.Client(client), iface.BasePath)
+		return nil
+	}
+	if err := s.connect(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Discover lists the TPU VM nodes of every zone, and returns a target for the
+// internal address of every worker of a ready node. After an authentication
+// error, Discover recreates its client and tries once more.
+func (s *Service) Discover(ctx context.Context) ([]discovery.StaticConfig, error) {
+	var targets []discovery.StaticConfig
+	err := credentials.Retry(ctx, "tpu", s.connect, func() error {
+		var err error
+		targets, err = s.discover(ctx)
+		return err
+	})
+	return targets, err
+}
+
+// discover lists every location and node once.
+func (s *Service) discover(ctx context.Context) ([]discovery.StaticConfig, error) {
+	var locations []string
+	err := s.api.LocationPages(ctx, func(list *iface.ListLocationsResponse) error {
+		for _, l := range list.Locations {
+			locations = append(locations, l.LocationId)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	targets := []discovery.StaticConfig{}
+	states := map[string]int{}
+	for _, location := range locations {
+		err := s.api.NodePages(ctx, location, func(list *iface.ListNodesResponse) error {
+			discovery.CountScanned(ctx, "nodes", len(list.Nodes))
+			for _, node := range list.Nodes {
+				object := location + "/" + path.Base(node.Name)
+				if !strings.HasPrefix(node.ApiVersion, "V2") {
+					discovery.Decide(ctx, object, false, "not a TPU VM")
+					continue
+				}
+				states[node.State]++
+				if node.State != "READY" {
+					discovery.Decide(ctx, object, false, "node "+node.State)
+					continue
+				}
+				configs := s.getTargets(location, node)
+				if len(configs) == 0 {
+					discovery.Decide(ctx, object, false, "no network endpoints")
+					continue
+				}
+				for _, config := range configs {
+					discovery.RecordOrigin(ctx, config, node)
+				}
+				discovery.Decide(ctx, object, true, "TPU VM "+node.AcceleratorType)
+				targets = append(targets, configs...)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	NodeCount.Reset()
+	for state, n := range states {
+		NodeCount.WithLabelValues(state).Set(float64(n))
+	}
+	return targets, nil
+}
+
+// getTargets creates a target configuration for the internal address of every
+// worker of a node. Workers are numbered in the order of the network endpoints
+// of the node.
+//
+// In serialized form, the label set of a worker looks like:
+//
+//	{
+//	    "labels": {
+//	        "__tpu_accelerator_type": "v4-32",
+//	        "__tpu_health": "HEALTHY",
+//	        "__tpu_label_team": "ml-infra",
+//	        "__tpu_node": "train-v4-32",
+//	        "__tpu_project": "mlab-sandbox",
+//	        "__tpu_runtime_version": "tpu-vm-v4-base",
+//	        "__tpu_topology": "2x2x4",
+//	        "__tpu_version": "V4",
+//	        "__tpu_worker": "0",
+//	        "__tpu_zone": "us-central2-b"
+//	    },
+//	    "targets": [
+//	        "10.130.0.4:9100"
+//	    ]
+//	}
+func (s *Service) getTargets(location string, node *iface.Node) []discovery.StaticConfig {
+	port := s.Port
+	if port == 0 {
+		port = DefaultPort
+	}
+	configs := []discovery.StaticConfig{}
+	for worker, endpoint := range node.NetworkEndpoints {
+		if endpoint.IpAddress == "" {
+			continue
+		}
+		labels := map[string]string{
+			labelProject:         s.project,
+			labelZone:            location,
+			labelNode:            path.Base(node.Name),
+			labelWorker:          strconv.Itoa(worker),
+			labelAcceleratorType: node.AcceleratorType,
+			labelRuntimeVersion:  node.RuntimeVersion,
+			labelHealth:          node.Health,
+		}
+		if node.AcceleratorConfig != nil {
+			labels[labelVersion] = node.AcceleratorConfig.Type
+			labels[labelTopology] = node.AcceleratorConfig.Topology
+		}
+		for k, v := range node.Labels {
+			labels[labelPrefix+strings.ReplaceAll(k, "-", "_")] = v
+		}
+		configs = append(configs, discovery.StaticConfig{
+			Targets: []string{endpoint.IpAddress + ":" + strconv.Itoa(port)},
+			Labels:  labels,
+		})
+	}
+	return configs
+}
+
+// Check verifies access to the Cloud TPU API by reading the first page of
+// locations. Check implements the discovery.Checker interface.
+func (s *Service) Check(ctx context.Context) error {
+	err := apicall.FirstPage(ctx, s.api.LocationPages)
+	if err != nil {
+		return fmt.Errorf("cannot list Cloud TPU locations in project %q; "+
+			"verify the Cloud TPU API is enabled and the credentials have the "+
+			"TPU Viewer role: %s", s.project, err)
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package tpu
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/m-lab/go/prometheusx/promtest"
+	"google.golang.org/api/googleapi"
+
+	"github.com/m-lab/gcp-service-discovery/credentials"
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/internal/schematest"
+	"github.com/m-lab/gcp-service-discovery/tpu/iface"
+)
+
+type fakeTPU struct {
+	nodes       map[string][]*iface.Node
+	locationErr error
+	nodeErr     error
+}
+
+func (f *fakeTPU) LocationPages(ctx context.Context, fn func(list *iface.ListLocationsResponse) error) error {
+	if f.locationErr != nil {
+		return f.locationErr
+	}
+	list := &iface.ListLocationsResponse{}
+	for _, l := range []string{"us-central1-a", "us-central2-b"} {
+		list.Locations = append(list.Locations, &iface.Location{LocationId: l})
+	}
+	return fn(list)
+}
+
+func (f *fakeTPU) NodePages(ctx context.Context, location string, fn func(list *iface.ListNodesResponse) error) error {
+	if f.nodeErr != nil {
+		return f.nodeErr
+	}
+	return fn(&iface.ListNodesResponse{Nodes: f.nodes[location]})
+}
+
+func newFakeNodes() map[string][]*iface.Node {
+	return map[string][]*iface.Node{
+		"us-central1-a": {
+			{
+				Name:             "projects/mlab-sandbox/locations/us-central1-a/nodes/legacy",
+				AcceleratorType:  "v3-8",
+				ApiVersion:       "V1",
+				State:            "READY",
+				NetworkEndpoints: []*iface.NetworkEndpoint{{IpAddress: "10.128.0.2"}},
+			},
+		},
+		"us-central2-b": {
+			{
+				Name:              "projects/mlab-sandbox/locations/us-central2-b/nodes/train",
+				AcceleratorType:   "v4-16",
+				AcceleratorConfig: &iface.AcceleratorConfig{Type: "V4", Topology: "2x2x2"},
+				ApiVersion:        "V2",
+				RuntimeVersion:    "tpu-vm-v4-base",
+				State:             "READY",
+				Health:            "HEALTHY",
+				Labels:            map[string]string{"ml-team": "infra"},
+				NetworkEndpoints: []*iface.NetworkEndpoint{
+					{IpAddress: "10.130.0.4"},
+					{IpAddress: "10.130.0.5"},
+				},
+			},
+			{
+				Name:       "projects/mlab-sandbox/locations/us-central2-b/nodes/creating",
+				ApiVersion: "V2_ALPHA1",
+				State:      "CREATING",
+			},
+		},
+	}
+}
+
+func TestService_Discover(t *testing.T) {
+	labels := func(worker string) map[string]string {
+		return map[string]string{
+			"__tpu_project":          "mlab-sandbox",
+			"__tpu_zone":             "us-central2-b",
+			"__tpu_node":             "train",
+			"__tpu_worker":           worker,
+			"__tpu_accelerator_type": "v4-16",
+			"__tpu_version":          "V4",
+			"__tpu_topology":         "2x2x2",
+			"__tpu_runtime_version":  "tpu-vm-v4-base",
+			"__tpu_health":           "HEALTHY",
+			"__tpu_label_ml_team":    "infra",
+		}
+	}
+	tests := []struct {
+		name    string
+		api     *fakeTPU
+		port    int
+		want    []discovery.StaticConfig
+		wantErr bool
+	}{
+		{
+			name: "success",
+			api:  &fakeTPU{nodes: newFakeNodes()},
+			port: 8431,
+			want: []discovery.StaticConfig{
+				{Targets: []string{"10.130.0.4:8431"}, Labels: labels("0")},
+				{Targets: []string{"10.130.0.5:8431"}, Labels: labels("1")},
+			},
+		},
+		{
+			name: "success-empty",
+			api:  &fakeTPU{},
+			want: []discovery.StaticConfig{},
+		},
+		{
+			name:    "failure-locations",
+			api:     &fakeTPU{locationErr: fmt.Errorf("forbidden")},
+			wantErr: true,
+		},
+		{
+			name:    "failure-nodes",
+			api:     &fakeTPU{nodeErr: fmt.Errorf("forbidden")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Service{project: "mlab-sandbox", api: tt.api, Port: tt.port}
+			got, err := s.Discover(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Service.Discover() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Service.Discover() = %v, want %v", got, tt.want)
+			}
+			data, _ := json.Marshal(got)
+			if err := schematest.Validate([]byte(discovery.Schema), data); err != nil && !tt.wantErr {
+				t.Errorf("Service.Discover() = %s, which does not match the schema: %v", data, err)
+			}
+		})
+	}
+}
+
+func TestService_DiscoverAuthRefresh(t *testing.T) {
+	s := &Service{project: "mlab-sandbox", api: &fakeTPU{locationErr: &googleapi.Error{Code: http.StatusUnauthorized}}}
+	connects := 0
+	s.connect = func(ctx context.Context) error {
+		connects++
+		s.api = &fakeTPU{nodes: newFakeNodes()}
+		return nil
+	}
+	got, err := s.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("Service.Discover() error = %v", err)
+	}
+	if connects != 1 || len(got) != 2 || got[0].Targets[0] != "10.130.0.4:9100" {
+		t.Errorf("Service.Discover() connected %d times and found %v, want 1 and two targets at the default port", connects, got)
+	}
+}
+
+func TestService_Check(t *testing.T) {
+	s := &Service{project: "mlab-sandbox", api: &fakeTPU{}}
+	if err := s.Check(context.Background()); err != nil {
+		t.Errorf("Service.Check() error = %v", err)
+	}
+	s.api = &fakeTPU{locationErr: fmt.Errorf("forbidden")}
+	if err := s.Check(context.Background()); err == nil {
+		t.Errorf("Service.Check() error = nil, want error")
+	}
+}
+
+func TestNewService(t *testing.T) {
+	if _, err := NewService(context.Background(), "mlab-sandbox", credentials.Config{}); err != nil {
+		t.Errorf("NewService() error = %v", err)
+	}
+}
+
+func TestNewTPU(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/projects/mlab-sandbox/locations":
+			fmt.Fprint(w, `{"locations": [{"locationId": "us-central2-b"}]}`)
+		case "/projects/mlab-sandbox/locations/us-central2-b/nodes":
+			if r.URL.Query().Get("pageToken") == "" {
+				fmt.Fprint(w, `{"nodes": [{"name": "a", "acceleratorConfig": {"type": "V4", "topology": "2x2x1"}}], "nextPageToken": "next"}`)
+				return
+			}
+			fmt.Fprint(w, `{"nodes": [{"name": "b", "networkEndpoints": [{"ipAddress": "10.130.0.4"}]}]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	tpu := iface.NewTPU("mlab-sandbox", srv.Client(), srv.URL+"/")
+	var locations []string
+	err := tpu.LocationPages(context.Background(), func(list *iface.ListLocationsResponse) error {
+		for _, l := range list.Locations {
+			locations = append(locations, l.LocationId)
+		}
+		return nil
+	})
+	if err != nil || !reflect.DeepEqual(locations, []string{"us-central2-b"}) {
+		t.Errorf("TPUImpl.LocationPages() = %v, %v, want [us-central2-b]", locations, err)
+	}
+	var nodes []*iface.Node
+	err = tpu.NodePages(context.Background(), "us-central2-b", func(list *iface.ListNodesResponse) error {
+		nodes = append(nodes, list.Nodes...)
+		return nil
+	})
+	if err != nil || len(nodes) != 2 || nodes[0].AcceleratorConfig.Topology != "2x2x1" ||
+		nodes[1].NetworkEndpoints[0].IpAddress != "10.130.0.4" {
+		t.Errorf("TPUImpl.NodePages() = %v, %v, want two decoded nodes", nodes, err)
+	}
+	err = tpu.NodePages(context.Background(), "unknown", func(list *iface.ListNodesResponse) error { return nil })
+	if e, ok := err.(*googleapi.Error); !ok || e.Code != http.StatusNotFound {
+		t.Errorf("TPUImpl.NodePages() error = %v, want a 404 googleapi.Error", err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	NodeCount.WithLabelValues("x")
+	promtest.LintMetrics(t)
+}
@@ -0,0 +1,120 @@
+// Package transport configures the network connections of the HTTP clients
+// created by all discovery sources. Connections honor the HTTPS_PROXY,
+// HTTP_PROXY, and NO_PROXY environment variables, and use a process-wide dial
+// timeout and TCP keep-alive period.
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Default dialer settings, matching http.DefaultTransport.
+const (
+	DefaultDialTimeout = 30 * time.Second
+	DefaultKeepAlive   = 30 * time.Second
+)
+
+var (
+	mu        sync.RWMutex
+	dialer    = &net.Dialer{Timeout: DefaultDialTimeout, KeepAlive: DefaultKeepAlive}
+	redirects = map[string]*url.URL{}
+)
+
+// Configure sets the dial timeout and TCP keep-alive period used by all
+// connections. Zero values restore the defaults, and a negative keepAlive
+// disables keep-alives. Configure should be called before clients are created.
+func Configure(dialTimeout, keepAlive time.Duration) {
+	if dialTimeout == 0 {
+		dialTimeout = DefaultDialTimeout
+	}
+	if keepAlive == 0 {
+		keepAlive = DefaultKeepAlive
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	dialer = &net.Dialer{Timeout: dialTimeout, KeepAlive: keepAlive}
+}
+
+// DialContext connects to the address on the named network using the
+// configured dialer.
+func DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	mu.RLock()
+	d := dialer
+	mu.RUnlock()
+	return d.DialContext(ctx, network, address)
+}
+
+// New returns a new Transport with the settings of http.DefaultTransport that
+// uses DialContext and honors the proxy environment variables.
+func New() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = http.ProxyFromEnvironment
+	t.DialContext = DialContext
+	return t
+}
+
+// Redirect sends the requests for host, e.g. "compute.googleapis.com", made by
+// clients built with Context to the scheme and host of target instead, e.g. a
+// Private Service Connect endpoint or a fake API server in tests. An empty
+// target removes the redirect. Redirect should be called before clients are
+// created.
+func Redirect(host, target string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if target == "" {
+		delete(redirects, host)
+		return nil
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("redirect target must be a URL with a scheme and host: %q", target)
+	}
+	redirects[host] = u
+	return nil
+}
+
+// redirectTransport rewrites the scheme and host of requests for redirected
+// hosts.
+type redirectTransport struct {
+	base      http.RoundTripper
+	redirects map[string]*url.URL
+}
+
+// RoundTrip sends req to its redirect target, if any, using the base transport.
+func (t *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if u, ok := t.redirects[req.URL.Host]; ok {
+		req = req.Clone(req.Context())
+		req.URL.Scheme = u.Scheme
+		req.URL.Host = u.Host
+		req.Host = u.Host
+	}
+	return t.base.RoundTrip(req)
+}
+
+// Context returns a copy of ctx that causes the oauth2 and google packages to
+// build clients, and fetch tokens, using a Transport returned by New, and the
+// current redirects.
+func Context(ctx context.Context) context.Context {
+	var rt http.RoundTripper = New()
+	mu.RLock()
+	if len(redirects) > 0 {
+		current := map[string]*url.URL{}
+		for k, v := range redirects {
+			current[k] = v
+		}
+		rt = &redirectTransport{base: rt, redirects: current}
+	}
+	mu.RUnlock()
+	return context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: rt})
+}
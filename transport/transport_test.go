@@ -0,0 +1,76 @@
+package transport
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestConfigure(t *testing.T) {
+	defer Configure(0, 0)
+	Configure(time.Second, -1)
+	if dialer.Timeout != time.Second || dialer.KeepAlive != -1 {
+		t.Errorf("Configure() dialer = %#v, want 1s timeout and no keep-alive", dialer)
+	}
+	Configure(0, 0)
+	if dialer.Timeout != DefaultDialTimeout || dialer.KeepAlive != DefaultKeepAlive {
+		t.Errorf("Configure() dialer = %#v, want defaults", dialer)
+	}
+}
+
+func TestNew(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	tr := New()
+	if tr.Proxy == nil {
+		t.Errorf("New() Proxy = nil, want proxy from environment")
+	}
+	c := &http.Client{Transport: tr}
+	resp, err := c.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("Client.Get() error = %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestContext(t *testing.T) {
+	ctx := Context(context.Background())
+	c, ok := ctx.Value(oauth2.HTTPClient).(*http.Client)
+	if !ok {
+		t.Fatalf("Context() did not set an oauth2.HTTPClient")
+	}
+	if _, ok := c.Transport.(*http.Transport); !ok {
+		t.Errorf("Context() client transport = %T, want *http.Transport", c.Transport)
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer ts.Close()
+	defer Redirect("compute.googleapis.com", "")
+
+	if err := Redirect("compute.googleapis.com", "not-a-url"); err == nil {
+		t.Errorf("Redirect() error = nil, want error")
+	}
+	if err := Redirect("compute.googleapis.com", ts.URL); err != nil {
+		t.Fatalf("Redirect() error = %v", err)
+	}
+	c := Context(context.Background()).Value(oauth2.HTTPClient).(*http.Client)
+	resp, err := c.Get("https://compute.googleapis.com/compute/v1/projects")
+	if err != nil {
+		t.Fatalf("Client.Get() error = %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "/compute/v1/projects" {
+		t.Errorf("Client.Get() path = %q, want /compute/v1/projects", body)
+	}
+}
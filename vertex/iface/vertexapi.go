@@ -0,0 +1,204 @@
+// Package iface defines an interface for accessing the Vertex AI and Notebooks
+// APIs. This is helpful for creating testable packages.
+//
+// The google.golang.org/api module used by this repository predates the Vertex
+// AI API, so the few Endpoint fields used by the vertex logic are decoded here
+// from the responses of the v1 REST API. Workbench instances are listed with
+// the Notebooks API client.
+package iface
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"google.golang.org/api/googleapi"
+	notebooks "google.golang.org/api/notebooks/v1"
+
+	"github.com/m-lab/gcp-service-discovery/internal/apicall"
+)
+
+// The names of the APIs in quota metrics.
+const (
+	vertexAPI    = "aiplatform"
+	notebooksAPI = "notebooks"
+)
+
+// BasePath is the URL of the Vertex AI v1 REST API. Vertex AI resources are
+// served by regional hosts, so "{location}" is replaced by the region of a
+// request and a dash, e.g. "us-central1-", or removed for global requests.
+const BasePath = "https://{location}aiplatform.googleapis.com/v1/"
+
+// locationListFields limits location list responses to the fields used by the
+// vertex logic.
+const locationListFields = "nextPageToken,locations(locationId)"
+
+// endpointListFields limits endpoint list responses to the fields used by the
+// vertex logic.
+const endpointListFields = "nextPageToken,endpoints(name,displayName,labels,deployedModels(id,model,displayName))"
+
+// instanceListFields limits Workbench instance list responses to the fields
+// used by the vertex logic.
+const instanceListFields = googleapi.Field("nextPageToken,instances(name,state,proxyUri,machineType,labels)")
+
+// Location is a region with Vertex AI resources.
+type Location struct {
+	LocationId string `json:"locationId,omitempty"`
+}
+
+// ListLocationsResponse is a page of locations.
+type ListLocationsResponse struct {
+	Locations     []*Location `json:"locations,omitempty"`
+	NextPageToken string      `json:"nextPageToken,omitempty"`
+
+	googleapi.ServerResponse `json:"-"`
+}
+
+// Endpoint is a Vertex AI prediction endpoint.
+type Endpoint struct {
+	// Name is the resource name of the endpoint, like
+	// projects/p/locations/l/endpoints/e.
+	Name string `json:"name,omitempty"`
+
+	// DisplayName is the name of the endpoint shown to users.
+	DisplayName string `json:"displayName,omitempty"`
+
+	// Labels are the labels of the endpoint.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// DeployedModels are the models served by the endpoint.
+	DeployedModels []*DeployedModel `json:"deployedModels,omitempty"`
+}
+
+// DeployedModel is a model deployed to an endpoint.
+type DeployedModel struct {
+	// Id is the ID of the deployment, unique within its endpoint.
+	Id string `json:"id,omitempty"`
+
+	// Model is the resource name of the model, like
+	// projects/p/locations/l/models/m.
+	Model string `json:"model,omitempty"`
+
+	// DisplayName is the name of the deployed model shown to users.
+	DisplayName string `json:"displayName,omitempty"`
+}
+
+// ListEndpointsResponse is a page of endpoints.
+type ListEndpointsResponse struct {
+	Endpoints     []*Endpoint `json:"endpoints,omitempty"`
+	NextPageToken string      `json:"nextPageToken,omitempty"`
+
+	googleapi.ServerResponse `json:"-"`
+}
+
+// Vertex defines the interface used by the vertex logic.
+type Vertex interface {
+	LocationPages(ctx context.Context, f func(list *ListLocationsResponse) error) error
+	EndpointPages(ctx context.Context, location string, f func(list *ListEndpointsResponse) error) error
+	NotebookLocationPages(ctx context.Context, f func(list *notebooks.ListLocationsResponse) error) error
+	InstancePages(ctx context.Context, location string, f func(list *notebooks.ListInstancesResponse) error) error
+}
+
+// VertexImpl implements the Vertex interface.
+type VertexImpl struct {
+	project   string
+	client    *http.Client
+	basePath  string
+	notebooks *notebooks.Service
+}
+
+// NewVertex creates a new Vertex for the given project that sends Vertex AI
+// requests with client to basePath, usually BasePath, and Notebooks requests
+// with the given service.
+func NewVertex(project string, client *http.Client, basePath string, service *notebooks.Service) *VertexImpl {
+	return &VertexImpl{project: project, client: client, basePath: basePath, notebooks: service}
+}
+
+// LocationPages lists the Vertex AI locations of the project and calls the
+// given function for each "page" of results.
+func (v *VertexImpl) LocationPages(ctx context.Context, f func(list *ListLocationsResponse) error) error {
+	return apicall.Pages(ctx, vertexAPI,
+		func(ctx context.Context, token string) (*ListLocationsResponse, error) {
+			list := &ListLocationsResponse{}
+			err := v.list(ctx, "", "/locations", locationListFields, token, list, &list.ServerResponse)
+			return list, err
+		},
+		func(list *ListLocationsResponse) (http.Header, string) {
+			return list.Header, list.NextPageToken
+		},
+		f)
+}
+
+// EndpointPages lists the endpoints of the given location and calls the given
+// function for each "page" of results.
+func (v *VertexImpl) EndpointPages(ctx context.Context, location string, f func(list *ListEndpointsResponse) error) error {
+	return apicall.Pages(ctx, vertexAPI,
+		func(ctx context.Context, token string) (*ListEndpointsResponse, error) {
+			list := &ListEndpointsResponse{}
+			err := v.list(ctx, location, "/locations/"+url.PathEscape(location)+"/endpoints", endpointListFields, token, list, &list.ServerResponse)
+			return list, err
+		},
+		func(list *ListEndpointsResponse) (http.Header, string) {
+			return list.Header, list.NextPageToken
+		},
+		f)
+}
+
+// NotebookLocationPages lists the Notebooks locations of the project and calls
+// the given function for each "page" of results.
+func (v *VertexImpl) NotebookLocationPages(ctx context.Context, f func(list *notebooks.ListLocationsResponse) error) error {
+	name := "projects/" + v.project
+	return apicall.Pages(ctx, notebooksAPI,
+		func(ctx context.Context, token string) (*notebooks.ListLocationsResponse, error) {
+			return v.notebooks.Projects.Locations.List(name).Fields("nextPageToken,locations(locationId)").PageToken(token).Context(ctx).Do()
+		},
+		func(list *notebooks.ListLocationsResponse) (http.Header, string) {
+			return list.Header, list.NextPageToken
+		},
+		f)
+}
+
+// InstancePages lists the Workbench instances of the given location and calls
+// the given function for each "page" of results.
+func (v *VertexImpl) InstancePages(ctx context.Context, location string, f func(list *notebooks.ListInstancesResponse) error) error {
+	parent := "projects/" + v.project + "/locations/" + location
+	return apicall.Pages(ctx, notebooksAPI,
+		func(ctx context.Context, token string) (*notebooks.ListInstancesResponse, error) {
+			return v.notebooks.Projects.Locations.Instances.List(parent).Fields(instanceListFields).PageToken(token).Context(ctx).Do()
+		},
+		func(list *notebooks.ListInstancesResponse) (http.Header, string) {
+			return list.Header, list.NextPageToken
+		},
+		f)
+}
+
+// list requests one page of the collection at path, relative to the project,
+// from the host of location into result, like the Do method of a generated
+// call, and records the response status in sr.
+func (v *VertexImpl) list(ctx context.Context, location, path, fields, token string, result interface{}, sr *googleapi.ServerResponse) error {
+	params := url.Values{"fields": {fields}}
+	if token != "" {
+		params.Set("pageToken", token)
+	}
+	prefix := ""
+	if location != "" {
+		prefix = location + "-"
+	}
+	u := strings.Replace(v.basePath, "{location}", prefix, 1) + "projects/" + url.PathEscape(v.project) + path + "?" + params.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer googleapi.CloseBody(resp)
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return err
+	}
+	*sr = googleapi.ServerResponse{Header: resp.Header, HTTPStatusCode: resp.StatusCode}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
@@ -0,0 +1,289 @@
+// Package vertex implements service discovery for the serving infrastructure of
+// Vertex AI: the models deployed to prediction endpoints, and Workbench
+// notebook instances. Every endpoint and instance URL is returned as a target,
+// for probing with the blackbox exporter.
+package vertex
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	notebooks "google.golang.org/api/notebooks/v1"
+
+	"github.com/m-lab/gcp-service-discovery/apilimit"
+	"github.com/m-lab/gcp-service-discovery/credentials"
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/internal/apicall"
+	"github.com/m-lab/gcp-service-discovery/metrics"
+	"github.com/m-lab/gcp-service-discovery/vertex/iface"
+)
+
+const (
+	vertexLabel        = "__vertex_"
+	labelKind          = vertexLabel + "kind"
+	labelProject       = vertexLabel + "project"
+	labelLocation      = vertexLabel + "location"
+	labelEndpoint      = vertexLabel + "endpoint"
+	labelEndpointName  = vertexLabel + "endpoint_name"
+	labelModel         = vertexLabel + "model"
+	labelModelName     = vertexLabel + "model_name"
+	labelDeployedModel = vertexLabel + "deployed_model"
+	labelInstance      = vertexLabel + "instance"
+	labelMachineType   = vertexLabel + "machine_type"
+	labelPrefix        = vertexLabel + "label_"
+
+	// Values of labelKind.
+	kindEndpoint  = "endpoint"
+	kindWorkbench = "workbench"
+)
+
+var (
+	// newNotebooksClient allocates a new Notebooks client. The indirection
+	// facilitates testing.
+	newNotebooksClient = notebooks.New
+)
+
+var (
+	// TargetCount is the number of discovered Vertex AI targets by kind.
+	//
+	// Provides metrics:
+	//   gcp_vertex_targets{kind="endpoint"}
+	// Example usage:
+	//   TargetCount.WithLabelValues("endpoint").Set(count)
+	TargetCount = metrics.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gcp_vertex_targets",
+			Help: "Number of discovered Vertex AI targets by kind.",
+		},
+		[]string{"kind"},
+	)
+)
+
+// Service discovers the prediction endpoints and Workbench instances of a
+// project.
+type Service struct {
+	project  string
+	api      iface.Vertex
+	basePath string
+
+	// connect creates api. It is called again to recreate the clients after
+	// an authentication error.
+	connect func(ctx context.Context) error
+}
+
+// NewService returns a Service initialized with Vertex AI and Notebooks API
+// clients authenticated by creds. The Service implements the discovery.Service
+// interface. NewService fails if the credentials are not found before ctx is
+// done.
+func NewService(ctx context.Context, project string, creds credentials.Config) (*Service, error) {
+	s := &Service{project: project, basePath: iface.BasePath}
+	s.connect = func(ctx context.Context) error {
+		client, err := creds.Client(ctx, notebooks.CloudPlatformScope)
+		if err != nil {
+			return fmt.Errorf("Error setting up API clients: %s", err)
+		}
+		client = apilimit.Client(client)
+		n, err := newNotebooksClient(client)
+		if err != nil {
+			return fmt.Errorf("Error setting up Notebooks client: %s", err)
+		}
+		s.api = iface.NewVertex(project, client, s.basePath, n)
+		return nil
+	}
+	if err := s.connect(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Discover lists the prediction endpoints of every Vertex AI region and the
+// Workbench instances of every zone. Discover returns a target for every model
+// deployed to an endpoint, and for the proxy URL of every active instance.
+// After an authentication error, Discover recreates its clients and tries once
+// more.
+func (s *Service) Discover(ctx context.Context) ([]discovery.StaticConfig, error) {
+	var targets []discovery.StaticConfig
+	err := credentials.Retry(ctx, "vertex", s.connect, func() error {
+		var err error
+		targets, err = s.discover(ctx)
+		return err
+	})
+	return targets, err
+}
+
+// discover lists every endpoint and instance once.
+func (s *Service) discover(ctx context.Context) ([]discovery.StaticConfig, error) {
+	var locations []string
+	err := s.api.LocationPages(ctx, func(list *iface.ListLocationsResponse) error {
+		for _, l := range list.Locations {
+			locations = append(locations, l.LocationId)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	targets := []discovery.StaticConfig{}
+	for _, location := range locations {
+		err := s.api.EndpointPages(ctx, location, func(list *iface.ListEndpointsResponse) error {
+			discovery.CountScanned(ctx, "endpoints", len(list.Endpoints))
+			for _, endpoint := range list.Endpoints {
+				object := location + "/endpoints/" + path.Base(endpoint.Name)
+				if len(endpoint.DeployedModels) == 0 {
+					discovery.Decide(ctx, object, false, "no deployed models")
+					continue
+				}
+				for _, config := range s.endpointLabels(location, endpoint) {
+					discovery.RecordOrigin(ctx, config, endpoint)
+					targets = append(targets, config)
+				}
+				discovery.Decide(ctx, object, true, "endpoint with deployed models")
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	endpoints := len(targets)
+
+	locations = nil
+	err = s.api.NotebookLocationPages(ctx, func(list *notebooks.ListLocationsResponse) error {
+		for _, l := range list.Locations {
+			locations = append(locations, l.LocationId)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, location := range locations {
+		err := s.api.InstancePages(ctx, location, func(list *notebooks.ListInstancesResponse) error {
+			discovery.CountScanned(ctx, "instances", len(list.Instances))
+			for _, instance := range list.Instances {
+				object := location + "/instances/" + path.Base(instance.Name)
+				if instance.State != "ACTIVE" {
+					discovery.Decide(ctx, object, false, "instance "+instance.State)
+					continue
+				}
+				if instance.ProxyUri == "" {
+					discovery.Decide(ctx, object, false, "no proxy URL")
+					continue
+				}
+				config := s.instanceLabels(location, instance)
+				discovery.RecordOrigin(ctx, config, instance)
+				discovery.Decide(ctx, object, true, "active instance")
+				targets = append(targets, config)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	TargetCount.WithLabelValues(kindEndpoint).Set(float64(endpoints))
+	TargetCount.WithLabelValues(kindWorkbench).Set(float64(len(targets) - endpoints))
+	return targets, nil
+}
+
+// endpointLabels creates a target configuration for the URL of an endpoint for
+// every model deployed to it.
+//
+// In serialized form, the label set of a deployed model looks like:
+//
+//	{
+//	    "labels": {
+//	        "__vertex_deployed_model": "4851396212271857664",
+//	        "__vertex_endpoint": "1234567890123456789",
+//	        "__vertex_endpoint_name": "speedtest-classifier",
+//	        "__vertex_kind": "endpoint",
+//	        "__vertex_label_team": "ml-platform",
+//	        "__vertex_location": "us-central1",
+//	        "__vertex_model": "987654321098765432",
+//	        "__vertex_model_name": "classifier-v3",
+//	        "__vertex_project": "mlab-sandbox"
+//	    },
+//	    "targets": [
+//	        "https://us-central1-aiplatform.googleapis.com/v1/projects/123/locations/us-central1/endpoints/1234567890123456789"
+//	    ]
+//	}
+func (s *Service) endpointLabels(location string, endpoint *iface.Endpoint) []discovery.StaticConfig {
+	url := strings.Replace(s.basePath, "{location}", location+"-", 1) + endpoint.Name
+	configs := []discovery.StaticConfig{}
+	for _, model := range endpoint.DeployedModels {
+		labels := map[string]string{
+			labelKind:          kindEndpoint,
+			labelProject:       s.project,
+			labelLocation:      location,
+			labelEndpoint:      path.Base(endpoint.Name),
+			labelEndpointName:  endpoint.DisplayName,
+			labelModel:         path.Base(model.Model),
+			labelModelName:     model.DisplayName,
+			labelDeployedModel: model.Id,
+		}
+		for k, v := range endpoint.Labels {
+			labels[labelPrefix+strings.ReplaceAll(k, "-", "_")] = v
+		}
+		configs = append(configs, discovery.StaticConfig{
+			Targets: []string{url},
+			Labels:  labels,
+		})
+	}
+	return configs
+}
+
+// instanceLabels creates a target configuration for the proxy URL of a
+// Workbench instance.
+//
+// In serialized form, the label set look like:
+//
+//	{
+//	    "labels": {
+//	        "__vertex_instance": "analysis",
+//	        "__vertex_kind": "workbench",
+//	        "__vertex_location": "us-central1-a",
+//	        "__vertex_machine_type": "n1-standard-4",
+//	        "__vertex_project": "mlab-sandbox"
+//	    },
+//	    "targets": [
+//	        "https://1a2b3c4d5e6f7a8b-dot-us-central1.notebooks.googleusercontent.com"
+//	    ]
+//	}
+func (s *Service) instanceLabels(location string, instance *notebooks.Instance) discovery.StaticConfig {
+	labels := map[string]string{
+		labelKind:        kindWorkbench,
+		labelProject:     s.project,
+		labelLocation:    location,
+		labelInstance:    path.Base(instance.Name),
+		labelMachineType: path.Base(instance.MachineType),
+	}
+	for k, v := range instance.Labels {
+		labels[labelPrefix+strings.ReplaceAll(k, "-", "_")] = v
+	}
+	return discovery.StaticConfig{
+		Targets: []string{"https://" + strings.TrimPrefix(instance.ProxyUri, "https://")},
+		Labels:  labels,
+	}
+}
+
+// Check verifies access to the Vertex AI and Notebooks APIs by reading the
+// first page of locations of both. Check implements the discovery.Checker
+// interface.
+func (s *Service) Check(ctx context.Context) error {
+	err := apicall.FirstPage(ctx, s.api.LocationPages)
+	if err != nil {
+		return fmt.Errorf("cannot list Vertex AI locations in project %q; "+
+			"verify the Vertex AI API is enabled and the credentials have the "+
+			"Vertex AI Viewer role: %s", s.project, err)
+	}
+	err = apicall.FirstPage(ctx, s.api.NotebookLocationPages)
+	if err != nil {
+		return fmt.Errorf("cannot list Notebooks locations in project %q; "+
+			"verify the Notebooks API is enabled and the credentials have the "+
+			"Notebooks Viewer role: %s", s.project, err)
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+package vertex
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/m-lab/go/prometheusx/promtest"
+	"google.golang.org/api/googleapi"
+	notebooks "google.golang.org/api/notebooks/v1"
+
+	"github.com/m-lab/gcp-service-discovery/credentials"
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/internal/schematest"
+	"github.com/m-lab/gcp-service-discovery/vertex/iface"
+)
+
+type fakeVertex struct {
+	endpoints   map[string][]*iface.Endpoint
+	instances   map[string][]*notebooks.Instance
+	locationErr error
+	instanceErr error
+}
+
+func (f *fakeVertex) LocationPages(ctx context.Context, fn func(list *iface.ListLocationsResponse) error) error {
+	if f.locationErr != nil {
+		return f.locationErr
+	}
+	list := &iface.ListLocationsResponse{}
+	for _, l := range []string{"us-central1", "us-east1"} {
+		list.Locations = append(list.Locations, &iface.Location{LocationId: l})
+	}
+	return fn(list)
+}
+
+func (f *fakeVertex) EndpointPages(ctx context.Context, location string, fn func(list *iface.ListEndpointsResponse) error) error {
+	return fn(&iface.ListEndpointsResponse{Endpoints: f.endpoints[location]})
+}
+
+func (f *fakeVertex) NotebookLocationPages(ctx context.Context, fn func(list *notebooks.ListLocationsResponse) error) error {
+	return fn(&notebooks.ListLocationsResponse{
+		Locations: []*notebooks.Location{{LocationId: "us-central1-a"}},
+	})
+}
+
+func (f *fakeVertex) InstancePages(ctx context.Context, location string, fn func(list *notebooks.ListInstancesResponse) error) error {
+	if f.instanceErr != nil {
+		return f.instanceErr
+	}
+	return fn(&notebooks.ListInstancesResponse{Instances: f.instances[location]})
+}
+
+func newFakeVertex() *fakeVertex {
+	return &fakeVertex{
+		endpoints: map[string][]*iface.Endpoint{
+			"us-central1": {
+				{
+					Name:        "projects/123/locations/us-central1/endpoints/111",
+					DisplayName: "classifier",
+					Labels:      map[string]string{"ml-team": "platform"},
+					DeployedModels: []*iface.DeployedModel{
+						{Id: "1", Model: "projects/123/locations/us-central1/models/501", DisplayName: "classifier-v2"},
+						{Id: "2", Model: "projects/123/locations/us-central1/models/502", DisplayName: "classifier-v3"},
+					},
+				},
+			},
+			"us-east1": {
+				{Name: "projects/123/locations/us-east1/endpoints/222", DisplayName: "empty"},
+			},
+		},
+		instances: map[string][]*notebooks.Instance{
+			"us-central1-a": {
+				{
+					Name:        "projects/mlab-sandbox/locations/us-central1-a/instances/analysis",
+					State:       "ACTIVE",
+					ProxyUri:    "1a2b3c-dot-us-central1.notebooks.googleusercontent.com",
+					MachineType: "https://www.googleapis.com/compute/v1/projects/mlab-sandbox/zones/us-central1-a/machineTypes/n1-standard-4",
+				},
+				{Name: "projects/mlab-sandbox/locations/us-central1-a/instances/stopped", State: "STOPPED"},
+				{Name: "projects/mlab-sandbox/locations/us-central1-a/instances/no-proxy", State: "ACTIVE"},
+			},
+		},
+	}
+}
+
+func TestService_Discover(t *testing.T) {
+	endpoint := func(model, name, id string) discovery.StaticConfig {
+		return discovery.StaticConfig{
+			Targets: []string{"https://us-central1-aiplatform.googleapis.com/v1/projects/123/locations/us-central1/endpoints/111"},
+			Labels: map[string]string{
+				"__vertex_kind":           "endpoint",
+				"__vertex_project":        "mlab-sandbox",
+				"__vertex_location":       "us-central1",
+				"__vertex_endpoint":       "111",
+				"__vertex_endpoint_name":  "classifier",
+				"__vertex_model":          model,
+				"__vertex_model_name":     name,
+				"__vertex_deployed_model": id,
+				"__vertex_label_ml_team":  "platform",
+			},
+		}
+	}
+	tests := []struct {
+		name    string
+		api     *fakeVertex
+		want    []discovery.StaticConfig
+		wantErr bool
+	}{
+		{
+			name: "success",
+			api:  newFakeVertex(),
+			want: []discovery.StaticConfig{
+				endpoint("501", "classifier-v2", "1"),
+				endpoint("502", "classifier-v3", "2"),
+				{
+					Targets: []string{"https://1a2b3c-dot-us-central1.notebooks.googleusercontent.com"},
+					Labels: map[string]string{
+						"__vertex_kind":         "workbench",
+						"__vertex_project":      "mlab-sandbox",
+						"__vertex_location":     "us-central1-a",
+						"__vertex_instance":     "analysis",
+						"__vertex_machine_type": "n1-standard-4",
+					},
+				},
+			},
+		},
+		{
+			name: "success-empty",
+			api:  &fakeVertex{},
+			want: []discovery.StaticConfig{},
+		},
+		{
+			name:    "failure-locations",
+			api:     &fakeVertex{locationErr: fmt.Errorf("forbidden")},
+			wantErr: true,
+		},
+		{
+			name:    "failure-instances",
+			api:     &fakeVertex{instanceErr: fmt.Errorf("forbidden")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Service{project: "mlab-sandbox", api: tt.api, basePath: iface.BasePath}
+			got, err := s.Discover(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Service.Discover() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Service.Discover() = %v, want %v", got, tt.want)
+			}
+			if err != nil {
+				return
+			}
+			data, _ := json.Marshal(got)
+			if err := schematest.Validate([]byte(discovery.Schema), data); err != nil {
+				t.Errorf("Service.Discover() = %s, which does not match the schema: %v", data, err)
+			}
+		})
+	}
+}
+
+func TestService_DiscoverAuthRefresh(t *testing.T) {
+	s := &Service{
+		project:  "mlab-sandbox",
+		api:      &fakeVertex{locationErr: &googleapi.Error{Code: http.StatusUnauthorized}},
+		basePath: iface.BasePath,
+	}
+	connects := 0
+	s.connect = func(ctx context.Context) error {
+		connects++
+		s.api = newFakeVertex()
+		return nil
+	}
+	got, err := s.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("Service.Discover() error = %v", err)
+	}
+	if connects != 1 || len(got) != 3 {
+		t.Errorf("Service.Discover() connected %d times and found %d targets, want 1 and 3", connects, len(got))
+	}
+}
+
+func TestService_Check(t *testing.T) {
+	s := &Service{project: "mlab-sandbox", api: &fakeVertex{}}
+	if err := s.Check(context.Background()); err != nil {
+		t.Errorf("Service.Check() error = %v", err)
+	}
+	s.api = &fakeVertex{locationErr: fmt.Errorf("forbidden")}
+	if err := s.Check(context.Background()); err == nil {
+		t.Errorf("Service.Check() error = nil, want error")
+	}
+}
+
+func TestNewService(t *testing.T) {
+	orig := newNotebooksClient
+	defer func() { newNotebooksClient = orig }()
+	if _, err := NewService(context.Background(), "mlab-sandbox", credentials.Config{}); err != nil {
+		t.Errorf("NewService() error = %v", err)
+	}
+	newNotebooksClient = func(client *http.Client) (*notebooks.Service, error) {
+		return nil, fmt.Errorf("failed to create client")
+	}
+	if _, err := NewService(context.Background(), "mlab-sandbox", credentials.Config{}); err == nil {
+		t.Errorf("NewService() error = nil, want error")
+	}
+}
+
+func TestNewVertex(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/projects/mlab-sandbox/locations":
+			fmt.Fprint(w, `{"locations": [{"locationId": "us-central1"}]}`)
+		case "/projects/mlab-sandbox/locations/us-central1/endpoints":
+			if r.URL.Query().Get("pageToken") == "" {
+				fmt.Fprint(w, `{"endpoints": [{"name": "a"}], "nextPageToken": "next"}`)
+				return
+			}
+			fmt.Fprint(w, `{"endpoints": [{"name": "b", "deployedModels": [{"id": "1", "model": "m"}]}]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	v := iface.NewVertex("mlab-sandbox", srv.Client(), srv.URL+"/{location}", nil)
+	var locations []string
+	err := v.LocationPages(context.Background(), func(list *iface.ListLocationsResponse) error {
+		for _, l := range list.Locations {
+			locations = append(locations, l.LocationId)
+		}
+		return nil
+	})
+	if err != nil || !reflect.DeepEqual(locations, []string{"us-central1"}) {
+		t.Errorf("VertexImpl.LocationPages() = %v, %v, want [us-central1]", locations, err)
+	}
+
+	// Regional requests are sent to a path prefixed by the region, as the
+	// server has no regional hosts.
+	err = v.EndpointPages(context.Background(), "us-central1", func(list *iface.ListEndpointsResponse) error { return nil })
+	if e, ok := err.(*googleapi.Error); !ok || e.Code != http.StatusNotFound {
+		t.Errorf("VertexImpl.EndpointPages() error = %v, want a 404 googleapi.Error", err)
+	}
+
+	v = iface.NewVertex("mlab-sandbox", srv.Client(), srv.URL+"/", nil)
+	var endpoints []*iface.Endpoint
+	err = v.EndpointPages(context.Background(), "us-central1", func(list *iface.ListEndpointsResponse) error {
+		endpoints = append(endpoints, list.Endpoints...)
+		return nil
+	})
+	if err != nil || len(endpoints) != 2 || endpoints[1].DeployedModels[0].Model != "m" {
+		t.Errorf("VertexImpl.EndpointPages() = %v, %v, want two decoded endpoints", endpoints, err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	TargetCount.WithLabelValues("x")
+	promtest.LintMetrics(t)
+}
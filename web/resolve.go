@@ -0,0 +1,224 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/metrics"
+)
+
+// LabelHostname is the original hostname of a target whose address was
+// resolved by a Resolver.
+const LabelHostname = "__web_hostname"
+
+const (
+	// DefaultResolveTTL is how long a resolved address is reused before the
+	// hostname is resolved again.
+	DefaultResolveTTL = 5 * time.Minute
+
+	// DefaultMaxStale is how long an address is still used after its TTL
+	// while the hostname cannot be resolved.
+	DefaultMaxStale = time.Hour
+)
+
+// now returns the current time. The indirection facilitates testing.
+var now = time.Now
+
+var (
+	// resolutions counts the addresses of target hostnames by result: resolved,
+	// cached, stale, or failed.
+	//
+	// Provides metrics:
+	//   gcp_web_resolutions_total{result="stale"}
+	// Example usage:
+	//   resolutions.WithLabelValues("stale").Inc()
+	resolutions = metrics.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gcp_web_resolutions_total",
+			Help: "Number of target hostname resolutions by result.",
+		},
+		[]string{"result"},
+	)
+)
+
+// Resolver replaces the hostnames of targets with their IP addresses, so that
+// scrapes continue during DNS outages. Every resolved target is written in its
+// own group, labeled with its original hostname as LabelHostname.
+//
+// The Go resolver does not report the TTL of DNS records, so addresses are
+// reused for a fixed TTL, which should not exceed the TTL of the records. When
+// a hostname cannot be resolved again, its pinned address is used for up to
+// maxStale after the TTL. Resolver is safe for concurrent use by several
+// services.
+type Resolver struct {
+	ttl      time.Duration
+	maxStale time.Duration
+
+	// lookup returns the addresses of a host. The indirection facilitates
+	// testing.
+	lookup func(ctx context.Context, host string) ([]string, error)
+
+	mu   sync.Mutex
+	pins map[string]*pin
+}
+
+// pin is the pinned address of one hostname.
+type pin struct {
+	addr     string
+	resolved time.Time
+}
+
+// NewResolver creates a Resolver that reuses addresses for ttl, and pins them
+// for up to maxStale longer while resolution fails.
+func NewResolver(ttl, maxStale time.Duration) *Resolver {
+	return &Resolver{
+		ttl:      ttl,
+		maxStale: maxStale,
+		lookup:   net.DefaultResolver.LookupHost,
+		pins:     map[string]*pin{},
+	}
+}
+
+// Resolve returns a copy of configs with every target hostname replaced by
+// its address. Targets that are IP addresses or URLs, or whose hostname cannot
+// be resolved and has no pinned address, are returned unchanged, so
+// resolution never causes discovery to fail.
+func (r *Resolver) Resolve(ctx context.Context, configs []discovery.StaticConfig) []discovery.StaticConfig {
+	r.expire()
+	result := make([]discovery.StaticConfig, 0, len(configs))
+	for _, c := range configs {
+		var kept []string
+		var resolved []discovery.StaticConfig
+		for _, target := range c.Targets {
+			host, port := splitTarget(target)
+			if host == "" {
+				kept = append(kept, target)
+				continue
+			}
+			addr := r.address(ctx, host)
+			if addr == "" {
+				kept = append(kept, target)
+				continue
+			}
+			labels := make(map[string]string, len(c.Labels)+1)
+			for k, v := range c.Labels {
+				labels[k] = v
+			}
+			labels[LabelHostname] = host
+			resolved = append(resolved, discovery.StaticConfig{
+				Targets: []string{joinTarget(addr, port)},
+				Labels:  labels,
+			})
+		}
+		if len(resolved) == 0 {
+			result = append(result, c)
+			continue
+		}
+		if len(kept) > 0 {
+			result = append(result, discovery.StaticConfig{Targets: kept, Labels: c.Labels})
+		}
+		result = append(result, resolved...)
+	}
+	return result
+}
+
+// address returns the pinned address of host, or the empty string if host
+// cannot be resolved.
+func (r *Resolver) address(ctx context.Context, host string) string {
+	r.mu.Lock()
+	p := r.pins[host]
+	r.mu.Unlock()
+	if p != nil && now().Sub(p.resolved) < r.ttl {
+		resolutions.WithLabelValues("cached").Inc()
+		return p.addr
+	}
+
+	addrs, err := r.lookup(ctx, host)
+	if err == nil && len(addrs) == 0 {
+		err = errors.New("no addresses")
+	}
+	if err != nil {
+		if p != nil {
+			log.Printf("Failed to resolve %s, using pinned address %s: %s", host, p.addr, err)
+			resolutions.WithLabelValues("stale").Inc()
+			return p.addr
+		}
+		log.Printf("Failed to resolve %s: %s", host, err)
+		resolutions.WithLabelValues("failed").Inc()
+		return ""
+	}
+	addr := choose(addrs, p)
+	r.mu.Lock()
+	r.pins[host] = &pin{addr: addr, resolved: now()}
+	r.mu.Unlock()
+	resolutions.WithLabelValues("resolved").Inc()
+	return addr
+}
+
+// expire removes pins older than the TTL and the maximum staleness.
+func (r *Resolver) expire() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for host, p := range r.pins {
+		if now().Sub(p.resolved) >= r.ttl+r.maxStale {
+			delete(r.pins, host)
+		}
+	}
+}
+
+// choose returns the previous address if it was resolved again, so targets do
+// not move between the addresses of round-robin records. Otherwise, choose
+// returns the first IPv4 address, or the first address.
+func choose(addrs []string, previous *pin) string {
+	if previous != nil {
+		for _, addr := range addrs {
+			if addr == previous.addr {
+				return addr
+			}
+		}
+	}
+	sorted := append([]string{}, addrs...)
+	sort.Strings(sorted)
+	for _, addr := range sorted {
+		if ip := net.ParseIP(addr); ip != nil && ip.To4() != nil {
+			return addr
+		}
+	}
+	return sorted[0]
+}
+
+// splitTarget returns the hostname and port of a target, or an empty hostname
+// if the target is an IP address or a URL.
+func splitTarget(target string) (host, port string) {
+	if strings.Contains(target, "/") {
+		return "", ""
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		host, port = target, ""
+	}
+	if host == "" || net.ParseIP(host) != nil {
+		return "", ""
+	}
+	return host, port
+}
+
+// joinTarget formats an address and an optional port as a target.
+func joinTarget(addr, port string) string {
+	if port != "" {
+		return net.JoinHostPort(addr, port)
+	}
+	if strings.Contains(addr, ":") {
+		return "[" + addr + "]"
+	}
+	return addr
+}
@@ -0,0 +1,148 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/prometheusx/promtest"
+
+	"github.com/m-lab/gcp-service-discovery/discovery"
+)
+
+// fakeLookup resolves hosts from a table, and fails for other hosts.
+type fakeLookup struct {
+	hosts map[string][]string
+	calls int
+}
+
+func (f *fakeLookup) lookup(ctx context.Context, host string) ([]string, error) {
+	f.calls++
+	addrs, ok := f.hosts[host]
+	if !ok {
+		return nil, fmt.Errorf("no such host %s", host)
+	}
+	return addrs, nil
+}
+
+func newFakeResolver(hosts map[string][]string) (*Resolver, *fakeLookup) {
+	f := &fakeLookup{hosts: hosts}
+	r := NewResolver(time.Minute, time.Hour)
+	r.lookup = f.lookup
+	return r, f
+}
+
+func TestResolver_Resolve(t *testing.T) {
+	r, _ := newFakeResolver(map[string][]string{
+		"a.example.com": {"2001:db8::1", "192.0.2.2", "192.0.2.1"},
+		"b.example.com": {"2001:db8::2"},
+	})
+	configs := []discovery.StaticConfig{
+		{
+			Targets: []string{"a.example.com:9100", "192.0.2.9:9100", "missing.example.com:9100", "https://a.example.com/probe"},
+			Labels:  map[string]string{"job": "node"},
+		},
+		{
+			Targets: []string{"b.example.com"},
+		},
+		{
+			Targets: []string{"[2001:db8::3]:80"},
+		},
+	}
+	want := []discovery.StaticConfig{
+		{
+			Targets: []string{"192.0.2.9:9100", "missing.example.com:9100", "https://a.example.com/probe"},
+			Labels:  map[string]string{"job": "node"},
+		},
+		{
+			Targets: []string{"192.0.2.1:9100"},
+			Labels:  map[string]string{"job": "node", LabelHostname: "a.example.com"},
+		},
+		{
+			Targets: []string{"[2001:db8::2]"},
+			Labels:  map[string]string{LabelHostname: "b.example.com"},
+		},
+		{
+			Targets: []string{"[2001:db8::3]:80"},
+		},
+	}
+	got := r.Resolve(context.Background(), configs)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Resolver.Resolve() = %v, want %v", got, want)
+	}
+	if configs[0].Labels[LabelHostname] != "" {
+		t.Errorf("Resolver.Resolve() modified the original labels")
+	}
+}
+
+func TestResolver_address(t *testing.T) {
+	current := time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+
+	r, f := newFakeResolver(map[string][]string{"a.example.com": {"192.0.2.2", "192.0.2.1"}})
+	ctx := context.Background()
+	if got := r.address(ctx, "a.example.com"); got != "192.0.2.1" {
+		t.Errorf("Resolver.address() = %q, want 192.0.2.1", got)
+	}
+
+	// Addresses are reused within the TTL.
+	current = current.Add(30 * time.Second)
+	f.hosts["a.example.com"] = []string{"192.0.2.3"}
+	if got := r.address(ctx, "a.example.com"); got != "192.0.2.1" || f.calls != 1 {
+		t.Errorf("Resolver.address() = %q after %d lookups, want cached 192.0.2.1", got, f.calls)
+	}
+
+	// The previous address is kept while it is still resolved.
+	current = current.Add(time.Minute)
+	f.hosts["a.example.com"] = []string{"192.0.2.3", "192.0.2.1"}
+	if got := r.address(ctx, "a.example.com"); got != "192.0.2.1" {
+		t.Errorf("Resolver.address() = %q, want 192.0.2.1", got)
+	}
+
+	// Pinned addresses are used during DNS failures, up to the maximum
+	// staleness.
+	delete(f.hosts, "a.example.com")
+	current = current.Add(30 * time.Minute)
+	r.expire()
+	if got := r.address(ctx, "a.example.com"); got != "192.0.2.1" {
+		t.Errorf("Resolver.address() = %q, want pinned 192.0.2.1", got)
+	}
+	current = current.Add(time.Hour)
+	r.expire()
+	if got := r.address(ctx, "a.example.com"); got != "" {
+		t.Errorf("Resolver.address() = %q, want no address after the maximum staleness", got)
+	}
+}
+
+func TestService_DiscoverResolve(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"targets": ["a.example.com:9100"]}]`)
+	}))
+	defer ts.Close()
+	s := NewService(ts.URL)
+	s.Passthrough = true
+	s.Resolver, _ = newFakeResolver(map[string][]string{"a.example.com": {"192.0.2.1"}})
+	got, err := s.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("Service.Discover() error = %v", err)
+	}
+	want := []discovery.StaticConfig{
+		{Targets: []string{"192.0.2.1:9100"}, Labels: map[string]string{LabelHostname: "a.example.com"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Service.Discover() = %v, want %v", got, want)
+	}
+	if s.Raw() != nil {
+		t.Errorf("Service.Raw() = %q, want nil for resolved targets", s.Raw())
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	resolutions.WithLabelValues("x")
+	promtest.LintMetrics(t)
+}
@@ -9,6 +9,7 @@ import (
 	"net/http"
 
 	"github.com/m-lab/gcp-service-discovery/discovery"
+	"github.com/m-lab/gcp-service-discovery/transport"
 )
 
 // Enable unit testing of readAll.
@@ -22,6 +23,18 @@ type Service struct {
 	// client is used for each web download.
 	client http.Client
 
+	// Passthrough causes Raw to return the original downloaded document, so
+	// it is written without re-serialization. This preserves upstream
+	// formatting and any fields unknown to discovery.StaticConfig.
+	Passthrough bool
+
+	// Resolver, when not nil, replaces the hostnames of targets with their
+	// addresses. Resolved documents are re-serialized, even with Passthrough.
+	Resolver *Resolver
+
+	// raw is the document downloaded by the most recent successful Discover.
+	raw []byte
+
 	// TODO: add cache to determine whether to update.
 }
 
@@ -31,9 +44,28 @@ type Service struct {
 func NewService(srcURL string) *Service {
 	return &Service{
 		srcURL: srcURL,
+		client: http.Client{Transport: transport.New()},
 	}
 }
 
+// Check verifies that the source URL is reachable and returns a successful
+// status. Check implements the discovery.Checker interface.
+func (srv *Service) Check(ctx context.Context) error {
+	req, err := http.NewRequest(http.MethodGet, srv.srcURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := srv.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("cannot download %q: %s", srv.srcURL, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cannot download %q: bad HTTP status code: %d", srv.srcURL, resp.StatusCode)
+	}
+	return nil
+}
+
 // Discover downloads the source URL provided at service creation time.
 //  registeredthe targets configuration.
 func (srv *Service) Discover(ctx context.Context) ([]discovery.StaticConfig, error) {
@@ -44,7 +76,7 @@ func (srv *Service) Discover(ctx context.Context) ([]discovery.StaticConfig, err
 	}
 
 	req = req.WithContext(ctx)
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := srv.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -66,5 +98,22 @@ func (srv *Service) Discover(ctx context.Context) ([]discovery.StaticConfig, err
 		// TODO: add metrics counting these errors.
 		return nil, err
 	}
+	if srv.Resolver != nil {
+		configs = srv.Resolver.Resolve(ctx, configs)
+	}
+	for i := range configs {
+		discovery.RecordOrigin(ctx, configs[i], map[string]string{"url": srv.srcURL})
+	}
+	srv.raw = data
 	return configs, nil
 }
+
+// Raw returns the document downloaded by the most recent successful call to
+// Discover when Passthrough is enabled and there is no Resolver. Otherwise, Raw
+// returns nil. Raw implements the discovery.RawSource interface.
+func (srv *Service) Raw() []byte {
+	if !srv.Passthrough || srv.Resolver != nil {
+		return nil
+	}
+	return srv.raw
+}
@@ -105,3 +105,73 @@ func TestSource_Discover(t *testing.T) {
 		})
 	}
 }
+
+func TestService_Check(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		badURL     string
+		wantErr    bool
+	}{
+		{
+			name:       "success",
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "failure-bad-http-status",
+			statusCode: http.StatusForbidden,
+			wantErr:    true,
+		},
+		{
+			name:    "failure-bad-url",
+			badURL:  "http://badurl:100",
+			wantErr: true,
+		},
+		{
+			name:    "failure-url-is-invalid",
+			badURL:  ":/this-is-an-invalid-url",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(tt.statusCode)
+				}),
+			)
+			defer ts.Close()
+			url := ts.URL
+			if tt.badURL != "" {
+				url = tt.badURL
+			}
+			err := NewService(url).Check(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Service.Check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestService_Raw(t *testing.T) {
+	content := `[{"targets": ["okay"], "extra": "field"}]`
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, content)
+		}),
+	)
+	defer ts.Close()
+
+	srv := NewService(ts.URL)
+	_, err := srv.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("Service.Discover() error = %v", err)
+	}
+	if srv.Raw() != nil {
+		t.Errorf("Service.Raw() = %q, want nil without passthrough", srv.Raw())
+	}
+	srv.Passthrough = true
+	if string(srv.Raw()) != content {
+		t.Errorf("Service.Raw() = %q, want %q", srv.Raw(), content)
+	}
+}
@@ -0,0 +1,214 @@
+// Package zookeeper publishes discovered targets as serverset members in
+// ZooKeeper, for legacy Finagle-style clients that cannot read Prometheus
+// file_sd_configs.
+//
+// Every target is an ephemeral, sequential znode named "member_" under the
+// serverset path, with data like:
+//
+//	{"serviceEndpoint":{"host":"10.0.0.1","port":9090},"additionalEndpoints":{},"status":"ALIVE"}
+//
+// Members are removed by ZooKeeper when the session of the Writer ends.
+package zookeeper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+
+	"github.com/m-lab/gcp-service-discovery/discovery"
+)
+
+// Scheme is the URL scheme of ZooKeeper outputs, e.g.
+//
+//	zk://zk1:2181,zk2:2181/services/gke?session_timeout=30s
+const Scheme = "zk"
+
+// DefaultSessionTimeout is the session timeout used when the output URL does
+// not set session_timeout.
+const DefaultSessionTimeout = 30 * time.Second
+
+// memberPrefix is the name prefix of serverset member znodes.
+const memberPrefix = "member_"
+
+// conn is the subset of *zk.Conn used by the Writer.
+type conn interface {
+	Children(path string) ([]string, *zk.Stat, error)
+	Create(path string, data []byte, flags int32, acl []zk.ACL) (string, error)
+	Delete(path string, version int32) error
+	Close()
+}
+
+// endpoint is the address of a serverset member.
+type endpoint struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+}
+
+// member is the data of a serverset member znode.
+type member struct {
+	ServiceEndpoint     endpoint            `json:"serviceEndpoint"`
+	AdditionalEndpoints map[string]endpoint `json:"additionalEndpoints"`
+	Status              string              `json:"status"`
+}
+
+// Writer publishes targets as members of a serverset. Writer implements the
+// discovery.Writer interface.
+type Writer struct {
+	conn    conn
+	servers []string
+	path    string
+
+	// members maps targets to the names of their member znodes.
+	members map[string]string
+}
+
+// New creates a Writer for the ensemble and serverset path of a URL with the
+// Scheme, e.g. zk://zk1:2181,zk2:2181/services/gke. New is a
+// discovery.WriterFactory.
+func New(u *url.URL) (discovery.Writer, error) {
+	if u.Host == "" || u.Path == "" || u.Path == "/" {
+		return nil, fmt.Errorf("zookeeper output must name servers and a path: %q", u.String())
+	}
+	timeout := DefaultSessionTimeout
+	if v := u.Query().Get("session_timeout"); v != "" {
+		var err error
+		timeout, err = time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid session_timeout: %s", err)
+		}
+	}
+	servers := strings.Split(u.Host, ",")
+	c, _, err := zk.Connect(servers, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return newWriter(c, servers, path.Clean(u.Path)), nil
+}
+
+func newWriter(c conn, servers []string, p string) *Writer {
+	return &Writer{conn: c, servers: servers, path: p, members: map[string]string{}}
+}
+
+// String returns the output URL of the Writer.
+func (w *Writer) String() string {
+	return Scheme + "://" + strings.Join(w.servers, ",") + w.path
+}
+
+// Write reconciles the serverset members with the targets in configs. Members
+// of removed targets are deleted, and members are created for new targets, or
+// for targets whose members were lost with an expired session.
+func (w *Writer) Write(ctx context.Context, configs []discovery.StaticConfig) error {
+	targets := map[string]*member{}
+	for _, config := range configs {
+		for _, target := range config.Targets {
+			m, err := newMember(target)
+			if err != nil {
+				return err
+			}
+			targets[target] = m
+		}
+	}
+	children, err := w.children()
+	if err != nil {
+		return err
+	}
+	for target, name := range w.members {
+		if targets[target] != nil && children[name] {
+			continue
+		}
+		if children[name] {
+			err = w.conn.Delete(path.Join(w.path, name), -1)
+			if err != nil && !errors.Is(err, zk.ErrNoNode) {
+				return fmt.Errorf("cannot delete member %s: %s", name, err)
+			}
+		}
+		delete(w.members, target)
+	}
+	// Create members in a stable order.
+	names := []string{}
+	for target := range targets {
+		if _, ok := w.members[target]; !ok {
+			names = append(names, target)
+		}
+	}
+	sort.Strings(names)
+	for _, target := range names {
+		data, err := json.Marshal(targets[target])
+		if err != nil {
+			return err
+		}
+		created, err := w.conn.Create(path.Join(w.path, memberPrefix), data,
+			zk.FlagEphemeral|zk.FlagSequence, zk.WorldACL(zk.PermAll))
+		if err != nil {
+			return fmt.Errorf("cannot create member for %s: %s", target, err)
+		}
+		w.members[target] = path.Base(created)
+	}
+	return nil
+}
+
+// Close ends the ZooKeeper session, which removes all members.
+func (w *Writer) Close() {
+	w.conn.Close()
+}
+
+// children returns the names of the children of the serverset path, creating
+// the path if it does not exist.
+func (w *Writer) children() (map[string]bool, error) {
+	names, _, err := w.conn.Children(w.path)
+	if errors.Is(err, zk.ErrNoNode) {
+		err = w.createPath()
+		if err != nil {
+			return nil, err
+		}
+		names, _, err = w.conn.Children(w.path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot list members of %s: %s", w.path, err)
+	}
+	children := map[string]bool{}
+	for _, name := range names {
+		children[name] = true
+	}
+	return children, nil
+}
+
+// createPath creates the serverset path and its parents as persistent znodes.
+func (w *Writer) createPath() error {
+	p := ""
+	for _, part := range strings.Split(strings.Trim(w.path, "/"), "/") {
+		p += "/" + part
+		_, err := w.conn.Create(p, nil, 0, zk.WorldACL(zk.PermAll))
+		if err != nil && !errors.Is(err, zk.ErrNodeExists) {
+			return fmt.Errorf("cannot create %s: %s", p, err)
+		}
+	}
+	return nil
+}
+
+// newMember returns the serverset member for a host:port target.
+func newMember(target string) (*member, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, fmt.Errorf("serverset target %q must be host:port: %s", target, err)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("serverset target %q has invalid port: %s", target, err)
+	}
+	return &member{
+		ServiceEndpoint:     endpoint{Host: host, Port: p},
+		AdditionalEndpoints: map[string]endpoint{},
+		Status:              "ALIVE",
+	}, nil
+}
@@ -0,0 +1,173 @@
+package zookeeper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-zookeeper/zk"
+
+	"github.com/m-lab/gcp-service-discovery/discovery"
+)
+
+// fakeConn stores znodes in memory.
+type fakeConn struct {
+	nodes map[string][]byte
+	seq   int
+}
+
+func (f *fakeConn) Children(p string) ([]string, *zk.Stat, error) {
+	if _, ok := f.nodes[p]; !ok {
+		return nil, nil, zk.ErrNoNode
+	}
+	names := []string{}
+	for n := range f.nodes {
+		if path.Dir(n) == p && n != p {
+			names = append(names, path.Base(n))
+		}
+	}
+	sort.Strings(names)
+	return names, &zk.Stat{}, nil
+}
+
+func (f *fakeConn) Create(p string, data []byte, flags int32, acl []zk.ACL) (string, error) {
+	if flags&zk.FlagSequence != 0 {
+		p = fmt.Sprintf("%s%010d", p, f.seq)
+		f.seq++
+	}
+	if _, ok := f.nodes[p]; ok {
+		return "", zk.ErrNodeExists
+	}
+	f.nodes[p] = data
+	return p, nil
+}
+
+func (f *fakeConn) Delete(p string, version int32) error {
+	if _, ok := f.nodes[p]; !ok {
+		return zk.ErrNoNode
+	}
+	delete(f.nodes, p)
+	return nil
+}
+
+func (f *fakeConn) Close() {}
+
+// hosts returns the sorted serverset member endpoints.
+func (f *fakeConn) hosts(t *testing.T, p string) []string {
+	hosts := []string{}
+	for n, data := range f.nodes {
+		if path.Dir(n) != p || !strings.HasPrefix(path.Base(n), memberPrefix) {
+			continue
+		}
+		m := member{}
+		err := json.Unmarshal(data, &m)
+		if err != nil {
+			t.Fatalf("json.Unmarshal() error = %v", err)
+		}
+		hosts = append(hosts, fmt.Sprintf("%s:%d", m.ServiceEndpoint.Host, m.ServiceEndpoint.Port))
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+func TestWriter_Write(t *testing.T) {
+	c := &fakeConn{nodes: map[string][]byte{}}
+	w := newWriter(c, []string{"zk1:2181"}, "/services/gke")
+	ctx := context.Background()
+	passes := []struct {
+		name    string
+		targets []string
+		lost    bool
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:    "create",
+			targets: []string{"10.0.0.1:9090", "10.0.0.2:9090"},
+			want:    []string{"10.0.0.1:9090", "10.0.0.2:9090"},
+		},
+		{
+			name:    "update",
+			targets: []string{"10.0.0.2:9090", "10.0.0.3:9090"},
+			want:    []string{"10.0.0.2:9090", "10.0.0.3:9090"},
+		},
+		{
+			name:    "recreate-after-session-expired",
+			targets: []string{"10.0.0.2:9090", "10.0.0.3:9090"},
+			lost:    true,
+			want:    []string{"10.0.0.2:9090", "10.0.0.3:9090"},
+		},
+		{
+			name:    "failure-no-port",
+			targets: []string{"10.0.0.4"},
+			want:    []string{"10.0.0.2:9090", "10.0.0.3:9090"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range passes {
+		if tt.lost {
+			for n := range c.nodes {
+				if strings.HasPrefix(path.Base(n), memberPrefix) {
+					delete(c.nodes, n)
+				}
+			}
+		}
+		err := w.Write(ctx, []discovery.StaticConfig{{Targets: tt.targets}})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: Writer.Write() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+		got := c.hosts(t, "/services/gke")
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s: Writer.Write() members = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "success",
+			output: "zk://127.0.0.1:2181,127.0.0.2:2181/services/gke/?session_timeout=10s",
+			want:   "zk://127.0.0.1:2181,127.0.0.2:2181/services/gke",
+		},
+		{
+			name:    "failure-no-path",
+			output:  "zk://zk1:2181",
+			wantErr: true,
+		},
+		{
+			name:    "failure-bad-timeout",
+			output:  "zk://zk1:2181/services?session_timeout=ten",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.output)
+			if err != nil {
+				t.Fatalf("url.Parse() error = %v", err)
+			}
+			w, err := New(u)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer w.(*Writer).Close()
+			if w.String() != tt.want {
+				t.Errorf("New() = %q, want %q", w.String(), tt.want)
+			}
+		})
+	}
+}